@@ -0,0 +1,1325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi"
+	"github.com/kinokochat/txwifi/iotwifi/process"
+)
+
+// cliTimeout bounds a CLI request, connect waits for association and DHCP.
+const cliTimeout = 2 * time.Minute
+
+const cliUsage = `usage: wifi-server [command]
+
+Without a command the daemon runs. The commands talk to the running
+daemon over its unix socket (IOTWIFI_SOCKET, ` + iotwifi.DefaultSocket + ` by default):
+
+  status                              station status
+  scan [--fresh] [--passive] [--dfs]  networks in range; the options but --fresh
+       [--freq MHZ] [--duration SEC]  tune a scan made now, --freq takes a list
+  connect --ssid SSID [--psk PSK]     connect the station
+          [--hidden] [--key-mgmt MODE] [--band 2.4|5]
+          [--attempts N] [--dry-run]  retry N times, or print the wpa_supplicant requests instead
+  forget --ssid SSID                  remove a saved network
+  networks [--collect]                networks configured in wpa_supplicant, or remove
+                                      the duplicate and disabled ones without a profile
+  profiles                            saved networks, without their secrets
+  profiles export [--passphrase P]    the saved networks as a bundle for another
+                  [--out FILE]        device, encrypted with the passphrase
+  profiles import --file FILE         save the networks of a bundle, and drop those
+                  [--passphrase P]    it does not have with --replace
+                  [--replace]
+  ap [up|down]                        ap status, or enable or disable the ap
+  ap window [open]                    when the setup ap closes, or open it again
+  ap devices                          devices on the ap, their vendor and when last seen
+  router [enable|disable]             router status, or share the uplink or stop
+  reload                              reload the config
+  identity                            device id and default ap ssid and passphrase
+  state                               provisioning state and its last transitions
+  history [--type TYPE] [--limit N]   connects, disconnects and ap toggles, newest first
+  audit [--action ACTION] [--limit N] provisioning actions and who made them, newest first
+  operations [ID] [--limit N]         api requests and the commands they ran, or those of one
+  queue                               the connect, scan or forget running on each radio, then those waiting
+  health [--ready]                    check the daemons and interfaces, exits 1 if unhealthy
+  conflicts [--fix]                   other network managers claiming the interfaces
+  processes                           hostapd, dnsmasq and wpa_supplicant, their state and uptime
+  preflight                           the capabilities, devices and mounts txwifi needs
+  capabilities                        what the radios support and what of the config they do not
+  diagnostics [--out FILE]            bundle the wifi state and recent logs for a support ticket
+  watchdog                            station link quality and the roams and reconnects
+  speedtest [--url URL|--iperf3 HOST] measure the throughput of the station's network
+            [--upload] [--duration N]
+  survey [--scans N] [--band BAND]    how busy each channel is and the one recommended for the ap
+         [--apply]                    and move the ap there
+  watchlist                           ssids the scans watch for and whether they are in range
+  watchlist add --ssid SSID           watch for an ssid, and connect to it with
+            [--auto-connect] [--min-rssi DBM]  its profile when it appears
+  watchlist remove --ssid SSID        stop watching an ssid
+  rfkill [block|unblock] [--iface]    the rfkill blocks of the wifi radios
+  p2p [find|group|remove|connect]     wi-fi direct peers, or find them, start or
+                                      end a group, or pair with --peer ADDR
+  qr                                  print the qr code for joining the ap
+
+status, scan, connect and forget take --iface IFACE to address another
+station radio.
+`
+
+// cliCommands are the commands run by runCLI.
+var cliCommands = map[string]func(c *cliClient, args []string) error{
+	"status":       cliStatus,
+	"scan":         cliScan,
+	"connect":      cliConnect,
+	"forget":       cliForget,
+	"networks":     cliNetworks,
+	"profiles":     cliProfiles,
+	"ap":           cliAP,
+	"router":       cliRouter,
+	"reload":       cliReload,
+	"identity":     cliIdentity,
+	"state":        cliState,
+	"history":      cliHistory,
+	"audit":        cliAudit,
+	"operations":   cliOperations,
+	"queue":        cliQueue,
+	"health":       cliHealth,
+	"conflicts":    cliConflicts,
+	"processes":    cliProcesses,
+	"preflight":    cliPreflight,
+	"rfkill":       cliRfkill,
+	"diagnostics":  cliDiagnostics,
+	"capabilities": cliCapabilities,
+	"watchdog":     cliWatchdog,
+	"speedtest":    cliSpeedTest,
+	"survey":       cliSurvey,
+	"watchlist":    cliWatchlist,
+	"p2p":          cliP2P,
+}
+
+// runCLI runs the command in args against the daemon listening on socket
+// and returns the exit code.
+func runCLI(socket string, args []string) int {
+	run, ok := cliCommands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		}
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	if err := run(newCLIClient(socket), args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, args[0]+":", err)
+		return 1
+	}
+
+	return 0
+}
+
+// cliClient calls the API over a unix socket.
+type cliClient struct {
+	client *http.Client
+}
+
+func newCLIClient(socket string) *cliClient {
+	dialer := &net.Dialer{}
+
+	return &cliClient{
+		client: &http.Client{
+			Timeout: cliTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// call GETs path, or POSTs body as json if it is not nil, and decodes the
+// returned payload into payload. A FAIL status is returned as an error,
+// after the payload is decoded.
+func (c *cliClient) call(path string, body interface{}, payload interface{}) (string, error) {
+	method := http.MethodGet
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		method = http.MethodPost
+		reqBody = bytes.NewReader(data)
+	}
+
+	// the host is ignored, every request goes to the socket
+	req, err := http.NewRequest(method, "http://txwifi"+path, reqBody)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("is txwifi running? %s", err)
+	}
+	defer resp.Body.Close()
+
+	ret := struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Payload json.RawMessage `json:"payload"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if payload != nil && len(ret.Payload) > 0 {
+		if err := json.Unmarshal(ret.Payload, payload); err != nil {
+			return "", err
+		}
+	}
+
+	if ret.Status != "OK" {
+		return "", fmt.Errorf("%s", ret.Message)
+	}
+
+	return ret.Message, nil
+}
+
+// cliStatus prints the station status.
+func cliStatus(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	iface := flags.String("iface", "", "station radio, the station interface by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	status := map[string]interface{}{}
+	if _, err := c.call(ifacePath(*iface, "/status"), nil, &status); err != nil {
+		return err
+	}
+
+	printMap(status)
+
+	return nil
+}
+
+// cliScan prints the networks in range, strongest first.
+func cliScan(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fresh := flags.Bool("fresh", false, "scan now instead of returning the last results")
+	iface := flags.String("iface", "", "station radio, always scans now")
+	passive := flags.Bool("passive", false, "listen for beacons instead of probing, scans now")
+	freqs := flags.String("freq", "", "comma separated MHz to scan, scans now")
+	dfs := flags.Bool("dfs", false, "scan the 5GHz DFS (radar) channels as well, scans now")
+	duration := flags.Int("duration", 0, "seconds to wait for the results, 15 by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *fresh {
+		query.Set("fresh", "true")
+	}
+	if *passive {
+		query.Set("passive", "true")
+	}
+	if *freqs != "" {
+		query.Set("freq", *freqs)
+	}
+	if *dfs {
+		query.Set("dfs", "true")
+	}
+	if *duration > 0 {
+		query.Set("duration", fmt.Sprint(*duration))
+	}
+
+	path := "/scan"
+	if *iface != "" {
+		path = ifacePath(*iface, "/scan")
+		query.Del("fresh")
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var results iotwifi.ScanResults
+	if _, err := c.call(path, nil, &results); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SSID\tSIGNAL\tQUALITY\tCHANNEL\tBAND\tFLAGS")
+	for _, network := range results.Networks {
+		ssid := network.Ssid
+		if ssid == "" {
+			ssid = "(hidden)"
+		}
+		fmt.Fprintf(tw, "%s\t%d dBm\t%d%%\t%d\t%s\t%s\n", ssid, network.SignalLevel, network.Quality, network.Channel, network.Band, network.Flags)
+	}
+
+	return tw.Flush()
+}
+
+// cliConnect connects the station and prints the connection.
+func cliConnect(c *cliClient, args []string) error {
+	creds := iotwifi.WpaCredentials{}
+
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	flags.StringVar(&creds.Ssid, "ssid", "", "network to connect to")
+	flags.StringVar(&creds.Psk, "psk", "", "passphrase, empty for open networks")
+	flags.StringVar(&creds.KeyMgmt, "key-mgmt", "", "WPA-PSK (default), SAE, \"WPA-PSK SAE\" or NONE")
+	flags.BoolVar(&creds.Hidden, "hidden", false, "the ssid is not broadcast")
+	flags.StringVar(&creds.PreferredBand, "band", "", "2.4, 5 or any, the band to connect on when the ssid is on both")
+	iface := flags.String("iface", "", "station radio, the station interface by default")
+	dryRun := flags.Bool("dry-run", false, "print the wpa_supplicant requests a connect would make, without making them")
+	attempts := flags.Int("attempts", 0, "attempts on a timeout or a network not found, connect_retry by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if creds.Ssid == "" {
+		return fmt.Errorf("--ssid is required")
+	}
+	if *attempts > 0 {
+		creds.Retry = &iotwifi.ConnectRetryCfg{MaxAttempts: *attempts}
+	}
+
+	if *dryRun {
+		var plan iotwifi.Plan
+		if _, err := c.call(ifacePath(*iface, "/connect")+"?dry_run=true", creds, &plan); err != nil {
+			return err
+		}
+
+		printPlan(plan)
+		return nil
+	}
+
+	var connection iotwifi.WpaConnection
+	_, err := c.call(ifacePath(*iface, "/connect"), creds, &connection)
+
+	// failed connections still say why
+	printMap(map[string]interface{}{
+		"ssid":               connection.Ssid,
+		"state":              connection.State,
+		"ip":                 connection.Ip,
+		"gateway":            connection.Gateway,
+		"message":            connection.Message,
+		"reason":             string(connection.Reason),
+		"connectivity":       connection.Connectivity,
+		"captive_portal_url": connection.CaptivePortalUrl,
+		"attempts":           len(connection.Attempts),
+	})
+
+	return err
+}
+
+// printPlan prints the files and commands of a dry run, then its notes.
+func printPlan(plan iotwifi.Plan) {
+	for _, file := range plan.Files {
+		fmt.Printf("# %s (%s)\n%s\n", file.Path, file.Mode, file.Content)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, command := range plan.Commands {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", command.Target, command.Iface, command.Command)
+	}
+	tw.Flush()
+
+	for _, note := range plan.Notes {
+		fmt.Printf("then %s\n", note)
+	}
+}
+
+// cliForget removes a saved network.
+func cliForget(c *cliClient, args []string) error {
+	creds := iotwifi.WpaCredentials{}
+
+	flags := flag.NewFlagSet("forget", flag.ContinueOnError)
+	flags.StringVar(&creds.Ssid, "ssid", "", "network to forget")
+	iface := flags.String("iface", "", "station radio, the station interface by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if creds.Ssid == "" {
+		return fmt.Errorf("--ssid is required")
+	}
+
+	message, err := c.call(ifacePath(*iface, "/forget"), creds, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(message, creds.Ssid)
+
+	return nil
+}
+
+// cliNetworks prints the networks configured in wpa_supplicant, or those
+// removed with --collect.
+func cliNetworks(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("networks", flag.ContinueOnError)
+	collect := flags.Bool("collect", false, "remove all but one network of each ssid and the disabled ones without a profile")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var networks []iotwifi.WpaConfiguredNetwork
+	var err error
+	if *collect {
+		_, err = c.call("/networks/collect", struct{}{}, &networks)
+	} else {
+		_, err = c.call("/networks", nil, &networks)
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSSID\tBSSID\tFLAGS")
+	for _, network := range networks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", network.Id, network.Ssid, network.Bssid, network.Flags)
+	}
+	tw.Flush()
+
+	return nil
+}
+
+// cliAP prints the AP status, after bringing the AP up or down if asked.
+func cliAP(c *cliClient, args []string) error {
+	path := "/ap"
+	var body interface{}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "up", "down":
+			path += "/" + args[0]
+			body = struct{}{}
+		case "window":
+			return cliAPWindow(c, args[1:])
+		case "devices":
+			return cliAPDevices(c)
+		default:
+			return fmt.Errorf("unknown ap command %q, want up, down, window or devices", args[0])
+		}
+	}
+
+	status := map[string]interface{}{}
+	if _, err := c.call(path, body, &status); err != nil {
+		return err
+	}
+
+	printMap(status)
+
+	return nil
+}
+
+// cliAPDevices prints the devices on the AP.
+func cliAPDevices(c *cliClient) error {
+	var devices []iotwifi.APDevice
+	if _, err := c.call("/ap/devices", nil, &devices); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAC\tIP\tHOSTNAME\tVENDOR\tASSOCIATED\tLAST SEEN")
+	for _, d := range devices {
+		vendor := d.Vendor
+		if vendor == "" && d.RandomMac {
+			vendor = "(random)"
+		}
+		lastSeen := ""
+		if d.LastSeen != nil {
+			lastSeen = time.Since(*d.LastSeen).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\n", d.Mac, d.Ip, d.Hostname, vendor, d.Associated, lastSeen)
+	}
+
+	return tw.Flush()
+}
+
+// cliAPWindow prints when the setup AP closes, after opening it again if
+// asked.
+func cliAPWindow(c *cliClient, args []string) error {
+	path := "/ap/window"
+	var body interface{}
+
+	if len(args) > 0 {
+		if args[0] != "open" {
+			return fmt.Errorf("unknown ap window command %q, want open", args[0])
+		}
+		path += "/open"
+		body = struct{}{}
+	}
+
+	var status iotwifi.APWindowStatus
+	if _, err := c.call(path, body, &status); err != nil {
+		return err
+	}
+
+	closes := "never"
+	if status.Closes != nil {
+		closes = status.Closes.Format(time.RFC3339)
+	}
+	printMap(map[string]interface{}{
+		"enabled": status.Enabled,
+		"open":    status.Open,
+		"closes":  closes,
+		"reason":  status.Reason,
+	})
+
+	return nil
+}
+
+// cliRouter prints the router status, after enabling or disabling
+// routing if asked.
+func cliRouter(c *cliClient, args []string) error {
+	path := "/router"
+	var body interface{}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "enable", "disable":
+			path += "/" + args[0]
+			body = struct{}{}
+		default:
+			return fmt.Errorf("unknown router command %q, want enable or disable", args[0])
+		}
+	}
+
+	var status iotwifi.RouterStatus
+	if _, err := c.call(path, body, &status); err != nil {
+		return err
+	}
+
+	printMap(map[string]interface{}{
+		"enabled":    status.Enabled,
+		"forwarding": status.Forwarding,
+		"subnet":     status.Subnet,
+		"uplink":     status.Uplink,
+	})
+	for _, rule := range status.Rules {
+		fmt.Println(rule)
+	}
+
+	return nil
+}
+
+// cliReload reloads the config and prints what changed.
+func cliReload(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var reload iotwifi.CfgReload
+	if _, err := c.call("/reload", struct{}{}, &reload); err != nil {
+		return err
+	}
+
+	printMap(map[string]interface{}{
+		"changed":          strings.Join(reload.Changed, ","),
+		"restart_required": strings.Join(reload.Restart, ","),
+	})
+
+	return nil
+}
+
+// cliIdentity prints the device identity.
+func cliIdentity(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("identity", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var identity iotwifi.Identity
+	if _, err := c.call("/identity", nil, &identity); err != nil {
+		return err
+	}
+
+	printMap(map[string]interface{}{
+		"device_id":      identity.DeviceId,
+		"ssid":           identity.Ssid,
+		"wpa_passphrase": identity.WpaPassphrase,
+		"created":        identity.Created.Format(time.RFC3339),
+	})
+
+	return nil
+}
+
+// cliHealth prints the health checks, failing if any failed.
+func cliHealth(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("health", flag.ContinueOnError)
+	ready := flags.Bool("ready", false, "also check the interfaces, as /readyz does")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path := "/healthz"
+	if *ready {
+		path = "/readyz"
+	}
+
+	var health iotwifi.Health
+	_, err := c.call(path, nil, &health)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tKIND\tIFACE\tOK\tERROR")
+	for _, check := range health.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", check.Name, check.Kind, check.Iface, check.Ok, check.Error)
+	}
+	tw.Flush()
+
+	return err
+}
+
+// cliConflicts prints the other network managers claiming the
+// interfaces, after fixing them with --fix.
+func cliConflicts(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("conflicts", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "write the configuration that makes the managers leave the interfaces alone")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var conflicts []iotwifi.Conflict
+	var err error
+	if *fix {
+		_, err = c.call("/conflicts/fix", struct{}{}, &conflicts)
+	} else {
+		_, err = c.call("/conflicts", nil, &conflicts)
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MANAGER\tIFACE\tFIXED\tHINT")
+	for _, conflict := range conflicts {
+		hint := conflict.Hint
+		if conflict.Fixed {
+			hint = "wrote " + conflict.File
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", conflict.Manager, conflict.Iface, conflict.Fixed, hint)
+	}
+	tw.Flush()
+
+	return nil
+}
+
+// cliProcesses prints the child processes, their state and uptime.
+func cliProcesses(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("processes", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var processes []process.Status
+	if _, err := c.call("/processes", nil, &processes); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tPID\tUPTIME\tRESTARTS\tPOLICY\tLAST EXIT")
+	for _, p := range processes {
+		uptime := time.Duration(p.UptimeSec) * time.Second
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n", p.Name, p.State, p.Pid, uptime, p.Restarts, p.Policy, p.LastExit)
+	}
+
+	return tw.Flush()
+}
+
+// cliRfkill prints the rfkill blocks of the wifi radios, after blocking
+// or unblocking them.
+func cliRfkill(c *cliClient, args []string) error {
+	path := "/rfkill"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "block", "unblock":
+			path += "/" + args[0]
+		default:
+			return fmt.Errorf("unknown rfkill command %q, want block or unblock", args[0])
+		}
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("rfkill", flag.ContinueOnError)
+	iface := flags.String("iface", "", "only the radio of this interface")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var body interface{}
+	if path != "/rfkill" {
+		body = iotwifi.RadioBlock{Iface: *iface}
+	}
+
+	var blocks []iotwifi.RadioBlock
+	if _, err := c.call(path, body, &blocks); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IFACE\tBLOCKED\tSOFT\tHARD\tSWITCHES")
+	for _, block := range blocks {
+		if *iface != "" && block.Iface != *iface {
+			continue
+		}
+
+		names := []string{}
+		for _, s := range block.Switches {
+			names = append(names, s.Name)
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%t\t%t\t%s\n", block.Iface, block.Blocked, block.Soft, block.Hard, strings.Join(names, ","))
+	}
+
+	return tw.Flush()
+}
+
+// cliP2P prints the Wi-Fi Direct peers, after looking for them, or
+// starts or ends a group, or pairs with a peer.
+func cliP2P(c *cliClient, args []string) error {
+	command := "peers"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("p2p", flag.ContinueOnError)
+	timeout := flags.Int("timeout", 0, "find for this many seconds, 10 by default")
+	persistent := flags.Bool("persistent", false, "keep the group for reinvoking it")
+	iface := flags.String("iface", "", "the group to remove")
+	peer := flags.String("peer", "", "P2P device address of the peer to pair with")
+	method := flags.String("method", iotwifi.P2PMethodPBC, "pbc, display or keypad")
+	pin := flags.String("pin", "", "the pin shown by the peer, for keypad")
+	join := flags.Bool("join", false, "join the group the peer owns")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var peers []iotwifi.P2PPeer
+	switch command {
+	case "peers":
+		if _, err := c.call("/p2p/peers", nil, &peers); err != nil {
+			return err
+		}
+	case "find":
+		if _, err := c.call("/p2p/find", iotwifi.P2PFindRequest{Timeout: *timeout}, &peers); err != nil {
+			return err
+		}
+	case "group":
+		var group iotwifi.P2PGroup
+		if _, err := c.call("/p2p/group", iotwifi.P2PGroupRequest{Persistent: *persistent}, &group); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s ssid %q passphrase %q on %d MHz\n", group.Iface, group.Role, group.Ssid, group.Passphrase, group.Frequency)
+		return nil
+	case "remove":
+		_, err := c.call("/p2p/group/remove", iotwifi.P2PGroupRequest{Iface: *iface}, nil)
+		return err
+	case "connect":
+		var wps iotwifi.WPSRequest
+		req := iotwifi.P2PConnectRequest{Peer: *peer, Method: *method, Pin: *pin, Join: *join}
+		msg, err := c.call("/p2p/connect", req, &wps)
+		if err != nil {
+			return err
+		}
+		fmt.Println(msg)
+		if *method == iotwifi.P2PMethodDisplay {
+			fmt.Println("pin:", wps.Pin)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown p2p command %q, want find, peers, group, remove or connect", command)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tNAME\tTYPE\tSIGNAL\tGROUP OWNER")
+	for _, p := range peers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%t\n", p.Address, p.DeviceName, p.DeviceType, p.Level, p.GroupOwner)
+	}
+
+	return tw.Flush()
+}
+
+// cliPreflight prints the checks of the container txwifi runs in.
+func cliPreflight(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report iotwifi.PreflightReport
+	if _, err := c.call("/preflight", nil, &report); err != nil {
+		return err
+	}
+
+	container := report.Container
+	if container == "" {
+		container = "none"
+	}
+	fmt.Printf("container: %s\n", container)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tOK\tERROR\tHINT")
+	for _, check := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\n", check.Name, check.Ok, check.Error, check.Hint)
+	}
+
+	return tw.Flush()
+}
+
+// cliWatchdog prints the link quality the watchdog sees and what it did
+// about it.
+func cliWatchdog(c *cliClient, args []string) error {
+	var status iotwifi.WatchdogStatus
+	if _, err := c.call("/watchdog", nil, &status); err != nil {
+		return err
+	}
+
+	last := ""
+	if status.LastTime != nil {
+		last = status.LastAction + " at " + status.LastTime.Format(time.RFC3339)
+	}
+	printMap(map[string]interface{}{
+		"enabled":     status.Enabled,
+		"state":       status.State,
+		"bssid":       status.Bssid,
+		"rssi":        status.Rssi,
+		"loss":        fmt.Sprintf("%d%%", status.Loss),
+		"poor_checks": status.PoorChecks,
+		"roams":       status.Roams,
+		"reconnects":  status.Reconnects,
+		"last_action": last,
+	})
+
+	return nil
+}
+
+// cliState prints the provisioning state and its last transitions.
+func cliState(c *cliClient, args []string) error {
+	var status iotwifi.MachineStatus
+	if _, err := c.call("/state", nil, &status); err != nil {
+		return err
+	}
+
+	deadline := ""
+	if status.Deadline != nil {
+		deadline = status.Deadline.Format(time.RFC3339)
+	}
+	printMap(map[string]interface{}{
+		"state":    status.State,
+		"since":    status.Since.Format(time.RFC3339),
+		"reason":   status.Reason,
+		"deadline": deadline,
+	})
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tFROM\tTO\tREASON")
+	for _, t := range status.Transitions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.Time.Format(time.RFC3339), t.From, t.To, t.Reason)
+	}
+
+	return tw.Flush()
+}
+
+// cliSpeedTest runs a speed test and prints the throughput.
+func cliSpeedTest(c *cliClient, args []string) error {
+	req := iotwifi.SpeedTestRequest{}
+
+	flags := flag.NewFlagSet("speedtest", flag.ContinueOnError)
+	flags.StringVar(&req.Url, "url", "", "download this file, speed_test.url by default")
+	flags.StringVar(&req.Server, "iperf3", "", "run iperf3 against this host[:port] instead")
+	flags.BoolVar(&req.Upload, "upload", false, "measure sending with iperf3")
+	flags.IntVar(&req.DurationSec, "duration", 0, "seconds, 10 by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if req.Server != "" {
+		req.Method = iotwifi.SpeedTestIperf3
+	} else if req.Url != "" {
+		req.Method = iotwifi.SpeedTestDownload
+	}
+
+	var result iotwifi.SpeedTestResult
+	if _, err := c.call("/speedtest", req, &result); err != nil {
+		return err
+	}
+
+	printMap(map[string]interface{}{
+		"method":      result.Method,
+		"target":      result.Target,
+		"direction":   result.Direction,
+		"mbps":        fmt.Sprintf("%.1f", result.Mbps),
+		"bytes":       result.Bytes,
+		"duration":    result.Duration.Round(time.Millisecond).String(),
+		"retransmits": result.Retransmits,
+	})
+
+	return nil
+}
+
+// cliSurvey runs a site survey and prints the channels.
+func cliSurvey(c *cliClient, args []string) error {
+	req := iotwifi.SurveyRequest{}
+
+	flags := flag.NewFlagSet("survey", flag.ContinueOnError)
+	flags.IntVar(&req.Scans, "scans", 0, "scans to aggregate, survey.scans by default")
+	flags.StringVar(&req.Band, "band", "", "2.4GHz or 5GHz, the ap's band by default")
+	flags.BoolVar(&req.Apply, "apply", false, "move the ap to the recommended channel")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report iotwifi.SurveyReport
+	if _, err := c.call("/survey", req, &report); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BAND\tCHANNEL\tAPS\tOVERLAPPING\tRSSI MAX\tSCORE")
+	for _, u := range report.Channels {
+		mark := ""
+		switch {
+		case u.Channel == report.Recommended && u.Band == report.Band:
+			mark = "recommended"
+		case u.Channel == report.APChannel && u.Band == report.Band:
+			mark = "ap"
+		case !u.Candidate:
+			mark = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.2f\t%s\n", u.Band, u.Channel, u.Aps, u.Overlapping, u.RssiMax, u.Score, mark)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if report.Applied {
+		fmt.Printf("ap moved to channel %d\n", report.Recommended)
+	}
+
+	return nil
+}
+
+// cliWatchlist prints the watched SSIDs, or adds or removes one.
+func cliWatchlist(c *cliClient, args []string) error {
+	path := "/watchlist"
+	var body interface{}
+
+	if len(args) > 0 {
+		entry := iotwifi.WatchEntry{}
+
+		flags := flag.NewFlagSet("watchlist "+args[0], flag.ContinueOnError)
+		flags.StringVar(&entry.Ssid, "ssid", "", "network name")
+		switch args[0] {
+		case "add":
+			flags.BoolVar(&entry.AutoConnect, "auto-connect", false, "connect with its profile when it appears")
+			flags.IntVar(&entry.MinRssi, "min-rssi", 0, "dBm, a weaker network is not in range")
+		case "remove":
+			path += "/delete"
+		default:
+			return fmt.Errorf("unknown watchlist command %q, want add or remove", args[0])
+		}
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if entry.Ssid == "" {
+			return fmt.Errorf("--ssid is required")
+		}
+		body = entry
+	}
+
+	var statuses []iotwifi.WatchStatus
+	if _, err := c.call(path, body, &statuses); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SSID\tSOURCE\tAUTO CONNECT\tIN RANGE\tRSSI\tLAST SEEN\tERROR")
+	for _, s := range statuses {
+		rssi, lastSeen := "", ""
+		if s.InRange {
+			rssi = fmt.Sprint(s.Rssi)
+		}
+		if s.LastSeen != nil {
+			lastSeen = time.Since(*s.LastSeen).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%s\t%s\t%s\n", s.Ssid, s.Source, s.AutoConnect, s.InRange, rssi, lastSeen, s.LastError)
+	}
+
+	return tw.Flush()
+}
+
+// cliCapabilities prints what the radios support and the problems with
+// the config.
+func cliCapabilities(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("capabilities", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report iotwifi.CapabilityReport
+	if _, err := c.call("/capabilities", nil, &report); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHY\tIFACES\tAP+STA\tCHANNELS\tMAX STATIONS\tBANDS")
+	for _, phy := range report.Radios {
+		bands := []string{}
+		for _, band := range phy.Bands {
+			standards := []string{}
+			if band.HT {
+				standards = append(standards, "n")
+			}
+			if band.VHT {
+				standards = append(standards, "ac")
+			}
+			if band.HE {
+				standards = append(standards, "ax")
+			}
+			bands = append(bands, fmt.Sprintf("%s (%d channels, %s)", band.Band, len(band.Channels), strings.Join(standards, "/")))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%d\t%d\t%s\n", phy.Phy, strings.Join(phy.Ifaces, ","), phy.APSTA, phy.APSTAChannels, phy.MaxAPStations, strings.Join(bands, ", "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println("problem:", problem.Error())
+	}
+
+	return nil
+}
+
+// cliDiagnostics writes the diagnostics bundle as JSON.
+func cliDiagnostics(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("diagnostics", flag.ContinueOnError)
+	out := flags.String("out", "", "write the bundle to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var diag iotwifi.Diagnostics
+	if _, err := c.call("/diagnostics", nil, &diag); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(diag, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", *out)
+
+	return nil
+}
+
+// cliProfiles prints the saved networks, or exports or imports them.
+func cliProfiles(c *cliClient, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return cliExportProfiles(c, args[1:])
+		case "import":
+			return cliImportProfiles(c, args[1:])
+		default:
+			return fmt.Errorf("unknown profiles command %q, want export or import", args[0])
+		}
+	}
+
+	var profiles []iotwifi.Profile
+	if _, err := c.call("/profiles", nil, &profiles); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SSID\tPRIORITY\tKEY MGMT\tHIDDEN")
+	for _, p := range profiles {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%t\n", p.Ssid, p.Priority, p.KeyMgmt, p.Hidden)
+	}
+
+	return tw.Flush()
+}
+
+// cliExportProfiles writes the saved networks as a bundle.
+func cliExportProfiles(c *cliClient, args []string) error {
+	req := iotwifi.ProfileExport{}
+
+	flags := flag.NewFlagSet("profiles export", flag.ContinueOnError)
+	flags.StringVar(&req.Passphrase, "passphrase", "", "encrypt the bundle, it holds the secrets in plain otherwise, which only the API socket allows")
+	out := flags.String("out", "", "write the bundle to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var bundle iotwifi.ProfileBundle
+	if _, err := c.call("/profiles/export", req, &bundle); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d profiles to %s\n", len(bundle.Ssids), *out)
+
+	return nil
+}
+
+// cliImportProfiles saves the networks of a bundle.
+func cliImportProfiles(c *cliClient, args []string) error {
+	req := iotwifi.ProfileImport{}
+
+	flags := flag.NewFlagSet("profiles import", flag.ContinueOnError)
+	file := flags.String("file", "", "the bundle, - for standard input")
+	flags.StringVar(&req.Passphrase, "passphrase", "", "of an encrypted bundle")
+	flags.BoolVar(&req.Replace, "replace", false, "drop the saved networks the bundle does not have")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("--file is required")
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &req.Bundle); err != nil {
+		return fmt.Errorf("%s is not a profile bundle: %s", *file, err)
+	}
+
+	var result iotwifi.ProfileImportResult
+	if _, err := c.call("/profiles/import", req, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %s\n", strings.Join(result.Imported, ", "))
+	if len(result.Removed) > 0 {
+		fmt.Printf("removed %s\n", strings.Join(result.Removed, ", "))
+	}
+
+	return nil
+}
+
+// cliHistory prints the last good connection and the history.
+func cliHistory(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	entryType := flags.String("type", "", "only entries of this type: connect, associated, disconnected, ap-up, ap-down, bootstrap or started")
+	limit := flags.Int("limit", 20, "at most this many entries, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(*limit))
+	if *entryType != "" {
+		query.Set("type", *entryType)
+	}
+
+	var state iotwifi.NetworkState
+	if _, err := c.call("/history?"+query.Encode(), nil, &state); err != nil {
+		return err
+	}
+
+	if last := state.LastConnection; last != nil {
+		fmt.Printf("last connection: %s %s %s\n", last.Ssid, last.Ip, last.Time.Local().Format(time.RFC3339))
+	}
+	if state.APDisabled {
+		fmt.Printf("ap disabled since %s\n", state.APChanged.Local().Format(time.RFC3339))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tTYPE\tIFACE\tSSID\tOK\tREASON\tMESSAGE")
+	for _, entry := range state.History {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.Type, entry.Iface, entry.Ssid, entry.Success, entry.Reason, entry.Message)
+	}
+
+	return tw.Flush()
+}
+
+// cliAudit prints the audit log.
+func cliAudit(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	action := flags.String("action", "", "only this action, such as connect, forget or ap/down")
+	transport := flags.String("transport", "", "only this transport: http, https, socket, serial, mqtt or grpc")
+	ssid := flags.String("ssid", "", "only actions for this ssid")
+	since := flags.Duration("since", 0, "only actions in this last while, such as 24h")
+	limit := flags.Int("limit", 20, "at most this many entries, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(*limit))
+	for key, value := range map[string]string{"action": *action, "transport": *transport, "ssid": *ssid} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if *since > 0 {
+		query.Set("since", time.Now().Add(-*since).UTC().Format(time.RFC3339))
+	}
+
+	var entries []iotwifi.AuditEntry
+	if _, err := c.call("/audit?"+query.Encode(), nil, &entries); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tTRANSPORT\tCLIENT\tACTION\tSSID\tOK\tDURATION\tMESSAGE")
+	for _, entry := range entries {
+		client := entry.Client
+		if entry.Mac != "" {
+			client += " " + entry.Mac
+		}
+		action := entry.Action
+		if entry.Iface != "" {
+			action += " " + entry.Iface
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.Transport, client, action, entry.Ssid, entry.Success, entry.Duration.Round(time.Millisecond), entry.Message)
+	}
+
+	return tw.Flush()
+}
+
+// cliOperations prints the traced API requests, or the commands one of
+// them ran with their output.
+func cliOperations(c *cliClient, args []string) error {
+	flags := flag.NewFlagSet("operations", flag.ContinueOnError)
+	limit := flags.Int("limit", 20, "at most this many operations, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if id := flags.Arg(0); id != "" {
+		var op iotwifi.Operation
+		if _, err := c.call("/operations/"+url.PathEscape(id), nil, &op); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s %s %s status=%d duration=%s\n", op.Started.Local().Format(time.RFC3339), op.Method, op.Path, op.Status, op.Duration.Round(time.Millisecond))
+		for _, command := range op.Commands {
+			fmt.Printf("\n%s %s %s\n", command.Target, command.Iface, command.Command)
+			fmt.Printf("  exit=%d duration=%s\n", command.ExitCode, command.Duration.Round(time.Millisecond))
+			if command.Error != "" {
+				fmt.Printf("  error: %s\n", command.Error)
+			}
+			if output := strings.TrimSpace(command.Output); output != "" {
+				fmt.Printf("  %s\n", strings.Replace(output, "\n", "\n  ", -1))
+			}
+		}
+		if op.Dropped > 0 {
+			fmt.Printf("\n%d more commands not kept\n", op.Dropped)
+		}
+
+		return nil
+	}
+
+	var ops []iotwifi.Operation
+	if _, err := c.call(fmt.Sprintf("/operations?limit=%d", *limit), nil, &ops); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tMETHOD\tPATH\tSTATUS\tDURATION\tCOMMANDS")
+	for _, op := range ops {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%d\n", op.Id, op.Started.Local().Format(time.RFC3339), op.Method, op.Path, op.Status, op.Duration.Round(time.Millisecond), len(op.Commands)+op.Dropped)
+	}
+
+	return tw.Flush()
+}
+
+// cliQueue prints the operations running and waiting on each radio.
+func cliQueue(c *cliClient, args []string) error {
+	queues := map[string][]iotwifi.QueuedOp{}
+	if _, err := c.call("/queue", nil, &queues); err != nil {
+		return err
+	}
+
+	ifaces := []string{}
+	for iface := range queues {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IFACE\tID\tKIND\tSSID\tSTATE\tQUEUED\tOPERATION")
+	for _, iface := range ifaces {
+		for _, op := range queues[iface] {
+			state := "waiting"
+			if op.Started != nil {
+				state = "running"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", iface, op.Id, op.Kind, op.Ssid, state, op.Queued.Local().Format(time.RFC3339), op.Operation)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// ifacePath returns the API path of a station radio command, or path
+// itself for the station interface.
+func ifacePath(iface string, path string) string {
+	if iface == "" {
+		return path
+	}
+
+	return "/interfaces/" + url.PathEscape(iface) + path
+}
+
+// printMap prints the non empty values of m as key=value lines, sorted by
+// key.
+func printMap(m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v == nil || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf("%s=%v\n", k, m[k])
+	}
+}
@@ -0,0 +1,896 @@
+// Package client is a Go client of the txwifi HTTP API, over TCP or the
+// unix socket, with the request and payload types of the iotwifi package.
+// Calls are retried when the daemon is unreachable, busy or rate limits
+// the client, connects and other changes only when they were not run.
+//
+//	c := client.New("http://192.168.27.1:8080")
+//	results, err := c.Scan(ctx, client.ScanOptions{})
+//	connection, err := c.Connect(ctx, iotwifi.WpaCredentials{Ssid: "home", Psk: "secret"})
+//
+// The API is described by the OpenAPI document at /openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi"
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+	"github.com/kinokochat/txwifi/iotwifi/process"
+)
+
+// DefaultRetries is how many times a call is retried.
+const DefaultRetries = 3
+
+// DefaultBackoff is the wait before the first retry, doubled for each
+// next one.
+const DefaultBackoff = 500 * time.Millisecond
+
+// Error is a call the daemon answered with status FAIL.
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Client calls the API of a txwifi daemon.
+type Client struct {
+	BaseURL    string // http://host:port, without a trailing slash
+	HTTPClient *http.Client
+	Retries    int           // retries of a failed call, DefaultRetries if 0, none if negative
+	Backoff    time.Duration // DefaultBackoff if 0
+}
+
+// New produces a Client of the API at baseURL, such as
+// http://192.168.27.1:8080 or https://192.168.27.1:8443.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{},
+	}
+}
+
+// NewSocket produces a Client of the API on the unix socket at path.
+func NewSocket(path string) *Client {
+	dialer := &net.Dialer{}
+
+	// the host is ignored, every request goes to the socket
+	return &Client{
+		BaseURL: "http://txwifi",
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// ScanOptions select the scan results.
+type ScanOptions struct {
+	Fresh bool   // scan now instead of returning the last results
+	Ssid  string // probe for this hidden network, scans now
+	Iface string // scan with this station radio, always now
+
+	// the rest tune the scan, which is then made now
+	Passive     bool  // listen for beacons instead of probing
+	Freqs       []int // MHz, all by default
+	Dfs         bool  // scan the 5GHz DFS (radar) channels as well
+	DurationSec int   // wait for the results, 15 by default
+}
+
+// query returns the query of the options.
+func (opts ScanOptions) query() url.Values {
+	query := url.Values{}
+	if opts.Fresh {
+		query.Set("fresh", "true")
+	}
+	if opts.Ssid != "" {
+		query.Set("ssid", opts.Ssid)
+	}
+	if opts.Passive {
+		query.Set("passive", "true")
+	}
+	if len(opts.Freqs) > 0 {
+		freqs := []string{}
+		for _, freq := range opts.Freqs {
+			freqs = append(freqs, strconv.Itoa(freq))
+		}
+		query.Set("freq", strings.Join(freqs, ","))
+	}
+	if opts.Dfs {
+		query.Set("dfs", "true")
+	}
+	if opts.DurationSec > 0 {
+		query.Set("duration", strconv.Itoa(opts.DurationSec))
+	}
+
+	return query
+}
+
+// Status returns the station status.
+func (c *Client) Status(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.get(ctx, "/status", nil, &status)
+}
+
+// Scan returns the networks in range, strongest first.
+func (c *Client) Scan(ctx context.Context, opts ScanOptions) (iotwifi.ScanResults, error) {
+	path := "/scan"
+	if opts.Iface != "" {
+		path = ifacePath(opts.Iface, "/scan")
+	}
+
+	var results iotwifi.ScanResults
+	return results, c.get(ctx, path, opts.query(), &results)
+}
+
+// Connect connects the station. A failed attempt returns the connection,
+// whose Reason tells why, and an *Error.
+func (c *Client) Connect(ctx context.Context, creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+	var connection iotwifi.WpaConnection
+	return connection, c.post(ctx, "/connect", creds, &connection)
+}
+
+// PlanConnect returns the wpa_supplicant requests Connect would make for
+// creds, without making them.
+func (c *Client) PlanConnect(ctx context.Context, creds iotwifi.WpaCredentials) (iotwifi.Plan, error) {
+	var plan iotwifi.Plan
+	return plan, c.post(ctx, "/connect?dry_run=true", creds, &plan)
+}
+
+// ConnectQR connects the station to the network of a scanned WIFI: QR
+// code.
+func (c *Client) ConnectQR(ctx context.Context, qr string) (iotwifi.WpaConnection, error) {
+	var connection iotwifi.WpaConnection
+	return connection, c.post(ctx, "/connect/qr", iotwifi.WifiQR{Qr: qr}, &connection)
+}
+
+// Forget removes the saved network ssid.
+func (c *Client) Forget(ctx context.Context, ssid string) error {
+	return c.post(ctx, "/forget", iotwifi.WpaCredentials{Ssid: ssid}, nil)
+}
+
+// Networks returns the networks configured in wpa_supplicant.
+func (c *Client) Networks(ctx context.Context) ([]iotwifi.WpaConfiguredNetwork, error) {
+	var networks []iotwifi.WpaConfiguredNetwork
+	return networks, c.get(ctx, "/networks", nil, &networks)
+}
+
+// CollectNetworks removes all but one network of each ssid and the
+// disabled networks without a profile, and returns those removed.
+func (c *Client) CollectNetworks(ctx context.Context) ([]iotwifi.WpaConfiguredNetwork, error) {
+	var networks []iotwifi.WpaConfiguredNetwork
+	return networks, c.post(ctx, "/networks/collect", nil, &networks)
+}
+
+// Disconnect disconnects the station and returns its status.
+func (c *Client) Disconnect(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.post(ctx, "/disconnect", nil, &status)
+}
+
+// Reassociate reassociates the station and returns its status.
+func (c *Client) Reassociate(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.post(ctx, "/reassociate", nil, &status)
+}
+
+// Reconnect reconnects a disconnected station and returns its status.
+func (c *Client) Reconnect(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.post(ctx, "/reconnect", nil, &status)
+}
+
+// SetRoaming pins the station to a BSS or sets the roaming threshold.
+func (c *Client) SetRoaming(ctx context.Context, cfg iotwifi.RoamingCfg) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.post(ctx, "/roaming", cfg, &status)
+}
+
+// WPSPushButton joins a router whose WPS button is pressed within two
+// minutes.
+func (c *Client) WPSPushButton(ctx context.Context) error {
+	return c.post(ctx, "/wps/pbc", nil, nil)
+}
+
+// WPSPin joins a router by WPS pin and returns the pin, generated when
+// pin is empty.
+func (c *Client) WPSPin(ctx context.Context, pin string) (string, error) {
+	var req iotwifi.WPSRequest
+	err := c.post(ctx, "/wps/pin", iotwifi.WPSRequest{Pin: pin}, &req)
+	return req.Pin, err
+}
+
+// Country returns the regulatory domain.
+func (c *Client) Country(ctx context.Context) (iotwifi.CountryStatus, error) {
+	var country iotwifi.CountryStatus
+	return country, c.get(ctx, "/country", nil, &country)
+}
+
+// SetCountry sets the regulatory domain, an ISO 3166-1 alpha-2 code.
+func (c *Client) SetCountry(ctx context.Context, code string) (iotwifi.CountryStatus, error) {
+	var country iotwifi.CountryStatus
+	return country, c.post(ctx, "/country", iotwifi.CountryStatus{Country: code}, &country)
+}
+
+// Profiles returns the saved connection profiles, without their secrets.
+func (c *Client) Profiles(ctx context.Context) ([]iotwifi.Profile, error) {
+	var profiles []iotwifi.Profile
+	return profiles, c.get(ctx, "/profiles", nil, &profiles)
+}
+
+// SaveProfile saves a connection profile.
+func (c *Client) SaveProfile(ctx context.Context, profile iotwifi.Profile) error {
+	return c.post(ctx, "/profiles", profile, nil)
+}
+
+// DeleteProfile deletes the connection profile of ssid.
+func (c *Client) DeleteProfile(ctx context.Context, ssid string) error {
+	return c.post(ctx, "/profiles/delete", iotwifi.Profile{WpaCredentials: iotwifi.WpaCredentials{Ssid: ssid}}, nil)
+}
+
+// ExportProfiles returns the saved networks as a bundle, encrypted with
+// passphrase if set.
+func (c *Client) ExportProfiles(ctx context.Context, passphrase string) (iotwifi.ProfileBundle, error) {
+	var bundle iotwifi.ProfileBundle
+	return bundle, c.post(ctx, "/profiles/export", iotwifi.ProfileExport{Passphrase: passphrase}, &bundle)
+}
+
+// ImportProfiles saves the networks of a bundle.
+func (c *Client) ImportProfiles(ctx context.Context, req iotwifi.ProfileImport) (iotwifi.ProfileImportResult, error) {
+	var result iotwifi.ProfileImportResult
+	return result, c.post(ctx, "/profiles/import", req, &result)
+}
+
+// Interfaces returns the link state of the station radios and the AP
+// interface.
+func (c *Client) Interfaces(ctx context.Context) ([]netif.Link, error) {
+	var links []netif.Link
+	return links, c.get(ctx, "/interfaces", nil, &links)
+}
+
+// InterfaceStatus returns the status of the station radio iface.
+func (c *Client) InterfaceStatus(ctx context.Context, iface string) (map[string]string, error) {
+	status := map[string]string{}
+	return status, c.get(ctx, ifacePath(iface, "/status"), nil, &status)
+}
+
+// InterfaceScan scans with the station radio iface.
+func (c *Client) InterfaceScan(ctx context.Context, iface string) (iotwifi.ScanResults, error) {
+	var results iotwifi.ScanResults
+	return results, c.get(ctx, ifacePath(iface, "/scan"), nil, &results)
+}
+
+// InterfaceConnect connects the station radio iface, see Connect.
+func (c *Client) InterfaceConnect(ctx context.Context, iface string, creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+	var connection iotwifi.WpaConnection
+	return connection, c.post(ctx, ifacePath(iface, "/connect"), creds, &connection)
+}
+
+// InterfaceForget removes the saved network ssid of the station radio
+// iface.
+func (c *Client) InterfaceForget(ctx context.Context, iface string, ssid string) error {
+	return c.post(ctx, ifacePath(iface, "/forget"), iotwifi.WpaCredentials{Ssid: ssid}, nil)
+}
+
+// InterfaceNetworks returns the networks configured on the station radio
+// iface.
+func (c *Client) InterfaceNetworks(ctx context.Context, iface string) ([]iotwifi.WpaConfiguredNetwork, error) {
+	var networks []iotwifi.WpaConfiguredNetwork
+	return networks, c.get(ctx, ifacePath(iface, "/networks"), nil, &networks)
+}
+
+// Queue returns the operation running on each station radio, then those
+// waiting their turn, by interface.
+func (c *Client) Queue(ctx context.Context) (map[string][]iotwifi.QueuedOp, error) {
+	queues := map[string][]iotwifi.QueuedOp{}
+	return queues, c.get(ctx, "/queue", nil, &queues)
+}
+
+// APStatus returns hostapd's status, the clients are under "clients".
+func (c *Client) APStatus(ctx context.Context) (map[string]interface{}, error) {
+	status := map[string]interface{}{}
+	return status, c.get(ctx, "/ap", nil, &status)
+}
+
+// ConfigureAP changes the AP settings and returns the AP status.
+func (c *Client) ConfigureAP(ctx context.Context, cfg iotwifi.APConfig) (map[string]interface{}, error) {
+	status := map[string]interface{}{}
+	return status, c.post(ctx, "/ap", cfg, &status)
+}
+
+// PlanConfigureAP returns the files and reload ConfigureAP would apply for
+// cfg, without applying them.
+func (c *Client) PlanConfigureAP(ctx context.Context, cfg iotwifi.APConfig) (iotwifi.Plan, error) {
+	var plan iotwifi.Plan
+	return plan, c.post(ctx, "/ap?dry_run=true", cfg, &plan)
+}
+
+// APUp enables the AP and returns its status.
+func (c *Client) APUp(ctx context.Context) (map[string]interface{}, error) {
+	status := map[string]interface{}{}
+	return status, c.post(ctx, "/ap/up", nil, &status)
+}
+
+// APDown disables the AP and returns its status.
+func (c *Client) APDown(ctx context.Context) (map[string]interface{}, error) {
+	status := map[string]interface{}{}
+	return status, c.post(ctx, "/ap/down", nil, &status)
+}
+
+// BlockClient blocks the client mac from the AP.
+func (c *Client) BlockClient(ctx context.Context, mac string) error {
+	return c.post(ctx, "/ap/block", iotwifi.APClient{Mac: mac}, nil)
+}
+
+// UnblockClient unblocks the client mac.
+func (c *Client) UnblockClient(ctx context.Context, mac string) error {
+	return c.post(ctx, "/ap/unblock", iotwifi.APClient{Mac: mac}, nil)
+}
+
+// APQR returns the WIFI: payload of the QR code for joining the AP.
+func (c *Client) APQR(ctx context.Context) (string, error) {
+	var qr iotwifi.WifiQR
+	err := c.get(ctx, "/ap/qr", url.Values{"format": {"text"}}, &qr)
+	return qr.Qr, err
+}
+
+// APQRImage returns the QR code for joining the AP as a PNG.
+func (c *Client) APQRImage(ctx context.Context) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/ap/qr", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "image/png" {
+		return nil, decode("/ap/qr", resp, nil)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// APWPSPushButton lets a device join the AP by pressing its WPS button.
+func (c *Client) APWPSPushButton(ctx context.Context) error {
+	return c.post(ctx, "/ap/wps/pbc", nil, nil)
+}
+
+// APWPSPin lets a device join the AP with the pin it shows.
+func (c *Client) APWPSPin(ctx context.Context, pin string) error {
+	return c.post(ctx, "/ap/wps/pin", iotwifi.WPSRequest{Pin: pin}, nil)
+}
+
+// Router returns the router status.
+func (c *Client) Router(ctx context.Context) (iotwifi.RouterStatus, error) {
+	var status iotwifi.RouterStatus
+	return status, c.get(ctx, "/router", nil, &status)
+}
+
+// EnableRouter shares the uplink with the AP clients.
+func (c *Client) EnableRouter(ctx context.Context) (iotwifi.RouterStatus, error) {
+	var status iotwifi.RouterStatus
+	return status, c.post(ctx, "/router/enable", nil, &status)
+}
+
+// DisableRouter stops sharing the uplink.
+func (c *Client) DisableRouter(ctx context.Context) (iotwifi.RouterStatus, error) {
+	var status iotwifi.RouterStatus
+	return status, c.post(ctx, "/router/disable", nil, &status)
+}
+
+// Bridge returns the status of the bridge between the AP and the wired
+// network.
+func (c *Client) Bridge(ctx context.Context) (iotwifi.BridgeStatus, error) {
+	var status iotwifi.BridgeStatus
+	return status, c.get(ctx, "/bridge", nil, &status)
+}
+
+// APDevices returns the devices on the AP, associated or not.
+func (c *Client) APDevices(ctx context.Context) ([]iotwifi.APDevice, error) {
+	var devices []iotwifi.APDevice
+	return devices, c.get(ctx, "/ap/devices", nil, &devices)
+}
+
+// Leases returns the DHCP leases handed out on the AP.
+func (c *Client) Leases(ctx context.Context) ([]dhcp.Lease, error) {
+	var leases []dhcp.Lease
+	return leases, c.get(ctx, "/leases", nil, &leases)
+}
+
+// RevokeLease revokes the DHCP lease of mac.
+func (c *Client) RevokeLease(ctx context.Context, mac string) error {
+	return c.post(ctx, "/leases/revoke", dhcp.Lease{Mac: mac}, nil)
+}
+
+// Identity returns the device id and the default AP ssid and passphrase.
+func (c *Client) Identity(ctx context.Context) (iotwifi.Identity, error) {
+	var identity iotwifi.Identity
+	return identity, c.get(ctx, "/identity", nil, &identity)
+}
+
+// History returns the last good connection, the AP state and the
+// history, of entries of type typ if not empty, at most limit if not 0.
+func (c *Client) History(ctx context.Context, typ string, limit int) (iotwifi.NetworkState, error) {
+	query := url.Values{}
+	if typ != "" {
+		query.Set("type", typ)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var state iotwifi.NetworkState
+	return state, c.get(ctx, "/history", query, &state)
+}
+
+// Audit returns the provisioning actions selected by q.
+func (c *Client) Audit(ctx context.Context, q iotwifi.AuditQuery) ([]iotwifi.AuditEntry, error) {
+	query := url.Values{}
+	if q.Action != "" {
+		query.Set("action", q.Action)
+	}
+	if q.Transport != "" {
+		query.Set("transport", q.Transport)
+	}
+	if q.Ssid != "" {
+		query.Set("ssid", q.Ssid)
+	}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var entries []iotwifi.AuditEntry
+	return entries, c.get(ctx, "/audit", query, &entries)
+}
+
+// Operations returns the traced API requests newest first, at most limit
+// of them, all with a limit of 0.
+func (c *Client) Operations(ctx context.Context, limit int) ([]iotwifi.Operation, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var ops []iotwifi.Operation
+	return ops, c.get(ctx, "/operations", query, &ops)
+}
+
+// Operation returns the trace of the API request id, the X-Operation-Id
+// of its response.
+func (c *Client) Operation(ctx context.Context, id string) (iotwifi.Operation, error) {
+	var op iotwifi.Operation
+	return op, c.get(ctx, "/operations/"+url.PathEscape(id), nil, &op)
+}
+
+// Signal returns the station signal history, the last samples if last
+// is not 0.
+func (c *Client) Signal(ctx context.Context, last int) ([]iotwifi.SignalSample, error) {
+	query := url.Values{}
+	if last > 0 {
+		query.Set("last", strconv.Itoa(last))
+	}
+
+	var samples []iotwifi.SignalSample
+	return samples, c.get(ctx, "/signal", query, &samples)
+}
+
+// State returns the provisioning state and its last transitions.
+func (c *Client) State(ctx context.Context) (iotwifi.MachineStatus, error) {
+	var status iotwifi.MachineStatus
+	return status, c.get(ctx, "/state", nil, &status)
+}
+
+// Watchdog returns the link quality the watchdog sees and the roams and
+// reconnects it made.
+func (c *Client) Watchdog(ctx context.Context) (iotwifi.WatchdogStatus, error) {
+	var status iotwifi.WatchdogStatus
+	return status, c.get(ctx, "/watchdog", nil, &status)
+}
+
+// SpeedTest measures the throughput of the station's network.
+func (c *Client) SpeedTest(ctx context.Context, req iotwifi.SpeedTestRequest) (iotwifi.SpeedTestResult, error) {
+	var result iotwifi.SpeedTestResult
+	return result, c.post(ctx, "/speedtest", req, &result)
+}
+
+// Survey surveys how busy each channel is and recommends one for the AP.
+func (c *Client) Survey(ctx context.Context, req iotwifi.SurveyRequest) (iotwifi.SurveyReport, error) {
+	var report iotwifi.SurveyReport
+	return report, c.post(ctx, "/survey", req, &report)
+}
+
+// Watchlist returns the SSIDs the scans watch for and whether they are in
+// range.
+func (c *Client) Watchlist(ctx context.Context) ([]iotwifi.WatchStatus, error) {
+	var statuses []iotwifi.WatchStatus
+	return statuses, c.get(ctx, "/watchlist", nil, &statuses)
+}
+
+// Watch has the scans watch for the SSID of entry.
+func (c *Client) Watch(ctx context.Context, entry iotwifi.WatchEntry) ([]iotwifi.WatchStatus, error) {
+	var statuses []iotwifi.WatchStatus
+	return statuses, c.post(ctx, "/watchlist", entry, &statuses)
+}
+
+// Unwatch stops watching ssid.
+func (c *Client) Unwatch(ctx context.Context, ssid string) ([]iotwifi.WatchStatus, error) {
+	var statuses []iotwifi.WatchStatus
+	return statuses, c.post(ctx, "/watchlist/delete", iotwifi.WatchEntry{Ssid: ssid}, &statuses)
+}
+
+// Connectivity checks the station connectivity now.
+func (c *Client) Connectivity(ctx context.Context) (iotwifi.Connectivity, error) {
+	var connectivity iotwifi.Connectivity
+	return connectivity, c.get(ctx, "/connectivity", nil, &connectivity)
+}
+
+// Reload reloads the config and returns what changed.
+func (c *Client) Reload(ctx context.Context) (iotwifi.CfgReload, error) {
+	var reload iotwifi.CfgReload
+	return reload, c.post(ctx, "/reload", nil, &reload)
+}
+
+// Supervisor returns the recovery counters of the supervised components.
+func (c *Client) Supervisor(ctx context.Context) (map[string]iotwifi.RecoveryCounter, error) {
+	counters := map[string]iotwifi.RecoveryCounter{}
+	return counters, c.get(ctx, "/supervisor", nil, &counters)
+}
+
+// Processes returns the child processes, their state, restarts and
+// uptime.
+func (c *Client) Processes(ctx context.Context) ([]process.Status, error) {
+	var processes []process.Status
+	return processes, c.get(ctx, "/processes", nil, &processes)
+}
+
+// Conflicts returns the other network managers claiming the wireless
+// interfaces.
+func (c *Client) Conflicts(ctx context.Context) ([]iotwifi.Conflict, error) {
+	var conflicts []iotwifi.Conflict
+	return conflicts, c.get(ctx, "/conflicts", nil, &conflicts)
+}
+
+// FixConflicts writes the configuration that makes the other network
+// managers leave the interfaces alone and returns the conflicts fixed.
+func (c *Client) FixConflicts(ctx context.Context) ([]iotwifi.Conflict, error) {
+	var conflicts []iotwifi.Conflict
+	return conflicts, c.post(ctx, "/conflicts/fix", nil, &conflicts)
+}
+
+// Rfkill returns the rfkill blocks of the radios of the wifi interfaces.
+func (c *Client) Rfkill(ctx context.Context) ([]iotwifi.RadioBlock, error) {
+	var blocks []iotwifi.RadioBlock
+	return blocks, c.get(ctx, "/rfkill", nil, &blocks)
+}
+
+// SetRfkill soft blocks, or unblocks, the radio of iface, or of every
+// wifi interface when iface is empty, and returns the new blocks.
+func (c *Client) SetRfkill(ctx context.Context, iface string, block bool) ([]iotwifi.RadioBlock, error) {
+	path := "/rfkill/unblock"
+	if block {
+		path = "/rfkill/block"
+	}
+
+	var blocks []iotwifi.RadioBlock
+	return blocks, c.post(ctx, path, iotwifi.RadioBlock{Iface: iface}, &blocks)
+}
+
+// P2PFind looks for Wi-Fi Direct devices for timeout, ten seconds if it
+// is zero, and returns the peers found.
+func (c *Client) P2PFind(ctx context.Context, timeout time.Duration) ([]iotwifi.P2PPeer, error) {
+	var peers []iotwifi.P2PPeer
+	return peers, c.post(ctx, "/p2p/find", iotwifi.P2PFindRequest{Timeout: int(timeout / time.Second)}, &peers)
+}
+
+// P2PPeers returns the Wi-Fi Direct devices found so far.
+func (c *Client) P2PPeers(ctx context.Context) ([]iotwifi.P2PPeer, error) {
+	var peers []iotwifi.P2PPeer
+	return peers, c.get(ctx, "/p2p/peers", nil, &peers)
+}
+
+// P2PGroupAdd starts a Wi-Fi Direct group owned by the device.
+func (c *Client) P2PGroupAdd(ctx context.Context, req iotwifi.P2PGroupRequest) (iotwifi.P2PGroup, error) {
+	var group iotwifi.P2PGroup
+	return group, c.post(ctx, "/p2p/group", req, &group)
+}
+
+// P2PGroupRemove ends the Wi-Fi Direct group on iface.
+func (c *Client) P2PGroupRemove(ctx context.Context, iface string) error {
+	return c.post(ctx, "/p2p/group/remove", iotwifi.P2PGroupRequest{Iface: iface}, nil)
+}
+
+// P2PConnect pairs with a Wi-Fi Direct device and returns the pin to
+// enter on it for the display method.
+func (c *Client) P2PConnect(ctx context.Context, req iotwifi.P2PConnectRequest) (string, error) {
+	var wps iotwifi.WPSRequest
+	err := c.post(ctx, "/p2p/connect", req, &wps)
+	return wps.Pin, err
+}
+
+// P2PAuthorize lets a Wi-Fi Direct device join the group on req.Iface.
+func (c *Client) P2PAuthorize(ctx context.Context, req iotwifi.P2PConnectRequest) error {
+	return c.post(ctx, "/p2p/authorize", req, nil)
+}
+
+// APWindow returns when the setup AP closes and why.
+func (c *Client) APWindow(ctx context.Context) (iotwifi.APWindowStatus, error) {
+	var status iotwifi.APWindowStatus
+	return status, c.get(ctx, "/ap/window", nil, &status)
+}
+
+// OpenAPWindow brings the setup AP up for another window.
+func (c *Client) OpenAPWindow(ctx context.Context) (iotwifi.APWindowStatus, error) {
+	var status iotwifi.APWindowStatus
+	return status, c.post(ctx, "/ap/window/open", nil, &status)
+}
+
+// Capabilities probes the radios and checks the config against them.
+func (c *Client) Capabilities(ctx context.Context) (iotwifi.CapabilityReport, error) {
+	var report iotwifi.CapabilityReport
+	return report, c.get(ctx, "/capabilities", nil, &report)
+}
+
+// Diagnostics collects the diagnostics bundle.
+func (c *Client) Diagnostics(ctx context.Context) (iotwifi.Diagnostics, error) {
+	var diag iotwifi.Diagnostics
+	return diag, c.get(ctx, "/diagnostics", nil, &diag)
+}
+
+// Preflight runs the checks of the container txwifi runs in.
+func (c *Client) Preflight(ctx context.Context) (iotwifi.PreflightReport, error) {
+	var report iotwifi.PreflightReport
+	return report, c.get(ctx, "/preflight", nil, &report)
+}
+
+// Health runs the health checks of /healthz, or of /readyz if ready. A
+// failed check returns the checks and an *Error. It is not retried.
+func (c *Client) Health(ctx context.Context, ready bool) (iotwifi.Health, error) {
+	path := "/healthz"
+	if ready {
+		path = "/readyz"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return iotwifi.Health{}, err
+	}
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return iotwifi.Health{}, err
+	}
+	defer resp.Body.Close()
+
+	var health iotwifi.Health
+	return health, decode(path, resp, &health)
+}
+
+// TLSFingerprint returns the fingerprint of the HTTPS certificate, for
+// pinning.
+func (c *Client) TLSFingerprint(ctx context.Context) (map[string]string, error) {
+	fingerprint := map[string]string{}
+	return fingerprint, c.get(ctx, "/tls", nil, &fingerprint)
+}
+
+// Metrics returns the event counters and child process state in the
+// Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/metrics", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/metrics: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// OpenAPI returns the OpenAPI document of the API.
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/openapi.json", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/openapi.json: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Events calls handle for each wifi event until ctx is done, handle
+// fails or the daemon closes the stream. It is not retried.
+func (c *Client) Events(ctx context.Context, handle func(iotwifi.Event) error) error {
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/events: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var ev iotwifi.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			return err
+		}
+		if err := handle(ev); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return scanner.Err()
+}
+
+// ifacePath returns the path of a station radio's route.
+func ifacePath(iface string, route string) string {
+	return "/interfaces/" + url.PathEscape(iface) + route
+}
+
+// get GETs path and decodes the payload into payload.
+func (c *Client) get(ctx context.Context, path string, query url.Values, payload interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decode(path, resp, payload)
+}
+
+// post POSTs body as json, an empty body if nil, and decodes the payload
+// into payload.
+func (c *Client) post(ctx context.Context, path string, body interface{}, payload interface{}) error {
+	data := []byte{}
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, path, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return decode(path, resp, payload)
+}
+
+// do sends a request, retrying with backoff: GETs on any network error,
+// 429 or 5xx, POSTs only when the daemon never got them, when the
+// connection was refused or the client was rate limited.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte) (*http.Response, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	retries := c.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, target, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+
+		wait := backoff << uint(attempt)
+		retry := false
+		switch {
+		case err != nil:
+			retry = method == http.MethodGet || isDialError(err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			retry = true
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+		case resp.StatusCode >= 500:
+			retry = method == http.MethodGet
+		}
+
+		if !retry || attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isDialError reports whether err is a failure to connect, before
+// anything was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// decode decodes the ApiReturn of resp, its payload into payload. A FAIL
+// status is an *Error, returned after the payload is decoded.
+func decode(path string, resp *http.Response, payload interface{}) error {
+	ret := struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Payload json.RawMessage `json:"payload"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	if payload != nil && len(ret.Payload) > 0 && string(ret.Payload) != "null" {
+		if err := json.Unmarshal(ret.Payload, payload); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	if ret.Status != "OK" {
+		return &Error{Path: path, Message: ret.Message}
+	}
+
+	return nil
+}
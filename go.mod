@@ -1,6 +1,6 @@
 module github.com/kinokochat/txwifi
 
-go 1.13
+go 1.24
 
 require (
 	github.com/bhoriuchi/go-bunyan v0.0.0-20170831222709-8815b5fdce8c
@@ -0,0 +1,85 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BlockClient denies mac from the AP and kicks it off immediately. The
+// mac is added to the deny list so it stays blocked across reloads.
+func (wpa *WpaCfg) BlockClient(ctx context.Context, mac string) error {
+	mac = strings.ToLower(mac)
+	if !macR.MatchString(mac) {
+		return fmt.Errorf("invalid mac address %q", mac)
+	}
+
+	if err := wpa.hostapdCli(ctx, "deny_acl", "ADD_MAC", mac); err != nil {
+		return err
+	}
+	if err := wpa.hostapdCli(ctx, "deauthenticate", mac); err != nil {
+		return err
+	}
+
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		if !containsMac(cfg.APDenyList, mac) {
+			cfg.APDenyList = append(append([]string{}, cfg.APDenyList...), mac)
+		}
+	})
+	wpa.Log.Info("ap client blocked", "iface", wpa.Cfg().APInterface, "mac", mac)
+
+	return nil
+}
+
+// UnblockClient removes mac from the AP deny list.
+func (wpa *WpaCfg) UnblockClient(ctx context.Context, mac string) error {
+	mac = strings.ToLower(mac)
+	if !macR.MatchString(mac) {
+		return fmt.Errorf("invalid mac address %q", mac)
+	}
+
+	if err := wpa.hostapdCli(ctx, "deny_acl", "DEL_MAC", mac); err != nil {
+		return err
+	}
+
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		denyList := []string{}
+		for _, denied := range cfg.APDenyList {
+			if !strings.EqualFold(denied, mac) {
+				denyList = append(denyList, denied)
+			}
+		}
+		cfg.APDenyList = denyList
+	})
+	wpa.Log.Info("ap client unblocked", "iface", wpa.Cfg().APInterface, "mac", mac)
+
+	return nil
+}
+
+// hostapdCli runs a hostapd_cli command on the AP interface and checks
+// it replied OK.
+func (wpa *WpaCfg) hostapdCli(ctx context.Context, args ...string) error {
+	args = append([]string{"-i", wpa.Cfg().APInterface}, args...)
+
+	out, err := wpa.Runner.Output(ctx, "hostapd_cli", args...)
+	if err != nil {
+		return fmt.Errorf("hostapd_cli %s: %w", args[2], err)
+	}
+
+	if status := strings.TrimSpace(string(out)); status != "OK" {
+		return fmt.Errorf("hostapd_cli %s: %s", args[2], status)
+	}
+
+	return nil
+}
+
+// containsMac reports whether macs contains mac, ignoring case.
+func containsMac(macs []string, mac string) bool {
+	for _, m := range macs {
+		if strings.EqualFold(m, mac) {
+			return true
+		}
+	}
+
+	return false
+}
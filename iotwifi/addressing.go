@@ -0,0 +1,179 @@
+package iotwifi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// ResolvConf is where static nameservers are written, unless
+// SetupCfg.ResolvConf says otherwise.
+const ResolvConf = "/etc/resolv.conf"
+
+// StaticIPCfg is a fixed address for the station interface. An empty
+// Address leaves addressing to DHCP.
+type StaticIPCfg struct {
+	Address string   `json:"address"` // 192.168.1.50/24
+	Gateway string   `json:"gateway"` // 192.168.1.1
+	Dns     []string `json:"dns"`     // ["192.168.1.1", "1.1.1.1"]
+}
+
+// Enabled reports whether a static address is configured.
+func (s StaticIPCfg) Enabled() bool {
+	return s.Address != ""
+}
+
+// Validate checks the address, gateway and nameservers. Nameservers
+// without an address are checked too, as profiles use them with DHCP.
+func (s StaticIPCfg) Validate() error {
+	for _, dns := range s.Dns {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid station dns %q", dns)
+		}
+	}
+
+	if !s.Enabled() {
+		return nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(s.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid station address %q, expected a.b.c.d/prefix", s.Address)
+	}
+
+	if s.Gateway != "" {
+		gw := net.ParseIP(s.Gateway)
+		if gw == nil || gw.To4() == nil {
+			return fmt.Errorf("invalid station gateway %q", s.Gateway)
+		}
+		if !ipNet.Contains(gw) {
+			return fmt.Errorf("station gateway %s is outside %s", s.Gateway, ipNet)
+		}
+	}
+
+	return nil
+}
+
+// applyAPSubnet derives the AP address and DHCP range from subnet where
+// they are not set: the AP takes the first host address and clients are
+// handed the upper half of the subnet.
+func applyAPSubnet(cfg *SetupCfg) error {
+	if cfg.APSubnet == "" {
+		return nil
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.APSubnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("invalid ap_subnet %q", cfg.APSubnet)
+	}
+
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 3 {
+		return fmt.Errorf("ap_subnet %s is too small", cfg.APSubnet)
+	}
+
+	network := binary.BigEndian.Uint32(subnet.IP.To4())
+	size := uint32(1) << uint(bits-ones)
+
+	if cfg.HostApdCfg.Ip == "" {
+		cfg.HostApdCfg.Ip = uint32IP(network + 1).String()
+	} else if !subnet.Contains(net.ParseIP(cfg.HostApdCfg.Ip)) {
+		return fmt.Errorf("ap ip %s is outside ap_subnet %s", cfg.HostApdCfg.Ip, cfg.APSubnet)
+	}
+
+	if cfg.DnsmasqCfg.DhcpRange == "" {
+		start := uint32IP(network + size/2)
+		end := uint32IP(network + size - 2)
+		cfg.DnsmasqCfg.DhcpRange = fmt.Sprintf("%s,%s,%s,1h", start, end, net.IP(subnet.Mask))
+	}
+
+	return nil
+}
+
+// apAddress returns the AP ip with the prefix of the AP subnet, /24 if
+// no subnet is set.
+func (s *SetupCfg) apAddress() string {
+	prefix := 24
+	if _, subnet, err := net.ParseCIDR(s.APSubnet); err == nil {
+		prefix, _ = subnet.Mask.Size()
+	}
+
+	return fmt.Sprintf("%s/%d", s.HostApdCfg.Ip, prefix)
+}
+
+// dnsAddresses returns the dnsmasq --address values: the configured one,
+// or every name resolving to the AP for the captive portal.
+func (s *SetupCfg) dnsAddresses() []string {
+	if s.DnsmasqCfg.Address != "" {
+		return []string{s.DnsmasqCfg.Address}
+	}
+	if !s.CaptivePortal.Enabled {
+		return nil
+	}
+
+	addresses := []string{}
+	if ip6 := s.apIP6(); ip6 != "" {
+		addresses = append(addresses, "/#/"+ip6)
+	}
+
+	return append(addresses, "/#/"+s.HostApdCfg.Ip)
+}
+
+// resolvConf returns where static nameservers are written.
+func (s *SetupCfg) resolvConf() string {
+	if s.ResolvConf != "" {
+		return s.ResolvConf
+	}
+
+	return ResolvConf
+}
+
+// uint32IP converts a host order address to a net.IP.
+func uint32IP(addr uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip
+}
+
+// setStaticAddress puts cfg on iface: the address, a default route via
+// the gateway and the nameservers in resolvConf, which is backed up first
+// so Shutdown can restore it.
+func setStaticAddress(iface string, cfg StaticIPCfg, resolvConf string) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := netif.ReplaceAddr(iface, cfg.Address); err != nil {
+		return err
+	}
+
+	if cfg.Gateway != "" {
+		if err := netif.ReplaceDefaultRoute(iface, cfg.Gateway); err != nil {
+			return err
+		}
+	}
+
+	return setNameservers(cfg.Dns, resolvConf)
+}
+
+// setNameservers writes dns to resolvConf, backing it up first. No
+// nameservers leave it alone.
+func setNameservers(dns []string, resolvConf string) error {
+	if len(dns) == 0 {
+		return nil
+	}
+
+	if err := backupFile(resolvConf); err != nil {
+		return err
+	}
+
+	data := ""
+	for _, server := range dns {
+		data += "nameserver " + server + "\n"
+	}
+
+	return ioutil.WriteFile(resolvConf, []byte(data), 0644)
+}
@@ -0,0 +1,122 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+)
+
+// DefaultLeaseFile is the dnsmasq lease file used when DnsmasqCfg.LeaseFile is empty.
+const DefaultLeaseFile = "/var/lib/misc/dnsmasq.leases"
+
+// APClient is a station associated with the AP.
+type APClient struct {
+	Mac           string `json:"mac"`
+	Ip            string `json:"ip"`
+	Hostname      string `json:"hostname"`
+	Vendor        string `json:"vendor"`         // from the OUI of the mac, empty when unknown
+	Rssi          int    `json:"rssi"`           // dBm
+	RxBytes       int64  `json:"rx_bytes"`       // from the station
+	TxBytes       int64  `json:"tx_bytes"`       // to the station
+	ConnectedTime int64  `json:"connected_time"` // seconds
+	InactiveMsec  int64  `json:"inactive_msec"`  // since the station last sent or received
+}
+
+var macR = regexp.MustCompile("^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$")
+
+// APClients returns details for every station associated with the AP,
+// with addresses and hostnames resolved from the dnsmasq leases.
+func (wpa *WpaCfg) APClients(ctx context.Context) ([]APClient, error) {
+	clients := []APClient{}
+
+	staOut, err := wpa.Runner.Output(ctx, "hostapd_cli", "-i", wpa.Cfg().APInterface, "all_sta")
+	if err != nil {
+		return clients, fmt.Errorf("%w: checking clients: %s", ErrAPStatusFailed, err)
+	}
+
+	leases, err := dhcp.ReadLeases(wpa.leaseFile())
+	if err != nil {
+		wpa.Log.Error("could not read leases", "path", wpa.leaseFile(), "error", err)
+	}
+
+	hosts := make(map[string]dhcp.Lease)
+	for _, lease := range leases {
+		hosts[lease.Mac] = lease
+	}
+
+	// all_sta prints each station's mac followed by its key=value stats
+	var client *APClient
+	for _, line := range bytes.Split(staOut, []byte("\n")) {
+		text := strings.TrimSpace(string(line))
+
+		if macR.MatchString(text) {
+			clients = append(clients, APClient{Mac: strings.ToLower(text)})
+			client = &clients[len(clients)-1]
+			client.Vendor = wpa.OUI.Vendor(client.Mac)
+
+			if lease, ok := hosts[client.Mac]; ok {
+				client.Ip = lease.Ip
+				client.Hostname = lease.Hostname
+			}
+			continue
+		}
+
+		kv := strings.SplitN(text, "=", 2)
+		if client == nil || len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "signal":
+			client.Rssi, _ = strconv.Atoi(kv[1])
+		case "rx_bytes":
+			client.RxBytes, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "tx_bytes":
+			client.TxBytes, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "connected_time":
+			client.ConnectedTime, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "inactive_msec":
+			client.InactiveMsec, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+
+	return clients, nil
+}
+
+// leaseFile returns the configured dnsmasq lease file.
+func (wpa *WpaCfg) leaseFile() string {
+	return wpa.Cfg().DnsmasqCfg.leaseFile()
+}
+
+// Leases returns the DHCP leases handed out on the AP.
+func (wpa *WpaCfg) Leases() ([]dhcp.Lease, error) {
+	return dhcp.ReadLeases(wpa.leaseFile())
+}
+
+// RevokeLease releases the lease held by mac so its address can be
+// handed out again.
+func (wpa *WpaCfg) RevokeLease(ctx context.Context, mac string) error {
+	// the built-in server rereads its lease file
+	if wpa.Cfg().DnsmasqCfg.Builtin {
+		return dhcp.RemoveLease(wpa.leaseFile(), mac)
+	}
+
+	leases, err := wpa.Leases()
+	if err != nil {
+		return err
+	}
+
+	mac = strings.ToLower(mac)
+	for _, lease := range leases {
+		if lease.Mac == mac {
+			return dhcp.Revoke(ctx, wpa.Cfg().APInterface, lease.Ip, lease.Mac)
+		}
+	}
+
+	return fmt.Errorf("no lease for %s", mac)
+}
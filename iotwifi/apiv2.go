@@ -0,0 +1,320 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The v2 API returns the structured types of this file where v1 passes on
+// what wpa_supplicant and hostapd print: numbers as numbers, flags as
+// lists and errors with a reason.
+
+// StationStatus is the station status of the v2 API, the STATUS fields of
+// wpa_supplicant parsed, with the signal.
+type StationStatus struct {
+	State            string   `json:"state"` // wpa_state, COMPLETED when connected
+	Ssid             string   `json:"ssid"`
+	Bssid            string   `json:"bssid"`
+	Frequency        int      `json:"frequency"` // MHz
+	Channel          int      `json:"channel"`
+	Band             string   `json:"band"`
+	Rssi             int      `json:"rssi"`    // dBm, 0 when not connected
+	Quality          int      `json:"quality"` // 0-100 percent
+	KeyMgmt          string   `json:"key_mgmt"`
+	PairwiseCipher   string   `json:"pairwise_cipher"`
+	Mac              string   `json:"mac"`
+	Ip               string   `json:"ip"`
+	Ipv6             []string `json:"ipv6"`
+	Gateway6         string   `json:"gateway6"`
+	Connectivity     string   `json:"connectivity"` // online, captive, no-dns or link-only
+	CaptivePortalUrl string   `json:"captive_portal_url"`
+	RadioBlocked     bool     `json:"radio_blocked"` // soft or hard blocked by rfkill
+
+	Latency []LatencyResult `json:"latency,omitempty"` // the last latency probes, when enabled
+}
+
+// ParseStationStatus parses the station status fields returned by
+// WpaCfg.Status. The signal is left out, see WpaCfg.StationStatus.
+func ParseStationStatus(fields map[string]string) StationStatus {
+	status := StationStatus{
+		State:            fields["wpa_state"],
+		Ssid:             fields["ssid"],
+		Bssid:            fields["bssid"],
+		KeyMgmt:          fields["key_mgmt"],
+		PairwiseCipher:   fields["pairwise_cipher"],
+		Mac:              fields["address"],
+		Ip:               fields["ip_address"],
+		Ipv6:             []string{},
+		Gateway6:         fields["ipv6_gateway"],
+		Connectivity:     fields["connectivity"],
+		CaptivePortalUrl: fields["captive_portal_url"],
+		RadioBlocked:     fields["radio"] == "blocked",
+	}
+
+	status.Frequency, _ = strconv.Atoi(fields["freq"])
+	status.Channel, status.Band = FrequencyChannel(status.Frequency)
+	if ips := fields["ipv6_address"]; ips != "" {
+		status.Ipv6 = strings.Split(ips, ",")
+	}
+
+	return status
+}
+
+// StationStatus returns the station status with the signal of the
+// connection.
+func (wpa *WpaCfg) StationStatus(ctx context.Context) (StationStatus, error) {
+	fields, err := wpa.Status(ctx)
+	if err != nil {
+		return StationStatus{}, err
+	}
+
+	status := ParseStationStatus(fields)
+	if status.State == "COMPLETED" {
+		if sample, err := wpa.SignalPoll(ctx); err == nil {
+			status.Rssi = sample.Rssi
+			status.Quality = SignalQuality(sample.Rssi)
+		}
+		status.Latency = wpa.Latency()
+	}
+
+	return status, nil
+}
+
+// BSS is a scanned BSS in the v2 API.
+type BSS struct {
+	Ssid      string      `json:"ssid"`
+	Bssid     string      `json:"bssid"`
+	Frequency int         `json:"frequency"` // MHz
+	Channel   int         `json:"channel"`
+	Band      string      `json:"band"`
+	Rssi      int         `json:"rssi"`    // dBm
+	Quality   int         `json:"quality"` // 0-100 percent
+	Flags     []string    `json:"flags"`   // WPA2-PSK-CCMP, WPS, ESS
+	Security  WpaSecurity `json:"security"`
+	Vendor    string      `json:"vendor,omitempty"` // of the AP, from the OUI of the bssid
+	Iface     string      `json:"iface,omitempty"`
+	SeenBy    []string    `json:"seen_by,omitempty"`
+}
+
+// ScanNetwork is a scanned network in the v2 API. The embedded BSS is the
+// strongest one, Bss lists all of them strongest first.
+type ScanNetwork struct {
+	BSS
+	Bss []BSS `json:"bss"`
+}
+
+// ScanReport is the scan results of the v2 API.
+type ScanReport struct {
+	Time     time.Time         `json:"time"` // zero if there has been no scan yet
+	Networks []ScanNetwork     `json:"networks"`
+	Ifaces   []string          `json:"ifaces,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// NewScanReport converts scan results.
+func NewScanReport(results ScanResults) ScanReport {
+	report := ScanReport{Time: results.Time, Networks: []ScanNetwork{}, Ifaces: results.Ifaces, Errors: results.Errors}
+	for _, result := range results.Networks {
+		network := ScanNetwork{BSS: newBSS(result.WpaNetwork), Bss: []BSS{}}
+		for _, bss := range result.Bss {
+			network.Bss = append(network.Bss, newBSS(bss))
+		}
+		report.Networks = append(report.Networks, network)
+	}
+
+	return report
+}
+
+// newBSS converts a scanned network.
+func newBSS(n WpaNetwork) BSS {
+	frequency, _ := strconv.Atoi(n.Frequency)
+
+	return BSS{
+		Ssid:      n.Ssid,
+		Bssid:     n.Bssid,
+		Frequency: frequency,
+		Channel:   n.Channel,
+		Band:      n.Band,
+		Rssi:      n.SignalLevel,
+		Quality:   n.Quality,
+		Flags:     ParseFlags(n.Flags),
+		Security:  n.Security,
+		Vendor:    n.Vendor,
+		Iface:     n.Iface,
+		SeenBy:    n.SeenBy,
+	}
+}
+
+// ParseFlags splits flags such as [WPA2-PSK-CCMP][WPS][ESS] into a list.
+func ParseFlags(flags string) []string {
+	list := []string{}
+	for _, flag := range strings.Split(flags, "]") {
+		if flag = strings.TrimPrefix(strings.TrimSpace(flag), "["); flag != "" {
+			list = append(list, flag)
+		}
+	}
+
+	return list
+}
+
+// ConfiguredNetwork is a network configured in wpa_supplicant, in the v2
+// API.
+type ConfiguredNetwork struct {
+	Id       int      `json:"id"`
+	Ssid     string   `json:"ssid"`
+	Bssid    string   `json:"bssid"` // empty for any
+	Flags    []string `json:"flags"`
+	Current  bool     `json:"current"`  // the station is connected to it
+	Disabled bool     `json:"disabled"` // disabled, or temporarily after failures
+}
+
+// NewConfiguredNetworks converts the networks of
+// WpaCfg.ListConfiguredNetworks.
+func NewConfiguredNetworks(networks []WpaConfiguredNetwork) []ConfiguredNetwork {
+	list := []ConfiguredNetwork{}
+	for _, n := range networks {
+		network := ConfiguredNetwork{
+			Ssid:  n.Ssid,
+			Bssid: n.Bssid,
+			Flags: ParseFlags(n.Flags),
+		}
+		network.Id, _ = strconv.Atoi(n.Id)
+		if network.Bssid == "any" {
+			network.Bssid = ""
+		}
+		for _, flag := range network.Flags {
+			switch flag {
+			case "CURRENT":
+				network.Current = true
+			case "DISABLED", "TEMP-DISABLED":
+				network.Disabled = true
+			}
+		}
+		list = append(list, network)
+	}
+
+	return list
+}
+
+// AccessPointStatus is the AP status of the v2 API, hostapd's status
+// parsed, with the clients.
+type AccessPointStatus struct {
+	State     string            `json:"state"` // ENABLED when up
+	Ssid      string            `json:"ssid"`
+	Bssid     string            `json:"bssid"`
+	Frequency int               `json:"frequency"` // MHz
+	Channel   int               `json:"channel"`
+	Band      string            `json:"band"`
+	Clients   []APClient        `json:"clients"`
+	Fields    map[string]string `json:"fields"` // every field hostapd reported
+}
+
+// ParseAPStatus parses the AP status returned by WpaCfg.APStatus.
+func ParseAPStatus(status map[string]interface{}) AccessPointStatus {
+	ap := AccessPointStatus{Clients: []APClient{}, Fields: map[string]string{}}
+	for key, value := range status {
+		switch value := value.(type) {
+		case string:
+			ap.Fields[key] = value
+		case []APClient:
+			ap.Clients = value
+		}
+	}
+
+	ap.State = ap.Fields["state"]
+	ap.Ssid = ap.Fields["ssid"]
+	ap.Bssid = ap.Fields["bssid"]
+	ap.Frequency, _ = strconv.Atoi(ap.Fields["freq"])
+	ap.Channel, ap.Band = FrequencyChannel(ap.Frequency)
+
+	return ap
+}
+
+// APIError tells v2 API clients why a call failed: a reason code to act
+// on, and the HTTP status it is answered with.
+type APIError struct {
+	Reason string `json:"reason"`
+	Status int    `json:"status"`
+}
+
+// Reasons of an APIError, besides the ConnectReasons of a failed connect.
+const (
+	ReasonInvalid       = "INVALID"
+	ReasonNotConfigured = "NOT_CONFIGURED"
+	ReasonNotFound      = "NOT_FOUND"
+	ReasonUnavailable   = "UNAVAILABLE"
+	ReasonConnectFailed = "CONNECT_FAILED"
+	ReasonWpsFailed     = "WPS_FAILED"
+	ReasonRateLimited   = "RATE_LIMITED"
+	ReasonLockedOut     = "LOCKED_OUT"
+	ReasonUnsupported   = "UNSUPPORTED"
+	ReasonRadioBlocked  = "RADIO_BLOCKED"
+	ReasonP2PFailed     = "P2P_FAILED"
+	ReasonSpeedTest     = "SPEED_TEST_FAILED"
+	ReasonBusy          = "BUSY"
+	ReasonInternal      = "INTERNAL"
+)
+
+// apiErrors are the APIErrors of the WpaCfg errors, the first match wins.
+var apiErrors = []struct {
+	err error
+	APIError
+}{
+	{ErrConfig, APIError{ReasonInvalid, http.StatusBadRequest}},
+	{ErrInvalid, APIError{ReasonInvalid, http.StatusBadRequest}},
+	{ErrWrongPassword, APIError{string(ReasonWrongPassword), http.StatusUnauthorized}},
+	{ErrNetworkNotFound, APIError{string(ReasonNetworkNotFound), http.StatusNotFound}},
+	{ErrNotConfigured, APIError{ReasonNotConfigured, http.StatusNotFound}},
+	{ErrProfileNotFound, APIError{ReasonNotFound, http.StatusNotFound}},
+	{ErrUnknownInterface, APIError{ReasonNotFound, http.StatusNotFound}},
+	{ErrOperationNotFound, APIError{ReasonNotFound, http.StatusNotFound}},
+	{ErrTimeout, APIError{string(ReasonTimeout), http.StatusGatewayTimeout}},
+	{ErrRateLimited, APIError{ReasonRateLimited, http.StatusTooManyRequests}},
+	{ErrLockedOut, APIError{ReasonLockedOut, http.StatusTooManyRequests}},
+	{ErrConnectFailed, APIError{ReasonConnectFailed, http.StatusBadGateway}},
+	{ErrWpsFailed, APIError{ReasonWpsFailed, http.StatusBadGateway}},
+	{ErrP2PFailed, APIError{ReasonP2PFailed, http.StatusBadGateway}},
+	{ErrSpeedTestFailed, APIError{ReasonSpeedTest, http.StatusBadGateway}},
+	{ErrBusy, APIError{ReasonBusy, http.StatusConflict}},
+	{ErrRadioBlocked, APIError{ReasonRadioBlocked, http.StatusServiceUnavailable}},
+	{ErrScanFailed, APIError{ReasonUnavailable, http.StatusServiceUnavailable}},
+	{ErrStatusFailed, APIError{ReasonUnavailable, http.StatusServiceUnavailable}},
+	{ErrAPStatusFailed, APIError{ReasonUnavailable, http.StatusServiceUnavailable}},
+	{ErrCommandFailed, APIError{ReasonUnavailable, http.StatusServiceUnavailable}},
+	{ErrNoFirewall, APIError{ReasonUnsupported, http.StatusNotImplemented}},
+}
+
+// connectStatuses are the HTTP statuses of failed connects by reason.
+var connectStatuses = map[ConnectReason]int{
+	ReasonWrongPassword:   http.StatusUnauthorized,
+	ReasonAuthFailed:      http.StatusUnauthorized,
+	ReasonNetworkNotFound: http.StatusNotFound,
+	ReasonTimeout:         http.StatusGatewayTimeout,
+	ReasonLostControl:     http.StatusServiceUnavailable,
+}
+
+// NewAPIError returns the APIError of err, INTERNAL for errors not
+// wrapping one of the WpaCfg errors.
+func NewAPIError(err error) APIError {
+	for _, e := range apiErrors {
+		if errors.Is(err, e.err) {
+			return e.APIError
+		}
+	}
+
+	return APIError{ReasonInternal, http.StatusInternalServerError}
+}
+
+// ConnectError returns the APIError of a failed connect, by the reason of
+// the connection when it has one.
+func ConnectError(connection WpaConnection, err error) APIError {
+	if status, ok := connectStatuses[connection.Reason]; ok {
+		return APIError{string(connection.Reason), status}
+	}
+
+	return NewAPIError(err)
+}
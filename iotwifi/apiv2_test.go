@@ -0,0 +1,56 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// TestAPIErrorInvalid checks the errors of invalid requests are answered
+// with 400 on /v2, not as internal errors.
+func TestAPIErrorInvalid(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		err  func() error
+	}{
+		{"short passphrase", func() error {
+			_, err := wpa.ReconfigureAP(context.Background(), APConfig{WpaPassphrase: "short"})
+			return err
+		}},
+		{"channel", func() error {
+			_, err := wpa.ReconfigureAP(context.Background(), APConfig{Channel: "36"})
+			return err
+		}},
+		{"key management", func() error {
+			_, err := wpa.ReconfigureAP(context.Background(), APConfig{WpaKeyMgmt: "NONE"})
+			return err
+		}},
+		// as the handlers report a query parameter they cannot parse
+		{"query parameter", func() error {
+			return fmt.Errorf("%w: invalid limit %q", ErrInvalid, "ten")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := len(runner.Calls())
+			err := tt.err()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if apiErr := NewAPIError(err); apiErr.Status != http.StatusBadRequest || apiErr.Reason != ReasonInvalid {
+				t.Errorf("%s: got %+v, want %d %s", err, apiErr, http.StatusBadRequest, ReasonInvalid)
+			}
+			if len(runner.Calls()) != calls {
+				t.Errorf("invalid request ran %v", runner.Calls()[calls:])
+			}
+		})
+	}
+
+	if passphrase := wpa.Cfg().HostApdCfg.WpaPassphrase; passphrase != "iotwifipass" {
+		t.Errorf("invalid reconfigures changed the passphrase to %q", passphrase)
+	}
+}
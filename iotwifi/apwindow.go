@@ -0,0 +1,283 @@
+package iotwifi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultAPWindowGrace is how long the AP stays up after the station
+// connects unless APWindowCfg.GraceSec says otherwise, for the phone
+// that provisioned the device to see it succeed.
+const DefaultAPWindowGrace = 60 * time.Second
+
+// Reasons the AP window closes.
+const (
+	APWindowExpired   = "expired"   // minutes after boot or the last open
+	APWindowConnected = "connected" // the grace period after the station connected
+	APWindowClosed    = "closed"    // by Close, as after a button press
+)
+
+// APWindowCfg limits how long the setup AP broadcasts and is used by
+// SetupCfg. Without minutes or close_on_connect the AP is always up.
+type APWindowCfg struct {
+	Minutes        int  `json:"minutes"`          // close the AP this long after boot, or after it is opened again
+	CloseOnConnect bool `json:"close_on_connect"` // close the AP once the station connects
+	GraceSec       int  `json:"grace_sec"`        // after the station connects, 60 by default
+}
+
+// enabled reports whether the AP is ever closed.
+func (cfg APWindowCfg) enabled() bool {
+	return cfg.Minutes > 0 || cfg.CloseOnConnect
+}
+
+// grace returns the configured grace period.
+func (cfg APWindowCfg) grace() time.Duration {
+	if cfg.GraceSec > 0 {
+		return time.Duration(cfg.GraceSec) * time.Second
+	}
+
+	return DefaultAPWindowGrace
+}
+
+// APWindowStatus is the state of the AP window.
+type APWindowStatus struct {
+	Enabled bool       `json:"enabled"`          // the window is configured
+	Open    bool       `json:"open"`             // the AP is up
+	Closes  *time.Time `json:"closes,omitempty"` // when the AP goes down, nil if it stays up
+	Reason  string     `json:"reason,omitempty"` // why it closes or closed: expired, connected or closed
+}
+
+// APWindow brings the setup AP down a set time after boot, or after the
+// station connects, so a provisioned device stops broadcasting. Open
+// brings it back for another window, as after a button press.
+type APWindow struct {
+	Wpa *WpaCfg
+
+	mu        sync.Mutex
+	cfg       APWindowCfg
+	open      bool
+	expires   time.Time // the end of the window, zero for none
+	connected time.Time // the end of the grace period, zero for none
+	reason    string
+	changed   chan struct{}
+}
+
+// NewAPWindow produces an APWindow keeping the AP up until configured.
+func NewAPWindow(wpa *WpaCfg) *APWindow {
+	return &APWindow{
+		Wpa:     wpa,
+		open:    true,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Configure applies cfg. A window of minutes is counted from now.
+func (a *APWindow) Configure(cfg APWindowCfg) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cfg = cfg
+	a.expires = time.Time{}
+	if cfg.Minutes > 0 && a.open {
+		a.expires = time.Now().Add(time.Duration(cfg.Minutes) * time.Minute)
+	}
+	if !cfg.CloseOnConnect {
+		a.connected = time.Time{}
+	}
+
+	a.notify()
+}
+
+// notify wakes Run to recompute when the AP closes. The caller holds mu.
+func (a *APWindow) notify() {
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the state of the window.
+func (a *APWindow) Status() APWindowStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := APWindowStatus{Enabled: a.cfg.enabled(), Open: a.open, Reason: a.reason}
+	if closes, reason := a.closes(); !closes.IsZero() {
+		status.Closes = &closes
+		status.Reason = reason
+	}
+
+	return status
+}
+
+// closes returns when and why the AP closes, zero if it stays up. The
+// caller holds mu.
+func (a *APWindow) closes() (time.Time, string) {
+	if !a.open {
+		return time.Time{}, ""
+	}
+
+	closes, reason := a.expires, APWindowExpired
+	if !a.connected.IsZero() && (closes.IsZero() || a.connected.Before(closes)) {
+		closes, reason = a.connected, APWindowConnected
+	}
+
+	return closes, reason
+}
+
+// Open brings the AP up for another window of minutes. The AP then only
+// closes on connect when the station connects again.
+func (a *APWindow) Open(ctx context.Context) (APWindowStatus, error) {
+	a.mu.Lock()
+	open := a.open
+	a.mu.Unlock()
+
+	// hostapd fails to enable an AP that is up
+	if !open {
+		if err := a.Wpa.hostapdCli(ctx, "enable"); err != nil {
+			return a.Status(), err
+		}
+	}
+
+	a.mu.Lock()
+	a.open = true
+	a.reason = ""
+	a.connected = time.Time{}
+	a.expires = time.Time{}
+	if a.cfg.Minutes > 0 {
+		a.expires = time.Now().Add(time.Duration(a.cfg.Minutes) * time.Minute)
+	}
+	a.notify()
+	a.mu.Unlock()
+
+	a.Wpa.Log.Info("ap window opened", "iface", a.Wpa.Cfg().APInterface, "minutes", a.cfg.Minutes)
+
+	return a.Status(), nil
+}
+
+// Close brings the AP down before its window ends.
+func (a *APWindow) Close(ctx context.Context) APWindowStatus {
+	a.mu.Lock()
+	open := a.open
+	a.mu.Unlock()
+
+	if open {
+		a.close(ctx, APWindowClosed)
+	}
+
+	return a.Status()
+}
+
+// Run closes the AP when its window ends, watching bus for the station
+// connecting and disconnecting, until ctx is done.
+func (a *APWindow) Run(ctx context.Context, bus *EventBus) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	// an AP disabled through the API stays down across restarts
+	if a.Wpa.State != nil && a.Wpa.State.State().APDisabled {
+		a.mu.Lock()
+		a.open = false
+		a.mu.Unlock()
+	}
+
+	// the station may have connected at boot, before the events were watched
+	if status, err := a.Wpa.wpaStatus(ctx); err == nil && status["wpa_state"] == "COMPLETED" {
+		a.stationConnected(true)
+	}
+
+	for {
+		a.mu.Lock()
+		closes, reason := a.closes()
+		a.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !closes.IsZero() {
+			timer = time.NewTimer(time.Until(closes))
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.changed:
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			a.handle(ev)
+		case <-expired:
+			a.close(ctx, reason)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// handle follows the station connecting and disconnecting, and the AP
+// going up or down through the API.
+func (a *APWindow) handle(ev Event) {
+	cfg := a.Wpa.Cfg()
+
+	switch {
+	case ev.Iface == cfg.StationInterface && (ev.Type == EventConnected || ev.Type == EventProvisioned):
+		a.stationConnected(true)
+	case ev.Iface == cfg.StationInterface && ev.Type == EventDisconnected:
+		a.stationConnected(false)
+	case ev.Iface == cfg.APInterface && (ev.Type == EventAPEnabled || ev.Type == EventAPDisabled):
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		// an AP toggled some other way has no window until opened
+		open := ev.Type == EventAPEnabled
+		if open != a.open {
+			a.open = open
+			a.expires = time.Time{}
+			a.connected = time.Time{}
+			a.reason = ""
+		}
+	}
+}
+
+// stationConnected starts the grace period when the station connects,
+// and calls it off if the station loses its network again before it
+// ends.
+func (a *APWindow) stationConnected(connected bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.cfg.CloseOnConnect || !a.open {
+		return
+	}
+
+	switch {
+	case connected && a.connected.IsZero():
+		a.connected = time.Now().Add(a.cfg.grace())
+		a.Wpa.Log.Info("ap window closing", "iface", a.Wpa.Cfg().APInterface, "reason", APWindowConnected, "grace", a.cfg.grace())
+	case !connected:
+		a.connected = time.Time{}
+	}
+}
+
+// close brings the AP down. It is not recorded as a toggle, so the AP is
+// back after a restart for a new window.
+func (a *APWindow) close(ctx context.Context, reason string) {
+	if err := a.Wpa.hostapdCli(ctx, "disable"); err != nil {
+		a.Wpa.Log.Error("could not close ap window", "iface", a.Wpa.Cfg().APInterface, "reason", reason, "error", err)
+	} else {
+		a.Wpa.Log.Info("ap window closed", "iface", a.Wpa.Cfg().APInterface, "reason", reason)
+	}
+
+	// failed or not, a closed window is not retried until opened again
+	a.mu.Lock()
+	a.open = false
+	a.reason = reason
+	a.expires = time.Time{}
+	a.connected = time.Time{}
+	a.notify()
+	a.mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package iotwifi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestAPWindowConnect connects the station under a window with and
+// without close_on_connect: only close_on_connect takes the AP down.
+func TestAPWindowConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    APWindowCfg
+		closed bool
+	}{
+		{"close on connect", APWindowCfg{CloseOnConnect: true, GraceSec: 1}, true},
+		{"stays up", APWindowCfg{CloseOnConnect: false, GraceSec: 1}, false},
+		{"no window", APWindowCfg{GraceSec: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newTestWpa(t)
+			defer cleanup()
+			runner.Outputs["hostapd_cli"] = "OK\n"
+
+			bus := NewEventBus()
+			window := NewAPWindow(wpa)
+			window.Configure(tt.cfg)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				window.Run(ctx, bus)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			// the window subscribes before it looks at the station
+			for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+				bus.mu.Lock()
+				subscribed := len(bus.subs) > 0
+				bus.mu.Unlock()
+				if subscribed {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("window never subscribed")
+				}
+			}
+			bus.Publish(Event{Type: EventConnected, Iface: wpa.Cfg().StationInterface})
+
+			// past the grace period
+			deadline := time.Now().Add(tt.cfg.grace() / 2 * 3)
+			for window.Status().Open && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			disabled := hasCall(runner, "hostapd_cli -i uap0 disable")
+			if open := window.Status().Open; open == tt.closed || disabled != tt.closed {
+				t.Errorf("open %t, disabled %t after the station connected, want closed %t", open, disabled, tt.closed)
+			}
+			if tt.closed && window.Status().Reason != APWindowConnected {
+				t.Errorf("closed for %q, want %q", window.Status().Reason, APWindowConnected)
+			}
+		})
+	}
+}
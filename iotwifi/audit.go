@@ -0,0 +1,230 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAuditFile is where provisioning actions are logged.
+const DefaultAuditFile = "/etc/txwifi/audit.log"
+
+// Audit log rotation defaults.
+const (
+	DefaultAuditMaxSizeKB = 1024
+	DefaultAuditMaxFiles  = 3
+)
+
+// Audit transports, for AuditEntry.Transport.
+const (
+	TransportHTTP   = "http"
+	TransportHTTPS  = "https"
+	TransportSocket = "socket" // the local unix socket, see cli.go
+	TransportSerial = "serial"
+	TransportMQTT   = "mqtt" // remote commands, see remote.go
+	TransportGRPC   = "grpc"
+)
+
+// AuditCfg configures the audit log and is used by SetupCfg.
+type AuditCfg struct {
+	Disabled  bool   `json:"disabled"`
+	File      string `json:"file"`        // /etc/txwifi/audit.log
+	MaxSizeKB int    `json:"max_size_kb"` // the log is rotated past this size, 1024 by default
+	MaxFiles  int    `json:"max_files"`   // rotated logs kept, audit.log.1 to audit.log.3 by default
+}
+
+// withDefaults fills in the file and rotation limits.
+func (c AuditCfg) withDefaults() AuditCfg {
+	if c.File == "" {
+		c.File = DefaultAuditFile
+	}
+	if c.MaxSizeKB == 0 {
+		c.MaxSizeKB = DefaultAuditMaxSizeKB
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = DefaultAuditMaxFiles
+	}
+
+	return c
+}
+
+// AuditEntry is one provisioning action: who asked, over what, for what,
+// and how it went. Secrets such as passphrases are never recorded.
+type AuditEntry struct {
+	Time      time.Time     `json:"time"`
+	Transport string        `json:"transport"`        // http, https, socket, serial, mqtt or grpc
+	Client    string        `json:"client,omitempty"` // the client address, the serial device or the mqtt broker
+	Mac       string        `json:"mac,omitempty"`    // the client MAC, for clients on the AP
+	Action    string        `json:"action"`           // connect, forget, ap/down, ...
+	Iface     string        `json:"iface,omitempty"`
+	Ssid      string        `json:"ssid,omitempty"`
+	Success   bool          `json:"success"`
+	Message   string        `json:"message,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Operation string        `json:"operation,omitempty"` // the id of its trace in /operations
+}
+
+// AuditQuery selects audit entries. Empty fields match everything, a
+// Limit of 0 returns every entry.
+type AuditQuery struct {
+	Action    string
+	Transport string
+	Ssid      string
+	Since     time.Time
+	Limit     int
+}
+
+// matches reports whether entry is selected by q.
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	return (q.Action == "" || entry.Action == q.Action) &&
+		(q.Transport == "" || entry.Transport == q.Transport) &&
+		(q.Ssid == "" || entry.Ssid == q.Ssid) &&
+		!entry.Time.Before(q.Since)
+}
+
+// AuditLog appends provisioning actions to a JSON lines file, rotating it
+// once it grows past the configured size, so operators can reconstruct
+// what happened to a unit. Entries are never rewritten.
+type AuditLog struct {
+	mu  sync.Mutex
+	cfg AuditCfg
+}
+
+// NewAuditLog produces an AuditLog writing as cfg says.
+func NewAuditLog(cfg AuditCfg) *AuditLog {
+	return &AuditLog{cfg: cfg.withDefaults()}
+}
+
+// Record appends entry to the log, rotating it first if it is full. It
+// does nothing when the log is disabled.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a.cfg.Disabled {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(a.cfg.File), 0755); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(a.cfg.File); err == nil && info.Size()+int64(len(line)) > int64(a.cfg.MaxSizeKB)*1024 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// ssids and client addresses are for operators only
+	f, err := os.OpenFile(a.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	return err
+}
+
+// rotate shifts audit.log to audit.log.1, audit.log.1 to audit.log.2 and
+// so on, dropping the oldest. The caller holds mu.
+func (a *AuditLog) rotate() error {
+	oldest := a.rotated(a.cfg.MaxFiles)
+	if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := a.cfg.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(a.cfg.File, a.rotated(1))
+}
+
+// rotated returns the name of the nth rotated log.
+func (a *AuditLog) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", a.cfg.File, n)
+}
+
+// Query returns the entries q selects, from the current and the rotated
+// logs, newest first.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// oldest first, then reversed
+	files := []string{}
+	for i := a.cfg.MaxFiles; i >= 1; i-- {
+		files = append(files, a.rotated(i))
+	}
+	files = append(files, a.cfg.File)
+
+	entries := []AuditEntry{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var entry AuditEntry
+			// a line cut short by a power loss is skipped
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+
+	return entries, nil
+}
+
+// NeighborMac returns the MAC of ip from the kernel's ARP table, or ""
+// when ip is not a neighbor, such as a client beyond the uplink.
+func NeighborMac(ip string) string {
+	data, err := ioutil.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == ip && fields[3] != "00:00:00:00:00:00" {
+			return fields[3]
+		}
+	}
+
+	return ""
+}
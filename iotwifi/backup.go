@@ -0,0 +1,45 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// BackupSuffix is appended to system config files saved before txwifi
+// first overwrites them.
+const BackupSuffix = ".txwifi.bak"
+
+// backupFile copies path to path+BackupSuffix, unless there is nothing
+// to back up or a backup already exists. The first backup is the
+// original, later writes are txwifi's own.
+func backupFile(path string) error {
+	backup := path + BackupSuffix
+	if _, err := os.Stat(backup); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(backup, data, info.Mode().Perm())
+}
+
+// restoreFile moves a backup made by backupFile back over path.
+func restoreFile(path string) error {
+	backup := path + BackupSuffix
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		return nil
+	}
+
+	return os.Rename(backup, path)
+}
@@ -0,0 +1,329 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Setup files looked for by the bootstrap, txwifi's own and the one
+// Raspberry Pi OS takes from the boot partition.
+const (
+	BootstrapSetupFile = "txwifi-setup.json"
+	BootstrapWpaFile   = "wpa_supplicant.conf"
+)
+
+// BootstrapArchiveSuffix is appended to a setup file once it is applied.
+const BootstrapArchiveSuffix = ".applied"
+
+// bootstrapApplyTimeout bounds the wait for wpa_supplicant to take the
+// networks of the setup files.
+const bootstrapApplyTimeout = 2 * time.Minute
+
+// DefaultBootstrapDirs are searched for setup files: the boot partition
+// and where USB sticks are mounted.
+var DefaultBootstrapDirs = []string{"/boot", "/boot/firmware", "/media/*", "/media/*/*", "/mnt/*", "/run/media/*/*"}
+
+// BootstrapCfg configures the setup files read at startup and is used by
+// SetupCfg.
+type BootstrapCfg struct {
+	Disabled bool     `json:"disabled"`
+	Dirs     []string `json:"dirs"`      // searched for setup files, glob patterns, DefaultBootstrapDirs if empty
+	KeepFile bool     `json:"keep_file"` // leave the file as it is rather than archive it, it is applied once all the same
+}
+
+// BootstrapFile is the form of txwifi-setup.json: networks, a bundle of
+// them exported from another device, or both.
+type BootstrapFile struct {
+	Networks   []Profile      `json:"networks"`
+	Bundle     *ProfileBundle `json:"bundle"`
+	Passphrase string         `json:"passphrase"` // of an encrypted bundle
+}
+
+// Bootstrap saves the networks of the setup files found on the boot
+// partition or a USB stick at startup, for headless devices, the way
+// Raspberry Pi OS takes wpa_supplicant.conf from its boot partition. A
+// file is archived once applied and, by its sum in the state, never
+// applied twice.
+type Bootstrap struct {
+	Wpa *WpaCfg
+	Cfg BootstrapCfg
+}
+
+// NewBootstrap produces a Bootstrap for the bootstrap config of wpa.
+func NewBootstrap(wpa *WpaCfg) *Bootstrap {
+	return &Bootstrap{Wpa: wpa, Cfg: wpa.Cfg().Bootstrap}
+}
+
+// Run applies the setup files, then waits for wpa_supplicant to take
+// their networks.
+func (b *Bootstrap) Run(ctx context.Context) {
+	if b.Cfg.Disabled {
+		return
+	}
+
+	if b.Apply() == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bootstrapApplyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		err := b.Wpa.ApplyProfiles(ctx)
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			b.Wpa.Log.Error("could not apply bootstrap networks", "iface", b.Wpa.Cfg().StationInterface, "error", err)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Apply saves the networks of the setup files not applied before and
+// returns how many were saved.
+func (b *Bootstrap) Apply() int {
+	wpa := b.Wpa
+
+	dirs := b.Cfg.Dirs
+	if len(dirs) == 0 {
+		dirs = DefaultBootstrapDirs
+	}
+
+	saved := 0
+	for _, pattern := range dirs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			wpa.Log.Warn("invalid bootstrap dir", "dir", pattern, "error", err)
+			continue
+		}
+
+		for _, dir := range matches {
+			for _, name := range []string{BootstrapSetupFile, BootstrapWpaFile} {
+				path := filepath.Join(dir, name)
+				if _, err := os.Stat(path); err != nil {
+					continue
+				}
+
+				n, err := b.applyFile(path)
+				if err != nil {
+					wpa.Log.Error("could not apply setup file", "path", path, "error", err)
+				}
+				saved += n
+			}
+		}
+	}
+
+	return saved
+}
+
+// applyFile saves the networks of the setup file in path, archives it and
+// returns how many were saved. A file that cannot be applied is left
+// where it is.
+func (b *Bootstrap) applyFile(path string) (int, error) {
+	wpa := b.Wpa
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if wpa.State != nil && wpa.State.Bootstrapped(digest) {
+		wpa.Log.Debug("setup file applied before", "path", path)
+		return 0, nil
+	}
+
+	var profiles []Profile
+	if filepath.Base(path) == BootstrapWpaFile {
+		profiles, err = parseWpaSupplicantConf(data)
+	} else {
+		profiles, err = parseSetupFile(data)
+	}
+
+	entry := HistoryEntry{Type: HistoryBootstrap, Message: path, Success: err == nil}
+	if err == nil {
+		err = wpa.Profiles.PutAll(profiles, false)
+		entry.Success = err == nil
+	}
+	if err != nil {
+		entry.Reason = err.Error()
+	}
+
+	ssids := []string{}
+	for _, profile := range profiles {
+		ssids = append(ssids, profile.Ssid)
+	}
+
+	// a broken file is not tried again either, a fixed one has another sum
+	if wpa.State != nil {
+		if err := wpa.State.SetBootstrapped(digest); err != nil {
+			wpa.Log.Warn("could not save state", "error", err)
+		}
+		if err := wpa.State.Record(entry); err != nil {
+			wpa.Log.Warn("could not save state", "error", err)
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !b.Cfg.KeepFile {
+		// the boot partition of a card may be read-only, the sum keeps
+		// the file from being applied again
+		if err := os.Rename(path, path+BootstrapArchiveSuffix); err != nil {
+			wpa.Log.Warn("could not archive setup file", "path", path, "error", err)
+		}
+	}
+
+	wpa.Log.Info("setup file applied", "path", path, "ssids", strings.Join(ssids, ","))
+	wpa.publish(Event{
+		Type:    EventBootstrapped,
+		Source:  "bootstrap",
+		Iface:   wpa.Cfg().StationInterface,
+		Message: fmt.Sprintf("file=%s ssids=%s", path, strings.Join(ssids, ",")),
+	})
+
+	return len(profiles), nil
+}
+
+// parseSetupFile returns the networks of a txwifi-setup.json.
+func parseSetupFile(data []byte) ([]Profile, error) {
+	var file BootstrapFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrConfig, err)
+	}
+
+	profiles := file.Networks
+	if file.Bundle != nil {
+		bundled, err := file.Bundle.Open(file.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, bundled...)
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%w: no networks", ErrConfig)
+	}
+
+	return profiles, nil
+}
+
+// parseWpaSupplicantConf returns the networks of the network blocks of a
+// wpa_supplicant.conf. Other settings, such as country, are left to the
+// config.
+func parseWpaSupplicantConf(data []byte) ([]Profile, error) {
+	profiles := []Profile{}
+
+	var profile *Profile
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if profile == nil {
+			if strings.HasPrefix(strings.Replace(text, " ", "", -1), "network={") {
+				profile = &Profile{}
+			}
+			continue
+		}
+
+		if text == "}" {
+			if profile.Ssid == "" {
+				return nil, fmt.Errorf("%w: line %d: network without an ssid", ErrConfig, line)
+			}
+			profiles = append(profiles, *profile)
+			profile = nil
+			continue
+		}
+
+		fields := strings.SplitN(text, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: line %d: want key=value", ErrConfig, line)
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+
+		quoted := len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"")
+		switch {
+		case quoted:
+			value = value[1 : len(value)-1]
+		case len(value) >= 3 && strings.HasPrefix(value, "P\"") && strings.HasSuffix(value, "\""):
+			// P"..." is quoted with escapes such as \x00
+			value, quoted = DecodeSsidText(value[2:len(value)-1]), true
+		}
+
+		switch key {
+		case "ssid":
+			// an unquoted ssid is hex
+			if !quoted {
+				ssid, err := hex.DecodeString(value)
+				if err != nil {
+					return nil, fmt.Errorf("%w: line %d: ssid is neither quoted nor hex", ErrConfig, line)
+				}
+				value = string(ssid)
+			}
+			profile.Ssid = value
+		case "psk":
+			profile.Psk = value
+		case "key_mgmt":
+			if value != KeyMgmtEap {
+				profile.KeyMgmt = value
+			}
+		case "scan_ssid":
+			profile.Hidden = value == "1"
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: priority is not a number", ErrConfig, line)
+			}
+			profile.Priority = priority
+		case "eap":
+			profile.EapMethod = value
+		case "identity":
+			profile.Identity = value
+		case "password":
+			profile.Password = value
+		case "phase2":
+			profile.Phase2 = value
+		case "ca_cert":
+			profile.CACert = value
+		case "client_cert":
+			profile.ClientCert = value
+		case "private_key":
+			profile.PrivateKey = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		return nil, fmt.Errorf("%w: network block not closed", ErrConfig)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%w: no network blocks", ErrConfig)
+	}
+
+	return profiles, nil
+}
@@ -0,0 +1,114 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Bridge defaults.
+const (
+	DefaultBridgeName      = "br0"
+	DefaultBridgeInterface = "eth0"
+)
+
+// BridgeCfg bridges the AP to a wired interface, so AP clients are on
+// the wired network and get their addresses from its DHCP server rather
+// than from dnsmasq. It is used by SetupCfg.
+type BridgeCfg struct {
+	Enabled    bool        `json:"enabled"`
+	Name       string      `json:"name"`        // br0 by default
+	Interface  string      `json:"interface"`   // eth0 by default
+	IP         StaticIPCfg `json:"ip"`          // static address for the bridge
+	DhcpClient string      `json:"dhcp_client"` // udhcpc, dhclient or dhcpcd, used without a static address
+}
+
+// BridgeStatus is the state of the bridge and its ports.
+type BridgeStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Name      string     `json:"name"`
+	Interface string     `json:"interface"`
+	Link      netif.Link `json:"link"`
+	Ports     []string   `json:"ports"` // eth0 and the AP interface once hostapd added it
+}
+
+// withDefaults fills in the bridge and interface names.
+func (b BridgeCfg) withDefaults() BridgeCfg {
+	if b.Name == "" {
+		b.Name = DefaultBridgeName
+	}
+	if b.Interface == "" {
+		b.Interface = DefaultBridgeInterface
+	}
+
+	return b
+}
+
+// setupBridge creates the bridge, adds the wired interface to it and
+// addresses it. hostapd adds the AP interface itself, from the bridge
+// option in hostapd.conf.
+func setupBridge(ctx context.Context, runner Runner, cfg BridgeCfg, resolvConf string) error {
+	if err := netif.AddBridge(cfg.Name); err != nil {
+		return err
+	}
+	if err := netif.SetMaster(cfg.Interface, cfg.Name); err != nil {
+		return err
+	}
+	if err := netif.SetUp(cfg.Interface); err != nil {
+		return err
+	}
+	if err := netif.SetUp(cfg.Name); err != nil {
+		return err
+	}
+
+	if cfg.IP.Enabled() {
+		return setStaticAddress(cfg.Name, cfg.IP, resolvConf)
+	}
+
+	return requestDhcp(ctx, runner, cfg.DhcpClient, cfg.Name)
+}
+
+// teardownBridge takes the wired interface out of the bridge and deletes
+// the bridge.
+func teardownBridge(cfg BridgeCfg) error {
+	if err := netif.SetMaster(cfg.Interface, ""); err != nil && !errors.Is(err, netif.ErrLinkNotFound) {
+		return err
+	}
+
+	err := netif.DeleteLink(cfg.Name)
+	if errors.Is(err, netif.ErrLinkNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// BridgeStatus returns the state of the bridge between the AP and the
+// wired interface.
+func (wpa *WpaCfg) BridgeStatus() (BridgeStatus, error) {
+	cfg := wpa.Cfg().Bridge
+	status := BridgeStatus{
+		Enabled:   cfg.Enabled,
+		Name:      cfg.Name,
+		Interface: cfg.Interface,
+		Ports:     []string{},
+	}
+	if !cfg.Enabled {
+		return status, nil
+	}
+
+	link, err := netif.LinkByName(cfg.Name)
+	if err != nil {
+		return status, err
+	}
+	status.Link = link
+
+	ports, err := netif.BridgePorts(cfg.Name)
+	if err != nil {
+		return status, err
+	}
+	status.Ports = ports
+
+	return status, nil
+}
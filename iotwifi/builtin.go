@@ -0,0 +1,132 @@
+package iotwifi
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/dns"
+)
+
+// builtinServers are the DHCP and DNS servers run in place of dnsmasq.
+type builtinServers struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startBuiltin starts the built-in DHCP and DNS servers on the AP
+// interface, replacing those already running. When one of them fails
+// both are stopped, for the supervisor to restart.
+func (c *Command) startBuiltin() error {
+	c.stopBuiltin()
+
+	cfg := c.Cfg()
+	start, end, leaseTime, err := dhcp.ParseRange(cfg.DnsmasqCfg.DhcpRange)
+	if err != nil {
+		return err
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.apAddress())
+	if err != nil {
+		return err
+	}
+	apIP := net.ParseIP(cfg.HostApdCfg.Ip)
+
+	dhcpServer, err := dhcp.NewServer(dhcp.ServerConfig{
+		Iface:        cfg.APInterface,
+		ServerIP:     apIP,
+		Mask:         subnet.Mask,
+		Start:        start,
+		End:          end,
+		LeaseTime:    leaseTime,
+		LeaseFile:    cfg.DnsmasqCfg.leaseFile(),
+		Reservations: cfg.DnsmasqCfg.Reservations,
+	}, c.Log)
+	if err != nil {
+		return err
+	}
+
+	rules := []dns.Rule{}
+	for _, address := range cfg.dnsAddresses() {
+		r, err := dns.ParseAddress(address)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r...)
+	}
+
+	dnsServer := &dns.Server{
+		Addr:   net.JoinHostPort(cfg.HostApdCfg.Ip, strconv.Itoa(dns.Port)),
+		Iface:  cfg.APInterface,
+		Rules:  rules,
+		Lookup: dhcpServer.Lookup,
+		Log:    c.Log,
+	}
+
+	// routed clients need names resolved upstream
+	if cfg.Router.Enabled {
+		dnsServer.Upstream = func() []string {
+			servers, err := dns.ResolvConfServers(cfg.resolvConf(), cfg.HostApdCfg.Ip)
+			if err != nil {
+				c.Log.Warn("no upstream dns servers", "path", cfg.resolvConf(), "error", err)
+			}
+			return servers
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	servers := &builtinServers{cancel: cancel, done: make(chan struct{})}
+
+	errs := make(chan error, 2)
+	go func() { errs <- dhcpServer.Run(ctx) }()
+	go func() { errs <- dnsServer.Run(ctx) }()
+	go func() {
+		defer close(servers.done)
+
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				c.Log.Error("built-in server failed", "iface", cfg.APInterface, "error", err)
+			}
+			cancel()
+		}
+	}()
+
+	c.mu.Lock()
+	c.builtin = servers
+	c.mu.Unlock()
+
+	return nil
+}
+
+// stopBuiltin stops the built-in servers and waits for them to return.
+func (c *Command) stopBuiltin() {
+	c.mu.Lock()
+	servers := c.builtin
+	c.builtin = nil
+	c.mu.Unlock()
+
+	if servers == nil {
+		return
+	}
+
+	servers.cancel()
+	<-servers.done
+}
+
+// builtinRunning reports whether the built-in servers are running.
+func (c *Command) builtinRunning() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.builtin == nil {
+		return false
+	}
+
+	select {
+	case <-c.builtin.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,220 @@
+package iotwifi
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ProfileBundleVersion is the format of the bundles ExportProfiles
+// produces. Newer bundles are refused rather than half imported.
+const ProfileBundleVersion = 1
+
+// Encryption of bundles, with a key derived from a passphrase rather than
+// the device secret, so another device can open them.
+const (
+	bundleKdf           = "pbkdf2-sha256"
+	bundleRounds        = 200000
+	maxBundleRounds     = 4 * bundleRounds // a bundle asking for more is refused, not derived for minutes
+	minBundlePassphrase = 8
+)
+
+// ProfileBundle is the saved networks of a device in a portable form, for
+// cloning them to another device or a replacement. The profiles hold
+// their secrets, so a bundle exported without a passphrase, which only
+// the API socket allows, must be kept as carefully as the passphrases
+// themselves.
+type ProfileBundle struct {
+	Version   int             `json:"version"`
+	Exported  time.Time       `json:"exported"`
+	DeviceId  string          `json:"device_id"`           // of the device it was exported from
+	Ssids     []string        `json:"ssids"`               // of the profiles, readable when they are encrypted
+	Profiles  []Profile       `json:"profiles,omitempty"`  // without a passphrase
+	Encrypted *SealedProfiles `json:"encrypted,omitempty"` // with a passphrase
+}
+
+// SealedProfiles are the profiles of a bundle encrypted with a key derived
+// from a passphrase.
+type SealedProfiles struct {
+	Cipher string `json:"cipher"` // aes-256-gcm
+	Kdf    string `json:"kdf"`    // pbkdf2-sha256
+	Rounds int    `json:"rounds"`
+	Salt   []byte `json:"salt"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// ProfileExport asks for the saved networks as a bundle.
+type ProfileExport struct {
+	Passphrase string `json:"passphrase"` // encrypts the profiles, at least 8 characters, plain if empty over the API socket
+}
+
+// ProfileImport saves the networks of a bundle.
+type ProfileImport struct {
+	Bundle     ProfileBundle `json:"bundle"`
+	Passphrase string        `json:"passphrase"` // of an encrypted bundle
+	Replace    bool          `json:"replace"`    // drop the saved networks the bundle does not have
+}
+
+// ProfileImportResult is what an import changed.
+type ProfileImportResult struct {
+	Imported []string `json:"imported"` // ssids saved from the bundle
+	Removed  []string `json:"removed"`  // ssids dropped with replace
+}
+
+// ExportProfiles returns the saved networks as a bundle, encrypted with
+// passphrase. Only with plain, for the API socket whose clients can read
+// the profiles file anyway, is an empty passphrase a bundle in plain.
+func (wpa *WpaCfg) ExportProfiles(passphrase string, plain bool) (ProfileBundle, error) {
+	if passphrase == "" && !plain {
+		return ProfileBundle{}, fmt.Errorf("%w: a passphrase is required, bundles are only exported in plain over the API socket", ErrInvalid)
+	}
+
+	profiles := wpa.Profiles.List()
+
+	bundle := ProfileBundle{
+		Version:  ProfileBundleVersion,
+		Exported: time.Now().UTC(),
+		Ssids:    []string{},
+	}
+	if identity, err := wpa.Identity(); err == nil {
+		bundle.DeviceId = identity.DeviceId
+	}
+	for _, profile := range profiles {
+		bundle.Ssids = append(bundle.Ssids, profile.Ssid)
+	}
+
+	if passphrase == "" {
+		bundle.Profiles = profiles
+		wpa.Log.Warn("profiles exported without a passphrase", "profiles", len(profiles))
+		return bundle, nil
+	}
+	if len(passphrase) < minBundlePassphrase {
+		return ProfileBundle{}, fmt.Errorf("%w: the bundle passphrase must be at least %d characters", ErrInvalid, minBundlePassphrase)
+	}
+
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return ProfileBundle{}, err
+	}
+
+	sealed := &SealedProfiles{Cipher: credentialsCipher, Kdf: bundleKdf, Rounds: bundleRounds, Salt: make([]byte, 16)}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return ProfileBundle{}, err
+	}
+
+	aead, err := sealed.aead(passphrase)
+	if err != nil {
+		return ProfileBundle{}, err
+	}
+
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return ProfileBundle{}, err
+	}
+	sealed.Data = aead.Seal(nil, sealed.Nonce, data, nil)
+	bundle.Encrypted = sealed
+
+	wpa.Log.Info("profiles exported", "profiles", len(profiles))
+
+	return bundle, nil
+}
+
+// aead derives the key of s from passphrase.
+func (s *SealedProfiles) aead(passphrase string) (cipher.AEAD, error) {
+	if s.Cipher != credentialsCipher || s.Kdf != bundleKdf {
+		return nil, fmt.Errorf("unknown encryption %s with %s", s.Cipher, s.Kdf)
+	}
+	if s.Rounds < 1 || len(s.Salt) == 0 {
+		return nil, errors.New("no key derivation rounds or salt")
+	}
+	if s.Rounds > maxBundleRounds {
+		return nil, fmt.Errorf("%d key derivation rounds, at most %d are allowed", s.Rounds, maxBundleRounds)
+	}
+
+	block, err := aes.NewCipher(pbkdf2(sha256.New, []byte(passphrase), s.Salt, s.Rounds, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Open returns the profiles of b, decrypting them with passphrase.
+func (b ProfileBundle) Open(passphrase string) ([]Profile, error) {
+	if b.Version < 1 || b.Version > ProfileBundleVersion {
+		return nil, fmt.Errorf("%w: bundle version %d, want 1-%d", ErrInvalid, b.Version, ProfileBundleVersion)
+	}
+	if b.Encrypted == nil {
+		return b.Profiles, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("%w: the bundle is encrypted, give its passphrase", ErrInvalid)
+	}
+
+	aead, err := b.Encrypted.aead(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	if len(b.Encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: the bundle nonce is %d bytes, want %d", ErrInvalid, len(b.Encrypted.Nonce), aead.NonceSize())
+	}
+
+	data, err := aead.Open(nil, b.Encrypted.Nonce, b.Encrypted.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decrypt the bundle, wrong passphrase", ErrInvalid)
+	}
+
+	profiles := []Profile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%w: bundle: %s", ErrInvalid, err)
+	}
+
+	return profiles, nil
+}
+
+// ImportProfiles saves the profiles of req's bundle, replacing saved ones
+// with the same ssids, and applies them to wpa_supplicant. None is saved
+// unless all are valid. With replace the saved networks the bundle does
+// not have are forgotten.
+func (wpa *WpaCfg) ImportProfiles(ctx context.Context, req ProfileImport) (ProfileImportResult, error) {
+	result := ProfileImportResult{Imported: []string{}, Removed: []string{}}
+
+	profiles, err := req.Bundle.Open(req.Passphrase)
+	if err != nil {
+		return result, err
+	}
+
+	imported := map[string]bool{}
+	for _, profile := range profiles {
+		imported[profile.Ssid] = true
+		result.Imported = append(result.Imported, profile.Ssid)
+	}
+	if req.Replace {
+		for _, profile := range wpa.Profiles.List() {
+			if !imported[profile.Ssid] {
+				result.Removed = append(result.Removed, profile.Ssid)
+			}
+		}
+	}
+
+	if err := wpa.Profiles.PutAll(profiles, req.Replace); err != nil {
+		return ProfileImportResult{}, err
+	}
+
+	wpa.Log.Info("profiles imported", "device_id", req.Bundle.DeviceId, "imported", len(result.Imported), "removed", len(result.Removed))
+
+	for _, ssid := range result.Removed {
+		if err := wpa.RemoveNetwork(ctx, ssid); err != nil && !errors.Is(err, ErrNotConfigured) {
+			return result, err
+		}
+	}
+
+	return result, wpa.ApplyProfiles(ctx)
+}
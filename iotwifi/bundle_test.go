@@ -0,0 +1,162 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// newBundleWpa produces a WpaCfg with two saved networks.
+func newBundleWpa(t *testing.T) (*WpaCfg, func()) {
+	t.Helper()
+
+	wpa, _, cleanup := newTestWpa(t)
+
+	profiles, err := NewProfileStore(filepath.Join(filepath.Dir(wpa.Cfg().HostApdCfg.ConfFile), "profiles.json"), nil)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	wpa.Profiles = profiles
+
+	for _, profile := range []Profile{
+		{WpaCredentials: WpaCredentials{Ssid: "home", Psk: "home passphrase"}, Priority: 2},
+		{WpaCredentials: WpaCredentials{Ssid: "warehouse", Psk: "warehouse passphrase"}},
+	} {
+		if err := wpa.Profiles.Put(profile); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	return wpa, cleanup
+}
+
+func TestExportProfiles(t *testing.T) {
+	wpa, cleanup := newBundleWpa(t)
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		passphrase string
+		plain      bool
+		err        error
+		encrypted  bool
+	}{
+		{name: "encrypted", passphrase: "fleet bundle secret", encrypted: true},
+		{name: "encrypted over the socket", passphrase: "fleet bundle secret", plain: true, encrypted: true},
+		{name: "plain over the socket", plain: true},
+		{name: "plain over the network", err: ErrInvalid},
+		{name: "short passphrase", passphrase: "short", err: ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, err := wpa.ExportProfiles(tt.passphrase, tt.plain)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err %v, want %v", err, tt.err)
+				}
+				if len(bundle.Profiles) > 0 || bundle.Encrypted != nil {
+					t.Errorf("a refused export returned profiles %+v", bundle)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bundle.Ssids) != 2 {
+				t.Errorf("ssids %q, want home and warehouse", bundle.Ssids)
+			}
+			if got := bundle.Encrypted != nil; got != tt.encrypted {
+				t.Errorf("encrypted %t, want %t", got, tt.encrypted)
+			}
+			if tt.encrypted && len(bundle.Profiles) > 0 {
+				t.Errorf("an encrypted bundle holds plain profiles")
+			}
+
+			profiles, err := bundle.Open(tt.passphrase)
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+			if len(profiles) != 2 || profiles[0].Psk == "" {
+				t.Errorf("opened profiles %+v", profiles)
+			}
+		})
+	}
+}
+
+func TestOpenBundle(t *testing.T) {
+	wpa, cleanup := newBundleWpa(t)
+	defer cleanup()
+
+	const passphrase = "fleet bundle secret"
+	bundle, err := wpa.ExportProfiles(passphrase, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rounds := func(n int) ProfileBundle {
+		b := bundle
+		sealed := *bundle.Encrypted
+		sealed.Rounds = n
+		b.Encrypted = &sealed
+		return b
+	}
+	newer := bundle
+	newer.Version = ProfileBundleVersion + 1
+
+	tests := []struct {
+		name       string
+		bundle     ProfileBundle
+		passphrase string
+	}{
+		{name: "wrong passphrase", bundle: bundle, passphrase: "not the passphrase"},
+		{name: "no passphrase", bundle: bundle},
+		{name: "newer version", bundle: newer, passphrase: passphrase},
+		{name: "no rounds", bundle: rounds(0), passphrase: passphrase},
+		{name: "too many rounds", bundle: rounds(maxBundleRounds + 1), passphrase: passphrase},
+		// derived for days were it not refused first
+		{name: "absurd rounds", bundle: rounds(1 << 40), passphrase: passphrase},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.bundle.Open(tt.passphrase); !errors.Is(err, ErrInvalid) {
+				t.Fatalf("err %v, want ErrInvalid", err)
+			}
+		})
+	}
+
+	if _, err := rounds(maxBundleRounds).Open(passphrase); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other rounds than the bundle was sealed with opened it: %v", err)
+	}
+}
+
+func TestImportProfiles(t *testing.T) {
+	wpa, cleanup := newBundleWpa(t)
+	defer cleanup()
+
+	bundle, err := wpa.ExportProfiles("fleet bundle secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wpa.Profiles.Put(Profile{WpaCredentials: WpaCredentials{Ssid: "cafe", Psk: "cafe passphrase"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := ProfileImport{Bundle: bundle, Passphrase: "fleet bundle secret", Replace: true}
+	result, err := wpa.ImportProfiles(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Imported) != 2 || len(result.Removed) != 1 || result.Removed[0] != "cafe" {
+		t.Errorf("result %+v, want home and warehouse imported and cafe removed", result)
+	}
+	if _, err := wpa.Profiles.Get("cafe"); err == nil {
+		t.Error("cafe kept with replace")
+	}
+}
@@ -0,0 +1,383 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Interface modes of iw phy.
+const (
+	ModeManaged = "managed"
+	ModeAP      = "AP"
+)
+
+var (
+	// wiphyR matches the "wiphy 0" line of iw dev info.
+	wiphyR = regexp.MustCompile(`^\s*wiphy (\d+)`)
+
+	// phyFreqR matches a channel of iw phy info,
+	// "* 5260 MHz [52] (20.0 dBm) (no IR, radar detection)".
+	phyFreqR = regexp.MustCompile(`^\*\s+(\d+)(?:\.\d+)? MHz \[(\d+)\](.*)$`)
+
+	// comboGroupR matches an interface group of a combination,
+	// "#{ AP, mesh point } <= 1".
+	comboGroupR = regexp.MustCompile(`#\{\s*([^}]*)\}\s*<=\s*(\d+)`)
+
+	comboTotalR    = regexp.MustCompile(`total\s*<=\s*(\d+)`)
+	comboChannelsR = regexp.MustCompile(`#channels\s*<=\s*(\d+)`)
+	maxAPStationsR = regexp.MustCompile(`Maximum associated stations in AP mode:\s*(\d+)`)
+)
+
+// CapabilitiesCfg configures the startup check of the config against what
+// the radios support and is used by SetupCfg.
+type CapabilitiesCfg struct {
+	Disabled bool `json:"disabled"`  // do not check at startup
+	WarnOnly bool `json:"warn_only"` // log what the radios do not support and start anyway
+}
+
+// PhyChannel is a channel a radio knows of.
+type PhyChannel struct {
+	Channel   int    `json:"channel"`
+	Frequency int    `json:"frequency"`           // MHz
+	Disabled  bool   `json:"disabled,omitempty"`  // not allowed in the regulatory domain
+	NoIR      bool   `json:"no_ir,omitempty"`     // no initiating radiation, so no AP
+	Radar     bool   `json:"radar,omitempty"`     // DFS, the AP waits for a channel availability check
+	MaxPower  string `json:"max_power,omitempty"` // 20.0 dBm
+}
+
+// PhyBand is a band of a radio and the standards it supports on it.
+type PhyBand struct {
+	Band     string       `json:"band"` // 2.4GHz, 5GHz or 6GHz
+	HT       bool         `json:"ht"`   // 802.11n
+	VHT      bool         `json:"vht"`  // 802.11ac
+	HE       bool         `json:"he"`   // 802.11ax
+	Channels []PhyChannel `json:"channels"`
+}
+
+// PhyCapabilities are what a radio supports, from iw phy info.
+type PhyCapabilities struct {
+	Phy           string    `json:"phy"`    // phy0
+	Ifaces        []string  `json:"ifaces"` // the configured interfaces on it
+	Modes         []string  `json:"modes"`  // managed, AP, monitor, P2P-GO, ...
+	APSTA         bool      `json:"ap_sta"` // runs an AP and a station at once
+	APSTAChannels int       `json:"ap_sta_channels"`
+	MaxAPStations int       `json:"max_ap_stations"` // 0 if the driver does not say
+	Bands         []PhyBand `json:"bands"`
+}
+
+// CapabilityReport is what the radios support and what of the config
+// they do not.
+type CapabilityReport struct {
+	Radios   []PhyCapabilities `json:"radios"`
+	Problems []FieldError      `json:"problems"`
+}
+
+// band returns the band named band, nil if the radio lacks it.
+func (p PhyCapabilities) band(band string) *PhyBand {
+	for i := range p.Bands {
+		if p.Bands[i].Band == band {
+			return &p.Bands[i]
+		}
+	}
+
+	return nil
+}
+
+// channel returns channel in band, nil if the radio lacks it.
+func (b PhyBand) channel(channel int) *PhyChannel {
+	for i := range b.Channels {
+		if b.Channels[i].Channel == channel {
+			return &b.Channels[i]
+		}
+	}
+
+	return nil
+}
+
+// Capabilities probes the radios of the station, AP and radio
+// interfaces with iw. Interfaces on the same radio share an entry. The
+// AP interface, added at startup on the station's radio unless
+// ap_dedicated, is looked up only when it has a radio of its own.
+func (wpa *WpaCfg) Capabilities(ctx context.Context) ([]PhyCapabilities, error) {
+	cfg := wpa.Cfg()
+
+	ifaces := wpa.stationInterfaces()
+	if cfg.APDedicated {
+		ifaces = append(ifaces, cfg.APInterface)
+	}
+
+	phys := []PhyCapabilities{}
+	for _, iface := range ifaces {
+		phy, err := wpa.phyOf(ctx, iface)
+		if err != nil {
+			return phys, err
+		}
+
+		found := false
+		for i := range phys {
+			if phys[i].Phy == phy {
+				phys[i].Ifaces = append(phys[i].Ifaces, iface)
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+
+		out, err := wpa.Runner.Output(ctx, "iw", "phy", phy, "info")
+		if err != nil {
+			return phys, fmt.Errorf("%w: iw phy %s info: %s", ErrCommandFailed, phy, err)
+		}
+		caps := parsePhyInfo(out)
+		caps.Phy = phy
+		caps.Ifaces = []string{iface}
+		phys = append(phys, caps)
+	}
+
+	return phys, nil
+}
+
+// CapabilityReport probes the radios and checks the config against them.
+func (wpa *WpaCfg) CapabilityReport(ctx context.Context) (CapabilityReport, error) {
+	phys, err := wpa.Capabilities(ctx)
+	if err != nil {
+		return CapabilityReport{}, err
+	}
+
+	return CapabilityReport{Radios: phys, Problems: wpa.CheckCapabilities(phys)}, nil
+}
+
+// phyOf returns the radio of iface, phy0.
+func (wpa *WpaCfg) phyOf(ctx context.Context, iface string) (string, error) {
+	out, err := wpa.Runner.Output(ctx, "iw", "dev", iface, "info")
+	if err != nil {
+		return "", fmt.Errorf("%w: iw dev %s info: %s", ErrCommandFailed, iface, err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := wiphyR.FindStringSubmatch(line); m != nil {
+			return "phy" + m[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: no wiphy for %s", ErrCommandFailed, iface)
+}
+
+// parsePhyInfo parses the output of iw phy info.
+func parsePhyInfo(out []byte) PhyCapabilities {
+	caps := PhyCapabilities{Modes: []string{}, Bands: []PhyBand{}}
+
+	var band *PhyBand
+	section := ""
+	combo := ""
+	combos := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		depth := len(raw) - len(strings.TrimLeft(raw, "\t"))
+
+		// the sections of a phy are one tab in, their lines deeper
+		if depth <= 1 {
+			if combo != "" {
+				combos = append(combos, combo)
+				combo = ""
+			}
+			band = nil
+			section = line
+
+			if strings.HasPrefix(line, "Band ") {
+				caps.Bands = append(caps.Bands, PhyBand{Channels: []PhyChannel{}})
+				band = &caps.Bands[len(caps.Bands)-1]
+			}
+			if m := maxAPStationsR.FindStringSubmatch(line); m != nil {
+				caps.MaxAPStations, _ = strconv.Atoi(m[1])
+			}
+			continue
+		}
+
+		switch {
+		case band != nil:
+			parseBandLine(band, line)
+		case section == "Supported interface modes:":
+			if strings.HasPrefix(line, "* ") {
+				caps.Modes = append(caps.Modes, strings.TrimPrefix(line, "* "))
+			}
+		case section == "valid interface combinations:":
+			// a combination starts with * and may continue on the next lines
+			if strings.HasPrefix(line, "* ") && combo != "" {
+				combos = append(combos, combo)
+				combo = ""
+			}
+			combo += " " + line
+		}
+	}
+	if combo != "" {
+		combos = append(combos, combo)
+	}
+
+	for _, combo := range combos {
+		if channels, ok := apstaCombo(combo); ok {
+			caps.APSTA = true
+			if channels > caps.APSTAChannels {
+				caps.APSTAChannels = channels
+			}
+		}
+	}
+
+	for i := range caps.Bands {
+		if len(caps.Bands[i].Channels) > 0 {
+			_, caps.Bands[i].Band = FrequencyChannel(caps.Bands[i].Channels[0].Frequency)
+		}
+	}
+
+	return caps
+}
+
+// parseBandLine parses a line of a Band section of iw phy info.
+func parseBandLine(band *PhyBand, line string) {
+	switch {
+	case strings.HasPrefix(line, "HT20") || strings.HasPrefix(line, "HT Max RX"):
+		band.HT = true
+	case strings.HasPrefix(line, "VHT Capabilities"):
+		band.VHT = true
+	case strings.HasPrefix(line, "HE Iftypes") || strings.HasPrefix(line, "HE MAC Capabilities"):
+		band.HE = true
+	}
+
+	m := phyFreqR.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	freq, _ := strconv.Atoi(m[1])
+	channel, _ := strconv.Atoi(m[2])
+	flags := m[3]
+	ch := PhyChannel{
+		Channel:   channel,
+		Frequency: freq,
+		Disabled:  strings.Contains(flags, "disabled"),
+		NoIR:      strings.Contains(flags, "no IR") || strings.Contains(flags, "passive scan"),
+		Radar:     strings.Contains(flags, "radar detection"),
+	}
+	if i := strings.Index(flags, " dBm)"); i > 0 {
+		if j := strings.LastIndex(flags[:i], "("); j >= 0 {
+			ch.MaxPower = flags[j+1:i] + " dBm"
+		}
+	}
+	band.Channels = append(band.Channels, ch)
+}
+
+// apstaCombo reports whether an interface combination of iw phy info,
+// "* #{ managed } <= 1, #{ AP } <= 1, total <= 2, #channels <= 1",
+// allows a station and an AP at once, and on how many channels.
+func apstaCombo(combo string) (int, bool) {
+	total := 0
+	if m := comboTotalR.FindStringSubmatch(combo); m != nil {
+		total, _ = strconv.Atoi(m[1])
+	}
+	channels := 1
+	if m := comboChannelsR.FindStringSubmatch(combo); m != nil {
+		channels, _ = strconv.Atoi(m[1])
+	}
+	if total < 2 {
+		return 0, false
+	}
+
+	// a station and an AP in separate groups, or in one that takes two
+	managed, ap := -1, -1
+	for i, m := range comboGroupR.FindAllStringSubmatch(combo, -1) {
+		limit, _ := strconv.Atoi(m[2])
+		modes := strings.Split(m[1], ",")
+		for j := range modes {
+			modes[j] = strings.TrimSpace(modes[j])
+		}
+
+		if contains(modes, ModeManaged) && contains(modes, ModeAP) && limit >= 2 {
+			return channels, true
+		}
+		if contains(modes, ModeManaged) {
+			managed = i
+		}
+		if contains(modes, ModeAP) {
+			ap = i
+		}
+	}
+
+	return channels, managed >= 0 && ap >= 0 && managed != ap
+}
+
+// CheckCapabilities checks the config against what the radios support:
+// an AP at all, an AP beside the station on a shared radio, and the band,
+// channel, standards and station limit of the AP. The problems are
+// returned as ConfigErrors, so hostapd is not left to fail on them.
+func (wpa *WpaCfg) CheckCapabilities(phys []PhyCapabilities) ConfigErrors {
+	cfg := wpa.Cfg()
+	errs := ConfigErrors{}
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// the AP runs on its own radio or on the station's
+	apIface := cfg.StationInterface
+	if cfg.APDedicated {
+		apIface = cfg.APInterface
+	}
+
+	var phy *PhyCapabilities
+	for i := range phys {
+		if contains(phys[i].Ifaces, apIface) {
+			phy = &phys[i]
+		}
+	}
+	if phy == nil {
+		return errs
+	}
+
+	if !contains(phy.Modes, ModeAP) {
+		fail("ap_interface", "the radio %s of %s does not support AP mode", phy.Phy, apIface)
+		return errs
+	}
+	if !cfg.APDedicated && !phy.APSTA {
+		fail("ap_dedicated", "the radio %s of %s cannot run an AP and a station at once, give the AP a radio of its own", phy.Phy, apIface)
+	}
+
+	ap := cfg.HostApdCfg.withDefaults()
+	band := phy.band(ap.Band)
+	if band == nil {
+		fail("host_apd_cfg.band", "the radio %s does not support %s", phy.Phy, ap.Band)
+		return errs
+	}
+
+	if channel, err := strconv.Atoi(ap.Channel); err == nil {
+		switch ch := band.channel(channel); {
+		case ch == nil:
+			fail("host_apd_cfg.channel", "the radio %s has no channel %d on %s", phy.Phy, channel, ap.Band)
+		case ch.Disabled:
+			fail("host_apd_cfg.channel", "channel %d is disabled in the regulatory domain, check country", channel)
+		case ch.NoIR:
+			fail("host_apd_cfg.channel", "channel %d does not allow an AP (no IR) in the regulatory domain, check country", channel)
+		}
+	}
+
+	if ap.Ieee80211n && !band.HT {
+		fail("host_apd_cfg.ieee80211n", "the radio %s does not support 802.11n on %s", phy.Phy, ap.Band)
+	}
+	if ap.Ieee80211ac && !band.VHT {
+		fail("host_apd_cfg.ieee80211ac", "the radio %s does not support 802.11ac on %s", phy.Phy, ap.Band)
+	}
+	if ap.Ieee80211ax && !band.HE {
+		fail("host_apd_cfg.ieee80211ax", "the radio %s does not support 802.11ax on %s", phy.Phy, ap.Band)
+	}
+	if phy.MaxAPStations > 0 && ap.MaxNumSta > phy.MaxAPStations {
+		fail("host_apd_cfg.max_num_sta", "the radio %s takes at most %d stations", phy.Phy, phy.MaxAPStations)
+	}
+
+	return errs
+}
@@ -0,0 +1,92 @@
+package iotwifi
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CaptivePortalCfg configures the captive portal served while the AP is up.
+type CaptivePortalCfg struct {
+	Enabled   bool   `json:"enabled"`
+	Listen    string `json:"listen"`     // :80
+	PortalUrl string `json:"portal_url"` // http://192.168.27.1/
+	WebRoot   string `json:"web_root"`   // static setup page served at the portal url
+}
+
+// connectivityChecks are the paths phones and laptops probe to decide
+// whether a network has a captive portal.
+var connectivityChecks = map[string]bool{
+	"/generate_204":              true, // Android, Chrome OS
+	"/gen_204":                   true,
+	"/hotspot-detect.html":       true, // Apple
+	"/library/test/success.html": true,
+	"/ncsi.txt":                  true, // Windows
+	"/connecttest.txt":           true,
+	"/redirect":                  true,
+	"/success.txt":               true, // Firefox
+	"/canonical.html":            true, // Ubuntu
+}
+
+// CaptivePortal answers connectivity checks and requests for foreign
+// hosts with a redirect to the setup page, so phones joining the AP open
+// it automatically. dnsmasq resolves every name to the AP address while
+// the portal is enabled, so all plain HTTP traffic lands here.
+type CaptivePortal struct {
+	portalUrl string
+	apIp      string
+	files     http.Handler
+}
+
+// NewCaptivePortal produces a CaptivePortal for the setup config.
+func NewCaptivePortal(setupCfg *SetupCfg) *CaptivePortal {
+	cfg := setupCfg.CaptivePortal
+
+	portal := &CaptivePortal{
+		portalUrl: cfg.PortalUrl,
+		apIp:      setupCfg.HostApdCfg.Ip,
+	}
+
+	if portal.portalUrl == "" {
+		portal.portalUrl = "http://" + portal.apIp + "/"
+	}
+
+	if cfg.WebRoot != "" {
+		portal.files = http.FileServer(http.Dir(cfg.WebRoot))
+	}
+
+	return portal
+}
+
+// ListenAddr returns the configured listen address, :80 by default.
+func (c CaptivePortalCfg) ListenAddr() string {
+	if c.Listen == "" {
+		return ":80"
+	}
+
+	return c.Listen
+}
+
+// ServeHTTP implements http.Handler.
+func (p *CaptivePortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	local := host == p.apIp || strings.HasPrefix(p.portalUrl, "http://"+r.Host+"/")
+
+	if local && p.files != nil && !connectivityChecks[r.URL.Path] {
+		p.files.ServeHTTP(w, r)
+		return
+	}
+
+	// avoid a redirect loop when the portal url is ourselves without a web root
+	if local && !connectivityChecks[r.URL.Path] {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.Redirect(w, r, p.portalUrl, http.StatusFound)
+}
@@ -0,0 +1,189 @@
+// Package cfgfile decodes configuration files written in JSON, YAML or
+// TOML into the same generic form, a map of json.Number, string, bool,
+// nil, []interface{} and map[string]interface{} values, together with the
+// line every field is on. The YAML and TOML decoders cover what
+// configuration files use: nested mappings or tables, lists, quoted and
+// multi-line strings, numbers, booleans and comments. YAML anchors, tags
+// and multiple documents are not supported.
+
+package cfgfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Formats of a configuration file.
+const (
+	JSON = "json"
+	YAML = "yaml"
+	TOML = "toml"
+)
+
+// Lines maps the path of every field, such as host_apd_cfg.ssid or
+// dnsmasq_cfg.reservations[0].mac, to the line it is on.
+type Lines map[string]int
+
+// SyntaxError is a file that could not be decoded.
+type SyntaxError struct {
+	Format string
+	Line   int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s syntax error on line %d: %s", e.Format, e.Line, e.Msg)
+}
+
+// Detect returns the format of a file from its name, such as a path or a
+// URL path, then its content type, then its content. Unrecognized files
+// are YAML unless they look like JSON or TOML.
+func Detect(name string, contentType string, data []byte) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return JSON
+	case ".yaml", ".yml":
+		return YAML
+	case ".toml":
+		return TOML
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch {
+		case strings.HasSuffix(mediaType, "json"):
+			return JSON
+		case strings.HasSuffix(mediaType, "yaml"):
+			return YAML
+		case strings.HasSuffix(mediaType, "toml"):
+			return TOML
+		}
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return JSON
+	}
+
+	// TOML starts with a [table] or has key = value lines
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return TOML
+		}
+		if eq := strings.Index(line, "="); eq > 0 && !strings.Contains(line[:eq], ":") {
+			return TOML
+		}
+		break
+	}
+
+	return YAML
+}
+
+// Decode decodes data, a configuration file in format, into a map.
+func Decode(data []byte, format string) (map[string]interface{}, Lines, error) {
+	switch format {
+	case JSON:
+		return decodeJSON(data)
+	case YAML:
+		return decodeYAML(data)
+	case TOML:
+		return decodeTOML(data)
+	}
+
+	return nil, nil, fmt.Errorf("unsupported config format %q", format)
+}
+
+// decodeJSON decodes a JSON object, keeping numbers as json.Number.
+func decodeJSON(data []byte) (map[string]interface{}, Lines, error) {
+	lines := Lines{}
+
+	// the lines found before a syntax error are still useful
+	walkJSON(json.NewDecoder(bytes.NewReader(data)), data, "", lines)
+
+	cfg := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cfg); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, lines, &SyntaxError{Format: JSON, Line: line, Msg: syntaxErr.Error()}
+		}
+		return nil, lines, &SyntaxError{Format: JSON, Line: 1, Msg: err.Error()}
+	}
+
+	return cfg, lines, nil
+}
+
+// walkJSON records the lines of the value at path and everything in it.
+func walkJSON(dec *json.Decoder, data []byte, path string, lines Lines) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			field, _ := keyTok.(string)
+			if path != "" {
+				field = path + "." + field
+			}
+			lines[field] = lineAt(data, dec.InputOffset())
+
+			if err := walkJSON(dec, data, field, lines); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			elem := fmt.Sprintf("%s[%d]", path, i)
+			lines[elem] = lineAt(data, dec.InputOffset())
+
+			if err := walkJSON(dec, data, elem, lines); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// lineAt returns the line of the next token at or after offset.
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// fieldPath joins a field to the path of the mapping or table it is in.
+func fieldPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
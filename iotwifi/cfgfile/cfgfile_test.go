@@ -0,0 +1,375 @@
+package cfgfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// render returns a decoded value as JSON with sorted keys, numbers as
+// their text, for comparing decoded files.
+func render(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case json.Number:
+		return string(v)
+	case []interface{}:
+		elems := []string{}
+		for _, elem := range v {
+			elems = append(elems, render(elem))
+		}
+		return "[" + strings.Join(elems, ",") + "]"
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		elems := []string{}
+		for _, key := range keys {
+			elems = append(elems, render(key)+":"+render(v[key]))
+		}
+		return "{" + strings.Join(elems, ",") + "}"
+	}
+
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// checkDecoded fails t unless cfg holds only the generic values and lines
+// only lines of data.
+func checkDecoded(t *testing.T, data []byte, cfg map[string]interface{}, lines Lines) {
+	t.Helper()
+
+	var check func(value interface{})
+	check = func(value interface{}) {
+		switch v := value.(type) {
+		case nil, bool, string:
+		case json.Number:
+			if v == "" {
+				t.Fatal("decoded an empty number")
+			}
+		case []interface{}:
+			for _, elem := range v {
+				check(elem)
+			}
+		case map[string]interface{}:
+			for _, elem := range v {
+				check(elem)
+			}
+		default:
+			t.Fatalf("decoded a %T", value)
+		}
+	}
+	check(cfg)
+
+	count := bytes.Count(data, []byte("\n")) + 1
+	for field, line := range lines {
+		if line < 1 || line > count {
+			t.Fatalf("%s on line %d of %d", field, line, count)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        string
+		format      string
+	}{
+		{"wificfg.json", "", "", JSON},
+		{"/etc/wificfg.YML", "", "", YAML},
+		{"wificfg.yaml", "application/json", "{}", YAML},
+		{"wificfg.toml", "", "", TOML},
+		{"", "application/json; charset=utf-8", "", JSON},
+		{"", "application/x-yaml", "", YAML},
+		{"", "application/toml", "", TOML},
+		{"", "", "  {\"a\": 1}", JSON},
+		{"", "", "# comment\n[host_apd_cfg]\nssid = \"x\"", TOML},
+		{"", "", "ssid = \"x\"", TOML},
+		{"", "", "ssid: x", YAML},
+		{"", "", "url: http://x/?a=b", YAML},
+		{"", "", "", YAML},
+	}
+
+	for _, tt := range tests {
+		if format := Detect(tt.name, tt.contentType, []byte(tt.data)); format != tt.format {
+			t.Errorf("Detect(%q, %q, %q) = %s, want %s", tt.name, tt.contentType, tt.data, format, tt.format)
+		}
+	}
+}
+
+// the same config in each format
+const (
+	sameJSON = `{
+  "station_interface": "wlan0",
+  "dont_fallback": false,
+  "host_apd_cfg": {"ssid": "iot-wifi", "channel": 6, "ip": "192.168.27.1"},
+  "dnsmasq_cfg": {"reservations": [{"mac": "02:00:00:00:00:01", "ip": "192.168.27.10"}]},
+  "allowed": ["a", "b # not a comment"],
+  "backoff": 1.5,
+  "proxy": null
+}`
+
+	sameYAML = `# iot wifi
+station_interface: wlan0
+dont_fallback: false
+host_apd_cfg:
+  ssid: "iot-wifi"
+  channel: 6     # 2.4GHz
+  ip: 192.168.27.1
+dnsmasq_cfg:
+  reservations:
+  - mac: 02:00:00:00:00:01
+    ip: '192.168.27.10'
+allowed: [a, "b # not a comment"]
+backoff: 1.5
+proxy: ~
+`
+
+	sameTOML = `# iot wifi
+station_interface = "wlan0"
+dont_fallback = false
+allowed = [
+  "a",
+  "b # not a comment", # trailing comma
+]
+backoff = 1.5
+
+[host_apd_cfg]
+ssid = "iot-wifi"
+channel = 6 # 2.4GHz
+ip = '192.168.27.1'
+
+[[dnsmasq_cfg.reservations]]
+mac = "02:00:00:00:00:01"
+ip = "192.168.27.10"
+`
+)
+
+func TestDecodeFormats(t *testing.T) {
+	want, _, err := Decode([]byte(sameJSON), JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TOML has no null
+	withoutNull := map[string]interface{}{}
+	for key, value := range want {
+		if value != nil {
+			withoutNull[key] = value
+		}
+	}
+
+	for _, tt := range []struct {
+		format string
+		data   string
+		want   map[string]interface{}
+	}{
+		{YAML, sameYAML, want},
+		{TOML, sameTOML, withoutNull},
+	} {
+		cfg, _, err := Decode([]byte(tt.data), tt.format)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		}
+		if got, want := render(cfg), render(tt.want); got != want {
+			t.Errorf("%s decoded\n%s\nwant\n%s", tt.format, got, want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   string
+	}{
+		{"yaml empty", YAML, "# nothing\n", `{}`},
+		{"yaml document markers", YAML, "---\na: 1\n...\nb: 2\n", `{"a":1}`},
+		{"yaml scalars", YAML, "a: yes\nb: TRUE\nc: 0x1F\nd: -2.5e3\ne: 1.2.3\nf: ''\ng: \"\"", `{"a":"yes","b":true,"c":0x1F,"d":-2.5e3,"e":"1.2.3","f":"","g":""}`},
+		{"yaml quotes", YAML, `a: "tab\there \"q\""` + "\nb: 'it''s'\n\"c d\": 1", `{"a":"tab\there \"q\"","b":"it's","c d":1}`},
+		{"yaml colon in value", YAML, "url: http://host:8080/x\ntime: 12:30", `{"time":"12:30","url":"http://host:8080/x"}`},
+		{"yaml literal", YAML, "a: |\n  one\n  two\n\nb: 1", `{"a":"one\ntwo\n","b":1}`},
+		{"yaml literal strip", YAML, "a: |-\n  one\n  two\n", `{"a":"one\ntwo"}`},
+		{"yaml literal keep", YAML, "a: |+\n  one\n\n\nb: 1", `{"a":"one\n\n\n","b":1}`},
+		{"yaml folded", YAML, "a: >\n  one\n  two\n\n  three\n    indented\n", `{"a":"one two\nthree\n  indented\n"}`},
+		{"yaml sequence of sequences", YAML, "a:\n  - - 1\n    - 2\n  - [3, {b: 4}]", `{"a":[[1,2],[3,{"b":4}]]}`},
+		{"yaml flow over lines", YAML, "a: [1,\n  2,   # two\n  3]\nb: {c: d,\n  e: f}", `{"a":[1,2,3],"b":{"c":"d","e":"f"}}`},
+		{"yaml empty values", YAML, "a:\nb: -\nc: []\nd: {}", `{"a":null,"b":"-","c":[],"d":{}}`},
+		{"yaml nested dash", YAML, "a:\n-\n  b: 1\n- c", `{"a":[{"b":1},"c"]}`},
+		{"toml empty", TOML, "", `{}`},
+		{"toml scalars", TOML, "a = 1_000\nb = 0xff\nc = -inf\nd = 1979-05-27T07:32:00Z\ne = 1979-05-27 07:32:00\nf = 07:32:00\ng = true", `{"a":1_000,"b":0xff,"c":-inf,"d":"1979-05-27T07:32:00Z","e":"1979-05-27 07:32:00","f":"07:32:00","g":true}`},
+		{"toml strings", TOML, `a = "tab\there \u00e9 \U0001F4F6"` + "\nb = 'C:\\no\\escape'\nc = \"\"\"\nline one\nline \\\n   two\"\"\"\nd = '''\nraw\\n'''", `{"a":"tab\there é 📶","b":"C:\\no\\escape","c":"line one\nline two","d":"raw\\n"}`},
+		{"toml quotes ending multi-line", TOML, `a = """x"""""`, `{"a":"x\"\""}`},
+		{"toml dotted keys", TOML, "a.b.c = 1\na.d = 2\n\"e.f\" = 3", `{"a":{"b":{"c":1},"d":2},"e.f":3}`},
+		{"toml inline table", TOML, "a = { b = 1, c.d = \"x\" }\ne = {}", `{"a":{"b":1,"c":{"d":"x"}},"e":{}}`},
+		{"toml array of tables", TOML, "[[a]]\nb = 1\n[a.c]\nd = 2\n[[a]]\nb = 3", `{"a":[{"b":1,"c":{"d":2}},{"b":3}]}`},
+		{"toml nested arrays", TOML, "a = [[1, 2], [\"x\"], []]", `{"a":[[1,2],["x"],[]]}`},
+		{"json numbers", JSON, `{"a": 1.50, "b": 10000000000000000000000}`, `{"a":1.50,"b":10000000000000000000000}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, lines, err := Decode([]byte(tt.data), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDecoded(t, []byte(tt.data), cfg, lines)
+
+			if got := render(cfg); got != tt.want {
+				t.Errorf("decoded %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeLines(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		lines  Lines
+	}{
+		{JSON, sameJSON, Lines{
+			"station_interface":              2,
+			"host_apd_cfg":                   4,
+			"host_apd_cfg.channel":           4,
+			"dnsmasq_cfg.reservations":       5,
+			"dnsmasq_cfg.reservations[0]":    5,
+			"dnsmasq_cfg.reservations[0].ip": 5,
+			"allowed[1]":                     6,
+			"proxy":                          8,
+		}},
+		{YAML, sameYAML, Lines{
+			"station_interface":              2,
+			"host_apd_cfg":                   4,
+			"host_apd_cfg.channel":           6,
+			"dnsmasq_cfg.reservations":       9,
+			"dnsmasq_cfg.reservations[0]":    10,
+			"dnsmasq_cfg.reservations[0].ip": 11,
+			"proxy":                          14,
+		}},
+		{TOML, sameTOML, Lines{
+			"station_interface":              2,
+			"allowed[1]":                     6,
+			"host_apd_cfg":                   10,
+			"host_apd_cfg.channel":           12,
+			"dnsmasq_cfg.reservations":       15,
+			"dnsmasq_cfg.reservations[0]":    15,
+			"dnsmasq_cfg.reservations[0].ip": 17,
+		}},
+	}
+
+	for _, tt := range tests {
+		_, lines, err := Decode([]byte(tt.data), tt.format)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		}
+		for field, want := range tt.lines {
+			if line := lines[field]; line != want {
+				t.Errorf("%s: %s on line %d, want %d", tt.format, field, line, want)
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		line   int
+	}{
+		{"json syntax", JSON, "{\n  \"a\": 1,\n  \"b\": }", 3},
+		{"json not an object", JSON, "[1]", 1},
+		{"yaml not a mapping", YAML, "- a\n- b", 1},
+		{"yaml tab indentation", YAML, "a:\n\tb: 1", 2},
+		{"yaml bad indentation", YAML, "a:\n    b: 1\n  c: 2", 3},
+		{"yaml set twice", YAML, "a: 1\nb: 2\na: 3", 3},
+		{"yaml unclosed flow", YAML, "a: [1, 2\nb: 3", 1},
+		{"yaml unclosed quote", YAML, "a: 1\nb: \"x", 2},
+		{"yaml after a quote", YAML, "a: 'x' y", 1},
+		{"yaml block header", YAML, "a: |x\n  b", 1},
+		{"yaml not key value", YAML, "a: 1\nb", 2},
+		{"toml unquoted string", TOML, "a = 1\nb = wlan0", 2},
+		{"toml set twice", TOML, "a = 1\n\na = 2", 3},
+		{"toml table twice", TOML, "[a]\nb = 1\n[a]", 3},
+		{"toml not a table", TOML, "a = 1\n[a.b]", 2},
+		{"toml not an array of tables", TOML, "a = [1]\n[[a]]", 2},
+		{"toml unclosed string", TOML, "a = \"x\nb = 1", 1},
+		{"toml unclosed multi-line string", TOML, "a = \"\"\"x\ny", 2},
+		{"toml bad escape", TOML, `a = "\q"`, 1},
+		{"toml bad unicode", TOML, `a = "\uD800"`, 1},
+		{"toml unclosed array", TOML, "a = [1,\n2", 2},
+		{"toml unclosed inline table", TOML, "a = { b = 1\nc = 2", 1},
+		{"toml two values", TOML, "a = 1 2", 1},
+		{"toml no value", TOML, "a =", 1},
+		{"toml bad key", TOML, "= 1", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Decode([]byte(tt.data), tt.format)
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("err %v, want a SyntaxError", err)
+			}
+			if syntaxErr.Format != tt.format || syntaxErr.Line != tt.line {
+				t.Errorf("%s error on line %d, want %s on line %d: %s", syntaxErr.Format, syntaxErr.Line, tt.format, tt.line, err)
+			}
+		})
+	}
+
+	if _, _, err := Decode([]byte("a: 1"), "ini"); err == nil {
+		t.Error("decoded an unsupported format")
+	}
+}
+
+// fuzzDecode decodes data as format, checking a file either decodes to
+// the generic values or fails with a SyntaxError on one of its lines.
+func fuzzDecode(t *testing.T, data []byte, format string) {
+	cfg, lines, err := Decode(data, format)
+	if err != nil {
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("err %v, want a SyntaxError", err)
+		}
+		if count := bytes.Count(data, []byte("\n")) + 1; syntaxErr.Line < 1 || syntaxErr.Line > count {
+			t.Fatalf("error on line %d of %d: %s", syntaxErr.Line, count, err)
+		}
+		return
+	}
+
+	if cfg == nil {
+		t.Fatal("decoded nothing without an error")
+	}
+	checkDecoded(t, data, cfg, lines)
+}
+
+func FuzzDecodeYAML(f *testing.F) {
+	f.Add([]byte(sameYAML))
+	for _, seed := range []string{"a: |+\n  x\n\n", "a: >-\n  x\n   y\n", "- - a", "a: [{b: 'c''d'}, \"e\\u00e9\"]", "a:\n-\n- b: 1\n  c: 2"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, data, YAML)
+	})
+}
+
+func FuzzDecodeTOML(f *testing.F) {
+	f.Add([]byte(sameTOML))
+	for _, seed := range []string{"a.b = { c = [1, 'x'] }", "[[a.b]]\n[a.b.c]\nd = 1", "a = \"\"\"\\\n  x\"\"\"\"", "a = 1979-05-27 07:32:00"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, data, TOML)
+	})
+}
@@ -0,0 +1,497 @@
+package cfgfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Plain TOML values: numbers, and dates and times, which are kept as
+// strings.
+var (
+	tomlNumberR = regexp.MustCompile(`^([-+]?[0-9_]+|0x[0-9a-fA-F_]+|0o[0-7_]+|0b[01_]+|[-+]?[0-9_]+(\.[0-9_]+)?([eE][-+]?[0-9_]+)?|[-+]?(inf|nan))$`)
+	tomlDateR   = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}([Tt ][0-9:.]+([Zz]|[-+][0-9:]+)?)?$|^[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?$`)
+)
+
+// tomlParser decodes TOML with a character scanner.
+type tomlParser struct {
+	data   string
+	pos    int
+	line   int
+	fields Lines
+
+	root    map[string]interface{}
+	table   map[string]interface{} // where key = value lines go
+	path    string                 // of table
+	defined map[string]bool        // tables given by a [header]
+	counts  map[string]int         // [[array]] tables so far, by path
+}
+
+// decodeTOML decodes a TOML document.
+func decodeTOML(data []byte) (map[string]interface{}, Lines, error) {
+	p := &tomlParser{
+		data:    strings.Replace(string(data), "\r\n", "\n", -1),
+		line:    1,
+		fields:  Lines{},
+		root:    map[string]interface{}{},
+		defined: map[string]bool{},
+		counts:  map[string]int{},
+	}
+	p.table = p.root
+
+	for {
+		p.skipBlank(true)
+		if p.pos >= len(p.data) {
+			return p.root, p.fields, nil
+		}
+
+		var err error
+		if p.data[p.pos] == '[' {
+			err = p.header()
+		} else {
+			err = p.keyValue(p.table, p.path)
+		}
+		if err != nil {
+			return nil, p.fields, err
+		}
+
+		if err := p.endOfLine(); err != nil {
+			return nil, p.fields, err
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Format: TOML, Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// skipBlank skips spaces and comments, and newlines too if newlines is set.
+func (p *tomlParser) skipBlank(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine expects nothing but a comment before the next line.
+func (p *tomlParser) endOfLine() error {
+	p.skipBlank(false)
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		return p.errorf("unexpected %q, expected a new line", p.rest())
+	}
+
+	return nil
+}
+
+// rest returns the rest of the line, for errors.
+func (p *tomlParser) rest() string {
+	end := strings.IndexByte(p.data[p.pos:], '\n')
+	if end < 0 {
+		return p.data[p.pos:]
+	}
+
+	return p.data[p.pos : p.pos+end]
+}
+
+// header parses a [table] or [[array of tables]] header and makes it the
+// current table.
+func (p *tomlParser) header() error {
+	array := strings.HasPrefix(p.data[p.pos:], "[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	p.skipBlank(false)
+	if !strings.HasPrefix(p.data[p.pos:], closing) {
+		return p.errorf("expected %s", closing)
+	}
+	p.pos += len(closing)
+
+	// the tables leading to the header
+	table, path := p.root, ""
+	for _, key := range keys[:len(keys)-1] {
+		if table, path, err = p.descend(table, path, key); err != nil {
+			return err
+		}
+	}
+
+	last := keys[len(keys)-1]
+	path = fieldPath(path, last)
+
+	if array {
+		// only an array made by [[headers]], not by a value
+		tables, ok := table[last].([]interface{})
+		if _, exists := table[last]; exists && (!ok || p.counts[path] == 0) {
+			return p.errorf("%s is not an array of tables", path)
+		}
+
+		next := map[string]interface{}{}
+		table[last] = append(tables, next)
+
+		elem := fmt.Sprintf("%s[%d]", path, p.counts[path])
+		p.counts[path]++
+		if _, ok := p.fields[path]; !ok {
+			p.fields[path] = p.line
+		}
+		p.fields[elem] = p.line
+		p.table, p.path = next, elem
+		return nil
+	}
+
+	if p.defined[path] {
+		return p.errorf("table %s is defined twice", path)
+	}
+	p.defined[path] = true
+	p.fields[path] = p.line
+
+	p.table, p.path, err = p.descend(table, path[:len(path)-len(last)], last)
+	if err != nil {
+		return err
+	}
+	p.path = path
+
+	return nil
+}
+
+// descend returns the table under key, creating it if needed. For an
+// array of tables it is the last one.
+func (p *tomlParser) descend(table map[string]interface{}, path string, key string) (map[string]interface{}, string, error) {
+	path = strings.TrimSuffix(path, ".")
+	field := fieldPath(path, key)
+
+	switch value := table[key].(type) {
+	case nil:
+		next := map[string]interface{}{}
+		table[key] = next
+		return next, field, nil
+	case map[string]interface{}:
+		return value, field, nil
+	case []interface{}:
+		if len(value) == 0 || p.counts[field] == 0 {
+			break
+		}
+		if last, ok := value[len(value)-1].(map[string]interface{}); ok {
+			return last, fmt.Sprintf("%s[%d]", field, p.counts[field]-1), nil
+		}
+	}
+
+	return nil, "", p.errorf("%s is not a table", field)
+}
+
+// keyValue parses key = value into table.
+func (p *tomlParser) keyValue(table map[string]interface{}, path string) error {
+	line := p.line
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+
+	p.skipBlank(false)
+	if p.pos >= len(p.data) || p.data[p.pos] != '=' {
+		return p.errorf("expected = after %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipBlank(false)
+
+	// dotted keys make tables on the way
+	for _, key := range keys[:len(keys)-1] {
+		if table, path, err = p.descend(table, path, key); err != nil {
+			return err
+		}
+	}
+
+	last := keys[len(keys)-1]
+	if _, dup := table[last]; dup {
+		return p.errorf("%s is set twice", fieldPath(path, last))
+	}
+
+	field := fieldPath(path, last)
+	p.fields[field] = line
+
+	value, err := p.value(field)
+	if err != nil {
+		return err
+	}
+	table[last] = value
+
+	return nil
+}
+
+// key parses a bare, quoted or dotted key.
+func (p *tomlParser) key() ([]string, error) {
+	keys := []string{}
+	for {
+		p.skipBlank(false)
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("expected a key")
+		}
+
+		switch p.data[p.pos] {
+		case '"', '\'':
+			key, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		default:
+			start := p.pos
+			for p.pos < len(p.data) && isTOMLBareKey(p.data[p.pos]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf("invalid key %q", p.rest())
+			}
+			keys = append(keys, p.data[start:p.pos])
+		}
+
+		p.skipBlank(false)
+		if p.pos >= len(p.data) || p.data[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isTOMLBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// value parses the value of the field at path.
+func (p *tomlParser) value(path string) (interface{}, error) {
+	if p.pos >= len(p.data) {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch c := p.data[p.pos]; c {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		return p.array(path)
+	case '{':
+		return p.inlineTable(path)
+	}
+
+	start := p.pos
+	for p.pos < len(p.data) && strings.IndexByte(" \t\n#,]}", p.data[p.pos]) < 0 {
+		p.pos++
+	}
+	// a date and a time separated by a space
+	if tomlDateR.MatchString(p.data[start:p.pos]) && p.pos+1 < len(p.data) && p.data[p.pos] == ' ' && p.data[p.pos+1] >= '0' && p.data[p.pos+1] <= '9' {
+		p.pos++
+		for p.pos < len(p.data) && strings.IndexByte(" \t\n#,]}", p.data[p.pos]) < 0 {
+			p.pos++
+		}
+	}
+	token := p.data[start:p.pos]
+
+	switch {
+	case token == "true":
+		return true, nil
+	case token == "false":
+		return false, nil
+	case tomlNumberR.MatchString(token):
+		return json.Number(token), nil
+	case tomlDateR.MatchString(token):
+		return token, nil
+	}
+
+	return nil, p.errorf("invalid value %q, strings must be quoted", token)
+}
+
+// array parses [a, b, ...], which may span lines.
+func (p *tomlParser) array(path string) (interface{}, error) {
+	p.pos++
+	values := []interface{}{}
+
+	for i := 0; ; i++ {
+		p.skipBlank(true)
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unclosed [")
+		}
+		if p.data[p.pos] == ']' {
+			p.pos++
+			return values, nil
+		}
+
+		elem := fmt.Sprintf("%s[%d]", path, i)
+		p.fields[elem] = p.line
+		value, err := p.value(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank(true)
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.data) && p.data[p.pos] != ']' {
+			return nil, p.errorf("expected , or ]")
+		}
+	}
+}
+
+// inlineTable parses { a = 1, b = "x" } on one line.
+func (p *tomlParser) inlineTable(path string) (interface{}, error) {
+	p.pos++
+	table := map[string]interface{}{}
+
+	for first := true; ; first = false {
+		p.skipBlank(false)
+		if p.pos >= len(p.data) || p.data[p.pos] == '\n' {
+			return nil, p.errorf("unclosed {")
+		}
+		if p.data[p.pos] == '}' && first {
+			p.pos++
+			return table, nil
+		}
+
+		if err := p.keyValue(table, path); err != nil {
+			return nil, err
+		}
+
+		p.skipBlank(false)
+		if p.pos < len(p.data) && p.data[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+		if p.pos >= len(p.data) || p.data[p.pos] != ',' {
+			return nil, p.errorf("expected , or }")
+		}
+		p.pos++
+	}
+}
+
+// str parses a basic, literal or multi-line string.
+func (p *tomlParser) str() (string, error) {
+	quote := p.data[p.pos]
+	multi := strings.HasPrefix(p.data[p.pos:], strings.Repeat(string(quote), 3))
+
+	delim := string(quote)
+	if multi {
+		delim = strings.Repeat(delim, 3)
+		p.pos += 3
+		// a newline right after the opening quotes is dropped
+		if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+			p.pos++
+			p.line++
+		}
+	} else {
+		p.pos++
+	}
+
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.data) {
+			return "", p.errorf("unclosed string")
+		}
+
+		if strings.HasPrefix(p.data[p.pos:], delim) {
+			// up to two quotes may end a multi-line string's content
+			for multi && strings.HasPrefix(p.data[p.pos+1:], delim) {
+				b.WriteByte(quote)
+				p.pos++
+			}
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+
+		c := p.data[p.pos]
+		switch {
+		case c == '\n' && !multi:
+			return "", p.errorf("unclosed string")
+		case c == '\n':
+			p.line++
+		case c == '\\' && quote == '"':
+			if err := p.escape(&b, multi); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		b.WriteByte(c)
+		p.pos++
+	}
+}
+
+// escape parses the escape sequence at p.pos into b.
+func (p *tomlParser) escape(b *strings.Builder, multi bool) error {
+	p.pos++
+	if p.pos >= len(p.data) {
+		return p.errorf("unclosed string")
+	}
+
+	c := p.data[p.pos]
+	p.pos++
+
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.data) {
+			return p.errorf("invalid unicode escape")
+		}
+		r, err := strconv.ParseUint(p.data[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("invalid unicode escape \\%c%s", c, p.data[p.pos:p.pos+n])
+		}
+		b.WriteRune(rune(r))
+		p.pos += n
+	case '\n', ' ', '\t':
+		// a line ending backslash trims the following whitespace
+		if !multi {
+			return p.errorf("invalid escape \\%c", c)
+		}
+		p.pos--
+		for p.pos < len(p.data) && strings.IndexByte(" \t\n", p.data[p.pos]) >= 0 {
+			if p.data[p.pos] == '\n' {
+				p.line++
+			}
+			p.pos++
+		}
+	default:
+		return p.errorf("invalid escape \\%c", c)
+	}
+
+	return nil
+}
@@ -0,0 +1,601 @@
+package cfgfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlNumberR matches the integers and floats of the YAML core schema.
+var yamlNumberR = regexp.MustCompile(`^([-+]?[0-9]+|0o[0-7]+|0x[0-9a-fA-F]+|[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?)$`)
+
+// yamlParser decodes block YAML line by line, by indentation.
+type yamlParser struct {
+	lines  []string // raw lines
+	next   int      // index of the next raw line
+	fields Lines
+}
+
+// decodeYAML decodes a YAML mapping.
+func decodeYAML(data []byte) (map[string]interface{}, Lines, error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	p := &yamlParser{
+		lines:  strings.Split(text, "\n"),
+		fields: Lines{},
+	}
+
+	indent, _, ok := p.peek()
+	if !ok {
+		return map[string]interface{}{}, p.fields, nil
+	}
+
+	value, err := p.parseNode("", indent)
+	if err != nil {
+		return nil, p.fields, err
+	}
+	if _, _, ok := p.peek(); ok {
+		return nil, p.fields, p.errorf("unexpected content, check the indentation")
+	}
+
+	cfg, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, p.fields, &SyntaxError{Format: YAML, Line: 1, Msg: "the config must be a mapping"}
+	}
+
+	return cfg, p.fields, nil
+}
+
+// errorf returns a SyntaxError on the next line.
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Format: YAML, Line: p.next + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// peek skips blank and comment lines and returns the indentation and the
+// text, without its comment, of the next line.
+func (p *yamlParser) peek() (int, string, bool) {
+	for ; p.next < len(p.lines); p.next++ {
+		raw := p.lines[p.next]
+		text := strings.TrimSpace(stripYAMLComment(raw))
+		if text == "" || text == "---" {
+			continue
+		}
+		if text == "..." {
+			p.next = len(p.lines)
+			break
+		}
+
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		return indent, text, true
+	}
+
+	return 0, "", false
+}
+
+// tabbed reports whether the indentation of the next line holds a tab.
+func (p *yamlParser) tabbed() bool {
+	raw := p.lines[p.next]
+	return strings.ContainsRune(raw[:len(raw)-len(strings.TrimLeft(raw, " \t"))], '\t')
+}
+
+// parseNode parses the mapping, sequence or scalar starting on the next
+// line, which must be indented at least indent.
+func (p *yamlParser) parseNode(path string, indent int) (interface{}, error) {
+	lineIndent, text, ok := p.peek()
+	if !ok || lineIndent < indent {
+		return nil, nil
+	}
+	if p.tabbed() {
+		return nil, p.errorf("tabs are not allowed in indentation")
+	}
+
+	if isYAMLSeqItem(text) {
+		return p.parseSeq(path, lineIndent)
+	}
+	if _, _, ok := splitYAMLKey(text); ok {
+		return p.parseMap(path, lineIndent)
+	}
+
+	// a lone scalar, possibly a flow collection spread over lines
+	p.next++
+	return p.parseInline(text)
+}
+
+// parseMap parses the mapping whose keys are indented indent.
+func (p *yamlParser) parseMap(path string, indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+
+	for {
+		lineIndent, text, ok := p.peek()
+		if !ok || lineIndent < indent {
+			return m, nil
+		}
+		if p.tabbed() {
+			return nil, p.errorf("tabs are not allowed in indentation")
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		key, rest, ok := splitYAMLKey(text)
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("%s is set twice", key)
+		}
+
+		field := fieldPath(path, key)
+		p.fields[field] = p.next + 1
+		p.next++
+
+		value, err := p.parseValue(field, indent, rest)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+}
+
+// parseSeq parses the sequence whose dashes are indented indent.
+func (p *yamlParser) parseSeq(path string, indent int) (interface{}, error) {
+	seq := []interface{}{}
+
+	for i := 0; ; i++ {
+		lineIndent, text, ok := p.peek()
+		if !ok || lineIndent < indent || (lineIndent == indent && !isYAMLSeqItem(text)) {
+			return seq, nil
+		}
+		if p.tabbed() {
+			return nil, p.errorf("tabs are not allowed in indentation")
+		}
+		if lineIndent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+
+		elem := fmt.Sprintf("%s[%d]", path, i)
+		p.fields[elem] = p.next + 1
+
+		item := strings.TrimLeft(text[1:], " ")
+
+		// "- key: value" starts a mapping indented past the dash, "- - x"
+		// a sequence
+		_, _, isKey := splitYAMLKey(item)
+		if isKey || isYAMLSeqItem(item) {
+			raw := p.lines[p.next]
+			itemIndent := indent + len(text) - len(item)
+			p.lines[p.next] = strings.Repeat(" ", itemIndent) + raw[itemIndent:]
+
+			parse := p.parseMap
+			if !isKey {
+				parse = p.parseSeq
+			}
+			value, err := parse(elem, itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+			continue
+		}
+
+		p.next++
+		value, err := p.parseValue(elem, indent, item)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+	}
+}
+
+// parseValue parses the value after a key or a dash: inline text, a block
+// scalar or a node on the following lines.
+func (p *yamlParser) parseValue(path string, indent int, text string) (interface{}, error) {
+	if text == "" {
+		// a sequence may sit at the same indentation as its key
+		if lineIndent, next, ok := p.peek(); ok && lineIndent == indent && isYAMLSeqItem(next) {
+			return p.parseSeq(path, indent)
+		}
+		return p.parseNode(path, indent+1)
+	}
+
+	if text[0] == '|' || text[0] == '>' {
+		return p.parseBlockScalar(text, indent)
+	}
+
+	return p.parseInline(text)
+}
+
+// parseInline parses a scalar or flow collection on the current line,
+// continuing a flow collection onto the following lines until it closes.
+func (p *yamlParser) parseInline(text string) (interface{}, error) {
+	line := p.next
+	if text[0] == '[' || text[0] == '{' {
+		for !flowClosed(text) && p.next < len(p.lines) {
+			text += " " + strings.TrimSpace(stripYAMLComment(p.lines[p.next]))
+			p.next++
+		}
+	}
+
+	value, err := parseYAMLScalar(text)
+	if err != nil {
+		return nil, &SyntaxError{Format: YAML, Line: line, Msg: err.Error()}
+	}
+
+	return value, nil
+}
+
+// parseBlockScalar parses a literal (|) or folded (>) block scalar whose
+// header is text, under a key or dash indented indent.
+func (p *yamlParser) parseBlockScalar(text string, indent int) (interface{}, error) {
+	folded := text[0] == '>'
+	chomp := byte(0)
+	blockIndent := 0
+	for _, c := range []byte(strings.TrimSpace(text[1:])) {
+		switch {
+		case c == '-' || c == '+':
+			chomp = c
+		case c >= '1' && c <= '9':
+			blockIndent = indent + int(c-'0')
+		default:
+			// the header is on the line before the next
+			return nil, &SyntaxError{Format: YAML, Line: p.next, Msg: fmt.Sprintf("invalid block scalar header %q", text)}
+		}
+	}
+
+	content := []string{}
+	for ; p.next < len(p.lines); p.next++ {
+		raw := p.lines[p.next]
+		if strings.TrimSpace(raw) == "" {
+			content = append(content, "")
+			continue
+		}
+
+		lineIndent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if blockIndent == 0 {
+			blockIndent = lineIndent
+		}
+		if lineIndent < blockIndent || lineIndent <= indent {
+			break
+		}
+		content = append(content, raw[blockIndent:])
+	}
+
+	// trailing blank lines only count when kept
+	trailing := 0
+	for trailing < len(content) && content[len(content)-1-trailing] == "" {
+		trailing++
+	}
+	content = content[:len(content)-trailing]
+
+	var body string
+	if folded {
+		body = foldYAML(content)
+	} else {
+		body = strings.Join(content, "\n")
+	}
+
+	switch {
+	case chomp == '-' || body == "":
+	case chomp == '+':
+		body += "\n" + strings.Repeat("\n", trailing)
+	default:
+		body += "\n"
+	}
+
+	return body, nil
+}
+
+// foldYAML joins the lines of a folded block scalar: lines are joined with
+// spaces, each blank line becomes a newline and more indented lines keep
+// their line breaks.
+func foldYAML(lines []string) string {
+	var b strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			prev := lines[i-1]
+			switch {
+			case line == "":
+				b.WriteString("\n")
+			case prev == "":
+			case strings.HasPrefix(line, " ") || strings.HasPrefix(prev, " "):
+				b.WriteString("\n")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(line)
+	}
+
+	return b.String()
+}
+
+// isYAMLSeqItem reports whether text is a sequence item.
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" into the key and the value text.
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' || isYAMLSeqItem(text) {
+		return "", "", false
+	}
+
+	// a quoted key
+	if text[0] == '"' || text[0] == '\'' {
+		end := quoteEnd(text)
+		if end < 0 {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(text[end+1:], " ")
+		if !strings.HasPrefix(rest, ":") || (len(rest) > 1 && rest[1] != ' ') {
+			return "", "", false
+		}
+		key, err := parseYAMLScalar(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return fmt.Sprint(key), strings.TrimSpace(rest[1:]), true
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+
+	return "", "", false
+}
+
+// stripYAMLComment removes a # comment, which starts the line or follows
+// whitespace outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	prev := byte(' ')
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && strings.IndexByte(" :-[{,", prev) >= 0:
+			quote = c
+		case c == '#' && (prev == ' ' || prev == '\t'):
+			return line[:i]
+		}
+		prev = c
+	}
+
+	return line
+}
+
+// quoteEnd returns the index of the quote closing the string text starts
+// with, or -1.
+func quoteEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+
+	return -1
+}
+
+// flowClosed reports whether the brackets and braces of text balance.
+func flowClosed(text string) bool {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			end := quoteEnd(text[i:])
+			if end < 0 {
+				return false
+			}
+			i += end
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+
+	return depth <= 0
+}
+
+// parseYAMLScalar parses a quoted or plain scalar or a flow collection.
+func parseYAMLScalar(text string) (interface{}, error) {
+	f := &yamlFlow{text: text}
+	value, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+
+	f.skipSpace()
+	if f.pos < len(f.text) {
+		return nil, fmt.Errorf("unexpected %q after value", f.text[f.pos:])
+	}
+
+	return value, nil
+}
+
+// yamlFlow scans flow collections and quoted scalars.
+type yamlFlow struct {
+	text  string
+	pos   int
+	depth int // inside a flow collection, where , ] and } end plain scalars
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return nil, nil
+	}
+
+	switch f.text[f.pos] {
+	case '[':
+		return f.seq()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	}
+
+	return f.plain(), nil
+}
+
+func (f *yamlFlow) seq() (interface{}, error) {
+	f.pos++
+	f.depth++
+	defer func() { f.depth-- }()
+
+	seq := []interface{}{}
+	for {
+		f.skipSpace()
+		if f.pos >= len(f.text) {
+			return nil, fmt.Errorf("unclosed [")
+		}
+		if f.text[f.pos] == ']' {
+			f.pos++
+			return seq, nil
+		}
+
+		value, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (interface{}, error) {
+	f.pos++
+	f.depth++
+	defer func() { f.depth-- }()
+
+	m := map[string]interface{}{}
+	for {
+		f.skipSpace()
+		if f.pos >= len(f.text) {
+			return nil, fmt.Errorf("unclosed {")
+		}
+		if f.text[f.pos] == '}' {
+			f.pos++
+			return m, nil
+		}
+
+		key, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		if f.pos >= len(f.text) || f.text[f.pos] != ':' {
+			return nil, fmt.Errorf("expected : after %v", key)
+		}
+		f.pos++
+
+		value, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(key)] = value
+
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator consumes the comma between flow entries, leaving the closing
+// bracket for the caller.
+func (f *yamlFlow) separator(closing byte) error {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return fmt.Errorf("unclosed %c", map[byte]byte{']': '[', '}': '{'}[closing])
+	}
+
+	switch f.text[f.pos] {
+	case ',':
+		f.pos++
+		return nil
+	case closing:
+		return nil
+	}
+
+	return fmt.Errorf("expected , or %c", closing)
+}
+
+func (f *yamlFlow) quoted() (interface{}, error) {
+	end := quoteEnd(f.text[f.pos:])
+	if end < 0 {
+		return nil, fmt.Errorf("unclosed quote")
+	}
+
+	raw := f.text[f.pos : f.pos+end+1]
+	f.pos += end + 1
+
+	if raw[0] == '\'' {
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	}
+
+	s, err := strconv.Unquote(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid string %s", raw)
+	}
+
+	return s, nil
+}
+
+// plain scans a plain scalar and resolves it to null, a bool, a number or
+// a string.
+func (f *yamlFlow) plain() interface{} {
+	start := f.pos
+	for f.pos < len(f.text) {
+		c := f.text[f.pos]
+		if f.depth > 0 && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		if f.depth > 0 && c == ':' && (f.pos+1 == len(f.text) || f.text[f.pos+1] == ' ') {
+			break
+		}
+		f.pos++
+	}
+
+	return resolveYAML(strings.TrimSpace(f.text[start:f.pos]))
+}
+
+// resolveYAML types a plain scalar with the YAML core schema.
+func resolveYAML(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	if yamlNumberR.MatchString(s) {
+		return json.Number(s)
+	}
+
+	return s
+}
@@ -0,0 +1,54 @@
+package iotwifi
+
+// Wifi bands as reported in WpaNetwork.Band.
+const (
+	Band24 = "2.4GHz"
+	Band5  = "5GHz"
+	Band6  = "6GHz"
+)
+
+// FrequencyChannel converts a center frequency in MHz to its channel
+// number and band. Unknown frequencies return 0 and "".
+func FrequencyChannel(mhz int) (int, string) {
+	switch {
+	case mhz == 2484:
+		return 14, Band24
+	case mhz >= 2412 && mhz <= 2472:
+		return (mhz - 2407) / 5, Band24
+	case mhz == 5935:
+		return 2, Band6
+	case mhz >= 5955 && mhz <= 7115:
+		return (mhz - 5950) / 5, Band6
+	case mhz >= 5150 && mhz <= 5895:
+		return (mhz - 5000) / 5, Band5
+	}
+
+	return 0, ""
+}
+
+// ChannelFrequency converts a channel number in band to its center
+// frequency in MHz. Unknown channels return 0.
+func ChannelFrequency(channel int, band string) int {
+	switch band {
+	case Band24:
+		switch {
+		case channel == 14:
+			return 2484
+		case channel >= 1 && channel <= 13:
+			return 2407 + channel*5
+		}
+	case Band5:
+		if channel >= 32 && channel <= 177 {
+			return 5000 + channel*5
+		}
+	case Band6:
+		switch {
+		case channel == 2:
+			return 5935
+		case channel >= 1 && channel <= 233:
+			return 5950 + channel*5
+		}
+	}
+
+	return 0
+}
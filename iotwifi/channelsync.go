@@ -0,0 +1,146 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// csaBeacons is how many beacons announce a channel switch of the AP
+// before it happens, so its clients follow it.
+const csaBeacons = "5"
+
+// ChannelSync keeps the AP on the channel of the station's network. A
+// radio running an AP and a station at once usually has one channel for
+// both, and either the AP or the station breaks when they differ.
+type ChannelSync struct {
+	Wpa *WpaCfg
+}
+
+// NewChannelSync produces a ChannelSync for wpa.
+func NewChannelSync(wpa *WpaCfg) *ChannelSync {
+	return &ChannelSync{Wpa: wpa}
+}
+
+// Run moves the AP whenever the station connects, roams or its network
+// switches channel, until ctx is done. It returns at once unless
+// host_apd_cfg.follow_station_channel is set.
+func (c *ChannelSync) Run(ctx context.Context, bus *EventBus) {
+	cfg := c.Wpa.Cfg()
+	if !cfg.HostApdCfg.FollowStationChannel || cfg.APDedicated {
+		return
+	}
+
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	// the station may have connected at boot, before the events were watched
+	c.follow(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			// a roam is connected again, to another AP
+			if ev.Iface == cfg.StationInterface && (ev.Type == EventConnected || ev.Type == EventChannelSwitched) {
+				c.follow(ctx)
+			}
+		}
+	}
+}
+
+// follow moves the AP to the channel the station is on, if it is
+// elsewhere.
+func (c *ChannelSync) follow(ctx context.Context) {
+	wpa := c.Wpa
+	iface := wpa.Cfg().APInterface
+
+	status, err := wpa.wpaStatus(ctx)
+	if err != nil || status["wpa_state"] != "COMPLETED" {
+		return
+	}
+
+	freq, _ := strconv.Atoi(status["freq"])
+	channel, band := FrequencyChannel(freq)
+	if channel == 0 {
+		return
+	}
+
+	current := wpa.Cfg().HostApdCfg.withDefaults()
+	if current.Channel == strconv.Itoa(channel) && current.Band == band {
+		return
+	}
+
+	how, err := wpa.switchAPChannel(ctx, channel, band)
+	if errors.Is(err, ErrInvalid) {
+		wpa.Log.Warn("ap cannot follow station channel", "iface", iface, "channel", channel, "band", band, "error", err)
+		return
+	}
+	if err != nil {
+		wpa.Log.Error("ap could not follow station channel", "iface", iface, "channel", channel, "band", band, "error", err)
+		return
+	}
+	wpa.Log.Info("ap follows station channel", "iface", iface, "channel", channel, "band", band, "switch", how)
+}
+
+// switchAPChannel moves the AP to channel in band. Within a band hostapd
+// announces the switch so the clients stay, and it returns "csa"; a
+// change of band, or a switch hostapd refused, rewrites hostapd.conf and
+// reloads it, and it returns "reload".
+func (wpa *WpaCfg) switchAPChannel(ctx context.Context, channel int, band string) (string, error) {
+	iface := wpa.Cfg().APInterface
+	current := wpa.Cfg().HostApdCfg.withDefaults()
+
+	switch {
+	case band == Band6:
+		return "", fmt.Errorf("%w: the ap cannot use 6GHz", ErrInvalid)
+	case band == Band5 && current.CountryCode == "":
+		return "", fmt.Errorf("%w: the ap needs a country_code for 5GHz", ErrInvalid)
+	}
+
+	freq := ChannelFrequency(channel, band)
+	if freq == 0 {
+		return "", fmt.Errorf("%w: no channel %d in %s", ErrInvalid, channel, band)
+	}
+
+	next := wpa.Cfg().HostApdCfg
+	next.Channel = strconv.Itoa(channel)
+	if band != current.Band {
+		next.Band = band
+		next.HwMode = ""
+		if band == Band24 {
+			next.Ieee80211ac = false
+		}
+	}
+
+	if band == current.Band {
+		args := []string{"chan_switch", csaBeacons, strconv.Itoa(freq)}
+		if next.Ieee80211n {
+			args = append(args, "ht")
+		}
+		err := wpa.hostapdCli(ctx, args...)
+		if err == nil {
+			// the switch is live, hostapd.conf keeps it for the next start
+			if _, err := WriteHostapdConf(iface, next, wpa.Cfg().MacACL()); err != nil {
+				wpa.Log.Error("could not write hostapd.conf", "iface", iface, "error", err)
+			}
+			wpa.updateCfg(func(cfg *SetupCfg) {
+				cfg.HostApdCfg = next
+			})
+			return "csa", nil
+		}
+		wpa.Log.Debug("ap channel switch failed, reloading", "iface", iface, "channel", channel, "error", err)
+	}
+
+	if err := wpa.applyHostapdCfg(next); err != nil {
+		return "", err
+	}
+
+	return "reload", nil
+}
@@ -1,129 +1,264 @@
 package iotwifi
 
 import (
+	"context"
+	"errors"
 	"os/exec"
-	"time"
+	"sync"
 
-	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+	"github.com/kinokochat/txwifi/iotwifi/process"
 )
 
 // Command for device network commands.
 type Command struct {
-	Log      bunyan.Logger
-	Runner   CmdRunner
-	SetupCfg *SetupCfg
+	Log       Logger
+	Processes *process.Supervisor
+	Bus       *EventBus        // optional, receives the events parsed from the daemons' output
+	Cfg       func() *SetupCfg // the running config, so restarts use a reloaded one
+
+	mu      sync.Mutex
+	builtin *builtinServers // the DHCP and DNS servers run instead of dnsmasq
 }
 
-// RemoveApInterface removes the AP interface.
-func (c *Command) RemoveApInterface() {
-	cmd := exec.Command("iw", "dev", "uap0", "del")
-	cmd.Start()
-	cmd.Wait()
+// RemoveApInterface removes the AP interface, if it exists. A dedicated
+// AP radio is left alone.
+func (c *Command) RemoveApInterface() error {
+	if c.Cfg().APDedicated {
+		return nil
+	}
+
+	err := netif.DeleteLink(c.Cfg().APInterface)
+	if errors.Is(err, netif.ErrLinkNotFound) {
+		return nil
+	}
+
+	return err
 }
 
-// ConfigureApInterface configured the AP interface.
-func (c *Command) ConfigureApInterface() {
-	cmd := exec.Command("ifconfig", "uap0", c.SetupCfg.HostApdCfg.Ip)
-	cmd.Start()
-	cmd.Wait()
+// ConfigureApInterface configured the AP interface, with its IPv6
+// address too when IPv6 is enabled. A bridged AP has no address of its
+// own, the bridge has.
+func (c *Command) ConfigureApInterface() error {
+	if c.Cfg().Bridge.Enabled {
+		return nil
+	}
+
+	if err := netif.ReplaceAddr(c.Cfg().APInterface, c.Cfg().apAddress()); err != nil {
+		return err
+	}
+
+	if address := c.Cfg().apAddress6(); address != "" {
+		return netif.ReplaceAddr(c.Cfg().APInterface, address)
+	}
+
+	return nil
+}
+
+// ConfigureStationInterface gives the station interface its static
+// address, if one is configured.
+func (c *Command) ConfigureStationInterface() error {
+	if !c.Cfg().StationIP.Enabled() {
+		return nil
+	}
+
+	return setStaticAddress(c.Cfg().StationInterface, c.Cfg().StationIP, c.Cfg().resolvConf())
 }
 
 // UpApInterface ups the AP Interface.
-func (c *Command) UpApInterface() {
-	cmd := exec.Command("ifconfig", "uap0", "up")
-	cmd.Start()
-	cmd.Wait()
+func (c *Command) UpApInterface() error {
+	return netif.SetUp(c.Cfg().APInterface)
 }
 
-// AddApInterface adds the AP interface.
-func (c *Command) AddApInterface() {
-	cmd := exec.Command("iw", "phy", "phy0", "interface", "add", "uap0", "type", "__ap")
-	cmd.Start()
-	cmd.Wait()
+// AddApInterface adds the AP interface on the same phy as the station
+// interface, unless the AP has a radio of its own.
+func (c *Command) AddApInterface() error {
+	if c.Cfg().APDedicated {
+		return nil
+	}
+
+	return netif.AddWirelessInterface(c.Cfg().StationInterface, c.Cfg().APInterface, netif.TypeAP)
 }
 
-// CheckInterface checks the AP interface.
-func (c *Command) CheckApInterface() {
-	cmd := exec.Command("ifconfig", "uap0")
-	go c.Runner.ProcessCmd("ifconfig_uap0", cmd)
+// CheckApInterface logs the state of the AP interface.
+func (c *Command) CheckApInterface() (netif.Link, error) {
+	link, err := netif.LinkByName(c.Cfg().APInterface)
+	if err != nil {
+		return link, err
+	}
+
+	c.Log.Info("ap interface", "iface", link.Name, "up", link.Up, "oper_state", link.OperState, "addrs", link.Addrs)
+
+	return link, nil
 }
 
 // EnableAp enables the AP interface.
 func (c *Command) EnableAp() {
-	cmd := exec.Command("hostapd_cli", "-i", "uap0", "enable")
+	cmd := exec.Command("hostapd_cli", "-i", c.Cfg().APInterface, "enable")
 	cmd.Start()
 	cmd.Wait()
 }
 
 // DisableAp disables the AP interface.
 func (c *Command) DisableAp() {
-	cmd := exec.Command("hostapd_cli", "-i", "uap0", "disable")
+	cmd := exec.Command("hostapd_cli", "-i", c.Cfg().APInterface, "disable")
 	cmd.Start()
 	cmd.Wait()
 }
 
 // StartWpaSupplicant starts wpa_supplicant.
 func (c *Command) StartWpaSupplicant() {
+	c.startWpaSupplicant(ComponentWpaSupplicant, c.Cfg().StationInterface, c.Cfg().WpaSupplicantCfg.CfgFile)
+}
 
-	args := []string{
-		"-Dnl80211",
-		"-iwlan0",
-		"-c" + c.SetupCfg.WpaSupplicantCfg.CfgFile,
+// StartRadio starts wpa_supplicant on an additional station radio and
+// gives it its static address, if one is configured.
+func (c *Command) StartRadio(radio RadioCfg) error {
+	c.startWpaSupplicant(radioComponent(radio.Interface), radio.Interface, radio.WpaSupplicantCfg.CfgFile)
+
+	if !radio.StationIP.Enabled() {
+		return nil
 	}
 
-	cmd := exec.Command("wpa_supplicant", args...)
-	go c.Runner.ProcessCmd("wpa_supplicant", cmd)
+	return setStaticAddress(radio.Interface, radio.StationIP, c.Cfg().resolvConf())
+}
+
+// startWpaSupplicant starts wpa_supplicant on iface as the process name.
+func (c *Command) startWpaSupplicant(name string, iface string, cfgFile string) {
+	c.startProcess(name, iface, "wpa_supplicant", "-Dnl80211", "-i"+iface, "-c"+cfgFile)
 }
 
-// StartDnsmasq starts dnsmasq.
+// StartDnsmasq starts dnsmasq, or the built-in DHCP and DNS servers
+// when the config asks for them, unless the AP is bridged to a wired
+// network whose DHCP server serves it.
 func (c *Command) StartDnsmasq() {
+	if c.Cfg().Bridge.Enabled {
+		return
+	}
+
+	if c.Cfg().DnsmasqCfg.Builtin {
+		if err := c.startBuiltin(); err != nil {
+			c.Log.Error("could not start the built-in dhcp server", "iface", c.Cfg().APInterface, "error", err)
+		}
+		return
+	}
+
 	// hostapd is enabled, fire up dnsmasq
 	args := []string{
 		"--no-hosts", // Don't read the hostnames in /etc/hosts.
 		"--keep-in-foreground",
-		"--interface=uap0",
+		"--interface=" + c.Cfg().APInterface,
 		"--log-queries",
-		"--no-resolv",
-		"--address=" + c.SetupCfg.DnsmasqCfg.Address,
-		"--dhcp-range=" + c.SetupCfg.DnsmasqCfg.DhcpRange,
-		"--dhcp-vendorclass=" + c.SetupCfg.DnsmasqCfg.VendorClass,
+		"--dhcp-range=" + c.Cfg().DnsmasqCfg.DhcpRange,
+		"--dhcp-vendorclass=" + c.Cfg().DnsmasqCfg.VendorClass,
+		"--dhcp-leasefile=" + c.Cfg().DnsmasqCfg.leaseFile(),
 		"--dhcp-authoritative",
 		"--log-facility=-",
 	}
 
-	cmd := exec.Command("dnsmasq", args...)
-	go c.Runner.ProcessCmd("dnsmasq", cmd)
+	if c.Cfg().IPv6.Enabled {
+		args = append(args, c.Cfg().IPv6.dnsmasqArgs6(c.Cfg().APInterface)...)
+	}
+
+	// routed clients need names resolved upstream
+	if !c.Cfg().Router.Enabled {
+		args = append(args, "--no-resolv")
+	}
+
+	for _, address := range c.Cfg().dnsAddresses() {
+		args = append(args, "--address="+address)
+	}
+
+	for _, reservation := range c.Cfg().DnsmasqCfg.Reservations {
+		if err := reservation.Validate(); err != nil {
+			c.Log.Error("skipping dhcp reservation", "iface", c.Cfg().APInterface, "mac", reservation.Mac, "error", err)
+			continue
+		}
+		args = append(args, reservation.HostArg())
+	}
+
+	c.startProcess(ComponentDnsmasq, c.Cfg().APInterface, "dnsmasq", args...)
 }
 
-// StartHostapd starts hostapd.
-func (c *Command) StartHostapd(ssid string, psk string, channel string) {
-	args := []string{
-		"/dev/stdin",
-	}
-	cmd := exec.Command("hostapd", args...)
-
-	cfg := `interface=uap0
-ssid=` + ssid + `
-hw_mode=g
-channel=` + channel + `
-ctrl_interface=/var/run/hostapd
-ctrl_interface_group=0
-macaddr_acl=0
-auth_algs=1
-ignore_broadcast_ssid=0
-wpa=2
-wpa_passphrase=` + psk + `
-wpa_key_mgmt=WPA-PSK
-wpa_pairwise=TKIP
-rsn_pairwise=CCMP`
-
-	c.Log.Info("Hostapd CFG: %s", cfg)
-
-	// handle in pipe here to pass cfg, out/error handled by Runner
-	hostapdPipe, _ := cmd.StdinPipe()
-	defer hostapdPipe.Close()
-	hostapdPipe.Write([]byte(cfg))
-
-	go c.Runner.ProcessCmd("hostapd", cmd)
-	time.Sleep(2)	// brief delay before closing pipe
+// StopDnsmasq stops dnsmasq or the built-in servers.
+func (c *Command) StopDnsmasq() {
+	if c.Cfg().DnsmasqCfg.Builtin {
+		c.stopBuiltin()
+		return
+	}
+
+	c.Processes.Stop(ComponentDnsmasq)
+}
+
+// DnsmasqActive reports whether dnsmasq, or the built-in servers, are
+// running or about to be restarted.
+func (c *Command) DnsmasqActive() bool {
+	if c.Cfg().DnsmasqCfg.Builtin {
+		return c.builtinRunning()
+	}
+
+	return c.Processes.Active(ComponentDnsmasq)
+}
+
+// StartHostapd writes hostapd.conf from the setup config and starts hostapd.
+func (c *Command) StartHostapd() error {
+	path, err := WriteHostapdConf(c.Cfg().APInterface, c.Cfg().HostApdCfg, c.Cfg().MacACL())
+	if err != nil {
+		return err
+	}
+
+	c.Log.Info("hostapd config written", "iface", c.Cfg().APInterface, "path", path)
+
+	c.startProcess(ComponentHostapd, c.Cfg().APInterface, "hostapd", "-P", c.Cfg().HostApdCfg.pidFile(), path)
+
+	return nil
+}
+
+// Shutdown stops the child processes, dnsmasq and hostapd before the
+// wpa_supplicant they sit beside, removes the AP interface and restores
+// the system config files txwifi overwrote. Processes still running when
+// ctx is done are killed.
+func (c *Command) Shutdown(ctx context.Context) error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	names := []string{ComponentDnsmasq, ComponentHostapd, ComponentWpaSupplicant}
+	for _, radio := range c.Cfg().Radios {
+		names = append(names, radioComponent(radio.Interface))
+	}
+
+	for _, name := range names {
+		if err := c.Processes.Terminate(ctx, name); err != nil {
+			c.Log.Error("could not stop process", "process", name, "error", err)
+			keep(err)
+		}
+	}
+	c.stopBuiltin()
+
+	if err := c.RemoveApInterface(); err != nil {
+		c.Log.Error("could not remove ap interface", "iface", c.Cfg().APInterface, "error", err)
+		keep(err)
+	}
+
+	if bridge := c.Cfg().Bridge; bridge.Enabled {
+		if err := teardownBridge(bridge); err != nil {
+			c.Log.Error("could not remove bridge", "iface", bridge.Name, "error", err)
+			keep(err)
+		}
+	}
+
+	for _, path := range []string{c.Cfg().HostApdCfg.confPath(), c.Cfg().resolvConf()} {
+		if err := restoreFile(path); err != nil {
+			c.Log.Error("could not restore config", "path", path, "error", err)
+			keep(err)
+		}
+	}
+
+	c.Log.Info("shutdown complete", "iface", c.Cfg().APInterface)
+
+	return firstErr
 }
@@ -0,0 +1,609 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kinokochat/txwifi/iotwifi/cfgfile"
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/dns"
+)
+
+// CfgVersion is the config layout this txwifi reads. Configs without a
+// version are version 1, the original iotwifi layout, and are migrated
+// when loaded.
+const CfgVersion = 2
+
+// cfgMigrations upgrade a decoded config from version i+1 to version i+2.
+var cfgMigrations = []func(cfg map[string]interface{}) error{
+	migrateCfg1,
+}
+
+// migrateCfg1 upgrades the original iotwifi layout, which had the
+// Raspberry Pi interface names built in. From version 2 they are required.
+func migrateCfg1(cfg map[string]interface{}) error {
+	if _, ok := cfg["station_interface"]; !ok {
+		cfg["station_interface"] = "wlan0"
+	}
+	if _, ok := cfg["ap_interface"]; !ok {
+		cfg["ap_interface"] = "uap0"
+	}
+
+	return nil
+}
+
+// FieldError is a problem with one field of the config.
+type FieldError struct {
+	Field   string `json:"field"`   // host_apd_cfg.wpa_passphrase, empty for the whole file
+	Line    int    `json:"line"`    // 0 if the field is not in the file
+	Message string `json:"message"` // must be 8-63 characters
+}
+
+func (e FieldError) Error() string {
+	msg := e.Message
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+
+	return msg
+}
+
+// ConfigErrors are all the problems found in a config. They wrap ErrConfig.
+type ConfigErrors []FieldError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fieldErr := range e {
+		msgs[i] = fieldErr.Error()
+	}
+
+	return ErrConfig.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e ConfigErrors) Unwrap() error {
+	return ErrConfig
+}
+
+// parseCfg decodes a config in format, migrating it from older versions,
+// applies defaults and validates it.
+func parseCfg(data []byte, format string) (*SetupCfg, error) {
+	v := &SetupCfg{}
+
+	raw, lines, err := cfgfile.Decode(data, format)
+	if err != nil {
+		var syntaxErr *cfgfile.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return v, ConfigErrors{{Line: syntaxErr.Line, Message: syntaxErr.Format + ": " + syntaxErr.Msg}}
+		}
+		return v, ConfigErrors{{Message: err.Error()}}
+	}
+
+	version := 1
+	if rawVersion, ok := raw["version"]; ok {
+		n, ok := rawVersion.(json.Number)
+		version, err = strconv.Atoi(string(n))
+		if !ok || err != nil || version < 1 {
+			return v, ConfigErrors{{Field: "version", Line: lines["version"], Message: "must be a whole number"}}
+		}
+	}
+	if version > CfgVersion {
+		return v, ConfigErrors{{Field: "version", Line: lines["version"], Message: fmt.Sprintf("%d is newer than this txwifi reads (%d)", version, CfgVersion)}}
+	}
+
+	for _, migrate := range cfgMigrations[version-1:] {
+		if err := migrate(raw); err != nil {
+			return v, ConfigErrors{{Field: "version", Message: err.Error()}}
+		}
+	}
+	raw["version"] = CfgVersion
+
+	// decoded again into SetupCfg, through JSON
+	normalize(raw, reflect.TypeOf(v))
+	cfgJSON, err := json.Marshal(raw)
+	if err != nil {
+		return v, ConfigErrors{{Message: err.Error()}}
+	}
+	if err := json.Unmarshal(cfgJSON, v); err != nil {
+		return v, ConfigErrors{jsonError(err, lines)}
+	}
+
+	if errs := v.validate(lines); len(errs) > 0 {
+		return v, errs
+	}
+
+	return v, nil
+}
+
+// validate applies the derived defaults and checks every field, returning
+// all of the problems found.
+func (s *SetupCfg) validate(lines cfgfile.Lines) ConfigErrors {
+	errs := ConfigErrors{}
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{
+			Field:   field,
+			Line:    lines[field],
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if s.StationInterface == "" {
+		fail("station_interface", "is required")
+	}
+	if s.APInterface == "" {
+		fail("ap_interface", "is required")
+	}
+	if s.StationInterface != "" && s.StationInterface == s.APInterface {
+		fail("ap_interface", "must differ from station_interface")
+	}
+
+	if err := applyAPSubnet(s); err != nil {
+		fail("ap_subnet", "%s", err)
+	}
+	if err := s.StationIP.Validate(); err != nil {
+		fail("station_ip", "%s", err)
+	}
+
+	// country is the default for hostapd's country_code
+	s.Country = strings.ToUpper(s.Country)
+	if s.Country != "" && !ValidCountry(s.Country) {
+		fail("country", "invalid country %q", s.Country)
+	}
+	if s.HostApdCfg.CountryCode == "" && s.Country != CountryWorld {
+		s.HostApdCfg.CountryCode = s.Country
+	}
+
+	// a device without an ssid or passphrase gets its own
+	if err := applyIdentity(s); err != nil {
+		fail("identity_file", "%s", err)
+	}
+	secrets.add(s.HostApdCfg.WpaPassphrase)
+
+	ap := s.HostApdCfg.withDefaults()
+	apErrs := len(errs)
+	if ap.Ssid == "" {
+		fail("host_apd_cfg.ssid", "is required")
+	} else if len(ap.Ssid) > 32 {
+		fail("host_apd_cfg.ssid", "must be 1-32 bytes, not %d", len(ap.Ssid))
+	}
+	if ap.WpaPassphrase == "" {
+		fail("host_apd_cfg.wpa_passphrase", "is required")
+	} else if len(ap.WpaPassphrase) < 8 || len(ap.WpaPassphrase) > 63 {
+		fail("host_apd_cfg.wpa_passphrase", "must be 8-63 characters, not %d", len(ap.WpaPassphrase))
+	}
+	if ip := net.ParseIP(ap.Ip); ip == nil || ip.To4() == nil {
+		fail("host_apd_cfg.ip", "invalid ip %q, set it or ap_subnet", ap.Ip)
+	}
+	if channel, err := strconv.Atoi(ap.Channel); err != nil {
+		fail("host_apd_cfg.channel", "invalid channel %q", ap.Channel)
+	} else if ap.Band == Band24 && (channel < 1 || channel > 14) {
+		fail("host_apd_cfg.channel", "channel %d is not a %s channel (1-14)", channel, ap.Band)
+	} else if ap.Band == Band5 && !channels5[channel] {
+		fail("host_apd_cfg.channel", "channel %d is not a %s channel", channel, ap.Band)
+	}
+
+	// the rest of the AP checks, once the fields above are right
+	if len(errs) == apErrs {
+		if err := ap.Validate(); err != nil {
+			fail("host_apd_cfg", "%s", err)
+		}
+	}
+
+	for i, mac := range s.APAllowList {
+		if !macR.MatchString(mac) {
+			fail(fmt.Sprintf("ap_allow_list[%d]", i), "invalid mac address %q", mac)
+		}
+	}
+	for i, mac := range s.APDenyList {
+		if !macR.MatchString(mac) {
+			fail(fmt.Sprintf("ap_deny_list[%d]", i), "invalid mac address %q", mac)
+		}
+	}
+
+	// a bridged AP is served by the DHCP server of the wired network
+	if s.Bridge.Enabled {
+		s.Bridge = s.Bridge.withDefaults()
+		s.HostApdCfg.Bridge = s.Bridge.Name
+
+		if s.Bridge.Interface == s.StationInterface || s.Bridge.Interface == s.APInterface {
+			fail("bridge.interface", "must differ from station_interface and ap_interface")
+		}
+		if err := s.Bridge.IP.Validate(); err != nil {
+			fail("bridge.ip", "%s", err)
+		}
+		if client := s.Bridge.DhcpClient; client != "" {
+			if _, ok := dhcpClientArgs[client]; !ok {
+				fail("bridge.dhcp_client", "unsupported dhcp client %q", client)
+			}
+		}
+	} else if s.DnsmasqCfg.DhcpRange == "" {
+		fail("dnsmasq_cfg.dhcp_range", "is required, set it or ap_subnet")
+	} else if parts := strings.Split(s.DnsmasqCfg.DhcpRange, ","); len(parts) < 2 || net.ParseIP(parts[0]) == nil || net.ParseIP(parts[1]) == nil {
+		fail("dnsmasq_cfg.dhcp_range", "invalid dhcp_range %q, expected start,end[,netmask],lease", s.DnsmasqCfg.DhcpRange)
+	} else if _, _, _, err := dhcp.ParseRange(s.DnsmasqCfg.DhcpRange); err != nil && s.DnsmasqCfg.Builtin {
+		fail("dnsmasq_cfg.dhcp_range", "%s", err)
+	}
+	if s.DnsmasqCfg.Builtin && s.DnsmasqCfg.Address != "" {
+		if _, err := dns.ParseAddress(s.DnsmasqCfg.Address); err != nil {
+			fail("dnsmasq_cfg.address", "%s", err)
+		}
+	}
+	for i, reservation := range s.DnsmasqCfg.Reservations {
+		if err := reservation.Validate(); err != nil {
+			fail(fmt.Sprintf("dnsmasq_cfg.reservations[%d]", i), "%s", err)
+		}
+	}
+
+	if s.WpaSupplicantCfg.CfgFile == "" {
+		fail("wpa_supplicant_cfg.cfg_file", "is required")
+	}
+	if client := s.WpaSupplicantCfg.DhcpClient; client != "" {
+		if _, ok := dhcpClientArgs[client]; !ok {
+			fail("wpa_supplicant_cfg.dhcp_client", "unsupported dhcp client %q", client)
+		}
+	}
+
+	switch s.Firewall {
+	case "", FirewallAuto, FirewallIptables, FirewallNftables:
+	default:
+		fail("firewall", "unknown firewall %q, want auto, iptables or nftables", s.Firewall)
+	}
+	if s.Router.Enabled && s.Bridge.Enabled {
+		fail("router.enabled", "cannot route a bridged AP, disable bridge")
+	}
+	if s.Router.Uplink != "" && s.Router.Uplink == s.APInterface {
+		fail("router.uplink", "must differ from ap_interface")
+	}
+
+	if host := s.Zeroconf.Host; host != "" && !hostLabelR.MatchString(host) {
+		fail("zeroconf.host", "invalid host name %q, want letters, digits and dashes", host)
+	}
+
+	if port := s.GRPC.Port; port < 0 || port > 65535 {
+		fail("grpc.port", "invalid port %d", port)
+	}
+
+	if broker := s.Remote.Broker; broker != "" {
+		if u, err := url.Parse(broker); err != nil || !remoteSchemes[u.Scheme] || u.Host == "" {
+			fail("remote.broker", "invalid broker %q, want tcp://host:1883 or tls://host:8883", broker)
+		}
+	}
+	if s.Remote.StatusIntervalSec < 0 {
+		fail("remote.status_interval_sec", "must not be negative")
+	}
+	secrets.add(s.Remote.Password)
+
+	if err := s.Credentials.Validate(); err != nil {
+		fail("credentials.key_source", "%s", err)
+	}
+
+	if s.Audit.MaxSizeKB < 0 {
+		fail("audit.max_size_kb", "must not be negative")
+	}
+	if s.Audit.MaxFiles < 0 {
+		fail("audit.max_files", "must not be negative")
+	}
+	if s.Operations.Keep < 0 {
+		fail("operations.keep", "must not be negative")
+	}
+	if endpoint := s.Telemetry.Endpoint; endpoint != "" && !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		fail("telemetry.endpoint", "must be an http or https URL")
+	}
+	if s.Telemetry.IntervalSec < 0 {
+		fail("telemetry.interval_sec", "must not be negative")
+	}
+	if err := s.ConnectRetry.Validate(); err != nil {
+		fail("connect_retry", "%s", err)
+	}
+
+	limits := []struct {
+		field string
+		value int
+	}{
+		{"rate_limit.connect_per_min", s.RateLimit.ConnectPerMin},
+		{"rate_limit.requests_per_min", s.RateLimit.RequestsPerMin},
+		{"rate_limit.max_auth_failures", s.RateLimit.MaxAuthFailures},
+		{"rate_limit.lockout_sec", s.RateLimit.LockoutSec},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 {
+			fail(limit.field, "must not be negative")
+		}
+	}
+
+	if s.APWindow.Minutes < 0 {
+		fail("ap_window.minutes", "must not be negative")
+	}
+	if s.APWindow.GraceSec < 0 {
+		fail("ap_window.grace_sec", "must not be negative")
+	}
+	if s.HostApdCfg.FollowStationChannel && s.APDedicated {
+		fail("host_apd_cfg.follow_station_channel", "needs the AP on the station's radio, not ap_dedicated")
+	}
+	if err := s.GPIO.Validate(); err != nil {
+		fail("gpio", "%s", err)
+	}
+	if s.GPIO.Button.LongPressSec < 0 {
+		fail("gpio.button.long_press_sec", "must not be negative")
+	}
+
+	if err := s.Webhook.Validate(); err != nil {
+		fail("webhook", "%s", err)
+	}
+	for i, hook := range s.Webhooks {
+		if hook.Url == "" {
+			fail(fmt.Sprintf("webhooks[%d].url", i), "is required")
+		}
+		if err := hook.Validate(); err != nil {
+			fail(fmt.Sprintf("webhooks[%d]", i), "%s", err)
+		}
+	}
+
+	if err := s.Preflight.Validate(); err != nil {
+		fail("preflight.mode", "%s", err)
+	}
+
+	if s.P2P.Enabled {
+		if s.NetworkManager.Enabled {
+			fail("p2p.enabled", "the wpa_supplicant of NetworkManager has no control socket, disable p2p or network_manager")
+		}
+		if s.P2P.GoIntent < 0 || s.P2P.GoIntent > 15 {
+			fail("p2p.go_intent", "must be within 0-15")
+		}
+	}
+
+	if s.SpeedTest.DurationSec < 0 || s.SpeedTest.DurationSec > maxSpeedTestSec {
+		fail("speed_test.duration_sec", "must be within 0-%d", maxSpeedTestSec)
+	}
+	if u, err := url.Parse(s.SpeedTest.Url); s.SpeedTest.Url != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+		fail("speed_test.url", "invalid url %q, want http(s)://", s.SpeedTest.Url)
+	}
+
+	if err := s.Scan.Options.Validate(); err != nil {
+		fail("scan.options", "%s", err)
+	}
+
+	if s.Survey.Scans < 0 || s.Survey.Scans > MaxSurveyScans {
+		fail("survey.scans", "must be within 0-%d", MaxSurveyScans)
+	}
+	if s.Survey.IntervalSec < 0 {
+		fail("survey.interval_sec", "must not be negative")
+	}
+	if s.Survey.AutoChannel && s.HostApdCfg.FollowStationChannel {
+		fail("survey.auto_channel", "the ap follows the station's channel, unset host_apd_cfg.follow_station_channel")
+	}
+
+	for field, sec := range map[string]int{
+		"state_machine.boot_timeout_sec":       s.StateMachine.BootTimeoutSec,
+		"state_machine.connecting_timeout_sec": s.StateMachine.ConnectingTimeoutSec,
+		"state_machine.offline_timeout_sec":    s.StateMachine.OfflineTimeoutSec,
+		"state_machine.error_timeout_sec":      s.StateMachine.ErrorTimeoutSec,
+	} {
+		if sec < 0 {
+			fail(field, "must not be negative")
+		}
+	}
+
+	for i, dir := range s.Bootstrap.Dirs {
+		if _, err := filepath.Match(dir, ""); err != nil || !filepath.IsAbs(dir) {
+			fail(fmt.Sprintf("bootstrap.dirs[%d]", i), "invalid dir %q, want an absolute path or glob pattern", dir)
+		}
+	}
+
+	watched := map[string]bool{}
+	for i, e := range s.Watchlist {
+		field := fmt.Sprintf("watchlist[%d]", i)
+		if err := e.Validate(); err != nil {
+			fail(field, "%s", err)
+		}
+		if watched[e.Ssid] {
+			fail(field, "ssid %q is watched twice", e.Ssid)
+		}
+		watched[e.Ssid] = true
+	}
+
+	if u, err := url.Parse(s.Oui.Url); s.Oui.Url != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+		fail("oui.url", "invalid url %q, want http(s)://", s.Oui.Url)
+	}
+
+	if s.Latency.IntervalSec < 0 || s.Latency.TimeoutSec < 0 {
+		fail("latency", "intervals must not be negative")
+	}
+	if s.Latency.Count < 0 || s.Latency.Count > 100 {
+		fail("latency.count", "must be within 0-100")
+	}
+	for i, target := range s.Latency.Targets {
+		if target == "" || strings.ContainsAny(target, " /") {
+			fail(fmt.Sprintf("latency.targets[%d]", i), "invalid host %q", target)
+		}
+	}
+
+	if s.Watchdog.Enabled && s.NetworkManager.Enabled {
+		fail("watchdog.enabled", "the wpa_supplicant of NetworkManager has no control socket, disable watchdog or network_manager")
+	}
+	if s.Watchdog.MinRssi > 0 || s.Watchdog.MinRssi < -100 {
+		fail("watchdog.min_rssi", "%d is not a dBm value", s.Watchdog.MinRssi)
+	}
+	if s.Watchdog.MaxLoss < 0 || s.Watchdog.MaxLoss > 100 {
+		fail("watchdog.max_loss", "must be within 0-100")
+	}
+	if s.Watchdog.HysteresisDb < 0 {
+		fail("watchdog.hysteresis_db", "must not be negative")
+	}
+	if s.Watchdog.RoamAfter > 0 && s.Watchdog.ReconnectAfter > 0 && s.Watchdog.ReconnectAfter < s.Watchdog.RoamAfter {
+		fail("watchdog.reconnect_after", "must not be less than roam_after")
+	}
+
+	if s.IPv6.Enabled {
+		s.IPv6 = s.IPv6.withDefaults()
+
+		if s.Bridge.Enabled {
+			fail("ipv6.enabled", "the wired network serves IPv6 to a bridged AP, disable ipv6")
+		}
+		if s.DnsmasqCfg.Builtin {
+			fail("ipv6.enabled", "the built-in DHCP server serves IPv4 only, disable ipv6 or dnsmasq_cfg.builtin")
+		}
+		if err := s.IPv6.Validate(); err != nil {
+			fail("ipv6", "%s", err)
+		}
+	}
+
+	ifaces := map[string]bool{s.StationInterface: true, s.APInterface: true}
+	cfgFiles := map[string]bool{s.WpaSupplicantCfg.CfgFile: true}
+	for i, radio := range s.Radios {
+		field := fmt.Sprintf("radios[%d]", i)
+
+		if radio.Interface == "" {
+			fail(field+".interface", "is required")
+		} else if ifaces[radio.Interface] {
+			fail(field+".interface", "%s is already in use", radio.Interface)
+		}
+		ifaces[radio.Interface] = true
+
+		if err := radio.StationIP.Validate(); err != nil {
+			fail(field+".station_ip", "%s", err)
+		}
+
+		if radio.WpaSupplicantCfg.CfgFile == "" {
+			fail(field+".wpa_supplicant_cfg.cfg_file", "is required")
+		} else if cfgFiles[radio.WpaSupplicantCfg.CfgFile] {
+			fail(field+".wpa_supplicant_cfg.cfg_file", "%s is used by another radio", radio.WpaSupplicantCfg.CfgFile)
+		}
+		cfgFiles[radio.WpaSupplicantCfg.CfgFile] = true
+
+		if client := radio.WpaSupplicantCfg.DhcpClient; client != "" {
+			if _, ok := dhcpClientArgs[client]; !ok {
+				fail(field+".wpa_supplicant_cfg.dhcp_client", "unsupported dhcp client %q", client)
+			}
+		}
+	}
+
+	if err := s.Processes.Validate(); err != nil {
+		fail("processes", "%s", err)
+	}
+
+	if _, err := ParseLogLevel(s.LogLevel); err != nil {
+		fail("log_level", "unknown log level %q, want debug, info, warn or error", s.LogLevel)
+	}
+	if err := s.APISocket.Validate(); err != nil {
+		fail("api_socket", "%s", err)
+	}
+
+	return errs
+}
+
+// jsonError turns a decoding error into a FieldError with the line of the
+// field it is about.
+func jsonError(err error, lines cfgfile.Lines) FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return FieldError{
+			Field:   typeErr.Field,
+			Line:    lines[typeErr.Field],
+			Message: fmt.Sprintf("is a %s, want %s", typeErr.Value, typeErr.Type),
+		}
+	}
+
+	return FieldError{Message: err.Error()}
+}
+
+// normalize converts the numbers in a decoded config to what the fields
+// they are in expect: numbers given for strings, such as a channel written
+// as 6, become strings and YAML and TOML forms such as 0x1f or 1_000
+// become JSON numbers.
+func normalize(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		if t != nil && t.Kind() == reflect.String {
+			return string(v)
+		}
+		return jsonNumber(v)
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalize(elem, fieldType(t, key))
+		}
+	case []interface{}:
+		var elemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elemType = t.Elem()
+		}
+		for i, elem := range v {
+			v[i] = normalize(elem, elemType)
+		}
+	}
+
+	return value
+}
+
+// fieldType returns the type of the field of t that key decodes into, or
+// nil if there is none.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		// embedded structs share their fields
+		if field.Anonymous && name == "" {
+			if embedded := fieldType(field.Type, key); embedded != nil {
+				return embedded
+			}
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field.Type
+		}
+	}
+
+	return nil
+}
+
+// jsonNumber rewrites a YAML or TOML number as a JSON one. Anything else,
+// such as inf, is left as a string for decoding to reject.
+func jsonNumber(n json.Number) interface{} {
+	s := strings.Replace(string(n), "_", "", -1)
+
+	// 0x, 0o and 0b, but a leading zero is still decimal
+	base := 10
+	if digits := strings.TrimLeft(s, "+-"); len(digits) > 1 && digits[0] == '0' && strings.IndexByte("xob", digits[1]) >= 0 {
+		base = 0
+	}
+	if i, err := strconv.ParseInt(s, base, 64); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+
+	return string(n)
+}
@@ -0,0 +1,622 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/dbus"
+)
+
+// Network managers that may claim the wireless interfaces.
+const (
+	ManagerDhcpcd         = "dhcpcd"
+	ManagerNetworkManager = "NetworkManager"
+	ManagerNetworkd       = "systemd-networkd"
+	ManagerConnman        = "connman"
+)
+
+// The configuration of the managers, read to detect conflicts and
+// written to fix them.
+const (
+	DhcpcdConf            = "/etc/dhcpcd.conf"
+	NetworkManagerConf    = "/etc/NetworkManager/NetworkManager.conf"
+	NetworkManagerConfDir = "/etc/NetworkManager/conf.d"
+	NetworkdDir           = "/etc/systemd/network"
+	ConnmanConf           = "/etc/connman/main.conf"
+)
+
+// networkdDirs are searched for .network files, a file in an earlier one
+// overriding one of the same name in a later one.
+var networkdDirs = []string{NetworkdDir, "/run/systemd/network", "/usr/lib/systemd/network", "/lib/systemd/network"}
+
+// managerProcesses are the process names of the managers, as in
+// /proc/*/comm, which cuts them at 15 characters.
+var managerProcesses = map[string]string{
+	ManagerDhcpcd:         "dhcpcd",
+	ManagerNetworkManager: "NetworkManager",
+	ManagerNetworkd:       "systemd-network",
+	ManagerConnman:        "connmand",
+}
+
+// connmanDefaultBlacklist is connman's NetworkInterfaceBlacklist when
+// main.conf does not set it.
+const connmanDefaultBlacklist = "vmnet,vboxnet,virbr,ifb,ve-,vb-"
+
+// The files FixConflicts writes.
+const (
+	nmUnmanagedConf  = "txwifi-unmanaged.conf"
+	networkdConfName = "00-txwifi.network"
+)
+
+// ConflictCfg configures the check for other network managers and is
+// used by SetupCfg.
+type ConflictCfg struct {
+	Disabled bool `json:"disabled"` // do not check at startup
+	Fix      bool `json:"fix"`      // write the configuration that makes the managers leave the interfaces alone
+}
+
+// Conflict is a network manager claiming an interface txwifi runs.
+type Conflict struct {
+	Manager string `json:"manager"`
+	Iface   string `json:"iface"`
+	Detail  string `json:"detail"` // why the manager is thought to claim it
+	Hint    string `json:"hint"`   // how to make it leave the interface alone
+	Fixed   bool   `json:"fixed"`  // FixConflicts wrote File
+	File    string `json:"file,omitempty"`
+}
+
+// Conflicts returns the network managers that run and claim the station
+// radios or the AP interface: dhcpcd without denyinterfaces for them,
+// NetworkManager managing them, systemd-networkd with a .network file
+// matching them and connman without them in its blacklist. Only managers
+// whose process is visible in /proc are checked.
+func (wpa *WpaCfg) Conflicts(ctx context.Context) []Conflict {
+	conflicts := []Conflict{}
+	ifaces := wpa.claimable()
+
+	if processRunning(managerProcesses[ManagerDhcpcd]) == nil {
+		conflicts = append(conflicts, wpa.dhcpcdConflicts(ifaces)...)
+	}
+	if processRunning(managerProcesses[ManagerNetworkManager]) == nil {
+		conflicts = append(conflicts, wpa.nmConflicts(ctx, ifaces)...)
+	}
+	if processRunning(managerProcesses[ManagerNetworkd]) == nil {
+		conflicts = append(conflicts, networkdConflicts(ifaces)...)
+	}
+	if processRunning(managerProcesses[ManagerConnman]) == nil {
+		conflicts = append(conflicts, connmanConflicts(ifaces)...)
+	}
+
+	return conflicts
+}
+
+// claimable returns the interfaces txwifi runs: the station radios and
+// the AP interface.
+func (wpa *WpaCfg) claimable() []string {
+	return append(wpa.stationInterfaces(), wpa.Cfg().APInterface)
+}
+
+// dhcpcdConflicts returns the interfaces dhcpcd does not deny, except the
+// station radios txwifi runs dhcpcd on itself.
+func (wpa *WpaCfg) dhcpcdConflicts(ifaces []string) []Conflict {
+	ours := map[string]bool{}
+	if wpa.Cfg().WpaSupplicantCfg.DhcpClient == ManagerDhcpcd {
+		ours[wpa.Cfg().StationInterface] = true
+	}
+	for _, radio := range wpa.Cfg().Radios {
+		if radio.WpaSupplicantCfg.DhcpClient == ManagerDhcpcd {
+			ours[radio.Interface] = true
+		}
+	}
+
+	denied := dhcpcdDenied()
+
+	conflicts := []Conflict{}
+	for _, iface := range ifaces {
+		if ours[iface] || matchAny(denied, iface) {
+			continue
+		}
+		conflicts = append(conflicts, Conflict{
+			Manager: ManagerDhcpcd,
+			Iface:   iface,
+			Detail:  "dhcpcd is running and " + DhcpcdConf + " does not deny " + iface,
+			Hint:    "add \"denyinterfaces " + iface + "\" to " + DhcpcdConf + " and restart dhcpcd",
+		})
+	}
+
+	return conflicts
+}
+
+// dhcpcdDenied returns the patterns of the denyinterfaces lines of
+// DhcpcdConf.
+func dhcpcdDenied() []string {
+	patterns := []string{}
+	for _, line := range confLines(DhcpcdConf) {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "denyinterfaces" {
+			patterns = append(patterns, fields[1:]...)
+		}
+	}
+
+	return patterns
+}
+
+// nmConflicts returns the interfaces NetworkManager manages, or would
+// manage once they appear, except the station in NetworkManager mode.
+func (wpa *WpaCfg) nmConflicts(ctx context.Context, ifaces []string) []Conflict {
+	conflicts := []Conflict{}
+	unmanaged := nmUnmanaged()
+
+	conn, err := dialBus(wpa.Cfg().DBusSocket)
+	if err == nil {
+		defer conn.Close()
+	}
+
+	for _, iface := range ifaces {
+		if wpa.Cfg().NetworkManager.Enabled && iface == wpa.Cfg().StationInterface {
+			continue
+		}
+
+		conflict := Conflict{
+			Manager: ManagerNetworkManager,
+			Iface:   iface,
+			Hint:    "add interface-name:" + iface + " to unmanaged-devices in the [keyfile] section of a file in " + NetworkManagerConfDir + " and reload NetworkManager",
+		}
+		if iface == wpa.Cfg().StationInterface {
+			conflict.Hint += ", or enable network_manager to let it run the station"
+		}
+
+		managed, known := nmManaged(ctx, conn, iface)
+		switch {
+		case known && !managed:
+			continue
+		case known:
+			conflict.Detail = "NetworkManager manages " + iface
+		case matchAny(unmanaged, iface):
+			continue
+		default:
+			conflict.Detail = "NetworkManager is running and its configuration does not leave " + iface + " unmanaged"
+		}
+		conflicts = append(conflicts, conflict)
+	}
+
+	return conflicts
+}
+
+// nmManaged asks NetworkManager whether it manages iface, known is false
+// when it cannot tell, not knowing the interface.
+func nmManaged(ctx context.Context, conn *dbus.Conn, iface string) (managed bool, known bool) {
+	if conn == nil {
+		return false, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	body, err := conn.Call(ctx, nmService, nmPath, nmService, "GetDeviceByIpIface", "s", iface)
+	if err != nil {
+		return false, false
+	}
+	device, _ := replyValue(body, 0).(dbus.ObjectPath)
+
+	value, err := conn.Get(ctx, nmService, device, nmDevice, "Managed")
+	if err != nil {
+		return false, false
+	}
+	managed, known = value.(bool)
+
+	return managed, known
+}
+
+// nmUnmanaged returns the interface name patterns of the unmanaged-devices
+// settings in the NetworkManager configuration.
+func nmUnmanaged() []string {
+	files, _ := filepath.Glob(filepath.Join(NetworkManagerConfDir, "*.conf"))
+
+	patterns := []string{}
+	for _, file := range append([]string{NetworkManagerConf}, files...) {
+		for _, line := range confLines(file) {
+			value := strings.TrimPrefix(line, "unmanaged-devices=")
+			if value == line {
+				continue
+			}
+			for _, spec := range strings.Split(value, ";") {
+				if name := strings.TrimPrefix(strings.TrimSpace(spec), "interface-name:"); name != spec {
+					patterns = append(patterns, name)
+				}
+			}
+		}
+	}
+
+	return patterns
+}
+
+// networkdConflicts returns the interfaces whose first matching .network
+// file does not leave them unmanaged.
+func networkdConflicts(ifaces []string) []Conflict {
+	files := networkdFiles()
+
+	conflicts := []Conflict{}
+	for _, iface := range ifaces {
+		for _, file := range files {
+			names, unmanaged := networkdMatch(file)
+			if !matchAny(names, iface) {
+				continue
+			}
+			if !unmanaged {
+				conflicts = append(conflicts, Conflict{
+					Manager: ManagerNetworkd,
+					Iface:   iface,
+					Detail:  "systemd-networkd is running and " + file + " matches " + iface,
+					Hint:    "add a .network file in " + NetworkdDir + " ordered before " + filepath.Base(file) + " matching Name=" + iface + " with Unmanaged=yes in its [Link] section, and run networkctl reload",
+				})
+			}
+			break
+		}
+	}
+
+	return conflicts
+}
+
+// networkdFiles returns the .network files in the order systemd-networkd
+// matches them: by name, a file in an earlier directory hiding one of the
+// same name in a later one.
+func networkdFiles() []string {
+	byName := map[string]string{}
+	for _, dir := range networkdDirs {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.network"))
+		for _, path := range paths {
+			if _, ok := byName[filepath.Base(path)]; !ok {
+				byName[filepath.Base(path)] = path
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := []string{}
+	for _, name := range names {
+		files = append(files, byName[name])
+	}
+
+	return files
+}
+
+// networkdMatch returns the Name= patterns of the [Match] section of a
+// .network file and whether its [Link] section sets Unmanaged=yes. Files
+// matching on anything but the name are left out.
+func networkdMatch(file string) (names []string, unmanaged bool) {
+	section := ""
+	for _, line := range confLines(file) {
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch {
+		case section == "[Match]" && key == "Name":
+			names = append(names, strings.Fields(value)...)
+		case section == "[Link]" && key == "Unmanaged":
+			unmanaged = value == "yes" || value == "true" || value == "1"
+		}
+	}
+
+	return names, unmanaged
+}
+
+// connmanConflicts returns the interfaces connman does not blacklist.
+func connmanConflicts(ifaces []string) []Conflict {
+	blacklist := connmanBlacklist()
+
+	conflicts := []Conflict{}
+	for _, iface := range ifaces {
+		blacklisted := false
+		for _, prefix := range blacklist {
+			if prefix != "" && strings.HasPrefix(iface, prefix) {
+				blacklisted = true
+			}
+		}
+		if blacklisted {
+			continue
+		}
+
+		conflicts = append(conflicts, Conflict{
+			Manager: ManagerConnman,
+			Iface:   iface,
+			Detail:  "connman is running and its NetworkInterfaceBlacklist does not have " + iface,
+			Hint:    "add " + iface + " to NetworkInterfaceBlacklist in the [General] section of " + ConnmanConf + " and restart connman",
+		})
+	}
+
+	return conflicts
+}
+
+// connmanBlacklist returns the interface name prefixes connman ignores.
+func connmanBlacklist() []string {
+	value, ok := iniValue(confLines(ConnmanConf), "[General]", "NetworkInterfaceBlacklist")
+	if !ok {
+		value = connmanDefaultBlacklist
+	}
+
+	prefixes := []string{}
+	for _, prefix := range strings.Split(value, ",") {
+		prefixes = append(prefixes, strings.TrimSpace(prefix))
+	}
+
+	return prefixes
+}
+
+// FixConflicts writes the configuration that makes the managers of
+// conflicts leave their interfaces alone and returns them with Fixed set
+// where that worked. NetworkManager is also told over D-Bus and
+// systemd-networkd reloaded, dhcpcd and connman only read theirs when
+// restarted.
+func (wpa *WpaCfg) FixConflicts(ctx context.Context, conflicts []Conflict) []Conflict {
+	byManager := map[string][]string{}
+	for _, conflict := range conflicts {
+		byManager[conflict.Manager] = append(byManager[conflict.Manager], conflict.Iface)
+	}
+
+	files := map[string]string{}
+	for manager, ifaces := range byManager {
+		var file string
+		var err error
+		switch manager {
+		case ManagerDhcpcd:
+			file, err = fixDhcpcd(ifaces)
+		case ManagerNetworkManager:
+			file, err = wpa.fixNetworkManager(ctx, ifaces)
+		case ManagerNetworkd:
+			file, err = wpa.fixNetworkd(ctx, ifaces)
+		case ManagerConnman:
+			file, err = fixConnman(ifaces)
+		}
+
+		if err != nil {
+			wpa.Log.Error("could not fix conflict", "manager", manager, "iface", strings.Join(ifaces, ","), "error", err)
+			continue
+		}
+		files[manager] = file
+		wpa.Log.Info("conflict fixed", "manager", manager, "iface", strings.Join(ifaces, ","), "file", file)
+	}
+
+	fixed := []Conflict{}
+	for _, conflict := range conflicts {
+		if file, ok := files[conflict.Manager]; ok {
+			conflict.Fixed = true
+			conflict.File = file
+		}
+		fixed = append(fixed, conflict)
+	}
+
+	return fixed
+}
+
+// fixDhcpcd appends a denyinterfaces line to DhcpcdConf.
+func fixDhcpcd(ifaces []string) (string, error) {
+	f, err := os.OpenFile(DhcpcdConf, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return DhcpcdConf, err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "\n# interfaces run by txwifi\ndenyinterfaces %s\n", strings.Join(ifaces, " "))
+	return DhcpcdConf, err
+}
+
+// fixNetworkManager writes a configuration file leaving ifaces, and those
+// an earlier fix left, unmanaged and sets them unmanaged right away.
+func (wpa *WpaCfg) fixNetworkManager(ctx context.Context, ifaces []string) (string, error) {
+	file := filepath.Join(NetworkManagerConfDir, nmUnmanagedConf)
+
+	// keep what an earlier run wrote
+	value, _ := iniValue(confLines(file), "[keyfile]", "unmanaged-devices")
+	specs := []string{}
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	for _, iface := range ifaces {
+		if spec := "interface-name:" + iface; !contains(specs, spec) {
+			specs = append(specs, spec)
+		}
+	}
+
+	if err := os.MkdirAll(NetworkManagerConfDir, 0755); err != nil {
+		return file, err
+	}
+	conf := "# interfaces run by txwifi\n[keyfile]\nunmanaged-devices=" + strings.Join(specs, ";") + "\n"
+	if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+		return file, err
+	}
+
+	nm := NewNetworkManager(wpa)
+	defer nm.Close()
+	for _, iface := range ifaces {
+		unmanageCtx, cancel := context.WithTimeout(ctx, healthTimeout)
+		if err := nm.Unmanage(unmanageCtx, iface); err != nil {
+			wpa.Log.Debug("could not unmanage interface", "iface", iface, "error", err)
+		}
+		cancel()
+	}
+
+	return file, nil
+}
+
+// fixNetworkd writes a .network file, ordered before the others, leaving
+// ifaces and those an earlier fix left unmanaged, and reloads
+// systemd-networkd.
+func (wpa *WpaCfg) fixNetworkd(ctx context.Context, ifaces []string) (string, error) {
+	file := filepath.Join(NetworkdDir, networkdConfName)
+
+	// keep what an earlier run wrote
+	names, _ := networkdMatch(file)
+	for _, iface := range ifaces {
+		if !contains(names, iface) {
+			names = append(names, iface)
+		}
+	}
+
+	if err := os.MkdirAll(NetworkdDir, 0755); err != nil {
+		return file, err
+	}
+	conf := "# interfaces run by txwifi\n[Match]\nName=" + strings.Join(names, " ") + "\n\n[Link]\nUnmanaged=yes\n"
+	if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+		return file, err
+	}
+
+	reloadCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := wpa.Runner.Output(reloadCtx, "networkctl", "reload"); err != nil {
+		wpa.Log.Warn("could not reload systemd-networkd", "error", err)
+	}
+
+	return file, nil
+}
+
+// fixConnman adds ifaces to NetworkInterfaceBlacklist in ConnmanConf.
+func fixConnman(ifaces []string) (string, error) {
+	prefixes := []string{}
+	for _, prefix := range connmanBlacklist() {
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	for _, iface := range ifaces {
+		if !contains(prefixes, iface) {
+			prefixes = append(prefixes, iface)
+		}
+	}
+
+	content, err := ioutil.ReadFile(ConnmanConf)
+	if err != nil && !os.IsNotExist(err) {
+		return ConnmanConf, err
+	}
+	content = setIniValue(content, "[General]", "NetworkInterfaceBlacklist", strings.Join(prefixes, ","))
+
+	if err := os.MkdirAll(filepath.Dir(ConnmanConf), 0755); err != nil {
+		return ConnmanConf, err
+	}
+
+	return ConnmanConf, ioutil.WriteFile(ConnmanConf, content, 0644)
+}
+
+// confLines returns the lines of a configuration file, trimmed, without
+// blank lines and comments. A missing file has none.
+func confLines(file string) []string {
+	lines := []string{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// iniValue returns the value of key in section of the lines of an ini
+// file.
+func iniValue(lines []string, section string, key string) (string, bool) {
+	current := ""
+	for _, line := range lines {
+		if strings.HasPrefix(line, "[") {
+			current = line
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if current == section && len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.TrimSpace(kv[1]), true
+		}
+	}
+
+	return "", false
+}
+
+// setIniValue sets key in section of an ini file, adding the section if
+// it is missing, and keeps the rest of the file as it is.
+func setIniValue(content []byte, section string, key string, value string) []byte {
+	setting := key + "=" + value
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(content) == 0 {
+		lines = nil
+	}
+
+	current := ""
+	insert := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			current = trimmed
+			if current == section {
+				insert = i + 1
+			}
+			continue
+		}
+
+		kv := strings.SplitN(trimmed, "=", 2)
+		if current == section && len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			lines[i] = setting
+			return []byte(strings.Join(lines, "\n") + "\n")
+		}
+	}
+
+	if insert < 0 {
+		lines = append(lines, section, setting)
+	} else {
+		lines = append(lines[:insert], append([]string{setting}, lines[insert:]...)...)
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// matchAny reports whether name matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains reports whether list has s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
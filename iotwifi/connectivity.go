@@ -0,0 +1,320 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Connectivity states, from best to worst.
+const (
+	ConnectivityOnline   = "online"    // the probe got the expected answer
+	ConnectivityCaptive  = "captive"   // the probe was answered by something else, a captive portal
+	ConnectivityNoDns    = "no-dns"    // addressed, but names do not resolve
+	ConnectivityLinkOnly = "link-only" // associated, but no address or nothing reachable
+)
+
+// Connectivity check defaults.
+const (
+	DefaultProbeUrl            = "http://connectivitycheck.gstatic.com/generate_204"
+	DefaultProbeStatus         = http.StatusNoContent
+	DefaultPingHost            = "1.1.1.1"
+	DefaultPingHost6           = "2606:4700:4700::1111"
+	DefaultConnectivityTimeout = 5 * time.Second
+)
+
+// connectivityMaxAge is how long Status reuses a connectivity result.
+const connectivityMaxAge = 30 * time.Second
+
+// ConnectivityCfg configures the connectivity check and is used by SetupCfg.
+type ConnectivityCfg struct {
+	Disabled    bool   `json:"disabled"`     // do not check, for networks without internet
+	ProbeUrl    string `json:"probe_url"`    // answered with probe_status when online
+	ProbeStatus int    `json:"probe_status"` // 204 by default
+	PingHost    string `json:"ping_host"`    // pinged when the probe fails, 1.1.1.1 by default
+	PingHost6   string `json:"ping_host6"`   // pinged instead without an IPv4 address
+	TimeoutSec  int    `json:"timeout_sec"`  // per step, 5 by default
+}
+
+// Connectivity is the result of a connectivity check of the station.
+type Connectivity struct {
+	State      string        `json:"state"`
+	Ip         string        `json:"ip"`
+	Gateway    string        `json:"gateway"`
+	Ipv6       []string      `json:"ipv6"`        // global IPv6 addresses
+	Gateway6   string        `json:"gateway6"`    // IPv6 default router
+	Dns        bool          `json:"dns"`         // the probe host resolved
+	HttpStatus int           `json:"http_status"` // 0 if the probe got no answer
+	Ping       bool          `json:"ping"`        // ping_host answered, only tried if the probe failed
+	Message    string        `json:"message"`
+	PortalUrl  string        `json:"captive_portal_url"` // where a captive portal sent the probe
+	Checked    time.Time     `json:"checked"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// withDefaults fills in the empty settings.
+func (c ConnectivityCfg) withDefaults() ConnectivityCfg {
+	if c.ProbeUrl == "" {
+		c.ProbeUrl = DefaultProbeUrl
+	}
+	if c.ProbeStatus == 0 {
+		c.ProbeStatus = DefaultProbeStatus
+	}
+	if c.PingHost == "" {
+		c.PingHost = DefaultPingHost
+	}
+	if c.PingHost6 == "" {
+		c.PingHost6 = DefaultPingHost6
+	}
+
+	return c
+}
+
+// timeout returns the per step timeout.
+func (c ConnectivityCfg) timeout() time.Duration {
+	if c.TimeoutSec > 0 {
+		return time.Duration(c.TimeoutSec) * time.Second
+	}
+
+	return DefaultConnectivityTimeout
+}
+
+// CheckConnectivity checks, through the station interface, that it has
+// an address and a gateway, that DNS resolves the probe host and that the
+// probe URL answers as expected, through the proxy of the network if its
+// profile has one, falling back to a ping when it does not answer at all. IPv4 and IPv6 both count, so IPv6-only networks are
+// online too.
+func (wpa *WpaCfg) CheckConnectivity(ctx context.Context) (result Connectivity) {
+	cfg := wpa.Cfg().Connectivity.withDefaults()
+	iface := wpa.Cfg().StationInterface
+	start := time.Now()
+
+	result = Connectivity{
+		State:    ConnectivityLinkOnly,
+		Ip:       interfaceIPv4(iface),
+		Gateway:  defaultGateway(iface),
+		Ipv6:     interfaceIPv6(iface),
+		Gateway6: defaultGateway6(iface),
+	}
+	defer func() {
+		result.Checked = time.Now()
+		result.Duration = time.Since(start)
+
+		wpa.connMu.Lock()
+		previous := wpa.connectivity
+		wpa.connectivity = result
+		wpa.connMu.Unlock()
+
+		// tell operators why an associated device is offline
+		if result.State == ConnectivityCaptive && (previous.State != ConnectivityCaptive || previous.PortalUrl != result.PortalUrl) {
+			wpa.Log.Warn("captive portal detected", "iface", iface, "captive_portal_url", result.PortalUrl)
+			wpa.publish(Event{
+				Type:    EventCaptivePortal,
+				Source:  "connectivity",
+				Name:    iface,
+				Message: result.PortalUrl,
+			})
+		}
+
+		wpa.Log.Info("connectivity checked", "iface", iface, "state", result.State, "http_status", result.HttpStatus, "duration", result.Duration)
+	}()
+
+	// DHCP (or the static address) must have given us somewhere to go
+	if result.Ip == "" && len(result.Ipv6) == 0 {
+		result.Message = "No IP address"
+		return result
+	}
+	if result.Gateway == "" && result.Gateway6 == "" {
+		result.Message = "No default gateway"
+		return result
+	}
+
+	probe, err := url.Parse(cfg.ProbeUrl)
+	if err != nil || probe.Hostname() == "" {
+		result.Message = fmt.Sprintf("Invalid probe_url %q", cfg.ProbeUrl)
+		return result
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.timeout(),
+		Control: netif.BindToDevice(iface),
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial:     dialer.DialContext,
+	}
+
+	// behind a proxy only the proxy needs to resolve, it resolves the probe
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	host := probe.Hostname()
+	if proxy := wpa.activeProxy(ctx); proxy.Enabled() {
+		transport.Proxy = proxy.proxyFunc()
+		if u, err := transport.Proxy(&http.Request{URL: probe}); err == nil && u != nil {
+			host = u.Hostname()
+		}
+	}
+
+	dnsCtx, cancel := context.WithTimeout(ctx, cfg.timeout())
+	_, err = resolver.LookupHost(dnsCtx, host)
+	cancel()
+	if err != nil {
+		result.State = ConnectivityNoDns
+		result.Message = "Could not resolve " + host
+		return result
+	}
+	result.Dns = true
+
+	client := &http.Client{
+		Timeout:   cfg.timeout(),
+		Transport: transport,
+		// a captive portal answers with a redirect to itself
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, cfg.ProbeUrl, nil)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+		result.HttpStatus = resp.StatusCode
+
+		if resp.StatusCode == cfg.ProbeStatus {
+			result.State = ConnectivityOnline
+			result.Message = "Online"
+		} else {
+			result.State = ConnectivityCaptive
+			result.Message = "Probe answered by a captive portal"
+			result.PortalUrl = portalUrl(probe, resp)
+		}
+		return result
+	}
+
+	// the probe may only be firewalled, try plain reachability
+	pingHost := cfg.PingHost
+	if result.Ip == "" || result.Gateway == "" {
+		pingHost = cfg.PingHost6
+	}
+	if err := ping(ctx, iface, pingHost, cfg.timeout()); err == nil {
+		result.Ping = true
+		result.State = ConnectivityOnline
+		result.Message = "Online, probe unreachable"
+		return result
+	}
+
+	result.Message = "Nothing reachable through " + iface
+	return result
+}
+
+// portalUrl returns where a captive portal redirected the probe, or the
+// probe URL itself when the portal answered it in place.
+func portalUrl(probe *url.URL, resp *http.Response) string {
+	location, err := resp.Location()
+	if err != nil {
+		return probe.String()
+	}
+
+	return probe.ResolveReference(location).String()
+}
+
+// connectivityState returns the last connectivity result, checking again
+// if it is older than connectivityMaxAge. It is empty when the check is
+// disabled.
+func (wpa *WpaCfg) connectivityState(ctx context.Context) Connectivity {
+	if wpa.Cfg().Connectivity.Disabled {
+		return Connectivity{}
+	}
+
+	wpa.connMu.Lock()
+	last := wpa.connectivity
+	wpa.connMu.Unlock()
+
+	if time.Since(last.Checked) < connectivityMaxAge {
+		return last
+	}
+
+	return wpa.CheckConnectivity(ctx)
+}
+
+// ping sends one ICMP echo request to host through iface and waits for
+// the reply, over ICMPv6 when host is an IPv6 address.
+func ping(ctx context.Context, iface string, host string, timeout time.Duration) error {
+	_, err := pingRTT(ctx, iface, host, timeout)
+	return err
+}
+
+// pingRTT pings host like ping and returns the round trip time, from
+// sending the request to the reply.
+func pingRTT(ctx context.Context, iface string, host string, timeout time.Duration) (time.Duration, error) {
+	network, listen, echo, reply := "ip4:icmp", "0.0.0.0", byte(8), byte(0)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network, listen, echo, reply = "ip6:ipv6-icmp", "::", 128, 129
+	}
+
+	lc := net.ListenConfig{Control: netif.BindToDevice(iface)}
+	conn, err := lc.ListenPacket(ctx, network, listen)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveIPAddr(network[:3], host)
+	if err != nil {
+		return 0, err
+	}
+
+	id := uint16(os.Getpid())
+	msg := []byte{echo, 0, 0, 0, 0, 0, 0, 1, 't', 'x', 'w', 'i', 'f', 'i'}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	// the kernel checksums ICMPv6, which covers the IPv6 header
+	if echo == 8 {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	sent := time.Now()
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		// an echo reply to our id from dst
+		if n >= 8 && buf[0] == reply && binary.BigEndian.Uint16(buf[4:]) == id && from.String() == dst.String() {
+			return time.Since(sent), nil
+		}
+	}
+}
+
+// icmpChecksum is the internet checksum of msg.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -0,0 +1,133 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// CountryWorld is the world regulatory domain, the most restrictive.
+const CountryWorld = "00"
+
+// iso3166 holds the ISO 3166-1 alpha-2 country codes.
+var iso3166 = countrySet(`
+AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI
+BJ BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN
+CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK
+FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM
+HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN
+KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK
+ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP
+NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF
+TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI
+VN VU WF WS YE YT ZA ZM ZW
+`)
+
+// countrySet turns a space separated list of codes into a set.
+func countrySet(codes string) map[string]bool {
+	set := make(map[string]bool)
+	for _, code := range strings.Fields(codes) {
+		set[code] = true
+	}
+
+	return set
+}
+
+// ValidCountry reports whether cc is an ISO 3166-1 alpha-2 code or the
+// world domain "00".
+func ValidCountry(cc string) bool {
+	return cc == CountryWorld || iso3166[cc]
+}
+
+// CountryStatus is the configured country and the kernel regulatory domain.
+type CountryStatus struct {
+	Country   string `json:"country"`    // configured, e.g. DE
+	RegDomain string `json:"reg_domain"` // reported by iw reg get, e.g. DE
+	DfsRegion string `json:"dfs_region"` // reported by iw reg get, e.g. DFS-ETSI
+}
+
+// setRegDomain sets the kernel regulatory domain with iw.
+func setRegDomain(ctx context.Context, runner Runner, cc string) error {
+	if _, err := runner.Output(ctx, "iw", "reg", "set", cc); err != nil {
+		return fmt.Errorf("iw reg set %s: %s", cc, err)
+	}
+
+	return nil
+}
+
+// parseRegDomain finds the first "country DE: DFS-ETSI" line of iw reg get.
+func parseRegDomain(out []byte) (string, string) {
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "country" {
+			continue
+		}
+
+		cc := strings.TrimSuffix(fields[1], ":")
+		dfs := ""
+		if len(fields) > 2 {
+			dfs = fields[2]
+		}
+
+		return cc, dfs
+	}
+
+	return "", ""
+}
+
+// Country returns the configured country and the current regulatory domain.
+func (wpa *WpaCfg) Country(ctx context.Context) (CountryStatus, error) {
+	status := CountryStatus{Country: wpa.Cfg().Country}
+
+	out, err := wpa.Runner.Output(ctx, "iw", "reg", "get")
+	if err != nil {
+		return status, fmt.Errorf("%w: iw reg get: %s", ErrCommandFailed, err)
+	}
+	status.RegDomain, status.DfsRegion = parseRegDomain(out)
+
+	return status, nil
+}
+
+// SetCountry changes the country everywhere it matters: the kernel
+// regulatory domain, wpa_supplicant (saved to its config) and hostapd,
+// which is reloaded with the new country_code.
+func (wpa *WpaCfg) SetCountry(ctx context.Context, cc string) (CountryStatus, error) {
+	cc = strings.ToUpper(strings.TrimSpace(cc))
+	if !ValidCountry(cc) {
+		return CountryStatus{}, fmt.Errorf("%w: invalid country %q", ErrInvalid, cc)
+	}
+
+	if err := setRegDomain(ctx, wpa.Runner, cc); err != nil {
+		return CountryStatus{}, fmt.Errorf("%w: %s", ErrCommandFailed, err)
+	}
+
+	if err := wpa.stationCmd(ctx, "SET", "country", cc); err != nil {
+		return CountryStatus{}, err
+	}
+	if err := wpa.SaveConfig(ctx); err != nil {
+		return CountryStatus{}, err
+	}
+
+	// hostapd has no world domain, leave its country_code out instead
+	hostApdCfg := wpa.Cfg().HostApdCfg
+	hostApdCfg.CountryCode = cc
+	if cc == CountryWorld {
+		hostApdCfg.CountryCode = ""
+	}
+
+	if _, err := WriteHostapdConf(wpa.Cfg().APInterface, hostApdCfg, wpa.Cfg().MacACL()); err != nil {
+		return CountryStatus{}, err
+	}
+	if err := reloadHostapd(hostApdCfg.pidFile()); err != nil {
+		return CountryStatus{}, fmt.Errorf("reloading hostapd: %w", err)
+	}
+
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		cfg.HostApdCfg = hostApdCfg
+		cfg.Country = cc
+	})
+	wpa.Log.Info("country set", "iface", wpa.Cfg().StationInterface, "country", cc)
+
+	return wpa.Country(ctx)
+}
@@ -0,0 +1,95 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hupSelf points the hostapd pid file of wpa at the test, which catches
+// the SIGHUP of a hostapd reload instead of dying of it.
+func hupSelf(t *testing.T, wpa *WpaCfg) (<-chan os.Signal, func()) {
+	t.Helper()
+
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := ioutil.WriteFile(wpa.Cfg().HostApdCfg.PidFile, pid, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	return hup, func() { signal.Stop(hup) }
+}
+
+func TestSetCountry(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+	hup, stop := hupSelf(t, wpa)
+	defer stop()
+
+	if _, err := wpa.SetCountry(context.Background(), "de"); err != nil {
+		t.Fatalf("SetCountry: %s", err)
+	}
+
+	for _, call := range []string{"iw reg set DE", "SET country DE", "SAVE_CONFIG"} {
+		if !hasCall(runner, call) {
+			t.Errorf("%q not sent, calls: %q", call, runner.Calls())
+		}
+	}
+	if wpa.Cfg().Country != "DE" || wpa.Cfg().HostApdCfg.CountryCode != "DE" {
+		t.Errorf("country %q, hostapd country_code %q, want DE", wpa.Cfg().Country, wpa.Cfg().HostApdCfg.CountryCode)
+	}
+
+	select {
+	case <-hup:
+	case <-time.After(5 * time.Second):
+		t.Error("hostapd not reloaded")
+	}
+}
+
+func TestSetCountryInvalid(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	for _, cc := range []string{"", "D", "DEU", "1A", "DE\nSET"} {
+		if _, err := wpa.SetCountry(context.Background(), cc); !errors.Is(err, ErrInvalid) {
+			t.Errorf("SetCountry(%q) = %v, want ErrInvalid", cc, err)
+		}
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("invalid countries sent %q", calls)
+	}
+}
+
+func TestReloadCountry(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	location, writeCfg := testCfgFile(t, wpa)
+	changed := *wpa.Cfg()
+	changed.Country = "FR"
+	writeCfg(&changed)
+
+	// the country is also hostapd's country_code
+	_, stop := hupSelf(t, wpa)
+	defer stop()
+
+	reload, err := NewCfgWatcher(wpa, location).Reload(context.Background())
+	if err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+
+	if !hasCall(runner, "SET country FR") {
+		t.Errorf("SET country FR not sent, calls: %q, changed: %q", runner.Calls(), reload.Changed)
+	}
+	if wpa.Cfg().Country != "FR" {
+		t.Errorf("country %q, want FR", wpa.Cfg().Country)
+	}
+}
@@ -0,0 +1,303 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Key sources, for CredentialsCfg.KeySource.
+const (
+	KeySourceAuto      = "auto"       // the first available of cpu-serial, product-uuid and machine-id
+	KeySourceCpuSerial = "cpu-serial" // the SoC serial number, burnt into the chip of a Raspberry Pi
+	KeySourceProduct   = "product-uuid"
+	KeySourceMachineId = "machine-id" // /etc/machine-id, on the same card as the credentials
+	KeySourceFile      = "file"       // key_file, generated if missing
+	KeySourceCommand   = "command"    // the output of key_command, such as tpm2_unseal
+)
+
+// DefaultCredentialsKeyFile is the key file of the file key source.
+const DefaultCredentialsKeyFile = "/etc/txwifi/credentials.key"
+
+// credentialsCipher names the encryption in sealed files.
+const credentialsCipher = "aes-256-gcm"
+
+// Files the device secret is read from.
+var (
+	cpuInfoFile     = "/proc/cpuinfo"
+	productUuidFile = "/sys/class/dmi/id/product_uuid"
+	machineIdFile   = "/etc/machine-id"
+)
+
+// CredentialsCfg encrypts stored credentials and is used by SetupCfg.
+type CredentialsCfg struct {
+	Encrypt    bool     `json:"encrypt"`
+	KeySource  string   `json:"key_source"`  // auto (default), cpu-serial, product-uuid, machine-id, file or command
+	KeyFile    string   `json:"key_file"`    // for the file source, /etc/txwifi/credentials.key
+	KeyCommand []string `json:"key_command"` // for the command source, prints the secret, e.g. ["tpm2_unseal", "-c", "0x81010001"]
+}
+
+// Validate checks the key source has what it needs.
+func (c CredentialsCfg) Validate() error {
+	switch c.KeySource {
+	case "", KeySourceAuto, KeySourceCpuSerial, KeySourceProduct, KeySourceMachineId, KeySourceFile:
+	case KeySourceCommand:
+		if len(c.KeyCommand) == 0 {
+			return fmt.Errorf("key_source command needs a key_command")
+		}
+	default:
+		return fmt.Errorf("unknown key_source %q", c.KeySource)
+	}
+
+	return nil
+}
+
+// sealedFile is the on-disk form of an encrypted file.
+type sealedFile struct {
+	Encrypted string `json:"encrypted"`  // aes-256-gcm
+	KeySource string `json:"key_source"` // the source of the key, for troubleshooting
+	Nonce     []byte `json:"nonce"`
+	Data      []byte `json:"data"`
+}
+
+// CredentialCipher encrypts files of credentials with a key derived from
+// a device secret, so the files are of no use off the device, such as on
+// an SD card pulled from it.
+type CredentialCipher struct {
+	Source string // the key source used, auto resolved
+	aead   cipher.AEAD
+}
+
+// NewCredentialCipher derives the key from the device secret cfg names.
+func NewCredentialCipher(ctx context.Context, runner Runner, cfg CredentialsCfg) (*CredentialCipher, error) {
+	source, secret, err := deviceSecret(ctx, runner, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: credentials key: %s", ErrConfig, err)
+	}
+
+	// the secret may be a serial number, the key is only ever its MAC
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("txwifi credentials v1"))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CredentialCipher{Source: source, aead: aead}, nil
+}
+
+// Seal encrypts data into a sealed file.
+func (c *CredentialCipher) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(sealedFile{
+		Encrypted: credentialsCipher,
+		KeySource: c.Source,
+		Nonce:     nonce,
+		Data:      c.aead.Seal(nil, nonce, data, nil),
+	}, "", "  ")
+}
+
+// Open decrypts a sealed file.
+func (c *CredentialCipher) Open(data []byte) ([]byte, error) {
+	var sealed sealedFile
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, err
+	}
+	if sealed.Encrypted != credentialsCipher {
+		return nil, fmt.Errorf("unknown encryption %q", sealed.Encrypted)
+	}
+
+	plain, err := c.aead.Open(nil, sealed.Nonce, sealed.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt, it was encrypted with the %s key of another device or source", sealed.KeySource)
+	}
+
+	return plain, nil
+}
+
+// isSealed reports whether data is a sealed file rather than plain JSON.
+func isSealed(data []byte) bool {
+	var sealed struct {
+		Encrypted string `json:"encrypted"`
+	}
+
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) && json.Unmarshal(data, &sealed) == nil && sealed.Encrypted != ""
+}
+
+// deviceSecret reads the secret of cfg's key source and returns the
+// source it came from.
+func deviceSecret(ctx context.Context, runner Runner, cfg CredentialsCfg) (string, []byte, error) {
+	switch cfg.KeySource {
+	case "", KeySourceAuto:
+		for _, source := range []string{KeySourceCpuSerial, KeySourceProduct, KeySourceMachineId} {
+			if _, secret, err := deviceSecret(ctx, runner, CredentialsCfg{KeySource: source}); err == nil {
+				return source, secret, nil
+			}
+		}
+		return "", nil, errors.New("no cpu serial, product uuid or machine id, set key_source")
+
+	case KeySourceCpuSerial:
+		serial, err := cpuSerial()
+		return cfg.KeySource, []byte(serial), err
+
+	case KeySourceProduct, KeySourceMachineId:
+		file := productUuidFile
+		if cfg.KeySource == KeySourceMachineId {
+			file = machineIdFile
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return cfg.KeySource, nil, err
+		}
+		if id := bytes.TrimSpace(data); len(id) > 0 {
+			return cfg.KeySource, id, nil
+		}
+		return cfg.KeySource, nil, fmt.Errorf("%s is empty", file)
+
+	case KeySourceFile:
+		secret, err := keyFile(cfg.KeyFile)
+		return cfg.KeySource, secret, err
+
+	case KeySourceCommand:
+		out, err := runner.Output(ctx, cfg.KeyCommand[0], cfg.KeyCommand[1:]...)
+		if err != nil {
+			return cfg.KeySource, nil, fmt.Errorf("%s: %s", cfg.KeyCommand[0], err)
+		}
+		if len(bytes.TrimSpace(out)) == 0 {
+			return cfg.KeySource, nil, fmt.Errorf("%s printed no secret", cfg.KeyCommand[0])
+		}
+		return cfg.KeySource, bytes.TrimSpace(out), nil
+	}
+
+	return cfg.KeySource, nil, fmt.Errorf("unknown key_source %q", cfg.KeySource)
+}
+
+// cpuSerial returns the Serial line of /proc/cpuinfo, which Raspberry Pis
+// fill in from the SoC.
+func cpuSerial() (string, error) {
+	data, err := ioutil.ReadFile(cpuInfoFile)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != "Serial" {
+			continue
+		}
+
+		serial := strings.TrimSpace(fields[1])
+		if strings.Trim(serial, "0") != "" {
+			return serial, nil
+		}
+	}
+
+	return "", errors.New("no cpu serial")
+}
+
+// keyFile reads the key in path, generating a random one if there is
+// none yet.
+func keyFile(path string) ([]byte, error) {
+	if path == "" {
+		path = DefaultCredentialsKeyFile
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return key, ioutil.WriteFile(path, key, 0400)
+}
+
+// hashPsk derives the PSK wpa_supplicant uses from passphrase and ssid,
+// PBKDF2-HMAC-SHA1 with 4096 rounds as IEEE 802.11i specifies, as 64 hex
+// digits.
+func hashPsk(passphrase string, ssid string) string {
+	return hex.EncodeToString(pbkdf2(sha1.New, []byte(passphrase), []byte(ssid), 4096, 32))
+}
+
+// pbkdf2 derives a key of keyLen bytes from password and salt, as RFC
+// 8018 specifies with HMAC and h.
+func pbkdf2(h func() hash.Hash, password []byte, salt []byte, rounds int, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	key := []byte{}
+	for block := uint32(1); len(key) < keyLen; block++ {
+		index := make([]byte, 4)
+		binary.BigEndian.PutUint32(index, block)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index)
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < rounds; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// storedPsk returns the psk of creds for wpa_supplicant, which saves it in
+// its config. With encryption on a passphrase is replaced by the PSK it
+// derives, which joins that network but does not reveal the passphrase.
+// SAE needs the passphrase itself.
+func (wpa *WpaCfg) storedPsk(creds WpaCredentials) (string, error) {
+	psk, err := pskValue(creds)
+	if err != nil {
+		return "", err
+	}
+
+	if !wpa.Cfg().Credentials.Encrypt || hexPskR.MatchString(psk) || strings.Contains(creds.KeyMgmt, KeyMgmtSae) {
+		return psk, nil
+	}
+
+	return hashPsk(creds.Psk, creds.Ssid), nil
+}
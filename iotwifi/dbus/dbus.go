@@ -0,0 +1,385 @@
+// Package dbus is a minimal client of the D-Bus system bus: method calls
+// and properties, with the marshalling they need, enough to drive
+// NetworkManager without libdbus.
+package dbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SystemBus is the socket of the system bus when DBUS_SYSTEM_BUS_ADDRESS
+// is not set.
+const SystemBus = "/var/run/dbus/system_bus_socket"
+
+// ErrClosed is returned by calls on a closed connection.
+var ErrClosed = errors.New("dbus connection closed")
+
+// Error is an error reply.
+type Error struct {
+	Name    string // org.freedesktop.NetworkManager.Device.NotAllowed
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+
+	return e.Name + ": " + e.Message
+}
+
+// message types
+const (
+	typeMethodCall   = 1
+	typeMethodReturn = 2
+	typeError        = 3
+	typeSignal       = 4
+)
+
+// header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+)
+
+// message is a decoded D-Bus message.
+type message struct {
+	typ         byte
+	serial      uint32
+	replySerial uint32
+	errorName   string
+	body        []interface{}
+}
+
+// Conn is a connection to a message bus. Calls may be made concurrently.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	wmu sync.Mutex // writes
+
+	mu      sync.Mutex
+	serial  uint32
+	pending map[uint32]chan *message
+	err     error // set once the connection is lost
+}
+
+// DialSystem connects to the system bus.
+func DialSystem() (*Conn, error) {
+	return Dial(SystemBusPath())
+}
+
+// SystemBusPath returns the socket of the system bus.
+func SystemBusPath() string {
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); strings.HasPrefix(addr, "unix:path=") {
+		return strings.SplitN(strings.TrimPrefix(addr, "unix:path="), ",", 2)[0]
+	}
+
+	return SystemBus
+}
+
+// Dial connects to the bus listening on the unix socket at path,
+// authenticates as the current user and registers with Hello.
+func Dial(path string) (*Conn, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		pending: make(map[uint32]chan *message),
+	}
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus auth: %s", err)
+	}
+	go c.read()
+
+	if _, err := c.Call(context.Background(), "org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// auth authenticates with the EXTERNAL mechanism, the uid the bus sees on
+// the socket.
+func (c *Conn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("rejected: %s", strings.TrimSpace(line))
+	}
+
+	_, err = c.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// Close closes the connection, failing the calls waiting for replies.
+// They fail first, so they see ErrClosed rather than the read error.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+
+	return c.conn.Close()
+}
+
+// Err returns why the connection was lost, nil while it is up.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// fail records err and fails the pending calls.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for serial, reply := range c.pending {
+		close(reply)
+		delete(c.pending, serial)
+	}
+}
+
+// read delivers replies to their calls until the connection is lost.
+// Signals and calls to us are dropped, nothing subscribes to them.
+func (c *Conn) read() {
+	for {
+		msg, err := readMessage(c.reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if msg.typ != typeMethodReturn && msg.typ != typeError {
+			continue
+		}
+
+		c.mu.Lock()
+		reply, ok := c.pending[msg.replySerial]
+		delete(c.pending, msg.replySerial)
+		c.mu.Unlock()
+
+		if ok {
+			reply <- msg
+		}
+	}
+}
+
+// Call calls method of iface on the object at path of dest with args
+// marshalled by signature, and returns the values of the reply. Variants
+// in the reply are returned as their values, see Decode.
+func (c *Conn) Call(ctx context.Context, dest string, path ObjectPath, iface string, method string, signature Signature, args ...interface{}) ([]interface{}, error) {
+	body, err := Encode(signature, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %s", iface, method, err)
+	}
+
+	fields := []interface{}{
+		[]interface{}{byte(fieldPath), MakeVariant("o", path)},
+		[]interface{}{byte(fieldInterface), MakeVariant("s", iface)},
+		[]interface{}{byte(fieldMember), MakeVariant("s", method)},
+		[]interface{}{byte(fieldDestination), MakeVariant("s", dest)},
+	}
+	if signature != "" {
+		fields = append(fields, []interface{}{byte(fieldSignature), MakeVariant("g", signature)})
+	}
+
+	reply := make(chan *message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.serial++
+	serial := c.serial
+	c.pending[serial] = reply
+	c.mu.Unlock()
+
+	msg, err := encodeMessage(typeMethodCall, serial, fields, body)
+	if err == nil {
+		c.wmu.Lock()
+		_, err = c.conn.Write(msg)
+		c.wmu.Unlock()
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, serial)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case m, ok := <-reply:
+		if !ok {
+			return nil, c.Err()
+		}
+		if m.typ == typeError {
+			e := &Error{Name: m.errorName}
+			if len(m.body) > 0 {
+				e.Message, _ = m.body[0].(string)
+			}
+			return nil, e
+		}
+		return m.body, nil
+
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, serial)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Get returns the value of property name of iface.
+func (c *Conn) Get(ctx context.Context, dest string, path ObjectPath, iface string, name string) (interface{}, error) {
+	body, err := c.Call(ctx, dest, path, "org.freedesktop.DBus.Properties", "Get", "ss", iface, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 1 {
+		return nil, fmt.Errorf("property %s.%s: unexpected reply", iface, name)
+	}
+
+	return body[0], nil
+}
+
+// GetAll returns the properties of iface by name.
+func (c *Conn) GetAll(ctx context.Context, dest string, path ObjectPath, iface string) (map[string]interface{}, error) {
+	body, err := c.Call(ctx, dest, path, "org.freedesktop.DBus.Properties", "GetAll", "s", iface)
+	if err != nil {
+		return nil, err
+	}
+
+	props, ok := firstValue(body).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("properties of %s: unexpected reply", iface)
+	}
+
+	return props, nil
+}
+
+// Set sets property name of iface.
+func (c *Conn) Set(ctx context.Context, dest string, path ObjectPath, iface string, name string, value Variant) error {
+	_, err := c.Call(ctx, dest, path, "org.freedesktop.DBus.Properties", "Set", "ssv", iface, name, value)
+	return err
+}
+
+// firstValue returns the first value of a reply body, nil if it is empty.
+func firstValue(body []interface{}) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+
+	return body[0]
+}
+
+// encodeMessage marshals a message, little endian.
+func encodeMessage(typ byte, serial uint32, fields []interface{}, body []byte) ([]byte, error) {
+	e := &encoder{order: binary.LittleEndian}
+	e.buf = append(e.buf, 'l', typ, 0, 1)
+	e.uint32(uint32(len(body)))
+	e.uint32(serial)
+	if err := e.encode("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	e.align(8)
+
+	return append(e.buf, body...), nil
+}
+
+// maxMessage bounds the messages read, as the specification does.
+const maxMessage = 128 << 20
+
+// readMessage reads and decodes one message.
+func readMessage(r io.Reader) (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid byte order %q", fixed[0])
+	}
+
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	headerLen := (16 + int(fieldsLen) + 7) &^ 7
+	if int64(headerLen)+int64(bodyLen) > maxMessage {
+		return nil, fmt.Errorf("message of %d bytes is too large", int64(headerLen)+int64(bodyLen))
+	}
+
+	// read as it arrives, a header alone does not allocate the size it
+	// claims
+	rest, err := ioutil.ReadAll(io.LimitReader(r, int64(headerLen)+int64(bodyLen)-16))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(rest)) < int64(headerLen)+int64(bodyLen)-16 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := append(fixed, rest...)
+
+	msg := &message{typ: fixed[1], serial: order.Uint32(fixed[8:])}
+
+	d := &decoder{buf: buf[:16+fieldsLen], pos: 12, order: order}
+	value, err := d.decode("a(yv)")
+	if err != nil {
+		return nil, fmt.Errorf("message header: %s", err)
+	}
+
+	var signature Signature
+	for _, f := range value.([]interface{}) {
+		field := f.([]interface{})
+		switch field[0].(byte) {
+		case fieldReplySerial:
+			msg.replySerial, _ = field[1].(uint32)
+		case fieldErrorName:
+			msg.errorName, _ = field[1].(string)
+		case fieldSignature:
+			signature, _ = field[1].(Signature)
+		}
+	}
+
+	if msg.body, err = Decode(signature, buf[headerLen:], order); err != nil {
+		return nil, fmt.Errorf("message body: %s", err)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,414 @@
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// call is a method call the fake bus received.
+type call struct {
+	path   ObjectPath
+	iface  string
+	member string
+	dest   string
+	body   []interface{}
+}
+
+// reply is what the fake bus answers a call with: a body, an error or
+// nothing.
+type reply struct {
+	signature Signature
+	body      []interface{}
+	errorName string
+	none      bool
+}
+
+// fakeBus accepts one connection on a unix socket, authenticates it and
+// answers its calls by member.
+type fakeBus struct {
+	path    string
+	replies map[string]reply
+	calls   chan call
+}
+
+func newFakeBus(t *testing.T, replies map[string]reply) *fakeBus {
+	t.Helper()
+	bus := &fakeBus{
+		path:    filepath.Join(t.TempDir(), "bus"),
+		replies: replies,
+		calls:   make(chan call, 16),
+	}
+
+	l, err := net.Listen("unix", bus.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the client hanging up is no failure
+		var opErr *net.OpError
+		if err := bus.serve(conn); err != nil && err != io.EOF && !errors.As(err, &opErr) {
+			t.Errorf("fake bus: %s", err)
+		}
+	}()
+
+	return bus
+}
+
+func (bus *fakeBus) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if line != "\x00AUTH EXTERNAL "+uid+"\r\n" {
+		return errors.New("auth " + strconv.Quote(line))
+	}
+	if _, err := conn.Write([]byte("OK 0123456789abcdef\r\n")); err != nil {
+		return err
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "BEGIN\r\n" {
+		return errors.New("begin " + strconv.Quote(line))
+	}
+
+	for serial := uint32(1); ; serial++ {
+		callSerial, c, err := readCall(r)
+		if err != nil {
+			return err
+		}
+		bus.calls <- c
+
+		// a signal and a reply to no call, both dropped
+		signal, _ := encodeMessage(typeSignal, 0, nil, nil)
+		stray, _ := encodeMessage(typeMethodReturn, 0, []interface{}{
+			[]interface{}{byte(fieldReplySerial), MakeVariant("u", callSerial+100)},
+		}, nil)
+		if _, err := conn.Write(append(signal, stray...)); err != nil {
+			return err
+		}
+
+		rep, ok := bus.replies[c.member]
+		if !ok {
+			return nil // hangs up
+		}
+		if rep.none {
+			continue
+		}
+
+		fields := []interface{}{
+			[]interface{}{byte(fieldReplySerial), MakeVariant("u", callSerial)},
+		}
+		typ := byte(typeMethodReturn)
+		if rep.errorName != "" {
+			typ = typeError
+			fields = append(fields, []interface{}{byte(fieldErrorName), MakeVariant("s", rep.errorName)})
+		}
+		if rep.signature != "" {
+			fields = append(fields, []interface{}{byte(fieldSignature), MakeVariant("g", rep.signature)})
+		}
+		body, err := Encode(rep.signature, rep.body...)
+		if err != nil {
+			return err
+		}
+		msg, err := encodeMessage(typ, serial, fields, body)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// readCall reads a method call with its header fields.
+func readCall(r io.Reader) (uint32, call, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return 0, call{}, err
+	}
+	if fixed[0] != 'l' || fixed[1] != typeMethodCall || fixed[3] != 1 {
+		return 0, call{}, errors.New("not a method call")
+	}
+	bodyLen := binary.LittleEndian.Uint32(fixed[4:])
+	fieldsLen := binary.LittleEndian.Uint32(fixed[12:])
+	headerLen := (16 + int(fieldsLen) + 7) &^ 7
+	buf := make([]byte, headerLen+int(bodyLen))
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return 0, call{}, err
+	}
+
+	d := &decoder{buf: buf[:16+fieldsLen], pos: 12, order: binary.LittleEndian}
+	value, err := d.decode("a(yv)")
+	if err != nil {
+		return 0, call{}, err
+	}
+	c := call{}
+	var signature Signature
+	for _, f := range value.([]interface{}) {
+		field := f.([]interface{})
+		switch field[0].(byte) {
+		case fieldPath:
+			c.path, _ = field[1].(ObjectPath)
+		case fieldInterface:
+			c.iface, _ = field[1].(string)
+		case fieldMember:
+			c.member, _ = field[1].(string)
+		case fieldDestination:
+			c.dest, _ = field[1].(string)
+		case fieldSignature:
+			signature, _ = field[1].(Signature)
+		}
+	}
+	if c.body, err = Decode(signature, buf[headerLen:], binary.LittleEndian); err != nil {
+		return 0, call{}, err
+	}
+
+	return binary.LittleEndian.Uint32(fixed[8:]), c, nil
+}
+
+// expectCall checks the next call the bus received.
+func (bus *fakeBus) expectCall(t *testing.T, want call) {
+	t.Helper()
+	select {
+	case c := <-bus.calls:
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("call %+v, want %+v", c, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no call of %s", want.member)
+	}
+}
+
+const (
+	nm      = "org.freedesktop.NetworkManager"
+	nmPath  = ObjectPath("/org/freedesktop/NetworkManager")
+	props   = "org.freedesktop.DBus.Properties"
+	timeout = 5 * time.Second
+)
+
+func TestConn(t *testing.T) {
+	bus := newFakeBus(t, map[string]reply{
+		"Hello":  {signature: "s", body: []interface{}{":1.7"}},
+		"Get":    {signature: "v", body: []interface{}{MakeVariant("u", uint32(70))}},
+		"GetAll": {signature: "a{sv}", body: []interface{}{map[string]Variant{"State": MakeVariant("u", uint32(70)), "Version": MakeVariant("s", "1.42")}}},
+		"Set":    {},
+		"Enable": {errorName: nm + ".NotAllowed", signature: "s", body: []interface{}{"not allowed"}},
+		"Sleep":  {errorName: nm + ".Failed"},
+		"Wait":   {none: true},
+	})
+
+	c, err := Dial(bus.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	bus.expectCall(t, call{path: "/org/freedesktop/DBus", iface: "org.freedesktop.DBus", member: "Hello", dest: "org.freedesktop.DBus", body: []interface{}{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	value, err := c.Get(ctx, nm, nmPath, nm, "State")
+	if err != nil || value != uint32(70) {
+		t.Errorf("got %#v, %v", value, err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: props, member: "Get", dest: nm, body: []interface{}{nm, "State"}})
+
+	all, err := c.GetAll(ctx, nm, nmPath, nm)
+	if want := map[string]interface{}{"State": uint32(70), "Version": "1.42"}; err != nil || !reflect.DeepEqual(all, want) {
+		t.Errorf("got all %#v, %v", all, err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: props, member: "GetAll", dest: nm, body: []interface{}{nm}})
+
+	if err := c.Set(ctx, nm, nmPath, nm, "WirelessEnabled", MakeVariant("b", true)); err != nil {
+		t.Error(err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: props, member: "Set", dest: nm, body: []interface{}{nm, "WirelessEnabled", true}})
+
+	_, err = c.Call(ctx, nm, nmPath, nm, "Enable", "b", true)
+	var dbusErr *Error
+	if !errors.As(err, &dbusErr) || dbusErr.Name != nm+".NotAllowed" || dbusErr.Message != "not allowed" {
+		t.Errorf("error %v", err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: nm, member: "Enable", dest: nm, body: []interface{}{true}})
+
+	if _, err = c.Call(ctx, nm, nmPath, nm, "Sleep", ""); err == nil || err.Error() != nm+".Failed" {
+		t.Errorf("error %v", err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: nm, member: "Sleep", dest: nm, body: []interface{}{}})
+
+	if _, err := c.Call(ctx, nm, nmPath, nm, "Enable", "b", "yes"); err == nil {
+		t.Error("called with a string as a bool")
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	if _, err := c.Call(waitCtx, nm, nmPath, nm, "Wait", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waited: %v", err)
+	}
+	bus.expectCall(t, call{path: nmPath, iface: nm, member: "Wait", dest: nm, body: []interface{}{}})
+
+	// the bus hangs up on calls it does not know
+	if _, err := c.Call(ctx, nm, nmPath, nm, "Reload", "u", uint32(0)); err == nil {
+		t.Error("called through a closed connection")
+	}
+	if c.Err() == nil {
+		t.Error("connection not failed")
+	}
+	if _, err := c.Call(ctx, nm, nmPath, nm, "Hello", ""); err == nil {
+		t.Error("called on a failed connection")
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	bus := newFakeBus(t, map[string]reply{
+		"Hello": {signature: "s", body: []interface{}{":1.7"}},
+		"Wait":  {none: true},
+	})
+
+	c, err := Dial(bus.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Call(context.Background(), nm, nmPath, nm, "Wait", "")
+		done <- err
+	}()
+	bus.expectCall(t, call{path: "/org/freedesktop/DBus", iface: "org.freedesktop.DBus", member: "Hello", dest: "org.freedesktop.DBus", body: []interface{}{}})
+	bus.expectCall(t, call{path: nmPath, iface: nm, member: "Wait", dest: nm, body: []interface{}{}})
+
+	c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("error %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(timeout):
+		t.Fatal("call not failed by close")
+	}
+}
+
+func TestDialRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("REJECTED EXTERNAL\r\n"))
+	}()
+
+	if _, err := Dial(path); err == nil || !strings.Contains(err.Error(), "REJECTED") {
+		t.Errorf("error %v", err)
+	}
+	if _, err := Dial(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("dialed no socket")
+	}
+}
+
+func TestSystemBusPath(t *testing.T) {
+	tests := []struct {
+		addr string
+		path string
+	}{
+		{"", SystemBus},
+		{"unix:path=/run/dbus/bus", "/run/dbus/bus"},
+		{"unix:path=/run/dbus/bus,guid=1234", "/run/dbus/bus"},
+		{"tcp:host=localhost,port=1", SystemBus},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", tt.addr)
+		if path := SystemBusPath(); path != tt.path {
+			t.Errorf("%q: path %s, want %s", tt.addr, path, tt.path)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	body, _ := Encode("su", "x", uint32(3))
+	msg, err := encodeMessage(typeError, 9, []interface{}{
+		[]interface{}{byte(fieldReplySerial), MakeVariant("u", uint32(4))},
+		[]interface{}{byte(fieldErrorName), MakeVariant("s", "org.example.Error")},
+		[]interface{}{byte(fieldSignature), MakeVariant("g", Signature("su"))},
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMessage(bytes.NewReader(msg))
+	want := &message{typ: typeError, serial: 9, replySerial: 4, errorName: "org.example.Error", body: []interface{}{"x", uint32(3)}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("read %+v, %v", got, err)
+	}
+
+	// a method return, big endian: reply serial 4, signature u, body 7
+	big := []byte{
+		'B', typeMethodReturn, 0, 1, 0, 0, 0, 4, 0, 0, 0, 9, 0, 0, 0, 15,
+		fieldReplySerial, 1, 'u', 0, 0, 0, 0, 4,
+		fieldSignature, 1, 'g', 0, 1, 'u', 0, 0,
+		0, 0, 0, 7,
+	}
+	got, err = readMessage(bytes.NewReader(big))
+	want = &message{typ: typeMethodReturn, serial: 9, replySerial: 4, body: []interface{}{uint32(7)}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("read %+v, %v", got, err)
+	}
+
+	invalid := map[string][]byte{
+		"byte order": append([]byte{'x'}, msg[1:]...),
+		"truncated":  msg[:len(msg)-1],
+		"short":      msg[:10],
+		"too large":  {'l', typeMethodReturn, 0, 1, 0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 0, 0, 0, 0},
+		"header":     {'l', typeMethodReturn, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0, 5, 1, 'z', 0, 0, 0, 0, 0},
+		"body":       {'l', typeMethodReturn, 0, 1, 2, 0, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0, fieldSignature, 1, 'g', 0, 1, 'u', 0, 0, 0, 0},
+	}
+	for name, wire := range invalid {
+		if got, err := readMessage(bytes.NewReader(wire)); err == nil {
+			t.Errorf("%s: read %+v", name, got)
+		}
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	body, _ := Encode("a{sv}", map[string]Variant{"State": MakeVariant("u", uint32(70))})
+	msg, _ := encodeMessage(typeMethodReturn, 2, []interface{}{
+		[]interface{}{byte(fieldReplySerial), MakeVariant("u", uint32(1))},
+		[]interface{}{byte(fieldSignature), MakeVariant("g", Signature("a{sv}"))},
+	}, body)
+	f.Add(msg)
+	f.Add([]byte{'B', typeMethodReturn, 0, 1, 0, 0, 0, 4, 0, 0, 0, 9, 0, 0, 0, 15, fieldReplySerial, 1, 'u', 0, 0, 0, 0, 4, fieldSignature, 1, 'g', 0, 1, 'u', 0, 0, 0, 0, 0, 7})
+
+	f.Fuzz(func(t *testing.T, wire []byte) {
+		readMessage(bytes.NewReader(wire))
+	})
+}
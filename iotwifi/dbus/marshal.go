@@ -0,0 +1,555 @@
+package dbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// maxDepth bounds the nesting of arrays, structs and variants, as the
+// specification does, so a signature or a variant nested in itself
+// cannot take the stack.
+const maxDepth = 64
+
+// basicTypes are the types a dictionary may have as its key.
+const basicTypes = "ybnqiuxtdsogh"
+
+// ObjectPath is a D-Bus object path, type o.
+type ObjectPath string
+
+// Signature is a D-Bus type signature, type g.
+type Signature string
+
+// Variant is a value with its signature, type v.
+type Variant struct {
+	Signature Signature
+	Value     interface{}
+}
+
+// MakeVariant produces a Variant of value marshalled as signature.
+func MakeVariant(signature Signature, value interface{}) Variant {
+	return Variant{Signature: signature, Value: value}
+}
+
+// Encode marshals args by signature, little endian, as a message body.
+//
+// Basic types take any Go value of a matching kind, arrays slices, and
+// dictionaries maps. Structs are []interface{} and variants Variant.
+func Encode(signature Signature, args ...interface{}) ([]byte, error) {
+	types, err := splitTypes(string(signature))
+	if err != nil {
+		return nil, err
+	}
+	if len(types) != len(args) {
+		return nil, fmt.Errorf("signature %s takes %d values, got %d", signature, len(types), len(args))
+	}
+
+	e := &encoder{order: binary.LittleEndian}
+	for i, t := range types {
+		if err := e.encode(t, args[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.buf, nil
+}
+
+// Decode unmarshals the values of a message body by signature.
+//
+// Basic types decode to the Go types of their size, byte arrays to
+// []byte, other arrays to []interface{}, dictionaries with string keys to
+// map[string]interface{} and other dictionaries to
+// map[interface{}]interface{}. Structs decode to []interface{} and
+// variants to their value.
+func Decode(signature Signature, body []byte, order binary.ByteOrder) ([]interface{}, error) {
+	types, err := splitTypes(string(signature))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: body, order: order}
+	values := []interface{}{}
+	for _, t := range types {
+		value, err := d.decode(t)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// splitTypes splits signature into its single complete types.
+func splitTypes(signature string) ([]string, error) {
+	types := []string{}
+	for signature != "" {
+		n, err := typeLen(signature, 0)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, signature[:n])
+		signature = signature[n:]
+	}
+
+	return types, nil
+}
+
+// typeLen returns the length of the single complete type signature starts
+// with, nested depth deep.
+func typeLen(signature string, depth int) (int, error) {
+	if signature == "" {
+		return 0, fmt.Errorf("incomplete signature")
+	}
+	if depth >= maxDepth {
+		return 0, fmt.Errorf("signature nested over %d deep", maxDepth)
+	}
+
+	switch signature[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 's', 'o', 'g', 'v', 'h':
+		return 1, nil
+
+	case 'a':
+		if strings.HasPrefix(signature[1:], "{") {
+			n, err := dictEntryLen(signature[1:], depth+1)
+			return n + 1, err
+		}
+		n, err := typeLen(signature[1:], depth+1)
+		return n + 1, err
+
+	case '(':
+		i := 1
+		for i < len(signature) && signature[i] != ')' {
+			n, err := typeLen(signature[i:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+		if i >= len(signature) {
+			return 0, fmt.Errorf("unterminated ( in signature")
+		}
+		if i == 1 {
+			return 0, fmt.Errorf("empty struct in signature")
+		}
+		return i + 1, nil
+
+	case '{':
+		return 0, fmt.Errorf("dictionary entry outside an array in signature")
+	}
+
+	return 0, fmt.Errorf("invalid type %q in signature", signature[0])
+}
+
+// dictEntryLen returns the length of the dictionary entry signature starts
+// with: a basic key type and a value type in braces.
+func dictEntryLen(signature string, depth int) (int, error) {
+	if len(signature) < 2 || !strings.ContainsRune(basicTypes, rune(signature[1])) {
+		return 0, fmt.Errorf("invalid dictionary key in signature")
+	}
+	n, err := typeLen(signature[2:], depth+1)
+	if err != nil {
+		return 0, err
+	}
+	if len(signature) <= 2+n || signature[2+n] != '}' {
+		return 0, fmt.Errorf("unterminated { in signature")
+	}
+
+	return n + 3, nil
+}
+
+// alignment returns the alignment of the values of type t.
+func alignment(t byte) int {
+	switch t {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 's', 'o', 'a', 'h':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+
+	return 1
+}
+
+// encoder marshals values.
+type encoder struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// encode marshals v as the single complete type t.
+func (e *encoder) encode(t string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+
+	switch t[0] {
+	case 'y', 'n', 'q', 'i', 'u', 'x', 't', 'h':
+		n, ok := integer(rv)
+		if !ok {
+			return fmt.Errorf("cannot encode %T as %s", v, t)
+		}
+		size := alignment(t[0])
+		e.align(size)
+		var b [8]byte
+		e.order.PutUint64(b[:], n)
+		if e.order == binary.LittleEndian {
+			e.buf = append(e.buf, b[:size]...)
+		} else {
+			e.buf = append(e.buf, b[8-size:]...)
+		}
+
+	case 'b':
+		if rv.Kind() != reflect.Bool {
+			return fmt.Errorf("cannot encode %T as b", v)
+		}
+		b := uint32(0)
+		if rv.Bool() {
+			b = 1
+		}
+		e.uint32(b)
+
+	case 'd':
+		if rv.Kind() != reflect.Float64 && rv.Kind() != reflect.Float32 {
+			return fmt.Errorf("cannot encode %T as d", v)
+		}
+		e.align(8)
+		var b [8]byte
+		e.order.PutUint64(b[:], math.Float64bits(rv.Float()))
+		e.buf = append(e.buf, b[:]...)
+
+	case 's', 'o':
+		if rv.Kind() != reflect.String {
+			return fmt.Errorf("cannot encode %T as %s", v, t)
+		}
+		e.uint32(uint32(rv.Len()))
+		e.buf = append(append(e.buf, rv.String()...), 0)
+
+	case 'g':
+		if rv.Kind() != reflect.String || rv.Len() > 255 {
+			return fmt.Errorf("cannot encode %T as g", v)
+		}
+		e.buf = append(append(append(e.buf, byte(rv.Len())), rv.String()...), 0)
+
+	case 'v':
+		variant, ok := v.(Variant)
+		if !ok {
+			return fmt.Errorf("cannot encode %T as v", v)
+		}
+		if n, err := typeLen(string(variant.Signature), 0); err != nil || n != len(variant.Signature) {
+			return fmt.Errorf("invalid variant signature %q", variant.Signature)
+		}
+		if err := e.encode("g", variant.Signature); err != nil {
+			return err
+		}
+		return e.encode(string(variant.Signature), variant.Value)
+
+	case '(':
+		fields, ok := v.([]interface{})
+		types, err := splitTypes(t[1 : len(t)-1])
+		if err != nil {
+			return err
+		}
+		if !ok || len(fields) != len(types) {
+			return fmt.Errorf("cannot encode %T as %s", v, t)
+		}
+		e.align(8)
+		for i, ft := range types {
+			if err := e.encode(ft, fields[i]); err != nil {
+				return err
+			}
+		}
+
+	case 'a':
+		return e.encodeArray(t[1:], rv)
+
+	default:
+		return fmt.Errorf("cannot encode type %s", t)
+	}
+
+	return nil
+}
+
+// encodeArray marshals the slice or map rv as an array of elem.
+func (e *encoder) encodeArray(elem string, rv reflect.Value) error {
+	e.uint32(0)
+	lenPos := len(e.buf) - 4
+	e.align(alignment(elem[0]))
+	start := len(e.buf)
+
+	switch {
+	case !rv.IsValid():
+		// nil is an empty array
+
+	case elem[0] == '{':
+		if rv.Kind() != reflect.Map {
+			return fmt.Errorf("cannot encode %s as a%s", rv.Type(), elem)
+		}
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil {
+			return err
+		}
+		if len(types) != 2 {
+			return fmt.Errorf("invalid dictionary a%s", elem)
+		}
+		iter := rv.MapRange()
+		for iter.Next() {
+			e.align(8)
+			if err := e.encode(types[0], iter.Key().Interface()); err != nil {
+				return err
+			}
+			if err := e.encode(types[1], iter.Value().Interface()); err != nil {
+				return err
+			}
+		}
+
+	case rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(elem, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("cannot encode %s as a%s", rv.Type(), elem)
+	}
+
+	e.order.PutUint32(e.buf[lenPos:], uint32(len(e.buf)-start))
+
+	return nil
+}
+
+// integer returns the bits of an integer of any kind.
+func integer(rv reflect.Value) (uint64, bool) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	}
+
+	return 0, false
+}
+
+// decoder unmarshals values.
+type decoder struct {
+	buf      []byte
+	pos      int
+	order    binary.ByteOrder
+	variants int // the variants the value decoded is in
+}
+
+// next returns the next n bytes after aligning to align.
+func (d *decoder) next(n int, align int) ([]byte, error) {
+	pos := (d.pos + align - 1) / align * align
+	if pos+n > len(d.buf) || n < 0 {
+		return nil, fmt.Errorf("truncated at %d", d.pos)
+	}
+	d.pos = pos + n
+
+	return d.buf[pos:d.pos], nil
+}
+
+// decode unmarshals a value of the single complete type t.
+func (d *decoder) decode(t string) (interface{}, error) {
+	switch t[0] {
+	case 'y':
+		b, err := d.next(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+
+	case 'n', 'q':
+		b, err := d.next(2, 2)
+		if err != nil {
+			return nil, err
+		}
+		if t[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+
+	case 'b', 'i', 'u', 'h':
+		b, err := d.next(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		n := d.order.Uint32(b)
+		switch t[0] {
+		case 'b':
+			return n != 0, nil
+		case 'i':
+			return int32(n), nil
+		}
+		return n, nil
+
+	case 'x', 't', 'd':
+		b, err := d.next(8, 8)
+		if err != nil {
+			return nil, err
+		}
+		n := d.order.Uint64(b)
+		switch t[0] {
+		case 'x':
+			return int64(n), nil
+		case 'd':
+			return math.Float64frombits(n), nil
+		}
+		return n, nil
+
+	case 's', 'o':
+		b, err := d.next(4, 4)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(int(d.order.Uint32(b))+1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if s[len(s)-1] != 0 {
+			return nil, fmt.Errorf("unterminated string at %d", d.pos)
+		}
+		if t[0] == 'o' {
+			return ObjectPath(s[:len(s)-1]), nil
+		}
+		return string(s[:len(s)-1]), nil
+
+	case 'g':
+		b, err := d.next(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(int(b[0])+1, 1)
+		if err != nil {
+			return nil, err
+		}
+		if s[len(s)-1] != 0 {
+			return nil, fmt.Errorf("unterminated signature at %d", d.pos)
+		}
+		return Signature(s[:len(s)-1]), nil
+
+	case 'v':
+		signature, err := d.decode("g")
+		if err != nil {
+			return nil, err
+		}
+		if n, err := typeLen(string(signature.(Signature)), 0); err != nil || n != len(signature.(Signature)) {
+			return nil, fmt.Errorf("invalid variant signature %q", signature)
+		}
+		if d.variants >= maxDepth {
+			return nil, fmt.Errorf("variants nested over %d deep at %d", maxDepth, d.pos)
+		}
+		d.variants++
+		defer func() { d.variants-- }()
+		return d.decode(string(signature.(Signature)))
+
+	case '(':
+		types, err := splitTypes(t[1 : len(t)-1])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := d.next(0, 8); err != nil {
+			return nil, err
+		}
+		fields := []interface{}{}
+		for _, ft := range types {
+			value, err := d.decode(ft)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, value)
+		}
+		return fields, nil
+
+	case 'a':
+		return d.decodeArray(t[1:])
+	}
+
+	return nil, fmt.Errorf("cannot decode type %s", t)
+}
+
+// decodeArray unmarshals an array of elem.
+func (d *decoder) decodeArray(elem string) (interface{}, error) {
+	b, err := d.next(4, 4)
+	if err != nil {
+		return nil, err
+	}
+	n := int(d.order.Uint32(b))
+	if _, err := d.next(0, alignment(elem[0])); err != nil {
+		return nil, err
+	}
+	end := d.pos + n
+	if end > len(d.buf) || n < 0 {
+		return nil, fmt.Errorf("truncated array at %d", d.pos)
+	}
+
+	if elem == "y" {
+		bytes := make([]byte, n)
+		copy(bytes, d.buf[d.pos:end])
+		d.pos = end
+		return bytes, nil
+	}
+
+	if elem[0] == '{' {
+		types, err := splitTypes(elem[1 : len(elem)-1])
+		if err != nil || len(types) != 2 {
+			return nil, fmt.Errorf("invalid dictionary a%s", elem)
+		}
+		byString := map[string]interface{}{}
+		others := map[interface{}]interface{}{}
+		for d.pos < end {
+			if _, err := d.next(0, 8); err != nil {
+				return nil, err
+			}
+			key, err := d.decode(types[0])
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(types[1])
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := key.(string); ok {
+				byString[s] = value
+			} else {
+				others[key] = value
+			}
+		}
+		if d.pos != end {
+			return nil, fmt.Errorf("array overruns its length at %d", end)
+		}
+		if types[0] == "s" {
+			return byString, nil
+		}
+		return others, nil
+	}
+
+	values := []interface{}{}
+	for d.pos < end {
+		value, err := d.decode(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	if d.pos != end {
+		return nil, fmt.Errorf("array overruns its length at %d", end)
+	}
+
+	return values, nil
+}
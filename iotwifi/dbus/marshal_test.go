@@ -0,0 +1,252 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		signature Signature
+		args      []interface{}
+		wire      []byte
+		decoded   []interface{} // when args do not decode to themselves
+	}{
+		{"", nil, []byte{}, []interface{}{}},
+		{"y", []interface{}{byte(7)}, []byte{7}, nil},
+		{"b", []interface{}{true}, []byte{1, 0, 0, 0}, nil},
+		{"n", []interface{}{int16(-2)}, []byte{0xfe, 0xff}, nil},
+		{"q", []interface{}{uint16(258)}, []byte{2, 1}, nil},
+		{"i", []interface{}{int32(-1)}, []byte{0xff, 0xff, 0xff, 0xff}, nil},
+		{"u", []interface{}{7}, []byte{7, 0, 0, 0}, []interface{}{uint32(7)}},
+		{"x", []interface{}{int64(-2)}, []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil},
+		{"t", []interface{}{uint64(1 << 32)}, []byte{0, 0, 0, 0, 1, 0, 0, 0}, nil},
+		{"d", []interface{}{1.0}, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}, nil},
+		{"s", []interface{}{"hi"}, []byte{2, 0, 0, 0, 'h', 'i', 0}, nil},
+		{"s", []interface{}{""}, []byte{0, 0, 0, 0, 0}, nil},
+		{"o", []interface{}{ObjectPath("/")}, []byte{1, 0, 0, 0, '/', 0}, nil},
+		{"g", []interface{}{Signature("a{sv}")}, []byte{5, 'a', '{', 's', 'v', '}', 0}, nil},
+		{"ys", []interface{}{byte(1), "a"}, []byte{1, 0, 0, 0, 1, 0, 0, 0, 'a', 0}, nil},
+		{"yx", []interface{}{byte(1), int64(2)}, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}, nil},
+		{"v", []interface{}{MakeVariant("u", uint32(5))}, []byte{1, 'u', 0, 0, 5, 0, 0, 0}, []interface{}{uint32(5)}},
+		{"ay", []interface{}{[]byte{1, 2}}, []byte{2, 0, 0, 0, 1, 2}, nil},
+		{"ai", []interface{}{[]int32{1, 2}}, []byte{8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}, []interface{}{[]interface{}{int32(1), int32(2)}}},
+		{"ax", []interface{}{nil}, []byte{0, 0, 0, 0, 0, 0, 0, 0}, []interface{}{[]interface{}{}}},
+		{"as", []interface{}{[]string{"a", "bc"}}, []byte{15, 0, 0, 0, 1, 0, 0, 0, 'a', 0, 0, 0, 2, 0, 0, 0, 'b', 'c', 0}, []interface{}{[]interface{}{"a", "bc"}}},
+		{"(yu)", []interface{}{[]interface{}{byte(1), uint32(2)}}, []byte{1, 0, 0, 0, 2, 0, 0, 0}, nil},
+		{"y(y)", []interface{}{byte(1), []interface{}{byte(2)}}, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2}, nil},
+		{
+			"a{sv}",
+			[]interface{}{map[string]Variant{"a": MakeVariant("y", byte(1))}},
+			[]byte{10, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 'a', 0, 1, 'y', 0, 1},
+			[]interface{}{map[string]interface{}{"a": byte(1)}},
+		},
+		{
+			"a{us}",
+			[]interface{}{map[uint32]string{3: "c"}},
+			[]byte{10, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 'c', 0},
+			[]interface{}{map[interface{}]interface{}{uint32(3): "c"}},
+		},
+		{
+			"v",
+			[]interface{}{MakeVariant("a(yv)", []interface{}{[]interface{}{byte(1), MakeVariant("s", "x")}})},
+			[]byte{5, 'a', '(', 'y', 'v', ')', 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 1, 1, 's', 0, 1, 0, 0, 0, 'x', 0},
+			[]interface{}{[]interface{}{[]interface{}{byte(1), "x"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.signature), func(t *testing.T) {
+			wire, err := Encode(tt.signature, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(wire, tt.wire) {
+				t.Errorf("encoded % x, want % x", wire, tt.wire)
+			}
+
+			decoded, err := Decode(tt.signature, tt.wire, binary.LittleEndian)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.decoded
+			if want == nil {
+				want = tt.args
+			}
+			if !reflect.DeepEqual(decoded, want) {
+				t.Errorf("decoded %#v, want %#v", decoded, want)
+			}
+		})
+	}
+}
+
+func TestDecodeBigEndian(t *testing.T) {
+	wire := []byte{0xff, 0xfe, 0, 0, 0, 0, 0, 7, 0, 0, 0, 2, 'h', 'i', 0}
+	decoded, err := Decode("nus", wire, binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int16(-2), uint32(7), "hi"}; !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %#v, want %#v", decoded, want)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature Signature
+		args      []interface{}
+	}{
+		{"too few values", "ss", []interface{}{"a"}},
+		{"too many values", "s", []interface{}{"a", "b"}},
+		{"invalid signature", "a", []interface{}{nil}},
+		{"string as int", "i", []interface{}{"1"}},
+		{"int as bool", "b", []interface{}{1}},
+		{"int as string", "s", []interface{}{1}},
+		{"int as double", "d", []interface{}{1}},
+		{"long signature", "g", []interface{}{strings.Repeat("y", 256)}},
+		{"not a variant", "v", []interface{}{"a"}},
+		{"empty variant", "v", []interface{}{Variant{}}},
+		{"two types in a variant", "v", []interface{}{MakeVariant("ss", "a")}},
+		{"mismatched variant", "v", []interface{}{MakeVariant("u", "a")}},
+		{"short struct", "(ss)", []interface{}{[]interface{}{"a"}}},
+		{"struct of a slice", "(s)", []interface{}{[]string{"a"}}},
+		{"array of a map", "as", []interface{}{map[string]string{}}},
+		{"dictionary of a slice", "a{ss}", []interface{}{[]string{"a"}}},
+		{"array element", "as", []interface{}{[]interface{}{"a", 1}}},
+		{"dictionary value", "a{ss}", []interface{}{map[string]int{"a": 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if wire, err := Encode(tt.signature, tt.args...); err == nil {
+				t.Errorf("encoded % x", wire)
+			}
+		})
+	}
+}
+
+// variants nests n variants, the innermost of a byte.
+func variants(n int) []byte {
+	return append(bytes.Repeat([]byte{1, 'v', 0}, n-1), 1, 'y', 0, 5)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature Signature
+		wire      []byte
+	}{
+		{"empty", "y", []byte{}},
+		{"short int", "u", []byte{1, 0, 0}},
+		{"short padding", "yu", []byte{1, 0, 0, 0, 1}},
+		{"short string", "s", []byte{5, 0, 0, 0, 'a', 0}},
+		{"unterminated string", "s", []byte{1, 0, 0, 0, 'a', 'b'}},
+		{"unterminated signature", "g", []byte{1, 's', 's'}},
+		{"huge string", "s", []byte{0xff, 0xff, 0xff, 0xff, 'a', 0}},
+		{"huge array", "ay", []byte{0xff, 0xff, 0xff, 0xff, 1}},
+		{"short array", "ai", []byte{8, 0, 0, 0, 1, 0, 0, 0}},
+		{"array overrun", "ai", []byte{2, 0, 0, 0, 1, 0, 0, 0}},
+		{"dictionary overrun", "a{yy}", []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 2}},
+		{"invalid variant", "v", []byte{1, 'z', 0, 0}},
+		{"empty variant", "v", []byte{0, 0, 1}},
+		{"two types in a variant", "v", []byte{2, 'y', 'y', 0, 1, 2}},
+		{"empty struct in a variant", "v", []byte{3, 'a', '(', ')', 0, 0, 0, 0, 8, 0, 0, 0}},
+		{"dictionary entry in a variant", "v", []byte{4, '{', 's', 's', '}', 0}},
+		{"unhashable key in a variant", "v", []byte{6, 'a', '{', 'a', 'y', 'y', '}', 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"nested variants", "v", variants(maxDepth + 1)},
+		{"invalid signature", "(", []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if values, err := Decode(tt.signature, tt.wire, binary.LittleEndian); err == nil {
+				t.Errorf("decoded %#v", values)
+			}
+		})
+	}
+
+	values, err := Decode("v", variants(maxDepth), binary.LittleEndian)
+	if err != nil || !reflect.DeepEqual(values, []interface{}{byte(5)}) {
+		t.Errorf("%d nested variants decoded to %#v, %v", maxDepth, values, err)
+	}
+}
+
+func TestSplitTypes(t *testing.T) {
+	tests := []struct {
+		signature string
+		types     []string
+	}{
+		{"", []string{}},
+		{"s", []string{"s"}},
+		{"sv", []string{"s", "v"}},
+		{"a{sv}u", []string{"a{sv}", "u"}},
+		{"a(yv)", []string{"a(yv)"}},
+		{"aa{s(ia{ov})}y", []string{"aa{s(ia{ov})}", "y"}},
+		{"(i(ss))(y)", []string{"(i(ss))", "(y)"}},
+		{strings.Repeat("a", maxDepth-1) + "y", []string{strings.Repeat("a", maxDepth-1) + "y"}},
+	}
+
+	for _, tt := range tests {
+		types, err := splitTypes(tt.signature)
+		if err != nil {
+			t.Errorf("%q: %s", tt.signature, err)
+			continue
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%q split to %q, want %q", tt.signature, types, tt.types)
+		}
+	}
+
+	invalid := []string{
+		"a", "z", "sz", "(", "(s", "()", "a()", ")", "}", "{sv}", "a{", "a{s", "a{sv", "a{s}",
+		"a{svs}", "a{vs}", "a{(s)s}", "a{ass}", "a{}",
+		strings.Repeat("a", maxDepth) + "y",
+		strings.Repeat("(", maxDepth) + "y" + strings.Repeat(")", maxDepth),
+	}
+	for _, signature := range invalid {
+		if types, err := splitTypes(signature); err == nil {
+			t.Errorf("%q split to %q", signature, types)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add("a{sv}", []byte{10, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 'a', 0, 1, 'y', 0, 1}, false)
+	f.Add("a(yv)", []byte{10, 0, 0, 0, 0, 0, 0, 0, 1, 1, 's', 0, 1, 0, 0, 0, 'x', 0}, false)
+	f.Add("a{us}", []byte{0, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 1, 'c', 0}, true)
+	f.Add("nqixtbogay", []byte{0xfe, 0xff, 2, 1, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, '/', 0, 1, 's', 0, 0, 1, 0, 0, 0, 9}, false)
+	f.Add("v", variants(3), false)
+
+	f.Fuzz(func(t *testing.T, signature string, wire []byte, big bool) {
+		var order binary.ByteOrder = binary.LittleEndian
+		if big {
+			order = binary.BigEndian
+		}
+
+		values, err := Decode(Signature(signature), wire, order)
+		if err != nil {
+			return
+		}
+
+		// values encode back to themselves, but for variants, which lose
+		// their signature, and doubles, which may be NaN
+		if strings.ContainsAny(signature, "vd") {
+			return
+		}
+		again, err := Encode(Signature(signature), values...)
+		if err != nil {
+			t.Fatalf("%s % x decoded to %#v, not encoded: %s", signature, wire, values, err)
+		}
+		decoded, err := Decode(Signature(signature), again, binary.LittleEndian)
+		if err != nil {
+			t.Fatalf("%s % x decoded to %#v, encoded to % x: %s", signature, wire, values, again, err)
+		}
+		if !reflect.DeepEqual(decoded, values) {
+			t.Fatalf("%s % x decoded to %#v, encoded to % x, decoded to %#v", signature, wire, values, again, decoded)
+		}
+	})
+}
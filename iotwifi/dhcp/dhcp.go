@@ -0,0 +1,105 @@
+// Package dhcp manages the dnsmasq DHCP server used on the AP interface:
+// reading its leases, building static reservations and revoking leases.
+// Server is a built-in replacement of dnsmasq, keeping the same leases.
+
+package dhcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease is an address handed out by dnsmasq.
+type Lease struct {
+	Expiry   time.Time `json:"expiry"` // zero for infinite leases
+	Mac      string    `json:"mac"`
+	Ip       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	ClientId string    `json:"client_id"`
+}
+
+// Reservation pins an address (and optionally a hostname) to a MAC.
+type Reservation struct {
+	Mac      string `json:"mac"`
+	Ip       string `json:"ip"`
+	Hostname string `json:"hostname"`
+}
+
+// ReadLeases parses a dnsmasq lease file. A missing file means no leases.
+func ReadLeases(path string) ([]Lease, error) {
+	leases := []Lease{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return leases, nil
+	}
+	if err != nil {
+		return leases, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// expiry mac ip hostname client-id, "duid ..." lines are DHCPv6
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+
+		lease := Lease{
+			Mac: strings.ToLower(fields[1]),
+			Ip:  fields[2],
+		}
+
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			lease.Expiry = time.Unix(expiry, 0)
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if len(fields) > 4 && fields[4] != "*" {
+			lease.ClientId = fields[4]
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, scanner.Err()
+}
+
+// Validate checks a reservation has a MAC and an IP.
+func (r Reservation) Validate() error {
+	if r.Mac == "" || r.Ip == "" {
+		return fmt.Errorf("reservation needs a mac and an ip")
+	}
+
+	return nil
+}
+
+// HostArg renders the reservation as a dnsmasq --dhcp-host option.
+func (r Reservation) HostArg() string {
+	arg := "--dhcp-host=" + r.Mac + "," + r.Ip
+	if r.Hostname != "" {
+		arg += "," + r.Hostname
+	}
+
+	return arg
+}
+
+// Revoke releases the lease of ip/mac on iface, so dnsmasq forgets it
+// and the address can be handed out again. It uses dhcp_release from
+// dnsmasq-utils, which sends dnsmasq a DHCPRELEASE on the client's behalf.
+func Revoke(ctx context.Context, iface string, ip string, mac string) error {
+	out, err := exec.CommandContext(ctx, "dhcp_release", iface, ip, mac).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dhcp_release: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package dhcp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	content := "1700000000 B8:27:EB:00:00:01 192.168.27.100 pi 01:b8:27:eb:00:00:01\n" +
+		"0 b8:27:eb:00:00:02 192.168.27.101 * *\n" +
+		"duid 00:01:00:01:2a:2b:2c:2d:b8:27:eb:00:00:01\n" +
+		"1700000000 b8:27:eb:00:00:03 fd00::1 host6\n" +
+		"\n" +
+		"garbage\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	leases, err := ReadLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Lease{
+		{Expiry: time.Unix(1700000000, 0), Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.100", Hostname: "pi", ClientId: "01:b8:27:eb:00:00:01"},
+		{Mac: "b8:27:eb:00:00:02", Ip: "192.168.27.101"},
+		{Expiry: time.Unix(1700000000, 0), Mac: "b8:27:eb:00:00:03", Ip: "fd00::1", Hostname: "host6"},
+	}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("leases %+v, want %+v", leases, want)
+	}
+
+	leases, err = ReadLeases(filepath.Join(t.TempDir(), "none"))
+	if err != nil || len(leases) != 0 {
+		t.Errorf("missing file read to %+v, %v", leases, err)
+	}
+}
+
+func TestWriteLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dir", "dnsmasq.leases")
+	leases := []Lease{
+		{Mac: "b8:27:eb:00:00:02", Ip: "192.168.27.101", Hostname: "with space"},
+		{Expiry: time.Unix(1700000000, 0), Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.100", ClientId: "01:02"},
+	}
+	if err := WriteLeases(path, leases); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	want := "1700000000 b8:27:eb:00:00:01 192.168.27.100 * 01:02\n" +
+		"0 b8:27:eb:00:00:02 192.168.27.101 with_space *\n"
+	if string(content) != want {
+		t.Errorf("wrote %q, want %q", content, want)
+	}
+
+	if err := RemoveLease(path, "B8:27:EB:00:00:01"); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLeases(path)
+	if err != nil || len(read) != 1 || read[0].Mac != "b8:27:eb:00:00:02" || read[0].Hostname != "with_space" {
+		t.Errorf("read %+v, %v", read, err)
+	}
+	if err := RemoveLease(path, "b8:27:eb:00:00:01"); err == nil {
+		t.Error("removed a lease twice")
+	}
+}
+
+func TestReservation(t *testing.T) {
+	tests := []struct {
+		r     Reservation
+		valid bool
+		arg   string
+	}{
+		{Reservation{Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.10"}, true, "--dhcp-host=b8:27:eb:00:00:01,192.168.27.10"},
+		{Reservation{Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.10", Hostname: "pi"}, true, "--dhcp-host=b8:27:eb:00:00:01,192.168.27.10,pi"},
+		{Reservation{Ip: "192.168.27.10"}, false, ""},
+		{Reservation{Mac: "b8:27:eb:00:00:01"}, false, ""},
+	}
+
+	for _, tt := range tests {
+		if err := tt.r.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: valid %v, want %v", tt.r, err == nil, tt.valid)
+		}
+		if tt.valid && tt.r.HostArg() != tt.arg {
+			t.Errorf("%+v: arg %s, want %s", tt.r, tt.r.HostArg(), tt.arg)
+		}
+	}
+}
@@ -0,0 +1,782 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Ports of DHCPv4 servers and clients.
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+// DefaultLeaseTime is the lease time of a range without one, dnsmasq's.
+const DefaultLeaseTime = time.Hour
+
+// DHCP message types, option 53.
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// DHCP options used by the Server.
+const (
+	optPad         = 0
+	optSubnetMask  = 1
+	optRouter      = 3
+	optDNS         = 6
+	optHostname    = 12
+	optBroadcast   = 28
+	optRequestedIP = 50
+	optLeaseTime   = 51
+	optMessageType = 53
+	optServerID    = 54
+	optRenewal     = 58
+	optRebinding   = 59
+	optClientID    = 61
+	optEnd         = 255
+)
+
+// magicCookie starts the options of a DHCP message.
+var magicCookie = []byte{99, 130, 83, 99}
+
+// flagBroadcast asks for the reply to be broadcast.
+const flagBroadcast = 0x8000
+
+// offerTimeout is how long an offered address is kept for the client it
+// was offered to.
+const offerTimeout = time.Minute
+
+// declineTimeout is how long an address a client declined, being in use
+// by another host, is not handed out.
+const declineTimeout = 10 * time.Minute
+
+// ErrMalformed is returned for packets that are not DHCP messages.
+var ErrMalformed = errors.New("malformed dhcp message")
+
+// Logger is the logging interface of the Server, iotwifi.Logger's.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Packet is a DHCPv4 message.
+type Packet struct {
+	Op      byte // 1 request, 2 reply
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options map[byte][]byte
+}
+
+// ParsePacket parses a DHCPv4 message of an Ethernet client.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < 240 || string(b[236:240]) != string(magicCookie) {
+		return nil, ErrMalformed
+	}
+	if b[1] != 1 || b[2] != 6 {
+		return nil, fmt.Errorf("%w: hardware type %d of length %d", ErrMalformed, b[1], b[2])
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:]),
+		Secs:    binary.BigEndian.Uint16(b[8:]),
+		Flags:   binary.BigEndian.Uint16(b[10:]),
+		CIAddr:  net.IP(append([]byte{}, b[12:16]...)),
+		YIAddr:  net.IP(append([]byte{}, b[16:20]...)),
+		SIAddr:  net.IP(append([]byte{}, b[20:24]...)),
+		GIAddr:  net.IP(append([]byte{}, b[24:28]...)),
+		CHAddr:  net.HardwareAddr(append([]byte{}, b[28:34]...)),
+		Options: map[byte][]byte{},
+	}
+
+	opts := b[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("%w: option %d overruns the message", ErrMalformed, code)
+		}
+
+		// options may be split over several instances, RFC 3396
+		end := 2 + int(opts[1])
+		p.Options[code] = append(p.Options[code], opts[2:end]...)
+		opts = opts[end:]
+	}
+
+	return p, nil
+}
+
+// MessageType returns the DHCP message type, 0 if there is none.
+func (p *Packet) MessageType() byte {
+	if t := p.Options[optMessageType]; len(t) == 1 {
+		return t[0]
+	}
+
+	return 0
+}
+
+// Marshal encodes the message, the message type first and the other
+// options by code.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, 240, 300)
+	b[0] = p.Op
+	b[1] = 1
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:], p.XID)
+	binary.BigEndian.PutUint16(b[8:], p.Secs)
+	binary.BigEndian.PutUint16(b[10:], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	copy(b[236:240], magicCookie)
+
+	codes := []int{}
+	for code := range p.Options {
+		if code != optMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := p.Options[optMessageType]; ok {
+		codes = append([]int{optMessageType}, codes...)
+	}
+
+	for _, code := range codes {
+		value := p.Options[byte(code)]
+		for len(value) > 255 {
+			b = append(append(b, byte(code), 255), value[:255]...)
+			value = value[255:]
+		}
+		b = append(append(b, byte(code), byte(len(value))), value...)
+	}
+	b = append(b, optEnd)
+
+	// some clients drop replies shorter than a BOOTP message
+	for len(b) < 300 {
+		b = append(b, optPad)
+	}
+
+	return b
+}
+
+// ParseRange parses a dnsmasq --dhcp-range, "192.168.27.100,192.168.27.150,1h",
+// with an optional netmask after the end address and tags before the
+// start address. The lease time is DefaultLeaseTime if it is left out, 0
+// for "infinite".
+func ParseRange(dhcpRange string) (start net.IP, end net.IP, leaseTime time.Duration, err error) {
+	fields := strings.Split(dhcpRange, ",")
+	for len(fields) > 0 && (strings.HasPrefix(fields[0], "set:") || strings.HasPrefix(fields[0], "tag:")) {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil, nil, 0, fmt.Errorf("invalid dhcp range %q, want start,end[,lease time]", dhcpRange)
+	}
+
+	start = net.ParseIP(strings.TrimSpace(fields[0])).To4()
+	end = net.ParseIP(strings.TrimSpace(fields[1])).To4()
+	if start == nil || end == nil || ipUint32(start) > ipUint32(end) {
+		return nil, nil, 0, fmt.Errorf("invalid dhcp range %q", dhcpRange)
+	}
+
+	leaseTime = DefaultLeaseTime
+	for _, field := range fields[2:] {
+		field = strings.TrimSpace(field)
+		if net.ParseIP(field) != nil {
+			continue // the netmask
+		}
+		if leaseTime, err = parseLeaseTime(field); err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid dhcp range %q: %s", dhcpRange, err)
+		}
+	}
+
+	return start, end, leaseTime, nil
+}
+
+// parseLeaseTime parses a dnsmasq lease time: seconds, or a number of
+// minutes, hours, days or weeks with m, h, d or w, or "infinite".
+func parseLeaseTime(s string) (time.Duration, error) {
+	if s == "infinite" {
+		return 0, nil
+	}
+
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	unit := time.Second
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1]]; ok {
+			unit = u
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || int64(n) > int64(math.MaxInt64/unit) {
+		return 0, fmt.Errorf("invalid lease time %q", s)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	Iface        string // uap0, served alone
+	ServerIP     net.IP // the address of Iface, handed out as router and DNS server
+	Mask         net.IPMask
+	Start        net.IP // the addresses handed out
+	End          net.IP
+	LeaseTime    time.Duration // 0 for infinite leases
+	LeaseFile    string        // kept in the dnsmasq format, so ReadLeases reads it
+	Reservations []Reservation
+}
+
+// offer is an address offered to a client.
+type offer struct {
+	ip    string
+	until time.Time
+}
+
+// Server is a DHCPv4 server for the AP, a replacement of the DHCP part of
+// dnsmasq. Leases survive restarts in the lease file, and leases removed
+// from it, by RemoveLease, are forgotten.
+type Server struct {
+	Config ServerConfig
+	Log    Logger
+
+	mu       sync.Mutex
+	leases   map[string]Lease // by mac
+	offers   map[string]offer // by mac
+	declined map[string]time.Time
+	fileMod  time.Time // of the lease file as last read or written
+}
+
+// NewServer produces a Server of cfg with the leases of its lease file.
+func NewServer(cfg ServerConfig, log Logger) (*Server, error) {
+	if cfg.ServerIP.To4() == nil || cfg.Start.To4() == nil || cfg.End.To4() == nil {
+		return nil, fmt.Errorf("dhcp server needs IPv4 addresses")
+	}
+	if cfg.Mask == nil {
+		cfg.Mask = cfg.ServerIP.DefaultMask()
+	}
+
+	s := &Server{
+		Config:   cfg,
+		Log:      log,
+		leases:   map[string]Lease{},
+		offers:   map[string]offer{},
+		declined: map[string]time.Time{},
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Run serves DHCP on the interface until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	lc := net.ListenConfig{Control: netif.BindToDevice(s.Config.Iface)}
+	pc, err := lc.ListenPacket(ctx, "udp4", ":"+strconv.Itoa(ServerPort))
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	conn := pc.(*net.UDPConn)
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := netif.SetBroadcast(raw); err != nil {
+		return err
+	}
+
+	s.Log.Info("dhcp server listening", "iface", s.Config.Iface, "range", s.Config.Start.String()+"-"+s.Config.End.String())
+
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil || req.Op != 1 {
+			continue
+		}
+
+		reply, dst := s.Handle(req)
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.WriteToUDP(reply.Marshal(), dst); err != nil {
+			s.Log.Warn("dhcp reply failed", "iface", s.Config.Iface, "mac", req.CHAddr.String(), "error", err)
+		}
+	}
+}
+
+// Handle answers a request, returning the reply and where to send it, or
+// nil when there is nothing to answer.
+func (s *Server) Handle(req *Packet) (*Packet, *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// leases revoked since are forgotten
+	if err := s.reloadIfChanged(); err != nil {
+		s.Log.Error("could not read leases", "path", s.Config.LeaseFile, "error", err)
+	}
+	s.expire()
+
+	mac := strings.ToLower(req.CHAddr.String())
+
+	switch req.MessageType() {
+	case Discover:
+		ip := s.allocate(mac, net.IP(req.Options[optRequestedIP]))
+		if ip == nil {
+			s.Log.Warn("dhcp range exhausted", "iface", s.Config.Iface, "mac", mac)
+			return nil, nil
+		}
+		s.offers[mac] = offer{ip: ip.String(), until: time.Now().Add(offerTimeout)}
+		s.Log.Debug("dhcp offer", "iface", s.Config.Iface, "mac", mac, "ip", ip.String())
+
+		return s.reply(req, Offer, ip, true)
+
+	case Request:
+		// the client took the offer of another server
+		if id := req.Options[optServerID]; id != nil && !net.IP(id).Equal(s.Config.ServerIP) {
+			delete(s.offers, mac)
+			return nil, nil
+		}
+
+		ip := net.IP(req.Options[optRequestedIP])
+		if ip == nil {
+			ip = req.CIAddr // renewing
+		}
+		if !s.available(mac, ip) {
+			s.Log.Info("dhcp nak", "iface", s.Config.Iface, "mac", mac, "ip", ip.String())
+			return s.reply(req, Nak, nil, false)
+		}
+
+		lease := Lease{Mac: mac, Ip: ip.To4().String(), Hostname: cleanHostname(req.Options[optHostname])}
+		if id := req.Options[optClientID]; len(id) > 0 {
+			lease.ClientId = hexColons(id)
+		}
+		if s.Config.LeaseTime > 0 {
+			lease.Expiry = time.Now().Add(s.Config.LeaseTime).Truncate(time.Second)
+		}
+		s.leases[mac] = lease
+		delete(s.offers, mac)
+		if err := s.save(); err != nil {
+			s.Log.Error("could not save leases", "path", s.Config.LeaseFile, "error", err)
+		}
+		s.Log.Info("dhcp ack", "iface", s.Config.Iface, "mac", mac, "ip", lease.Ip, "hostname", lease.Hostname)
+
+		return s.reply(req, Ack, ip, true)
+
+	case Decline:
+		// only addresses of the range are kept out, so declines cannot
+		// grow without bound
+		if ip := net.IP(req.Options[optRequestedIP]).To4(); ip != nil && s.inRange(ip) {
+			s.declined[ip.String()] = time.Now().Add(declineTimeout)
+			s.Log.Warn("dhcp address declined", "iface", s.Config.Iface, "mac", mac, "ip", ip.String())
+		}
+		s.forget(mac)
+
+	case Release:
+		s.Log.Info("dhcp release", "iface", s.Config.Iface, "mac", mac, "ip", req.CIAddr.String())
+		s.forget(mac)
+
+	case Inform:
+		return s.reply(req, Ack, nil, false)
+	}
+
+	return nil, nil
+}
+
+// reply builds the reply to req of type msgType, handing out ip. Leases
+// come with their times.
+func (s *Server) reply(req *Packet, msgType byte, ip net.IP, lease bool) (*Packet, *net.UDPAddr) {
+	reply := &Packet{
+		Op:     2,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: s.Config.ServerIP,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			optMessageType: {msgType},
+			optServerID:    s.Config.ServerIP.To4(),
+		},
+	}
+	if ip != nil {
+		reply.YIAddr = ip
+	}
+	if msgType == Ack && req.MessageType() == Inform {
+		reply.CIAddr = req.CIAddr
+	}
+
+	if msgType != Nak {
+		reply.Options[optSubnetMask] = []byte(s.Config.Mask)
+		reply.Options[optRouter] = s.Config.ServerIP.To4()
+		reply.Options[optDNS] = s.Config.ServerIP.To4()
+		reply.Options[optBroadcast] = s.broadcast()
+	}
+	if lease && msgType != Nak {
+		seconds := uint32(0xffffffff)
+		if s.Config.LeaseTime > 0 {
+			seconds = uint32(s.Config.LeaseTime / time.Second)
+		}
+		reply.Options[optLeaseTime] = be32(seconds)
+		if seconds != 0xffffffff {
+			reply.Options[optRenewal] = be32(seconds / 2)
+			reply.Options[optRebinding] = be32(seconds / 8 * 7)
+		}
+	}
+
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+	switch {
+	case !req.GIAddr.Equal(net.IPv4zero):
+		dst = &net.UDPAddr{IP: req.GIAddr, Port: ServerPort}
+	case msgType != Nak && !req.CIAddr.Equal(net.IPv4zero):
+		dst = &net.UDPAddr{IP: req.CIAddr, Port: ClientPort}
+	}
+
+	return reply, dst
+}
+
+// allocate picks the address for mac: its reservation, its lease or
+// offer, the address it asked for, or the first free one.
+func (s *Server) allocate(mac string, requested net.IP) net.IP {
+	if r, ok := s.reservation(mac); ok {
+		return net.ParseIP(r.Ip).To4()
+	}
+	if lease, ok := s.leases[mac]; ok {
+		return net.ParseIP(lease.Ip).To4()
+	}
+	if o, ok := s.offers[mac]; ok && time.Now().Before(o.until) {
+		return net.ParseIP(o.ip).To4()
+	}
+	if requested != nil && s.available(mac, requested) {
+		return requested.To4()
+	}
+
+	for n := ipUint32(s.Config.Start); n <= ipUint32(s.Config.End); n++ {
+		if ip := uint32IP(n); s.available(mac, ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// available reports whether ip may be handed to mac: reserved for it, or
+// in the range and not the server's, reserved, leased, offered or
+// declined.
+func (s *Server) available(mac string, ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+
+	if r, ok := s.reservation(mac); ok {
+		return net.ParseIP(r.Ip).Equal(ip)
+	}
+
+	if !s.inRange(ip) || ip.Equal(s.Config.ServerIP) {
+		return false
+	}
+	if until, ok := s.declined[ip.String()]; ok && time.Now().Before(until) {
+		return false
+	}
+
+	for _, r := range s.Config.Reservations {
+		if net.ParseIP(r.Ip).Equal(ip) {
+			return false
+		}
+	}
+	for other, lease := range s.leases {
+		if other != mac && lease.Ip == ip.String() && (lease.Expiry.IsZero() || time.Now().Before(lease.Expiry)) {
+			return false
+		}
+	}
+	for other, o := range s.offers {
+		if other != mac && o.ip == ip.String() && time.Now().Before(o.until) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inRange reports whether ip is in the range handed out.
+func (s *Server) inRange(ip net.IP) bool {
+	n := ipUint32(ip)
+	return n >= ipUint32(s.Config.Start) && n <= ipUint32(s.Config.End)
+}
+
+// expire drops the offers and declines that are over, so clients coming
+// and going do not grow them.
+func (s *Server) expire() {
+	now := time.Now()
+	for mac, o := range s.offers {
+		if !now.Before(o.until) {
+			delete(s.offers, mac)
+		}
+	}
+	for ip, until := range s.declined {
+		if !now.Before(until) {
+			delete(s.declined, ip)
+		}
+	}
+}
+
+// reservation returns the reservation of mac.
+func (s *Server) reservation(mac string) (Reservation, bool) {
+	for _, r := range s.Config.Reservations {
+		if strings.EqualFold(r.Mac, mac) {
+			return r, true
+		}
+	}
+
+	return Reservation{}, false
+}
+
+// forget drops the lease and offer of mac.
+func (s *Server) forget(mac string) {
+	delete(s.offers, mac)
+	if _, ok := s.leases[mac]; !ok {
+		return
+	}
+
+	delete(s.leases, mac)
+	if err := s.save(); err != nil {
+		s.Log.Error("could not save leases", "path", s.Config.LeaseFile, "error", err)
+	}
+}
+
+// broadcast returns the broadcast address of the subnet.
+func (s *Server) broadcast() []byte {
+	ip := s.Config.ServerIP.To4()
+	b := make([]byte, 4)
+	for i := range b {
+		b[i] = ip[i] | ^s.Config.Mask[len(s.Config.Mask)-4+i]
+	}
+
+	return b
+}
+
+// reload reads the lease file, leaving out the expired leases.
+func (s *Server) reload() error {
+	leases, err := ReadLeases(s.Config.LeaseFile)
+	if err != nil {
+		return err
+	}
+
+	s.leases = map[string]Lease{}
+	for _, lease := range leases {
+		if lease.Expiry.IsZero() || time.Now().Before(lease.Expiry) {
+			s.leases[lease.Mac] = lease
+		}
+	}
+
+	if info, err := os.Stat(s.Config.LeaseFile); err == nil {
+		s.fileMod = info.ModTime()
+	}
+
+	return nil
+}
+
+// reloadIfChanged reads the lease file again if it was written by
+// someone else since.
+func (s *Server) reloadIfChanged() error {
+	info, err := os.Stat(s.Config.LeaseFile)
+	if os.IsNotExist(err) && len(s.leases) == 0 {
+		return nil
+	}
+	if err == nil && info.ModTime().Equal(s.fileMod) {
+		return nil
+	}
+
+	return s.reload()
+}
+
+// save writes the leases to the lease file.
+func (s *Server) save() error {
+	leases := make([]Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, lease)
+	}
+
+	if err := WriteLeases(s.Config.LeaseFile, leases); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(s.Config.LeaseFile); err == nil {
+		s.fileMod = info.ModTime()
+	}
+
+	return nil
+}
+
+// Lookup returns the address leased to the host named hostname, nil if
+// there is none.
+func (s *Server) Lookup(hostname string) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, lease := range s.leases {
+		if lease.Hostname != "" && strings.EqualFold(lease.Hostname, hostname) {
+			return net.ParseIP(lease.Ip)
+		}
+	}
+
+	return nil
+}
+
+// WriteLeases writes leases to path in the dnsmasq format, replacing the
+// file at once.
+func WriteLeases(path string, leases []Lease) error {
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Mac < leases[j].Mac })
+
+	var b strings.Builder
+	for _, lease := range leases {
+		expiry := int64(0)
+		if !lease.Expiry.IsZero() {
+			expiry = lease.Expiry.Unix()
+		}
+		fmt.Fprintf(&b, "%d %s %s %s %s\n", expiry, lease.Mac, lease.Ip, orStar(lease.Hostname), orStar(lease.ClientId))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// RemoveLease removes the lease of mac from the lease file at path, so a
+// Server serving it hands the address out again.
+func RemoveLease(path string, mac string) error {
+	leases, err := ReadLeases(path)
+	if err != nil {
+		return err
+	}
+
+	kept := []Lease{}
+	for _, lease := range leases {
+		if !strings.EqualFold(lease.Mac, mac) {
+			kept = append(kept, lease)
+		}
+	}
+	if len(kept) == len(leases) {
+		return fmt.Errorf("no lease for %s", mac)
+	}
+
+	return WriteLeases(path, kept)
+}
+
+// orStar returns s, or * for an empty field of the lease file.
+func orStar(s string) string {
+	if s == "" {
+		return "*"
+	}
+
+	return strings.Replace(s, " ", "_", -1)
+}
+
+// cleanHostname returns the hostname a client sent as dnsmasq keeps it:
+// its first label, when it is a valid one, else nothing, so a name
+// cannot break the lines of the lease file or the names answered.
+func cleanHostname(option []byte) string {
+	name := strings.TrimRight(string(option), "\x00")
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" || len(name) > 63 {
+		return ""
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ""
+		}
+	}
+
+	return name
+}
+
+// hexColons formats b as dnsmasq writes client ids, 01:b8:27:...
+func hexColons(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// be32 encodes n big endian.
+func be32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// ipUint32 converts an IPv4 address to a number.
+func ipUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// uint32IP converts a number to an IPv4 address.
+func uint32IP(n uint32) net.IP {
+	return net.IP(be32(n))
+}
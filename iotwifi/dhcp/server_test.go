@@ -0,0 +1,461 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopLogger discards the logs of the Server.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (nopLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+// packet is a request of an Ethernet client, a DHCPDISCOVER of
+// b8:27:eb:00:00:01.
+func packet() []byte {
+	b := make([]byte, 240)
+	b[0], b[1], b[2] = 1, 1, 6
+	copy(b[4:], []byte{0xde, 0xad, 0xbe, 0xef})
+	b[10] = 0x80
+	copy(b[28:], []byte{0xb8, 0x27, 0xeb, 0, 0, 1})
+	copy(b[236:], magicCookie)
+
+	return append(b, optMessageType, 1, Discover, optPad, optHostname, 2, 'p', 'i', optEnd, 0xaa)
+}
+
+func TestParsePacket(t *testing.T) {
+	p, err := ParsePacket(packet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Packet{
+		Op:      1,
+		XID:     0xdeadbeef,
+		Flags:   flagBroadcast,
+		CIAddr:  net.IPv4zero.To4(),
+		YIAddr:  net.IPv4zero.To4(),
+		SIAddr:  net.IPv4zero.To4(),
+		GIAddr:  net.IPv4zero.To4(),
+		CHAddr:  net.HardwareAddr{0xb8, 0x27, 0xeb, 0, 0, 1},
+		Options: map[byte][]byte{optMessageType: {Discover}, optHostname: []byte("pi")},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("parsed %+v, want %+v", p, want)
+	}
+	if p.MessageType() != Discover {
+		t.Errorf("message type %d", p.MessageType())
+	}
+
+	// options split over several instances are joined
+	split := append(packet()[:240], optHostname, 1, 'p', optHostname, 1, 'i')
+	if p, err := ParsePacket(split); err != nil || string(p.Options[optHostname]) != "pi" || p.MessageType() != 0 {
+		t.Errorf("parsed %+v, %v", p, err)
+	}
+
+	invalid := map[string][]byte{
+		"short":          packet()[:239],
+		"no cookie":      append(append(packet()[:236], 1, 2, 3, 4), optEnd),
+		"hardware type":  append(append(packet()[:1], 6), packet()[2:]...),
+		"address length": append(append(packet()[:2], 8), packet()[3:]...),
+		"option overrun": append(packet()[:240], optHostname, 3, 'p', 'i'),
+		"option length":  append(packet()[:240], optHostname),
+	}
+	for name, b := range invalid {
+		if p, err := ParsePacket(b); err == nil {
+			t.Errorf("%s: parsed %+v", name, p)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 300)
+	p := &Packet{
+		Op:     2,
+		XID:    7,
+		Secs:   3,
+		CIAddr: net.ParseIP("192.168.27.100"),
+		YIAddr: net.IPv4zero,
+		SIAddr: net.ParseIP("192.168.27.1"),
+		CHAddr: net.HardwareAddr{0xb8, 0x27, 0xeb, 0, 0, 1},
+		Options: map[byte][]byte{
+			optServerID:    {192, 168, 27, 1},
+			optRouter:      {192, 168, 27, 1},
+			optMessageType: {Ack},
+			optHostname:    long,
+		},
+	}
+	b := p.Marshal()
+
+	if len(b) < 300 {
+		t.Errorf("marshaled %d bytes", len(b))
+	}
+	// the message type first, the others by code, the long one split
+	opts := append([]byte{optMessageType, 1, Ack, optRouter, 4, 192, 168, 27, 1, optHostname, 255}, long[:255]...)
+	opts = append(append(opts, optHostname, 45), long[255:]...)
+	opts = append(opts, optServerID, 4, 192, 168, 27, 1, optEnd)
+	if !bytes.HasPrefix(b[240:], opts) {
+		t.Errorf("options % x, want % x", b[240:], opts)
+	}
+
+	parsed, err := ParsePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.XID != 7 || parsed.Secs != 3 || !parsed.CIAddr.Equal(p.CIAddr) || !parsed.SIAddr.Equal(p.SIAddr) || !bytes.Equal(parsed.Options[optHostname], long) {
+		t.Errorf("parsed %+v", parsed)
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	f.Add(packet())
+	f.Add(append(packet()[:240], optHostname, 1, 'p', optHostname, 1, 'i', optRequestedIP, 4, 10, 0, 0, 1))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := ParsePacket(b)
+		if err != nil {
+			return
+		}
+
+		again, err := ParsePacket(p.Marshal())
+		if err != nil {
+			t.Fatalf("% x parsed to %+v, marshaled unparseable: %s", b, p, err)
+		}
+		if !reflect.DeepEqual(again, p) {
+			t.Fatalf("% x parsed to %+v, marshaled and parsed to %+v", b, p, again)
+		}
+	})
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		dhcpRange string
+		start     string
+		end       string
+		leaseTime time.Duration
+	}{
+		{"192.168.27.100,192.168.27.150", "192.168.27.100", "192.168.27.150", DefaultLeaseTime},
+		{"192.168.27.100,192.168.27.150,12h", "192.168.27.100", "192.168.27.150", 12 * time.Hour},
+		{"192.168.27.100,192.168.27.150,255.255.255.0,30m", "192.168.27.100", "192.168.27.150", 30 * time.Minute},
+		{"set:ap,tag:x,192.168.27.5, 192.168.27.5 ,infinite", "192.168.27.5", "192.168.27.5", 0},
+		{"10.0.0.1,10.0.0.9,90", "10.0.0.1", "10.0.0.9", 90 * time.Second},
+		{"10.0.0.1,10.0.0.9,2d", "10.0.0.1", "10.0.0.9", 48 * time.Hour},
+		{"10.0.0.1,10.0.0.9,1w", "10.0.0.1", "10.0.0.9", 7 * 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		start, end, leaseTime, err := ParseRange(tt.dhcpRange)
+		if err != nil {
+			t.Errorf("%q: %s", tt.dhcpRange, err)
+			continue
+		}
+		if start.String() != tt.start || end.String() != tt.end || leaseTime != tt.leaseTime {
+			t.Errorf("%q parsed to %s %s %s", tt.dhcpRange, start, end, leaseTime)
+		}
+	}
+
+	invalid := []string{
+		"", "192.168.27.100", "set:ap,192.168.27.100", "192.168.27.150,192.168.27.100",
+		"192.168.27.100,fd00::1", "a,b", "192.168.27.100,192.168.27.150,1y",
+		"192.168.27.100,192.168.27.150,0", "192.168.27.100,192.168.27.150,-1h",
+		"192.168.27.100,192.168.27.150,h", "192.168.27.100,192.168.27.150,99999999999999w",
+	}
+	for _, dhcpRange := range invalid {
+		if start, end, leaseTime, err := ParseRange(dhcpRange); err == nil {
+			t.Errorf("%q parsed to %s %s %s", dhcpRange, start, end, leaseTime)
+		}
+	}
+}
+
+func TestCleanHostname(t *testing.T) {
+	tests := map[string]string{
+		"pi":              "pi",
+		"Pi-Zero_2":       "Pi-Zero_2",
+		"pi\x00":          "pi",
+		"pi.local":        "pi",
+		"":                "",
+		".local":          "",
+		"with space":      "",
+		"pi\n0 aa:bb 1 *": "",
+		"café":            "",
+	}
+	tests[strings.Repeat("a", 63)] = strings.Repeat("a", 63)
+	tests[strings.Repeat("a", 64)] = ""
+
+	for option, want := range tests {
+		if name := cleanHostname([]byte(option)); name != want {
+			t.Errorf("%q cleaned to %q, want %q", option, name, want)
+		}
+	}
+}
+
+const (
+	mac1     = "b8:27:eb:00:00:01"
+	mac2     = "b8:27:eb:00:00:02"
+	mac3     = "b8:27:eb:00:00:03"
+	reserved = "b8:27:eb:00:00:0a"
+)
+
+// testServer serves 192.168.27.100-102 from 192.168.27.1, with a
+// reservation of 192.168.27.10.
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(ServerConfig{
+		Iface:        "uap0",
+		ServerIP:     net.ParseIP("192.168.27.1"),
+		Start:        net.ParseIP("192.168.27.100"),
+		End:          net.ParseIP("192.168.27.102"),
+		LeaseTime:    time.Hour,
+		LeaseFile:    filepath.Join(t.TempDir(), "dnsmasq.leases"),
+		Reservations: []Reservation{{Mac: reserved, Ip: "192.168.27.10"}},
+	}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// request is a request of type msgType from mac with options.
+func request(mac string, msgType byte, options map[byte][]byte) *Packet {
+	hw, _ := net.ParseMAC(mac)
+	p := &Packet{
+		Op:      1,
+		XID:     42,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  hw,
+		Options: map[byte][]byte{optMessageType: {msgType}},
+	}
+	for code, value := range options {
+		p.Options[code] = value
+	}
+
+	return p
+}
+
+var serverID = []byte{192, 168, 27, 1}
+
+// handle passes req through the wire, as Run does, and checks the type
+// of the reply and the address handed out.
+func handle(t *testing.T, s *Server, req *Packet, msgType byte, ip string) (*Packet, *net.UDPAddr) {
+	t.Helper()
+	parsed, err := ParsePacket(req.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, dst := s.Handle(parsed)
+	if msgType == 0 {
+		if reply != nil {
+			t.Fatalf("replied %+v", reply)
+		}
+		return nil, nil
+	}
+	if reply == nil {
+		t.Fatalf("no reply, want %d", msgType)
+	}
+	if reply.MessageType() != msgType || reply.Op != 2 || reply.XID != req.XID {
+		t.Fatalf("reply %+v, want type %d", reply, msgType)
+	}
+	if ip != "" && reply.YIAddr.String() != ip {
+		t.Fatalf("handed out %s, want %s", reply.YIAddr, ip)
+	}
+
+	return reply, dst
+}
+
+func TestServer(t *testing.T) {
+	s := testServer(t)
+
+	// discover and request
+	offer, dst := handle(t, s, request(mac1, Discover, nil), Offer, "192.168.27.100")
+	if dst.String() != "255.255.255.255:68" {
+		t.Errorf("offered to %s", dst)
+	}
+	wantOptions := map[byte][]byte{
+		optMessageType: {Offer},
+		optServerID:    serverID,
+		optSubnetMask:  {255, 255, 255, 0},
+		optRouter:      serverID,
+		optDNS:         serverID,
+		optBroadcast:   {192, 168, 27, 255},
+		optLeaseTime:   be32(3600),
+		optRenewal:     be32(1800),
+		optRebinding:   be32(3150),
+	}
+	if !reflect.DeepEqual(offer.Options, wantOptions) {
+		t.Errorf("offered %v, want %v", offer.Options, wantOptions)
+	}
+	handle(t, s, request(mac1, Discover, nil), Offer, "192.168.27.100")
+	handle(t, s, request(mac2, Discover, nil), Offer, "192.168.27.101")
+
+	handle(t, s, request(mac1, Request, map[byte][]byte{
+		optRequestedIP: {192, 168, 27, 100},
+		optServerID:    serverID,
+		optHostname:    []byte("pi\x00"),
+		optClientID:    {1, 0xb8, 0x27},
+	}), Ack, "192.168.27.100")
+	if ip := s.Lookup("PI"); !ip.Equal(net.ParseIP("192.168.27.100")) {
+		t.Errorf("pi looked up to %s", ip)
+	}
+	leases, err := ReadLeases(s.Config.LeaseFile)
+	if err != nil || len(leases) != 1 || leases[0].Mac != mac1 || leases[0].Hostname != "pi" || leases[0].ClientId != "01:b8:27" || leases[0].Expiry.IsZero() {
+		t.Errorf("leases %+v, %v", leases, err)
+	}
+
+	// the lease is kept across restarts
+	s, err = NewServer(s.Config, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle(t, s, request(mac1, Discover, nil), Offer, "192.168.27.100")
+
+	// renewing, the client unicasts from its address
+	renew := request(mac1, Request, nil)
+	renew.CIAddr = net.ParseIP("192.168.27.100")
+	if _, dst := handle(t, s, renew, Ack, "192.168.27.100"); dst.String() != "192.168.27.100:68" {
+		t.Errorf("acked to %s", dst)
+	}
+
+	// the address of another client
+	nak, dst := handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 100}}), Nak, "0.0.0.0")
+	if _, ok := nak.Options[optRouter]; ok || dst.String() != "255.255.255.255:68" {
+		t.Errorf("nak %v to %s", nak.Options, dst)
+	}
+	handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 200}}), Nak, "")
+	handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 1}}), Nak, "")
+	handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27}}), Nak, "")
+
+	// the offer of another server taken
+	handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 101}, optServerID: {192, 168, 27, 2}}), 0, "")
+	handle(t, s, request(mac3, Discover, map[byte][]byte{optRequestedIP: {192, 168, 27, 101}}), Offer, "192.168.27.101")
+
+	// the reserved address, and no other
+	handle(t, s, request(reserved, Discover, nil), Offer, "192.168.27.10")
+	handle(t, s, request(reserved, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 102}}), Nak, "")
+	handle(t, s, request(reserved, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 10}}), Ack, "192.168.27.10")
+
+	// the range exhausted, an address declined
+	handle(t, s, request(mac2, Discover, nil), Offer, "192.168.27.102")
+	handle(t, s, request(mac2, Decline, map[byte][]byte{optRequestedIP: {192, 168, 27, 102}}), 0, "")
+	handle(t, s, request(mac2, Discover, nil), 0, "")
+	handle(t, s, request(mac2, Decline, map[byte][]byte{optRequestedIP: {10, 0, 0, 1}}), 0, "")
+	if len(s.declined) != 1 {
+		t.Errorf("declined %v", s.declined)
+	}
+
+	// released
+	release := request(mac1, Release, nil)
+	release.CIAddr = net.ParseIP("192.168.27.100")
+	handle(t, s, release, 0, "")
+	handle(t, s, request(mac2, Discover, nil), Offer, "192.168.27.100")
+	if ip := s.Lookup("pi"); ip != nil {
+		t.Errorf("released pi looked up to %s", ip)
+	}
+
+	// inform, of a host configured by hand
+	inform := request(mac3, Inform, nil)
+	inform.CIAddr = net.ParseIP("192.168.27.50")
+	ack, dst := handle(t, s, inform, Ack, "0.0.0.0")
+	if _, ok := ack.Options[optLeaseTime]; ok || !ack.CIAddr.Equal(inform.CIAddr) || dst.String() != "192.168.27.50:68" {
+		t.Errorf("informed %+v to %s", ack, dst)
+	}
+
+	// relayed
+	relayed := request(mac3, Discover, nil)
+	relayed.GIAddr = net.ParseIP("10.0.0.1")
+	if reply, dst := handle(t, s, relayed, Offer, "192.168.27.101"); dst.String() != "10.0.0.1:67" || !reply.GIAddr.Equal(relayed.GIAddr) {
+		t.Errorf("relayed %+v to %s", reply, dst)
+	}
+}
+
+func TestServerLeaseFile(t *testing.T) {
+	s := testServer(t)
+
+	handle(t, s, request(mac1, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 100}, optHostname: []byte("pi\n0 " + mac2 + " 192.168.27.101 x *")}), Ack, "192.168.27.100")
+	leases, err := ReadLeases(s.Config.LeaseFile)
+	if err != nil || len(leases) != 1 || leases[0].Hostname != "" {
+		t.Fatalf("leases %+v, %v", leases, err)
+	}
+
+	// a lease revoked in the file is forgotten
+	if err := RemoveLease(s.Config.LeaseFile, mac1); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(s.Config.LeaseFile, later, later)
+	handle(t, s, request(mac2, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 100}}), Ack, "192.168.27.100")
+
+	// expired leases are not read
+	past := time.Now().Add(-time.Minute)
+	if err := WriteLeases(s.Config.LeaseFile, []Lease{{Expiry: past, Mac: mac3, Ip: "192.168.27.102"}}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewServer(s.Config, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.leases) != 0 {
+		t.Errorf("leases %+v", s.leases)
+	}
+}
+
+func TestServerExpire(t *testing.T) {
+	s := testServer(t)
+
+	past := time.Now().Add(-time.Second)
+	s.offers[mac1] = offer{ip: "192.168.27.100", until: past}
+	s.offers[mac2] = offer{ip: "192.168.27.101", until: time.Now().Add(time.Minute)}
+	s.declined["192.168.27.102"] = past
+
+	handle(t, s, request(mac3, Discover, nil), Offer, "192.168.27.100")
+	if _, ok := s.offers[mac1]; ok || len(s.offers) != 2 || len(s.declined) != 0 {
+		t.Errorf("offers %v, declined %v", s.offers, s.declined)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	if _, err := NewServer(ServerConfig{ServerIP: net.ParseIP("fd00::1"), Start: net.ParseIP("10.0.0.1"), End: net.ParseIP("10.0.0.2")}, nopLogger{}); err == nil {
+		t.Error("served from an IPv6 address")
+	}
+}
+
+func FuzzHandle(f *testing.F) {
+	f.Add(request(mac1, Discover, map[byte][]byte{optRequestedIP: {192, 168, 27, 101}}).Marshal())
+	f.Add(request(mac1, Request, map[byte][]byte{optRequestedIP: {192, 168, 27, 100}, optHostname: []byte("pi")}).Marshal())
+	f.Add(request(mac1, Decline, map[byte][]byte{optRequestedIP: {192, 168, 27, 100}}).Marshal())
+	f.Add(request(reserved, Inform, nil).Marshal())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := ParsePacket(b)
+		if err != nil {
+			return
+		}
+
+		s := testServer(t)
+		reply, dst := s.Handle(req)
+		if reply == nil {
+			return
+		}
+		if dst == nil {
+			t.Fatalf("reply %+v to nowhere", reply)
+		}
+		if _, err := ParsePacket(reply.Marshal()); err != nil {
+			t.Fatalf("reply %+v unparseable: %s", reply, err)
+		}
+		if ip := reply.YIAddr.To4(); reply.MessageType() != Nak && !ip.Equal(net.IPv4zero) && !s.available(req.CHAddr.String(), ip) && ip.String() != "192.168.27.10" {
+			t.Fatalf("handed out %s", ip)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package iotwifi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// diagnosticsTimeout bounds each command of the bundle, so one hung tool
+// does not hold up the rest.
+const diagnosticsTimeout = 5 * time.Second
+
+// dmesgWifiR matches the kernel messages of the wifi drivers and stack.
+var dmesgWifiR = regexp.MustCompile(`(?i)wlan|wlp|80211|cfg80211|brcmf|ath[0-9k]|rtl|rtw|iwl|mt76|mwifiex|wifi|firmware`)
+
+// DiagnosticsOutput is the output of one command of the bundle.
+type DiagnosticsOutput struct {
+	Name   string `json:"name"`   // iw dev wlan0 link
+	Output string `json:"output"` // with the secrets redacted
+	Error  string `json:"error,omitempty"`
+}
+
+// DriverInfo is the driver and firmware of a wifi interface.
+type DriverInfo struct {
+	Iface    string `json:"iface"`
+	Driver   string `json:"driver"`   // brcmfmac
+	Version  string `json:"version"`  // of the driver, often the kernel's
+	Firmware string `json:"firmware"` // 01-6cb8e269, empty if the driver does not say
+	Error    string `json:"error,omitempty"`
+}
+
+// Diagnostics is everything a support ticket needs about the wifi, in
+// one bundle.
+type Diagnostics struct {
+	Time     time.Time           `json:"time"`
+	Version  string              `json:"version"` // of txwifi
+	Device   string              `json:"device"`  // the device_id of the Identity
+	Commands []DiagnosticsOutput `json:"commands"`
+	Drivers  []DriverInfo        `json:"drivers"`
+	Leases   string              `json:"leases"` // the dnsmasq lease file
+	Dmesg    []string            `json:"dmesg"`  // the kernel messages about the wifi
+	Logs     []LogEntry          `json:"logs"`   // the recent entries of the txwifi log
+}
+
+// Diagnostics collects the state of the wifi interfaces, wpa_supplicant,
+// hostapd and dnsmasq, the kernel messages of the drivers and logs. Failures are recorded in the bundle rather than
+// returned, so it always holds what could be collected.
+func (wpa *WpaCfg) Diagnostics(ctx context.Context, logs []LogEntry) Diagnostics {
+	cfg := wpa.Cfg()
+	diag := Diagnostics{
+		Time:     time.Now().UTC(),
+		Commands: []DiagnosticsOutput{},
+		Drivers:  []DriverInfo{},
+		Dmesg:    []string{},
+		Logs:     logs,
+	}
+	if diag.Logs == nil {
+		diag.Logs = []LogEntry{}
+	}
+
+	if identity, err := wpa.Identity(); err == nil {
+		diag.Device = identity.DeviceId
+	}
+
+	ifaces := wpa.stationInterfaces()
+	if !contains(ifaces, cfg.APInterface) {
+		ifaces = append(ifaces, cfg.APInterface)
+	}
+
+	diag.Commands = append(diag.Commands, wpa.diagnosticsCommand(ctx, "iw", "dev"))
+	for _, iface := range ifaces {
+		diag.Commands = append(diag.Commands,
+			wpa.diagnosticsCommand(ctx, "iw", "dev", iface, "info"),
+			wpa.diagnosticsCommand(ctx, "iw", "dev", iface, "link"),
+			wpa.diagnosticsCommand(ctx, "iw", "dev", iface, "station", "dump"),
+		)
+		diag.Drivers = append(diag.Drivers, wpa.driverInfo(ctx, iface))
+	}
+	diag.Commands = append(diag.Commands, wpa.diagnosticsCommand(ctx, "iw", "reg", "get"))
+
+	if !cfg.NetworkManager.Enabled {
+		for _, iface := range wpa.stationInterfaces() {
+			diag.Commands = append(diag.Commands, wpa.diagnosticsRequest(ctx, iface, "STATUS"))
+		}
+	}
+	diag.Commands = append(diag.Commands, wpa.diagnosticsCommand(ctx, "hostapd_cli", "-i", cfg.APInterface, "status"))
+
+	if leases, err := ioutil.ReadFile(wpa.leaseFile()); err == nil {
+		diag.Leases = string(leases)
+	} else if !os.IsNotExist(err) {
+		diag.Leases = err.Error()
+	}
+
+	dmesg := wpa.diagnosticsCommand(ctx, "dmesg")
+	if dmesg.Error != "" {
+		diag.Commands = append(diag.Commands, DiagnosticsOutput{Name: dmesg.Name, Error: dmesg.Error})
+	}
+	for _, line := range strings.Split(dmesg.Output, "\n") {
+		if dmesgWifiR.MatchString(line) {
+			diag.Dmesg = append(diag.Dmesg, line)
+		}
+	}
+
+	return diag
+}
+
+// diagnosticsCommand runs name with args for the bundle.
+func (wpa *WpaCfg) diagnosticsCommand(ctx context.Context, name string, args ...string) DiagnosticsOutput {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+
+	out, err := wpa.Runner.Output(ctx, name, args...)
+
+	return diagnosticsOutput(strings.Join(append([]string{name}, args...), " "), out, err)
+}
+
+// diagnosticsRequest sends cmd to the wpa_supplicant of iface for the
+// bundle.
+func (wpa *WpaCfg) diagnosticsRequest(ctx context.Context, iface string, cmd string) DiagnosticsOutput {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+
+	out, err := wpa.Runner.Request(ctx, iface, cmd)
+
+	return diagnosticsOutput("wpa_cli -i "+iface+" "+strings.ToLower(cmd), out, err)
+}
+
+// diagnosticsOutput redacts the secrets from the output and error of a
+// command.
+func diagnosticsOutput(name string, out []byte, err error) DiagnosticsOutput {
+	output := DiagnosticsOutput{Name: name, Output: secrets.scrub(string(out))}
+	if err != nil {
+		output.Error = secrets.scrub(err.Error())
+	}
+
+	return output
+}
+
+// driverInfo returns the driver and firmware of iface from ethtool. When
+// ethtool is missing only the driver is known, from sysfs.
+func (wpa *WpaCfg) driverInfo(ctx context.Context, iface string) DriverInfo {
+	info := DriverInfo{Iface: iface}
+
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+
+	out, err := wpa.Runner.Output(ctx, "ethtool", "-i", iface)
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value := strings.TrimSpace(parts[1])
+			switch strings.TrimSpace(parts[0]) {
+			case "driver":
+				info.Driver = value
+			case "version":
+				info.Version = value
+			case "firmware-version":
+				info.Firmware = value
+			}
+		}
+		return info
+	}
+
+	driver, lerr := os.Readlink(filepath.Join("/sys/class/net", iface, "device", "driver"))
+	if lerr != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Driver = filepath.Base(driver)
+
+	return info
+}
+
+// WriteTar writes the bundle as a gzipped tar: diagnostics.json with
+// all of it, and a text file per command, the leases, the kernel
+// messages and the log, for reading without tools.
+func (d Diagnostics) WriteTar(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	all, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	type file struct {
+		name string
+		data []byte
+	}
+	files := []file{
+		{"diagnostics.json", all},
+		{"leases.txt", []byte(d.Leases)},
+		{"dmesg.txt", []byte(strings.Join(d.Dmesg, "\n"))},
+	}
+
+	logs := &bytes.Buffer{}
+	enc := json.NewEncoder(logs)
+	for _, entry := range d.Logs {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	files = append(files, file{"txwifi.log", logs.Bytes()})
+
+	for _, cmd := range d.Commands {
+		data := cmd.Output
+		if cmd.Error != "" {
+			data += "\nerror: " + cmd.Error + "\n"
+		}
+		name := "commands/" + strings.Join(strings.Fields(cmd.Name), "_") + ".txt"
+		files = append(files, file{name, []byte(data)})
+	}
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    "txwifi-diagnostics/" + f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: d.Time,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
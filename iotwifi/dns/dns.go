@@ -0,0 +1,344 @@
+// Package dns is a stub DNS responder for the AP, a replacement of the
+// DNS part of dnsmasq: it answers the names it has addresses for, the
+// --address rules and the hostnames of DHCP clients, and forwards the
+// rest upstream or refuses them.
+
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port is the DNS port.
+const Port = 53
+
+// Record types and the class the Server answers.
+const (
+	TypeA    = 1
+	TypeAAAA = 28
+	ClassIN  = 1
+)
+
+// Response codes.
+const (
+	RcodeNoError  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeRefused  = 5
+)
+
+// forwardTimeout bounds a query forwarded upstream.
+const forwardTimeout = 3 * time.Second
+
+// ErrMalformed is returned for packets that are not DNS queries.
+var ErrMalformed = errors.New("malformed dns message")
+
+// Logger is the logging interface of the Server, iotwifi.Logger's.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Rule answers the names of Domain, and the names under it, with IP, as
+// the dnsmasq --address=/domain/ip option. Domain # matches every name.
+type Rule struct {
+	Domain string
+	IP     net.IP
+}
+
+// Matches reports whether name is answered by r.
+func (r Rule) Matches(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain := strings.ToLower(strings.Trim(r.Domain, "."))
+
+	return domain == "#" || name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// ParseAddress parses a dnsmasq --address value, "/#/192.168.27.1" or
+// "/example.com/example.org/192.168.27.1", into rules.
+func ParseAddress(address string) ([]Rule, error) {
+	parts := strings.Split(strings.TrimPrefix(address, "/"), "/")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid address %q, want /domain/ip", address)
+	}
+
+	ip := net.ParseIP(parts[len(parts)-1])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q: no ip", address)
+	}
+
+	rules := []Rule{}
+	for _, domain := range parts[:len(parts)-1] {
+		if domain == "" {
+			return nil, fmt.Errorf("invalid address %q: empty domain", address)
+		}
+		rules = append(rules, Rule{Domain: domain, IP: ip})
+	}
+
+	return rules, nil
+}
+
+// ResolvConfServers returns the nameservers of a resolv.conf, leaving out
+// those in skip.
+func ResolvConfServers(path string, skip ...string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	servers := []string{}
+	scanner := bufio.NewScanner(f)
+lines:
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" || net.ParseIP(fields[1]) == nil {
+			continue
+		}
+		for _, s := range skip {
+			if fields[1] == s {
+				continue lines
+			}
+		}
+		servers = append(servers, fields[1])
+	}
+
+	return servers, scanner.Err()
+}
+
+// Question is the question of a query.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// ParseQuery parses the header and the first question of a query,
+// returning the question and the length of the message up to its end.
+func ParseQuery(b []byte) (Question, int, error) {
+	if len(b) < 12 {
+		return Question{}, 0, ErrMalformed
+	}
+	if b[2]&0x80 != 0 || binary.BigEndian.Uint16(b[4:]) == 0 {
+		return Question{}, 0, fmt.Errorf("%w: not a query", ErrMalformed)
+	}
+
+	labels := []string{}
+	i := 12
+	for {
+		if i >= len(b) {
+			return Question{}, 0, fmt.Errorf("%w: name overruns the message", ErrMalformed)
+		}
+		n := int(b[i])
+		if n == 0 {
+			i++
+			break
+		}
+		if n&0xc0 != 0 || i+1+n > len(b) {
+			return Question{}, 0, fmt.Errorf("%w: bad label", ErrMalformed)
+		}
+		labels = append(labels, string(b[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+4 > len(b) {
+		return Question{}, 0, fmt.Errorf("%w: question overruns the message", ErrMalformed)
+	}
+
+	q := Question{
+		Name:  strings.Join(labels, "."),
+		Type:  binary.BigEndian.Uint16(b[i:]),
+		Class: binary.BigEndian.Uint16(b[i+2:]),
+	}
+
+	return q, i + 4, nil
+}
+
+// Server answers DNS queries over UDP.
+type Server struct {
+	Addr     string                       // 192.168.27.1:53
+	Iface    string                       // for the logs
+	Rules    []Rule                       // answered first
+	Lookup   func(hostname string) net.IP // the hosts known by name, nil for none
+	Upstream func() []string              // the servers to forward to, none refuses the query
+	Log      Logger
+}
+
+// Run serves queries on Addr until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	s.Log.Info("dns server listening", "iface", s.Iface, "addr", s.Addr)
+
+	buf := make([]byte, 1500)
+	for {
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := pc.ReadFrom(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if reply := s.Answer(ctx, query); reply != nil {
+				pc.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// Answer answers query, nil if it is not worth an answer.
+func (s *Server) Answer(ctx context.Context, query []byte) []byte {
+	q, end, err := ParseQuery(query)
+	if err != nil {
+		if len(query) >= 12 && query[2]&0x80 == 0 {
+			return reply(query[:12], RcodeFormErr, nil, nil)
+		}
+		return nil
+	}
+	question := query[12:end]
+
+	if ip := s.resolve(q.Name); ip != nil && q.Class == ClassIN {
+		s.Log.Debug("dns query", "iface", s.Iface, "name", q.Name, "type", q.Type, "answer", ip.String())
+		switch {
+		case q.Type == TypeA && ip.To4() != nil:
+			return reply(query[:12], RcodeNoError, question, answer(TypeA, ip.To4()))
+		case q.Type == TypeAAAA && ip.To4() == nil:
+			return reply(query[:12], RcodeNoError, question, answer(TypeAAAA, ip.To16()))
+		default:
+			// the name exists, without records of the type
+			return reply(query[:12], RcodeNoError, question, nil)
+		}
+	}
+
+	var servers []string
+	if s.Upstream != nil {
+		servers = s.Upstream()
+	}
+	if len(servers) == 0 {
+		s.Log.Debug("dns query refused", "iface", s.Iface, "name", q.Name, "type", q.Type)
+		return reply(query[:12], RcodeRefused, question, nil)
+	}
+
+	for _, server := range servers {
+		resp, err := forward(ctx, net.JoinHostPort(server, strconv.Itoa(Port)), query)
+		if err == nil {
+			s.Log.Debug("dns query forwarded", "iface", s.Iface, "name", q.Name, "type", q.Type, "server", server)
+			return resp
+		}
+		s.Log.Warn("dns forward failed", "iface", s.Iface, "name", q.Name, "server", server, "error", err)
+	}
+
+	return reply(query[:12], RcodeServFail, question, nil)
+}
+
+// resolve returns the address of name from the rules, or of the host
+// named name.
+func (s *Server) resolve(name string) net.IP {
+	for _, rule := range s.Rules {
+		if rule.Matches(name) {
+			return rule.IP
+		}
+	}
+
+	// hosts are known by their bare names
+	if s.Lookup != nil && name != "" && !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		return s.Lookup(strings.TrimSuffix(name, "."))
+	}
+
+	return nil
+}
+
+// forward sends query to server and returns its answer.
+func forward(ctx context.Context, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// a late answer to an earlier query is not this one's
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// reply builds a response with the header of the query, its question
+// and an answer record.
+func reply(header []byte, rcode byte, question []byte, answer []byte) []byte {
+	b := append([]byte{}, header...)
+	b[2] = 0x80 | b[2]&0x79 // QR, the opcode and RD of the query, not authoritative
+	b[3] = 0x80 | rcode     // RA
+	qdcount, ancount := 0, 0
+	if question != nil {
+		qdcount = 1
+	}
+	if answer != nil {
+		ancount = 1
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(qdcount))
+	binary.BigEndian.PutUint16(b[6:], uint16(ancount))
+	binary.BigEndian.PutUint32(b[8:], 0)
+
+	return append(append(b, question...), answer...)
+}
+
+// answer builds a record for the name of the question, not cached by
+// the clients, as dnsmasq's local answers.
+func answer(recordType uint16, data []byte) []byte {
+	b := []byte{0xc0, 12} // the name of the question
+	b = append(b, byte(recordType>>8), byte(recordType), 0, ClassIN)
+	b = append(b, 0, 0, 0, 0) // ttl
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+
+	return append(b, data...)
+}
+
+// Ping asks the server at addr for a name and waits for any answer.
+func Ping(ctx context.Context, addr string) error {
+	query := []byte{0x7a, 0x77, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, 6, 't', 'x', 'w', 'i', 'f', 'i', 0, 0, TypeA, 0, ClassIN)
+
+	_, err := forward(ctx, addr, query)
+	return err
+}
@@ -0,0 +1,301 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopLogger discards the logs of the Server.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (nopLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+// query builds a recursive query of id for name.
+func query(id uint16, name string, qtype uint16) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		if label != "" {
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+
+	return append(b, 0, byte(qtype>>8), byte(qtype), 0, ClassIN)
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query []byte
+		q     Question
+		end   int
+	}{
+		{query(1, "captive.portal", TypeA), Question{Name: "captive.portal", Type: TypeA, Class: ClassIN}, 32},
+		{query(1, "", TypeAAAA), Question{Name: "", Type: TypeAAAA, Class: ClassIN}, 17},
+		{append(query(1, "pi", TypeA), 0, 0, 41), Question{Name: "pi", Type: TypeA, Class: ClassIN}, 20},
+	}
+
+	for _, tt := range tests {
+		q, end, err := ParseQuery(tt.query)
+		if err != nil || q != tt.q || end != tt.end {
+			t.Errorf("% x parsed to %+v %d, %v", tt.query, q, end, err)
+		}
+	}
+
+	response := query(1, "pi", TypeA)
+	response[2] |= 0x80
+	noQuestion := query(1, "pi", TypeA)
+	noQuestion[5] = 0
+	pointer := append(query(1, "", TypeA)[:12], 0xc0, 12, 0, 1, 0, 1)
+
+	invalid := map[string][]byte{
+		"empty":             {},
+		"header":            query(1, "pi", TypeA)[:11],
+		"response":          response,
+		"no question":       noQuestion,
+		"name overrun":      query(1, "pi", TypeA)[:13],
+		"label overrun":     query(1, "pi", TypeA)[:14],
+		"unterminated name": query(1, "pi", TypeA)[:15],
+		"question overrun":  query(1, "pi", TypeA)[:19],
+		"pointer":           pointer,
+	}
+	for name, b := range invalid {
+		if q, _, err := ParseQuery(b); err == nil {
+			t.Errorf("%s: parsed %+v", name, q)
+		}
+	}
+}
+
+func TestRule(t *testing.T) {
+	rules, err := ParseAddress("/captive.portal/Example.COM./192.168.27.1")
+	want := []Rule{{Domain: "captive.portal", IP: net.ParseIP("192.168.27.1")}, {Domain: "Example.COM.", IP: net.ParseIP("192.168.27.1")}}
+	if err != nil || !reflect.DeepEqual(rules, want) {
+		t.Fatalf("parsed %+v, %v", rules, err)
+	}
+
+	matches := map[string]bool{
+		"captive.portal":      true,
+		"CAPTIVE.portal.":     true,
+		"www.captive.portal":  true,
+		"xcaptive.portal":     false,
+		"portal":              false,
+		"example.com":         true,
+		"a.b.example.com.":    true,
+		"example.com.evil.io": false,
+	}
+	for name, want := range matches {
+		if matched := rules[0].Matches(name) || rules[1].Matches(name); matched != want {
+			t.Errorf("%s matched %v, want %v", name, matched, want)
+		}
+	}
+
+	all, err := ParseAddress("/#/fd00::1")
+	if err != nil || len(all) != 1 || !all[0].Matches("anything.at.all") || !all[0].IP.Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("parsed %+v, %v", all, err)
+	}
+
+	for _, address := range []string{"", "192.168.27.1", "/captive.portal/", "/captive.portal/x", "//192.168.27.1", "/a//192.168.27.1"} {
+		if rules, err := ParseAddress(address); err == nil {
+			t.Errorf("%q parsed to %+v", address, rules)
+		}
+	}
+}
+
+func TestResolvConfServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	content := "# generated\nsearch lan\nnameserver 192.168.1.1\nnameserver 192.168.27.1\nnameserver fd00::53\nnameserver\nnameserver bogus\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := ResolvConfServers(path, "192.168.27.1")
+	if want := []string{"192.168.1.1", "fd00::53"}; err != nil || !reflect.DeepEqual(servers, want) {
+		t.Errorf("servers %q, %v", servers, err)
+	}
+	if _, err := ResolvConfServers(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("read a missing file")
+	}
+}
+
+// testServer answers captive.portal and v6.test by rules and pi by
+// lookup, without upstream servers.
+func testServer() *Server {
+	return &Server{
+		Iface: "uap0",
+		Rules: []Rule{
+			{Domain: "captive.portal", IP: net.ParseIP("192.168.27.1")},
+			{Domain: "v6.test", IP: net.ParseIP("fd00::1")},
+		},
+		Lookup: func(hostname string) net.IP {
+			if strings.EqualFold(hostname, "pi") {
+				return net.ParseIP("192.168.27.100")
+			}
+			return nil
+		},
+		Log: nopLogger{},
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	s := testServer()
+
+	tests := []struct {
+		name   string
+		query  []byte
+		rcode  byte
+		answer []byte // the record data
+	}{
+		{"rule", query(0x1234, "captive.portal", TypeA), RcodeNoError, []byte{192, 168, 27, 1}},
+		{"under a rule", query(0x1234, "www.Captive.Portal", TypeA), RcodeNoError, []byte{192, 168, 27, 1}},
+		{"no AAAA", query(0x1234, "captive.portal", TypeAAAA), RcodeNoError, nil},
+		{"AAAA", query(0x1234, "v6.test", TypeAAAA), RcodeNoError, net.ParseIP("fd00::1")},
+		{"no A", query(0x1234, "v6.test", TypeA), RcodeNoError, nil},
+		{"host", query(0x1234, "pi", TypeA), RcodeNoError, []byte{192, 168, 27, 100}},
+		{"host with a domain", query(0x1234, "pi.lan", TypeA), RcodeRefused, nil},
+		{"unknown", query(0x1234, "example.com", TypeA), RcodeRefused, nil},
+		{"unknown host", query(0x1234, "nas", TypeA), RcodeRefused, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := s.Answer(context.Background(), tt.query)
+			_, end, _ := ParseQuery(tt.query)
+
+			header := []byte{0x12, 0x34, 0x81, 0x80 | tt.rcode, 0, 1, 0, 0, 0, 0, 0, 0}
+			if tt.answer != nil {
+				header[7] = 1
+			}
+			want := append(header, tt.query[12:end]...)
+			if tt.answer != nil {
+				rtype := TypeA
+				if len(tt.answer) == 16 {
+					rtype = TypeAAAA
+				}
+				want = append(want, 0xc0, 12, 0, byte(rtype), 0, ClassIN, 0, 0, 0, 0, 0, byte(len(tt.answer)))
+				want = append(want, tt.answer...)
+			}
+			if !bytes.Equal(reply, want) {
+				t.Errorf("answered % x, want % x", reply, want)
+			}
+		})
+	}
+
+	malformed := query(0x1234, "pi", TypeA)[:15]
+	if reply := s.Answer(context.Background(), malformed); !bytes.Equal(reply, []byte{0x12, 0x34, 0x81, 0x80 | RcodeFormErr, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("malformed query answered % x", reply)
+	}
+	response := query(0x1234, "pi", TypeA)
+	response[2] |= 0x80
+	if reply := s.Answer(context.Background(), response); reply != nil {
+		t.Errorf("response answered % x", reply)
+	}
+	if reply := s.Answer(context.Background(), []byte{1, 2, 3}); reply != nil {
+		t.Errorf("short message answered % x", reply)
+	}
+}
+
+// upstream serves one query on 127.0.0.1, answering first with a stale
+// answer and then with answer.
+func upstream(t *testing.T, answer func(query []byte) []byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		stale := append([]byte{}, buf[:n]...)
+		stale[0]++
+		pc.WriteTo(stale, addr)
+		pc.WriteTo(answer(buf[:n]), addr)
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestForward(t *testing.T) {
+	q := query(0x4242, "example.com", TypeA)
+	addr := upstream(t, func(query []byte) []byte {
+		return reply(query[:12], RcodeNoError, query[12:], answer(TypeA, []byte{93, 184, 216, 34}))
+	})
+
+	resp, err := forward(context.Background(), addr, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp[:2], q[:2]) || binary.BigEndian.Uint16(resp[6:]) != 1 || !bytes.HasSuffix(resp, []byte{93, 184, 216, 34}) {
+		t.Errorf("forwarded % x", resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	silent := upstream(t, func(query []byte) []byte { return nil })
+	if _, err := forward(ctx, silent, q); err == nil {
+		t.Error("forwarded to a server not answering")
+	}
+}
+
+func TestPing(t *testing.T) {
+	addr := upstream(t, func(query []byte) []byte {
+		if q, _, err := ParseQuery(query); err != nil || q.Name != "txwifi" {
+			t.Errorf("pinged with %+v, %v", q, err)
+		}
+		return reply(query[:12], RcodeRefused, nil, nil)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Ping(ctx, addr); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzAnswer(f *testing.F) {
+	f.Add(query(1, "captive.portal", TypeA))
+	f.Add(query(2, "v6.test", TypeAAAA))
+	f.Add(query(3, "pi", TypeA))
+	f.Add(append(query(4, "example.com", 255), 0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0))
+
+	s := testServer()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		reply := s.Answer(context.Background(), b)
+		if reply == nil {
+			return
+		}
+
+		if len(reply) < 12 || !bytes.Equal(reply[:2], b[:2]) || reply[2]&0x80 == 0 {
+			t.Fatalf("% x answered % x", b, reply)
+		}
+		// the records counted are there
+		qdcount, ancount := binary.BigEndian.Uint16(reply[4:]), binary.BigEndian.Uint16(reply[6:])
+		size := 12
+		if qdcount == 1 {
+			_, end, err := ParseQuery(b)
+			if err != nil {
+				t.Fatalf("% x answered with its question: %s", b, err)
+			}
+			size = end
+		}
+		if ancount == 1 {
+			size += 12 + int(binary.BigEndian.Uint16(reply[size+10:]))
+		}
+		if len(reply) != size || qdcount > 1 || ancount > 1 {
+			t.Fatalf("% x answered % x", b, reply)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package iotwifi
+
+import "errors"
+
+// Errors returned (wrapped) by WpaCfg methods. Use errors.Is to test for them.
+var (
+	ErrConfig          = errors.New("could not load config")
+	ErrInvalid         = errors.New("invalid request")
+	ErrStatusFailed    = errors.New("status failed")
+	ErrAPStatusFailed  = errors.New("ap status failed")
+	ErrScanFailed      = errors.New("scan failed")
+	ErrConnectFailed   = errors.New("connect failed")
+	ErrWrongPassword   = errors.New("wrong password")
+	ErrNetworkNotFound = errors.New("network not found")
+	ErrTimeout         = errors.New("timed out")
+	ErrNotConfigured   = errors.New("network not configured")
+	ErrCommandFailed   = errors.New("wpa_supplicant command failed")
+	ErrProfileNotFound = errors.New("profile not found")
+	ErrWpsFailed       = errors.New("wps failed")
+	ErrRateLimited     = errors.New("too many requests")
+	ErrLockedOut       = errors.New("locked out after repeated wrong passwords")
+
+	ErrUnknownInterface  = errors.New("unknown interface")
+	ErrNoFirewall        = errors.New("neither iptables nor nftables is available")
+	ErrRadioBlocked      = errors.New("radio blocked")
+	ErrP2PFailed         = errors.New("p2p failed")
+	ErrSpeedTestFailed   = errors.New("speed test failed")
+	ErrBusy              = errors.New("busy")
+	ErrOperationNotFound = errors.New("operation not found")
+)
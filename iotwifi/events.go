@@ -0,0 +1,298 @@
+package iotwifi
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// HostapdCtrlDir is the hostapd ctrl_interface directory, unless
+// HostApdCfg.CtrlDir says otherwise.
+const HostapdCtrlDir = "/var/run/hostapd"
+
+// Event types published on an EventBus.
+const (
+	EventScanComplete = "scan-complete"
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventClientJoined = "client-joined-ap"
+	EventClientLeft   = "client-left-ap"
+	EventAPEnabled    = "ap-enabled"
+	EventAPDisabled   = "ap-disabled"
+	EventEAPFailure   = "eap-failure"
+	EventAuthFailure  = "auth-failure"
+
+	EventChannelSwitched  = "channel-switched"   // the station's network moved to another channel
+	EventAPChannelChanged = "ap-channel-changed" // a site survey moved the AP to a less congested channel
+
+	EventComponentDown      = "component-down"
+	EventComponentRestarted = "component-restarted"
+
+	EventCaptivePortal = "captive-portal"
+
+	EventLinkDegraded   = "link-degraded"   // the station's signal or packet loss stayed poor
+	EventLinkRecovered  = "link-recovered"  // and is good again
+	EventWatchdogAction = "watchdog-action" // the watchdog roamed, scanned or reconnected
+
+	EventConnecting  = "connecting"            // a connect through the API started
+	EventProvisioned = "provisioning-complete" // a connect through the API succeeded
+	EventAPFallback  = "fell-back-to-ap"       // a connect through the API failed, the device is left on the setup AP
+
+	EventWatchedAppeared = "watched-ssid-appeared" // a scan found an SSID of the watchlist
+	EventWatchedGone     = "watched-ssid-gone"     // and scans stopped finding it
+
+	EventBootstrapped = "bootstrap-applied" // the networks of a setup file were saved
+	EventStateChanged = "state-changed"     // the provisioning state machine moved, Name is the new state
+
+	EventP2PDeviceFound  = "p2p-device-found"
+	EventP2PDeviceLost   = "p2p-device-lost"
+	EventP2PGroupStarted = "p2p-group-started"
+	EventP2PGroupRemoved = "p2p-group-removed"
+	EventP2PRequest      = "p2p-request" // a peer asks to pair
+	EventP2PFailure      = "p2p-failure"
+)
+
+// eventTypes maps wpa_supplicant and hostapd event names to Event types.
+var eventTypes = map[string]string{
+	"CTRL-EVENT-SCAN-RESULTS": EventScanComplete,
+	"CTRL-EVENT-CONNECTED":    EventConnected,
+	"CTRL-EVENT-DISCONNECTED": EventDisconnected,
+	"AP-STA-CONNECTED":        EventClientJoined,
+	"AP-STA-DISCONNECTED":     EventClientLeft,
+	"AP-ENABLED":              EventAPEnabled,
+	"AP-DISABLED":             EventAPDisabled,
+	"CTRL-EVENT-EAP-FAILURE":  EventEAPFailure,
+
+	"CTRL-EVENT-CHANNEL-SWITCH": EventChannelSwitched,
+
+	// a network disabled after failing to authenticate, wrong_key and the like
+	"CTRL-EVENT-SSID-TEMP-DISABLED": EventAuthFailure,
+
+	"P2P-DEVICE-FOUND":            EventP2PDeviceFound,
+	"P2P-DEVICE-LOST":             EventP2PDeviceLost,
+	"P2P-GROUP-STARTED":           EventP2PGroupStarted,
+	"P2P-GROUP-REMOVED":           EventP2PGroupRemoved,
+	"P2P-GO-NEG-REQUEST":          EventP2PRequest,
+	"P2P-PROV-DISC-PBC-REQ":       EventP2PRequest,
+	"P2P-PROV-DISC-SHOW-PIN":      EventP2PRequest,
+	"P2P-PROV-DISC-ENTER-PIN":     EventP2PRequest,
+	"P2P-GO-NEG-FAILURE":          EventP2PFailure,
+	"P2P-GROUP-FORMATION-FAILURE": EventP2PFailure,
+}
+
+// daemonEventPrefixes start the names of the events hostapd and
+// wpa_supplicant write to their output, among lines of mere logging.
+var daemonEventPrefixes = []string{"CTRL-EVENT-", "AP-", "WPS-", "EAPOL-", "DFS-", "ACS-", "P2P-"}
+
+// Event is a wifi state change pushed to subscribers.
+type Event struct {
+	Type    string    `json:"type"`
+	Source  string    `json:"source"`          // wpa_supplicant or hostapd
+	Iface   string    `json:"iface,omitempty"` // wlan0, the interface the event is from
+	Name    string    `json:"name"`            // raw event name, e.g. CTRL-EVENT-CONNECTED
+	Message string    `json:"message"`
+	Mac     string    `json:"mac,omitempty"` // the station of AP client events
+	Time    time.Time `json:"time"`
+}
+
+// EventBus fans events out to any number of subscribers.
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewEventBus produces an EventBus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel of events and a function to unsubscribe.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish sends ev to every subscriber. Slow subscribers miss events
+// rather than block the publisher.
+func (b *EventBus) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publish sends an event if there is a bus to send it on.
+func (wpa *WpaCfg) publish(ev Event) {
+	if wpa.Bus == nil {
+		return
+	}
+
+	wpa.Bus.Publish(ev)
+}
+
+// WatchEvents publishes wpa_supplicant and hostapd events to bus until
+// ctx is done. Either daemon may not be up yet, so each control socket
+// is redialed until it attaches. In output mode the events are parsed
+// from the output of the daemons txwifi runs instead, only the
+// wpa_supplicant of NetworkManager is watched. With Wi-Fi Direct the P2P
+// device of the station is watched too, when it has a socket of its own.
+func (wpa *WpaCfg) WatchEvents(ctx context.Context, bus *EventBus) {
+	if wpa.Cfg().Processes.Events == ProcessEventsOutput {
+		if wpa.Cfg().NetworkManager.Enabled {
+			go watchCtrl(ctx, bus, "wpa_supplicant", wpa.Cfg().StationInterface, filepath.Join(wpa.Cfg().WpaSupplicantCfg.ctrlDir(), wpa.Cfg().StationInterface))
+		}
+		return
+	}
+
+	go watchCtrl(ctx, bus, "wpa_supplicant", wpa.Cfg().StationInterface, filepath.Join(wpa.Cfg().WpaSupplicantCfg.ctrlDir(), wpa.Cfg().StationInterface))
+	go watchCtrl(ctx, bus, "hostapd", wpa.Cfg().APInterface, filepath.Join(wpa.Cfg().HostApdCfg.ctrlDir(), wpa.Cfg().APInterface))
+
+	if iface := wpa.p2pIface(); wpa.Cfg().P2P.Enabled && iface != wpa.Cfg().StationInterface {
+		go watchCtrl(ctx, bus, "wpa_supplicant", iface, filepath.Join(wpa.Cfg().WpaSupplicantCfg.ctrlDir(), iface))
+	}
+}
+
+// watchCtrl attaches to the control socket of iface and forwards its
+// events to bus.
+func watchCtrl(ctx context.Context, bus *EventBus, source string, iface string, path string) {
+	for {
+		conn, err := wpactl.Dial(path)
+		if err == nil {
+			events, err := conn.Attach()
+			if err == nil {
+				forwardEvents(ctx, bus, source, iface, events)
+			}
+			conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// forwardEvents copies events to bus until the connection drops or ctx is done.
+func forwardEvents(ctx context.Context, bus *EventBus, source string, iface string, events <-chan wpactl.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			bus.Publish(Event{
+				Type:    eventType(ev.Name),
+				Source:  source,
+				Iface:   iface,
+				Name:    ev.Name,
+				Message: ev.Message,
+				Mac:     eventMac(ev.Name, ev.Message),
+			})
+		}
+	}
+}
+
+// eventType returns the Event type of a wpa_supplicant or hostapd event
+// name, the name in lower case for those without one.
+func eventType(name string) string {
+	if evType, ok := eventTypes[name]; ok {
+		return evType
+	}
+
+	return strings.ToLower(name)
+}
+
+// eventMac returns the station of an AP client event, whose message
+// starts with its mac: "AP-STA-CONNECTED 02:00:00:00:01:00".
+func eventMac(name string, message string) string {
+	if !strings.HasPrefix(name, "AP-STA-") {
+		return ""
+	}
+
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !macR.MatchString(fields[0]) {
+		return ""
+	}
+
+	return strings.ToLower(fields[0])
+}
+
+// daemonEvent parses a line of hostapd or wpa_supplicant output, such as
+// "wlan0: CTRL-EVENT-CONNECTED - Connection to ...", into the event it
+// reports. Lines without an interface are from iface.
+func daemonEvent(source string, iface string, line string) (Event, bool) {
+	if i := strings.Index(line, ": "); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+		iface, line = line[:i], line[i+2:]
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	name := fields[0]
+	if !isDaemonEvent(name) {
+		return Event{}, false
+	}
+
+	ev := Event{
+		Type:   eventType(name),
+		Source: source,
+		Iface:  iface,
+		Name:   name,
+	}
+	if len(fields) == 2 {
+		ev.Message = strings.TrimSpace(fields[1])
+	}
+	ev.Mac = eventMac(name, ev.Message)
+
+	return ev, true
+}
+
+// isDaemonEvent reports whether name is an event name, upper case letters,
+// digits and dashes with one of daemonEventPrefixes.
+func isDaemonEvent(name string) bool {
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+
+	for _, prefix := range daemonEventPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Firewall backends for SetupCfg.Firewall.
+const (
+	FirewallAuto     = "auto"
+	FirewallIptables = "iptables"
+	FirewallNftables = "nftables"
+)
+
+// Firewall rule actions.
+const (
+	ActionMasquerade = "masquerade" // source NAT to the address of Out
+	ActionAccept     = "accept"     // forward from In to Out
+)
+
+// FirewallRule is a rule txwifi installs, independent of the backend.
+type FirewallRule struct {
+	Action      string
+	Source      string // 192.168.27.0/24, any if empty
+	In          string // input interface, any if empty
+	Out         string // output interface, any if empty
+	Established bool   // only packets of established connections
+}
+
+// Firewall installs the rules of txwifi, in groups such as "router" that
+// are replaced and removed as a whole, without touching the host's rules.
+type Firewall interface {
+	// Name returns the backend name, iptables or nftables.
+	Name() string
+
+	// Apply replaces the rules of group with rules.
+	Apply(ctx context.Context, group string, rules []FirewallRule) error
+
+	// Clear removes the rules of group.
+	Clear(ctx context.Context, group string) error
+
+	// List returns the installed rules of group as the backend prints them.
+	List(ctx context.Context, group string) ([]string, error)
+}
+
+// firewallTag names the rules of group, as an iptables comment or an
+// nftables table.
+func firewallTag(group string) string {
+	return "txwifi_" + group
+}
+
+// DetectFirewall returns the firewall backend configured, or for auto
+// the one the kernel uses: iptables when the legacy iptables works, as
+// its rules would bypass nftables, otherwise nftables, falling back to
+// iptables over nf_tables when nft is not installed.
+func DetectFirewall(ctx context.Context, runner Runner, backend string) (Firewall, error) {
+	switch backend {
+	case FirewallIptables:
+		return &iptablesFirewall{runner: runner}, nil
+	case FirewallNftables:
+		return &nftablesFirewall{runner: runner}, nil
+	case "", FirewallAuto:
+	default:
+		return nil, fmt.Errorf("%w: unknown firewall %q", ErrConfig, backend)
+	}
+
+	version, iptablesErr := runner.Output(ctx, "iptables", "-V")
+	if iptablesErr == nil && !strings.Contains(string(version), "nf_tables") {
+		if _, err := runner.Output(ctx, "iptables", "-t", "nat", "-S", "POSTROUTING"); err == nil {
+			return &iptablesFirewall{runner: runner}, nil
+		}
+	}
+
+	if _, err := runner.Output(ctx, "nft", "list", "tables"); err == nil {
+		return &nftablesFirewall{runner: runner}, nil
+	}
+
+	if iptablesErr == nil {
+		return &iptablesFirewall{runner: runner}, nil
+	}
+
+	return nil, ErrNoFirewall
+}
+
+// firewall returns the firewall backend, detecting it on first use.
+func (wpa *WpaCfg) firewall(ctx context.Context) (Firewall, error) {
+	wpa.fwMu.Lock()
+	defer wpa.fwMu.Unlock()
+
+	if wpa.Firewall != nil {
+		return wpa.Firewall, nil
+	}
+
+	firewall, err := DetectFirewall(ctx, wpa.Runner, wpa.Cfg().Firewall)
+	if err != nil {
+		return nil, err
+	}
+	wpa.Firewall = firewall
+
+	return firewall, nil
+}
+
+// DetectFirewall detects the firewall backend, for logging at startup.
+func (wpa *WpaCfg) DetectFirewall(ctx context.Context) (string, error) {
+	firewall, err := wpa.firewall(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return firewall.Name(), nil
+}
@@ -0,0 +1,309 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/gpio"
+)
+
+// GPIO defaults.
+const (
+	DefaultLongPress = 3 * time.Second
+	buttonPoll       = 20 * time.Millisecond
+	ledStatePoll     = time.Second
+	ledErrorTime     = 10 * time.Second // an error shows this long after it happened
+)
+
+// LED states, each blinked in its own pattern.
+const (
+	LedOff        = "off"
+	LedAP         = "ap"         // the setup AP is up: slow blink
+	LedConnecting = "connecting" // the station is associating: fast blink
+	LedConnected  = "connected"  // the station is connected: on
+	LedError      = "error"      // a connect or component failed: double blink
+)
+
+// ledPatterns are the on and off times of each state, repeated.
+var ledPatterns = map[string][]time.Duration{
+	LedAP:         {500 * time.Millisecond, 500 * time.Millisecond},
+	LedConnecting: {100 * time.Millisecond, 100 * time.Millisecond},
+	LedError:      {100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 700 * time.Millisecond},
+}
+
+// connectingStates are the wpa_states of a station on its way to
+// COMPLETED.
+var connectingStates = map[string]bool{
+	"AUTHENTICATING":  true,
+	"ASSOCIATING":     true,
+	"ASSOCIATED":      true,
+	"4WAY_HANDSHAKE":  true,
+	"GROUP_HANDSHAKE": true,
+}
+
+// GPIOCfg configures the button and LED of headless devices and is used
+// by SetupCfg.
+type GPIOCfg struct {
+	Chip   string        `json:"chip"` // pinctrl-bcm2835, the pins are offsets on this gpio chip; sysfs numbers if empty
+	Button GPIOButtonCfg `json:"button"`
+	Led    GPIOLedCfg    `json:"led"`
+}
+
+// GPIOButtonCfg is a button that opens or closes the setup AP when held.
+type GPIOButtonCfg struct {
+	Enabled      bool `json:"enabled"`
+	Pin          int  `json:"pin"`
+	ActiveLow    bool `json:"active_low"`     // pressed pulls the line low, as with a pull-up
+	LongPressSec int  `json:"long_press_sec"` // how long to hold it, 3 by default
+}
+
+// GPIOLedCfg is an LED blinking the state of the device.
+type GPIOLedCfg struct {
+	Enabled   bool `json:"enabled"`
+	Pin       int  `json:"pin"`
+	ActiveLow bool `json:"active_low"` // lit by driving the line low
+}
+
+// Validate checks that the button and LED are on different pins.
+func (cfg GPIOCfg) Validate() error {
+	if cfg.Button.Enabled && cfg.Led.Enabled && cfg.Button.Pin == cfg.Led.Pin {
+		return fmt.Errorf("the button and led are both on pin %d", cfg.Button.Pin)
+	}
+	if cfg.Button.Pin < 0 || cfg.Led.Pin < 0 {
+		return fmt.Errorf("pins must not be negative")
+	}
+
+	return nil
+}
+
+// longPress returns the configured hold time.
+func (cfg GPIOButtonCfg) longPress() time.Duration {
+	if cfg.LongPressSec > 0 {
+		return time.Duration(cfg.LongPressSec) * time.Second
+	}
+
+	return DefaultLongPress
+}
+
+// GPIO toggles the setup AP on a long press of a button and blinks the
+// state of the device on an LED, for devices without a screen.
+type GPIO struct {
+	Wpa    *WpaCfg
+	Window *APWindow // opened and closed by the button
+
+	mu        sync.Mutex
+	lastError time.Time // shown as LedError for ledErrorTime
+}
+
+// NewGPIO produces a GPIO toggling window.
+func NewGPIO(wpa *WpaCfg, window *APWindow) *GPIO {
+	return &GPIO{
+		Wpa:    wpa,
+		Window: window,
+	}
+}
+
+// Run watches the button and drives the LED until ctx is done. It
+// returns at once when neither is enabled. The pins are set up once;
+// changing them takes a restart.
+func (g *GPIO) Run(ctx context.Context, bus *EventBus) {
+	cfg := g.Wpa.Cfg().GPIO
+	if !cfg.Button.Enabled && !cfg.Led.Enabled {
+		return
+	}
+
+	base := 0
+	if cfg.Chip != "" {
+		var err error
+		if base, err = gpio.Base(cfg.Chip); err != nil {
+			g.Wpa.Log.Error("gpio unavailable", "chip", cfg.Chip, "error", err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	if cfg.Button.Enabled {
+		button, err := gpio.Open(base+cfg.Button.Pin, gpio.In, cfg.Button.ActiveLow)
+		if err != nil {
+			g.Wpa.Log.Error("gpio button unavailable", "pin", cfg.Button.Pin, "error", err)
+		} else {
+			defer button.Close()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.watchButton(ctx, button, cfg.Button.longPress())
+			}()
+		}
+	}
+
+	if cfg.Led.Enabled {
+		led, err := gpio.Open(base+cfg.Led.Pin, gpio.Out, cfg.Led.ActiveLow)
+		if err != nil {
+			g.Wpa.Log.Error("gpio led unavailable", "pin", cfg.Led.Pin, "error", err)
+		} else {
+			defer led.Close()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.driveLed(ctx, bus, led)
+			}()
+		}
+	}
+
+	wg.Wait()
+}
+
+// watchButton polls the button, toggling the setup AP each time it is
+// held for longPress.
+func (g *GPIO) watchButton(ctx context.Context, button *gpio.Pin, longPress time.Duration) {
+	ticker := time.NewTicker(buttonPoll)
+	defer ticker.Stop()
+
+	var pressed time.Time
+	fired := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		down, err := button.Read()
+		if err != nil {
+			g.Wpa.Log.Error("gpio button read failed", "pin", button.Number, "error", err)
+			return
+		}
+
+		switch {
+		case !down:
+			pressed, fired = time.Time{}, false
+		case pressed.IsZero():
+			pressed = time.Now()
+		case !fired && time.Since(pressed) >= longPress:
+			// once per press, however long it is held
+			fired = true
+			g.toggleAP(ctx)
+		}
+	}
+}
+
+// toggleAP opens the setup AP for another window, or closes it if it is
+// open.
+func (g *GPIO) toggleAP(ctx context.Context) {
+	if g.Window.Status().Open {
+		g.Window.Close(ctx)
+		g.Wpa.Log.Info("button closed the ap", "iface", g.Wpa.Cfg().APInterface)
+		return
+	}
+
+	if _, err := g.Window.Open(ctx); err != nil {
+		g.Wpa.Log.Error("button could not open the ap", "iface", g.Wpa.Cfg().APInterface, "error", err)
+		g.failed()
+		return
+	}
+	g.Wpa.Log.Info("button opened the ap", "iface", g.Wpa.Cfg().APInterface)
+}
+
+// failed shows the error pattern for a while.
+func (g *GPIO) failed() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.lastError = time.Now()
+}
+
+// driveLed blinks the pattern of the device state, rechecking the state
+// every second and on every event.
+func (g *GPIO) driveLed(ctx context.Context, bus *EventBus, led *gpio.Pin) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	defer led.Write(false)
+
+	states := make(chan string, 1)
+	go func() {
+		ticker := time.NewTicker(ledStatePoll)
+		defer ticker.Stop()
+
+		for {
+			state := g.ledState(ctx)
+			select {
+			case states <- state:
+			default:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				switch ev.Type {
+				case EventAuthFailure, EventEAPFailure, EventAPFallback, EventComponentDown:
+					g.failed()
+				}
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	state := LedOff
+	step := 0
+	for {
+		pattern := ledPatterns[state]
+		on := state == LedConnected
+		wait := ledStatePoll
+		if len(pattern) > 0 {
+			step %= len(pattern)
+			on = step%2 == 0
+			wait = pattern[step]
+			step++
+		}
+
+		if err := led.Write(on); err != nil {
+			g.Wpa.Log.Error("gpio led write failed", "pin", led.Number, "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case next := <-states:
+			if next != state {
+				state, step = next, 0
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ledState returns the state the LED shows: a recent error, the station
+// connecting or connected, or the setup AP up.
+func (g *GPIO) ledState(ctx context.Context) string {
+	g.mu.Lock()
+	lastError := g.lastError
+	g.mu.Unlock()
+
+	if !lastError.IsZero() && time.Since(lastError) < ledErrorTime {
+		return LedError
+	}
+
+	status, err := g.Wpa.wpaStatus(ctx)
+	if err == nil {
+		if status["wpa_state"] == "COMPLETED" {
+			return LedConnected
+		}
+		if connectingStates[status["wpa_state"]] {
+			return LedConnecting
+		}
+	}
+
+	if g.Window.Status().Open {
+		return LedAP
+	}
+
+	return LedOff
+}
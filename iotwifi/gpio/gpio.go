@@ -0,0 +1,146 @@
+// Package gpio drives GPIO pins through the sysfs interface of the
+// kernel, /sys/class/gpio: a pin is exported, given a direction and then
+// read or written through its value file.
+
+package gpio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SysDir is where the pins are exported.
+const SysDir = "/sys/class/gpio"
+
+// exportWait bounds the wait for udev to make the files of an exported
+// pin writable.
+const exportWait = time.Second
+
+// Directions of a pin.
+const (
+	In  = "in"
+	Out = "out"
+)
+
+// Pin is an exported pin.
+type Pin struct {
+	Number int // sysfs number, the base of its chip plus its offset
+
+	dir      string
+	exported bool // by Open, unexported by Close
+}
+
+// Base returns the number of the first pin of the chip labeled label,
+// pinctrl-bcm2835 on a Raspberry Pi, whose pin numbers are offsets from
+// it.
+func Base(label string) (int, error) {
+	chips, err := filepath.Glob(filepath.Join(SysDir, "gpiochip*"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, chip := range chips {
+		data, err := ioutil.ReadFile(filepath.Join(chip, "label"))
+		if err != nil || strings.TrimSpace(string(data)) != label {
+			continue
+		}
+
+		data, err = ioutil.ReadFile(filepath.Join(chip, "base"))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	return 0, fmt.Errorf("no gpio chip %q", label)
+}
+
+// Open exports pin number, if it is not already, as an input or output.
+// An active low pin reads and writes true when its line is low.
+func Open(number int, direction string, activeLow bool) (*Pin, error) {
+	p := &Pin{
+		Number: number,
+		dir:    filepath.Join(SysDir, "gpio"+strconv.Itoa(number)),
+	}
+
+	if _, err := os.Stat(p.dir); os.IsNotExist(err) {
+		if err := write(filepath.Join(SysDir, "export"), strconv.Itoa(number)); err != nil {
+			return nil, fmt.Errorf("export gpio %d: %s", number, err)
+		}
+		p.exported = true
+	}
+
+	// udev changes the owner of the new files a moment after the export
+	deadline := time.Now().Add(exportWait)
+	for {
+		err := write(filepath.Join(p.dir, "direction"), direction)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			p.Close()
+			return nil, fmt.Errorf("gpio %d direction: %s", number, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	activeLowValue := "0"
+	if activeLow {
+		activeLowValue = "1"
+	}
+	if err := write(filepath.Join(p.dir, "active_low"), activeLowValue); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("gpio %d active_low: %s", number, err)
+	}
+
+	return p, nil
+}
+
+// Read reports whether the pin is active.
+func (p *Pin) Read() (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, "value"))
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+// Write activates or deactivates an output pin.
+func (p *Pin) Write(on bool) error {
+	value := "0"
+	if on {
+		value = "1"
+	}
+
+	return write(filepath.Join(p.dir, "value"), value)
+}
+
+// Close unexports the pin if Open exported it.
+func (p *Pin) Close() error {
+	if !p.exported {
+		return nil
+	}
+
+	return write(filepath.Join(SysDir, "unexport"), strconv.Itoa(p.Number))
+}
+
+// write writes value to the sysfs file at path.
+func write(path string, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,288 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// maxDepth bounds the nesting of decoded messages, as protobuf runtimes
+// do, so a message nested in itself cannot take the stack.
+const maxDepth = 100
+
+// Marshal encodes the struct msg points to in the protobuf wire format.
+func Marshal(msg interface{}) ([]byte, error) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", msg)
+	}
+
+	return appendStruct(nil, v.Elem())
+}
+
+// Unmarshal decodes data into the struct msg points to. Unknown fields
+// are skipped, as proto3 requires.
+func Unmarshal(data []byte, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("grpc: cannot unmarshal into %T", msg)
+	}
+
+	return decodeStruct(data, v.Elem(), 0)
+}
+
+// field is a struct field with a protobuf field number.
+type field struct {
+	number int
+	index  int
+}
+
+// fieldCache holds the proto fields of each struct type.
+var fieldCache sync.Map
+
+// fields returns the proto fields of t.
+func fields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	list := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("proto")
+		if tag == "" {
+			continue
+		}
+		number, err := strconv.Atoi(tag)
+		if err != nil || number < 1 {
+			panic(fmt.Sprintf("grpc: bad proto tag %q on %s.%s", tag, t.Name(), t.Field(i).Name))
+		}
+		list = append(list, field{number: number, index: i})
+	}
+
+	fieldCache.Store(t, list)
+	return list
+}
+
+// appendStruct appends the fields of v, leaving out zero values.
+func appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	for _, f := range fields(v.Type()) {
+		if b, err = appendValue(b, f.number, v.Field(f.index)); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// appendValue appends field number with the value of v.
+func appendValue(b []byte, number int, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			b = appendTag(b, number, wireBytes)
+			b = appendVarint(b, uint64(v.Len()))
+			b = append(b, v.String()...)
+		}
+	case reflect.Bool:
+		if v.Bool() {
+			b = appendTag(b, number, wireVarint)
+			b = append(b, 1)
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if v.Int() != 0 {
+			b = appendTag(b, number, wireVarint)
+			b = appendVarint(b, uint64(v.Int()))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return appendValue(b, number, v.Elem())
+		}
+	case reflect.Struct:
+		data, err := appendStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendTag(b, number, wireBytes)
+		b = appendVarint(b, uint64(len(data)))
+		b = append(b, data...)
+	case reflect.Slice:
+		// repeated fields, each element in a field of its own
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() == reflect.String {
+				b = appendTag(b, number, wireBytes)
+				b = appendVarint(b, uint64(elem.Len()))
+				b = append(b, elem.String()...)
+				continue
+			}
+			if b, err = appendValue(b, number, elem); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		// map<string, string> is a repeated entry of key 1 and value 2
+		for _, key := range v.MapKeys() {
+			entry := appendTag(nil, 1, wireBytes)
+			entry = appendVarint(entry, uint64(key.Len()))
+			entry = append(entry, key.String()...)
+			value := v.MapIndex(key).String()
+			entry = appendTag(entry, 2, wireBytes)
+			entry = appendVarint(entry, uint64(len(value)))
+			entry = append(entry, value...)
+
+			b = appendTag(b, number, wireBytes)
+			b = appendVarint(b, uint64(len(entry)))
+			b = append(b, entry...)
+		}
+	default:
+		return nil, fmt.Errorf("grpc: cannot marshal %s", v.Type())
+	}
+
+	return b, nil
+}
+
+// decodeStruct decodes data into the fields of v, a message nested depth
+// messages deep.
+func decodeStruct(data []byte, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errMalformed
+	}
+
+	byNumber := map[int]reflect.Value{}
+	for _, f := range fields(v.Type()) {
+		byNumber[f.number] = v.Field(f.index)
+	}
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformed
+		}
+		data = data[n:]
+		number, wire := int(tag>>3), int(tag&7)
+
+		var scalar uint64
+		var bytes []byte
+		switch wire {
+		case wireVarint:
+			scalar, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errMalformed
+			}
+			data = data[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errMalformed
+			}
+			data = data[size:]
+			continue // not used by txwifi.proto
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errMalformed
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return errMalformed
+		}
+
+		target, ok := byNumber[number]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(target, wire, scalar, bytes, depth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeValue sets v from one occurrence of its field, in a message
+// nested depth messages deep.
+func decodeValue(v reflect.Value, wire int, scalar uint64, bytes []byte, depth int) error {
+	switch v.Kind() {
+	case reflect.String, reflect.Struct, reflect.Map:
+		if wire != wireBytes {
+			return errMalformed
+		}
+	case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64:
+		if wire != wireVarint {
+			return errMalformed
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(bytes))
+	case reflect.Bool:
+		v.SetBool(scalar != 0)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		// negatives are sign extended to 64 bits, int32 ones too
+		v.SetInt(int64(scalar))
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeValue(v.Elem(), wire, scalar, bytes, depth)
+	case reflect.Struct:
+		return decodeStruct(bytes, v, depth+1)
+	case reflect.Slice:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := decodeValue(elem, wire, scalar, bytes, depth); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	case reflect.Map:
+		var entry struct {
+			Key   string `proto:"1"`
+			Value string `proto:"2"`
+		}
+		if err := decodeStruct(bytes, reflect.ValueOf(&entry).Elem(), depth+1); err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(reflect.ValueOf(entry.Key), reflect.ValueOf(entry.Value))
+	default:
+		return fmt.Errorf("grpc: cannot unmarshal into %s", v.Type())
+	}
+
+	return nil
+}
+
+var errMalformed = errors.New("grpc: malformed protobuf message")
+
+// appendTag appends the key of field number.
+func appendTag(b []byte, number int, wire int) []byte {
+	return appendVarint(b, uint64(number)<<3|uint64(wire))
+}
+
+// appendVarint appends v 7 bits a byte, least significant first.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
@@ -0,0 +1,169 @@
+package grpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  interface{}
+		wire []byte
+	}{
+		{"empty", &ScanRequest{}, []byte{}},
+		{"bool", &ScanRequest{Fresh: true}, []byte{0x08, 0x01}},
+		// the examples of the protobuf encoding guide
+		{"varint", &Network{Frequency: 150}, []byte{0x18, 0x96, 0x01}},
+		{"string", &Network{Bssid: "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{"negative int32", &Network{SignalLevel: -2}, []byte{0x30, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"int64", &Event{TimeUnixMs: 1 << 40}, []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x80, 0x20}},
+		{"high field number", &ConnectRequest{PreferredBand: "5GHz"}, []byte{0x62, 0x04, '5', 'G', 'H', 'z'}},
+		{"nested", &Network{Security: &Security{Wpa2: true}}, []byte{0x4a, 0x02, 0x20, 0x01}},
+		{"nested empty", &Network{Security: &Security{}}, []byte{0x4a, 0x00}},
+		{"repeated", &ConnectResponse{Dns: []string{"a", "", "b"}}, []byte{0x2a, 0x01, 'a', 0x2a, 0x00, 0x2a, 0x01, 'b'}},
+		{"repeated messages", &ApStatusResponse{Clients: []*ApClient{{Rssi: 1}, nil, {}}}, []byte{0x12, 0x02, 0x20, 0x01, 0x12, 0x00}},
+		{"map", &StatusResponse{Fields: map[string]string{"k": "v"}}, []byte{0x0a, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire, err := Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(wire, tt.wire) {
+				t.Errorf("marshaled % x, want % x", wire, tt.wire)
+			}
+		})
+	}
+
+	for _, msg := range []interface{}{nil, ScanRequest{}, new(int)} {
+		if _, err := Marshal(msg); err == nil {
+			t.Errorf("marshaled %T", msg)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		wire []byte
+		msg  interface{} // the type to decode into, and what it decodes to
+		err  bool
+	}{
+		{
+			name: "fields",
+			wire: []byte{0x0a, 0x04, 'h', 'o', 'm', 'e', 0x20, 0x01, 0x62, 0x04, '5', 'G', 'H', 'z'},
+			msg:  &ConnectRequest{Ssid: "home", Hidden: true, PreferredBand: "5GHz"},
+		},
+		{
+			name: "unknown fields skipped",
+			wire: []byte{0x78, 0x05, 0x81, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x8d, 0x01, 0x01, 0x02, 0x03, 0x04, 0x92, 0x01, 0x01, 'x', 0x0a, 0x01, 'a'},
+			msg:  &ConnectRequest{Ssid: "a"},
+		},
+		{
+			name: "last value wins",
+			wire: []byte{0x0a, 0x01, 'a', 0x0a, 0x01, 'b'},
+			msg:  &ConnectRequest{Ssid: "b"},
+		},
+		{
+			name: "negative int32",
+			wire: []byte{0x30, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+			msg:  &Network{SignalLevel: -2},
+		},
+		{
+			name: "repeated and nested",
+			wire: []byte{0x0a, 0x03, 0x0a, 0x01, 'a', 0x0a, 0x04, 0x52, 0x02, 0x0a, 0x00, 0x10, 0x07},
+			msg:  &ScanResponse{Networks: []*Network{{Ssid: "a"}, {Bss: []*Network{{}}}}, TimeUnix: 7},
+		},
+		{
+			name: "map entries",
+			wire: []byte{0x0a, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v', 0x0a, 0x03, 0x0a, 0x01, 'e', 0x0a, 0x00},
+			msg:  &StatusResponse{Fields: map[string]string{"k": "v", "e": "", "": ""}},
+		},
+		{name: "string as varint", wire: []byte{0x08, 0x01}, msg: &ConnectRequest{}, err: true},
+		{name: "bool as bytes", wire: []byte{0x22, 0x00}, msg: &ConnectRequest{}, err: true},
+		{name: "truncated tag", wire: []byte{0x80}, msg: &ConnectRequest{}, err: true},
+		{name: "truncated varint", wire: []byte{0x20, 0x80}, msg: &ConnectRequest{}, err: true},
+		{name: "truncated bytes", wire: []byte{0x0a, 0x05, 'a'}, msg: &ConnectRequest{}, err: true},
+		{name: "huge length", wire: []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, msg: &ConnectRequest{}, err: true},
+		{name: "truncated fixed64", wire: []byte{0x79, 0x01}, msg: &ConnectRequest{}, err: true},
+		{name: "group", wire: []byte{0x0b, 0x0c}, msg: &ConnectRequest{}, err: true},
+		{name: "malformed nested", wire: []byte{0x4a, 0x01, 0x80}, msg: &Network{}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := reflect.New(reflect.TypeOf(tt.msg).Elem()).Interface()
+			err := Unmarshal(tt.wire, got)
+			if (err != nil) != tt.err {
+				t.Fatalf("err %v, want failed %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("unmarshaled %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+
+	if err := Unmarshal(nil, ScanRequest{}); err == nil {
+		t.Error("unmarshaled into a struct value")
+	}
+}
+
+func TestUnmarshalDepth(t *testing.T) {
+	// networks nested in their bss, as deep as allowed and one deeper
+	nest := func(depth int) []byte {
+		wire := []byte{}
+		for i := 0; i < depth; i++ {
+			wire = append(appendVarint([]byte{0x52}, uint64(len(wire))), wire...)
+		}
+		return wire
+	}
+
+	if err := Unmarshal(nest(maxDepth), &Network{}); err != nil {
+		t.Errorf("%d deep: %s", maxDepth, err)
+	}
+	if err := Unmarshal(nest(maxDepth+1), &Network{}); err == nil {
+		t.Errorf("decoded %d deep", maxDepth+1)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add(byte(0), []byte{0x0a, 0x04, 'h', 'o', 'm', 'e', 0x20, 0x01})
+	f.Add(byte(1), []byte{0x0a, 0x03, 0x0a, 0x01, 'a', 0x0a, 0x04, 0x52, 0x02, 0x18, 0x01, 0x10, 0x07})
+	f.Add(byte(2), []byte{0x0a, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v'})
+	f.Add(byte(3), []byte{0x12, 0x04, 0x20, 0x7f, 0x28, 0x01})
+
+	types := []reflect.Type{
+		reflect.TypeOf(ConnectRequest{}),
+		reflect.TypeOf(ScanResponse{}),
+		reflect.TypeOf(StatusResponse{}),
+		reflect.TypeOf(ApStatusResponse{}),
+		reflect.TypeOf(WatchEventsRequest{}),
+		reflect.TypeOf(Event{}),
+	}
+
+	f.Fuzz(func(t *testing.T, kind byte, wire []byte) {
+		msgType := types[int(kind)%len(types)]
+
+		msg := reflect.New(msgType).Interface()
+		if err := Unmarshal(wire, msg); err != nil {
+			return
+		}
+
+		// what decoded marshals to the same message
+		again, err := Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := reflect.New(msgType).Interface()
+		if err := Unmarshal(again, decoded); err != nil {
+			t.Fatalf("% x decoded to %+v, marshaled to % x: %s", wire, msg, again, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Fatalf("% x decoded to %+v, marshaled to % x, decoded to %+v", wire, msg, again, decoded)
+		}
+	})
+}
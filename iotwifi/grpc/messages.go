@@ -0,0 +1,101 @@
+package grpc
+
+// The messages of txwifi.proto. Field numbers are in the proto tags.
+
+type ScanRequest struct {
+	Fresh bool `proto:"1"`
+}
+
+type Security struct {
+	Open       bool `proto:"1"`
+	Wep        bool `proto:"2"`
+	Wpa        bool `proto:"3"`
+	Wpa2       bool `proto:"4"`
+	Wpa3       bool `proto:"5"`
+	Enterprise bool `proto:"6"`
+	Wps        bool `proto:"7"`
+}
+
+type Network struct {
+	Ssid        string     `proto:"1"`
+	Bssid       string     `proto:"2"`
+	Frequency   int32      `proto:"3"`
+	Channel     int32      `proto:"4"`
+	Band        string     `proto:"5"`
+	SignalLevel int32      `proto:"6"`
+	Quality     int32      `proto:"7"`
+	Flags       string     `proto:"8"`
+	Security    *Security  `proto:"9"`
+	Bss         []*Network `proto:"10"`
+}
+
+type ScanResponse struct {
+	Networks []*Network `proto:"1"`
+	TimeUnix int64      `proto:"2"`
+}
+
+type ConnectRequest struct {
+	Ssid       string `proto:"1"`
+	Psk        string `proto:"2"`
+	KeyMgmt    string `proto:"3"`
+	Hidden     bool   `proto:"4"`
+	Identity   string `proto:"5"`
+	Password   string `proto:"6"`
+	EapMethod  string `proto:"7"`
+	Phase2     string `proto:"8"`
+	CaCert     string `proto:"9"`
+	ClientCert string `proto:"10"`
+	PrivateKey string `proto:"11"`
+
+	PreferredBand string `proto:"12"`
+}
+
+type ConnectResponse struct {
+	Ssid             string   `proto:"1"`
+	State            string   `proto:"2"`
+	Ip               string   `proto:"3"`
+	Gateway          string   `proto:"4"`
+	Dns              []string `proto:"5"`
+	Ipv6             []string `proto:"6"`
+	Gateway6         string   `proto:"7"`
+	Message          string   `proto:"8"`
+	Reason           string   `proto:"9"`
+	Connectivity     string   `proto:"10"`
+	CaptivePortalUrl string   `proto:"11"`
+}
+
+type StatusRequest struct{}
+
+type StatusResponse struct {
+	Fields map[string]string `proto:"1"`
+}
+
+type ApStatusRequest struct{}
+
+type ApClient struct {
+	Mac           string `proto:"1"`
+	Ip            string `proto:"2"`
+	Hostname      string `proto:"3"`
+	Rssi          int32  `proto:"4"`
+	RxBytes       int64  `proto:"5"`
+	TxBytes       int64  `proto:"6"`
+	ConnectedTime int64  `proto:"7"`
+}
+
+type ApStatusResponse struct {
+	Fields  map[string]string `proto:"1"`
+	Clients []*ApClient       `proto:"2"`
+}
+
+type WatchEventsRequest struct {
+	Types []string `proto:"1"`
+}
+
+type Event struct {
+	Type       string `proto:"1"`
+	Source     string `proto:"2"`
+	Iface      string `proto:"3"`
+	Name       string `proto:"4"`
+	Message    string `proto:"5"`
+	TimeUnixMs int64  `proto:"6"`
+}
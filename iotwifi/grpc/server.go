@@ -0,0 +1,211 @@
+// Package grpc serves the txwifi gRPC API of txwifi.proto over HTTP/2
+// with net/http, without the grpc-go runtime: the length-prefixed message
+// framing, status trailers and timeouts of the gRPC protocol, and a
+// protobuf codec for the message types of messages.go, structs whose
+// fields carry their protobuf field numbers in proto tags. Clients in
+// other languages are generated from txwifi.proto as usual.
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceName is the full name of the Wifi service.
+const ServiceName = "txwifi.v1.Wifi"
+
+// maxMessageSize bounds a request message.
+const maxMessageSize = 1 << 20
+
+// timeoutUnits are the units of a grpc-timeout header.
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// Service is the Wifi service of txwifi.proto. Errors that are not a
+// Status reach the client as Unknown.
+type Service interface {
+	Scan(ctx context.Context, req *ScanRequest) (*ScanResponse, error)
+	Connect(ctx context.Context, req *ConnectRequest) (*ConnectResponse, error)
+	Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error)
+	ApStatus(ctx context.Context, req *ApStatusRequest) (*ApStatusResponse, error)
+
+	// WatchEvents calls send for each event until ctx is done or send
+	// fails.
+	WatchEvents(ctx context.Context, req *WatchEventsRequest, send func(*Event) error) error
+}
+
+// peerKey holds the client address in a call's context.
+type peerKey struct{}
+
+// Peer returns the address of the client of a call, host:port.
+func Peer(ctx context.Context) string {
+	addr, _ := ctx.Value(peerKey{}).(string)
+	return addr
+}
+
+// Server serves a Service to gRPC clients. It is an http.Handler for a
+// server speaking HTTP/2, over TLS or in cleartext.
+type Server struct {
+	Service Service
+}
+
+// NewServer produces a Server for service.
+func NewServer(service Service) *Server {
+	return &Server{Service: service}
+}
+
+// ServeHTTP implements http.Handler, answering one call.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), peerKey{}, r.RemoteAddr)
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/grpc+proto")
+
+	status := &Status{Code: OK}
+	if err := s.call(ctx, w, r); err != nil {
+		status = statusOf(err)
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// call runs the method of r.
+func (s *Server) call(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	method := strings.TrimPrefix(r.URL.Path, "/"+ServiceName+"/")
+	if method == r.URL.Path {
+		return Errorf(Unimplemented, "unknown service %s", r.URL.Path)
+	}
+
+	switch method {
+	case "Scan":
+		req := &ScanRequest{}
+		return unary(w, r, req, func() (interface{}, error) { return s.Service.Scan(ctx, req) })
+	case "Connect":
+		req := &ConnectRequest{}
+		return unary(w, r, req, func() (interface{}, error) { return s.Service.Connect(ctx, req) })
+	case "Status":
+		req := &StatusRequest{}
+		return unary(w, r, req, func() (interface{}, error) { return s.Service.Status(ctx, req) })
+	case "ApStatus":
+		req := &ApStatusRequest{}
+		return unary(w, r, req, func() (interface{}, error) { return s.Service.ApStatus(ctx, req) })
+	case "WatchEvents":
+		req := &WatchEventsRequest{}
+		if err := readMessage(r.Body, req); err != nil {
+			return err
+		}
+
+		// the headers go out now, events may be a while
+		w.WriteHeader(http.StatusOK)
+		flush(w)
+
+		return s.Service.WatchEvents(ctx, req, func(ev *Event) error { return writeMessage(w, ev) })
+	}
+
+	return Errorf(Unimplemented, "unknown method %s", method)
+}
+
+// unary reads req, runs call and writes its response.
+func unary(w http.ResponseWriter, r *http.Request, req interface{}, call func() (interface{}, error)) error {
+	if err := readMessage(r.Body, req); err != nil {
+		return err
+	}
+
+	resp, err := call()
+	if err != nil {
+		return err
+	}
+
+	return writeMessage(w, resp)
+}
+
+// readMessage reads a length-prefixed message into msg.
+func readMessage(body io.Reader, msg interface{}) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return Errorf(InvalidArgument, "reading the request: %s", err)
+	}
+	if prefix[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxMessageSize {
+		return Errorf(ResourceExhausted, "request of %d bytes is over %d", length, maxMessageSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return Errorf(InvalidArgument, "reading the request: %s", err)
+	}
+	if err := Unmarshal(data, msg); err != nil {
+		return Errorf(InvalidArgument, "%s", err)
+	}
+
+	return nil
+}
+
+// writeMessage writes msg length-prefixed and flushes it to the client.
+func writeMessage(w http.ResponseWriter, msg interface{}) error {
+	data, err := Marshal(msg)
+	if err != nil {
+		return Errorf(Internal, "%s", err)
+	}
+
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	if _, err := w.Write(append(frame, data...)); err != nil {
+		return err
+	}
+	flush(w)
+
+	return nil
+}
+
+// flush sends what w has buffered.
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// parseTimeout parses a grpc-timeout header, such as 30S or 500m.
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	unit, ok := timeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
@@ -0,0 +1,361 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeService answers calls with canned responses.
+type fakeService struct {
+	scan   *ScanResponse
+	err    error
+	events []*Event
+
+	connect *ConnectRequest // the last request
+	peer    string
+}
+
+func (f *fakeService) Scan(ctx context.Context, req *ScanRequest) (*ScanResponse, error) {
+	f.peer = Peer(ctx)
+	return f.scan, f.err
+}
+
+func (f *fakeService) Connect(ctx context.Context, req *ConnectRequest) (*ConnectResponse, error) {
+	f.connect = req
+	return &ConnectResponse{Ssid: req.Ssid, State: "COMPLETED"}, f.err
+}
+
+func (f *fakeService) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	// waits for the deadline of the call
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *fakeService) ApStatus(ctx context.Context, req *ApStatusRequest) (*ApStatusResponse, error) {
+	return &ApStatusResponse{}, f.err
+}
+
+func (f *fakeService) WatchEvents(ctx context.Context, req *WatchEventsRequest, send func(*Event) error) error {
+	for _, ev := range f.events {
+		if len(req.Types) > 0 && ev.Type != req.Types[0] {
+			continue
+		}
+		if err := send(ev); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+// frame length-prefixes msg.
+func frame(t *testing.T, msg interface{}) []byte {
+	t.Helper()
+	data, err := Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	return append(prefix, data...)
+}
+
+// h2cServer serves service over cleartext HTTP/2, returning its url and
+// a client speaking it.
+func h2cServer(t *testing.T, service Service) (string, *http.Client) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(NewServer(service))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	t.Cleanup(client.CloseIdleConnections)
+
+	return srv.URL, client
+}
+
+// call posts body to method, returning the messages of the response and
+// its grpc-status and grpc-message.
+func call(t *testing.T, url string, client *http.Client, method string, body []byte, header http.Header) ([][]byte, Code, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url+"/"+ServiceName+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("%s %s", resp.Proto, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/grpc+proto" {
+		t.Errorf("content type %q", ct)
+	}
+
+	messages := [][]byte{}
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(resp.Body, data); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, data)
+	}
+
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("grpc-status %q", resp.Trailer.Get("Grpc-Status"))
+	}
+
+	return messages, Code(code), resp.Trailer.Get("Grpc-Message")
+}
+
+func TestServer(t *testing.T) {
+	service := &fakeService{
+		scan: &ScanResponse{Networks: []*Network{{Ssid: "home", Frequency: 2412}}, TimeUnix: 1700000000},
+		events: []*Event{
+			{Type: "scan", Message: "done"},
+			{Type: "connect", Message: "home"},
+			{Type: "scan", Message: "again"},
+		},
+	}
+	url, client := h2cServer(t, service)
+
+	t.Run("unary", func(t *testing.T) {
+		messages, code, message := call(t, url, client, "Scan", frame(t, &ScanRequest{Fresh: true}), nil)
+		if code != OK || message != "" || len(messages) != 1 {
+			t.Fatalf("code %d %q, %d messages", code, message, len(messages))
+		}
+		resp := &ScanResponse{}
+		if err := Unmarshal(messages[0], resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp, service.scan) {
+			t.Errorf("response %+v, want %+v", resp, service.scan)
+		}
+		if service.peer == "" {
+			t.Error("no peer in the call context")
+		}
+	})
+
+	t.Run("request", func(t *testing.T) {
+		req := &ConnectRequest{Ssid: "home", Psk: "secret", Hidden: true}
+		messages, code, _ := call(t, url, client, "Connect", frame(t, req), nil)
+		if code != OK || len(messages) != 1 {
+			t.Fatalf("code %d, %d messages", code, len(messages))
+		}
+		if !reflect.DeepEqual(service.connect, req) {
+			t.Errorf("request %+v, want %+v", service.connect, req)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		messages, code, _ := call(t, url, client, "WatchEvents", frame(t, &WatchEventsRequest{Types: []string{"scan"}}), nil)
+		if code != OK || len(messages) != 2 {
+			t.Fatalf("code %d, %d messages", code, len(messages))
+		}
+		for i, want := range []string{"done", "again"} {
+			ev := &Event{}
+			if err := Unmarshal(messages[i], ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type != "scan" || ev.Message != want {
+				t.Errorf("event %d %+v, want %s", i, ev, want)
+			}
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		start := time.Now()
+		_, code, _ := call(t, url, client, "Status", frame(t, &StatusRequest{}), http.Header{"Grpc-Timeout": {"50m"}})
+		if code != DeadlineExceeded {
+			t.Errorf("code %d, want %d", code, DeadlineExceeded)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("took %s", time.Since(start))
+		}
+	})
+
+	oversize := make([]byte, 5)
+	binary.BigEndian.PutUint32(oversize[1:], maxMessageSize+1)
+
+	errs := []struct {
+		name    string
+		method  string
+		body    []byte
+		err     error
+		code    Code
+		message string
+	}{
+		{name: "status", method: "ApStatus", body: frame(t, &ApStatusRequest{}), err: &Status{Code: FailedPrecondition, Message: "no ap: 100%\n"}, code: FailedPrecondition, message: "no ap: 100%25%0A"},
+		{name: "other error", method: "Scan", body: frame(t, &ScanRequest{}), err: errors.New("busy"), code: Unknown, message: "busy"},
+		{name: "context error", method: "Scan", body: frame(t, &ScanRequest{}), err: context.Canceled, code: Canceled},
+		{name: "error after events", method: "WatchEvents", body: frame(t, &WatchEventsRequest{Types: []string{"none"}}), err: Errorf(Unavailable, "gone"), code: Unavailable},
+		{name: "unknown method", method: "Forget", body: frame(t, &ScanRequest{}), code: Unimplemented},
+		{name: "no message", method: "Scan", body: nil, code: InvalidArgument},
+		{name: "short message", method: "Scan", body: frame(t, &ScanRequest{Fresh: true})[:6], code: InvalidArgument},
+		{name: "malformed message", method: "Scan", body: []byte{0, 0, 0, 0, 1, 0x80}, code: InvalidArgument},
+		{name: "compressed", method: "Scan", body: []byte{1, 0, 0, 0, 0}, code: Unimplemented},
+		{name: "oversize", method: "Scan", body: oversize, code: ResourceExhausted},
+	}
+
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			service.err = tt.err
+			defer func() { service.err = nil }()
+
+			messages, code, message := call(t, url, client, tt.method, tt.body, nil)
+			if len(messages) != 0 {
+				t.Errorf("%d messages", len(messages))
+			}
+			if code != tt.code {
+				t.Errorf("code %d, want %d", code, tt.code)
+			}
+			if tt.message != "" && message != tt.message {
+				t.Errorf("message %q, want %q", message, tt.message)
+			}
+		})
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	server := NewServer(&fakeService{})
+	body := frame(t, &ScanRequest{})
+
+	tests := []struct {
+		name        string
+		method      string
+		proto       int
+		contentType string
+	}{
+		{"http/1.1", http.MethodPost, 1, "application/grpc"},
+		{"get", http.MethodGet, 2, "application/grpc"},
+		{"json", http.MethodPost, 2, "application/json"},
+		{"no content type", http.MethodPost, 2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/"+ServiceName+"/Scan", bytes.NewReader(body))
+			r.ProtoMajor = tt.proto
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("status %d", w.Code)
+			}
+		})
+	}
+
+	// the service is checked before the method
+	r := httptest.NewRequest(http.MethodPost, "/other.Service/Scan", bytes.NewReader(body))
+	r.ProtoMajor = 2
+	r.Header.Set("Content-Type", "application/grpc+proto")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if status := w.Header().Get(http.TrailerPrefix + "Grpc-Status"); status != strconv.Itoa(int(Unimplemented)) {
+		t.Errorf("grpc-status %q", status)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		timeout time.Duration
+		ok      bool
+	}{
+		{"30S", 30 * time.Second, true},
+		{"500m", 500 * time.Millisecond, true},
+		{"1H", time.Hour, true},
+		{"2M", 2 * time.Minute, true},
+		{"10u", 10 * time.Microsecond, true},
+		{"0n", 0, true},
+		{"99999999S", 99999999 * time.Second, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"30", 0, false},
+		{"30s", 0, false},
+		{"-1S", 0, false},
+		{"1.5S", 0, false},
+		{"100000000S", 0, false},
+		{" 30S", 0, false},
+	}
+
+	for _, tt := range tests {
+		timeout, ok := parseTimeout(tt.value)
+		if timeout != tt.timeout || ok != tt.ok {
+			t.Errorf("%q parsed to %s %v, want %s %v", tt.value, timeout, ok, tt.timeout, tt.ok)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		encoded string
+	}{
+		{"", ""},
+		{"no such network", "no such network"},
+		{"100%", "100%25"},
+		{"line\nbreak\t", "line%0Abreak%09"},
+		{"café", "caf%C3%A9"},
+		{"~ \x7f", "~ %7F"},
+	}
+
+	for _, tt := range tests {
+		if encoded := encodeMessage(tt.message); encoded != tt.encoded {
+			t.Errorf("%q encoded to %q, want %q", tt.message, encoded, tt.encoded)
+		}
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 6, 0x0a, 0x04, 'h', 'o', 'm', 'e'})
+	f.Add([]byte{0, 0, 0, 0, 0})
+	f.Add([]byte{1, 0, 0, 0, 0})
+	f.Add([]byte{0, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 0, 9, 0x0a})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req := &ConnectRequest{}
+		err := readMessage(bytes.NewReader(body), req)
+		if err == nil {
+			return
+		}
+
+		// errors reach clients with a status of the protocol
+		status := statusOf(err)
+		switch status.Code {
+		case InvalidArgument, Unimplemented, ResourceExhausted:
+		default:
+			t.Fatalf("% x: code %d: %s", body, status.Code, err)
+		}
+	})
+}
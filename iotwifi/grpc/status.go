@@ -0,0 +1,76 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code is a gRPC status code.
+type Code int
+
+// Status codes, those txwifi returns.
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	Unauthenticated    Code = 16
+)
+
+// Status is an error with a gRPC status code, sent to the client as the
+// grpc-status and grpc-message trailers.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+// Errorf returns a Status error.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: code %d: %s", s.Code, s.Message)
+}
+
+// statusOf returns the Status of err: a Status as it is, context errors
+// as Canceled or DeadlineExceeded and anything else as Unknown.
+func statusOf(err error) *Status {
+	var status *Status
+	switch {
+	case errors.As(err, &status):
+		return status
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// encodeMessage percent-encodes a grpc-message as the protocol requires,
+// everything outside printable ASCII and the percent sign itself.
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,310 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/grpc"
+)
+
+// DefaultGRPCPort is the port of the gRPC API.
+const DefaultGRPCPort = 50051
+
+// GRPCCfg configures the gRPC API and is used by SetupCfg. It is served
+// over TLS with the HTTPS certificate when https is enabled.
+type GRPCCfg struct {
+	Enabled bool `json:"enabled"`
+	Port    int  `json:"port"` // 50051 by default
+}
+
+// Addr returns the address to listen on.
+func (c GRPCCfg) Addr() string {
+	port := c.Port
+	if port == 0 {
+		port = DefaultGRPCPort
+	}
+
+	return ":" + strconv.Itoa(port)
+}
+
+// GRPCService implements the Wifi service of txwifi.proto over WpaCfg,
+// with the rate limits and audit log of the HTTP API.
+type GRPCService struct {
+	Wpa     *WpaCfg
+	Scans   *ScanManager
+	Bus     *EventBus
+	Audit   *AuditLog    // optional, records connects
+	Limiter *RateLimiter // optional, limits clients as on the HTTP API
+}
+
+var _ grpc.Service = (*GRPCService)(nil)
+
+// grpcCodes are the status codes of the WpaCfg errors.
+var grpcCodes = []struct {
+	err  error
+	code grpc.Code
+}{
+	{ErrConfig, grpc.InvalidArgument},
+	{ErrInvalid, grpc.InvalidArgument},
+	{ErrNetworkNotFound, grpc.NotFound},
+	{ErrNotConfigured, grpc.NotFound},
+	{ErrTimeout, grpc.DeadlineExceeded},
+	{ErrRateLimited, grpc.ResourceExhausted},
+	{ErrLockedOut, grpc.ResourceExhausted},
+	{ErrRadioBlocked, grpc.FailedPrecondition},
+	{ErrScanFailed, grpc.Unavailable},
+	{ErrStatusFailed, grpc.Unavailable},
+	{ErrAPStatusFailed, grpc.Unavailable},
+	{ErrCommandFailed, grpc.Unavailable},
+}
+
+// grpcError returns err with the status code of the WpaCfg error it wraps.
+func grpcError(err error) error {
+	for _, c := range grpcCodes {
+		if errors.Is(err, c.err) {
+			return grpc.Errorf(c.code, "%s", err)
+		}
+	}
+
+	return grpc.Errorf(grpc.Internal, "%s", err)
+}
+
+// Scan implements grpc.Service.
+func (s *GRPCService) Scan(ctx context.Context, req *grpc.ScanRequest) (*grpc.ScanResponse, error) {
+	if _, err := s.allow(ctx, false); err != nil {
+		return nil, err
+	}
+
+	results, err := s.Scans.Results(ctx, req.Fresh)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &grpc.ScanResponse{Networks: []*grpc.Network{}}
+	if !results.Time.IsZero() {
+		resp.TimeUnix = results.Time.Unix()
+	}
+	for _, result := range results.Networks {
+		network := grpcNetwork(result.WpaNetwork)
+		for _, bss := range result.Bss {
+			network.Bss = append(network.Bss, grpcNetwork(bss))
+		}
+		resp.Networks = append(resp.Networks, network)
+	}
+
+	return resp, nil
+}
+
+// grpcNetwork converts a scanned network.
+func grpcNetwork(n WpaNetwork) *grpc.Network {
+	frequency, _ := strconv.Atoi(n.Frequency)
+
+	return &grpc.Network{
+		Ssid:        n.Ssid,
+		Bssid:       n.Bssid,
+		Frequency:   int32(frequency),
+		Channel:     int32(n.Channel),
+		Band:        n.Band,
+		SignalLevel: int32(n.SignalLevel),
+		Quality:     int32(n.Quality),
+		Flags:       n.Flags,
+		Security: &grpc.Security{
+			Open:       n.Security.Open,
+			Wep:        n.Security.Wep,
+			Wpa:        n.Security.Wpa,
+			Wpa2:       n.Security.Wpa2,
+			Wpa3:       n.Security.Wpa3,
+			Enterprise: n.Security.Enterprise,
+			Wps:        n.Security.Wps,
+		},
+	}
+}
+
+// Connect implements grpc.Service. A failed attempt is a response with
+// state FAIL and a reason, not an error.
+func (s *GRPCService) Connect(ctx context.Context, req *grpc.ConnectRequest) (*grpc.ConnectResponse, error) {
+	client, err := s.allow(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := WpaCredentials{
+		Ssid:       req.Ssid,
+		Psk:        req.Psk,
+		KeyMgmt:    req.KeyMgmt,
+		Hidden:     req.Hidden,
+		Identity:   req.Identity,
+		Password:   req.Password,
+		EapMethod:  req.EapMethod,
+		Phase2:     req.Phase2,
+		CACert:     req.CaCert,
+		ClientCert: req.ClientCert,
+		PrivateKey: req.PrivateKey,
+
+		PreferredBand: req.PreferredBand,
+	}
+	if creds.Ssid == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "ssid is required")
+	}
+
+	start := time.Now()
+	connection, err := s.Wpa.ConnectNetwork(ctx, creds)
+	s.audit(ctx, creds.Ssid, err, time.Since(start))
+
+	if client != "" && (connection.Reason == ReasonWrongPassword || connection.Reason == ReasonAuthFailed) {
+		s.Limiter.AuthFailed(client)
+	}
+	if err != nil && connection.Reason == ReasonNone {
+		return nil, grpcError(err)
+	}
+
+	return &grpc.ConnectResponse{
+		Ssid:             connection.Ssid,
+		State:            connection.State,
+		Ip:               connection.Ip,
+		Gateway:          connection.Gateway,
+		Dns:              connection.Dns,
+		Ipv6:             connection.Ipv6,
+		Gateway6:         connection.Gateway6,
+		Message:          connection.Message,
+		Reason:           string(connection.Reason),
+		Connectivity:     connection.Connectivity,
+		CaptivePortalUrl: connection.CaptivePortalUrl,
+	}, nil
+}
+
+// Status implements grpc.Service.
+func (s *GRPCService) Status(ctx context.Context, req *grpc.StatusRequest) (*grpc.StatusResponse, error) {
+	if _, err := s.allow(ctx, false); err != nil {
+		return nil, err
+	}
+
+	status, err := s.Wpa.Status(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &grpc.StatusResponse{Fields: status}, nil
+}
+
+// ApStatus implements grpc.Service. The clients get fields of their own,
+// the other values are passed as text.
+func (s *GRPCService) ApStatus(ctx context.Context, req *grpc.ApStatusRequest) (*grpc.ApStatusResponse, error) {
+	if _, err := s.allow(ctx, false); err != nil {
+		return nil, err
+	}
+
+	status, err := s.Wpa.APStatus(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &grpc.ApStatusResponse{Fields: map[string]string{}, Clients: []*grpc.ApClient{}}
+	for key, value := range status {
+		switch value := value.(type) {
+		case string:
+			resp.Fields[key] = value
+		case []APClient:
+			for _, c := range value {
+				resp.Clients = append(resp.Clients, &grpc.ApClient{
+					Mac:           c.Mac,
+					Ip:            c.Ip,
+					Hostname:      c.Hostname,
+					Rssi:          int32(c.Rssi),
+					RxBytes:       c.RxBytes,
+					TxBytes:       c.TxBytes,
+					ConnectedTime: c.ConnectedTime,
+				})
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// WatchEvents implements grpc.Service.
+func (s *GRPCService) WatchEvents(ctx context.Context, req *grpc.WatchEventsRequest, send func(*grpc.Event) error) error {
+	if _, err := s.allow(ctx, false); err != nil {
+		return err
+	}
+
+	types := map[string]bool{}
+	for _, t := range req.Types {
+		types[t] = true
+	}
+
+	events, unsubscribe := s.Bus.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-events:
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+
+			err := send(&grpc.Event{
+				Type:       ev.Type,
+				Source:     ev.Source,
+				Iface:      ev.Iface,
+				Name:       ev.Name,
+				Message:    ev.Message,
+				TimeUnixMs: ev.Time.UnixNano() / int64(time.Millisecond),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// allow applies the rate limits to the client of a call, returning the
+// client it was counted against, "" for clients never limited.
+func (s *GRPCService) allow(ctx context.Context, connect bool) (string, error) {
+	host, _, err := net.SplitHostPort(grpc.Peer(ctx))
+	if s.Limiter == nil || err != nil || net.ParseIP(host).IsLoopback() || s.Limiter.Exempt(host) {
+		return "", nil
+	}
+
+	// clients on the AP by MAC, which survives a new lease
+	client := host
+	if mac := NeighborMac(host); mac != "" {
+		client = mac
+	}
+
+	if _, err := s.Limiter.Allow(client, connect); err != nil {
+		return client, grpcError(err)
+	}
+
+	return client, nil
+}
+
+// audit records a connect in the audit log.
+func (s *GRPCService) audit(ctx context.Context, ssid string, err error, duration time.Duration) {
+	if s.Audit == nil {
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(grpc.Peer(ctx))
+	entry := AuditEntry{
+		Transport: TransportGRPC,
+		Client:    host,
+		Mac:       NeighborMac(host),
+		Action:    CmdConnect,
+		Ssid:      ssid,
+		Success:   err == nil,
+		Duration:  duration,
+	}
+	if err != nil {
+		entry.Message = err.Error()
+	}
+
+	if err := s.Audit.Record(entry); err != nil {
+		s.Wpa.Log.Warn("could not write audit log", "error", err)
+	}
+}
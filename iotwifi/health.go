@@ -0,0 +1,185 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/dns"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// Kinds of HealthCheck.
+const (
+	CheckProcess   = "process"   // the daemon is running
+	CheckControl   = "control"   // its control socket answers PING
+	CheckInterface = "interface" // the network interface exists
+)
+
+// healthTimeout bounds each control socket check.
+const healthTimeout = 2 * time.Second
+
+// HealthCheck is the result of one check.
+type HealthCheck struct {
+	Name  string `json:"name"` // wpa_supplicant, hostapd, dnsmasq or the interface
+	Kind  string `json:"kind"`
+	Iface string `json:"iface,omitempty"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Health is the result of the checks of Liveness or Readiness, Ok when
+// all of them passed.
+type Health struct {
+	Ok     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// add records a check.
+func (h *Health) add(check HealthCheck, err error) {
+	check.Ok = err == nil
+	if err != nil {
+		check.Error = err.Error()
+		h.Ok = false
+	}
+	h.Checks = append(h.Checks, check)
+}
+
+// Liveness checks that wpa_supplicant, hostapd and dnsmasq are running
+// and that the wpa_supplicant of every station radio and hostapd answer
+// on their control sockets: what restarting the daemon would fix. In
+// NetworkManager mode NetworkManager is checked instead of the
+// wpa_supplicant control sockets.
+func (wpa *WpaCfg) Liveness(ctx context.Context) Health {
+	health := Health{Ok: true, Checks: []HealthCheck{}}
+	cfg := wpa.Cfg()
+
+	daemons := []string{ComponentWpaSupplicant, ComponentHostapd}
+	if cfg.NetworkManager.Enabled {
+		daemons = append(daemons, ComponentNetworkManager)
+	}
+	if !cfg.Bridge.Enabled && !cfg.DnsmasqCfg.Builtin {
+		daemons = append(daemons, ComponentDnsmasq) // a bridged AP runs none
+	}
+	for _, name := range daemons {
+		health.add(HealthCheck{Name: name, Kind: CheckProcess}, processRunning(name))
+	}
+
+	// NetworkManager runs wpa_supplicant without a control socket
+	if cfg.NetworkManager.Enabled {
+		health.add(HealthCheck{Name: ComponentNetworkManager, Kind: CheckControl, Iface: cfg.StationInterface}, pingNetworkManager(ctx, cfg.DBusSocket, cfg.StationInterface))
+	} else {
+		for _, iface := range wpa.stationInterfaces() {
+			health.add(HealthCheck{Name: ComponentWpaSupplicant, Kind: CheckControl, Iface: iface}, wpa.pingWpa(ctx, iface))
+		}
+	}
+	health.add(HealthCheck{Name: ComponentHostapd, Kind: CheckControl, Iface: cfg.APInterface}, pingHostapd(ctx, cfg.HostApdCfg.ctrlDir(), cfg.APInterface))
+
+	// the built-in servers run in txwifi, so answering is being alive
+	if !cfg.Bridge.Enabled && cfg.DnsmasqCfg.Builtin {
+		health.add(HealthCheck{Name: ComponentDnsmasq, Kind: CheckControl, Iface: cfg.APInterface}, pingDNS(ctx, cfg.HostApdCfg.Ip))
+	}
+
+	return health
+}
+
+// Readiness runs the Liveness checks and checks that the station and AP
+// interfaces exist, so the API can serve provisioning.
+func (wpa *WpaCfg) Readiness(ctx context.Context) Health {
+	health := wpa.Liveness(ctx)
+
+	ifaces := append(wpa.stationInterfaces(), wpa.Cfg().APInterface)
+	if bridge := wpa.Cfg().Bridge; bridge.Enabled {
+		ifaces = append(ifaces, bridge.Name)
+	}
+	for _, iface := range ifaces {
+		_, err := netif.LinkByName(iface)
+		health.add(HealthCheck{Name: iface, Kind: CheckInterface, Iface: iface}, err)
+	}
+
+	return health
+}
+
+// stationInterfaces returns the station interface and the interfaces of
+// the other station radios.
+func (wpa *WpaCfg) stationInterfaces() []string {
+	ifaces := []string{wpa.Cfg().StationInterface}
+	for _, radio := range wpa.Cfg().Radios {
+		ifaces = append(ifaces, radio.Interface)
+	}
+
+	return ifaces
+}
+
+// pingWpa pings the wpa_supplicant of iface.
+func (wpa *WpaCfg) pingWpa(ctx context.Context, iface string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	out, err := wpa.Runner.Request(ctx, iface, "PING")
+	if err != nil {
+		return err
+	}
+
+	return pong(out)
+}
+
+// pingDNS queries the built-in DNS server at ip.
+func pingDNS(ctx context.Context, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	return dns.Ping(ctx, net.JoinHostPort(ip, strconv.Itoa(dns.Port)))
+}
+
+// pingHostapd pings the hostapd of iface, whose socket is in dir.
+func pingHostapd(ctx context.Context, dir string, iface string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	conn, err := wpactl.Dial(filepath.Join(dir, iface))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	out, err := conn.RequestContext(ctx, "PING")
+	if err != nil {
+		return err
+	}
+
+	return pong(out)
+}
+
+// pong checks the reply to a PING.
+func pong(out []byte) error {
+	if reply := strings.TrimSpace(string(out)); reply != "PONG" {
+		return fmt.Errorf("PING answered %q", reply)
+	}
+
+	return nil
+}
+
+// processRunning returns an error unless a process named name runs,
+// looking through /proc so daemons started outside txwifi count too.
+func processRunning(name string) error {
+	paths, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil || len(paths) == 0 {
+		return fmt.Errorf("cannot list processes")
+	}
+
+	for _, path := range paths {
+		comm, err := ioutil.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(comm)) == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("not running")
+}
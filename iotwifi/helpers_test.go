@@ -0,0 +1,132 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kinokochat/txwifi/iotwifi/iotwifitest"
+)
+
+// newTestWpa produces a WpaCfg for wlan0 on a fake runner, with its
+// files in a temporary directory that is removed by the returned func.
+func newTestWpa(t testing.TB) (*WpaCfg, *iotwifitest.Runner, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "iotwifi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := iotwifitest.NewRunner()
+	wpa := &WpaCfg{
+		Log:    NewJSONLogger(ioutil.Discard, "test"),
+		Runner: runner,
+		WpaCfg: &SetupCfg{
+			Version:          CfgVersion,
+			StationInterface: "wlan0",
+			APInterface:      "uap0",
+			APSubnet:         "192.168.27.0/24",
+			WpaSupplicantCfg: WpaSupplicantCfg{CfgFile: filepath.Join(dir, "wpa_supplicant.conf")},
+			IdentityFile:     filepath.Join(dir, "identity.json"),
+			HostApdCfg: HostApdCfg{
+				Ssid:          "iot-wifi-test",
+				WpaPassphrase: "iotwifipass",
+				Channel:       "6",
+				ConfFile:      filepath.Join(dir, "hostapd.conf"),
+				PidFile:       filepath.Join(dir, "hostapd.pid"),
+			},
+		},
+	}
+
+	return wpa, runner, func() { os.RemoveAll(dir) }
+}
+
+// newStationWpa produces a WpaCfg on a fake runner whose station is the
+// loopback interface, which has an address right away, with a profile
+// store and without connectivity checks, so connects complete at once.
+// The network of home in use is saved with savedPsk and reads back
+// WPA-PSK as its key_mgmt.
+func newStationWpa(t *testing.T) (*WpaCfg, *iotwifitest.Runner, func()) {
+	t.Helper()
+
+	wpa, runner, cleanup := newTestWpa(t)
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		cfg.StationInterface = "lo"
+		cfg.Connectivity.Disabled = true
+	})
+	runner.Replies["GET_NETWORK 0 key_mgmt"] = "WPA-PSK\n"
+
+	conf := "ctrl_interface=DIR=/var/run/wpa_supplicant\n\nnetwork={\n\tssid=\"home\"\n\tpsk=\"" + savedPsk + "\"\n}\n"
+	if err := ioutil.WriteFile(wpa.Cfg().WpaSupplicantCfg.CfgFile, []byte(conf), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	profiles, err := NewProfileStore(filepath.Join(filepath.Dir(wpa.Cfg().HostApdCfg.ConfFile), "profiles.json"), nil)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	wpa.Profiles = profiles
+
+	return wpa, runner, cleanup
+}
+
+// callsSince returns the calls runner was sent after the first n.
+func callsSince(runner *iotwifitest.Runner, n int) []string {
+	return runner.Calls()[n:]
+}
+
+// testCfgFile writes the config of wpa to a file next to its hostapd.conf
+// and makes the config loaded back from it the config of wpa, so a reload
+// of an unchanged file changes nothing. It returns the file and a func
+// writing a config to it.
+func testCfgFile(t *testing.T, wpa *WpaCfg) (string, func(cfg *SetupCfg)) {
+	t.Helper()
+
+	location := filepath.Join(filepath.Dir(wpa.Cfg().HostApdCfg.ConfFile), "wificfg.json")
+	writeCfg := func(cfg *SetupCfg) {
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(location, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCfg(wpa.Cfg())
+	cfg, err := loadCfg(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wpa.SetCfg(cfg)
+
+	return location, writeCfg
+}
+
+// hasCall reports whether runner was sent call.
+func hasCall(runner *iotwifitest.Runner, call string) bool {
+	for _, c := range runner.Calls() {
+		if c == call {
+			return true
+		}
+	}
+
+	return false
+}
+
+// countCalls returns how many times runner was sent call.
+func countCalls(runner *iotwifitest.Runner, call string) int {
+	n := 0
+	for _, c := range runner.Calls() {
+		if c == call {
+			n++
+		}
+	}
+
+	return n
+}
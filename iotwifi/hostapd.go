@@ -0,0 +1,448 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// DefaultHostapdConf is where the generated hostapd.conf is written when
+// HostApdCfg.ConfFile is empty.
+const DefaultHostapdConf = "/etc/hostapd/hostapd.conf"
+
+// HostapdPidFile is where hostapd writes its pid, used to signal a
+// reload, unless HostApdCfg.PidFile says otherwise.
+const HostapdPidFile = "/var/run/hostapd.pid"
+
+// hostapdTemplate generates hostapd.conf from hostapdConf.
+var hostapdTemplate = template.Must(template.New("hostapd.conf").Parse(`interface={{.Interface}}
+{{- if .Bridge}}
+bridge={{.Bridge}}
+{{- end}}
+{{- if .SsidHex}}
+ssid2={{.SsidHex}}
+{{- if .Utf8Ssid}}
+utf8_ssid=1
+{{- end}}
+{{- else}}
+ssid={{.Ssid}}
+{{- end}}
+hw_mode={{.HwMode}}
+channel={{.Channel}}
+{{- if .CountryCode}}
+country_code={{.CountryCode}}
+ieee80211d=1
+{{- end}}
+ctrl_interface={{.CtrlDir}}
+ctrl_interface_group=0
+macaddr_acl={{if .AcceptMacFile}}1{{else}}0{{end}}
+{{- if .AcceptMacFile}}
+accept_mac_file={{.AcceptMacFile}}
+{{- end}}
+{{- if .DenyMacFile}}
+deny_mac_file={{.DenyMacFile}}
+{{- end}}
+auth_algs=1
+ignore_broadcast_ssid={{if .Hidden}}1{{else}}0{{end}}
+{{- if .MaxNumSta}}
+max_num_sta={{.MaxNumSta}}
+{{- end}}
+{{- if .Wmm}}
+wmm_enabled=1
+{{- end}}
+{{- if .Ieee80211n}}
+ieee80211n=1
+{{- end}}
+{{- if .Ieee80211ac}}
+ieee80211ac=1
+{{- end}}
+{{- if .Ieee80211ax}}
+ieee80211ax=1
+{{- end}}
+wpa=2
+wpa_passphrase={{.WpaPassphrase}}
+wpa_key_mgmt={{.KeyMgmt}}
+{{- if .Pmf}}
+ieee80211w={{.Pmf}}
+{{- end}}
+{{- if .Tkip}}
+wpa_pairwise=TKIP
+{{- end}}
+rsn_pairwise=CCMP
+{{- if .Wps}}
+wps_state=2
+eap_server=1
+config_methods=push_button virtual_push_button keypad
+{{- end}}
+`))
+
+// hostapdConf is the data hostapdTemplate is executed with.
+type hostapdConf struct {
+	HostApdCfg
+	Interface     string
+	KeyMgmt       string
+	Pmf           string
+	Tkip          bool
+	AcceptMacFile string
+	DenyMacFile   string
+	CtrlDir       string
+	SsidHex       string // an ssid that is not plain ASCII, in hex
+	Utf8Ssid      bool
+}
+
+// MacACL lists the stations allowed on or denied from the AP. A non-empty
+// Allow list denies every station not on it.
+type MacACL struct {
+	Allow []string
+	Deny  []string
+}
+
+// Validate checks every entry is a MAC address.
+func (acl MacACL) Validate() error {
+	for _, mac := range append(append([]string{}, acl.Allow...), acl.Deny...) {
+		if !macR.MatchString(mac) {
+			return fmt.Errorf("invalid mac address %q", mac)
+		}
+	}
+
+	return nil
+}
+
+// confPath returns the hostapd.conf path for cfg.
+func (h HostApdCfg) confPath() string {
+	if h.ConfFile != "" {
+		return h.ConfFile
+	}
+
+	return DefaultHostapdConf
+}
+
+// ctrlDir returns the directory of the hostapd control sockets.
+func (h HostApdCfg) ctrlDir() string {
+	if h.CtrlDir != "" {
+		return h.CtrlDir
+	}
+
+	return HostapdCtrlDir
+}
+
+// pidFile returns where hostapd writes its pid.
+func (h HostApdCfg) pidFile() string {
+	if h.PidFile != "" {
+		return h.PidFile
+	}
+
+	return HostapdPidFile
+}
+
+// aclFiles returns the accept and deny MAC file paths, next to hostapd.conf.
+func (h HostApdCfg) aclFiles() (string, string) {
+	dir := filepath.Dir(h.confPath())
+	return filepath.Join(dir, "hostapd.accept"), filepath.Join(dir, "hostapd.deny")
+}
+
+// channels5 are the 20 MHz 5GHz channels hostapd accepts.
+var channels5 = map[int]bool{
+	36: true, 40: true, 44: true, 48: true, 52: true, 56: true, 60: true, 64: true,
+	100: true, 104: true, 108: true, 112: true, 116: true, 120: true, 124: true,
+	128: true, 132: true, 136: true, 140: true, 144: true,
+	149: true, 153: true, 157: true, 161: true, 165: true,
+}
+
+// withDefaults fills in the band and hw_mode from each other.
+func (h HostApdCfg) withDefaults() HostApdCfg {
+	if h.Band == "" {
+		h.Band = Band24
+		if h.HwMode == "a" {
+			h.Band = Band5
+		}
+	}
+
+	if h.HwMode == "" {
+		h.HwMode = "g"
+		if h.Band == Band5 {
+			h.HwMode = "a"
+		}
+	}
+
+	if h.WpaKeyMgmt == "" {
+		h.WpaKeyMgmt = KeyMgmtWpaPsk
+	}
+
+	return h
+}
+
+// Validate rejects AP settings hostapd would refuse or misapply, such as
+// a 5GHz channel on the 2.4GHz band.
+func (h HostApdCfg) Validate() error {
+	h = h.withDefaults()
+
+	if err := ValidateSsid(h.Ssid); err != nil {
+		return err
+	}
+	if len(h.WpaPassphrase) < 8 || len(h.WpaPassphrase) > 63 {
+		return fmt.Errorf("wpa_passphrase must be 8-63 characters")
+	}
+	for _, c := range h.WpaPassphrase {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("wpa_passphrase must be printable ASCII")
+		}
+	}
+
+	channel, err := strconv.Atoi(h.Channel)
+	if err != nil {
+		return fmt.Errorf("invalid channel %q", h.Channel)
+	}
+
+	switch h.Band {
+	case Band24:
+		if h.HwMode != "g" && h.HwMode != "b" {
+			return fmt.Errorf("hw_mode %s is not valid on %s", h.HwMode, h.Band)
+		}
+		if channel < 1 || channel > 14 {
+			return fmt.Errorf("channel %d is not a %s channel", channel, h.Band)
+		}
+		if h.Ieee80211ac {
+			return fmt.Errorf("ieee80211ac requires %s", Band5)
+		}
+	case Band5:
+		if h.HwMode != "a" {
+			return fmt.Errorf("hw_mode %s is not valid on %s", h.HwMode, h.Band)
+		}
+		if !channels5[channel] {
+			return fmt.Errorf("channel %d is not a %s channel", channel, h.Band)
+		}
+		if h.CountryCode == "" {
+			return fmt.Errorf("%s requires a country_code", h.Band)
+		}
+	default:
+		return fmt.Errorf("unsupported band %q", h.Band)
+	}
+
+	if h.CountryCode != "" && (h.CountryCode == CountryWorld || !ValidCountry(h.CountryCode)) {
+		return fmt.Errorf("invalid country_code %q", h.CountryCode)
+	}
+	if h.MaxNumSta < 0 || h.MaxNumSta > 2007 {
+		return fmt.Errorf("max_num_sta must be 0-2007")
+	}
+
+	switch h.WpaKeyMgmt {
+	case KeyMgmtWpaPsk, KeyMgmtSae, KeyMgmtTransition:
+	default:
+		return fmt.Errorf("unsupported wpa_key_mgmt %q", h.WpaKeyMgmt)
+	}
+
+	// hostapd refuses WPS on hidden and WPA3-only networks
+	if h.Wps && h.Hidden {
+		return fmt.Errorf("wps requires a broadcast ssid")
+	}
+	if h.Wps && h.WpaKeyMgmt == KeyMgmtSae {
+		return fmt.Errorf("wps requires %s or %s", KeyMgmtWpaPsk, KeyMgmtTransition)
+	}
+
+	return nil
+}
+
+// RenderHostapdConf validates cfg and renders hostapd.conf for iface.
+func RenderHostapdConf(iface string, cfg HostApdCfg, acl MacACL) ([]byte, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := acl.Validate(); err != nil {
+		return nil, err
+	}
+	cfg = cfg.withDefaults()
+
+	conf := hostapdConf{
+		HostApdCfg: cfg,
+		Interface:  iface,
+		CtrlDir:    cfg.ctrlDir(),
+		KeyMgmt:    cfg.WpaKeyMgmt,
+		Pmf:        pmfFor(cfg.WpaKeyMgmt),
+		// SAE only allows CCMP, keep TKIP for older WPA-PSK clients
+		Tkip: cfg.WpaKeyMgmt != KeyMgmtSae,
+	}
+
+	if !plainSsid(cfg.Ssid) {
+		conf.SsidHex, conf.Utf8Ssid = EncodeSsid(cfg.Ssid), utf8Ssid(cfg.Ssid)
+	}
+
+	acceptFile, denyFile := cfg.aclFiles()
+	if len(acl.Allow) > 0 {
+		conf.AcceptMacFile = acceptFile
+	}
+	if len(acl.Deny) > 0 {
+		conf.DenyMacFile = denyFile
+	}
+
+	var buf bytes.Buffer
+	if err := hostapdTemplate.Execute(&buf, conf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriteHostapdConf renders and writes hostapd.conf and its MAC files for
+// iface, returning the path of hostapd.conf.
+func WriteHostapdConf(iface string, cfg HostApdCfg, acl MacACL) (string, error) {
+	data, err := RenderHostapdConf(iface, cfg, acl)
+	if err != nil {
+		return "", err
+	}
+
+	path := cfg.confPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	acceptFile, denyFile := cfg.aclFiles()
+	if err := writeMacFile(acceptFile, acl.Allow); err != nil {
+		return "", err
+	}
+	if err := writeMacFile(denyFile, acl.Deny); err != nil {
+		return "", err
+	}
+
+	// keep the host's own hostapd.conf so Shutdown can put it back
+	if err := backupFile(path); err != nil {
+		return "", err
+	}
+
+	// the file holds the passphrase
+	return path, ioutil.WriteFile(path, data, 0600)
+}
+
+// writeMacFile writes one MAC address per line, as hostapd expects.
+func writeMacFile(path string, macs []string) error {
+	data := ""
+	for _, mac := range macs {
+		data += strings.ToLower(mac) + "\n"
+	}
+
+	return ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// APConfig holds the AP settings that can be changed at runtime. Empty
+// fields keep their current value.
+type APConfig struct {
+	Ssid          string `json:"ssid"`
+	WpaPassphrase string `json:"wpa_passphrase"`
+	Channel       string `json:"channel"`
+	WpaKeyMgmt    string `json:"wpa_key_mgmt"`
+}
+
+// apply returns h with the non-empty fields of cfg applied.
+func (cfg APConfig) apply(h HostApdCfg) HostApdCfg {
+	if cfg.Ssid != "" {
+		h.Ssid = cfg.Ssid
+	}
+	if cfg.WpaPassphrase != "" {
+		h.WpaPassphrase = cfg.WpaPassphrase
+	}
+	if cfg.Channel != "" {
+		h.Channel = cfg.Channel
+	}
+	if cfg.WpaKeyMgmt != "" {
+		h.WpaKeyMgmt = cfg.WpaKeyMgmt
+	}
+
+	return h
+}
+
+// reloadHostapd sends SIGHUP to the hostapd that wrote pidFile, which
+// makes it re-read hostapd.conf without dropping the interface.
+func reloadHostapd(pidFile string) error {
+	pidData, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidData)))
+	if err != nil {
+		return err
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return proc.Signal(syscall.SIGHUP)
+}
+
+// ReconfigureAP applies cfg to the running AP: it rewrites hostapd.conf,
+// signals hostapd to reload it and returns the new AP status.
+func (wpa *WpaCfg) ReconfigureAP(ctx context.Context, cfg APConfig) (map[string]interface{}, error) {
+	hostApdCfg := cfg.apply(wpa.Cfg().HostApdCfg)
+	if err := wpa.applyHostapdCfg(hostApdCfg); err != nil {
+		return nil, err
+	}
+
+	wpa.Log.Info("ap reconfigured", "iface", wpa.Cfg().APInterface, "ssid", hostApdCfg.Ssid, "channel", hostApdCfg.Channel)
+
+	// give hostapd a moment to bring the BSS back up
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(2 * time.Second):
+	}
+
+	return wpa.APStatus(ctx)
+}
+
+// applyHostapdCfg writes hostApdCfg to hostapd.conf and makes hostapd
+// reload it. Settings hostapd would refuse are an ErrInvalid.
+func (wpa *WpaCfg) applyHostapdCfg(hostApdCfg HostApdCfg) error {
+	if err := hostApdCfg.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	if _, err := WriteHostapdConf(wpa.Cfg().APInterface, hostApdCfg, wpa.Cfg().MacACL()); err != nil {
+		return err
+	}
+
+	if err := reloadHostapd(hostApdCfg.pidFile()); err != nil {
+		return fmt.Errorf("reloading hostapd: %w", err)
+	}
+
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		cfg.HostApdCfg = hostApdCfg
+	})
+
+	return nil
+}
+
+// EnableAP starts the AP beaconing again after DisableAP.
+func (wpa *WpaCfg) EnableAP(ctx context.Context) error {
+	if err := wpa.hostapdCli(ctx, "enable"); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("ap enabled", "iface", wpa.Cfg().APInterface)
+	wpa.record(HistoryEntry{Type: HistoryAPUp, Iface: wpa.Cfg().APInterface, Success: true})
+
+	return nil
+}
+
+// DisableAP stops the AP, disconnecting its clients. hostapd keeps
+// running so EnableAP can bring it back. The AP stays off across
+// restarts until EnableAP.
+func (wpa *WpaCfg) DisableAP(ctx context.Context) error {
+	if err := wpa.hostapdCli(ctx, "disable"); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("ap disabled", "iface", wpa.Cfg().APInterface)
+	wpa.record(HistoryEntry{Type: HistoryAPDown, Iface: wpa.Cfg().APInterface, Success: true})
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package iotwifi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdentityFile is where the device identity is stored.
+const DefaultIdentityFile = "/etc/txwifi/identity.json"
+
+// DefaultSsidPrefix starts the default AP ssid, TXWIFI-3456.
+const DefaultSsidPrefix = "TXWIFI-"
+
+// pskAlphabet leaves out characters easily confused on a printed label,
+// 0 and O, 1, l and I.
+const pskAlphabet = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// pskLength is the length of a generated passphrase, about 70 bits.
+const pskLength = 12
+
+// Identity tells one device from the next: its id and the default AP
+// ssid and passphrase, generated on first boot and kept in the identity
+// file so they survive reboots and upgrades.
+type Identity struct {
+	DeviceId      string    `json:"device_id"`                // b827eb123456, the MAC of the station interface
+	Ssid          string    `json:"ssid"`                     // TXWIFI-3456, the default AP ssid
+	WpaPassphrase string    `json:"wpa_passphrase,omitempty"` // the default AP passphrase, random
+	Created       time.Time `json:"created"`
+}
+
+// identityMu keeps RunWifi and the API, which load the config at the same
+// time on first boot, from generating two identities.
+var identityMu sync.Mutex
+
+// LoadIdentity reads the identity in path, generating and storing one for
+// the MAC of iface if there is none yet.
+func LoadIdentity(path string, iface string) (Identity, error) {
+	if path == "" {
+		path = DefaultIdentityFile
+	}
+
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	var identity Identity
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &identity); err != nil {
+			return identity, fmt.Errorf("%s: %s", path, err)
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return identity, err
+	}
+
+	identity, err = newIdentity(iface)
+	if err != nil {
+		return identity, err
+	}
+
+	data, err = json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return identity, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return identity, err
+	}
+
+	// the passphrase is a secret
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return identity, err
+	}
+
+	return identity, os.Rename(tmp, path)
+}
+
+// newIdentity derives the id and ssid from the MAC of iface, or from
+// random bytes when iface has none, and picks a random passphrase.
+func newIdentity(iface string) (Identity, error) {
+	mac := []byte{}
+	if ifi, err := net.InterfaceByName(iface); err == nil {
+		mac = ifi.HardwareAddr
+	}
+	if len(mac) < 2 {
+		mac = make([]byte, 6)
+		if _, err := rand.Read(mac); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	psk, err := randomPsk()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return Identity{
+		DeviceId:      hex.EncodeToString(mac),
+		Ssid:          DefaultSsidPrefix + strings.ToUpper(hex.EncodeToString(mac[len(mac)-2:])),
+		WpaPassphrase: psk,
+		Created:       time.Now().UTC(),
+	}, nil
+}
+
+// randomPsk returns pskLength random characters of pskAlphabet.
+func randomPsk() (string, error) {
+	psk := make([]byte, pskLength)
+	max := big.NewInt(int64(len(pskAlphabet)))
+	for i := range psk {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		psk[i] = pskAlphabet[n.Int64()]
+	}
+
+	return string(psk), nil
+}
+
+// applyIdentity fills in the AP ssid and passphrase the config leaves
+// out from the device identity, so no two devices share them.
+func applyIdentity(cfg *SetupCfg) error {
+	if cfg.HostApdCfg.Ssid != "" && cfg.HostApdCfg.WpaPassphrase != "" {
+		return nil
+	}
+
+	identity, err := LoadIdentity(cfg.IdentityFile, cfg.StationInterface)
+	if err != nil {
+		return err
+	}
+
+	if cfg.HostApdCfg.Ssid == "" {
+		cfg.HostApdCfg.Ssid = identity.Ssid
+	}
+	if cfg.HostApdCfg.WpaPassphrase == "" {
+		cfg.HostApdCfg.WpaPassphrase = identity.WpaPassphrase
+	}
+
+	return nil
+}
+
+// Identity returns the device identity, generating it if this is the
+// first boot.
+func (wpa *WpaCfg) Identity() (Identity, error) {
+	return LoadIdentity(wpa.Cfg().IdentityFile, wpa.Cfg().StationInterface)
+}
+
+// Redacted returns identity without the passphrase, for clients that
+// are not on the API socket.
+func (identity Identity) Redacted() Identity {
+	identity.WpaPassphrase = ""
+
+	return identity
+}
@@ -0,0 +1,37 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIdentityRedacted(t *testing.T) {
+	wpa, _, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	identity, err := wpa.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.WpaPassphrase == "" {
+		t.Fatal("generated identity has no passphrase")
+	}
+
+	data, err := json.Marshal(identity.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "wpa_passphrase") || strings.Contains(string(data), identity.WpaPassphrase) {
+		t.Errorf("redacted identity %s has the passphrase", data)
+	}
+
+	// the stored identity keeps it
+	again, err := wpa.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != identity {
+		t.Errorf("identity changed from %+v to %+v", identity, again)
+	}
+}
@@ -0,0 +1,103 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// RadioCfg configures an additional station radio, such as a USB dongle
+// beside the onboard wifi, and is used by SetupCfg. Each radio runs its
+// own wpa_supplicant.
+type RadioCfg struct {
+	Interface        string           `json:"interface"`          // wlan1
+	StationIP        StaticIPCfg      `json:"station_ip"`         // static address, DHCP if empty
+	WpaSupplicantCfg WpaSupplicantCfg `json:"wpa_supplicant_cfg"` // cfg_file must differ from the other radios'
+}
+
+// radioComponent is the command id of the wpa_supplicant of a radio.
+func radioComponent(iface string) string {
+	return ComponentWpaSupplicant + ":" + iface
+}
+
+// radioCfg returns a copy of s for the radio, with the station settings
+// replaced by the radio's.
+func (s *SetupCfg) radioCfg(radio RadioCfg) *SetupCfg {
+	cfg := *s
+	cfg.StationInterface = radio.Interface
+	cfg.StationIP = radio.StationIP
+	cfg.WpaSupplicantCfg = radio.WpaSupplicantCfg
+	cfg.WpaSupplicantCfg.CtrlDir = s.WpaSupplicantCfg.CtrlDir
+	cfg.Radios = nil
+
+	return &cfg
+}
+
+// InterfaceManager addresses the station radios by interface name: the
+// station interface of the config and its additional radios. Every radio
+// is a WpaCfg of its own, so it can be scanned, connected and queried
+// like the station interface.
+type InterfaceManager struct {
+	names  []string
+	radios map[string]*WpaCfg
+}
+
+// NewInterfaceManager produces an InterfaceManager for the station
+// interface of wpa and the radios in its config.
+func NewInterfaceManager(wpa *WpaCfg) *InterfaceManager {
+	m := &InterfaceManager{
+		names:  []string{wpa.Cfg().StationInterface},
+		radios: map[string]*WpaCfg{wpa.Cfg().StationInterface: wpa},
+	}
+
+	for _, radio := range wpa.Cfg().Radios {
+		m.names = append(m.names, radio.Interface)
+		m.radios[radio.Interface] = &WpaCfg{
+			Log:      wpa.Log,
+			WpaCmd:   wpa.WpaCmd,
+			WpaCfg:   wpa.Cfg().radioCfg(radio),
+			Profiles: wpa.Profiles,
+			Runner:   wpa.Runner,
+			Bus:      wpa.Bus,
+			OUI:      wpa.OUI,
+		}
+	}
+
+	return m
+}
+
+// Names returns the station interfaces, the configured station interface
+// first.
+func (m *InterfaceManager) Names() []string {
+	return append([]string{}, m.names...)
+}
+
+// Get returns the WpaCfg of the station interface iface.
+func (m *InterfaceManager) Get(iface string) (*WpaCfg, error) {
+	wpa, ok := m.radios[iface]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownInterface, iface)
+	}
+
+	return wpa, nil
+}
+
+// Radios returns the WpaCfg of the additional radios, in config order.
+func (m *InterfaceManager) Radios() []*WpaCfg {
+	radios := []*WpaCfg{}
+	for _, name := range m.names[1:] {
+		radios = append(radios, m.radios[name])
+	}
+
+	return radios
+}
+
+// WatchEvents publishes the wpa_supplicant events of the additional
+// radios to bus until ctx is done. The station interface is watched by
+// its WpaCfg.
+func (m *InterfaceManager) WatchEvents(ctx context.Context, bus *EventBus) {
+	for _, name := range m.names[1:] {
+		dir := m.radios[name].WpaCfg.WpaSupplicantCfg.ctrlDir()
+		go watchCtrl(ctx, bus, "wpa_supplicant", name, filepath.Join(dir, name))
+	}
+}
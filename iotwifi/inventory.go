@@ -0,0 +1,152 @@
+package iotwifi
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Where an APDevice was found.
+const (
+	SourceHostapd  = "hostapd"  // associated with the AP
+	SourceLease    = "lease"    // holds a DHCP lease
+	SourceNeighbor = "neighbor" // in the kernel's neighbor table of the AP
+)
+
+// APDevice is a device on the AP, merged from the stations hostapd has
+// associated, the DHCP leases and the neighbor table, so one entry says
+// what a device is and when it was last seen, whether it is still
+// associated or not.
+type APDevice struct {
+	Mac           string     `json:"mac"`
+	Ip            string     `json:"ip"`
+	Ipv6          []string   `json:"ipv6"`
+	Hostname      string     `json:"hostname"`
+	Vendor        string     `json:"vendor"`     // from the OUI of the mac, empty when unknown
+	RandomMac     bool       `json:"random_mac"` // a locally administered mac, as phones randomize, without a vendor
+	Associated    bool       `json:"associated"`
+	Rssi          int        `json:"rssi,omitempty"`           // dBm, while associated
+	ConnectedTime int64      `json:"connected_time,omitempty"` // seconds, while associated
+	LeaseExpiry   *time.Time `json:"lease_expiry,omitempty"`
+	LastSeen      *time.Time `json:"last_seen,omitempty"` // last traffic hostapd or the neighbor table saw
+	Sources       []string   `json:"sources"`             // hostapd, lease and neighbor
+}
+
+// apNeighborInterface returns the interface the neighbors of the AP
+// clients are on, the bridge when the AP is bridged.
+func (wpa *WpaCfg) apNeighborInterface() string {
+	if wpa.Cfg().Bridge.Enabled {
+		return wpa.Cfg().Bridge.withDefaults().Name
+	}
+
+	return wpa.Cfg().APInterface
+}
+
+// APInventory returns the devices on the AP, associated ones first and
+// then by the time they were last seen. A bridged AP shares its neighbor
+// table with the wired network, so there only the neighbors that are
+// associated or hold a lease are listed. A source that cannot be read
+// is left out.
+func (wpa *WpaCfg) APInventory(ctx context.Context) []APDevice {
+	now := time.Now()
+	devices := map[string]*APDevice{}
+
+	device := func(mac string) *APDevice {
+		mac = strings.ToLower(mac)
+		d, ok := devices[mac]
+		if !ok {
+			d = &APDevice{Mac: mac, Ipv6: []string{}, Sources: []string{}}
+			devices[mac] = d
+		}
+		return d
+	}
+	seen := func(d *APDevice, t time.Time) {
+		if d.LastSeen == nil || t.After(*d.LastSeen) {
+			d.LastSeen = &t
+		}
+	}
+
+	// a down AP has no stations, the leases and neighbors still say who
+	// was on it
+	clients, err := wpa.APClients(ctx)
+	if err != nil {
+		wpa.Log.Debug("inventory without stations", "iface", wpa.Cfg().APInterface, "error", err)
+	}
+	for _, client := range clients {
+		d := device(client.Mac)
+		d.Associated = true
+		d.Rssi = client.Rssi
+		d.ConnectedTime = client.ConnectedTime
+		d.Sources = append(d.Sources, SourceHostapd)
+		seen(d, now.Add(-time.Duration(client.InactiveMsec)*time.Millisecond))
+	}
+
+	leases, err := dhcp.ReadLeases(wpa.leaseFile())
+	if err != nil {
+		wpa.Log.Error("could not read leases", "path", wpa.leaseFile(), "error", err)
+	}
+	for _, lease := range leases {
+		d := device(lease.Mac)
+		d.Ip = lease.Ip
+		d.Hostname = lease.Hostname
+		if !lease.Expiry.IsZero() {
+			expiry := lease.Expiry
+			d.LeaseExpiry = &expiry
+		}
+		d.Sources = append(d.Sources, SourceLease)
+	}
+
+	iface := wpa.apNeighborInterface()
+	neighbors, err := netif.Neighbors(iface)
+	if err != nil {
+		wpa.Log.Debug("inventory without neighbors", "iface", iface, "error", err)
+	}
+	for _, neighbor := range neighbors {
+		if _, ok := devices[neighbor.Mac]; !ok && wpa.Cfg().Bridge.Enabled {
+			continue
+		}
+
+		d := device(neighbor.Mac)
+		if ip := net.ParseIP(neighbor.Ip); ip.To4() != nil {
+			if d.Ip == "" {
+				d.Ip = neighbor.Ip
+			}
+		} else {
+			d.Ipv6 = append(d.Ipv6, neighbor.Ip)
+		}
+		if len(d.Sources) == 0 || d.Sources[len(d.Sources)-1] != SourceNeighbor {
+			d.Sources = append(d.Sources, SourceNeighbor)
+		}
+		if neighbor.State != "permanent" {
+			seen(d, now.Add(-neighbor.Confirmed))
+		}
+	}
+
+	inventory := []APDevice{}
+	for _, d := range devices {
+		d.Vendor = wpa.OUI.Vendor(d.Mac)
+		d.RandomMac = randomMac(d.Mac)
+		inventory = append(inventory, *d)
+	}
+
+	sort.Slice(inventory, func(i, j int) bool {
+		a, b := inventory[i], inventory[j]
+		if a.Associated != b.Associated {
+			return a.Associated
+		}
+		if (a.LastSeen == nil) != (b.LastSeen == nil) {
+			return a.LastSeen != nil
+		}
+		if a.LastSeen != nil && !a.LastSeen.Equal(*b.LastSeen) {
+			return a.LastSeen.After(*b.LastSeen)
+		}
+		return a.Mac < b.Mac
+	})
+
+	return inventory
+}
@@ -5,26 +5,27 @@
 package iotwifi
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/kinokochat/txwifi/iotwifi/cfgfile"
+	"github.com/kinokochat/txwifi/iotwifi/process"
 )
 
-// CmdRunner runs internal commands allows output handlers to be attached.
+// CmdRunner dispatches internal command messages, such as kill, to the
+// handlers attached for their ids.
 type CmdRunner struct {
-	Log      bunyan.Logger
+	Log      Logger
 	Messages chan CmdMessage
 	Handlers map[string]func(CmdMessage)
-	Commands map[string]*exec.Cmd
 }
 
 // CmdMessage structures command output.
@@ -37,197 +38,311 @@ type CmdMessage struct {
 	Stdin   *io.WriteCloser
 }
 
-// loadCfg loads the configuration.
-func loadCfg(cfgLocation string) (*SetupCfg, error) {
-
-	v := &SetupCfg{}
-	var jsonData []byte
+// cfgTimeout bounds fetching a config from a URL.
+const cfgTimeout = 30 * time.Second
 
-	urlDelimR, _ := regexp.Compile("://")
-	isUrl := urlDelimR.Match([]byte(cfgLocation))
+// maxCfgSize bounds the size of a config.
+const maxCfgSize = 1 << 20
 
-	// if not a url
-	if !isUrl {
-		fileData, err := ioutil.ReadFile(cfgLocation)
-		if err != nil {
-			panic(err)
-		}
-		jsonData = fileData
+// loadCfg loads the configuration from a file or an http(s) URL. It may
+// be JSON, YAML or TOML, as told by its extension, content type or
+// content.
+func loadCfg(cfgLocation string) (*SetupCfg, error) {
+	data, name, contentType, err := readCfg(cfgLocation)
+	if err != nil {
+		return &SetupCfg{}, err
 	}
 
-	if isUrl {
-		res, err := http.Get(cfgLocation)
-		if err != nil {
-			panic(err)
-		}
-
-		defer res.Body.Close()
+	return parseCfg(data, cfgfile.Detect(name, contentType, data))
+}
 
-		urlData, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			panic(err)
-		}
+// readCfg reads the config at location and returns it with the name and
+// content type its format is detected from.
+func readCfg(location string) ([]byte, string, string, error) {
+	cfgUrl, err := url.Parse(location)
+	if err != nil || !strings.Contains(location, "://") {
+		data, err := ioutil.ReadFile(location)
+		return data, location, "", err
+	}
 
-		jsonData = urlData
+	switch cfgUrl.Scheme {
+	case "file":
+		data, err := ioutil.ReadFile(cfgUrl.Path)
+		return data, cfgUrl.Path, "", err
+	case "http", "https":
+	default:
+		return nil, "", "", fmt.Errorf("unsupported config url scheme %q", cfgUrl.Scheme)
 	}
 
-	err := json.Unmarshal(jsonData, v)
+	client := &http.Client{Timeout: cfgTimeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
 
-	return v, err
-}
+	if res.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("get %s: %s", location, res.Status)
+	}
 
-// EthActive checks if the ethernet interface is active
-func EthActive() bool {
-	ethOut, err := exec.Command("ethtool", "eth0").Output()
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCfgSize))
 	if err != nil {
-		panic(err)
+		return nil, "", "", err
 	}
-	return strings.Contains(string(ethOut), "Link detected: yes")
+
+	return data, cfgUrl.Path, res.Header.Get("Content-Type"), nil
 }
 
-// RunWifi starts AP and Station modes.
-func RunWifi(log bunyan.Logger, messages chan CmdMessage, cfgLocation string) {
+// shutdownTimeout bounds the cleanup RunWifi does once its context is done.
+const shutdownTimeout = 15 * time.Second
 
-	log.Info("Loading IoT Wifi...")
+// RunWifi starts AP and Station modes on wpacfg and its station radios,
+// the daemons under processes, whose output events go to bus in output
+// mode. wpacfg is the one the API and the transports use, so they share
+// its config and its operation queue. If the config enables it, the
+// supervisor is then left watching the started components. When ctx is
+// done the configuration is saved and everything is shut down before
+// RunWifi returns.
+func RunWifi(ctx context.Context, wpacfg *WpaCfg, interfaces *InterfaceManager, messages chan CmdMessage, bus *EventBus, supervisor *Supervisor, processes *process.Supervisor) {
+	log := wpacfg.Log
+	setupCfg := wpacfg.Cfg()
 
-	cmdRunner := CmdRunner{
+	log.Info("starting iot wifi", "iface", setupCfg.StationInterface, "ap_iface", setupCfg.APInterface)
+
+	cmdRunner := &CmdRunner{
 		Log:      log,
 		Messages: messages,
 		Handlers: make(map[string]func(cmsg CmdMessage), 0),
-		Commands: make(map[string]*exec.Cmd, 0),
 	}
 
-	setupCfg, err := loadCfg(cfgLocation)
-	if err != nil {
-		log.Error("Could not load config: %s", err.Error())
-		return
-	}
+	// hostapd, dnsmasq and wpa_supplicant run under the process
+	// supervisor, restarted as their policies say
+	processes.Log = log
+	ConfigureProcesses(processes, setupCfg.Processes)
 
 	command := &Command{
-		Log:      log,
-		Runner:   cmdRunner,
-		SetupCfg: setupCfg,
+		Log:       log,
+		Processes: processes,
+		Bus:       bus,
+		Cfg:       wpacfg.Cfg,
 	}
 
 	// listen to kill messages
 	cmdRunner.HandleFunc("kill", func(cmsg CmdMessage) {
-		log.Error("GOT KILL")
+		log.Error("got kill")
 		os.Exit(1)
 	})
 
-	wpacfg := NewWpaCfg(log, cfgLocation)
+	// a container without the capabilities, devices and mounts txwifi
+	// needs fails in confusing ways later, say what is missing instead
+	if report := wpacfg.Preflight(); !report.Ok {
+		for _, check := range report.Checks {
+			if !check.Ok {
+				log.Error("preflight check failed", "check", check.Name, "container", report.Container, "error", check.Error, "hint", check.Hint)
+			}
+		}
+		if !setupCfg.Preflight.WarnOnly {
+			log.Error("not starting", "error", report.Err())
+			return
+		}
+	}
 
-	// bring up soft AP
-	command.RemoveApInterface()
-	command.AddApInterface()
-	command.UpApInterface()
-	command.ConfigureApInterface()
-	command.StartHostapd(wpacfg.WpaCfg.HostApdCfg.Ssid, wpacfg.WpaCfg.HostApdCfg.WpaPassphrase, wpacfg.WpaCfg.HostApdCfg.Channel)
+	// in NetworkManager mode the station is NetworkManager's, txwifi
+	// only keeps the AP interface to itself
+	var nm *NetworkManager
+	if setupCfg.NetworkManager.Enabled {
+		nm = NewNetworkManager(wpacfg)
+		defer nm.Close()
 
-	time.Sleep(10 * time.Second)
+		if len(setupCfg.Radios) > 0 {
+			log.Warn("radios are not started in NetworkManager mode", "iface", setupCfg.StationInterface)
+		}
+	}
 
-	// Start supplicant and attempt to connect
-	command.StartWpaSupplicant()
+	// another network manager claiming the interfaces fights over them
+	// with wpa_supplicant and hostapd
+	if !setupCfg.Conflicts.Disabled {
+		conflicts := wpacfg.Conflicts(ctx)
+		if setupCfg.Conflicts.Fix && len(conflicts) > 0 {
+			conflicts = wpacfg.FixConflicts(ctx, conflicts)
+		}
+		for _, c := range conflicts {
+			log.Warn("network manager conflict", "manager", c.Manager, "iface", c.Iface, "detail", c.Detail, "hint", c.Hint, "fixed", c.Fixed)
+		}
+	}
 
-	// Do a single scan
-	time.Sleep(5 * time.Second)
-	wpacfg.ScanNetworks()
+	// a blocked radio can neither scan nor run the AP
+	wpacfg.UnblockRadios()
 
-	command.StartDnsmasq()
+	// the regulatory domain decides which channels the AP may use
+	if setupCfg.Country != "" {
+		if err := setRegDomain(ctx, wpacfg.Runner, setupCfg.Country); err != nil {
+			log.Error("could not set regulatory domain", "country", setupCfg.Country, "error", err)
+		}
+	}
 
-	// monitor for a future connection - shut down AP when it occurs
-	go func() {
-		for {
-			if EthActive() {
-				log.Info("Eth Connection detected - stopping AP...")
-				time.Sleep(5 * time.Second)
-				command.DisableAp()
-				break
+	// hostapd fails cryptically on what the radio does not support, say
+	// what it is instead; the regulatory domain is set by now
+	if !setupCfg.Capabilities.Disabled {
+		phys, err := wpacfg.Capabilities(ctx)
+		if err != nil {
+			log.Warn("could not probe the radios", "error", err)
+		} else if errs := wpacfg.CheckCapabilities(phys); len(errs) > 0 {
+			for _, fieldErr := range errs {
+				log.Error("radio does not support the config", "field", fieldErr.Field, "error", fieldErr.Message)
 			}
-
-			if status, ok := wpacfg.Status(); ok == nil && status["wpa_state"] == "COMPLETED" {
-				log.Info("WiFi Connection detected - stopping AP...")
-				time.Sleep(5 * time.Second)
-				command.DisableAp()
-				break
+			if !setupCfg.Capabilities.WarnOnly {
+				log.Error("not starting", "error", errs)
+				return
 			}
-
-			time.Sleep(30 * time.Second)
 		}
-	}()
+	}
 
-	// staticFields for logger
-	staticFields := make(map[string]interface{})
+	// bring up soft AP
+	if err := command.RemoveApInterface(); err != nil {
+		log.Error("could not remove ap interface", "iface", setupCfg.APInterface, "error", err)
+	}
+	if err := command.AddApInterface(); err != nil {
+		log.Error("could not add ap interface", "iface", setupCfg.APInterface, "error", err)
+	}
+	if err := command.UpApInterface(); err != nil {
+		log.Error("could not bring up ap interface", "iface", setupCfg.APInterface, "error", err)
+	}
+	if nm != nil {
+		unmanageCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := nm.Unmanage(unmanageCtx, setupCfg.APInterface); err != nil {
+			log.Error("could not unmanage ap interface", "iface", setupCfg.APInterface, "error", err)
+		}
+		cancel()
+	}
+	if err := command.ConfigureApInterface(); err != nil {
+		log.Error("could not address ap interface", "iface", setupCfg.APInterface, "error", err)
+	}
+	if bridge := setupCfg.Bridge; bridge.Enabled {
+		if err := setupBridge(ctx, wpacfg.Runner, bridge, setupCfg.resolvConf()); err != nil {
+			log.Error("could not set up bridge", "iface", bridge.Name, "port", bridge.Interface, "error", err)
+		}
+	}
+	if err := command.StartHostapd(); err != nil {
+		log.Error("could not start hostapd", "iface", setupCfg.APInterface, "error", err)
+	}
 
-	// command output loop (channel messages)
-	// loop and log
-	//
-	for {
-		out := <-messages // Block until we receive a message on the channel
+	time.Sleep(10 * time.Second)
 
-		staticFields["cmd_id"] = out.Id
-		staticFields["cmd"] = out.Command
-		staticFields["is_error"] = out.Error
+	// NetworkManager runs its own wpa_supplicant and connects by itself
+	if nm == nil {
+		startStations(ctx, log, command, wpacfg, interfaces)
+	} else {
+		time.Sleep(5 * time.Second)
+		nm.ScanNetworks(ctx)
+	}
 
-		log.Info(staticFields, out.Message)
+	command.StartDnsmasq()
 
-		if handler, ok := cmdRunner.Handlers[out.Id]; ok {
-			handler(out)
+	if setupCfg.Router.Enabled {
+		if err := wpacfg.EnableRouter(ctx); err != nil {
+			log.Error("could not enable router", "iface", setupCfg.APInterface, "error", err)
 		}
 	}
-}
 
-// HandleFunc is a function that gets all channel messages for a command id
-func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)) {
-	c.Handlers[cmdId] = handler
-}
+	// restart anything that crashes from here on
+	if setupCfg.Supervisor.Enabled && supervisor != nil {
+		supervisor.Log = log
+		supervisor.Configure(setupCfg.Supervisor)
+		go supervisor.Run(ctx, command)
+	}
 
-// ProcessCmd processes an internal command.
-func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
-	c.Log.Debug("ProcessCmd got %s", id)
+	// command output loop (channel messages)
+	// loop and log, and keep logging while shutting down so the
+	// commands being stopped are not blocked on their output
+	//
+	stop := ctx.Done()
+	var shutdown chan struct{}
+	for {
+		select {
+		case <-stop:
+			stop = nil
+			shutdown = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+
+				log.Info("shutting down", "iface", setupCfg.StationInterface)
+
+				// flush the config while wpa_supplicant is still up,
+				// NetworkManager saves its profiles itself
+				if nm == nil {
+					if err := wpacfg.SaveConfig(shutdownCtx); err != nil {
+						log.Error("could not save config", "iface", setupCfg.StationInterface, "error", err)
+					}
+				}
+
+				// the rules are removed whether routing was enabled at
+				// startup or through the API
+				if err := wpacfg.DisableRouter(shutdownCtx); err != nil {
+					log.Error("could not disable router", "iface", setupCfg.APInterface, "error", err)
+				}
+
+				command.Shutdown(shutdownCtx)
+			}(shutdown)
+
+		case <-shutdown:
+			return
+
+		case out := <-messages: // Block until we receive a message on the channel
+			log.Info(out.Message, "cmd_id", out.Id, "cmd", out.Command, "is_error", out.Error)
+
+			if handler, ok := cmdRunner.Handlers[out.Id]; ok {
+				handler(out)
+			}
+		}
+	}
+}
 
-	// add command to the commands map TODO close the readers
-	c.Commands[id] = cmd
+// startStations starts wpa_supplicant on the station radios, scans once
+// and restores the saved profiles and state.
+func startStations(ctx context.Context, log Logger, command *Command, wpacfg *WpaCfg, interfaces *InterfaceManager) {
+	setupCfg := command.Cfg()
 
-	cmdStdoutReader, err := cmd.StdoutPipe()
-	if err != nil {
-		panic(err)
+	// Start supplicant and attempt to connect
+	command.StartWpaSupplicant()
+	if err := command.ConfigureStationInterface(); err != nil {
+		log.Error("could not set static address", "iface", setupCfg.StationInterface, "address", setupCfg.StationIP.Address, "error", err)
 	}
 
-	cmdStderrReader, err := cmd.StderrPipe()
-	if err != nil {
-		panic(err)
-	}
-
-	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
-	go func() {
-		for stdOutScanner.Scan() {
-			c.Messages <- CmdMessage{
-				Id:      id,
-				Command: cmd.Path,
-				Message: stdOutScanner.Text(),
-				Error:   false,
-				Cmd:     cmd,
-			}
+	// the additional station radios
+	for _, radio := range setupCfg.Radios {
+		if err := command.StartRadio(radio); err != nil {
+			log.Error("could not set static address", "iface", radio.Interface, "address", radio.StationIP.Address, "error", err)
 		}
-	}()
-
-	stdErrScanner := bufio.NewScanner(cmdStderrReader)
-	go func() {
-		for stdErrScanner.Scan() {
-			c.Messages <- CmdMessage{
-				Id:      id,
-				Command: cmd.Path,
-				Message: stdErrScanner.Text(),
-				Error:   true,
-				Cmd:     cmd,
+	}
+
+	// Do a single scan
+	time.Sleep(5 * time.Second)
+	if setupCfg.Country != "" {
+		for _, name := range interfaces.Names() {
+			radio, _ := interfaces.Get(name)
+			if err := radio.stationCmd(ctx, "SET", "country", setupCfg.Country); err != nil {
+				log.Error("could not set wpa_supplicant country", "iface", name, "country", setupCfg.Country, "error", err)
 			}
 		}
-	}()
+	}
+	wpacfg.ScanNetworks(ctx)
 
-	err = cmd.Start()
+	// load saved profiles so wpa_supplicant can fall back between them
+	if err := wpacfg.ApplyProfiles(ctx); err != nil {
+		log.Error("could not apply profiles", "iface", setupCfg.StationInterface, "error", err)
+	}
 
-	if err != nil {
-		panic(err)
+	// keep the AP off and the last good network on, as before the restart
+	if err := wpacfg.RestoreState(ctx); err != nil {
+		log.Error("could not restore state", "iface", setupCfg.APInterface, "error", err)
 	}
 }
+
+// HandleFunc is a function that gets all channel messages for a command id
+func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)) {
+	c.Handlers[cmdId] = handler
+}
@@ -0,0 +1,284 @@
+// Package iotwifitest provides a fake iotwifi.Runner that replays canned
+// wpa_supplicant, hostapd_cli and iw output, so WpaCfg can be exercised
+// without root or wireless hardware:
+//
+//	runner := iotwifitest.NewRunner()
+//	wpa := &iotwifi.WpaCfg{Log: log, WpaCfg: cfg, Runner: runner}
+//	results, err := wpa.ScanNetworks(ctx)
+
+package iotwifitest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// Canned replies used by NewRunner.
+const (
+	WpaStatus = "bssid=aa:bb:cc:dd:ee:01\n" +
+		"freq=2437\n" +
+		"ssid=home\n" +
+		"id=0\n" +
+		"mode=station\n" +
+		"pairwise_cipher=CCMP\n" +
+		"group_cipher=CCMP\n" +
+		"key_mgmt=WPA2-PSK\n" +
+		"wpa_state=COMPLETED\n" +
+		"ip_address=192.168.1.50\n" +
+		"address=b8:27:eb:00:00:01\n"
+
+	WpaScanResults = "bssid / frequency / signal level / flags / ssid\n" +
+		"aa:bb:cc:dd:ee:01\t2437\t-48\t[WPA2-PSK-CCMP][WPS][ESS]\thome\n" +
+		"aa:bb:cc:dd:ee:02\t5180\t-61\t[WPA2-PSK-CCMP][ESS]\thome\n" +
+		"aa:bb:cc:dd:ee:03\t2412\t-72\t[ESS]\tcafe\n" +
+		"aa:bb:cc:dd:ee:04\t2462\t-80\t[WPA2-PSK+SAE-CCMP][ESS]\t\n"
+
+	WpaSignalPoll = "RSSI=-52\n" +
+		"LINKSPEED=65\n" +
+		"NOISE=9999\n" +
+		"FREQUENCY=2437\n"
+
+	WpaListNetworks = "network id / ssid / bssid / flags\n" +
+		"0\thome\tany\t[CURRENT]\n"
+
+	HostapdStatus = "state=ENABLED\n" +
+		"phy=phy0\n" +
+		"freq=2437\n" +
+		"channel=6\n" +
+		"ssid[0]=iot-wifi-cfg-3\n" +
+		"bssid[0]=b8:27:eb:00:00:02\n" +
+		"bss[0]=uap0\n" +
+		"num_sta[0]=1\n"
+
+	HostapdAllSta = "02:00:00:00:00:01\n" +
+		"flags=[AUTH][ASSOC][AUTHORIZED]\n" +
+		"rx_bytes=10240\n" +
+		"tx_bytes=20480\n" +
+		"connected_time=60\n" +
+		"signal=-52\n"
+
+	IwStationDump = "Station aa:bb:cc:dd:ee:01 (on wlan0)\n" +
+		"\tinactive time:\t120 ms\n" +
+		"\ttx retries:\t42\n" +
+		"\ttx failed:\t3\n" +
+		"\tsignal:  \t-52 [-52] dBm\n" +
+		"\ttx bitrate:\t65.0 MBit/s MCS 7\n"
+
+	IwRegGet = "global\n" +
+		"country US: DFS-FCC\n" +
+		"\t(2400 - 2472 @ 40), (N/A, 30), (N/A)\n"
+)
+
+// Runner is a fake iotwifi.Runner. Replies are looked up by the full
+// command line first and then by its first word, so "SET_NETWORK" answers
+// every SET_NETWORK request while "SET_NETWORK 0 psk \"x\"" answers just
+// one. Commands with no reply get "OK". Every call is recorded in Calls.
+type Runner struct {
+	// Outputs are the replies of external commands, keyed by the command
+	// line such as "hostapd_cli -i uap0 status" or by the command name.
+	Outputs map[string]string
+
+	// Replies are the replies of wpa_supplicant requests, keyed by the
+	// request such as "SCAN_RESULTS".
+	Replies map[string]string
+
+	// Errors fail matching commands and requests instead of replying.
+	Errors map[string]error
+
+	// Events are sent to attached monitors after a matching request, for
+	// example "SCAN" followed by CTRL-EVENT-SCAN-RESULTS.
+	Events map[string][]wpactl.Event
+
+	// EventsInTurn are sent after matching requests in place of Events,
+	// the first set after the first request and so on, until they run
+	// out. They script a request failing before it succeeds.
+	EventsInTurn map[string][][]wpactl.Event
+
+	mu       sync.Mutex
+	calls    []string
+	monitors []chan wpactl.Event
+}
+
+// NewRunner produces a Runner with canned replies for a connected station
+// and an AP with one client.
+func NewRunner() *Runner {
+	return &Runner{
+		Outputs: map[string]string{
+			"hostapd_cli -i uap0 status":  HostapdStatus,
+			"hostapd_cli -i uap0 all_sta": HostapdAllSta,
+			"iw reg get":                  IwRegGet,
+			"iw dev wlan0 station dump":   IwStationDump,
+			"iw":                          "",
+			"udhcpc":                      "",
+			"dhclient":                    "",
+			"dhcpcd":                      "",
+		},
+		Replies: map[string]string{
+			"STATUS":        WpaStatus,
+			"SCAN_RESULTS":  WpaScanResults,
+			"LIST_NETWORKS": WpaListNetworks,
+			"SIGNAL_POLL":   WpaSignalPoll,
+			"ADD_NETWORK":   "1\n",
+			"GET_NETWORK":   "FAIL\n", // not set
+		},
+		Errors:       map[string]error{},
+		EventsInTurn: map[string][][]wpactl.Event{},
+		Events: map[string][]wpactl.Event{
+			"SCAN": {{
+				Level: 3,
+				Name:  "CTRL-EVENT-SCAN-RESULTS",
+			}},
+			"ENABLE_NETWORK": {{
+				Level:   3,
+				Name:    "CTRL-EVENT-CONNECTED",
+				Message: "- Connection to aa:bb:cc:dd:ee:01 completed [id=1 id_str=]",
+			}},
+		},
+	}
+}
+
+// Output replies to an external command.
+func (r *Runner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+
+	return r.reply(ctx, line, r.Outputs, "")
+}
+
+// Request replies to a wpa_supplicant request and then sends any events
+// registered for it.
+func (r *Runner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	out, err := r.reply(ctx, cmd, r.Replies, "OK\n")
+	if err != nil {
+		return out, err
+	}
+
+	r.mu.Lock()
+	events := r.eventsFor(cmd)
+	r.mu.Unlock()
+
+	for _, ev := range events {
+		r.Emit(ev)
+	}
+
+	return out, nil
+}
+
+// Attach registers a monitor for events sent by Request and Emit.
+func (r *Runner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.Errors["ATTACH"]; err != nil {
+		return nil, nil, err
+	}
+
+	events := make(chan wpactl.Event, 16)
+	r.monitors = append(r.monitors, events)
+
+	return events, &monitor{runner: r, events: events}, nil
+}
+
+// Emit sends ev to every attached monitor, dropping it for monitors that
+// are not keeping up.
+func (r *Runner) Emit(ev wpactl.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, events := range r.monitors {
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+}
+
+// Calls returns every command line and request made so far, in order.
+func (r *Runner) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.calls...)
+}
+
+// reply records line and looks up its reply in replies, falling back to def.
+func (r *Runner) reply(ctx context.Context, line string, replies map[string]string, def string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, line)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{line, firstWord(line)} {
+		if err, ok := r.Errors[key]; ok {
+			return nil, err
+		}
+		if out, ok := replies[key]; ok {
+			return []byte(out), nil
+		}
+	}
+
+	if def == "" {
+		return nil, fmt.Errorf("iotwifitest: no output for %q", line)
+	}
+
+	return []byte(def), nil
+}
+
+// eventsFor returns the events to send after cmd, taking the next set of
+// EventsInTurn if there is one left.
+func (r *Runner) eventsFor(cmd string) []wpactl.Event {
+	for _, key := range []string{cmd, firstWord(cmd)} {
+		if turns := r.EventsInTurn[key]; len(turns) > 0 {
+			r.EventsInTurn[key] = turns[1:]
+			return turns[0]
+		}
+	}
+
+	if events := r.Events[cmd]; events != nil {
+		return events
+	}
+
+	return r.Events[firstWord(cmd)]
+}
+
+// detach removes and closes a monitor.
+func (r *Runner) detach(events chan wpactl.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, m := range r.monitors {
+		if m == events {
+			r.monitors = append(r.monitors[:i], r.monitors[i+1:]...)
+			close(events)
+			return
+		}
+	}
+}
+
+// monitor detaches its events from the Runner when closed.
+type monitor struct {
+	runner *Runner
+	events chan wpactl.Event
+}
+
+func (m *monitor) Close() error {
+	m.runner.detach(m.events)
+	return nil
+}
+
+// firstWord returns the command name of line.
+func firstWord(line string) string {
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i]
+	}
+
+	return line
+}
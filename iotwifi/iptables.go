@@ -0,0 +1,126 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// iptablesChains are the chains rules are installed in, by table.
+var iptablesChains = []struct {
+	Table string
+	Chain string
+}{
+	{"nat", "POSTROUTING"},
+	{"filter", "FORWARD"},
+}
+
+// iptablesFirewall installs rules with iptables, tagging them with a
+// comment naming their group.
+type iptablesFirewall struct {
+	runner Runner
+}
+
+func (f *iptablesFirewall) Name() string {
+	return FirewallIptables
+}
+
+// Apply removes the rules of group and appends rules.
+func (f *iptablesFirewall) Apply(ctx context.Context, group string, rules []FirewallRule) error {
+	if err := f.Clear(ctx, group); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		args, err := iptablesArgs(group, rule)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.runner.Output(ctx, "iptables", args...); err != nil {
+			return fmt.Errorf("iptables %s: %w", args[3], err)
+		}
+	}
+
+	return nil
+}
+
+// Clear deletes every rule tagged with group.
+func (f *iptablesFirewall) Clear(ctx context.Context, group string) error {
+	for _, chain := range iptablesChains {
+		rules, err := f.list(ctx, chain.Table, chain.Chain, group)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			// -S prints the rule as the -A that added it
+			args := append([]string{"-t", chain.Table, "-D"}, strings.Fields(rule)[1:]...)
+			if _, err := f.runner.Output(ctx, "iptables", args...); err != nil {
+				return fmt.Errorf("iptables %s: %w", chain.Chain, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *iptablesFirewall) List(ctx context.Context, group string) ([]string, error) {
+	rules := []string{}
+	for _, chain := range iptablesChains {
+		chainRules, err := f.list(ctx, chain.Table, chain.Chain, group)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, chainRules...)
+	}
+
+	return rules, nil
+}
+
+// list returns the rules of chain tagged with group, as iptables -S
+// prints them.
+func (f *iptablesFirewall) list(ctx context.Context, table string, chain string, group string) ([]string, error) {
+	out, err := f.runner.Output(ctx, "iptables", "-t", table, "-S", chain)
+	if err != nil {
+		return nil, fmt.Errorf("iptables %s: %w", chain, err)
+	}
+
+	rules := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "--comment "+firewallTag(group)) {
+			rules = append(rules, strings.TrimSpace(line))
+		}
+	}
+
+	return rules, nil
+}
+
+// iptablesArgs returns the iptables arguments that append rule.
+func iptablesArgs(group string, rule FirewallRule) ([]string, error) {
+	var args []string
+	switch rule.Action {
+	case ActionMasquerade:
+		args = []string{"-t", "nat", "-A", "POSTROUTING"}
+	case ActionAccept:
+		args = []string{"-t", "filter", "-A", "FORWARD"}
+	default:
+		return nil, fmt.Errorf("unknown firewall action %q", rule.Action)
+	}
+
+	args = append(args, "-m", "comment", "--comment", firewallTag(group))
+	if rule.Source != "" {
+		args = append(args, "-s", rule.Source)
+	}
+	if rule.In != "" {
+		args = append(args, "-i", rule.In)
+	}
+	if rule.Out != "" {
+		args = append(args, "-o", rule.Out)
+	}
+	if rule.Established {
+		args = append(args, "-m", "state", "--state", "RELATED,ESTABLISHED")
+	}
+
+	return append(args, "-j", strings.ToUpper(rule.Action)), nil
+}
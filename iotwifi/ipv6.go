@@ -0,0 +1,110 @@
+package iotwifi
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPv6 modes of the AP, for IPv6Cfg.Mode.
+const (
+	IPv6Slaac     = "slaac"     // router advertisements only, clients pick their addresses
+	IPv6Stateless = "stateless" // addresses from router advertisements, nameservers from DHCPv6
+	IPv6Stateful  = "stateful"  // addresses and nameservers from DHCPv6
+)
+
+// DefaultAPPrefix6 is the AP prefix when IPv6 is enabled without one, a
+// unique local prefix matching the default 192.168.27.0/24.
+const DefaultAPPrefix6 = "fd00:27::/64"
+
+// IPv6Cfg serves IPv6 to AP clients through dnsmasq and is used by
+// SetupCfg. The AP takes the first address of the prefix. It is only
+// advertised as on-link, not as a default router, since AP clients are
+// routed over IPv4 alone.
+type IPv6Cfg struct {
+	Enabled  bool   `json:"enabled"`
+	APPrefix string `json:"ap_prefix"` // fd00:27::/64 by default
+	Mode     string `json:"mode"`      // slaac, stateless (default) or stateful
+}
+
+// withDefaults fills in the prefix and mode.
+func (c IPv6Cfg) withDefaults() IPv6Cfg {
+	if c.APPrefix == "" {
+		c.APPrefix = DefaultAPPrefix6
+	}
+	if c.Mode == "" {
+		c.Mode = IPv6Stateless
+	}
+
+	return c
+}
+
+// Validate checks the prefix and mode. Router advertisements and the
+// DHCPv6 range are for a /64.
+func (c IPv6Cfg) Validate() error {
+	_, prefix, err := net.ParseCIDR(c.APPrefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("invalid ap_prefix %q, expected an IPv6 prefix", c.APPrefix)
+	}
+	if ones, _ := prefix.Mask.Size(); ones != 64 {
+		return fmt.Errorf("ap_prefix %s must be a /64", c.APPrefix)
+	}
+
+	switch c.Mode {
+	case IPv6Slaac, IPv6Stateless, IPv6Stateful:
+	default:
+		return fmt.Errorf("unknown mode %q, want slaac, stateless or stateful", c.Mode)
+	}
+
+	return nil
+}
+
+// apIP6 returns the AP IPv6 address, the first of the prefix, or ""
+// when IPv6 is off.
+func (s *SetupCfg) apIP6() string {
+	if !s.IPv6.Enabled {
+		return ""
+	}
+
+	_, prefix, err := net.ParseCIDR(s.IPv6.APPrefix)
+	if err != nil {
+		return ""
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	ip[net.IPv6len-1] |= 1
+
+	return ip.String()
+}
+
+// apAddress6 returns the AP IPv6 address with the /64 prefix length, or
+// "" when IPv6 is off.
+func (s *SetupCfg) apAddress6() string {
+	ip := s.apIP6()
+	if ip == "" {
+		return ""
+	}
+
+	return ip + "/64"
+}
+
+// dnsmasqArgs6 returns the dnsmasq arguments that send router
+// advertisements on iface and, unless the mode is slaac, answer DHCPv6.
+// The router lifetime is 0 so clients keep their IPv4 default route.
+func (c IPv6Cfg) dnsmasqArgs6(iface string) []string {
+	var dhcpRange string
+	switch c.Mode {
+	case IPv6Slaac:
+		dhcpRange = "::,constructor:" + iface + ",ra-only,64,1h"
+	case IPv6Stateful:
+		dhcpRange = "::100,::1ff,constructor:" + iface + ",64,1h"
+	default:
+		dhcpRange = "::,constructor:" + iface + ",ra-stateless,64,1h"
+	}
+
+	return []string{
+		"--enable-ra",
+		"--ra-param=" + iface + ",60,0",
+		"--dhcp-range=" + dhcpRange,
+	}
+}
@@ -0,0 +1,203 @@
+package iotwifi
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Latency probe defaults.
+const (
+	DefaultLatencyInterval = 30 * time.Second
+	DefaultLatencyCount    = 5
+	DefaultLatencyTimeout  = time.Second
+	latencyPingGap         = 200 * time.Millisecond // between the pings of a round
+)
+
+// LatencyTargetGateway is the target of the pings to the station's
+// default gateway.
+const LatencyTargetGateway = "gateway"
+
+// LatencyCfg configures the latency probes and is used by SetupCfg.
+type LatencyCfg struct {
+	Enabled     bool     `json:"enabled"`
+	IntervalSec int      `json:"interval_sec"` // how often to probe, 30 by default
+	Count       int      `json:"count"`        // pings per target and round, 5 by default
+	TimeoutSec  int      `json:"timeout_sec"`  // per ping, 1 by default
+	Targets     []string `json:"targets"`      // hosts beyond the gateway, ["1.1.1.1", "example.com"]
+}
+
+// withDefaults fills in the empty settings.
+func (c LatencyCfg) withDefaults() LatencyCfg {
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = int(DefaultLatencyInterval / time.Second)
+	}
+	if c.Count <= 0 {
+		c.Count = DefaultLatencyCount
+	}
+	if c.TimeoutSec <= 0 {
+		c.TimeoutSec = int(DefaultLatencyTimeout / time.Second)
+	}
+
+	return c
+}
+
+// LatencyResult is the round trip time and loss of the pings to one
+// target in the last round.
+type LatencyResult struct {
+	Target   string    `json:"target"` // gateway, or a configured target
+	Host     string    `json:"host"`   // the address pinged
+	Sent     int       `json:"sent"`
+	Received int       `json:"received"`
+	Loss     float64   `json:"loss"`    // 0-1, of the pings sent
+	RttMin   float64   `json:"rtt_min"` // ms, 0 when nothing came back
+	RttAvg   float64   `json:"rtt_avg"` // ms
+	RttMax   float64   `json:"rtt_max"` // ms
+	Time     time.Time `json:"time"`
+	Error    string    `json:"error,omitempty"` // of the last lost ping
+}
+
+// ProbeLatency pings the default gateway of the station and the
+// configured targets count times each and keeps the results for Latency.
+// Without an address on the station there is nothing to probe and the
+// results are cleared.
+func (wpa *WpaCfg) ProbeLatency(ctx context.Context, cfg LatencyCfg) []LatencyResult {
+	cfg = cfg.withDefaults()
+	iface := wpa.Cfg().StationInterface
+	results := []LatencyResult{}
+
+	type target struct{ name, host string }
+	targets := []target{}
+	if gw := defaultGateway(iface); gw != "" {
+		targets = append(targets, target{LatencyTargetGateway, gw})
+	} else if gw := defaultGateway6(iface); gw != "" {
+		// a link-local router is only reachable through its interface
+		if ip := net.ParseIP(gw); ip.IsLinkLocalUnicast() {
+			gw += "%" + iface
+		}
+		targets = append(targets, target{LatencyTargetGateway, gw})
+	}
+
+	if len(targets) == 0 && interfaceIPv4(iface) == "" && len(interfaceIPv6(iface)) == 0 {
+		wpa.setLatency(results)
+		return results
+	}
+	for _, host := range cfg.Targets {
+		targets = append(targets, target{host, host})
+	}
+
+	timeout := time.Duration(cfg.TimeoutSec) * time.Second
+	for _, t := range targets {
+		result := LatencyResult{Target: t.name, Host: t.host, Time: time.Now()}
+
+		var total time.Duration
+		for i := 0; i < cfg.Count; i++ {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return results
+				case <-time.After(latencyPingGap):
+				}
+			}
+
+			result.Sent++
+			rtt, err := pingRTT(ctx, iface, t.host, timeout)
+			if err != nil {
+				result.Error = err.Error()
+				continue
+			}
+
+			ms := float64(rtt) / float64(time.Millisecond)
+			if result.Received == 0 || ms < result.RttMin {
+				result.RttMin = ms
+			}
+			if ms > result.RttMax {
+				result.RttMax = ms
+			}
+			total += rtt
+			result.Received++
+		}
+
+		if result.Received > 0 {
+			result.RttAvg = float64(total) / float64(result.Received) / float64(time.Millisecond)
+			result.Error = ""
+		}
+		result.Loss = float64(result.Sent-result.Received) / float64(result.Sent)
+
+		results = append(results, result)
+	}
+
+	wpa.setLatency(results)
+
+	return results
+}
+
+// setLatency keeps the results of the last round.
+func (wpa *WpaCfg) setLatency(results []LatencyResult) {
+	wpa.latencyMu.Lock()
+	defer wpa.latencyMu.Unlock()
+
+	wpa.latency = results
+}
+
+// Latency returns the results of the last round of latency probes,
+// empty when the probes are disabled or the station has no address.
+func (wpa *WpaCfg) Latency() []LatencyResult {
+	wpa.latencyMu.Lock()
+	defer wpa.latencyMu.Unlock()
+
+	return append([]LatencyResult{}, wpa.latency...)
+}
+
+// LatencyProber probes the latency on an interval.
+type LatencyProber struct {
+	Wpa *WpaCfg
+
+	cfgs chan LatencyCfg
+}
+
+// NewLatencyProber produces a LatencyProber for wpa, disabled until
+// configured.
+func NewLatencyProber(wpa *WpaCfg) *LatencyProber {
+	return &LatencyProber{
+		Wpa:  wpa,
+		cfgs: make(chan LatencyCfg, 1),
+	}
+}
+
+// Configure applies cfg from the next round on.
+func (p *LatencyProber) Configure(cfg LatencyCfg) {
+	// only the latest config matters
+	select {
+	case <-p.cfgs:
+	default:
+	}
+	p.cfgs <- cfg
+}
+
+// Run probes every interval until ctx is done. It idles while the
+// probes are disabled.
+func (p *LatencyProber) Run(ctx context.Context) {
+	var cfg LatencyCfg
+
+	for {
+		var tick <-chan time.Time
+		if cfg.Enabled {
+			tick = time.After(time.Duration(cfg.withDefaults().IntervalSec) * time.Second)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case cfg = <-p.cfgs:
+			if !cfg.Enabled {
+				p.Wpa.setLatency(nil)
+				continue
+			}
+		case <-tick:
+		}
+
+		results := p.Wpa.ProbeLatency(ctx, cfg)
+		p.Wpa.Log.Debug("latency probed", "iface", p.Wpa.Cfg().StationInterface, "targets", len(results))
+	}
+}
@@ -0,0 +1,324 @@
+package iotwifi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/kinokochat/txwifi/iotwifi/systemd"
+)
+
+// Logger is the logging interface used by the package so embedders can
+// plug in their own logger. Messages are constant strings and variable
+// data goes in alternating key/value pairs:
+//
+//	log.Info("network enabled", "iface", "wlan0", "ssid", "home", "net_id", "0")
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Log levels accepted by ParseLogLevel and SetupCfg.LogLevel.
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevels = map[string]int{
+	LogLevelDebug: 20,
+	LogLevelInfo:  30,
+	LogLevelWarn:  40,
+	LogLevelError: 50,
+}
+
+// ParseLogLevel validates level, defaulting to info when empty.
+func ParseLogLevel(level string) (string, error) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if level == "" {
+		return LogLevelInfo, nil
+	}
+
+	if _, ok := logLevels[level]; !ok {
+		return "", fmt.Errorf("%w: unknown log_level %s", ErrConfig, level)
+	}
+
+	return level, nil
+}
+
+// logFields turns alternating key/value pairs into a map. A trailing key
+// without a value is kept under "!BADKEY" rather than dropped.
+func logFields(keysAndValues []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(keysAndValues)/2)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 >= len(keysAndValues) {
+			fields["!BADKEY"] = keysAndValues[i]
+			break
+		}
+
+		key := fmt.Sprint(keysAndValues[i])
+		value := keysAndValues[i+1]
+
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case time.Duration:
+			value = v.String()
+		}
+
+		fields[key] = value
+	}
+
+	return fields
+}
+
+// bunyanLogger adapts a bunyan.Logger to Logger.
+type bunyanLogger struct {
+	log *bunyan.Logger
+}
+
+// NewBunyanLogger wraps log so it can be passed to the package.
+func NewBunyanLogger(log *bunyan.Logger) Logger {
+	return &bunyanLogger{log: log}
+}
+
+func (b *bunyanLogger) Debug(msg string, keysAndValues ...interface{}) {
+	b.log.Debug(logFields(keysAndValues), msg)
+}
+
+func (b *bunyanLogger) Info(msg string, keysAndValues ...interface{}) {
+	b.log.Info(logFields(keysAndValues), msg)
+}
+
+func (b *bunyanLogger) Warn(msg string, keysAndValues ...interface{}) {
+	b.log.Warn(logFields(keysAndValues), msg)
+}
+
+func (b *bunyanLogger) Error(msg string, keysAndValues ...interface{}) {
+	b.log.Error(logFields(keysAndValues), msg)
+}
+
+// jsonLogger writes one JSON object per line.
+type jsonLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	name string
+}
+
+// NewJSONLogger produces a Logger writing JSON lines to w. It needs
+// nothing beyond the standard library.
+func NewJSONLogger(w io.Writer, name string) Logger {
+	return &jsonLogger{w: w, name: name}
+}
+
+func (j *jsonLogger) write(level string, msg string, keysAndValues []interface{}) {
+	entry := logFields(keysAndValues)
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["name"] = j.name
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": level, "msg": msg, "log_error": err.Error()})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.w.Write(append(line, '\n'))
+}
+
+func (j *jsonLogger) Debug(msg string, keysAndValues ...interface{}) {
+	j.write(LogLevelDebug, msg, keysAndValues)
+}
+
+func (j *jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	j.write(LogLevelInfo, msg, keysAndValues)
+}
+
+func (j *jsonLogger) Warn(msg string, keysAndValues ...interface{}) {
+	j.write(LogLevelWarn, msg, keysAndValues)
+}
+
+func (j *jsonLogger) Error(msg string, keysAndValues ...interface{}) {
+	j.write(LogLevelError, msg, keysAndValues)
+}
+
+// journalPriorities are the journal priorities of the log levels.
+var journalPriorities = map[string]int{
+	LogLevelDebug: systemd.PriDebug,
+	LogLevelInfo:  systemd.PriInfo,
+	LogLevelWarn:  systemd.PriWarning,
+	LogLevelError: systemd.PriErr,
+}
+
+// journalLogger writes entries to journald with the key/value pairs as
+// fields, falling back to JSON lines when journald does not take them.
+type journalLogger struct {
+	journal  *systemd.Journal
+	name     string
+	fallback Logger
+}
+
+// NewJournalLogger produces a Logger writing to journal, so the fields
+// can be matched with journalctl, IFACE=wlan0. Entries journald refuses
+// are written to fallback as JSON lines.
+func NewJournalLogger(journal *systemd.Journal, name string, fallback io.Writer) Logger {
+	return &journalLogger{journal: journal, name: name, fallback: NewJSONLogger(fallback, name)}
+}
+
+func (j *journalLogger) write(level string, msg string, keysAndValues []interface{}) error {
+	fields := map[string]string{"SYSLOG_IDENTIFIER": j.name}
+	for key, value := range logFields(keysAndValues) {
+		fields[systemd.FieldName(key)] = fmt.Sprint(value)
+	}
+
+	return j.journal.Send(journalPriorities[level], msg, fields)
+}
+
+func (j *journalLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if j.write(LogLevelDebug, msg, keysAndValues) != nil {
+		j.fallback.Debug(msg, keysAndValues...)
+	}
+}
+
+func (j *journalLogger) Info(msg string, keysAndValues ...interface{}) {
+	if j.write(LogLevelInfo, msg, keysAndValues) != nil {
+		j.fallback.Info(msg, keysAndValues...)
+	}
+}
+
+func (j *journalLogger) Warn(msg string, keysAndValues ...interface{}) {
+	if j.write(LogLevelWarn, msg, keysAndValues) != nil {
+		j.fallback.Warn(msg, keysAndValues...)
+	}
+}
+
+func (j *journalLogger) Error(msg string, keysAndValues ...interface{}) {
+	if j.write(LogLevelError, msg, keysAndValues) != nil {
+		j.fallback.Error(msg, keysAndValues...)
+	}
+}
+
+// levelLogger drops entries below a minimum level.
+type levelLogger struct {
+	log   Logger
+	level int
+}
+
+// WithLevel filters log so only entries at level or above are written.
+// An invalid level leaves log unfiltered.
+func WithLevel(log Logger, level string) Logger {
+	level, err := ParseLogLevel(level)
+	if err != nil || level == LogLevelDebug {
+		return log
+	}
+
+	if l, ok := log.(*levelLogger); ok {
+		log = l.log
+	}
+
+	return &levelLogger{log: log, level: logLevels[level]}
+}
+
+func (l *levelLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if logLevels[LogLevelDebug] >= l.level {
+		l.log.Debug(msg, keysAndValues...)
+	}
+}
+
+func (l *levelLogger) Info(msg string, keysAndValues ...interface{}) {
+	if logLevels[LogLevelInfo] >= l.level {
+		l.log.Info(msg, keysAndValues...)
+	}
+}
+
+func (l *levelLogger) Warn(msg string, keysAndValues ...interface{}) {
+	if logLevels[LogLevelWarn] >= l.level {
+		l.log.Warn(msg, keysAndValues...)
+	}
+}
+
+func (l *levelLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log.Error(msg, keysAndValues...)
+}
+
+// LogEntry is an entry kept by a LogRecorder.
+type LogEntry struct {
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogRecorder passes entries on to a Logger and keeps the last ones in
+// memory, for the diagnostics bundle.
+type LogRecorder struct {
+	log     Logger
+	mu      sync.Mutex
+	entries []LogEntry
+	size    int
+	next    int // where the next entry goes once entries is full
+}
+
+// NewLogRecorder produces a LogRecorder writing to log and keeping the
+// last size entries. Wrap it in Scrub so no secret is kept.
+func NewLogRecorder(log Logger, size int) *LogRecorder {
+	return &LogRecorder{log: log, size: size}
+}
+
+// Entries returns the kept entries, oldest first.
+func (l *LogRecorder) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]LogEntry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+
+	return append(entries, l.entries[:l.next]...)
+}
+
+func (l *LogRecorder) record(level string, msg string, keysAndValues []interface{}) {
+	entry := LogEntry{Time: time.Now().UTC(), Level: level, Msg: msg, Fields: logFields(keysAndValues)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	if l.size > 0 {
+		l.entries[l.next] = entry
+		l.next = (l.next + 1) % l.size
+	}
+}
+
+func (l *LogRecorder) Debug(msg string, keysAndValues ...interface{}) {
+	l.record(LogLevelDebug, msg, keysAndValues)
+	l.log.Debug(msg, keysAndValues...)
+}
+
+func (l *LogRecorder) Info(msg string, keysAndValues ...interface{}) {
+	l.record(LogLevelInfo, msg, keysAndValues)
+	l.log.Info(msg, keysAndValues...)
+}
+
+func (l *LogRecorder) Warn(msg string, keysAndValues ...interface{}) {
+	l.record(LogLevelWarn, msg, keysAndValues)
+	l.log.Warn(msg, keysAndValues...)
+}
+
+func (l *LogRecorder) Error(msg string, keysAndValues ...interface{}) {
+	l.record(LogLevelError, msg, keysAndValues)
+	l.log.Error(msg, keysAndValues...)
+}
@@ -0,0 +1,432 @@
+// Package mdns answers multicast DNS queries (RFC 6762) for one host name
+// and one DNS-SD service (RFC 6763), enough for phones and laptops to find
+// the device as txwifi.local and browse for its API without avahi. It
+// only builds and parses messages, the caller owns the sockets.
+
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Port is the mDNS port, queries and announcements go to Group on it.
+const Port = 5353
+
+// Group is the IPv4 mDNS multicast group.
+var Group = net.IPv4(224, 0, 0, 251)
+
+// Record types and classes.
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+
+	classIN    = 1
+	cacheFlush = 0x8000 // the record replaces cached ones, for unique records
+	unicastQU  = 0x8000 // in a question, a unicast reply is wanted
+)
+
+// Record lifetimes, as recommended by RFC 6762 10.
+const (
+	hostTTL    = 120
+	serviceTTL = 4500
+	legacyTTL  = 10 // at most, for one-shot queries from plain resolvers
+)
+
+// ErrMalformed is returned for messages that cannot be parsed.
+var ErrMalformed = errors.New("mdns: malformed message")
+
+// Service is the DNS-SD service and host name answered for.
+type Service struct {
+	Instance string   // txwifi b827eb123456
+	Type     string   // _http._tcp
+	Host     string   // txwifi, answered as txwifi.local
+	Port     int      // 8080
+	Txt      []string // id=b827eb123456, version=1.0.4
+}
+
+// Responder answers for a Service with the addresses Addrs returns, read
+// for every answer since they come and go with DHCP.
+type Responder struct {
+	Service Service
+	Addrs   func() []net.IP
+}
+
+// Question is a parsed question of a query.
+type Question struct {
+	Name    []string
+	Type    uint16
+	Unicast bool // the QU bit
+}
+
+// record is a resource record to answer with.
+type record struct {
+	name  []string
+	rtype uint16
+	flush bool
+	ttl   uint32
+	data  []byte
+}
+
+// names of the records, as labels.
+func (r *Responder) hostName() []string {
+	return []string{r.Service.Host, "local"}
+}
+
+func (r *Responder) serviceName() []string {
+	return append(strings.Split(r.Service.Type, "."), "local")
+}
+
+func (r *Responder) instanceName() []string {
+	return append([]string{r.Service.Instance}, r.serviceName()...)
+}
+
+// servicesName is browsed for the service types on the network.
+var servicesName = []string{"_services", "_dns-sd", "_udp", "local"}
+
+// ParseQuestions returns the questions of msg, or nothing when msg is a
+// response or not a standard query.
+func ParseQuestions(msg []byte) ([]Question, error) {
+	if len(msg) < 12 {
+		return nil, ErrMalformed
+	}
+
+	// responses have the QR bit set, other opcodes are ignored, RFC 6762
+	// 18.3
+	if msg[2]&0x80 != 0 || msg[2]&0x78 != 0 {
+		return nil, nil
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	questions := make([]Question, 0, count)
+
+	offset := 12
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, ErrMalformed
+		}
+
+		questions = append(questions, Question{
+			Name:    name,
+			Type:    binary.BigEndian.Uint16(msg[next:]),
+			Unicast: binary.BigEndian.Uint16(msg[next+2:])&unicastQU != 0,
+		})
+		offset = next + 4
+	}
+
+	return questions, nil
+}
+
+// readName reads the name at offset, following compression pointers, and
+// returns it and the offset after it.
+func readName(msg []byte, offset int) ([]string, int, error) {
+	labels := []string{}
+	end := -1
+
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return nil, 0, ErrMalformed
+		}
+
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return labels, end, nil
+
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return nil, 0, ErrMalformed
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+
+		case length&0xc0 != 0:
+			// the reserved label types
+			return nil, 0, ErrMalformed
+
+		default:
+			if offset+1+length > len(msg) {
+				return nil, 0, ErrMalformed
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// Answer returns the response to query, or nil when it asks nothing the
+// responder knows. A legacy query, from a port other than 5353, gets a
+// reply fit for a plain resolver: its id and questions are echoed and
+// the lifetimes shortened. unicast reports whether the reply should go
+// back to the sender rather than to the group.
+func (r *Responder) Answer(query []byte, legacy bool) (response []byte, unicast bool, err error) {
+	questions, err := ParseQuestions(query)
+	if err != nil || len(questions) == 0 {
+		return nil, false, err
+	}
+
+	answers, additional := []record{}, []record{}
+	unicast = legacy
+	for _, q := range questions {
+		a, add := r.records(q)
+		if len(a) == 0 {
+			continue
+		}
+
+		answers = appendNew(answers, nil, a...)
+		additional = appendNew(additional, answers, add...)
+		unicast = unicast || q.Unicast
+	}
+	if len(answers) == 0 {
+		return nil, false, nil
+	}
+
+	// an answer asked for after it was an additional record
+	kept := []record{}
+	for _, rec := range additional {
+		kept = appendNew(kept, answers, rec)
+	}
+	additional = kept
+
+	if !legacy {
+		return encode(0, 0, nil, answers, additional, 0), unicast, nil
+	}
+
+	// echo the question section, which ends where the answers would start
+	count, end, err := readQuestionSection(query)
+	if err != nil {
+		return nil, false, err
+	}
+	id := binary.BigEndian.Uint16(query)
+
+	return encode(id, count, query[12:end], answers, additional, legacyTTL), true, nil
+}
+
+// appendNew appends the records of recs that are in neither list nor
+// other, so questions asked again, or asking for records already added,
+// do not repeat them.
+func appendNew(list []record, other []record, recs ...record) []record {
+	for _, rec := range recs {
+		if !hasRecord(list, rec) && !hasRecord(other, rec) {
+			list = append(list, rec)
+		}
+	}
+
+	return list
+}
+
+// hasRecord reports whether list holds rec.
+func hasRecord(list []record, rec record) bool {
+	for _, r := range list {
+		if r.rtype == rec.rtype && nameEqual(r.name, rec.name) && string(r.data) == string(rec.data) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readQuestionSection returns the question count and the offset after
+// the questions.
+func readQuestionSection(msg []byte) (int, int, error) {
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	offset := 12
+	for i := 0; i < count; i++ {
+		_, next, err := readName(msg, offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		offset = next + 4
+	}
+	if offset > len(msg) {
+		return 0, 0, ErrMalformed
+	}
+
+	return count, offset, nil
+}
+
+// Announcement returns an unsolicited response with every record, sent
+// when the responder starts. A goodbye has lifetimes of 0, flushing the
+// records from caches when the responder stops.
+func (r *Responder) Announcement(goodbye bool) []byte {
+	answers := append(r.serviceRecords(), r.addressRecords()...)
+	answers = append(answers, r.ptr(servicesName, r.serviceName()))
+
+	if goodbye {
+		for i := range answers {
+			answers[i].ttl = 0
+		}
+	}
+
+	return encode(0, 0, nil, answers, nil, 0)
+}
+
+// records returns the answers and additional records for q.
+func (r *Responder) records(q Question) ([]record, []record) {
+	anyType := q.Type == typeANY
+
+	switch {
+	case nameEqual(q.Name, r.hostName()):
+		answers := []record{}
+		for _, rec := range r.addressRecords() {
+			if anyType || rec.rtype == q.Type {
+				answers = append(answers, rec)
+			}
+		}
+		return answers, nil
+
+	case nameEqual(q.Name, r.serviceName()) && (anyType || q.Type == typePTR):
+		answers := []record{r.ptr(r.serviceName(), r.instanceName())}
+		return answers, append(r.instanceRecords(), r.addressRecords()...)
+
+	case nameEqual(q.Name, r.instanceName()):
+		answers := []record{}
+		for _, rec := range r.instanceRecords() {
+			if anyType || rec.rtype == q.Type {
+				answers = append(answers, rec)
+			}
+		}
+		if len(answers) == 0 {
+			return nil, nil
+		}
+		return answers, r.addressRecords()
+
+	case nameEqual(q.Name, servicesName) && (anyType || q.Type == typePTR):
+		return []record{r.ptr(servicesName, r.serviceName())}, nil
+	}
+
+	return nil, nil
+}
+
+// serviceRecords are the PTR, SRV and TXT records of the service.
+func (r *Responder) serviceRecords() []record {
+	return append([]record{r.ptr(r.serviceName(), r.instanceName())}, r.instanceRecords()...)
+}
+
+// instanceRecords are the SRV and TXT records of the service instance.
+func (r *Responder) instanceRecords() []record {
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(r.Service.Port))
+	srv = append(srv, encodeName(r.hostName())...)
+
+	txt := []byte{}
+	for _, s := range r.Service.Txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+	// an empty TXT record still holds one empty string
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	return []record{
+		{name: r.instanceName(), rtype: typeSRV, flush: true, ttl: hostTTL, data: srv},
+		{name: r.instanceName(), rtype: typeTXT, flush: true, ttl: serviceTTL, data: txt},
+	}
+}
+
+// addressRecords are the A and AAAA records of the host.
+func (r *Responder) addressRecords() []record {
+	records := []record{}
+	if r.Addrs == nil {
+		return records
+	}
+
+	for _, ip := range r.Addrs() {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, record{name: r.hostName(), rtype: typeA, flush: true, ttl: hostTTL, data: ip4})
+		} else if ip6 := ip.To16(); ip6 != nil {
+			records = append(records, record{name: r.hostName(), rtype: typeAAAA, flush: true, ttl: hostTTL, data: ip6})
+		}
+	}
+
+	return records
+}
+
+// ptr is a shared PTR record from name to target.
+func (r *Responder) ptr(name []string, target []string) record {
+	return record{name: name, rtype: typePTR, ttl: serviceTTL, data: encodeName(target)}
+}
+
+// encode builds a response. questions is the raw section of count
+// questions echoed for legacy replies, maxTTL caps the lifetimes when it
+// is not 0.
+func encode(id uint16, count int, questions []byte, answers []record, additional []record, maxTTL uint32) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // a response, authoritative
+	binary.BigEndian.PutUint16(msg[4:], uint16(count))
+	msg = append(msg, questions...)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(additional)))
+
+	for _, rec := range append(answers, additional...) {
+		msg = append(msg, encodeName(rec.name)...)
+
+		class := uint16(classIN)
+		// legacy resolvers do not know the cache flush bit
+		if rec.flush && questions == nil {
+			class |= cacheFlush
+		}
+		ttl := rec.ttl
+		if maxTTL > 0 && ttl > maxTTL {
+			ttl = maxTTL
+		}
+
+		fixed := make([]byte, 10)
+		binary.BigEndian.PutUint16(fixed, rec.rtype)
+		binary.BigEndian.PutUint16(fixed[2:], class)
+		binary.BigEndian.PutUint32(fixed[4:], ttl)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rec.data)))
+		msg = append(append(msg, fixed...), rec.data...)
+	}
+
+	return msg
+}
+
+// encodeName encodes labels uncompressed.
+func encodeName(labels []string) []byte {
+	name := []byte{}
+	for _, label := range labels {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		name = append(name, byte(len(label)))
+		name = append(name, label...)
+	}
+
+	return append(name, 0)
+}
+
+// nameEqual compares names case-insensitively, as DNS does.
+func nameEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,337 @@
+package mdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// question is a question of a test query.
+type question struct {
+	name    string
+	qtype   uint16
+	unicast bool
+}
+
+// query builds a query of id for questions, with names uncompressed.
+func query(id uint16, questions ...question) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	for _, q := range questions {
+		msg = append(msg, encodeName(strings.Split(q.name, "."))...)
+		class := uint16(classIN)
+		if q.unicast {
+			class |= unicastQU
+		}
+		msg = append(msg, byte(q.qtype>>8), byte(q.qtype), byte(class>>8), byte(class))
+	}
+
+	return msg
+}
+
+// rr is a record of a parsed response.
+type rr struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+// parseResponse parses the header, the question count and the records
+// of a response.
+func parseResponse(t *testing.T, msg []byte) (uint16, int, []rr, []rr) {
+	t.Helper()
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[2:]) != 0x8400 {
+		t.Fatalf("not a response: % x", msg)
+	}
+
+	qdcount, end, err := readQuestionSection(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := end
+	records := []rr{}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])+binary.BigEndian.Uint16(msg[10:])); i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil || next+10 > len(msg) {
+			t.Fatalf("record %d at %d: %v", i, offset, err)
+		}
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		if next+10+length > len(msg) {
+			t.Fatalf("record %d overruns", i)
+		}
+		records = append(records, rr{
+			name:  strings.Join(name, "."),
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			class: binary.BigEndian.Uint16(msg[next+2:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+			data:  msg[next+10 : next+10+length],
+		})
+		offset = next + 10 + length
+	}
+	if offset != len(msg) {
+		t.Fatalf("%d bytes after the records", len(msg)-offset)
+	}
+
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	return binary.BigEndian.Uint16(msg), qdcount, records[:ancount], records[ancount:]
+}
+
+// types returns the names and types of records, name/type.
+func types(records []rr) []string {
+	list := []string{}
+	for _, r := range records {
+		list = append(list, r.name+"/"+map[uint16]string{typeA: "A", typeAAAA: "AAAA", typePTR: "PTR", typeSRV: "SRV", typeTXT: "TXT"}[r.rtype])
+	}
+
+	return list
+}
+
+func testResponder() *Responder {
+	return &Responder{
+		Service: Service{
+			Instance: "txwifi b827eb123456",
+			Type:     "_http._tcp",
+			Host:     "txwifi",
+			Port:     8080,
+			Txt:      []string{"id=b827eb123456", "version=1.0.4"},
+		},
+		Addrs: func() []net.IP {
+			return []net.IP{net.ParseIP("192.168.27.1"), net.ParseIP("fe80::1")}
+		},
+	}
+}
+
+func TestParseQuestions(t *testing.T) {
+	qs, err := ParseQuestions(query(0, question{"txwifi.local", typeA, false}, question{"_http._tcp.local", typePTR, true}))
+	want := []Question{
+		{Name: []string{"txwifi", "local"}, Type: typeA},
+		{Name: []string{"_http", "_tcp", "local"}, Type: typePTR, Unicast: true},
+	}
+	if err != nil || !reflect.DeepEqual(qs, want) {
+		t.Errorf("parsed %+v, %v", qs, err)
+	}
+
+	// the second question points into the first
+	compressed := query(0, question{"txwifi.local", typeA, false})
+	compressed[5] = 2
+	compressed = append(compressed, 0xc0, 19, 0, typeAAAA, 0, classIN)
+	qs, err = ParseQuestions(compressed)
+	if err != nil || len(qs) != 2 || !reflect.DeepEqual(qs[1].Name, []string{"local"}) || qs[1].Type != typeAAAA {
+		t.Errorf("parsed %+v, %v", qs, err)
+	}
+
+	response := query(0, question{"txwifi.local", typeA, false})
+	response[2] = 0x84
+	notify := query(0, question{"txwifi.local", typeA, false})
+	notify[2] = 4 << 3
+	for name, msg := range map[string][]byte{"response": response, "notify": notify} {
+		if qs, err := ParseQuestions(msg); err != nil || qs != nil {
+			t.Errorf("%s parsed to %+v, %v", name, qs, err)
+		}
+	}
+
+	loop := append(query(0)[:12], 0xc0, 12, 0, 1, 0, 1)
+	loop[5] = 1
+	invalid := map[string][]byte{
+		"short":          query(0)[:11],
+		"name overrun":   query(0, question{"txwifi.local", typeA, false})[:16],
+		"no terminator":  query(0, question{"txwifi.local", typeA, false})[:25],
+		"type overrun":   query(0, question{"txwifi.local", typeA, false})[:28],
+		"missing":        append(query(0, question{"txwifi.local", typeA, false})[:4], 0, 2),
+		"pointer loop":   loop,
+		"pointer out":    append(append(query(0)[:5], 1, 0, 0, 0, 0, 0, 0), 0xc0, 0xff, 0, 1, 0, 1),
+		"half pointer":   append(append(query(0)[:5], 1, 0, 0, 0, 0, 0, 0), 0xc0),
+		"reserved label": append(append(query(0)[:5], 1, 0, 0, 0, 0, 0, 0), 0x40, 0, 0, 1, 0, 1),
+	}
+	for name, msg := range invalid {
+		if qs, err := ParseQuestions(msg); err == nil {
+			t.Errorf("%s parsed to %+v", name, qs)
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	r := testResponder()
+
+	tests := []struct {
+		name       string
+		questions  []question
+		answers    []string
+		additional []string
+		unicast    bool
+	}{
+		{"host A", []question{{"txwifi.local", typeA, false}}, []string{"txwifi.local/A"}, []string{}, false},
+		{"host AAAA", []question{{"TXWIFI.Local", typeAAAA, false}}, []string{"txwifi.local/AAAA"}, []string{}, false},
+		{"host ANY", []question{{"txwifi.local", typeANY, true}}, []string{"txwifi.local/A", "txwifi.local/AAAA"}, []string{}, true},
+		{
+			"browse", []question{{"_http._tcp.local", typePTR, false}},
+			[]string{"_http._tcp.local/PTR"},
+			[]string{"txwifi b827eb123456._http._tcp.local/SRV", "txwifi b827eb123456._http._tcp.local/TXT", "txwifi.local/A", "txwifi.local/AAAA"},
+			false,
+		},
+		{
+			"resolve", []question{{"txwifi b827eb123456._http._tcp.local", typeSRV, false}},
+			[]string{"txwifi b827eb123456._http._tcp.local/SRV"},
+			[]string{"txwifi.local/A", "txwifi.local/AAAA"},
+			false,
+		},
+		{"txt", []question{{"txwifi b827eb123456._http._tcp.local", typeTXT, false}}, []string{"txwifi b827eb123456._http._tcp.local/TXT"}, []string{"txwifi.local/A", "txwifi.local/AAAA"}, false},
+		{"service types", []question{{"_services._dns-sd._udp.local", typePTR, false}}, []string{"_services._dns-sd._udp.local/PTR"}, []string{}, false},
+		{
+			"repeated", []question{{"txwifi.local", typeA, false}, {"txwifi.local", typeA, false}, {"txwifi.local", typeANY, false}},
+			[]string{"txwifi.local/A", "txwifi.local/AAAA"}, []string{}, false,
+		},
+		{
+			"answered after added", []question{{"_http._tcp.local", typePTR, false}, {"txwifi.local", typeA, false}},
+			[]string{"_http._tcp.local/PTR", "txwifi.local/A"},
+			[]string{"txwifi b827eb123456._http._tcp.local/SRV", "txwifi b827eb123456._http._tcp.local/TXT", "txwifi.local/AAAA"},
+			false,
+		},
+		{"known and unknown", []question{{"other.local", typeA, true}, {"txwifi.local", typeA, false}}, []string{"txwifi.local/A"}, []string{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, unicast, err := r.Answer(query(0x1234, tt.questions...), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unicast != tt.unicast {
+				t.Errorf("unicast %v", unicast)
+			}
+			id, qdcount, answers, additional := parseResponse(t, resp)
+			if id != 0 || qdcount != 0 {
+				t.Errorf("id %d, %d questions", id, qdcount)
+			}
+			if !reflect.DeepEqual(types(answers), tt.answers) || !reflect.DeepEqual(types(additional), tt.additional) {
+				t.Errorf("answered %q + %q, want %q + %q", types(answers), types(additional), tt.answers, tt.additional)
+			}
+			for _, rec := range append(answers, additional...) {
+				if flush := rec.class&cacheFlush != 0; rec.class&^cacheFlush != classIN || flush != (rec.rtype != typePTR) {
+					t.Errorf("%s/%d class %x", rec.name, rec.rtype, rec.class)
+				}
+			}
+		})
+	}
+
+	for _, q := range []question{{"other.local", typeA, false}, {"_http._tcp.local", typeA, false}, {"txwifi b827eb123456._http._tcp.local", typeA, false}, {"txwifi.local", typePTR, false}} {
+		if resp, _, err := r.Answer(query(0, q), false); resp != nil || err != nil {
+			t.Errorf("%+v answered % x, %v", q, resp, err)
+		}
+	}
+	if resp, _, err := r.Answer([]byte{1, 2}, false); resp != nil || err == nil {
+		t.Errorf("short query answered % x, %v", resp, err)
+	}
+}
+
+func TestAnswerRecords(t *testing.T) {
+	r := testResponder()
+
+	resp, _, err := r.Answer(query(0, question{"_http._tcp.local", typePTR, false}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, answers, additional := parseResponse(t, resp)
+
+	ptr := answers[0]
+	if !bytes.Equal(ptr.data, encodeName([]string{"txwifi b827eb123456", "_http", "_tcp", "local"})) || ptr.ttl != serviceTTL {
+		t.Errorf("ptr %+v", ptr)
+	}
+	srv := additional[0]
+	wantSrv := append([]byte{0, 0, 0, 0, 0x1f, 0x90}, encodeName([]string{"txwifi", "local"})...)
+	if !bytes.Equal(srv.data, wantSrv) || srv.ttl != hostTTL {
+		t.Errorf("srv %+v", srv)
+	}
+	txt := additional[1]
+	if want := "\x0fid=b827eb123456\x0dversion=1.0.4"; string(txt.data) != want {
+		t.Errorf("txt %q, want %q", txt.data, want)
+	}
+	if a, aaaa := additional[2], additional[3]; !bytes.Equal(a.data, []byte{192, 168, 27, 1}) || !net.IP(aaaa.data).Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("addresses %+v %+v", a, aaaa)
+	}
+
+	// an empty TXT record holds one empty string, long strings are cut
+	r.Service.Txt = nil
+	if recs := r.instanceRecords(); !bytes.Equal(recs[1].data, []byte{0}) {
+		t.Errorf("empty txt % x", recs[1].data)
+	}
+	r.Service.Txt = []string{strings.Repeat("x", 300)}
+	if recs := r.instanceRecords(); len(recs[1].data) != 256 || recs[1].data[0] != 255 {
+		t.Errorf("long txt of %d bytes", len(recs[1].data))
+	}
+
+	// no addresses yet
+	r.Addrs = nil
+	if resp, _, _ := r.Answer(query(0, question{"txwifi.local", typeA, false}), false); resp != nil {
+		t.Errorf("answered % x without addresses", resp)
+	}
+}
+
+func TestAnswerLegacy(t *testing.T) {
+	r := testResponder()
+	q := query(0xbeef, question{"txwifi.local", typeA, false}, question{"other.local", typeA, false})
+
+	resp, unicast, err := r.Answer(q, true)
+	if err != nil || !unicast {
+		t.Fatalf("unicast %v, %v", unicast, err)
+	}
+	id, qdcount, answers, _ := parseResponse(t, resp)
+	if id != 0xbeef || qdcount != 2 || !bytes.Equal(resp[12:len(q)], q[12:]) {
+		t.Errorf("id %x, %d questions: % x", id, qdcount, resp)
+	}
+	if len(answers) != 1 || answers[0].ttl != legacyTTL || answers[0].class != classIN {
+		t.Errorf("answers %+v", answers)
+	}
+}
+
+func TestAnnouncement(t *testing.T) {
+	r := testResponder()
+
+	for _, goodbye := range []bool{false, true} {
+		_, qdcount, answers, additional := parseResponse(t, r.Announcement(goodbye))
+		want := []string{
+			"_http._tcp.local/PTR",
+			"txwifi b827eb123456._http._tcp.local/SRV",
+			"txwifi b827eb123456._http._tcp.local/TXT",
+			"txwifi.local/A",
+			"txwifi.local/AAAA",
+			"_services._dns-sd._udp.local/PTR",
+		}
+		if qdcount != 0 || len(additional) != 0 || !reflect.DeepEqual(types(answers), want) {
+			t.Errorf("announced %q", types(answers))
+		}
+		for _, rec := range answers {
+			if (rec.ttl == 0) != goodbye {
+				t.Errorf("goodbye %v: %s ttl %d", goodbye, rec.name, rec.ttl)
+			}
+		}
+	}
+}
+
+func FuzzAnswer(f *testing.F) {
+	f.Add(query(0, question{"txwifi.local", typeANY, true}), false)
+	f.Add(query(7, question{"_http._tcp.local", typePTR, false}, question{"txwifi.local", typeA, false}), true)
+	f.Add(append(append(query(0)[:5], 2, 0, 0, 0, 0, 0, 0), 6, 't', 'x', 'w', 'i', 'f', 'i', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0, 1, 0xc0, 12, 0, 28, 0, 1), true)
+
+	r := testResponder()
+	f.Fuzz(func(t *testing.T, msg []byte, legacy bool) {
+		resp, _, err := r.Answer(msg, legacy)
+		if err != nil || resp == nil {
+			return
+		}
+
+		id, qdcount, answers, additional := parseResponse(t, resp)
+		if legacy && (id != binary.BigEndian.Uint16(msg) || qdcount != int(binary.BigEndian.Uint16(msg[4:]))) {
+			t.Fatalf("% x answered % x", msg, resp)
+		}
+		if len(answers) == 0 || len(answers)+len(additional) > 6 {
+			t.Fatalf("% x answered %q + %q", msg, types(answers), types(additional))
+		}
+	})
+}
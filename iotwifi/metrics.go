@@ -0,0 +1,153 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kinokochat/txwifi/iotwifi/process"
+)
+
+// MetricsContentType is the content type of the Prometheus text format
+// WritePrometheus writes.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// eventSeries identifies the counter of one kind of event.
+type eventSeries struct {
+	Type   string
+	Source string
+	Iface  string
+}
+
+// Metrics counts the events published on a bus, the AP clients that
+// joined, the EAP failures and the rest, for scraping.
+type Metrics struct {
+	mu     sync.Mutex
+	events map[eventSeries]uint64
+}
+
+// NewMetrics produces Metrics with no events counted.
+func NewMetrics() *Metrics {
+	return &Metrics{events: make(map[eventSeries]uint64)}
+}
+
+// Run counts the events on bus until ctx is done.
+func (m *Metrics) Run(ctx context.Context, bus *EventBus) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			m.Count(ev)
+		}
+	}
+}
+
+// Count counts ev.
+func (m *Metrics) Count(ev Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events[eventSeries{Type: ev.Type, Source: ev.Source, Iface: ev.Iface}]++
+}
+
+// counts returns the event counters.
+func (m *Metrics) counts() map[eventSeries]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[eventSeries]uint64, len(m.events))
+	for s, n := range m.events {
+		counts[s] = n
+	}
+
+	return counts
+}
+
+// WritePrometheus writes the event counters, the state of processes and
+// the last latency probes in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer, processes []process.Status, latency []LatencyResult) error {
+	m.mu.Lock()
+	series := make([]eventSeries, 0, len(m.events))
+	counts := make(map[eventSeries]uint64, len(m.events))
+	for s, n := range m.events {
+		series = append(series, s)
+		counts[s] = n
+	}
+	m.mu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Iface < b.Iface
+	})
+
+	bw := bufio.NewWriter(w)
+
+	metricHeader(bw, "txwifi_events_total", "counter", "Events of wpa_supplicant, hostapd and txwifi, by type.")
+	for _, s := range series {
+		fmt.Fprintf(bw, "txwifi_events_total{type=%s,source=%s,iface=%s} %d\n", metricLabel(s.Type), metricLabel(s.Source), metricLabel(s.Iface), counts[s])
+	}
+
+	metricHeader(bw, "txwifi_process_up", "gauge", "Whether the child process is running.")
+	for _, p := range processes {
+		up := 0
+		if p.State == process.Running {
+			up = 1
+		}
+		fmt.Fprintf(bw, "txwifi_process_up{process=%s} %d\n", metricLabel(p.Name), up)
+	}
+
+	metricHeader(bw, "txwifi_process_restarts_total", "counter", "Restarts of the child process by its restart policy.")
+	for _, p := range processes {
+		fmt.Fprintf(bw, "txwifi_process_restarts_total{process=%s} %d\n", metricLabel(p.Name), p.Restarts)
+	}
+
+	metricHeader(bw, "txwifi_process_uptime_seconds", "gauge", "How long the child process has been running.")
+	for _, p := range processes {
+		fmt.Fprintf(bw, "txwifi_process_uptime_seconds{process=%s} %d\n", metricLabel(p.Name), p.UptimeSec)
+	}
+
+	metricHeader(bw, "txwifi_latency_rtt_seconds", "gauge", "Average round trip time of the last latency probe of the target.")
+	for _, l := range latency {
+		fmt.Fprintf(bw, "txwifi_latency_rtt_seconds{target=%s} %g\n", metricLabel(l.Target), l.RttAvg/1000)
+	}
+
+	metricHeader(bw, "txwifi_latency_rtt_max_seconds", "gauge", "Longest round trip time of the last latency probe of the target.")
+	for _, l := range latency {
+		fmt.Fprintf(bw, "txwifi_latency_rtt_max_seconds{target=%s} %g\n", metricLabel(l.Target), l.RttMax/1000)
+	}
+
+	metricHeader(bw, "txwifi_latency_loss_ratio", "gauge", "Share of the pings of the last latency probe of the target that were lost.")
+	for _, l := range latency {
+		fmt.Fprintf(bw, "txwifi_latency_loss_ratio{target=%s} %g\n", metricLabel(l.Target), l.Loss)
+	}
+
+	return bw.Flush()
+}
+
+// metricHeader writes the HELP and TYPE lines of a metric.
+func metricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// metricLabel quotes a label value, escaping backslashes, quotes and
+// newlines.
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
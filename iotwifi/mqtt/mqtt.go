@@ -0,0 +1,559 @@
+// Package mqtt is a small MQTT 3.1.1 client, enough to publish state to a
+// broker and take commands from it: QoS 0 and 1, subscriptions, keep
+// alive and a last will. It has no persistence and does not reconnect,
+// the caller dials again when Done is closed.
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet types.
+const (
+	typeConnect     = 1
+	typeConnack     = 2
+	typePublish     = 3
+	typePuback      = 4
+	typeSubscribe   = 8
+	typeSuback      = 9
+	typePingreq     = 12
+	typePingresp    = 13
+	typeDisconnect  = 14
+	maxRemainingLen = 268435455
+	maxStringLen    = 65535 // of a string or binary field, its length takes 2 bytes
+)
+
+// DefaultKeepAlive is the keep alive when Options leaves it out.
+const DefaultKeepAlive = 60 * time.Second
+
+// ErrClosed is returned for operations on a lost or closed connection.
+var ErrClosed = errors.New("mqtt: connection closed")
+
+// connackErrors are the CONNACK return codes.
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Message is a published message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte // 0 or 1
+	Retain  bool
+}
+
+// Options are the CONNECT settings.
+type Options struct {
+	ClientId  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration // DefaultKeepAlive when 0
+	Will      *Message      // published by the broker if the client goes away
+	TLS       *tls.Config   // for tls:// and mqtts:// brokers, defaults when nil
+}
+
+// Client is a connection to a broker.
+type Client struct {
+	conn      net.Conn
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextId  uint16
+	pending map[uint16]chan byte // acks awaited, by packet id
+	err     error
+
+	messages chan Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Dial connects to broker, tcp://host:1883 or tls://host:8883 (mqtt://
+// and mqtts:// too), and waits for the broker to accept the session.
+func Dial(ctx context.Context, broker string, opts Options) (*Client, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := false
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		secure, port = true, "8883"
+	default:
+		return nil, fmt.Errorf("mqtt: unsupported scheme %q", u.Scheme)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if secure {
+		cfg := opts.TLS
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive := opts.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	c := &Client{
+		conn:      conn,
+		keepAlive: keepAlive,
+		pending:   map[uint16]chan byte{},
+		messages:  make(chan Message, 16),
+		done:      make(chan struct{}),
+	}
+
+	if err := c.connect(ctx, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.read()
+	go c.ping()
+
+	return c, nil
+}
+
+// connect sends CONNECT and reads the CONNACK.
+func (c *Client) connect(ctx context.Context, opts Options) error {
+	if len(opts.ClientId) > maxStringLen || len(opts.Username) > maxStringLen || len(opts.Password) > maxStringLen {
+		return fmt.Errorf("mqtt: client id, username and password must be at most %d bytes", maxStringLen)
+	}
+	if will := opts.Will; will != nil {
+		if err := checkMessage(*will); err != nil {
+			return fmt.Errorf("mqtt: will: %w", err)
+		}
+		if len(will.Payload) > maxStringLen {
+			return fmt.Errorf("mqtt: will payload must be at most %d bytes", maxStringLen)
+		}
+	}
+
+	flags := byte(0x02) // clean session
+	payload := appendString(nil, opts.ClientId)
+
+	if will := opts.Will; will != nil {
+		flags |= 0x04 | will.QoS<<3
+		if will.Retain {
+			flags |= 0x20
+		}
+		payload = appendString(payload, will.Topic)
+		payload = appendBytes(payload, will.Payload)
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		payload = appendString(payload, opts.Username)
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+		payload = appendString(payload, opts.Password)
+	}
+
+	header := appendString(nil, "MQTT")
+	header = append(header, 4, flags) // protocol level 4 is 3.1.1
+	header = appendUint16(header, uint16(c.keepAlive/time.Second))
+
+	deadline := time.Now().Add(30 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.write(typeConnect<<4, append(header, payload...)); err != nil {
+		return err
+	}
+
+	packetType, body, err := readPacket(c.conn)
+	if err != nil {
+		return err
+	}
+	if packetType>>4 != typeConnack || len(body) < 2 {
+		return errors.New("mqtt: expected CONNACK")
+	}
+	if code := body[1]; code != 0 {
+		if reason, ok := connackErrors[code]; ok {
+			return fmt.Errorf("mqtt: connection refused: %s", reason)
+		}
+		return fmt.Errorf("mqtt: connection refused: code %d", code)
+	}
+
+	return nil
+}
+
+// Messages delivers the messages of the subscriptions. It is closed when
+// the connection is.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Done is closed when the connection is lost or closed, Err says why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, nil while it is up.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Publish sends msg, waiting for the broker's acknowledgement at QoS 1.
+func (c *Client) Publish(ctx context.Context, msg Message) error {
+	if err := checkMessage(msg); err != nil {
+		return fmt.Errorf("mqtt: %w", err)
+	}
+
+	flags := byte(typePublish<<4) | msg.QoS<<1
+	if msg.Retain {
+		flags |= 0x01
+	}
+
+	body := appendString(nil, msg.Topic)
+	if msg.QoS == 0 {
+		return c.write(flags, append(body, msg.Payload...))
+	}
+
+	id, ack := c.await()
+	body = appendUint16(body, id)
+	if err := c.write(flags, append(body, msg.Payload...)); err != nil {
+		c.forget(id)
+		return err
+	}
+
+	_, err := c.wait(ctx, id, ack)
+	return err
+}
+
+// Subscribe subscribes to topic, which may hold + and # wildcards.
+func (c *Client) Subscribe(ctx context.Context, topic string, qos byte) error {
+	if topic == "" || len(topic) > maxStringLen || qos > 1 {
+		return fmt.Errorf("mqtt: invalid subscription to %q at QoS %d", topic, qos)
+	}
+
+	id, ack := c.await()
+
+	body := appendUint16(nil, id)
+	body = appendString(body, topic)
+	body = append(body, qos)
+	if err := c.write(typeSubscribe<<4|0x02, body); err != nil {
+		c.forget(id)
+		return err
+	}
+
+	code, err := c.wait(ctx, id, ack)
+	if err != nil {
+		return err
+	}
+	if code == 0x80 {
+		return fmt.Errorf("mqtt: subscription to %s refused", topic)
+	}
+
+	return nil
+}
+
+// Close disconnects cleanly, the broker does not publish the will.
+func (c *Client) Close() error {
+	c.write(typeDisconnect<<4, nil)
+	c.shutdown(ErrClosed)
+
+	return nil
+}
+
+// checkMessage checks msg can be published: a topic of 1-65535 bytes
+// without wildcards, at QoS 0 or 1.
+func checkMessage(msg Message) error {
+	switch {
+	case msg.Topic == "" || len(msg.Topic) > maxStringLen:
+		return fmt.Errorf("topic must be 1-%d bytes, not %d", maxStringLen, len(msg.Topic))
+	case strings.ContainsAny(msg.Topic, "+#\x00"):
+		return fmt.Errorf("topic %q holds a wildcard or a NUL", msg.Topic)
+	case msg.QoS > 1:
+		return fmt.Errorf("QoS %d is not supported", msg.QoS)
+	}
+
+	return nil
+}
+
+// await reserves a packet id and the channel its ack arrives on.
+func (c *Client) await() (uint16, chan byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextId++
+	if c.nextId == 0 {
+		c.nextId = 1
+	}
+
+	ack := make(chan byte, 1)
+	c.pending[c.nextId] = ack
+
+	return c.nextId, ack
+}
+
+// forget drops the ack awaited for id.
+func (c *Client) forget(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+}
+
+// wait waits for the ack of id and returns its code, for SUBACK the
+// granted QoS.
+func (c *Client) wait(ctx context.Context, id uint16, ack chan byte) (byte, error) {
+	defer c.forget(id)
+
+	select {
+	case code := <-ack:
+		return code, nil
+	case <-c.done:
+		return 0, c.Err()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// read handles incoming packets until the connection fails. A broker that
+// stays silent past one and a half keep alives is taken as gone.
+func (c *Client) read() {
+	defer close(c.messages)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+
+		packetType, body, err := readPacket(reader)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch packetType >> 4 {
+		case typePublish:
+			msg, id, err := parsePublish(packetType, body)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			if msg.QoS > 0 {
+				c.write(typePuback<<4, appendUint16(nil, id))
+			}
+
+			select {
+			case c.messages <- msg:
+			case <-c.done:
+				return
+			}
+
+		case typePuback, typeSuback:
+			if len(body) < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(body)
+
+			code := byte(0)
+			if packetType>>4 == typeSuback && len(body) > 2 {
+				code = body[2]
+			}
+
+			c.mu.Lock()
+			if ack, ok := c.pending[id]; ok {
+				ack <- code
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// ping sends a PINGREQ every half keep alive, the broker drops clients
+// silent for longer than one and a half.
+func (c *Client) ping() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(typePingreq<<4, nil); err != nil {
+				c.shutdown(err)
+				return
+			}
+		}
+	}
+}
+
+// shutdown closes the connection once, recording why.
+func (c *Client) shutdown(err error) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// write sends a packet with the fixed header byte first.
+func (c *Client) write(first byte, body []byte) error {
+	if len(body) > maxRemainingLen {
+		return errors.New("mqtt: packet too large")
+	}
+
+	packet := append([]byte{first}, encodeLength(len(body))...)
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+	_, err := c.conn.Write(packet)
+
+	return err
+}
+
+// readPacket reads one packet and returns its first header byte and body.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length += int(b[0]&0x7f) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	// read as it arrives, a length alone does not allocate
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(body) < length {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	return first[0], body, nil
+}
+
+// parsePublish parses a PUBLISH body, returning the packet id for QoS 1.
+func parsePublish(first byte, body []byte) (Message, uint16, error) {
+	msg := Message{QoS: (first >> 1) & 0x03, Retain: first&0x01 != 0}
+
+	if msg.QoS > 1 {
+		return msg, 0, fmt.Errorf("mqtt: unsupported PUBLISH QoS %d", msg.QoS)
+	}
+	if len(body) < 2 {
+		return msg, 0, errors.New("mqtt: malformed PUBLISH")
+	}
+	topicLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+topicLen {
+		return msg, 0, errors.New("mqtt: malformed PUBLISH")
+	}
+	msg.Topic = string(body[2 : 2+topicLen])
+	rest := body[2+topicLen:]
+
+	var id uint16
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return msg, 0, errors.New("mqtt: malformed PUBLISH")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	msg.Payload = append([]byte{}, rest...)
+
+	return msg, id, nil
+}
+
+// encodeLength encodes the remaining length, 7 bits a byte.
+func encodeLength(length int) []byte {
+	encoded := []byte{}
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+// appendString appends s with its 2 byte length.
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+// appendBytes appends data with its 2 byte length.
+func appendBytes(b []byte, data []byte) []byte {
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// appendUint16 appends v big endian.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,445 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeLength(t *testing.T) {
+	// the examples of the MQTT 3.1.1 spec, section 2.2.3
+	tests := []struct {
+		length  int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{maxRemainingLen, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+
+	for _, tt := range tests {
+		if encoded := encodeLength(tt.length); !bytes.Equal(encoded, tt.encoded) {
+			t.Errorf("encodeLength(%d) = % x, want % x", tt.length, encoded, tt.encoded)
+		}
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		first  byte
+		body   []byte
+		failed bool
+	}{
+		{"empty body", []byte{0xd0, 0x00}, 0xd0, []byte{}, false},
+		{"body", []byte{0x40, 0x02, 0x00, 0x07}, 0x40, []byte{0x00, 0x07}, false},
+		{"two byte length", append([]byte{0x30, 0x80, 0x01}, make([]byte, 128)...), 0x30, make([]byte, 128), false},
+		{"trailing data", []byte{0x40, 0x01, 0x09, 0xff}, 0x40, []byte{0x09}, false},
+		{"nothing", []byte{}, 0, nil, true},
+		{"no length", []byte{0x30}, 0, nil, true},
+		{"five byte length", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}, 0, nil, true},
+		{"short body", []byte{0x30, 0x03, 0x00}, 0, nil, true},
+		// a length alone does not get 256MB allocated
+		{"huge length", []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00}, 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, body, err := readPacket(bytes.NewReader(tt.data))
+			if (err != nil) != tt.failed {
+				t.Fatalf("err %v, want failed %v", err, tt.failed)
+			}
+			if !tt.failed && (first != tt.first || !bytes.Equal(body, tt.body)) {
+				t.Errorf("read %#x % x, want %#x % x", first, body, tt.first, tt.body)
+			}
+		})
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	tests := []struct {
+		name  string
+		first byte
+		body  []byte
+		msg   Message
+		id    uint16
+		err   bool
+	}{
+		{
+			name:  "qos 0",
+			first: 0x30,
+			body:  []byte("\x00\x03a/bhi"),
+			msg:   Message{Topic: "a/b", Payload: []byte("hi")},
+		},
+		{
+			name:  "qos 1 retained",
+			first: 0x33,
+			body:  []byte("\x00\x01t\x12\x34{}"),
+			msg:   Message{Topic: "t", Payload: []byte("{}"), QoS: 1, Retain: true},
+			id:    0x1234,
+		},
+		{
+			name:  "empty payload",
+			first: 0x30,
+			body:  []byte("\x00\x01t"),
+			msg:   Message{Topic: "t", Payload: []byte{}},
+		},
+		{name: "no topic length", first: 0x30, body: []byte{0x00}, err: true},
+		{name: "short topic", first: 0x30, body: []byte("\x00\x05abc"), err: true},
+		{name: "no packet id", first: 0x32, body: []byte("\x00\x01t\x00"), err: true},
+		{name: "qos 2", first: 0x34, body: []byte("\x00\x01t\x00\x01"), err: true},
+		{name: "qos 3", first: 0x36, body: []byte("\x00\x01t\x00\x01"), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, id, err := parsePublish(tt.first, tt.body)
+			if (err != nil) != tt.err {
+				t.Fatalf("err %v, want failed %v", err, tt.err)
+			}
+			if !tt.err && (!reflect.DeepEqual(msg, tt.msg) || id != tt.id) {
+				t.Errorf("parsed %+v id %d, want %+v id %d", msg, id, tt.msg, tt.id)
+			}
+		})
+	}
+}
+
+func FuzzReadPacket(f *testing.F) {
+	f.Add([]byte{0x30, 0x05, 0x00, 0x01, 't', 'h', 'i'})
+	f.Add([]byte{0x32, 0x80, 0x01})
+	f.Add([]byte{0x90, 0x03, 0x00, 0x01, 0x80})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		first, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		// the bytes read are the header, a length of at most 4 bytes
+		// and the body
+		read := len(data) - r.Len()
+		if header := read - len(body) - 1; header < 1 || header > 4 || data[0] != first {
+			t.Fatalf("read %d bytes for a body of %d", read, len(body))
+		}
+
+		if first>>4 != typePublish {
+			return
+		}
+		msg, id, err := parsePublish(first, body)
+		if err != nil {
+			return
+		}
+
+		// written back, the PUBLISH is the same
+		again := appendString(nil, msg.Topic)
+		if msg.QoS > 0 {
+			again = appendUint16(again, id)
+		}
+		if again = append(again, msg.Payload...); !bytes.Equal(again, body) {
+			t.Fatalf("PUBLISH % x parsed as %+v, written back as % x", body, msg, again)
+		}
+	})
+}
+
+// broker is one end of a session, the test playing the broker.
+type broker struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// listen starts a broker for one client, returning its URL and the
+// session once the client connects.
+func listen(t *testing.T) (string, <-chan *broker) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := make(chan *broker, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sessions <- &broker{t: t, conn: conn}
+	}()
+
+	return "tcp://" + ln.Addr().String(), sessions
+}
+
+// expect reads a packet of packetType.
+func (b *broker) expect(packetType byte) (byte, []byte) {
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	first, body, err := readPacket(b.conn)
+	if err != nil {
+		b.t.Errorf("broker: %s", err)
+		return 0, nil
+	}
+	if first>>4 != packetType {
+		b.t.Errorf("broker got packet type %d, want %d", first>>4, packetType)
+	}
+
+	return first, body
+}
+
+// send writes a packet.
+func (b *broker) send(first byte, body []byte) {
+	packet := append(append([]byte{first}, encodeLength(len(body))...), body...)
+	if _, err := b.conn.Write(packet); err != nil {
+		b.t.Errorf("broker: %s", err)
+	}
+}
+
+// readString reads a length prefixed field of body at *pos.
+func readString(body []byte, pos *int) string {
+	if len(body) < *pos+2 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(body[*pos:]))
+	if len(body) < *pos+2+n {
+		return ""
+	}
+	s := string(body[*pos+2 : *pos+2+n])
+	*pos += 2 + n
+
+	return s
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		flags   byte
+		payload []string
+		code    byte
+		err     string
+	}{
+		{
+			name:    "anonymous",
+			opts:    Options{ClientId: "txwifi-1"},
+			flags:   0x02,
+			payload: []string{"txwifi-1"},
+		},
+		{
+			name:    "will and login",
+			opts:    Options{ClientId: "c", Username: "u", Password: "p", Will: &Message{Topic: "dev/online", Payload: []byte("offline"), QoS: 1, Retain: true}},
+			flags:   0x02 | 0x04 | 0x08 | 0x20 | 0x80 | 0x40,
+			payload: []string{"c", "dev/online", "offline", "u", "p"},
+		},
+		{
+			name:    "refused",
+			opts:    Options{ClientId: "c", Username: "u", Password: "wrong"},
+			flags:   0xc2,
+			payload: []string{"c", "u", "wrong"},
+			code:    4,
+			err:     "bad user name or password",
+		},
+		{
+			name:    "unknown refusal",
+			opts:    Options{ClientId: "c"},
+			flags:   0x02,
+			payload: []string{"c"},
+			code:    42,
+			err:     "code 42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, sessions := listen(t)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				b := <-sessions
+				defer b.conn.Close()
+
+				_, body := b.expect(typeConnect)
+				pos := 0
+				if protocol := readString(body, &pos); protocol != "MQTT" || len(body) < pos+4 || body[pos] != 4 {
+					t.Errorf("CONNECT % x", body)
+					return
+				}
+				if flags := body[pos+1]; flags != tt.flags {
+					t.Errorf("flags %#x, want %#x", flags, tt.flags)
+				}
+				if keepAlive := binary.BigEndian.Uint16(body[pos+2:]); keepAlive != 60 {
+					t.Errorf("keep alive %d", keepAlive)
+				}
+				pos += 4
+
+				payload := []string{}
+				for pos < len(body) {
+					payload = append(payload, readString(body, &pos))
+				}
+				if !reflect.DeepEqual(payload, tt.payload) {
+					t.Errorf("payload %q, want %q", payload, tt.payload)
+				}
+
+				b.send(typeConnack<<4, []byte{0, tt.code})
+				if tt.code == 0 {
+					b.expect(typeDisconnect)
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client, err := Dial(ctx, url, tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err %v, want %s", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				client.Close()
+				if !errors.Is(client.Err(), ErrClosed) {
+					t.Errorf("closed with %v", client.Err())
+				}
+			}
+			<-done
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	url, sessions := listen(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	connected := make(chan *broker, 1)
+	go func() {
+		b := <-sessions
+		b.expect(typeConnect)
+		b.send(typeConnack<<4, []byte{0, 0})
+		connected <- b
+	}()
+
+	client, err := Dial(ctx, url, Options{ClientId: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	b := <-connected
+	defer b.conn.Close()
+
+	// QoS 1 waits for the PUBACK of its packet id
+	published := make(chan error, 1)
+	go func() {
+		published <- client.Publish(ctx, Message{Topic: "dev/state", Payload: []byte(`{"up":true}`), QoS: 1, Retain: true})
+	}()
+	first, body := b.expect(typePublish)
+	msg, id, err := parsePublish(first, body)
+	if err != nil || msg.Topic != "dev/state" || string(msg.Payload) != `{"up":true}` || !msg.Retain || msg.QoS != 1 {
+		t.Fatalf("PUBLISH %+v, %v", msg, err)
+	}
+	select {
+	case err := <-published:
+		t.Fatalf("published before the PUBACK: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.send(typePuback<<4, appendUint16(nil, id))
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+
+	// QoS 0 goes without a packet id
+	if err := client.Publish(ctx, Message{Topic: "dev/log", Payload: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if first, body := b.expect(typePublish); first != typePublish<<4 || !bytes.Equal(body, []byte("\x00\x07dev/logx")) {
+		t.Errorf("PUBLISH %#x % x", first, body)
+	}
+
+	// a refused subscription fails
+	for _, granted := range []byte{1, 0x80} {
+		subscribed := make(chan error, 1)
+		go func() { subscribed <- client.Subscribe(ctx, "dev/cmd/#", 1) }()
+		first, body := b.expect(typeSubscribe)
+		if first != typeSubscribe<<4|0x02 || !bytes.Equal(body[2:], []byte("\x00\x09dev/cmd/#\x01")) {
+			t.Errorf("SUBSCRIBE %#x % x", first, body)
+		}
+		b.send(typeSuback<<4, append(body[:2:2], granted))
+		if err := <-subscribed; (err != nil) != (granted == 0x80) {
+			t.Errorf("granted %#x: %v", granted, err)
+		}
+	}
+
+	// messages from the broker are delivered, QoS 1 acknowledged
+	b.send(typePublish<<4|0x02, []byte("\x00\x07dev/cmd\x00\x2areboot"))
+	select {
+	case msg := <-client.Messages():
+		if msg.Topic != "dev/cmd" || string(msg.Payload) != "reboot" || msg.QoS != 1 {
+			t.Errorf("message %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("no message")
+	}
+	if _, body := b.expect(typePuback); !bytes.Equal(body, []byte{0x00, 0x2a}) {
+		t.Errorf("PUBACK % x", body)
+	}
+
+	// a malformed packet ends the session
+	b.send(typePublish<<4, []byte{0x00})
+	select {
+	case <-client.Done():
+	case <-ctx.Done():
+		t.Fatal("session survived a malformed PUBLISH")
+	}
+	if err := client.Publish(ctx, Message{Topic: "dev/log"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("published after the session ended: %v", err)
+	}
+	if _, ok := <-client.Messages(); ok {
+		t.Error("messages not closed")
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	client := &Client{done: make(chan struct{})}
+	ctx := context.Background()
+
+	for _, msg := range []Message{
+		{Topic: ""},
+		{Topic: "a/+"},
+		{Topic: "a/#"},
+		{Topic: "a\x00"},
+		{Topic: strings.Repeat("a", maxStringLen+1)},
+		{Topic: "a", QoS: 2},
+	} {
+		if err := client.Publish(ctx, msg); err == nil || errors.Is(err, ErrClosed) {
+			t.Errorf("published %.20q at QoS %d: %v", msg.Topic, msg.QoS, err)
+		}
+	}
+
+	for _, sub := range []struct {
+		topic string
+		qos   byte
+	}{{"", 0}, {"a", 2}, {strings.Repeat("a", maxStringLen+1), 0}} {
+		if err := client.Subscribe(ctx, sub.topic, sub.qos); err == nil || errors.Is(err, ErrClosed) {
+			t.Errorf("subscribed to %.20q at QoS %d: %v", sub.topic, sub.qos, err)
+		}
+	}
+
+	if _, err := Dial(ctx, "http://broker", Options{}); err == nil {
+		t.Error("dialed an http url")
+	}
+	if err := (&Client{}).connect(ctx, Options{Will: &Message{Topic: "t", Payload: make([]byte, maxStringLen+1)}}); err == nil {
+		t.Error("connected with a will too large")
+	}
+}
@@ -0,0 +1,130 @@
+// Package netif manages network interfaces through netlink instead of
+// shelling out to ip, ifconfig and iw: creating and deleting the virtual
+// AP interface, bringing links up and down, setting addresses and reading
+// link state.
+
+package netif
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Errors returned (wrapped in a LinkError) by netif functions.
+var (
+	ErrLinkNotFound = errors.New("link not found")
+	ErrUnsupported  = errors.New("not supported on this platform")
+)
+
+// Interface types for AddWirelessInterface.
+const (
+	TypeStation = 2 // NL80211_IFTYPE_STATION
+	TypeAP      = 3 // NL80211_IFTYPE_AP
+)
+
+// LinkError records the operation and link that failed.
+type LinkError struct {
+	Op   string
+	Link string
+	Err  error
+}
+
+func (e *LinkError) Error() string {
+	return "netif: " + e.Op + " " + e.Link + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error, so errors.Is(err, ErrLinkNotFound) works.
+func (e *LinkError) Unwrap() error {
+	return e.Err
+}
+
+// Link is the state of a network interface.
+type Link struct {
+	Name      string   `json:"name"`
+	Index     int      `json:"index"`
+	Mac       string   `json:"mac"`
+	Up        bool     `json:"up"`         // administratively up
+	OperState string   `json:"oper_state"` // up, down, dormant, ...
+	Addrs     []string `json:"addrs"`      // a.b.c.d/prefix
+}
+
+// Neighbor is an entry of the kernel's neighbor table, the ARP cache for
+// IPv4 and the NDP cache for IPv6.
+type Neighbor struct {
+	Ip        string        `json:"ip"`
+	Mac       string        `json:"mac"`
+	State     string        `json:"state"`     // reachable, stale, delay, probe or permanent
+	Confirmed time.Duration `json:"confirmed"` // since the neighbor last answered
+}
+
+// LinkByName returns the state of the interface name.
+func LinkByName(name string) (Link, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return Link{}, &LinkError{Op: "lookup", Link: name, Err: ErrLinkNotFound}
+	}
+
+	link := Link{
+		Name:      ifi.Name,
+		Index:     ifi.Index,
+		Mac:       ifi.HardwareAddr.String(),
+		Up:        ifi.Flags&net.FlagUp != 0,
+		OperState: operState(name),
+		Addrs:     []string{},
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return link, &LinkError{Op: "addrs", Link: name, Err: err}
+	}
+	for _, addr := range addrs {
+		link.Addrs = append(link.Addrs, addr.String())
+	}
+
+	return link, nil
+}
+
+// Exists reports whether the interface name exists.
+func Exists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// BridgePorts returns the interfaces in the bridge name.
+func BridgePorts(name string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join("/sys/class/net", name, "brif"))
+	if err != nil {
+		return nil, &LinkError{Op: "ports", Link: name, Err: ErrLinkNotFound}
+	}
+
+	ports := []string{}
+	for _, file := range files {
+		ports = append(ports, file.Name())
+	}
+
+	return ports, nil
+}
+
+// operState reads the kernel's operational state of name.
+func operState(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "operstate"))
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// index returns the interface index of name.
+func index(op string, name string) (int, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, &LinkError{Op: op, Link: name, Err: ErrLinkNotFound}
+	}
+
+	return ifi.Index, nil
+}
@@ -0,0 +1,504 @@
+//go:build linux
+// +build linux
+
+package netif
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// generic netlink and nl80211 constants not in package syscall
+const (
+	genlIdCtrl            = 0x10
+	ctrlCmdGetFamily      = 3
+	ctrlAttrFamilyId      = 1
+	ctrlAttrFamilyName    = 2
+	nl80211CmdNewIface    = 7
+	nl80211AttrIfindex    = 3
+	nl80211AttrIfname     = 4
+	nl80211AttrIftype     = 5
+	iflaLinkinfo          = 18
+	iflaInfoKind          = 1
+	nlmsgAlignTo          = 4
+	sizeofGenlmsghdr      = 4
+	sizeofIfAddrmsg       = 8
+	sizeofNdmsg           = 12
+	ndaDst                = 1
+	ndaLladdr             = 2
+	ndaCacheinfo          = 3
+	userHz                = 100 // the clock ticks of nda_cacheinfo
+	sizeofRtmsg           = syscall.SizeofRtMsg
+	sizeofIfInfomsgHeader = syscall.SizeofIfInfomsg
+)
+
+// nativeEndian is the byte order netlink uses, the host's.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+var seq uint32
+
+// SetUp brings the interface name up.
+func SetUp(name string) error {
+	return setFlags("up", name, syscall.IFF_UP)
+}
+
+// SetDown takes the interface name down.
+func SetDown(name string) error {
+	return setFlags("down", name, 0)
+}
+
+// setFlags sets the IFF_UP flag of name to flags.
+func setFlags(op string, name string, flags uint32) error {
+	idx, err := index(op, name)
+	if err != nil {
+		return err
+	}
+
+	msg := ifInfomsg(idx, flags, syscall.IFF_UP)
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK, 0, msg); err != nil {
+		return &LinkError{Op: op, Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// ReplaceAddr sets the address cidr (a.b.c.d/prefix or an IPv6
+// address/prefix) on name, replacing it if it is already there.
+func ReplaceAddr(name string, cidr string) error {
+	msg, err := addrMsg("addr", name, cidr)
+	if err != nil {
+		return err
+	}
+
+	flags := uint16(syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_NEWADDR, flags, msg); err != nil {
+		return &LinkError{Op: "addr", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// DelAddr removes the address cidr from name. The routes through it go
+// with it.
+func DelAddr(name string, cidr string) error {
+	msg, err := addrMsg("deladdr", name, cidr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_DELADDR, 0, msg); err != nil {
+		return &LinkError{Op: "deladdr", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// addrMsg builds the ifaddrmsg and attributes of cidr on name.
+func addrMsg(op string, name string, cidr string) ([]byte, error) {
+	idx, err := index(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, &LinkError{Op: op, Link: name, Err: fmt.Errorf("invalid address %q", cidr)}
+	}
+	prefix, _ := ipNet.Mask.Size()
+
+	msg := make([]byte, sizeofIfAddrmsg)
+	msg[1] = byte(prefix)
+	msg[3] = syscall.RT_SCOPE_UNIVERSE
+	nativeEndian.PutUint32(msg[4:], uint32(idx))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		broadcast := make(net.IP, 4)
+		for i := range broadcast {
+			broadcast[i] = ipNet.IP.To4()[i] | ^ipNet.Mask[i]
+		}
+
+		msg[0] = syscall.AF_INET
+		msg = append(msg, attr(syscall.IFA_LOCAL, ip4)...)
+		msg = append(msg, attr(syscall.IFA_ADDRESS, ip4)...)
+		msg = append(msg, attr(syscall.IFA_BROADCAST, broadcast)...)
+	} else {
+		// we own the address, skip duplicate address detection
+		msg[0] = syscall.AF_INET6
+		msg[2] = syscall.IFA_F_NODAD
+		msg = append(msg, attr(syscall.IFA_ADDRESS, ip.To16())...)
+	}
+
+	return msg, nil
+}
+
+// neighborStates names the NUD states of the entries Neighbors returns.
+var neighborStates = map[uint16]string{
+	0x02: "reachable",
+	0x04: "stale",
+	0x08: "delay",
+	0x10: "probe",
+	0x80: "permanent",
+}
+
+// Neighbors returns the neighbor table of name, skipping the entries
+// without a link layer address, those still resolving or failed.
+func Neighbors(name string) ([]Neighbor, error) {
+	idx, err := index("neighbors", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// AF_UNSPEC dumps both the IPv4 and the IPv6 tables
+	replies, err := request(syscall.NETLINK_ROUTE, syscall.RTM_GETNEIGH, syscall.NLM_F_DUMP, make([]byte, sizeofNdmsg))
+	if err != nil {
+		return nil, &LinkError{Op: "neighbors", Link: name, Err: err}
+	}
+
+	neighbors := []Neighbor{}
+	for _, reply := range replies {
+		if len(reply) < sizeofNdmsg || int(nativeEndian.Uint32(reply[4:8])) != idx {
+			continue
+		}
+
+		state, ok := neighborStates[nativeEndian.Uint16(reply[8:10])]
+		if !ok {
+			continue
+		}
+
+		attrs := parseAttrs(reply[sizeofNdmsg:])
+		dst, lladdr := attrs[ndaDst], attrs[ndaLladdr]
+		if (len(dst) != net.IPv4len && len(dst) != net.IPv6len) || len(lladdr) != 6 {
+			continue
+		}
+
+		neighbor := Neighbor{
+			Ip:    net.IP(dst).String(),
+			Mac:   net.HardwareAddr(lladdr).String(),
+			State: state,
+		}
+		if cacheinfo := attrs[ndaCacheinfo]; len(cacheinfo) >= 4 {
+			neighbor.Confirmed = time.Duration(nativeEndian.Uint32(cacheinfo[0:4])) * time.Second / userHz
+		}
+
+		neighbors = append(neighbors, neighbor)
+	}
+
+	return neighbors, nil
+}
+
+// ReplaceDefaultRoute points the IPv4 default route at gateway via name.
+func ReplaceDefaultRoute(name string, gateway string) error {
+	idx, err := index("route", name)
+	if err != nil {
+		return err
+	}
+
+	gw := net.ParseIP(gateway).To4()
+	if gw == nil {
+		return &LinkError{Op: "route", Link: name, Err: fmt.Errorf("invalid IPv4 gateway %q", gateway)}
+	}
+
+	oif := make([]byte, 4)
+	nativeEndian.PutUint32(oif, uint32(idx))
+
+	msg := make([]byte, sizeofRtmsg)
+	msg[0] = syscall.AF_INET
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	msg[6] = syscall.RT_SCOPE_UNIVERSE
+	msg[7] = syscall.RTN_UNICAST
+
+	msg = append(msg, attr(syscall.RTA_GATEWAY, gw)...)
+	msg = append(msg, attr(syscall.RTA_OIF, oif)...)
+
+	flags := uint16(syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE, flags, msg); err != nil {
+		return &LinkError{Op: "route", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// DeleteLink deletes the interface name.
+func DeleteLink(name string) error {
+	idx, err := index("delete", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_DELLINK, 0, ifInfomsg(idx, 0, 0)); err != nil {
+		return &LinkError{Op: "delete", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// AddBridge creates the bridge name, like "ip link add name type
+// bridge". An existing bridge is left as it is.
+func AddBridge(name string) error {
+	linkInfo := attr(iflaInfoKind, []byte("bridge"))
+
+	msg := ifInfomsg(0, 0, 0)
+	msg = append(msg, attr(syscall.IFLA_IFNAME, append([]byte(name), 0))...)
+	msg = append(msg, attr(iflaLinkinfo, linkInfo)...)
+
+	flags := uint16(syscall.NLM_F_CREATE | syscall.NLM_F_EXCL)
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK, flags, msg); err != nil && err != syscall.EEXIST {
+		return &LinkError{Op: "add bridge", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// SetMaster adds the interface name to the bridge master, or removes it
+// from its bridge if master is empty.
+func SetMaster(name string, master string) error {
+	idx, err := index("master", name)
+	if err != nil {
+		return err
+	}
+
+	masterIdx := 0
+	if master != "" {
+		if masterIdx, err = index("master", master); err != nil {
+			return err
+		}
+	}
+
+	value := make([]byte, 4)
+	nativeEndian.PutUint32(value, uint32(masterIdx))
+
+	msg := append(ifInfomsg(idx, 0, 0), attr(syscall.IFLA_MASTER, value)...)
+	if _, err := request(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK, 0, msg); err != nil {
+		return &LinkError{Op: "master", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// AddWirelessInterface creates the virtual interface name of type
+// iftype on the radio of parent, like "iw dev parent interface add".
+func AddWirelessInterface(parent string, name string, iftype uint32) error {
+	idx, err := index("add", parent)
+	if err != nil {
+		return err
+	}
+
+	family, err := genlFamily("nl80211")
+	if err != nil {
+		return &LinkError{Op: "add", Link: name, Err: err}
+	}
+
+	ifindex := make([]byte, 4)
+	nativeEndian.PutUint32(ifindex, uint32(idx))
+	ifaceType := make([]byte, 4)
+	nativeEndian.PutUint32(ifaceType, iftype)
+
+	msg := genlmsghdr(nl80211CmdNewIface, 0)
+	msg = append(msg, attr(nl80211AttrIfindex, ifindex)...)
+	msg = append(msg, attr(nl80211AttrIfname, append([]byte(name), 0))...)
+	msg = append(msg, attr(nl80211AttrIftype, ifaceType)...)
+
+	if _, err := request(syscall.NETLINK_GENERIC, family, 0, msg); err != nil {
+		return &LinkError{Op: "add", Link: name, Err: err}
+	}
+
+	return nil
+}
+
+// BindToDevice binds the socket fd to the interface name, so its traffic
+// leaves through name whatever the routing table says. It fits the
+// Control hook of net.Dialer and net.ListenConfig via syscall.RawConn.
+func BindToDevice(name string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		if err != nil {
+			return &LinkError{Op: "bind", Link: name, Err: err}
+		}
+
+		return nil
+	}
+}
+
+// genlFamily resolves a generic netlink family name to its id.
+func genlFamily(name string) (uint16, error) {
+	msg := genlmsghdr(ctrlCmdGetFamily, 1)
+	msg = append(msg, attr(ctrlAttrFamilyName, append([]byte(name), 0))...)
+
+	replies, err := request(syscall.NETLINK_GENERIC, genlIdCtrl, 0, msg)
+	if err != nil {
+		return 0, fmt.Errorf("resolving %s: %w", name, err)
+	}
+
+	for _, reply := range replies {
+		if len(reply) < sizeofGenlmsghdr {
+			continue
+		}
+		for typ, value := range parseAttrs(reply[sizeofGenlmsghdr:]) {
+			if typ == ctrlAttrFamilyId && len(value) >= 2 {
+				return nativeEndian.Uint16(value), nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("resolving %s: no family id", name)
+}
+
+// request sends one netlink message and collects the replies until the
+// kernel acknowledges it.
+func request(proto int, msgType uint16, flags uint16, data []byte) ([][]byte, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	n := atomic.AddUint32(&seq, 1)
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	nativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(data)))
+	nativeEndian.PutUint16(msg[4:6], msgType)
+	nativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:12], n)
+	msg = append(msg, data...)
+
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	replies := [][]byte{}
+	buf := make([]byte, syscall.Getpagesize()*4)
+	for {
+		nr, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != n {
+				continue
+			}
+
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, syscall.EINVAL
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			default:
+				// buf is reused by the next read
+				replies = append(replies, append([]byte{}, m.Data...))
+			}
+		}
+	}
+}
+
+// ifInfomsg builds an ifinfomsg for index, setting the change bits of flags.
+func ifInfomsg(idx int, flags uint32, change uint32) []byte {
+	msg := make([]byte, sizeofIfInfomsgHeader)
+	msg[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(msg[4:8], uint32(idx))
+	nativeEndian.PutUint32(msg[8:12], flags)
+	nativeEndian.PutUint32(msg[12:16], change)
+
+	return msg
+}
+
+// genlmsghdr builds a generic netlink header.
+func genlmsghdr(cmd uint8, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
+
+// attr encodes a netlink attribute, padded to 4 bytes.
+func attr(typ uint16, value []byte) []byte {
+	length := syscall.SizeofRtAttr + len(value)
+	b := make([]byte, align(length))
+	nativeEndian.PutUint16(b[0:2], uint16(length))
+	nativeEndian.PutUint16(b[2:4], typ)
+	copy(b[syscall.SizeofRtAttr:], value)
+
+	return b
+}
+
+// parseAttrs decodes a run of netlink attributes.
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		typ := nativeEndian.Uint16(b[2:4])
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+
+		attrs[typ] = b[syscall.SizeofRtAttr:length]
+
+		if align(length) >= len(b) {
+			break
+		}
+		b = b[align(length):]
+	}
+
+	return attrs
+}
+
+// align rounds n up to the netlink alignment.
+func align(n int) int {
+	return (n + nlmsgAlignTo - 1) &^ (nlmsgAlignTo - 1)
+}
+
+// SetMulticastTTL sets the time to live of the IPv4 multicast packets
+// sent on c.
+func SetMulticastTTL(c syscall.RawConn, ttl int) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+
+	return err
+}
+
+// SetBroadcast lets c send to broadcast addresses.
+func SetBroadcast(c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+//go:build !linux
+// +build !linux
+
+package netif
+
+import "syscall"
+
+// SetUp brings the interface name up.
+func SetUp(name string) error {
+	return &LinkError{Op: "up", Link: name, Err: ErrUnsupported}
+}
+
+// SetDown takes the interface name down.
+func SetDown(name string) error {
+	return &LinkError{Op: "down", Link: name, Err: ErrUnsupported}
+}
+
+// ReplaceAddr sets the address cidr on name.
+func ReplaceAddr(name string, cidr string) error {
+	return &LinkError{Op: "addr", Link: name, Err: ErrUnsupported}
+}
+
+// DelAddr removes the address cidr from name.
+func DelAddr(name string, cidr string) error {
+	return &LinkError{Op: "deladdr", Link: name, Err: ErrUnsupported}
+}
+
+// Neighbors returns the neighbor table of name.
+func Neighbors(name string) ([]Neighbor, error) {
+	return nil, &LinkError{Op: "neighbors", Link: name, Err: ErrUnsupported}
+}
+
+// ReplaceDefaultRoute points the IPv4 default route at gateway via name.
+func ReplaceDefaultRoute(name string, gateway string) error {
+	return &LinkError{Op: "route", Link: name, Err: ErrUnsupported}
+}
+
+// DeleteLink deletes the interface name.
+func DeleteLink(name string) error {
+	return &LinkError{Op: "delete", Link: name, Err: ErrUnsupported}
+}
+
+// AddBridge creates the bridge name.
+func AddBridge(name string) error {
+	return &LinkError{Op: "add bridge", Link: name, Err: ErrUnsupported}
+}
+
+// SetMaster adds the interface name to the bridge master.
+func SetMaster(name string, master string) error {
+	return &LinkError{Op: "master", Link: name, Err: ErrUnsupported}
+}
+
+// AddWirelessInterface creates the virtual interface name on the radio of parent.
+func AddWirelessInterface(parent string, name string, iftype uint32) error {
+	return &LinkError{Op: "add", Link: name, Err: ErrUnsupported}
+}
+
+// BindToDevice binds the socket to the interface name.
+func BindToDevice(name string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		return &LinkError{Op: "bind", Link: name, Err: ErrUnsupported}
+	}
+}
+
+// SetMulticastTTL sets the time to live of the IPv4 multicast packets
+// sent on c.
+func SetMulticastTTL(c syscall.RawConn, ttl int) error {
+	return ErrUnsupported
+}
+
+// SetBroadcast lets c send to broadcast addresses.
+func SetBroadcast(c syscall.RawConn) error {
+	return ErrUnsupported
+}
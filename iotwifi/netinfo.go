@@ -0,0 +1,202 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dhcpClientArgs are the one-shot invocations of supported DHCP clients.
+var dhcpClientArgs = map[string][]string{
+	"udhcpc":   {"-n", "-q", "-i"},
+	"dhclient": {"-1"},
+	"dhcpcd":   {"-1", "-w"},
+}
+
+// requestDhcp runs the configured DHCP client once on iface. An empty
+// client means addressing is left to the host.
+func requestDhcp(ctx context.Context, runner Runner, client string, iface string) error {
+	if client == "" {
+		return nil
+	}
+
+	args, ok := dhcpClientArgs[client]
+	if !ok {
+		return fmt.Errorf("unsupported dhcp client %s", client)
+	}
+
+	args = append(append([]string{}, args...), iface)
+	_, err := runner.Output(ctx, client, args...)
+	return err
+}
+
+// waitForIPv4 polls iface until it has an IPv4 address or ctx is done.
+func waitForIPv4(ctx context.Context, iface string) (string, error) {
+	for {
+		if ip := interfaceIPv4(iface); ip != "" {
+			return ip, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// waitForIP polls iface until it has an IPv4 address or ctx is done,
+// settling for a global IPv6 address when no IPv4 address follows it
+// within ipv6Grace, as on IPv6-only networks.
+func waitForIP(ctx context.Context, iface string) (string, error) {
+	var ipv6Since time.Time
+	for {
+		if ip := interfaceIPv4(iface); ip != "" {
+			return ip, nil
+		}
+
+		if ips := interfaceIPv6(iface); len(ips) == 0 {
+			ipv6Since = time.Time{}
+		} else if ipv6Since.IsZero() {
+			ipv6Since = time.Now()
+		} else if time.Since(ipv6Since) >= ipv6Grace {
+			return ips[0], nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// interfaceIPv4 returns the first IPv4 address of iface, or "".
+func interfaceIPv4(iface string) string {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return ""
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+
+	return ""
+}
+
+// interfaceIPv6 returns the global IPv6 addresses of iface, leaving out
+// link-local ones.
+func interfaceIPv6(iface string) []string {
+	ips := []string{}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return ips
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return ips
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+
+	return ips
+}
+
+// defaultGateway reads the default route for iface from /proc/net/route.
+func defaultGateway(iface string) string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			continue
+		}
+
+		// the kernel writes the address in host (little endian) order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		return ip.String()
+	}
+
+	return ""
+}
+
+// defaultGateway6 reads the IPv6 default route for iface from
+// /proc/net/ipv6_route. Routers advertise their link-local address.
+func defaultGateway6(iface string) string {
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Destination PrefixLen Source PrefixLen NextHop Metric RefCnt Use Flags Iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] != iface || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[4])
+		if err != nil || len(gw) != net.IPv6len || net.IP(gw).IsUnspecified() {
+			continue
+		}
+
+		return net.IP(gw).String()
+	}
+
+	return ""
+}
+
+// nameservers returns the nameservers in the resolv.conf at path.
+func nameservers(path string) []string {
+	servers := []string{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return servers
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	return servers
+}
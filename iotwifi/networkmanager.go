@@ -0,0 +1,833 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/dbus"
+)
+
+// ComponentNetworkManager is NetworkManager, for health checks.
+const ComponentNetworkManager = "NetworkManager"
+
+// NetworkManagerCfg configures NetworkManager mode and is used by
+// SetupCfg.
+type NetworkManagerCfg struct {
+	Enabled bool `json:"enabled"` // NetworkManager owns the station, driven over D-Bus
+}
+
+// NetworkManager D-Bus names.
+const (
+	nmService      = "org.freedesktop.NetworkManager"
+	nmPath         = "/org/freedesktop/NetworkManager"
+	nmSettingsPath = "/org/freedesktop/NetworkManager/Settings"
+	nmDevice       = nmService + ".Device"
+	nmWireless     = nmService + ".Device.Wireless"
+	nmAccessPoint  = nmService + ".AccessPoint"
+	nmSettings     = nmService + ".Settings"
+	nmConnection   = nmService + ".Settings.Connection"
+	nmActive       = nmService + ".Connection.Active"
+)
+
+// NetworkManager device states.
+const (
+	nmDeviceIPConfig  = 70
+	nmDeviceActivated = 100
+)
+
+// NetworkManager active connection states.
+const (
+	nmActiveActivated   = 2
+	nmActiveDeactivated = 4
+)
+
+// NetworkManager device state reasons of failed connects.
+const (
+	nmReasonNoSecrets            = 7
+	nmReasonSupplicantDisconnect = 8
+	nmReasonSupplicantTimeout    = 11
+	nmReasonSsidNotFound         = 53
+)
+
+// NetworkManager access point flags.
+const (
+	nmAPPrivacy = 0x1
+	nmAPWps     = 0x2
+
+	nmPairTkip = 0x4
+	nmPairCcmp = 0x8
+	nmKeyPsk   = 0x100
+	nmKeyEap   = 0x200
+	nmKeySae   = 0x400
+	nmKeyOwe   = 0x800
+
+	nmModeInfra = 2
+)
+
+// nmPollInterval is how often NetworkManager is polled for a scan or a
+// connection to finish.
+const nmPollInterval = 500 * time.Millisecond
+
+// NetworkManager drives the station through NetworkManager's D-Bus API
+// instead of the wpa_supplicant control socket, for images where
+// NetworkManager owns wifi: scans through Device.Wireless and
+// AccessPoint, networks as Settings.Connection profiles. It implements
+// Provisioner.
+type NetworkManager struct {
+	Wpa *WpaCfg // the config, log and state history
+
+	mu   sync.Mutex
+	conn *dbus.Conn
+}
+
+var _ Provisioner = (*NetworkManager)(nil)
+
+// NewNetworkManager produces a NetworkManager for the station of wpa.
+func NewNetworkManager(wpa *WpaCfg) *NetworkManager {
+	return &NetworkManager{Wpa: wpa}
+}
+
+// Close closes the connection to the system bus.
+func (nm *NetworkManager) Close() error {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.conn == nil {
+		return nil
+	}
+	err := nm.conn.Close()
+	nm.conn = nil
+
+	return err
+}
+
+// bus connects to the system bus on first use, and again once the
+// connection is lost.
+func (nm *NetworkManager) bus() (*dbus.Conn, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if nm.conn != nil && nm.conn.Err() == nil {
+		return nm.conn, nil
+	}
+
+	conn, err := dialBus(nm.Wpa.Cfg().DBusSocket)
+	if err != nil {
+		return nil, err
+	}
+	nm.conn = conn
+
+	return conn, nil
+}
+
+// call calls method of iface on the NetworkManager object at path.
+func (nm *NetworkManager) call(ctx context.Context, path dbus.ObjectPath, iface string, method string, signature dbus.Signature, args ...interface{}) ([]interface{}, error) {
+	conn, err := nm.bus()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Call(ctx, nmService, path, iface, method, signature, args...)
+}
+
+// get returns property name of iface of the object at path.
+func (nm *NetworkManager) get(ctx context.Context, path dbus.ObjectPath, iface string, name string) (interface{}, error) {
+	conn, err := nm.bus()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Get(ctx, nmService, path, iface, name)
+}
+
+// getAll returns the properties of iface of the object at path.
+func (nm *NetworkManager) getAll(ctx context.Context, path dbus.ObjectPath, iface string) (map[string]interface{}, error) {
+	conn, err := nm.bus()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.GetAll(ctx, nmService, path, iface)
+}
+
+// device returns the device of iface.
+func (nm *NetworkManager) device(ctx context.Context, iface string) (dbus.ObjectPath, error) {
+	body, err := nm.call(ctx, nmPath, nmService, "GetDeviceByIpIface", "s", iface)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %s", ErrUnknownInterface, iface, err)
+	}
+
+	path, _ := replyValue(body, 0).(dbus.ObjectPath)
+	return path, nil
+}
+
+// Unmanage tells NetworkManager to leave iface alone, so hostapd and
+// dnsmasq can run the AP on it. A new interface takes NetworkManager a
+// moment to pick up, it is waited for until ctx is done.
+func (nm *NetworkManager) Unmanage(ctx context.Context, iface string) error {
+	for {
+		device, err := nm.device(ctx, iface)
+		if err == nil {
+			conn, err := nm.bus()
+			if err != nil {
+				return err
+			}
+			return conn.Set(ctx, nmService, device, nmDevice, "Managed", dbus.MakeVariant("b", false))
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(nmPollInterval):
+		}
+	}
+}
+
+// ScanNetworks implements Provisioner, asking NetworkManager to scan and
+// collecting its access points once LastScan changes.
+func (nm *NetworkManager) ScanNetworks(ctx context.Context) ([]WpaScanResult, error) {
+	results := []WpaScanResult{}
+	iface := nm.Wpa.Cfg().StationInterface
+	start := time.Now()
+
+	device, err := nm.device(ctx, iface)
+	if err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+
+	last, err := nm.get(ctx, device, nmWireless, "LastScan")
+	if err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+
+	// refused while a scan is running, its results are just as good
+	if _, err := nm.call(ctx, device, nmWireless, "RequestScan", "a{sv}", map[string]dbus.Variant{}); err != nil {
+		var dbusErr *dbus.Error
+		if !errors.As(err, &dbusErr) {
+			return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+		}
+		nm.Wpa.Log.Debug("scan request refused", "iface", iface, "error", err)
+	}
+
+	timeout := time.After(scanTimeout)
+	for {
+		scanned, err := nm.get(ctx, device, nmWireless, "LastScan")
+		if err != nil {
+			return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+		}
+		if scanned != last {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return results, ctx.Err()
+		case <-timeout:
+			return results, fmt.Errorf("%w: scan", ErrTimeout)
+		case <-time.After(nmPollInterval):
+		}
+	}
+
+	body, err := nm.call(ctx, device, nmWireless, "GetAllAccessPoints", "")
+	if err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+	paths, _ := replyValue(body, 0).([]interface{})
+
+	networks := []WpaNetwork{}
+	for _, path := range paths {
+		// access points may be gone by now
+		props, err := nm.getAll(ctx, path.(dbus.ObjectPath), nmAccessPoint)
+		if err != nil {
+			continue
+		}
+		if network := nmNetwork(props); network.Ssid != "" {
+			networks = append(networks, network)
+		}
+	}
+
+	nm.Wpa.OUI.annotate(networks)
+	results = groupScanResults(networks)
+	nm.Wpa.Log.Debug("scan complete", "iface", iface, "networks", len(results), "duration", time.Since(start))
+
+	return results, nil
+}
+
+// nmNetwork converts the properties of an access point.
+func nmNetwork(props map[string]interface{}) WpaNetwork {
+	ssid, _ := props["Ssid"].([]byte)
+	bssid, _ := props["HwAddress"].(string)
+	freq, _ := props["Frequency"].(uint32)
+	strength, _ := props["Strength"].(byte)
+
+	channel, band := FrequencyChannel(int(freq))
+	flags := nmFlags(props)
+
+	return WpaNetwork{
+		Bssid:       strings.ToLower(bssid),
+		Frequency:   strconv.Itoa(int(freq)),
+		Channel:     channel,
+		Band:        band,
+		SignalLevel: int(strength)/2 - 100, // NetworkManager only reports percent, see SignalQuality
+		Quality:     int(strength),
+		Flags:       flags,
+		Security:    ParseSecurity(flags),
+		Ssid:        string(ssid),
+	}
+}
+
+// nmFlags formats the flags of an access point as wpa_supplicant does,
+// [WPA2-PSK-CCMP][WPS][ESS].
+func nmFlags(props map[string]interface{}) string {
+	apFlags, _ := props["Flags"].(uint32)
+	wpaFlags, _ := props["WpaFlags"].(uint32)
+	rsnFlags, _ := props["RsnFlags"].(uint32)
+	mode, _ := props["Mode"].(uint32)
+
+	flags := nmSecurityFlag("WPA", wpaFlags) + nmSecurityFlag("WPA2", rsnFlags)
+	if apFlags&nmAPPrivacy != 0 && wpaFlags == 0 && rsnFlags == 0 {
+		flags += "[WEP]"
+	}
+	if apFlags&nmAPWps != 0 {
+		flags += "[WPS]"
+	}
+	if mode == nmModeInfra {
+		flags += "[ESS]"
+	}
+
+	return flags
+}
+
+// nmSecurityFlag formats the WPA or RSN security flags of an access
+// point, empty when it does not use proto.
+func nmSecurityFlag(proto string, flags uint32) string {
+	mgmt := []string{}
+	for _, key := range []struct {
+		flag uint32
+		name string
+	}{{nmKeyPsk, "PSK"}, {nmKeyEap, "EAP"}, {nmKeySae, "SAE"}, {nmKeyOwe, "OWE"}} {
+		if flags&key.flag != 0 {
+			mgmt = append(mgmt, key.name)
+		}
+	}
+	if len(mgmt) == 0 {
+		return ""
+	}
+
+	flag := "[" + proto + "-" + strings.Join(mgmt, "+")
+	if cipher := nmCipher(flags); cipher != "" {
+		flag += "-" + cipher
+	}
+
+	return flag + "]"
+}
+
+// nmCipher returns the pairwise ciphers of security flags.
+func nmCipher(flags uint32) string {
+	switch {
+	case flags&nmPairCcmp != 0 && flags&nmPairTkip != 0:
+		return "CCMP+TKIP"
+	case flags&nmPairCcmp != 0:
+		return "CCMP"
+	case flags&nmPairTkip != 0:
+		return "TKIP"
+	}
+
+	return ""
+}
+
+// nmKeyMgmt returns the key management of an access point, as
+// wpa_supplicant's STATUS reports it.
+func nmKeyMgmt(props map[string]interface{}) string {
+	wpaFlags, _ := props["WpaFlags"].(uint32)
+	rsnFlags, _ := props["RsnFlags"].(uint32)
+
+	switch {
+	case rsnFlags&nmKeySae != 0:
+		return KeyMgmtSae
+	case rsnFlags&nmKeyEap != 0:
+		return "WPA2/IEEE 802.1X/EAP"
+	case rsnFlags&nmKeyPsk != 0:
+		return "WPA2-PSK"
+	case wpaFlags&nmKeyPsk != 0:
+		return "WPA-PSK"
+	}
+
+	return KeyMgmtNone
+}
+
+// nmWpaStates are the wpa_state reported for the NetworkManager device
+// states, unmanaged to failed: COMPLETED once associated, as
+// wpa_supplicant reports before DHCP.
+var nmWpaStates = map[uint32]string{
+	10:  "INTERFACE_DISABLED",
+	20:  "INTERFACE_DISABLED",
+	30:  "DISCONNECTED",
+	40:  "ASSOCIATING",
+	50:  "ASSOCIATING",
+	60:  "4WAY_HANDSHAKE",
+	70:  "COMPLETED",
+	80:  "COMPLETED",
+	90:  "COMPLETED",
+	100: "COMPLETED",
+	110: "DISCONNECTED",
+	120: "DISCONNECTED",
+}
+
+// Status implements Provisioner with the fields of wpa_supplicant's
+// STATUS, from the device and its access point, and nm_state, the
+// NetworkManager device state.
+func (nm *NetworkManager) Status(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	iface := nm.Wpa.Cfg().StationInterface
+
+	device, err := nm.device(ctx, iface)
+	if err != nil {
+		return status, fmt.Errorf("%w: %s", ErrStatusFailed, err)
+	}
+
+	state, err := nm.get(ctx, device, nmDevice, "State")
+	if err != nil {
+		return status, fmt.Errorf("%w: %s", ErrStatusFailed, err)
+	}
+	wireless, err := nm.getAll(ctx, device, nmWireless)
+	if err != nil {
+		return status, fmt.Errorf("%w: %s", ErrStatusFailed, err)
+	}
+
+	deviceState, _ := state.(uint32)
+	status["nm_state"] = strconv.Itoa(int(deviceState))
+	status["wpa_state"] = nmWpaStates[deviceState]
+	if status["wpa_state"] == "" {
+		status["wpa_state"] = "UNKNOWN"
+	}
+	if mac, ok := wireless["HwAddress"].(string); ok {
+		status["address"] = strings.ToLower(mac)
+	}
+
+	if ap, _ := wireless["ActiveAccessPoint"].(dbus.ObjectPath); ap != "" && ap != "/" {
+		if props, err := nm.getAll(ctx, ap, nmAccessPoint); err == nil {
+			network := nmNetwork(props)
+			status["ssid"] = network.Ssid
+			status["bssid"] = network.Bssid
+			status["freq"] = network.Frequency
+			status["key_mgmt"] = nmKeyMgmt(props)
+			rsnFlags, _ := props["RsnFlags"].(uint32)
+			wpaFlags, _ := props["WpaFlags"].(uint32)
+			if cipher := nmCipher(rsnFlags | wpaFlags); cipher != "" {
+				status["pairwise_cipher"] = cipher
+			}
+		}
+	}
+
+	if ip := interfaceIPv4(iface); ip != "" {
+		status["ip_address"] = ip
+	}
+	if radioBlocked(iface) != nil {
+		status["radio"] = "blocked"
+	}
+	if ips := interfaceIPv6(iface); len(ips) > 0 {
+		status["ipv6_address"] = strings.Join(ips, ",")
+	}
+	if gw := defaultGateway6(iface); gw != "" {
+		status["ipv6_gateway"] = gw
+	}
+
+	// whether the connection actually reaches anything
+	if deviceState == nmDeviceActivated {
+		connectivity := nm.Wpa.connectivityState(ctx)
+		if connectivity.State != "" {
+			status["connectivity"] = connectivity.State
+		}
+		if connectivity.PortalUrl != "" {
+			status["captive_portal_url"] = connectivity.PortalUrl
+		}
+	}
+
+	return status, nil
+}
+
+// nmProfile is a wifi connection profile of NetworkManager.
+type nmProfile struct {
+	path  dbus.ObjectPath
+	ssid  string
+	bssid string
+	iface string
+}
+
+// profiles returns the wifi connection profiles usable on the station.
+func (nm *NetworkManager) profiles(ctx context.Context) ([]nmProfile, error) {
+	profiles := []nmProfile{}
+
+	body, err := nm.call(ctx, nmSettingsPath, nmSettings, "ListConnections", "")
+	if err != nil {
+		return profiles, err
+	}
+	paths, _ := replyValue(body, 0).([]interface{})
+
+	for _, p := range paths {
+		path := p.(dbus.ObjectPath)
+		body, err := nm.call(ctx, path, nmConnection, "GetSettings", "")
+		if err != nil {
+			continue
+		}
+		settings, _ := replyValue(body, 0).(map[string]interface{})
+		connection, _ := settings["connection"].(map[string]interface{})
+		wireless, _ := settings["802-11-wireless"].(map[string]interface{})
+		if connection["type"] != "802-11-wireless" || wireless == nil {
+			continue
+		}
+
+		profile := nmProfile{path: path, bssid: "any"}
+		profile.iface, _ = connection["interface-name"].(string)
+		if profile.iface != "" && profile.iface != nm.Wpa.Cfg().StationInterface {
+			continue
+		}
+		if mode, _ := wireless["mode"].(string); mode == "ap" {
+			continue
+		}
+		ssid, _ := wireless["ssid"].([]byte)
+		profile.ssid = string(ssid)
+		if bssid, ok := wireless["bssid"].([]byte); ok && len(bssid) == 6 {
+			profile.bssid = net.HardwareAddr(bssid).String()
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// ListConfiguredNetworks implements Provisioner with the wifi connection
+// profiles. Ids are the positions in the list, the profile the station
+// is connected with is flagged [CURRENT].
+func (nm *NetworkManager) ListConfiguredNetworks(ctx context.Context) ([]WpaConfiguredNetwork, error) {
+	networks := []WpaConfiguredNetwork{}
+
+	profiles, err := nm.profiles(ctx)
+	if err != nil {
+		return networks, fmt.Errorf("%w: list connections: %s", ErrCommandFailed, err)
+	}
+	current := nm.currentProfile(ctx)
+
+	for i, profile := range profiles {
+		flags := ""
+		if profile.path == current {
+			flags = "[CURRENT]"
+		}
+		networks = append(networks, WpaConfiguredNetwork{
+			Id:    strconv.Itoa(i),
+			Ssid:  profile.ssid,
+			Bssid: profile.bssid,
+			Flags: flags,
+		})
+	}
+
+	return networks, nil
+}
+
+// currentProfile returns the profile the station is connected with, empty
+// if none.
+func (nm *NetworkManager) currentProfile(ctx context.Context) dbus.ObjectPath {
+	device, err := nm.device(ctx, nm.Wpa.Cfg().StationInterface)
+	if err != nil {
+		return ""
+	}
+	value, _ := nm.get(ctx, device, nmDevice, "ActiveConnection")
+	active, ok := value.(dbus.ObjectPath)
+	if !ok || active == "/" {
+		return ""
+	}
+	profile, err := nm.get(ctx, active, nmActive, "Connection")
+	if err != nil {
+		return ""
+	}
+
+	path, _ := profile.(dbus.ObjectPath)
+	return path
+}
+
+// RemoveNetwork implements Provisioner, deleting every profile of ssid.
+func (nm *NetworkManager) RemoveNetwork(ctx context.Context, ssid string) error {
+	profiles, err := nm.profiles(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: list connections: %s", ErrCommandFailed, err)
+	}
+
+	removed := 0
+	for _, profile := range profiles {
+		if profile.ssid != ssid {
+			continue
+		}
+		if _, err := nm.call(ctx, profile.path, nmConnection, "Delete", ""); err != nil {
+			return fmt.Errorf("%w: delete connection: %s", ErrCommandFailed, err)
+		}
+		nm.Wpa.Log.Info("network removed", "iface", nm.Wpa.Cfg().StationInterface, "ssid", ssid, "profile", string(profile.path))
+		removed++
+	}
+
+	if removed == 0 {
+		return fmt.Errorf("%w: %s", ErrNotConfigured, ssid)
+	}
+
+	return nil
+}
+
+// ConnectNetwork implements Provisioner, recording the attempt in the
+// state history.
+func (nm *NetworkManager) ConnectNetwork(ctx context.Context, creds WpaCredentials) (WpaConnection, error) {
+	start := time.Now()
+	connection, err := nm.connectNetwork(ctx, creds)
+	nm.Wpa.recordConnect(creds.Ssid, connection, err, time.Since(start))
+
+	return connection, err
+}
+
+// connectNetwork adds a profile for creds and activates it on the
+// station. A profile that fails is deleted so NetworkManager does not keep
+// retrying it, one that works replaces the older profiles of the ssid.
+func (nm *NetworkManager) connectNetwork(ctx context.Context, creds WpaCredentials) (WpaConnection, error) {
+	connection := WpaConnection{}
+	iface := nm.Wpa.Cfg().StationInterface
+	start := time.Now()
+
+	if _, err := freqList(creds.PreferredBand); err != nil {
+		return connection, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	addSecrets(creds)
+
+	device, err := nm.device(ctx, iface)
+	if err != nil {
+		return connection, fmt.Errorf("%w: %s", ErrConnectFailed, err)
+	}
+
+	older, err := nm.profiles(ctx)
+	if err != nil {
+		return connection, fmt.Errorf("%w: list connections: %s", ErrConnectFailed, err)
+	}
+
+	body, err := nm.call(ctx, nmPath, nmService, "AddAndActivateConnection", "a{sa{sv}}oo", nmSettingsFor(iface, creds), device, dbus.ObjectPath("/"))
+	if err != nil {
+		return connection, fmt.Errorf("%w: add connection: %s", ErrConnectFailed, err)
+	}
+	profile, _ := replyValue(body, 0).(dbus.ObjectPath)
+	active, _ := replyValue(body, 1).(dbus.ObjectPath)
+	nm.Wpa.Log.Info("network added", "iface", iface, "ssid", creds.Ssid, "profile", string(profile))
+
+	// fail reports a failed attempt in connection and as an error
+	fail := func(reason ConnectReason, message string, kind error) (WpaConnection, error) {
+		deleteCtx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		defer cancel()
+		if _, err := nm.call(deleteCtx, profile, nmConnection, "Delete", ""); err != nil {
+			nm.Wpa.Log.Warn("could not delete connection", "iface", iface, "ssid", creds.Ssid, "profile", string(profile), "error", err)
+		}
+
+		connection.State = "FAIL"
+		connection.Reason = reason
+		connection.Message = message
+		nm.Wpa.Log.Error("connect failed", "iface", iface, "ssid", creds.Ssid, "profile", string(profile), "reason", reason, "duration", time.Since(start))
+		return connection, fmt.Errorf("%w: %s", kind, creds.Ssid)
+	}
+
+	// wait for the connection to activate, longer once associated as
+	// NetworkManager activates only with an address
+	associate := time.After(15 * time.Second)
+	address := time.After(15*time.Second + addressTimeout)
+	associated := false
+	for {
+		state, err := nm.get(ctx, active, nmActive, "State")
+		if state == uint32(nmActiveActivated) {
+			break
+		}
+		if ctx.Err() != nil {
+			return connection, ctx.Err()
+		}
+
+		// the active connection goes away when activation fails
+		if err != nil || state == uint32(nmActiveDeactivated) {
+			reason := nm.stateReason(ctx, device)
+			switch reason {
+			case nmReasonNoSecrets, nmReasonSupplicantDisconnect:
+				return fail(ReasonWrongPassword, "Wrong password for "+creds.Ssid, ErrWrongPassword)
+			case nmReasonSsidNotFound:
+				return fail(ReasonNetworkNotFound, "Unable to find "+creds.Ssid, ErrNetworkNotFound)
+			case nmReasonSupplicantTimeout:
+				return fail(ReasonTimeout, "Unable to connect to "+creds.Ssid, ErrTimeout)
+			}
+			return fail(ReasonAuthFailed, "Authentication failed for "+creds.Ssid, ErrConnectFailed)
+		}
+
+		if !associated {
+			deviceState, _ := nm.get(ctx, device, nmDevice, "State")
+			if state, ok := deviceState.(uint32); ok && state >= nmDeviceIPConfig {
+				associated = true
+				nm.Wpa.Log.Info("connection state", "iface", iface, "ssid", creds.Ssid, "state", "COMPLETED")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return connection, ctx.Err()
+		case <-associate:
+			if !associated {
+				return fail(ReasonTimeout, "Unable to connect to "+creds.Ssid, ErrTimeout)
+			}
+			continue
+		case <-address:
+			nm.Wpa.Log.Warn("connected without address", "iface", iface, "ssid", creds.Ssid, "duration", time.Since(start))
+			connection.Ssid = creds.Ssid
+			connection.State = "COMPLETED"
+			connection.Message = "Connected, no IP address assigned yet"
+			return connection, nil
+		case <-time.After(nmPollInterval):
+		}
+	}
+
+	// the new profile replaces the older ones of the ssid
+	for _, p := range older {
+		if p.ssid != creds.Ssid {
+			continue
+		}
+		if _, err := nm.call(ctx, p.path, nmConnection, "Delete", ""); err != nil {
+			nm.Wpa.Log.Warn("could not delete connection", "iface", iface, "ssid", creds.Ssid, "profile", string(p.path), "error", err)
+		}
+	}
+
+	connection.Ssid = creds.Ssid
+	connection.State = "COMPLETED"
+	connection.Ip = interfaceIPv4(iface)
+	connection.Gateway = defaultGateway(iface)
+	connection.Dns = nameservers(nm.Wpa.Cfg().resolvConf())
+	connection.Ipv6 = interfaceIPv6(iface)
+	connection.Gateway6 = defaultGateway6(iface)
+	if !nm.Wpa.Cfg().Connectivity.Disabled {
+		connectivity := nm.Wpa.CheckConnectivity(ctx)
+		connection.Connectivity = connectivity.State
+		connection.CaptivePortalUrl = connectivity.PortalUrl
+	}
+
+	nm.Wpa.Log.Info("connected", "iface", iface, "ssid", creds.Ssid, "profile", string(profile), "ip", connection.Ip, "connectivity", connection.Connectivity, "duration", time.Since(start))
+
+	return connection, nil
+}
+
+// stateReason returns why the device last changed state.
+func (nm *NetworkManager) stateReason(ctx context.Context, device dbus.ObjectPath) uint32 {
+	value, err := nm.get(ctx, device, nmDevice, "StateReason")
+	if err != nil {
+		return 0
+	}
+	reason, _ := value.([]interface{})
+	if len(reason) != 2 {
+		return 0
+	}
+
+	code, _ := reason[1].(uint32)
+	return code
+}
+
+// nmSettingsFor returns the settings of a connection profile for creds on
+// iface, addressed by NetworkManager.
+func nmSettingsFor(iface string, creds WpaCredentials) map[string]map[string]dbus.Variant {
+	settings := map[string]map[string]dbus.Variant{
+		"connection": {
+			"id":             dbus.MakeVariant("s", creds.Ssid),
+			"type":           dbus.MakeVariant("s", "802-11-wireless"),
+			"interface-name": dbus.MakeVariant("s", iface),
+			"autoconnect":    dbus.MakeVariant("b", true),
+		},
+		"802-11-wireless": {
+			"ssid":   dbus.MakeVariant("ay", []byte(creds.Ssid)),
+			"mode":   dbus.MakeVariant("s", "infrastructure"),
+			"hidden": dbus.MakeVariant("b", creds.Hidden),
+		},
+		"ipv4": {"method": dbus.MakeVariant("s", "auto")},
+		"ipv6": {"method": dbus.MakeVariant("s", "auto")},
+	}
+
+	switch creds.PreferredBand {
+	case PreferredBand24:
+		settings["802-11-wireless"]["band"] = dbus.MakeVariant("s", "bg")
+	case PreferredBand5:
+		settings["802-11-wireless"]["band"] = dbus.MakeVariant("s", "a")
+	}
+
+	switch {
+	case creds.EapMethod != "":
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("s", "wpa-eap"),
+		}
+		eap := map[string]dbus.Variant{
+			"eap":      dbus.MakeVariant("as", []string{strings.ToLower(creds.EapMethod)}),
+			"identity": dbus.MakeVariant("s", creds.Identity),
+		}
+		if creds.Password != "" {
+			eap["password"] = dbus.MakeVariant("s", creds.Password)
+		}
+		if creds.Phase2 != "" {
+			eap["phase2-auth"] = dbus.MakeVariant("s", strings.ToLower(strings.TrimPrefix(creds.Phase2, "auth=")))
+		}
+		for key, path := range map[string]string{"ca-cert": creds.CACert, "client-cert": creds.ClientCert, "private-key": creds.PrivateKey} {
+			if path != "" {
+				eap[key] = dbus.MakeVariant("ay", []byte("file://"+path+"\x00"))
+			}
+		}
+		settings["802-1x"] = eap
+
+	case creds.Psk == "" || creds.KeyMgmt == KeyMgmtNone:
+		// open networks have no security settings
+
+	default:
+		keyMgmt := "wpa-psk"
+		if creds.KeyMgmt == KeyMgmtSae {
+			keyMgmt = "sae"
+		}
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("s", keyMgmt),
+			"psk":      dbus.MakeVariant("s", creds.Psk),
+		}
+	}
+
+	return settings
+}
+
+// dialBus connects to the system bus listening at path, or where the
+// environment says when path is empty.
+func dialBus(path string) (*dbus.Conn, error) {
+	if path != "" {
+		return dbus.Dial(path)
+	}
+
+	return dbus.DialSystem()
+}
+
+// pingNetworkManager checks that NetworkManager answers on the system bus
+// at busPath and knows iface.
+func pingNetworkManager(ctx context.Context, busPath string, iface string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	conn, err := dialBus(busPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Call(ctx, nmService, nmPath, nmService, "GetDeviceByIpIface", "s", iface)
+	return err
+}
+
+// replyValue returns value i of a reply body, nil if it has fewer.
+func replyValue(body []interface{}, i int) interface{} {
+	if i >= len(body) {
+		return nil
+	}
+
+	return body[i]
+}
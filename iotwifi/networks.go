@@ -0,0 +1,292 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// rollbackTimeout bounds the requests that undo a failed connect, which
+// are made even when the connect was cancelled.
+const rollbackTimeout = 5 * time.Second
+
+// stagedNetwork is the network a connect tries its credentials with: the
+// network configured for the ssid, the one in use first, or one added
+// when there is none. The other networks of the ssid, left behind by
+// older connects, are disabled while it is tried and removed once
+// wpa_supplicant completed the connection. A connect that fails puts the
+// settings of the network it reused back, so a wrong password leaves a
+// working network as it was.
+type stagedNetwork struct {
+	id       string
+	ssid     string
+	added    bool                   // by the connect, removed if it fails
+	disabled bool                   // the network reused was disabled before
+	settings []networkSetting       // of the network reused, before the connect
+	previous []WpaConfiguredNetwork // the other networks of the ssid
+}
+
+// networkSetting is a setting of a network as GET_NETWORK returns it and
+// SET_NETWORK takes it.
+type networkSetting struct {
+	name  string
+	value string
+}
+
+// networkSettings are the settings of a network a connect may change that
+// wpa_supplicant reads back. It reads back no secrets, the psk and the
+// password of a network reused are put back from the saved config.
+var networkSettings = []string{"scan_ssid", "key_mgmt", "ieee80211w", "freq_list", "eap", "identity", "phase2", "ca_cert", "client_cert", "private_key"}
+
+// stageNetwork configures the network of the ssid for creds, or adds one
+// when there is none. The settings of the network reused are read first,
+// for dropNetwork to put back. The network is staged even when
+// configuring it fails, for dropNetwork to undo.
+func (wpa *WpaCfg) stageNetwork(ctx context.Context, creds WpaCredentials) (stagedNetwork, error) {
+	staged := stagedNetwork{ssid: creds.Ssid, previous: []WpaConfiguredNetwork{}}
+
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return staged, fmt.Errorf("%w: %s", ErrConnectFailed, err)
+	}
+	for _, network := range networks {
+		if network.Ssid != creds.Ssid {
+			continue
+		}
+		if strings.Contains(network.Flags, "[CURRENT]") {
+			staged.previous = append([]WpaConfiguredNetwork{network}, staged.previous...)
+		} else {
+			staged.previous = append(staged.previous, network)
+		}
+	}
+
+	iface := wpa.Cfg().StationInterface
+	if len(staged.previous) == 0 {
+		addNetOut, err := wpa.wpaCtl(ctx, "ADD_NETWORK")
+		if err != nil {
+			return staged, fmt.Errorf("%w: add_network: %s", ErrConnectFailed, err)
+		}
+		staged.id, staged.added = strings.TrimSpace(string(addNetOut)), true
+		wpa.Log.Info("network added", "iface", iface, "ssid", creds.Ssid, "net_id", staged.id)
+	} else {
+		reused := staged.previous[0]
+		staged.previous = staged.previous[1:]
+
+		settings := []networkSetting{}
+		for _, name := range networkSettings {
+			out, err := wpa.wpaCtl(ctx, "GET_NETWORK", reused.Id, name)
+			switch {
+			case errors.Is(err, wpactl.ErrFail):
+				// not set
+				continue
+			case err != nil:
+				return staged, fmt.Errorf("%w: get_network %s: %s", ErrConnectFailed, name, err)
+			}
+			settings = append(settings, networkSetting{name, strings.TrimSpace(string(out))})
+		}
+
+		staged.id, staged.settings = reused.Id, settings
+		staged.disabled = strings.Contains(reused.Flags, "[DISABLED]")
+		wpa.Log.Info("network reused", "iface", iface, "ssid", creds.Ssid, "net_id", staged.id, "replaces", len(staged.previous))
+	}
+
+	if err := wpa.configureNetwork(ctx, staged.id, creds); err != nil {
+		return staged, err
+	}
+
+	return staged, nil
+}
+
+// enableNetwork disables the networks staged replaces, so wpa_supplicant
+// does not join them with their old credentials, and enables staged.
+func (wpa *WpaCfg) enableNetwork(ctx context.Context, staged stagedNetwork) error {
+	for _, network := range staged.previous {
+		if _, err := wpa.wpaCtl(ctx, "DISABLE_NETWORK", network.Id); err != nil {
+			return fmt.Errorf("%w: disable_network: %s", ErrConnectFailed, err)
+		}
+	}
+
+	enableOut, err := wpa.wpaCtl(ctx, "ENABLE_NETWORK", staged.id)
+	if err != nil {
+		return fmt.Errorf("%w: enable_network: %s", ErrConnectFailed, err)
+	}
+	wpa.Log.Debug("network enabled", "iface", wpa.Cfg().StationInterface, "net_id", staged.id, "status", strings.TrimSpace(string(enableOut)))
+
+	return nil
+}
+
+// replaceNetworks removes the networks staged replaces, once the connect
+// to it completed. A network that cannot be removed stays disabled, for
+// CollectNetworks.
+func (wpa *WpaCfg) replaceNetworks(ctx context.Context, staged stagedNetwork) {
+	iface := wpa.Cfg().StationInterface
+	for _, network := range staged.previous {
+		if _, err := wpa.wpaCtl(ctx, "REMOVE_NETWORK", network.Id); err != nil {
+			wpa.Log.Warn("could not remove replaced network", "iface", iface, "ssid", network.Ssid, "net_id", network.Id, "error", err)
+			continue
+		}
+		wpa.Log.Debug("replaced network removed", "iface", iface, "ssid", network.Ssid, "net_id", network.Id, "by", staged.id)
+	}
+}
+
+// dropNetwork undoes a failed connect: it removes the network staged
+// added, or puts back the settings of the network it reused, and enables
+// the other networks of the ssid again, unless they were disabled before.
+// The config was not saved, so it is as it was.
+func (wpa *WpaCfg) dropNetwork(ctx context.Context, staged stagedNetwork) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	iface := wpa.Cfg().StationInterface
+	switch {
+	case staged.id == "":
+	case staged.added:
+		if _, err := wpa.wpaCtl(ctx, "REMOVE_NETWORK", staged.id); err != nil {
+			wpa.Log.Warn("could not remove network", "iface", iface, "net_id", staged.id, "error", err)
+		}
+	default:
+		wpa.restoreNetwork(ctx, staged)
+	}
+
+	for _, network := range staged.previous {
+		if strings.Contains(network.Flags, "[DISABLED]") {
+			continue
+		}
+		if _, err := wpa.wpaCtl(ctx, "ENABLE_NETWORK", network.Id); err != nil {
+			wpa.Log.Warn("could not enable network again", "iface", iface, "ssid", network.Ssid, "net_id", network.Id, "error", err)
+			continue
+		}
+		wpa.Log.Info("network restored", "iface", iface, "ssid", network.Ssid, "net_id", network.Id)
+	}
+}
+
+// restoreNetwork puts the credentials and settings of the network staged
+// reused back, and disables it again if it was disabled. The credentials
+// come from the saved config, else the profile of the ssid; a network
+// without either is disabled, and has its saved settings back on the next
+// start of wpa_supplicant.
+func (wpa *WpaCfg) restoreNetwork(ctx context.Context, staged stagedNetwork) {
+	iface := wpa.Cfg().StationInterface
+
+	creds, err := wpa.savedCredentials(staged.ssid)
+	if err == nil {
+		err = wpa.configureNetwork(ctx, staged.id, creds)
+	}
+	if err == nil {
+		for _, setting := range staged.settings {
+			if err = wpa.setNetwork(ctx, staged.id, setting.name, setting.value); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil || staged.disabled {
+		if _, err := wpa.wpaCtl(ctx, "DISABLE_NETWORK", staged.id); err != nil {
+			wpa.Log.Warn("could not disable network", "iface", iface, "ssid", staged.ssid, "net_id", staged.id, "error", err)
+		}
+	}
+	if err != nil {
+		wpa.Log.Warn("could not restore network, disabled until wpa_supplicant restarts", "iface", iface, "ssid", staged.ssid, "net_id", staged.id, "error", err)
+		return
+	}
+
+	wpa.Log.Info("network restored", "iface", iface, "ssid", staged.ssid, "net_id", staged.id)
+}
+
+// savedCredentials returns the credentials ssid has in the saved
+// wpa_supplicant config, or else in its profile.
+func (wpa *WpaCfg) savedCredentials(ssid string) (WpaCredentials, error) {
+	if data, err := ioutil.ReadFile(wpa.Cfg().WpaSupplicantCfg.CfgFile); err == nil {
+		if saved, err := parseWpaSupplicantConf(data); err == nil {
+			for _, profile := range saved {
+				if profile.Ssid == ssid {
+					return profile.WpaCredentials, nil
+				}
+			}
+		}
+	}
+
+	if wpa.Profiles != nil {
+		if profile, err := wpa.Profiles.Get(ssid); err == nil {
+			return profile.WpaCredentials, nil
+		}
+	}
+
+	return WpaCredentials{}, fmt.Errorf("%w: no saved credentials for %s", ErrNotConfigured, ssid)
+}
+
+// CollectNetworks removes the networks wpa_supplicant keeps for nothing:
+// all but one network of each ssid, left behind by connects made before
+// they replaced the networks of a known ssid, and the disabled networks of
+// ssids without a profile, which it never joins. The network in use is
+// kept. The config is saved when any were removed, and those removed
+// are returned.
+func (wpa *WpaCfg) CollectNetworks(ctx context.Context) ([]WpaConfiguredNetwork, error) {
+	removed := []WpaConfiguredNetwork{}
+
+	ctx, done, err := wpa.ops.acquire(ctx, OpCollect, "")
+	if err != nil {
+		return removed, err
+	}
+	defer done()
+
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return removed, err
+	}
+
+	// the network kept for each ssid: the one in use, else an enabled
+	// one, else the first
+	rank := func(network WpaConfiguredNetwork) int {
+		switch {
+		case strings.Contains(network.Flags, "[CURRENT]"):
+			return 2
+		case !strings.Contains(network.Flags, "[DISABLED]"):
+			return 1
+		}
+		return 0
+	}
+	kept := map[string]WpaConfiguredNetwork{}
+	for _, network := range networks {
+		if k, ok := kept[network.Ssid]; !ok || rank(network) > rank(k) {
+			kept[network.Ssid] = network
+		}
+	}
+
+	iface := wpa.Cfg().StationInterface
+	for _, network := range networks {
+		reason := ""
+		switch k := kept[network.Ssid]; {
+		case k.Id != network.Id:
+			reason = "duplicate of " + k.Id
+		case rank(network) == 0 && wpa.Profiles != nil && !wpa.hasProfile(network.Ssid):
+			reason = "disabled without a profile"
+		default:
+			continue
+		}
+
+		removeOut, err := wpa.wpaCtl(ctx, "REMOVE_NETWORK", network.Id)
+		if err != nil {
+			return removed, fmt.Errorf("%w: remove_network: %s", ErrCommandFailed, err)
+		}
+		wpa.Log.Info("stale network removed", "iface", iface, "ssid", network.Ssid, "net_id", network.Id, "reason", reason, "status", strings.TrimSpace(string(removeOut)))
+		removed = append(removed, network)
+	}
+
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	return removed, wpa.SaveConfig(ctx)
+}
+
+// hasProfile reports whether a profile is saved for ssid.
+func (wpa *WpaCfg) hasProfile(ssid string) bool {
+	_, err := wpa.Profiles.Get(ssid)
+	return err == nil
+}
@@ -0,0 +1,270 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// the network of home in use, in the canned LIST_NETWORKS, and the one a
+// connect to another ssid adds
+const (
+	homeNetId  = "0"
+	addedNetId = "1"
+)
+
+// savedPsk is the passphrase of home in the saved config.
+const savedPsk = "old passphrase"
+
+// wrongKey is the event of the network of home refused for a wrong
+// password.
+var wrongKey = wpactl.Event{
+	Level:   3,
+	Name:    "CTRL-EVENT-SSID-TEMP-DISABLED",
+	Message: `id=0 ssid="home" auth_failures=1 duration=10 reason=WRONG_KEY`,
+}
+
+// notFound is the event of a scan that did not find the network.
+var notFound = wpactl.Event{Level: 3, Name: "CTRL-EVENT-NETWORK-NOT-FOUND"}
+
+// networkCalls keeps the requests of calls that change the networks.
+func networkCalls(calls []string) []string {
+	kept := []string{}
+	for _, call := range calls {
+		switch firstField(call) {
+		case "ADD_NETWORK", "SET_NETWORK", "ENABLE_NETWORK", "DISABLE_NETWORK", "REMOVE_NETWORK", "SAVE_CONFIG":
+			kept = append(kept, call)
+		}
+	}
+
+	return kept
+}
+
+// firstField returns the first word of s.
+func firstField(s string) string {
+	return strings.SplitN(s, " ", 2)[0]
+}
+
+// the requests that configure a network for home and put home back
+var (
+	setHome = []string{
+		"SET_NETWORK " + homeNetId + " ssid 686f6d65",
+		"SET_NETWORK " + homeNetId + ` psk "new passphrase"`,
+	}
+	restoreHome = []string{
+		"SET_NETWORK " + homeNetId + " ssid 686f6d65",
+		"SET_NETWORK " + homeNetId + ` psk "` + savedPsk + `"`,
+		"SET_NETWORK " + homeNetId + " key_mgmt WPA-PSK",
+	}
+)
+
+// join returns the calls of lists one after the other.
+func join(lists ...[]string) []string {
+	calls := []string{}
+	for _, list := range lists {
+		calls = append(calls, list...)
+	}
+
+	return calls
+}
+
+func TestConnectReusesNetwork(t *testing.T) {
+	const duplicates = "network id / ssid / bssid / flags\n" +
+		"0\thome\tany\t[CURRENT]\n" +
+		"2\thome\tany\t\n"
+
+	tests := []struct {
+		name     string
+		networks string // LIST_NETWORKS, the canned one if empty
+		ssid     string
+		events   []wpactl.Event // after ENABLE_NETWORK of the network tried
+		err      error
+		calls    []string
+	}{
+		{
+			name:  "connected",
+			ssid:  "home",
+			calls: join(setHome, []string{"ENABLE_NETWORK " + homeNetId, "SAVE_CONFIG"}),
+		},
+		{
+			name:   "wrong password",
+			ssid:   "home",
+			events: []wpactl.Event{wrongKey},
+			err:    ErrWrongPassword,
+			// the working network is put back as it was
+			calls: join(setHome, []string{"ENABLE_NETWORK " + homeNetId}, restoreHome),
+		},
+		{
+			name:   "not found",
+			ssid:   "home",
+			events: []wpactl.Event{notFound, notFound},
+			err:    ErrNetworkNotFound,
+			calls:  join(setHome, []string{"ENABLE_NETWORK " + homeNetId}, restoreHome),
+		},
+		{
+			name:     "duplicate removed",
+			networks: duplicates,
+			ssid:     "home",
+			// the duplicate goes only once the network completed
+			calls: join(setHome, []string{"DISABLE_NETWORK 2", "ENABLE_NETWORK " + homeNetId, "REMOVE_NETWORK 2", "SAVE_CONFIG"}),
+		},
+		{
+			name:     "duplicate kept on a wrong password",
+			networks: duplicates,
+			ssid:     "home",
+			events:   []wpactl.Event{wrongKey},
+			err:      ErrWrongPassword,
+			calls:    join(setHome, []string{"DISABLE_NETWORK 2", "ENABLE_NETWORK " + homeNetId}, restoreHome, []string{"ENABLE_NETWORK 2"}),
+		},
+		{
+			name: "new ssid",
+			ssid: "office",
+			calls: []string{
+				"ADD_NETWORK",
+				"SET_NETWORK " + addedNetId + " ssid 6f6666696365",
+				"SET_NETWORK " + addedNetId + ` psk "new passphrase"`,
+				"ENABLE_NETWORK " + addedNetId,
+				"SAVE_CONFIG",
+			},
+		},
+		{
+			name:   "new ssid not found",
+			ssid:   "office",
+			events: []wpactl.Event{notFound, notFound},
+			err:    ErrNetworkNotFound,
+			calls: []string{
+				"ADD_NETWORK",
+				"SET_NETWORK " + addedNetId + " ssid 6f6666696365",
+				"SET_NETWORK " + addedNetId + ` psk "new passphrase"`,
+				"ENABLE_NETWORK " + addedNetId,
+				"REMOVE_NETWORK " + addedNetId,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newStationWpa(t)
+			defer cleanup()
+			if tt.networks != "" {
+				runner.Replies["LIST_NETWORKS"] = tt.networks
+			}
+			if tt.events != nil {
+				runner.Events["ENABLE_NETWORK "+homeNetId] = tt.events
+				runner.Events["ENABLE_NETWORK "+addedNetId] = tt.events
+			}
+
+			_, err := wpa.ConnectNetwork(context.Background(), WpaCredentials{Ssid: tt.ssid, Psk: "new passphrase"})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err %v, want %v", err, tt.err)
+			}
+
+			if calls := networkCalls(runner.Calls()); !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls\n%q\nwant\n%q", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestConnectKeepsDisabledNetwork(t *testing.T) {
+	wpa, runner, cleanup := newStationWpa(t)
+	defer cleanup()
+	runner.Replies["LIST_NETWORKS"] = "network id / ssid / bssid / flags\n" +
+		"0\thome\tany\t[DISABLED]\n"
+	runner.Events["ENABLE_NETWORK "+homeNetId] = []wpactl.Event{wrongKey}
+
+	if _, err := wpa.ConnectNetwork(context.Background(), WpaCredentials{Ssid: "home", Psk: "new passphrase"}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("err %v, want ErrWrongPassword", err)
+	}
+
+	// disabled before the connect, it is put back disabled
+	want := join(setHome, []string{"ENABLE_NETWORK " + homeNetId}, restoreHome, []string{"DISABLE_NETWORK " + homeNetId})
+	if calls := networkCalls(runner.Calls()); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls\n%q\nwant\n%q", calls, want)
+	}
+}
+
+func TestConnectWithoutSavedCredentials(t *testing.T) {
+	wpa, runner, cleanup := newStationWpa(t)
+	defer cleanup()
+	if err := os.Remove(wpa.Cfg().WpaSupplicantCfg.CfgFile); err != nil {
+		t.Fatal(err)
+	}
+	runner.Events["ENABLE_NETWORK "+homeNetId] = []wpactl.Event{wrongKey}
+
+	if _, err := wpa.ConnectNetwork(context.Background(), WpaCredentials{Ssid: "home", Psk: "new passphrase"}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("err %v, want ErrWrongPassword", err)
+	}
+
+	// its passphrase cannot be read back, so it is not left enabled with
+	// the wrong one
+	want := join(setHome, []string{"ENABLE_NETWORK " + homeNetId, "DISABLE_NETWORK " + homeNetId})
+	if calls := networkCalls(runner.Calls()); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls\n%q\nwant\n%q", calls, want)
+	}
+}
+
+func TestConnectAddNetworkFails(t *testing.T) {
+	wpa, runner, cleanup := newStationWpa(t)
+	defer cleanup()
+	runner.Replies["ADD_NETWORK"] = "FAIL\n"
+
+	if _, err := wpa.ConnectNetwork(context.Background(), WpaCredentials{Ssid: "office", Psk: "new passphrase"}); !errors.Is(err, ErrConnectFailed) {
+		t.Fatalf("err %v, want ErrConnectFailed", err)
+	}
+
+	// FAIL is not taken for the id of a network
+	if calls := networkCalls(runner.Calls()); !reflect.DeepEqual(calls, []string{"ADD_NETWORK"}) {
+		t.Errorf("calls %q after a failed add_network", calls)
+	}
+}
+
+func TestPlanConnectReuses(t *testing.T) {
+	tests := []struct {
+		ssid string
+		want []string
+	}{
+		{"home", []string{
+			"SET_NETWORK " + homeNetId + " ssid 686f6d65",
+			"SET_NETWORK " + homeNetId + " psk " + redacted,
+			"ENABLE_NETWORK " + homeNetId,
+		}},
+		{"office", []string{
+			"ADD_NETWORK",
+			"SET_NETWORK " + planNetId + " ssid 6f6666696365",
+			"SET_NETWORK " + planNetId + " psk " + redacted,
+			"ENABLE_NETWORK " + planNetId,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ssid, func(t *testing.T) {
+			wpa, runner, cleanup := newStationWpa(t)
+			defer cleanup()
+
+			plan, err := wpa.PlanConnect(context.Background(), WpaCredentials{Ssid: tt.ssid, Psk: "new passphrase"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			commands := []string{}
+			for _, command := range plan.Commands {
+				commands = append(commands, command.Command)
+			}
+			if calls := networkCalls(commands); !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("planned %q, want %q", calls, tt.want)
+			}
+
+			// only the reads reach wpa_supplicant
+			for _, call := range runner.Calls() {
+				if !planReads[firstField(call)] {
+					t.Errorf("a dry run sent %q", call)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nftablesChains are the base chains of a group's table, by name.
+var nftablesChains = []struct {
+	Name string
+	Hook string
+}{
+	{"postrouting", "type nat hook postrouting priority 100 ;"},
+	{"forward", "type filter hook forward priority 0 ;"},
+}
+
+// nftablesFirewall installs every group in an ip table of its own, so a
+// group is replaced or removed by recreating or deleting its table.
+type nftablesFirewall struct {
+	runner Runner
+}
+
+func (f *nftablesFirewall) Name() string {
+	return FirewallNftables
+}
+
+// Apply recreates the table of group with rules.
+func (f *nftablesFirewall) Apply(ctx context.Context, group string, rules []FirewallRule) error {
+	if err := f.Clear(ctx, group); err != nil {
+		return err
+	}
+
+	table := firewallTag(group)
+	if err := f.nft(ctx, "add", "table", "ip", table); err != nil {
+		return err
+	}
+	for _, chain := range nftablesChains {
+		if err := f.nft(ctx, "add", "chain", "ip", table, chain.Name, "{ "+chain.Hook+" }"); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range rules {
+		args, err := nftablesArgs(table, rule)
+		if err != nil {
+			return err
+		}
+
+		if err := f.nft(ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Clear deletes the table of group, if there is one.
+func (f *nftablesFirewall) Clear(ctx context.Context, group string) error {
+	if _, err := f.runner.Output(ctx, "nft", "list", "table", "ip", firewallTag(group)); err != nil {
+		return nil
+	}
+
+	return f.nft(ctx, "delete", "table", "ip", firewallTag(group))
+}
+
+func (f *nftablesFirewall) List(ctx context.Context, group string) ([]string, error) {
+	rules := []string{}
+
+	// a missing table has no rules
+	out, err := f.runner.Output(ctx, "nft", "list", "table", "ip", firewallTag(group))
+	if err != nil {
+		return rules, nil
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "}" || strings.HasPrefix(line, "table ") || strings.HasPrefix(line, "chain ") || strings.HasPrefix(line, "type ") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+
+	return rules, nil
+}
+
+// nft runs an nft command.
+func (f *nftablesFirewall) nft(ctx context.Context, args ...string) error {
+	if _, err := f.runner.Output(ctx, "nft", args...); err != nil {
+		return fmt.Errorf("nft %s %s: %w", args[0], args[1], err)
+	}
+
+	return nil
+}
+
+// nftablesArgs returns the nft arguments that add rule to table.
+func nftablesArgs(table string, rule FirewallRule) ([]string, error) {
+	var chain string
+	switch rule.Action {
+	case ActionMasquerade:
+		chain = "postrouting"
+	case ActionAccept:
+		chain = "forward"
+	default:
+		return nil, fmt.Errorf("unknown firewall action %q", rule.Action)
+	}
+
+	args := []string{"add", "rule", "ip", table, chain}
+	if rule.Source != "" {
+		args = append(args, "ip", "saddr", rule.Source)
+	}
+	if rule.In != "" {
+		args = append(args, "iifname", strconv.Quote(rule.In))
+	}
+	if rule.Out != "" {
+		args = append(args, "oifname", strconv.Quote(rule.Out))
+	}
+	if rule.Established {
+		args = append(args, "ct", "state", "related,established")
+	}
+
+	return append(args, rule.Action), nil
+}
@@ -0,0 +1,263 @@
+// Package openapi builds OpenAPI 3 documents, deriving the schemas of
+// request and response bodies from Go types the way encoding/json
+// marshals them.
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of the documents.
+const Version = "3.0.3"
+
+// pathParamR matches the parameters of a path template, {iface}.
+var pathParamR = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Schema is a JSON schema object.
+type Schema map[string]interface{}
+
+// Param is a query parameter.
+type Param struct {
+	Name        string
+	Description string
+	Type        string // string, integer or boolean
+}
+
+// Operation describes one method of one path.
+type Operation struct {
+	Summary  string
+	Query    []Param
+	Request  interface{} // a value of the type of the JSON request body, nil for none
+	Response Schema      // the 200 response body schema, see Document.Schema
+	Produces string      // the response content type, application/json when empty
+}
+
+// Document is an OpenAPI document under construction.
+type Document struct {
+	title   string
+	version string
+	paths   map[string]map[string]interface{}
+	schemas map[string]Schema
+	types   map[reflect.Type]string // named types and their schema names
+}
+
+// New produces an empty document of an API.
+func New(title string, version string) *Document {
+	return &Document{
+		title:   title,
+		version: version,
+		paths:   map[string]map[string]interface{}{},
+		schemas: map[string]Schema{},
+		types:   map[reflect.Type]string{},
+	}
+}
+
+// Add documents method on path, a template such as
+// /interfaces/{iface}/status whose parameters become path parameters.
+func (d *Document) Add(path string, method string, op Operation) {
+	operation := map[string]interface{}{
+		"summary":     op.Summary,
+		"operationId": operationId(path, method),
+	}
+
+	params := []interface{}{}
+	for _, match := range pathParamR.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   Schema{"type": "string"},
+		})
+	}
+	for _, param := range op.Query {
+		params = append(params, map[string]interface{}{
+			"name":        param.Name,
+			"in":          "query",
+			"description": param.Description,
+			"schema":      Schema{"type": param.Type},
+		})
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+
+	if op.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": d.Schema(op.Request)},
+			},
+		}
+	}
+
+	produces := op.Produces
+	if produces == "" {
+		produces = "application/json"
+	}
+	response := map[string]interface{}{"description": "OK"}
+	if op.Response != nil {
+		response["content"] = map[string]interface{}{
+			produces: map[string]interface{}{"schema": op.Response},
+		}
+	}
+	operation["responses"] = map[string]interface{}{"200": response}
+
+	// gorilla/mux patterns are left out of the template
+	path = pathParamR.ReplaceAllString(path, "{$1}")
+	if d.paths[path] == nil {
+		d.paths[path] = map[string]interface{}{}
+	}
+	d.paths[path][strings.ToLower(method)] = operation
+}
+
+// Ref returns a reference to the named schema.
+func Ref(name string) Schema {
+	return Schema{"$ref": "#/components/schemas/" + name}
+}
+
+// Schema returns the schema of the type of v, defining the structs it
+// uses as named schemas. A nil v is any value.
+func (d *Document) Schema(v interface{}) Schema {
+	if v == nil {
+		return Schema{}
+	}
+
+	return d.schema(reflect.TypeOf(v))
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"openapi": Version,
+		"info": map[string]interface{}{
+			"title":   d.title,
+			"version": d.version,
+		},
+		"paths": d.paths,
+		"components": map[string]interface{}{
+			"schemas": d.schemas,
+		},
+	})
+}
+
+// schema returns the schema of t.
+func (d *Document) schema(t reflect.Type) Schema {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return Schema{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return Schema{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return d.schema(t.Elem())
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return Schema{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return Schema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"}
+		}
+		return Schema{"type": "array", "items": d.schema(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": d.schema(t.Elem())}
+	case reflect.Struct:
+		return d.structSchema(t)
+	}
+
+	// interfaces, anything goes
+	return Schema{}
+}
+
+// structSchema defines the schema of struct t, once, and returns a
+// reference to it. Anonymous structs are inlined.
+func (d *Document) structSchema(t reflect.Type) Schema {
+	if t.Name() == "" {
+		return d.object(t)
+	}
+	if name, ok := d.types[t]; ok {
+		return Ref(name)
+	}
+
+	// types of the same name in two packages, dhcp.Lease and a Lease
+	name := t.Name()
+	if _, taken := d.schemas[name]; taken {
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+
+	// recursive types refer to the schema being defined
+	d.types[t] = name
+	d.schemas[name] = Schema{}
+	d.schemas[name] = d.object(t)
+
+	return Ref(name)
+}
+
+// object returns the object schema of the fields of struct t, as
+// encoding/json marshals them.
+func (d *Document) object(t reflect.Type) Schema {
+	properties := map[string]interface{}{}
+	d.fields(t, properties)
+
+	return Schema{"type": "object", "properties": properties}
+}
+
+// fields adds the properties of the fields of t, and of the structs it
+// embeds, to properties.
+func (d *Document) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			d.fields(ft, properties)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		if strings.Contains(tag, ",string") {
+			properties[name] = Schema{"type": "string"}
+			continue
+		}
+		properties[name] = d.schema(f.Type)
+	}
+}
+
+// operationId names an operation after its method and path,
+// getInterfacesIfaceStatus.
+func operationId(path string, method string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(pathParamR.ReplaceAllString(path, "$1"), func(r rune) bool {
+		return r == '/' || r == '.' || r == '-' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+
+	return id
+}
@@ -0,0 +1,282 @@
+package iotwifi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// OperationHeader carries the operation id of an API request in its
+// response.
+const OperationHeader = "X-Operation-Id"
+
+// Operation log defaults and bounds.
+const (
+	DefaultOperationsKeep = 200
+	maxOperationCommands  = 200  // per operation, later commands are counted but not kept
+	maxTracedOutput       = 2048 // bytes of a command's output kept
+)
+
+// OperationsCfg configures the trace of API requests and is used by
+// SetupCfg.
+type OperationsCfg struct {
+	Disabled bool `json:"disabled"`
+	Keep     int  `json:"keep"` // operations kept in memory, the oldest are dropped first, 200 by default
+}
+
+// TracedCommand is a command run or a wpa_supplicant request made for an
+// operation. Secrets are redacted from the command and its output.
+type TracedCommand struct {
+	Time     time.Time     `json:"time"`
+	Target   string        `json:"target"` // wpa_supplicant or exec
+	Iface    string        `json:"iface,omitempty"`
+	Command  string        `json:"command"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"` // -1 when it could not run; for wpa_supplicant 1 on a FAIL reply
+	Output   string        `json:"output"`    // at most 2048 bytes
+	Error    string        `json:"error,omitempty"`
+}
+
+// Operation is an API request and the commands it ran.
+type Operation struct {
+	Id       string          `json:"id"`
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Started  time.Time       `json:"started"`
+	Duration time.Duration   `json:"duration"` // zero while it runs
+	Status   int             `json:"status"`   // the HTTP status, zero while it runs
+	Commands []TracedCommand `json:"commands"`
+	Dropped  int             `json:"dropped,omitempty"` // commands past the 200 kept
+}
+
+type operationKey struct{}
+
+// NewOperationId returns a random operation id.
+func NewOperationId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// WithOperation returns a copy of ctx carrying the operation id, under
+// which the commands run with it are traced.
+func WithOperation(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationKey{}, id)
+}
+
+// OperationId returns the operation id of ctx, empty if it has none.
+func OperationId(ctx context.Context) string {
+	id, _ := ctx.Value(operationKey{}).(string)
+	return id
+}
+
+// OperationLog keeps the last operations in memory, for debugging in the
+// field why a request, such as a connect, failed.
+type OperationLog struct {
+	mu         sync.Mutex
+	cfg        OperationsCfg
+	operations []*Operation // oldest first
+}
+
+// NewOperationLog produces an OperationLog keeping what cfg says.
+func NewOperationLog(cfg OperationsCfg) *OperationLog {
+	if cfg.Keep == 0 {
+		cfg.Keep = DefaultOperationsKeep
+	}
+
+	return &OperationLog{cfg: cfg}
+}
+
+// Start records the start of the operation id. It does nothing when the
+// log is disabled.
+func (l *OperationLog) Start(id string, method string, path string) {
+	if l.cfg.Disabled {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.operations = append(l.operations, &Operation{
+		Id:       id,
+		Method:   method,
+		Path:     path,
+		Started:  time.Now().UTC(),
+		Commands: []TracedCommand{},
+	})
+	if len(l.operations) > l.cfg.Keep {
+		l.operations = append([]*Operation{}, l.operations[len(l.operations)-l.cfg.Keep:]...)
+	}
+}
+
+// Finish records the end of the operation id with the HTTP status.
+func (l *OperationLog) Finish(id string, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if op := l.find(id); op != nil {
+		op.Duration = time.Since(op.Started)
+		op.Status = status
+	}
+}
+
+// Record adds c to the operation of ctx, if it has one still kept.
+func (l *OperationLog) Record(ctx context.Context, c TracedCommand) {
+	id := OperationId(ctx)
+	if id == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	op := l.find(id)
+	if op == nil {
+		return
+	}
+	if len(op.Commands) >= maxOperationCommands {
+		op.Dropped++
+		return
+	}
+	op.Commands = append(op.Commands, c)
+}
+
+// Get returns the operation id.
+func (l *OperationLog) Get(id string) (Operation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	op := l.find(id)
+	if op == nil {
+		return Operation{}, ErrOperationNotFound
+	}
+
+	return op.copy(), nil
+}
+
+// List returns the operations newest first, at most limit of them, all
+// with a limit of 0.
+func (l *OperationLog) List(limit int) []Operation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := []Operation{}
+	for i := len(l.operations) - 1; i >= 0; i-- {
+		if limit > 0 && len(list) >= limit {
+			break
+		}
+		list = append(list, l.operations[i].copy())
+	}
+
+	return list
+}
+
+// find returns the operation id, nil if it is not kept. The caller holds
+// mu.
+func (l *OperationLog) find(id string) *Operation {
+	for i := len(l.operations) - 1; i >= 0; i-- {
+		if l.operations[i].Id == id {
+			return l.operations[i]
+		}
+	}
+
+	return nil
+}
+
+// copy returns op with its own commands.
+func (op *Operation) copy() Operation {
+	c := *op
+	c.Commands = append([]TracedCommand{}, op.Commands...)
+
+	return c
+}
+
+// tracingRunner records what it runs under the operation of its context.
+type tracingRunner struct {
+	Runner
+	log *OperationLog
+}
+
+// NewTracingRunner produces a Runner that runs through r and records each
+// command and request made for an operation in log.
+func NewTracingRunner(r Runner, log *OperationLog) Runner {
+	return &tracingRunner{Runner: r, log: log}
+}
+
+// Output runs name and records it with its exit code.
+func (r *tracingRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.Runner.Output(ctx, name, args...)
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+
+	r.record(ctx, start, TracedCommand{
+		Target:   PlanExec,
+		Command:  secrets.scrub(strings.Join(append([]string{name}, args...), " ")),
+		ExitCode: exitCode,
+	}, out, err)
+
+	return out, err
+}
+
+// Request sends cmd and records it with its reply.
+func (r *tracingRunner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.Runner.Request(ctx, iface, cmd)
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+	} else if strings.HasPrefix(string(out), "FAIL") {
+		exitCode = 1
+	}
+
+	r.record(ctx, start, TracedCommand{
+		Target:   PlanWpaSupplicant,
+		Iface:    iface,
+		Command:  redactRequest(cmd),
+		ExitCode: exitCode,
+	}, out, err)
+
+	return out, err
+}
+
+// Attach is not traced, events are not made for an operation.
+func (r *tracingRunner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	return r.Runner.Attach(iface)
+}
+
+// record completes c with its timing, output and error and adds it to
+// the operation of ctx.
+func (r *tracingRunner) record(ctx context.Context, start time.Time, c TracedCommand, out []byte, err error) {
+	if OperationId(ctx) == "" {
+		return
+	}
+
+	c.Time = start.UTC()
+	c.Duration = time.Since(start)
+	if len(out) > maxTracedOutput {
+		out = out[:maxTracedOutput]
+	}
+	c.Output = secrets.scrub(string(out))
+	if err != nil {
+		c.Error = secrets.scrub(err.Error())
+	}
+
+	r.log.Record(ctx, c)
+}
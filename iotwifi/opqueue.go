@@ -0,0 +1,162 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queued operation kinds.
+const (
+	OpConnect = "connect"
+	OpScan    = "scan"
+	OpForget  = "forget"
+	OpCollect = "collect"  // of the stale networks, by CollectNetworks
+	OpApply   = "profiles" // of the saved profiles, by ApplyProfiles
+	OpRestore = "restore"  // of the last network, by RestoreState
+	OpRoaming = "roaming"
+	OpWps     = "wps"
+)
+
+// maxQueuedOps bounds the operations waiting on an interface, more are
+// refused as busy.
+const maxQueuedOps = 16
+
+// QueuedOp is an operation running or waiting its turn on an interface.
+type QueuedOp struct {
+	Id        int64      `json:"id"`
+	Kind      string     `json:"kind"`                // connect, scan, forget, collect, profiles, restore, roaming or wps
+	Ssid      string     `json:"ssid,omitempty"`      // of a connect or forget
+	Operation string     `json:"operation,omitempty"` // the id of the API request that asked for it
+	Queued    time.Time  `json:"queued"`
+	Started   *time.Time `json:"started,omitempty"` // nil while it waits
+}
+
+// queuedOp is a QueuedOp with the channel that tells it its turn came.
+type queuedOp struct {
+	QueuedOp
+	ready chan struct{}
+}
+
+type opQueueKey struct{}
+
+// opQueue runs the operations on the wpa_supplicant of an interface one
+// at a time, in the order they came: a connect adds and sets a network
+// with several requests, which another operation changing the networks
+// or scanning in between would get mixed up with. An operation run under
+// one already holding the queue, its context says, runs right away. The
+// zero value is an empty queue.
+type opQueue struct {
+	mu      sync.Mutex
+	nextId  int64
+	running *queuedOp
+	waiting []*queuedOp // oldest first
+}
+
+// acquire waits for the turn of an operation of kind, for ssid, and
+// returns the context to run it with and the func to call once it is
+// done. It gives up as busy when the queue is full or ctx is done first.
+func (q *opQueue) acquire(ctx context.Context, kind string, ssid string) (context.Context, func(), error) {
+	if held, _ := ctx.Value(opQueueKey{}).(*opQueue); held == q {
+		return ctx, func() {}, nil
+	}
+
+	q.mu.Lock()
+	q.nextId++
+	op := &queuedOp{
+		QueuedOp: QueuedOp{
+			Id:        q.nextId,
+			Kind:      kind,
+			Ssid:      ssid,
+			Operation: OperationId(ctx),
+			Queued:    time.Now().UTC(),
+		},
+		ready: make(chan struct{}),
+	}
+
+	switch {
+	case q.running == nil:
+		q.start(op)
+	case len(q.waiting) >= maxQueuedOps:
+		running := q.running.Kind
+		q.mu.Unlock()
+		return ctx, nil, fmt.Errorf("%w: %d operations are queued behind a %s", ErrBusy, len(q.waiting), running)
+	default:
+		q.waiting = append(q.waiting, op)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-op.ready:
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		// its turn may have come just as ctx was done, the operation then
+		// finds out about ctx itself
+		if op.Started == nil {
+			q.remove(op)
+			return ctx, nil, fmt.Errorf("%w: %s gave up waiting behind a %s: %s", ErrBusy, kind, q.running.Kind, ctx.Err())
+		}
+	}
+
+	return context.WithValue(ctx, opQueueKey{}, q), func() { q.release(op) }, nil
+}
+
+// start runs op. The caller holds mu.
+func (q *opQueue) start(op *queuedOp) {
+	now := time.Now().UTC()
+	op.Started = &now
+	q.running = op
+	close(op.ready)
+}
+
+// remove drops op from the waiting operations. The caller holds mu.
+func (q *opQueue) remove(op *queuedOp) {
+	for i, waiting := range q.waiting {
+		if waiting == op {
+			q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// release ends op and starts the next operation.
+func (q *opQueue) release(op *queuedOp) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.running != op {
+		return
+	}
+	q.running = nil
+
+	if len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.start(next)
+	}
+}
+
+// list returns the running operation, if any, then the waiting ones.
+func (q *opQueue) list() []QueuedOp {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ops := []QueuedOp{}
+	if q.running != nil {
+		ops = append(ops, q.running.QueuedOp)
+	}
+	for _, op := range q.waiting {
+		ops = append(ops, op.QueuedOp)
+	}
+
+	return ops
+}
+
+// Queue returns the operation running on the station interface, if any,
+// then those waiting their turn, oldest first.
+func (wpa *WpaCfg) Queue() []QueuedOp {
+	return wpa.ops.list()
+}
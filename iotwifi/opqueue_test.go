@@ -0,0 +1,84 @@
+package iotwifi
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestQueueNetworkChanges checks every operation changing the networks
+// waits for the one running, and runs under it when its context holds
+// the queue.
+func TestQueueNetworkChanges(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	var err error
+
+	dir := filepath.Dir(wpa.WpaCfg.HostApdCfg.ConfFile)
+	if wpa.Profiles, err = NewProfileStore(filepath.Join(dir, "profiles.json"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if wpa.State, err = OpenStateStore(filepath.Join(dir, "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wpa.State.Record(HistoryEntry{Type: HistoryConnect, Ssid: "home", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// wps last: the monitor it leaves behind saves the network outside
+	// the queue, after the checks of the others
+	ops := []struct {
+		kind string
+		op   func(ctx context.Context) error
+	}{
+		{OpApply, wpa.ApplyProfiles},
+		{OpRestore, wpa.RestoreState},
+		{OpRoaming, func(ctx context.Context) error {
+			return wpa.SetRoaming(ctx, RoamingCfg{})
+		}},
+		{OpWps, func(ctx context.Context) error {
+			_, err := wpa.startWps(ctx, "WPS_PBC")
+			return err
+		}},
+	}
+
+	for _, tt := range ops {
+		kind, op := tt.kind, tt.op
+		t.Run(kind, func(t *testing.T) {
+			ctx, done, err := wpa.ops.acquire(context.Background(), OpConnect, "home")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := len(runner.Calls())
+			finished := make(chan error, 1)
+			go func() { finished <- op(context.Background()) }()
+
+			// queued behind the connect, nothing sent
+			time.Sleep(50 * time.Millisecond)
+			if calls := runner.Calls()[before:]; len(calls) != 0 {
+				t.Errorf("sent %q while a connect held the queue", calls)
+			}
+			if queued := wpa.Queue(); len(queued) != 2 || queued[1].Kind != kind {
+				t.Errorf("queue %+v, want the connect then a %s", queued, kind)
+			}
+
+			// under the connect it runs right away
+			if err := op(ctx); err != nil {
+				t.Errorf("%s under the connect: %s", kind, err)
+			}
+
+			done()
+			select {
+			case err := <-finished:
+				if err != nil {
+					t.Errorf("%s: %s", kind, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s did not run after the connect", kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OUI registry defaults.
+const (
+	DefaultOUIUrl       = "https://standards-oui.ieee.org/oui/oui.txt"
+	DefaultOUICacheFile = "/var/lib/txwifi/oui.txt"
+	ouiRetry            = time.Hour        // between loads or downloads that failed
+	ouiDownloadTimeout  = 2 * time.Minute  // the registry is some 5 MB
+	maxOUISize          = 32 * 1024 * 1024 // bounds a download
+)
+
+// ouiFiles are where distributions install the IEEE OUI registry, the
+// hwdata and ieee-data packages.
+var ouiFiles = []string{
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/misc/oui.txt",
+}
+
+// OUICfg says where the OUI registry, which names the manufacturer of a
+// mac, comes from and is used by SetupCfg.
+type OUICfg struct {
+	File      string `json:"file"`       // the registry, the one the hwdata or ieee-data package installs if empty
+	Url       string `json:"url"`        // downloaded from when no registry is installed, the IEEE's by default
+	CacheFile string `json:"cache_file"` // where the download is kept, /var/lib/txwifi/oui.txt by default
+	Offline   bool   `json:"offline"`    // never download the registry
+}
+
+// withDefaults fills in the download url and cache file.
+func (c OUICfg) withDefaults() OUICfg {
+	if c.Url == "" {
+		c.Url = DefaultOUIUrl
+	}
+	if c.CacheFile == "" {
+		c.CacheFile = DefaultOUICacheFile
+	}
+
+	return c
+}
+
+// OUIRegistry names the manufacturers of macs from the IEEE OUI registry.
+// The registry is read on first use from the configured file, the
+// installed one or an earlier download, and when there is none it is
+// downloaded in the background, so the first lookups answer nothing
+// rather than wait for it.
+type OUIRegistry struct {
+	Log Logger
+	Cfg OUICfg
+
+	mu          sync.Mutex
+	vendors     map[string]string // nil until loaded
+	tried       time.Time         // the last load that failed
+	downloading bool
+}
+
+// NewOUIRegistry produces an OUIRegistry for cfg.
+func NewOUIRegistry(log Logger, cfg OUICfg) *OUIRegistry {
+	return &OUIRegistry{Log: log, Cfg: cfg.withDefaults()}
+}
+
+// Vendor returns the manufacturer of mac, empty when it is unknown or
+// the registry is not there yet. A nil OUIRegistry knows no vendors.
+func (r *OUIRegistry) Vendor(mac string) string {
+	if r == nil {
+		return ""
+	}
+
+	prefix := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(prefix) < 6 {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.vendors == nil && time.Since(r.tried) >= ouiRetry {
+		r.load()
+	}
+
+	return r.vendors[prefix[:6]]
+}
+
+// annotate sets the vendor of each of networks from its bssid.
+func (r *OUIRegistry) annotate(networks []WpaNetwork) {
+	for i := range networks {
+		networks[i].Vendor = r.Vendor(networks[i].Bssid)
+	}
+}
+
+// load reads the first registry found, or starts downloading one. The
+// caller holds mu.
+func (r *OUIRegistry) load() {
+	files := append(append([]string{}, ouiFiles...), r.Cfg.CacheFile)
+	if r.Cfg.File != "" {
+		files = []string{r.Cfg.File}
+	}
+
+	for _, path := range files {
+		vendors, err := readOUIFile(path)
+		if err == nil && len(vendors) > 0 {
+			r.vendors = vendors
+			r.Log.Debug("oui registry loaded", "path", path, "vendors", len(vendors))
+			return
+		}
+		if r.Cfg.File != "" {
+			r.Log.Error("could not read oui registry", "path", path, "error", err)
+		}
+	}
+	r.tried = time.Now()
+
+	if r.Cfg.File != "" || r.Cfg.Offline || r.downloading {
+		return
+	}
+
+	r.downloading = true
+	go func() {
+		err := downloadOUIFile(r.Cfg.Url, r.Cfg.CacheFile)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.downloading = false
+		if err != nil {
+			r.Log.Warn("could not download oui registry", "url", r.Cfg.Url, "error", err)
+			return
+		}
+
+		r.Log.Info("oui registry downloaded", "url", r.Cfg.Url, "path", r.Cfg.CacheFile)
+		r.tried = time.Time{}
+		r.load()
+	}()
+}
+
+// downloadOUIFile downloads the registry at url to path, through a
+// temporary file, so a failed download does not leave half a registry.
+func downloadOUIFile(url string, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ouiDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOUISize))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), "(hex)") {
+		return fmt.Errorf("%s is not an oui registry", url)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readOUIFile parses the IEEE registry, whose entries start with a line
+// like "00-1A-11   (hex)		Google, Inc.".
+func readOUIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vendors := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "(hex)", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		prefix := strings.Replace(strings.TrimSpace(fields[0]), "-", "", -1)
+		if len(prefix) == 6 {
+			vendors[strings.ToUpper(prefix)] = strings.TrimSpace(fields[1])
+		}
+	}
+
+	return vendors, scanner.Err()
+}
+
+// randomMac reports whether mac is locally administered, as the
+// randomized macs phones use for privacy are, so it has no vendor.
+func randomMac(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+
+	switch strings.ToLower(mac[1:2]) {
+	case "2", "6", "a", "e":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,491 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// p2pFindTime is how long P2PFind looks for peers unless told otherwise.
+const p2pFindTime = 10 * time.Second
+
+// p2pMaxFindTime bounds the search of P2PFind.
+const p2pMaxFindTime = 2 * time.Minute
+
+// p2pFormationTime is how long group formation may take, the WPS walk
+// time the peer has to press its button or enter the PIN in.
+const p2pFormationTime = wpsWalkTime
+
+// Pairing methods of a P2PConnectRequest.
+const (
+	P2PMethodPBC     = "pbc"     // push button on both devices
+	P2PMethodDisplay = "display" // this device shows a PIN, entered on the peer
+	P2PMethodKeypad  = "keypad"  // the PIN shown by the peer is entered here
+)
+
+// P2PCfg configures Wi-Fi Direct and is used by SetupCfg.
+type P2PCfg struct {
+	Enabled    bool   `json:"enabled"`
+	Interface  string `json:"interface"`   // p2p-dev-wlan0, the P2P device of the station interface by default
+	DeviceName string `json:"device_name"` // the name peers see, wpa_supplicant's device_name if empty
+	GoIntent   int    `json:"go_intent"`   // 1-15, how much to insist on being group owner; 0 leaves wpa_supplicant's 7
+}
+
+// P2PPeer is a Wi-Fi Direct device found by P2PFind.
+type P2PPeer struct {
+	Address       string `json:"address"` // P2P device address
+	DeviceName    string `json:"device_name"`
+	DeviceType    string `json:"device_type"`    // primary device type, 10-0050F204-5
+	ConfigMethods string `json:"config_methods"` // WPS config methods, 0x188
+	Level         int    `json:"level"`          // dBm
+	GroupOwner    bool   `json:"group_owner"`    // owns a group that may be joined
+}
+
+// P2PGroup is a Wi-Fi Direct group this device is in.
+type P2PGroup struct {
+	Iface      string `json:"iface"` // p2p-wlan0-0, the interface of the group
+	Role       string `json:"role"`  // GO or client
+	Ssid       string `json:"ssid"`
+	Frequency  int    `json:"frequency"`
+	Passphrase string `json:"passphrase,omitempty"` // of a group this device owns
+	GoDevAddr  string `json:"go_dev_addr"`
+	Persistent bool   `json:"persistent"`
+}
+
+// P2PFindRequest is the body of the find endpoint.
+type P2PFindRequest struct {
+	Timeout int `json:"timeout"` // seconds, 10 if 0
+}
+
+// P2PGroupRequest is the body of the group endpoints.
+type P2PGroupRequest struct {
+	Iface      string `json:"iface"`      // the group to remove
+	Persistent bool   `json:"persistent"` // keep the credentials for reinvoking the group
+	Frequency  int    `json:"frequency"`  // MHz, 2412, chosen by wpa_supplicant if 0
+}
+
+// P2PConnectRequest is the body of the connect and authorize endpoints.
+type P2PConnectRequest struct {
+	Peer     string `json:"peer"`      // P2P device address of the peer
+	Method   string `json:"method"`    // pbc (default), display or keypad
+	Pin      string `json:"pin"`       // keypad PIN, or display PIN; generated if empty
+	Join     bool   `json:"join"`      // join the group the peer owns
+	GoIntent int    `json:"go_intent"` // 1-15, p2p.go_intent if 0
+	Iface    string `json:"iface"`     // the group to authorize the peer on
+}
+
+// Validate checks the pairing method and the PIN.
+func (req P2PConnectRequest) Validate() error {
+	switch req.Method {
+	case "", P2PMethodPBC:
+		if req.Pin != "" {
+			return fmt.Errorf("%w: pbc takes no pin", ErrP2PFailed)
+		}
+	case P2PMethodDisplay:
+		if req.Pin != "" && !ValidWPSPin(req.Pin) {
+			return fmt.Errorf("%w: invalid pin %q", ErrP2PFailed, req.Pin)
+		}
+	case P2PMethodKeypad:
+		if !ValidWPSPin(req.Pin) {
+			return fmt.Errorf("%w: invalid pin %q", ErrP2PFailed, req.Pin)
+		}
+	default:
+		return fmt.Errorf("%w: unknown method %q, want pbc, display or keypad", ErrP2PFailed, req.Method)
+	}
+
+	if req.GoIntent < 0 || req.GoIntent > 15 {
+		return fmt.Errorf("%w: go_intent %d is not within 0-15", ErrP2PFailed, req.GoIntent)
+	}
+
+	return nil
+}
+
+// p2pIface returns the interface P2P commands go to: the configured one,
+// the P2P device wpa_supplicant adds for drivers with one, or the station
+// interface itself.
+func (wpa *WpaCfg) p2pIface() string {
+	cfg := wpa.Cfg()
+	if cfg.P2P.Interface != "" {
+		return cfg.P2P.Interface
+	}
+
+	dev := "p2p-dev-" + cfg.StationInterface
+	if _, err := os.Stat(filepath.Join(cfg.WpaSupplicantCfg.ctrlDir(), dev)); err == nil {
+		return dev
+	}
+
+	return cfg.StationInterface
+}
+
+// p2pCtl sends a P2P command to wpa_supplicant, failing on a FAIL reply.
+func (wpa *WpaCfg) p2pCtl(ctx context.Context, iface string, args ...string) (string, error) {
+	cmd, err := ctlCommand(args...)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrP2PFailed, err)
+	}
+
+	out, err := wpa.Runner.Request(ctx, iface, cmd)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrP2PFailed, err)
+	}
+
+	reply := strings.TrimSpace(string(out))
+	if strings.HasPrefix(reply, "FAIL") || reply == "UNKNOWN COMMAND" {
+		return "", fmt.Errorf("%w: %s: %s", ErrP2PFailed, args[0], reply)
+	}
+
+	return reply, nil
+}
+
+// p2pReady checks that P2P is enabled and names this device.
+func (wpa *WpaCfg) p2pReady(ctx context.Context) (string, error) {
+	cfg := wpa.Cfg().P2P
+	if !cfg.Enabled {
+		return "", fmt.Errorf("%w: p2p is not enabled", ErrP2PFailed)
+	}
+
+	iface := wpa.p2pIface()
+	if cfg.DeviceName != "" {
+		if _, err := wpa.p2pCtl(ctx, iface, "SET", "device_name", cfg.DeviceName); err != nil {
+			return "", err
+		}
+	}
+
+	return iface, nil
+}
+
+// P2PFind looks for Wi-Fi Direct devices for timeout, ten seconds if it is
+// zero, and returns the peers found.
+func (wpa *WpaCfg) P2PFind(ctx context.Context, timeout time.Duration) ([]P2PPeer, error) {
+	if timeout <= 0 {
+		timeout = p2pFindTime
+	}
+	if timeout > p2pMaxFindTime {
+		return nil, fmt.Errorf("%w: find timeout %s is over %s", ErrP2PFailed, timeout, p2pMaxFindTime)
+	}
+
+	iface, err := wpa.p2pReady(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seconds := strconv.Itoa(int((timeout + time.Second - 1) / time.Second))
+	if _, err := wpa.p2pCtl(ctx, iface, "P2P_FIND", seconds); err != nil {
+		return nil, err
+	}
+	wpa.Log.Info("p2p find started", "iface", iface, "timeout", timeout)
+
+	select {
+	case <-time.After(timeout):
+	case <-ctx.Done():
+		wpa.p2pCtl(context.Background(), iface, "P2P_STOP_FIND")
+		return nil, ctx.Err()
+	}
+
+	return wpa.P2PPeers(ctx)
+}
+
+// P2PPeers returns the Wi-Fi Direct devices found so far.
+func (wpa *WpaCfg) P2PPeers(ctx context.Context) ([]P2PPeer, error) {
+	peers := []P2PPeer{}
+
+	if !wpa.Cfg().P2P.Enabled {
+		return peers, fmt.Errorf("%w: p2p is not enabled", ErrP2PFailed)
+	}
+	iface := wpa.p2pIface()
+
+	out, err := wpa.p2pCtl(ctx, iface, "P2P_PEERS")
+	if err != nil {
+		return peers, err
+	}
+
+	for _, addr := range strings.Fields(out) {
+		info, err := wpa.p2pCtl(ctx, iface, "P2P_PEER", addr)
+		if err != nil {
+			// the peer expired between the two commands
+			continue
+		}
+		peers = append(peers, parseP2PPeer(addr, info))
+	}
+
+	return peers, nil
+}
+
+// parseP2PPeer parses the P2P_PEER reply, the address followed by
+// key=value lines.
+func parseP2PPeer(addr string, info string) P2PPeer {
+	values := cfgMapper([]byte(info))
+	level, _ := strconv.Atoi(values["level"])
+
+	// bit 0 of the group capability is P2P Group Owner
+	groupCapab, _ := strconv.ParseUint(strings.TrimPrefix(values["group_capab"], "0x"), 16, 8)
+
+	return P2PPeer{
+		Address:       addr,
+		DeviceName:    values["device_name"],
+		DeviceType:    values["pri_dev_type"],
+		ConfigMethods: values["config_methods"],
+		Level:         level,
+		GroupOwner:    groupCapab&1 != 0,
+	}
+}
+
+// P2PGroupAdd starts a group owned by this device, for peers to join
+// with P2PAuthorize, and returns it once it is up.
+func (wpa *WpaCfg) P2PGroupAdd(ctx context.Context, persistent bool, freq int) (P2PGroup, error) {
+	iface, err := wpa.p2pReady(ctx)
+	if err != nil {
+		return P2PGroup{}, err
+	}
+
+	events, monitor, err := wpa.Runner.Attach(iface)
+	if err != nil {
+		return P2PGroup{}, fmt.Errorf("%w: %s", ErrP2PFailed, err)
+	}
+	defer monitor.Close()
+
+	args := []string{"P2P_GROUP_ADD"}
+	if persistent {
+		args = append(args, "persistent")
+	}
+	if freq > 0 {
+		args = append(args, "freq="+strconv.Itoa(freq))
+	}
+	if _, err := wpa.p2pCtl(ctx, iface, args...); err != nil {
+		return P2PGroup{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p2pFormationTime)
+	defer cancel()
+
+	group, err := wpa.awaitP2PGroup(ctx, events)
+	if err != nil {
+		return group, err
+	}
+	wpa.Log.Info("p2p group started", "iface", group.Iface, "role", group.Role, "ssid", group.Ssid, "frequency", group.Frequency)
+
+	return group, nil
+}
+
+// P2PGroupRemove ends the group on iface.
+func (wpa *WpaCfg) P2PGroupRemove(ctx context.Context, iface string) error {
+	if !wpa.Cfg().P2P.Enabled {
+		return fmt.Errorf("%w: p2p is not enabled", ErrP2PFailed)
+	}
+	if !strings.HasPrefix(iface, "p2p-") || strings.HasPrefix(iface, "p2p-dev-") {
+		return fmt.Errorf("%w: %s is not a p2p group", ErrUnknownInterface, iface)
+	}
+
+	if _, err := wpa.p2pCtl(ctx, wpa.p2pIface(), "P2P_GROUP_REMOVE", iface); err != nil {
+		return err
+	}
+	wpa.Log.Info("p2p group removed", "iface", iface)
+
+	return nil
+}
+
+// P2PConnect pairs with the peer of req, negotiating who owns the group,
+// or joining the group the peer owns, and returns the PIN in use for the
+// display method. Group formation completes in the background and is
+// reported as p2p-group-started or p2p-failure events.
+func (wpa *WpaCfg) P2PConnect(ctx context.Context, req P2PConnectRequest) (string, error) {
+	if err := req.Validate(); err != nil {
+		return "", err
+	}
+	if req.Peer == "" {
+		return "", fmt.Errorf("%w: peer is required", ErrP2PFailed)
+	}
+
+	iface, err := wpa.p2pReady(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"P2P_CONNECT", req.Peer}
+	switch req.Method {
+	case P2PMethodDisplay:
+		// an empty pin has wpa_supplicant generate one
+		if req.Pin != "" {
+			args = append(args, req.Pin, "display")
+		} else {
+			args = append(args, "pin", "display")
+		}
+	case P2PMethodKeypad:
+		args = append(args, req.Pin, "keypad")
+	default:
+		args = append(args, "pbc")
+	}
+
+	if req.Join {
+		args = append(args, "join")
+	} else if intent := wpa.goIntent(req.GoIntent); intent > 0 {
+		args = append(args, "go_intent="+strconv.Itoa(intent))
+	}
+
+	events, monitor, err := wpa.Runner.Attach(iface)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrP2PFailed, err)
+	}
+
+	reply, err := wpa.p2pCtl(ctx, iface, args...)
+	if err != nil {
+		monitor.Close()
+		return "", err
+	}
+	wpa.Log.Info("p2p connect started", "iface", iface, "peer", req.Peer, "method", req.Method, "join", req.Join)
+
+	go func() {
+		defer monitor.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p2pFormationTime)
+		defer cancel()
+
+		group, err := wpa.awaitP2PGroup(ctx, events)
+		if err != nil {
+			wpa.Log.Error("p2p connect failed", "iface", iface, "peer", req.Peer, "error", err)
+			return
+		}
+		wpa.Log.Info("p2p group started", "iface", group.Iface, "role", group.Role, "ssid", group.Ssid, "peer", req.Peer)
+	}()
+
+	// P2P_CONNECT replies with the generated PIN, with OK otherwise
+	if req.Method == P2PMethodDisplay && req.Pin == "" {
+		return reply, nil
+	}
+
+	return req.Pin, nil
+}
+
+// P2PAuthorize lets the peer of req join the group this device owns on
+// req.Iface, by push button or with the PIN it shows.
+func (wpa *WpaCfg) P2PAuthorize(ctx context.Context, req P2PConnectRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if _, err := wpa.p2pReady(ctx); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(req.Iface, "p2p-") || strings.HasPrefix(req.Iface, "p2p-dev-") {
+		return fmt.Errorf("%w: %s is not a p2p group", ErrUnknownInterface, req.Iface)
+	}
+
+	// the group interface runs WPS as an AP would
+	peer := "any"
+	if req.Peer != "" {
+		peer = req.Peer
+	}
+
+	args := []string{"WPS_PBC", peer}
+	if req.Method == P2PMethodKeypad || req.Method == P2PMethodDisplay {
+		if req.Pin == "" {
+			return fmt.Errorf("%w: pin is required", ErrP2PFailed)
+		}
+		args = []string{"WPS_PIN", peer, req.Pin}
+	}
+
+	if _, err := wpa.p2pCtl(ctx, req.Iface, args...); err != nil {
+		return err
+	}
+	wpa.Log.Info("p2p peer authorized", "iface", req.Iface, "peer", peer, "method", args[0])
+
+	return nil
+}
+
+// goIntent returns intent, or the configured intent if it is zero.
+func (wpa *WpaCfg) goIntent(intent int) int {
+	if intent > 0 {
+		return intent
+	}
+
+	return wpa.Cfg().P2P.GoIntent
+}
+
+// awaitP2PGroup waits for a group to start, or for its formation to fail.
+func (wpa *WpaCfg) awaitP2PGroup(ctx context.Context, events <-chan wpactl.Event) (P2PGroup, error) {
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return P2PGroup{}, fmt.Errorf("%w: lost wpa_supplicant control connection", ErrP2PFailed)
+			}
+
+			switch ev.Name {
+			case "P2P-GROUP-STARTED":
+				return parseP2PGroup(ev.Message), nil
+			case "P2P-GO-NEG-FAILURE", "P2P-GROUP-FORMATION-FAILURE":
+				return P2PGroup{}, fmt.Errorf("%w: %s %s", ErrP2PFailed, ev.Name, strings.TrimSpace(ev.Message))
+			case "WPS-TIMEOUT":
+				return P2PGroup{}, fmt.Errorf("%w: p2p group formation", ErrTimeout)
+			}
+
+		case <-ctx.Done():
+			return P2PGroup{}, fmt.Errorf("%w: p2p group formation", ErrTimeout)
+		}
+	}
+}
+
+// parseP2PGroup parses the message of a P2P-GROUP-STARTED event,
+// `p2p-wlan0-0 GO ssid="DIRECT-xy" freq=2412 passphrase="..."
+// go_dev_addr=02:00:00:00:01:00 [PERSISTENT]`.
+func parseP2PGroup(msg string) P2PGroup {
+	fields := splitQuoted(msg)
+	group := P2PGroup{}
+
+	for i, field := range fields {
+		switch {
+		case i == 0:
+			group.Iface = field
+		case i == 1:
+			group.Role = field
+		case field == "[PERSISTENT]":
+			group.Persistent = true
+		case strings.HasPrefix(field, "ssid="):
+			group.Ssid = strings.Trim(strings.TrimPrefix(field, "ssid="), `"`)
+		case strings.HasPrefix(field, "freq="):
+			group.Frequency, _ = strconv.Atoi(strings.TrimPrefix(field, "freq="))
+		case strings.HasPrefix(field, "passphrase="):
+			group.Passphrase = strings.Trim(strings.TrimPrefix(field, "passphrase="), `"`)
+		case strings.HasPrefix(field, "go_dev_addr="):
+			group.GoDevAddr = strings.TrimPrefix(field, "go_dev_addr=")
+		}
+	}
+
+	return group
+}
+
+// splitQuoted splits s at spaces outside double quotes.
+func splitQuoted(s string) []string {
+	fields := []string{}
+	quoted := false
+	start := -1
+
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			if start < 0 {
+				start = i
+			}
+		case c == ' ' && !quoted:
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+
+	return fields
+}
@@ -0,0 +1,209 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// Targets of planned commands.
+const (
+	PlanWpaSupplicant = "wpa_supplicant" // a request on its control socket
+	PlanHostapd       = "hostapd"        // a signal to hostapd
+	PlanExec          = "exec"           // an external command
+)
+
+// planNetId stands for the id wpa_supplicant gives a network it adds,
+// which a dry run cannot know.
+const planNetId = "<net_id>"
+
+// planSecretFields are the SET_NETWORK fields whose values a plan hides.
+var planSecretFields = map[string]bool{"psk": true, "password": true, "private_key_passwd": true, "sae_password": true}
+
+// Plan is what an operation would do, rendered by a dry run without
+// doing it, for debugging and for reviewing changes before they are
+// deployed. Secrets are redacted.
+type Plan struct {
+	Operation string           `json:"operation"` // connect or ap-reconfigure
+	Commands  []PlannedCommand `json:"commands"`  // in the order they would run
+	Files     []PlannedFile    `json:"files"`     // written before the commands
+	Notes     []string         `json:"notes"`     // what happens after the commands, which a dry run cannot show
+}
+
+// PlannedCommand is a command a Plan would run.
+type PlannedCommand struct {
+	Target  string `json:"target"` // wpa_supplicant, hostapd or exec
+	Iface   string `json:"iface,omitempty"`
+	Command string `json:"command"`
+}
+
+// PlannedFile is a file a Plan would write.
+type PlannedFile struct {
+	Path    string `json:"path"`
+	Mode    string `json:"mode"`
+	Content string `json:"content"`
+}
+
+// planReads are the wpa_supplicant requests a planRunner passes on to
+// its live Runner: they change nothing, and what an operation does
+// depends on their answers.
+var planReads = map[string]bool{"LIST_NETWORKS": true, "GET_NETWORK": true}
+
+// planRunner records the commands and requests it is given instead of
+// running them, answering OK, so an operation can be rendered as a Plan.
+// The reads of planReads are made with live, and not recorded.
+type planRunner struct {
+	live Runner
+
+	mu       sync.Mutex
+	commands []PlannedCommand
+}
+
+func (r *planRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.record(PlannedCommand{Target: PlanExec, Command: strings.Join(append([]string{name}, args...), " ")})
+	return []byte{}, nil
+}
+
+func (r *planRunner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	if planReads[strings.Fields(cmd)[0]] {
+		return r.live.Request(ctx, iface, cmd)
+	}
+
+	r.record(PlannedCommand{Target: PlanWpaSupplicant, Iface: iface, Command: redactRequest(cmd)})
+	if cmd == "ADD_NETWORK" {
+		return []byte(planNetId + "\n"), nil
+	}
+
+	return []byte("OK\n"), nil
+}
+
+func (r *planRunner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	return nil, nil, fmt.Errorf("%w: a dry run does not watch events", ErrInvalid)
+}
+
+// record appends c to the commands.
+func (r *planRunner) record(c PlannedCommand) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, c)
+}
+
+// redactRequest hides the secret of a SET_NETWORK request, along with
+// any known passphrase.
+func redactRequest(cmd string) string {
+	fields := strings.SplitN(cmd, " ", 4)
+	if len(fields) == 4 && fields[0] == "SET_NETWORK" && planSecretFields[fields[2]] {
+		fields[3] = redacted
+		return strings.Join(fields, " ")
+	}
+
+	return secrets.scrub(cmd)
+}
+
+// PlanConnect renders the wpa_supplicant requests ConnectNetwork would
+// make for creds, without making them. The credentials are checked as a
+// connect checks them, and the configured networks are listed and read to
+// tell the one it would reuse and those it would replace.
+func (wpa *WpaCfg) PlanConnect(ctx context.Context, creds WpaCredentials) (Plan, error) {
+	plan := Plan{Operation: "connect", Commands: []PlannedCommand{}, Files: []PlannedFile{}, Notes: []string{}}
+
+	if _, err := freqList(creds.PreferredBand); err != nil {
+		return plan, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	runner := &planRunner{live: wpa.Runner}
+	dry := &WpaCfg{Log: wpa.Log, WpaCmd: wpa.WpaCmd, WpaCfg: wpa.Cfg(), Profiles: wpa.Profiles, Runner: runner}
+	iface := wpa.Cfg().StationInterface
+
+	staged, err := dry.stageNetwork(ctx, creds)
+	if err != nil {
+		return plan, err
+	}
+	if err := dry.enableNetwork(ctx, staged); err != nil {
+		return plan, err
+	}
+
+	policy := wpa.Cfg().ConnectRetry.override(creds.Retry)
+	if err := policy.Validate(); err != nil {
+		return plan, fmt.Errorf("%w: retry: %s", ErrInvalid, err)
+	}
+
+	previous := []string{}
+	for _, network := range staged.previous {
+		previous = append(previous, network.Id)
+	}
+
+	plan.Notes = append(plan.Notes, fmt.Sprintf("wait up to %s for wpa_supplicant to connect to %q", policy.attemptTimeout(), creds.Ssid))
+	if len(previous) > 0 {
+		plan.Notes = append(plan.Notes, fmt.Sprintf("once connected, REMOVE_NETWORK %s, which network %s replaces", strings.Join(previous, ", "), staged.id))
+	}
+	plan.Notes = append(plan.Notes,
+		"SAVE_CONFIG once connected, wpa_supplicant then writes its config",
+		"wait for an address on "+iface,
+	)
+	if attempts := policy.attempts(); attempts > 1 {
+		plan.Notes = append(plan.Notes, fmt.Sprintf("on a timeout or a network not found, try again with network %s, up to %d attempts", staged.id, attempts))
+	}
+	undo := fmt.Sprintf("REMOVE_NETWORK %s", staged.id)
+	if !staged.added {
+		undo = fmt.Sprintf("put the saved credentials and settings of network %s back", staged.id)
+	}
+	if len(previous) > 0 {
+		undo += fmt.Sprintf(" and enable those of %s that were enabled again", strings.Join(previous, ", "))
+	}
+	plan.Notes = append(plan.Notes, "if the connect fails, "+undo)
+	plan.Commands = runner.commands
+
+	return plan, nil
+}
+
+// PlanReconfigureAP renders the hostapd.conf and MAC files ReconfigureAP
+// would write for cfg and the reload it would signal, without doing
+// either. The config is checked as a reconfigure checks it.
+func (wpa *WpaCfg) PlanReconfigureAP(cfg APConfig) (Plan, error) {
+	plan := Plan{Operation: "ap-reconfigure", Commands: []PlannedCommand{}, Files: []PlannedFile{}, Notes: []string{}}
+
+	hostApdCfg := cfg.apply(wpa.Cfg().HostApdCfg)
+	acl := wpa.Cfg().MacACL()
+
+	data, err := RenderHostapdConf(wpa.Cfg().APInterface, hostApdCfg, acl)
+	if err != nil {
+		return plan, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	content := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "wpa_passphrase=") || strings.HasPrefix(line, "sae_password=") {
+			line = line[:strings.Index(line, "=")+1] + redacted
+		}
+		content = append(content, line)
+	}
+
+	acceptFile, denyFile := hostApdCfg.aclFiles()
+	macs := func(list []string) string {
+		data := ""
+		for _, mac := range list {
+			data += strings.ToLower(mac) + "\n"
+		}
+		return data
+	}
+
+	plan.Files = append(plan.Files,
+		PlannedFile{Path: acceptFile, Mode: "0644", Content: macs(acl.Allow)},
+		PlannedFile{Path: denyFile, Mode: "0644", Content: macs(acl.Deny)},
+		PlannedFile{Path: hostApdCfg.confPath(), Mode: "0600", Content: strings.Join(content, "\n")},
+	)
+	plan.Commands = append(plan.Commands, PlannedCommand{
+		Target:  PlanHostapd,
+		Iface:   wpa.Cfg().APInterface,
+		Command: "SIGHUP to the pid in " + hostApdCfg.pidFile(),
+	})
+	plan.Notes = append(plan.Notes, "hostapd re-reads hostapd.conf, the AP clients are disconnected while it reloads")
+
+	return plan, nil
+}
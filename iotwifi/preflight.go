@@ -0,0 +1,289 @@
+package iotwifi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kinokochat/txwifi/iotwifi/dbus"
+	"github.com/kinokochat/txwifi/iotwifi/rfkill"
+)
+
+// Preflight modes.
+const (
+	PreflightAuto   = "auto"   // check when running in a container
+	PreflightAlways = "always" // check on the host too
+	PreflightOff    = "off"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets.
+const capNetAdmin = 12
+
+// ErrPreflight is returned when the environment cannot run txwifi.
+var ErrPreflight = errors.New("preflight failed")
+
+// PreflightCfg configures the startup checks of the environment and is
+// used by SetupCfg.
+type PreflightCfg struct {
+	Mode     string `json:"mode"`      // auto (default), always or off
+	WarnOnly bool   `json:"warn_only"` // log the failed checks and start anyway
+}
+
+// Validate checks the mode.
+func (cfg PreflightCfg) Validate() error {
+	switch cfg.Mode {
+	case "", PreflightAuto, PreflightAlways, PreflightOff:
+		return nil
+	}
+
+	return fmt.Errorf("unknown mode %q, want auto, always or off", cfg.Mode)
+}
+
+// PreflightCheck is the result of one check, with what to do about a
+// failure.
+type PreflightCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+// PreflightReport is the result of all checks.
+type PreflightReport struct {
+	Container string           `json:"container"` // docker, podman, kubernetes, lxc, ..., empty on the host
+	Ok        bool             `json:"ok"`
+	Checks    []PreflightCheck `json:"checks"`
+}
+
+// add records a check.
+func (r *PreflightReport) add(name string, err error, hint string) {
+	check := PreflightCheck{Name: name, Ok: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		check.Hint = hint
+		r.Ok = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Err returns ErrPreflight naming the failed checks, nil if all passed.
+func (r PreflightReport) Err() error {
+	failed := []string{}
+	for _, check := range r.Checks {
+		if !check.Ok {
+			failed = append(failed, check.Name)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrPreflight, strings.Join(failed, ", "))
+}
+
+// Container returns the kind of container txwifi runs in, empty on the
+// host.
+func Container() string {
+	if kind := os.Getenv("container"); kind != "" {
+		return kind // podman and systemd-nspawn
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+
+	cgroup, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, kind := range []string{"kubepods", "docker", "containerd", "lxc"} {
+		if strings.Contains(string(cgroup), kind) {
+			return kind
+		}
+	}
+
+	return ""
+}
+
+// Preflight checks that the environment lets txwifi manage the wifi: the
+// NET_ADMIN capability, rfkill, the wifi interfaces of the host network
+// and the directories of the control sockets. In auto mode nothing is
+// checked outside a container.
+func (wpa *WpaCfg) Preflight() PreflightReport {
+	cfg := wpa.Cfg()
+	report := PreflightReport{Container: Container(), Ok: true, Checks: []PreflightCheck{}}
+
+	switch cfg.Preflight.Mode {
+	case PreflightOff:
+		return report
+	case PreflightAlways:
+	default:
+		if report.Container == "" {
+			return report
+		}
+	}
+
+	report.add("net_admin", netAdmin(),
+		"interfaces, addresses and routes need CAP_NET_ADMIN, run the container with --cap-add=NET_ADMIN --cap-add=NET_RAW or --privileged")
+
+	report.add("rfkill", openRfkill(),
+		"soft blocked radios cannot be unblocked, pass --device "+rfkill.Device+" to the container or run it --privileged")
+
+	ifaces := []string{cfg.StationInterface}
+	if cfg.APDedicated {
+		ifaces = append(ifaces, cfg.APInterface)
+	}
+	for _, radio := range cfg.Radios {
+		ifaces = append(ifaces, radio.Interface)
+	}
+	for _, iface := range ifaces {
+		report.add("host_network:"+iface, wirelessInterface(iface),
+			"the wifi interfaces are in the host network namespace, run the container with --network host")
+	}
+
+	report.add("hostapd_ctrl_dir", writableDir(cfg.HostApdCfg.ctrlDir()),
+		"hostapd creates its control socket there, mount a writable directory or set host_apd_cfg.ctrl_dir")
+
+	// NetworkManager's wpa_supplicant has no control socket
+	if cfg.NetworkManager.Enabled {
+		report.add("dbus_socket", unixSocket(dbusPath(cfg.DBusSocket)),
+			"NetworkManager is driven over the system bus, mount /var/run/dbus into the container or set dbus_socket")
+		return report
+	}
+
+	report.add("wpa_ctrl_dir", writableDir(cfg.WpaSupplicantCfg.ctrlDir()),
+		"wpa_supplicant creates its control sockets there, mount a writable directory or set wpa_supplicant_cfg.ctrl_dir")
+	report.add("wpa_ctrl_interface", wpaCtrlInterface(cfg.WpaSupplicantCfg),
+		"mount wpa_supplicant_cfg.cfg_file into the container and set wpa_supplicant_cfg.ctrl_dir to its ctrl_interface")
+
+	return report
+}
+
+// netAdmin checks that the process has CAP_NET_ADMIN.
+func netAdmin() error {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return err
+		}
+		if caps&(1<<capNetAdmin) == 0 {
+			return fmt.Errorf("CAP_NET_ADMIN is missing")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no capabilities in /proc/self/status")
+}
+
+// openRfkill checks that the rfkill device can be written.
+func openRfkill() error {
+	f, err := os.OpenFile(rfkill.Device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// wirelessInterface checks that iface exists and is a wifi interface.
+func wirelessInterface(iface string) error {
+	dir := filepath.Join("/sys/class/net", iface)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no interface %s", iface)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "phy80211")); err != nil {
+		return fmt.Errorf("%s is not a wifi interface", iface)
+	}
+
+	return nil
+}
+
+// writableDir checks that dir exists, or can be created, and is writable.
+func writableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".txwifi-preflight")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// unixSocket checks that path is a unix socket.
+func unixSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+
+	return nil
+}
+
+// dbusPath returns the socket of the system bus, path if it is set.
+func dbusPath(path string) string {
+	if path != "" {
+		return path
+	}
+
+	return dbus.SystemBusPath()
+}
+
+// wpaCtrlInterface checks that the ctrl_interface of the wpa_supplicant
+// config, "/var/run/wpa_supplicant" or "DIR=/var/run/wpa_supplicant
+// GROUP=0", is the directory txwifi looks in.
+func wpaCtrlInterface(cfg WpaSupplicantCfg) error {
+	f, err := os.Open(cfg.CfgFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "ctrl_interface=") {
+			continue
+		}
+
+		dir := strings.TrimPrefix(line, "ctrl_interface=")
+		for _, field := range strings.Fields(dir) {
+			if strings.HasPrefix(field, "DIR=") {
+				dir = strings.TrimPrefix(field, "DIR=")
+			}
+		}
+		if filepath.Clean(dir) != filepath.Clean(cfg.ctrlDir()) {
+			return fmt.Errorf("ctrl_interface of %s is %s, not %s", cfg.CfgFile, dir, cfg.ctrlDir())
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%s has no ctrl_interface", cfg.CfgFile)
+}
@@ -0,0 +1,439 @@
+// Package process supervises the daemons txwifi runs as children:
+// hostapd, dnsmasq and wpa_supplicant. Every process has a state machine,
+// starting, running, backoff and stopped, its output is logged line by
+// line and it is restarted after it exits as its restart policy says.
+package process
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// State is where a process is in its life.
+type State string
+
+// States of a process.
+const (
+	Starting State = "starting" // being started
+	Running  State = "running"
+	Backoff  State = "backoff" // exited, waiting to be restarted
+	Stopped  State = "stopped" // exited and not restarted, or never started
+)
+
+// Policy says when a process that exited is restarted. A process stopped
+// with Stop or Terminate is never restarted.
+type Policy string
+
+// Restart policies.
+const (
+	Always    Policy = "always"     // whatever its exit status
+	OnFailure Policy = "on-failure" // unless it exited with status 0
+	Never     Policy = "never"
+)
+
+// ErrUnknownPolicy is returned by ParsePolicy.
+var ErrUnknownPolicy = errors.New("unknown restart policy")
+
+// ParsePolicy returns the policy named s, OnFailure if s is empty.
+func ParsePolicy(s string) (Policy, error) {
+	switch Policy(s) {
+	case "":
+		return OnFailure, nil
+	case Always, OnFailure, Never:
+		return Policy(s), nil
+	}
+
+	return "", fmt.Errorf("%w: %q, want always, on-failure or never", ErrUnknownPolicy, s)
+}
+
+// Supervisor defaults.
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// Logger is the logging interface of the Supervisor, iotwifi.Logger's.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// Spec describes a process to run.
+type Spec struct {
+	Name    string // hostapd, unique among the processes
+	Path    string
+	Args    []string
+	Restart Policy // OnFailure if empty
+
+	// Output, if set, is called with every line the process writes, after
+	// it is logged, from the goroutine reading its stream.
+	Output func(line string)
+}
+
+// Status is the state of a process, as returned by List.
+type Status struct {
+	Name      string    `json:"name"`
+	Command   string    `json:"command"`
+	State     State     `json:"state"`
+	Policy    Policy    `json:"policy"`
+	Pid       int       `json:"pid"`        // 0 unless running
+	Started   time.Time `json:"started"`    // when it last started, zero if it never did
+	UptimeSec int64     `json:"uptime_sec"` // how long it has been running, 0 unless running
+	Restarts  int       `json:"restarts"`   // restarts by the policy since Start
+	LastExit  string    `json:"last_exit"`  // exit status 1, empty if it never exited
+	Exited    time.Time `json:"exited"`     // when it last exited, zero if it never did
+	NextStart time.Time `json:"next_start"` // when it is restarted, zero unless backing off
+}
+
+// Supervisor runs and restarts the child processes. Its timings and Log
+// must be set before the first Start.
+type Supervisor struct {
+	Log        Logger
+	MinBackoff time.Duration // first wait before a restart, doubled for every failure in a row
+	MaxBackoff time.Duration // longest wait, and how long a process must run to reset the backoff
+
+	mu    sync.Mutex
+	procs map[string]*proc
+}
+
+// proc is one run of a Spec, from Start until it is stopped for good.
+type proc struct {
+	spec Spec
+
+	mu        sync.Mutex
+	state     State
+	cmd       *exec.Cmd
+	started   time.Time
+	restarts  int
+	lastExit  string
+	exited    time.Time
+	nextStart time.Time
+	stopping  bool
+
+	stop chan struct{} // closed by Stop and Terminate
+	done chan struct{} // closed once the process is stopped for good
+}
+
+// NewSupervisor produces a Supervisor with default timings.
+func NewSupervisor(log Logger) *Supervisor {
+	return &Supervisor{
+		Log:        log,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		procs:      make(map[string]*proc),
+	}
+}
+
+// Start runs the process of spec and keeps restarting it as its policy
+// says. A process already running under the name is killed and
+// replaced.
+func (s *Supervisor) Start(spec Spec) {
+	if spec.Restart == "" {
+		spec.Restart = OnFailure
+	}
+
+	p := &proc{
+		spec:  spec,
+		state: Starting,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	old := s.procs[spec.Name]
+	s.procs[spec.Name] = p
+	s.mu.Unlock()
+
+	if old != nil {
+		old.kill()
+	}
+
+	go s.run(p)
+}
+
+// Stop kills the process started under name, if it is running, and keeps
+// it from being restarted.
+func (s *Supervisor) Stop(name string) error {
+	p := s.proc(name)
+	if p == nil {
+		return nil
+	}
+
+	return p.kill()
+}
+
+// Terminate asks the process started under name to exit with SIGTERM,
+// keeps it from being restarted and waits for it to exit. It is killed
+// if it is still running when ctx is done.
+func (s *Supervisor) Terminate(ctx context.Context, name string) error {
+	p := s.proc(name)
+	if p == nil {
+		return nil
+	}
+
+	if err := p.signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return p.kill()
+	}
+}
+
+// State returns the state of the process started under name, Stopped if
+// none was.
+func (s *Supervisor) State(name string) State {
+	p := s.proc(name)
+	if p == nil {
+		return Stopped
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state
+}
+
+// Running reports whether the process started under name is running.
+func (s *Supervisor) Running(name string) bool {
+	return s.State(name) == Running
+}
+
+// Active reports whether the process started under name is running or
+// will be, being started or backing off before a restart.
+func (s *Supervisor) Active(name string) bool {
+	return s.State(name) != Stopped
+}
+
+// List returns the status of the processes, by name.
+func (s *Supervisor) List() []Status {
+	s.mu.Lock()
+	procs := make([]*proc, 0, len(s.procs))
+	for _, p := range s.procs {
+		procs = append(procs, p)
+	}
+	s.mu.Unlock()
+
+	list := make([]Status, 0, len(procs))
+	for _, p := range procs {
+		list = append(list, p.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// proc returns the process started under name, nil if none was.
+func (s *Supervisor) proc(name string) *proc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.procs[name]
+}
+
+// run starts the process and restarts it until its policy or a stop says
+// otherwise.
+func (s *Supervisor) run(p *proc) {
+	defer close(p.done)
+
+	failures := 0
+	for {
+		started, err := s.runOnce(p)
+
+		p.mu.Lock()
+		p.cmd = nil
+		if !started.IsZero() || err != nil {
+			p.lastExit = exitString(err)
+			p.exited = time.Now()
+		}
+		stopping := p.stopping
+		p.mu.Unlock()
+
+		if stopping {
+			s.Log.Info("process stopped", "process", p.spec.Name, "exit", exitString(err))
+			p.setState(Stopped)
+			return
+		}
+
+		if p.spec.Restart == Never || (p.spec.Restart == OnFailure && err == nil) {
+			s.Log.Warn("process exited", "process", p.spec.Name, "exit", exitString(err), "policy", p.spec.Restart)
+			p.setState(Stopped)
+			return
+		}
+
+		// a process that ran for a while failed afresh
+		if !started.IsZero() && time.Since(started) > s.MaxBackoff {
+			failures = 0
+		}
+		failures++
+		backoff := s.backoff(failures)
+
+		s.Log.Warn("process exited", "process", p.spec.Name, "exit", exitString(err), "policy", p.spec.Restart, "restart_in", backoff)
+
+		p.mu.Lock()
+		p.state = Backoff
+		p.nextStart = time.Now().Add(backoff)
+		p.mu.Unlock()
+
+		select {
+		case <-p.stop:
+			p.setState(Stopped)
+			return
+		case <-time.After(backoff):
+		}
+
+		p.mu.Lock()
+		p.state = Starting
+		p.nextStart = time.Time{}
+		p.restarts++
+		p.mu.Unlock()
+	}
+}
+
+// runOnce starts the process, logs its output and waits for it to exit.
+// It returns when the process started, zero if it could not be.
+func (s *Supervisor) runOnce(p *proc) (time.Time, error) {
+	cmd := exec.Command(p.spec.Path, p.spec.Args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return time.Time{}, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		return time.Time{}, nil
+	}
+	if err := cmd.Start(); err != nil {
+		p.mu.Unlock()
+		s.Log.Error("process failed to start", "process", p.spec.Name, "cmd", p.spec.Path, "error", err)
+		return time.Time{}, err
+	}
+	p.cmd = cmd
+	p.state = Running
+	p.started = time.Now()
+	started, restarts := p.started, p.restarts
+	p.mu.Unlock()
+
+	s.Log.Info("process started", "process", p.spec.Name, "pid", cmd.Process.Pid, "restarts", restarts)
+
+	// the pipes must be drained before the command is waited on
+	var output sync.WaitGroup
+	output.Add(2)
+	go s.logOutput(&output, p.spec, cmd.Process.Pid, "stdout", stdout)
+	go s.logOutput(&output, p.spec, cmd.Process.Pid, "stderr", stderr)
+	output.Wait()
+
+	return started, cmd.Wait()
+}
+
+// logOutput logs the lines of one output stream of a process and hands
+// them to its Output.
+func (s *Supervisor) logOutput(output *sync.WaitGroup, spec Spec, pid int, stream string, r io.Reader) {
+	defer output.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.Log.Info(scanner.Text(), "process", spec.Name, "pid", pid, "stream", stream)
+
+		if spec.Output != nil {
+			spec.Output(scanner.Text())
+		}
+	}
+}
+
+// backoff doubles MinBackoff for every failure, up to MaxBackoff.
+func (s *Supervisor) backoff(failures int) time.Duration {
+	backoff := s.MinBackoff
+	for i := 1; i < failures && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > s.MaxBackoff {
+		backoff = s.MaxBackoff
+	}
+
+	return backoff
+}
+
+// kill stops p for good, killing the process if it runs.
+func (p *proc) kill() error {
+	return p.signal(syscall.SIGKILL)
+}
+
+// signal stops p for good and sends sig to the process if it runs.
+func (p *proc) signal(sig syscall.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.stopping {
+		p.stopping = true
+		close(p.stop)
+	}
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+
+	return p.cmd.Process.Signal(sig)
+}
+
+// setState moves p to state.
+func (p *proc) setState(state State) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = state
+	p.nextStart = time.Time{}
+}
+
+// status returns the Status of p.
+func (p *proc) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := Status{
+		Name:      p.spec.Name,
+		Command:   strings.Join(append([]string{p.spec.Path}, p.spec.Args...), " "),
+		State:     p.state,
+		Policy:    p.spec.Restart,
+		Started:   p.started,
+		Restarts:  p.restarts,
+		LastExit:  p.lastExit,
+		Exited:    p.exited,
+		NextStart: p.nextStart,
+	}
+	if p.state == Running && p.cmd != nil && p.cmd.Process != nil {
+		status.Pid = p.cmd.Process.Pid
+		status.UptimeSec = int64(time.Since(p.started) / time.Second)
+	}
+
+	return status
+}
+
+// exitString describes how a process exited.
+func exitString(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+
+	return err.Error()
+}
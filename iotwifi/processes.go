@@ -0,0 +1,95 @@
+package iotwifi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/process"
+)
+
+// Where the events of the managed hostapd and wpa_supplicant come from.
+const (
+	ProcessEventsControl = "control" // their control sockets
+	ProcessEventsOutput  = "output"  // their output, parsed line by line
+)
+
+// ProcessCfg configures how the hostapd, dnsmasq and wpa_supplicant
+// children are restarted and is used by SetupCfg.
+type ProcessCfg struct {
+	Restart       string            `json:"restart"`         // on-failure (default), always or never
+	Policies      map[string]string `json:"policies"`        // hostapd: always, overrides restart for one process
+	MinBackoffSec int               `json:"min_backoff_sec"` // first wait before a restart, 1 by default
+	MaxBackoffSec int               `json:"max_backoff_sec"` // longest wait between restarts, 60 by default
+	Events        string            `json:"events"`          // control (default) or output, where the daemon events come from
+}
+
+// Validate checks the restart policies and backoffs.
+func (cfg ProcessCfg) Validate() error {
+	if _, err := process.ParsePolicy(cfg.Restart); err != nil {
+		return err
+	}
+	for name, policy := range cfg.Policies {
+		if _, err := process.ParsePolicy(policy); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if cfg.MinBackoffSec < 0 || cfg.MaxBackoffSec < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+
+	switch cfg.Events {
+	case "", ProcessEventsControl, ProcessEventsOutput:
+	default:
+		return fmt.Errorf("unknown events %q, want control or output", cfg.Events)
+	}
+
+	return nil
+}
+
+// policy returns the restart policy of the process name.
+func (cfg ProcessCfg) policy(name string) process.Policy {
+	restart := cfg.Restart
+	if p, ok := cfg.Policies[name]; ok {
+		restart = p
+	}
+
+	policy, err := process.ParsePolicy(restart)
+	if err != nil {
+		return process.OnFailure
+	}
+
+	return policy
+}
+
+// ConfigureProcesses applies cfg over the default timings of s.
+func ConfigureProcesses(s *process.Supervisor, cfg ProcessCfg) {
+	if cfg.MinBackoffSec > 0 {
+		s.MinBackoff = time.Duration(cfg.MinBackoffSec) * time.Second
+	}
+	if cfg.MaxBackoffSec > 0 {
+		s.MaxBackoff = time.Duration(cfg.MaxBackoffSec) * time.Second
+	}
+}
+
+// startProcess runs a child process under the process supervisor,
+// restarted as the config says. In output mode the events hostapd and
+// wpa_supplicant write are published on the bus.
+func (c *Command) startProcess(name string, iface string, path string, args ...string) {
+	spec := process.Spec{
+		Name:    name,
+		Path:    path,
+		Args:    args,
+		Restart: c.Cfg().Processes.policy(name),
+	}
+
+	if c.Cfg().Processes.Events == ProcessEventsOutput && c.Bus != nil && path != "dnsmasq" {
+		spec.Output = func(line string) {
+			if ev, ok := daemonEvent(path, iface, line); ok {
+				c.Bus.Publish(ev)
+			}
+		}
+	}
+
+	c.Processes.Start(spec)
+}
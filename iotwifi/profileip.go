@@ -0,0 +1,152 @@
+package iotwifi
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// ProfileIP puts the station_ip of a profile on the station while it is
+// connected to that profile's network, and takes it off again when the
+// station disconnects, for networks without DHCP.
+type ProfileIP struct {
+	Wpa *WpaCfg
+
+	mu      sync.Mutex
+	ssid    string      // the network the override is applied for
+	applied StaticIPCfg // empty when none is
+}
+
+// NewProfileIP produces a ProfileIP for wpa.
+func NewProfileIP(wpa *WpaCfg) *ProfileIP {
+	return &ProfileIP{Wpa: wpa}
+}
+
+// Run follows the station connecting and disconnecting until ctx is
+// done, then reverts any override. NetworkManager keeps the addressing of
+// each connection itself, so under it Run returns at once.
+func (p *ProfileIP) Run(ctx context.Context, bus *EventBus) {
+	cfg := p.Wpa.Cfg()
+	if cfg.NetworkManager.Enabled {
+		return
+	}
+
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	defer p.revert()
+
+	// the station may have connected at boot, before the events were watched
+	p.update(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			// provisioned comes after DHCP, which may have rewritten resolv.conf
+			if ev.Iface == cfg.StationInterface && (ev.Type == EventConnected || ev.Type == EventDisconnected || ev.Type == EventProvisioned) {
+				p.update(ctx)
+			}
+		}
+	}
+}
+
+// update applies the override of the network the station is connected
+// to, reverting the one of a network it left.
+func (p *ProfileIP) update(ctx context.Context) {
+	wpa := p.Wpa
+
+	ssid := ""
+	if status, err := wpa.wpaStatus(ctx); err == nil && status["wpa_state"] == "COMPLETED" {
+		ssid = status["ssid"]
+	}
+
+	var override StaticIPCfg
+	if ssid != "" {
+		if profile, err := wpa.Profiles.Get(ssid); err == nil {
+			override = profile.StationIP
+		}
+	}
+
+	p.mu.Lock()
+	current := p.ssid
+	p.mu.Unlock()
+
+	if current != "" && current != ssid {
+		p.revert()
+	}
+	if !override.Enabled() && len(override.Dns) == 0 {
+		return
+	}
+
+	iface := wpa.Cfg().StationInterface
+	resolvConf := wpa.Cfg().resolvConf()
+
+	var err error
+	if override.Enabled() {
+		// the address of the config does not belong on this network
+		if static := wpa.Cfg().StationIP; static.Enabled() && static.Address != override.Address {
+			if err := netif.DelAddr(iface, static.Address); err != nil {
+				wpa.Log.Debug("could not remove static address", "iface", iface, "address", static.Address, "error", err)
+			}
+		}
+		err = setStaticAddress(iface, override, resolvConf)
+	} else {
+		err = setNameservers(override.Dns, resolvConf)
+	}
+	if err != nil {
+		wpa.Log.Error("could not apply profile addressing", "iface", iface, "ssid", ssid, "address", override.Address, "error", err)
+		return
+	}
+
+	if current != ssid {
+		wpa.Log.Info("profile addressing applied", "iface", iface, "ssid", ssid, "address", override.Address, "dns", override.Dns)
+	}
+
+	p.mu.Lock()
+	p.ssid = ssid
+	p.applied = override
+	p.mu.Unlock()
+}
+
+// revert takes the applied override off the station: its address goes,
+// resolv.conf is restored and the station_ip of the config, if any, is
+// put back.
+func (p *ProfileIP) revert() {
+	p.mu.Lock()
+	ssid, applied := p.ssid, p.applied
+	p.ssid, p.applied = "", StaticIPCfg{}
+	p.mu.Unlock()
+
+	if ssid == "" {
+		return
+	}
+
+	wpa := p.Wpa
+	iface := wpa.Cfg().StationInterface
+	resolvConf := wpa.Cfg().resolvConf()
+
+	if applied.Enabled() {
+		if err := netif.DelAddr(iface, applied.Address); err != nil {
+			wpa.Log.Warn("could not remove profile address", "iface", iface, "ssid", ssid, "address", applied.Address, "error", err)
+		}
+	}
+	if len(applied.Dns) > 0 {
+		if err := restoreFile(resolvConf); err != nil {
+			wpa.Log.Warn("could not restore resolv.conf", "path", resolvConf, "error", err)
+		}
+	}
+
+	if static := wpa.Cfg().StationIP; static.Enabled() {
+		if err := setStaticAddress(iface, static, resolvConf); err != nil {
+			wpa.Log.Error("could not set static address", "iface", iface, "address", static.Address, "error", err)
+		}
+	}
+
+	wpa.Log.Info("profile addressing reverted", "iface", iface, "ssid", ssid)
+}
@@ -0,0 +1,335 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultProfileFile is where connection profiles are stored.
+const DefaultProfileFile = "/etc/txwifi/profiles.json"
+
+// Profile is a saved network. When several profiles are in range
+// wpa_supplicant joins the one with the highest Priority, and falls back
+// to the next when it is lost. StationIP replaces the station_ip of the
+// config while the station is connected to the profile's network.
+type Profile struct {
+	WpaCredentials
+	Priority  int         `json:"priority"`   // higher is preferred, 0 is the lowest
+	StationIP StaticIPCfg `json:"station_ip"` // static address or nameservers for this network only
+	Proxy     ProxyCfg    `json:"proxy"`      // exported to proxy_file while on this network
+}
+
+// ProfileStore keeps connection profiles in a JSON file, encrypted when it
+// has a cipher.
+type ProfileStore struct {
+	path   string
+	cipher *CredentialCipher
+
+	mu       sync.Mutex
+	profiles []Profile
+}
+
+// NewProfileStore loads the profiles in path. A missing file is an empty
+// store. With a cipher the file is encrypted, and a plain one is encrypted
+// right away.
+func NewProfileStore(path string, cipher *CredentialCipher) (*ProfileStore, error) {
+	if path == "" {
+		path = DefaultProfileFile
+	}
+
+	store := &ProfileStore{path: path, cipher: cipher, profiles: []Profile{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrConfig, err)
+	}
+
+	sealed := isSealed(data)
+	if sealed {
+		if cipher == nil {
+			return nil, fmt.Errorf("%w: %s is encrypted, set credentials.encrypt", ErrConfig, path)
+		}
+		if data, err = cipher.Open(data); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrConfig, path, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, &store.profiles); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrConfig, path, err)
+	}
+	for _, profile := range store.profiles {
+		addSecrets(profile.WpaCredentials)
+		profile.Proxy.addSecrets()
+	}
+
+	if cipher != nil && !sealed {
+		if err := store.save(store.profiles); err != nil {
+			return nil, fmt.Errorf("%w: encrypting %s: %s", ErrConfig, path, err)
+		}
+	}
+
+	return store, nil
+}
+
+// List returns the profiles, highest priority first.
+func (s *ProfileStore) List() []Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profiles := append([]Profile{}, s.profiles...)
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].Priority > profiles[j].Priority
+	})
+
+	return profiles
+}
+
+// Get returns the profile for ssid.
+func (s *ProfileStore) Get(ssid string) (Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, profile := range s.profiles {
+		if profile.Ssid == ssid {
+			return profile, nil
+		}
+	}
+
+	return Profile{}, fmt.Errorf("%w: %s", ErrProfileNotFound, ssid)
+}
+
+// Validate checks the ssid, priority, band, addressing and proxy of
+// profile.
+func (profile Profile) Validate() error {
+	if err := ValidateSsid(profile.Ssid); err != nil {
+		return fmt.Errorf("%w: profile %s", ErrInvalid, err)
+	}
+	if profile.Priority < 0 {
+		return fmt.Errorf("%w: profile priority must not be negative", ErrInvalid)
+	}
+	if _, err := freqList(profile.PreferredBand); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	if err := profile.StationIP.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	if err := profile.Proxy.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	return nil
+}
+
+// Put adds profile, replacing any profile with the same ssid, and saves
+// the store.
+func (s *ProfileStore) Put(profile Profile) error {
+	return s.PutAll([]Profile{profile}, false)
+}
+
+// PutAll adds profiles, replacing those with the same ssids, and saves the
+// store once. With replace the profiles not among them are dropped. No
+// profile is added unless all are valid.
+func (s *ProfileStore) PutAll(profiles []Profile, replace bool) error {
+	ssids := map[string]bool{}
+	for _, profile := range profiles {
+		if err := profile.Validate(); err != nil {
+			return err
+		}
+		if ssids[profile.Ssid] {
+			return fmt.Errorf("%w: profile %s given twice", ErrInvalid, profile.Ssid)
+		}
+		ssids[profile.Ssid] = true
+	}
+	for _, profile := range profiles {
+		addSecrets(profile.WpaCredentials)
+		profile.Proxy.addSecrets()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := []Profile{}
+	for _, existing := range s.profiles {
+		if !ssids[existing.Ssid] && !replace {
+			kept = append(kept, existing)
+		}
+	}
+	kept = append(kept, profiles...)
+
+	if err := s.save(kept); err != nil {
+		return err
+	}
+	s.profiles = kept
+
+	return nil
+}
+
+// Delete removes the profile for ssid and saves the store.
+func (s *ProfileStore) Delete(ssid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profiles := []Profile{}
+	for _, existing := range s.profiles {
+		if existing.Ssid != ssid {
+			profiles = append(profiles, existing)
+		}
+	}
+
+	if len(profiles) == len(s.profiles) {
+		return fmt.Errorf("%w: %s", ErrProfileNotFound, ssid)
+	}
+
+	if err := s.save(profiles); err != nil {
+		return err
+	}
+	s.profiles = profiles
+
+	return nil
+}
+
+// save writes profiles to a temporary file and renames it over the store,
+// so a power cut never leaves a truncated file. The file holds secrets and
+// is only readable by its owner.
+func (s *ProfileStore) save(profiles []Profile) error {
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if s.cipher != nil {
+		if data, err = s.cipher.Seal(data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// SaveProfile stores profile and applies it to wpa_supplicant.
+func (wpa *WpaCfg) SaveProfile(ctx context.Context, profile Profile) error {
+	if err := wpa.Profiles.Put(profile); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("profile saved", "ssid", profile.Ssid, "priority", profile.Priority)
+
+	return wpa.ApplyProfiles(ctx)
+}
+
+// DeleteProfile removes the profile for ssid and forgets the network.
+func (wpa *WpaCfg) DeleteProfile(ctx context.Context, ssid string) error {
+	if err := wpa.Profiles.Delete(ssid); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("profile deleted", "ssid", ssid)
+
+	if err := wpa.RemoveNetwork(ctx, ssid); err != nil && !errors.Is(err, ErrNotConfigured) {
+		return err
+	}
+
+	return nil
+}
+
+// stationIP returns the addressing of the station on ssid: the
+// station_ip of its profile when that has an address, otherwise the one
+// of the config.
+func (wpa *WpaCfg) stationIP(ssid string) StaticIPCfg {
+	if profile, err := wpa.Profiles.Get(ssid); err == nil && profile.StationIP.Enabled() {
+		return profile.StationIP
+	}
+
+	return wpa.Cfg().StationIP
+}
+
+// ApplyProfiles makes wpa_supplicant match the profile store: missing
+// networks are added and every profile's credentials and priority are
+// set, then the config is saved. wpa_supplicant does the fallback between
+// networks itself.
+func (wpa *WpaCfg) ApplyProfiles(ctx context.Context) error {
+	ctx, done, err := wpa.ops.acquire(ctx, OpApply, "")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return err
+	}
+
+	iface := wpa.Cfg().StationInterface
+	for _, profile := range wpa.Profiles.List() {
+		ids := []string{}
+		for _, network := range networks {
+			if network.Ssid == profile.Ssid {
+				ids = append(ids, network.Id)
+			}
+		}
+
+		if len(ids) == 0 {
+			addNetOut, err := wpa.wpaCtl(ctx, "ADD_NETWORK")
+			if err != nil {
+				return fmt.Errorf("%w: add_network: %s", ErrCommandFailed, err)
+			}
+
+			net := strings.TrimSpace(string(addNetOut))
+			wpa.Log.Info("profile network added", "iface", iface, "ssid", profile.Ssid, "net_id", net)
+			ids = append(ids, net)
+		}
+
+		for _, id := range ids {
+			// the credentials of the profile may have changed since the
+			// network was added, or been saved before encryption was on
+			if err := wpa.configureNetwork(ctx, id, profile.WpaCredentials); err != nil {
+				return err
+			}
+
+			// a profile that no longer prefers a band drops it
+			band := profile.PreferredBand
+			if band == "" {
+				band = PreferredBandAny
+			}
+			if err := wpa.setPreferredBand(ctx, id, band); err != nil {
+				return err
+			}
+
+			if err := wpa.setNetwork(ctx, id, "priority", strconv.Itoa(profile.Priority)); err != nil {
+				return err
+			}
+
+			if _, err := wpa.wpaCtl(ctx, "ENABLE_NETWORK", id); err != nil {
+				return fmt.Errorf("%w: enable_network: %s", ErrCommandFailed, err)
+			}
+		}
+	}
+
+	saveOut, err := wpa.wpaCtl(ctx, "SAVE_CONFIG")
+	if err != nil {
+		return fmt.Errorf("%w: save_config: %s", ErrCommandFailed, err)
+	}
+	wpa.Log.Info("config saved", "iface", iface, "status", strings.TrimSpace(string(saveOut)))
+
+	return nil
+}
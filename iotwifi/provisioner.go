@@ -0,0 +1,166 @@
+package iotwifi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Provisioner is the command surface a provisioning transport drives.
+// HTTP, BLE, serial/UART and USB gadget transports all work against it
+// rather than against WpaCfg directly.
+type Provisioner interface {
+	ScanNetworks(ctx context.Context) ([]WpaScanResult, error)
+	ConnectNetwork(ctx context.Context, creds WpaCredentials) (WpaConnection, error)
+	Status(ctx context.Context) (map[string]string, error)
+	ListConfiguredNetworks(ctx context.Context) ([]WpaConfiguredNetwork, error)
+	RemoveNetwork(ctx context.Context, ssid string) error
+}
+
+var _ Provisioner = (*WpaCfg)(nil)
+
+// Transport carries provisioning requests to a Provisioner until ctx is done.
+type Transport interface {
+	Serve(ctx context.Context, p Provisioner) error
+}
+
+// Provisioning commands understood by Dispatch.
+const (
+	CmdScan     = "scan"
+	CmdConnect  = "connect"
+	CmdStatus   = "status"
+	CmdNetworks = "networks"
+	CmdForget   = "forget"
+)
+
+// auditedCommands change the station and are recorded in the audit log.
+var auditedCommands = map[string]bool{
+	CmdConnect: true,
+	CmdForget:  true,
+}
+
+// ProvisionRequest is a transport independent provisioning command.
+type ProvisionRequest struct {
+	Command     string         `json:"command"`
+	Credentials WpaCredentials `json:"credentials"`
+}
+
+// ProvisionResponse is the reply to a ProvisionRequest, shaped like the
+// HTTP API's return.
+type ProvisionResponse struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Payload interface{} `json:"payload"`
+}
+
+// Dispatch runs req against p and builds the response.
+func Dispatch(ctx context.Context, p Provisioner, req ProvisionRequest) ProvisionResponse {
+	var payload interface{}
+	var err error
+
+	switch req.Command {
+	case CmdScan:
+		payload, err = p.ScanNetworks(ctx)
+	case CmdConnect:
+		payload, err = p.ConnectNetwork(ctx, req.Credentials)
+	case CmdStatus:
+		payload, err = p.Status(ctx)
+	case CmdNetworks:
+		payload, err = p.ListConfiguredNetworks(ctx)
+	case CmdForget:
+		err = p.RemoveNetwork(ctx, req.Credentials.Ssid)
+		payload = req.Credentials.Ssid
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		return ProvisionResponse{Status: "FAIL", Message: err.Error(), Payload: payload}
+	}
+
+	return ProvisionResponse{Status: "OK", Message: req.Command, Payload: payload}
+}
+
+// LineTransport speaks newline delimited JSON ProvisionRequests and
+// responses over a stream, such as a UART or a USB gadget serial port.
+type LineTransport struct {
+	Audit  *AuditLog // optional, records connects and forgets
+	Device string    // the serial device, for the audit log
+
+	rw io.ReadWriter
+}
+
+// NewLineTransport produces a LineTransport over rw.
+func NewLineTransport(rw io.ReadWriter) *LineTransport {
+	return &LineTransport{rw: rw}
+}
+
+// OpenSerialTransport opens a serial device, e.g. /dev/ttyGS0, as a
+// LineTransport. The port is expected to be configured (baud rate, raw
+// mode) by the system.
+func OpenSerialTransport(device string) (*LineTransport, io.Closer, error) {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := NewLineTransport(f)
+	transport.Device = device
+
+	return transport, f, nil
+}
+
+// Serve implements Transport. Requests are handled one at a time.
+func (t *LineTransport) Serve(ctx context.Context, p Provisioner) error {
+	scanner := bufio.NewScanner(t.rw)
+	encoder := json.NewEncoder(t.rw)
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var req ProvisionRequest
+		resp := ProvisionResponse{}
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp = ProvisionResponse{Status: "FAIL", Message: err.Error()}
+		} else {
+			start := time.Now()
+			resp = Dispatch(ctx, p, req)
+			t.audit(req, resp, time.Since(start))
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// audit records req in the audit log if it is a command that changes the
+// station. A log that cannot be written does not stop provisioning.
+func (t *LineTransport) audit(req ProvisionRequest, resp ProvisionResponse, duration time.Duration) {
+	if t.Audit == nil || !auditedCommands[req.Command] {
+		return
+	}
+
+	t.Audit.Record(AuditEntry{
+		Transport: TransportSerial,
+		Client:    t.Device,
+		Action:    req.Command,
+		Ssid:      req.Credentials.Ssid,
+		Success:   resp.Status == "OK",
+		Message:   resp.Message,
+		Duration:  duration,
+	})
+}
@@ -0,0 +1,289 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultProxyFile is where the proxy of the current network is
+// exported, unless SetupCfg.ProxyFile says otherwise.
+const DefaultProxyFile = "/run/txwifi/proxy.env"
+
+// ProxyCfg is the HTTP proxy of a network, for networks that only reach
+// the internet through one, and is used by Profile.
+type ProxyCfg struct {
+	Http    string `json:"http"`     // http://proxy.corp:3128, for http URLs
+	Https   string `json:"https"`    // for https URLs, the http one if empty
+	NoProxy string `json:"no_proxy"` // localhost,.corp,10.0.0.0/8, reached directly
+}
+
+// Enabled reports whether a proxy is configured.
+func (p ProxyCfg) Enabled() bool {
+	return p.Http != "" || p.Https != ""
+}
+
+// Validate checks that the proxies are http, https or socks5 URLs.
+func (p ProxyCfg) Validate() error {
+	for _, proxy := range []string{p.Http, p.Https} {
+		if proxy == "" {
+			continue
+		}
+
+		u, err := url.Parse(proxy)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid proxy %q, expected scheme://host:port", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid proxy %q, expected an http, https or socks5 URL", proxy)
+		}
+		if strings.ContainsAny(proxy, "\"\n") {
+			return fmt.Errorf("invalid proxy %q", proxy)
+		}
+	}
+	if strings.ContainsAny(p.NoProxy, "\"\n") {
+		return fmt.Errorf("invalid no_proxy %q", p.NoProxy)
+	}
+
+	return nil
+}
+
+// https returns the proxy of https URLs.
+func (p ProxyCfg) https() string {
+	if p.Https != "" {
+		return p.Https
+	}
+
+	return p.Http
+}
+
+// Redacted returns p with the passwords in the proxy URLs hidden.
+func (p ProxyCfg) Redacted() ProxyCfg {
+	p.Http = redactURL(p.Http)
+	p.Https = redactURL(p.Https)
+
+	return p
+}
+
+// redactURL hides the password of a URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+
+	return u.String()
+}
+
+// addSecrets keeps the passwords of the proxy URLs out of the logs.
+func (p ProxyCfg) addSecrets() {
+	for _, proxy := range []string{p.Http, p.Https} {
+		if u, err := url.Parse(proxy); err == nil && u.User != nil {
+			password, _ := u.User.Password()
+			secrets.add(password)
+		}
+	}
+}
+
+// env returns p as an environment file, in both the upper and lower case
+// spellings tools look for.
+func (p ProxyCfg) env() string {
+	vars := []struct {
+		name  string
+		value string
+	}{
+		{"HTTP_PROXY", p.Http},
+		{"HTTPS_PROXY", p.https()},
+		{"NO_PROXY", p.NoProxy},
+	}
+
+	env := ""
+	for _, v := range vars {
+		if v.value == "" {
+			continue
+		}
+		env += fmt.Sprintf("%s=\"%s\"\n%s=\"%s\"\n", v.name, v.value, strings.ToLower(v.name), v.value)
+	}
+
+	return env
+}
+
+// proxyFunc returns the proxy of a request for an http.Transport,
+// skipping the hosts of NoProxy.
+func (p ProxyCfg) proxyFunc() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if p.direct(req.URL.Hostname()) {
+			return nil, nil
+		}
+
+		proxy := p.Http
+		if req.URL.Scheme == "https" {
+			proxy = p.https()
+		}
+		if proxy == "" {
+			return nil, nil
+		}
+
+		return url.Parse(proxy)
+	}
+}
+
+// direct reports whether NoProxy has host reached without the proxy: the
+// host itself, a domain it is in, or * for every host.
+func (p ProxyCfg) direct(host string) bool {
+	for _, skip := range strings.Split(p.NoProxy, ",") {
+		skip = strings.TrimPrefix(strings.TrimSpace(skip), ".")
+		switch {
+		case skip == "":
+		case skip == "*", host == skip, strings.HasSuffix(host, "."+skip):
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyFile returns where the proxy of the current network is exported.
+func (s *SetupCfg) proxyFile() string {
+	if s.ProxyFile != "" {
+		return s.ProxyFile
+	}
+
+	return DefaultProxyFile
+}
+
+// proxy returns the proxy of the profile of ssid, none if it has no
+// profile or the profile no proxy.
+func (wpa *WpaCfg) proxy(ssid string) ProxyCfg {
+	if ssid == "" {
+		return ProxyCfg{}
+	}
+
+	profile, err := wpa.Profiles.Get(ssid)
+	if err != nil {
+		return ProxyCfg{}
+	}
+
+	return profile.Proxy
+}
+
+// activeProxy returns the proxy of the network the station is connected
+// to.
+func (wpa *WpaCfg) activeProxy(ctx context.Context) ProxyCfg {
+	status, err := wpa.wpaStatus(ctx)
+	if err != nil || status["wpa_state"] != "COMPLETED" {
+		return ProxyCfg{}
+	}
+
+	return wpa.proxy(status["ssid"])
+}
+
+// ProfileProxy exports the proxy of the profile of the network the
+// station is connected to, as an environment file other services on the
+// device load, and removes it when the station disconnects.
+type ProfileProxy struct {
+	Wpa *WpaCfg
+
+	mu      sync.Mutex
+	current ProxyCfg // the proxy exported, empty for none
+}
+
+// NewProfileProxy produces a ProfileProxy for wpa.
+func NewProfileProxy(wpa *WpaCfg) *ProfileProxy {
+	return &ProfileProxy{Wpa: wpa}
+}
+
+// Run follows the station connecting and disconnecting until ctx is
+// done, then removes the file. NetworkManager keeps the proxy of each
+// connection itself, so under it Run returns at once.
+func (p *ProfileProxy) Run(ctx context.Context, bus *EventBus) {
+	cfg := p.Wpa.Cfg()
+	if cfg.NetworkManager.Enabled {
+		return
+	}
+
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	defer p.export(ProxyCfg{})
+
+	// a file left by a previous run may belong to another network
+	p.export(ProxyCfg{})
+	p.export(p.Wpa.activeProxy(ctx))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if ev.Iface == cfg.StationInterface && (ev.Type == EventConnected || ev.Type == EventDisconnected) {
+				p.export(p.Wpa.activeProxy(ctx))
+			}
+		}
+	}
+}
+
+// export writes proxy to the proxy file, or removes the file when proxy
+// is empty.
+func (p *ProfileProxy) export(proxy ProxyCfg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wpa := p.Wpa
+	path := wpa.Cfg().proxyFile()
+
+	if !proxy.Enabled() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			wpa.Log.Error("could not remove proxy file", "path", path, "error", err)
+			return
+		}
+		if p.current.Enabled() {
+			wpa.Log.Info("proxy removed", "path", path)
+		}
+		p.current = ProxyCfg{}
+		return
+	}
+
+	if proxy == p.current {
+		return
+	}
+
+	if err := writeProxyFile(path, proxy); err != nil {
+		wpa.Log.Error("could not write proxy file", "path", path, "error", err)
+		return
+	}
+	p.current = proxy
+
+	wpa.Log.Info("proxy exported", "path", path, "http", proxy.Redacted().Http, "https", proxy.Redacted().https())
+}
+
+// writeProxyFile writes proxy to a temporary file and renames it over
+// path, so a service starting meanwhile never loads half of it. It may
+// hold a proxy password and is only readable by its owner.
+func writeProxyFile(path string, proxy ProxyCfg) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(proxy.env()), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,576 @@
+// Package qr encodes text as a QR code (byte mode, error correction
+// level M, versions 1 to 10) and renders it as a PNG or as text for a
+// terminal, enough for the WIFI: payloads shown on attached screens.
+
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// ErrTooLong is returned for text that does not fit in version 10.
+var ErrTooLong = errors.New("qr: text too long")
+
+// QuietZone is the light border, in modules, around a rendered code.
+const QuietZone = 4
+
+// Code is an encoded QR code.
+type Code struct {
+	Size    int      // modules per side
+	Modules [][]bool // [y][x], true is dark
+}
+
+// version describes the level M block structure of one version.
+type version struct {
+	ecPerBlock int
+	blocks     []int // data codewords of each block
+	alignment  []int // alignment pattern centers
+}
+
+// versions are the level M structures of versions 1 to 10.
+var versions = []version{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// dataCodewords returns the data capacity of v in codewords.
+func (v version) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+// Encode encodes text in the smallest version that holds it.
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+
+	for i, v := range versions {
+		ver := i + 1
+
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > v.dataCodewords()*8 {
+			continue
+		}
+
+		codewords := v.codewords(encodeData(data, countBits, v.dataCodewords()))
+		return build(ver, v, codewords), nil
+	}
+
+	return nil, ErrTooLong
+}
+
+// bitBuffer accumulates bits most significant first.
+type bitBuffer struct {
+	bytes []byte
+	n     int
+}
+
+func (b *bitBuffer) put(value int, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if value>>uint(i)&1 == 1 {
+			b.bytes[b.n/8] |= 0x80 >> uint(b.n%8)
+		}
+		b.n++
+	}
+}
+
+// encodeData builds the byte mode segment padded to capacity codewords.
+func encodeData(data []byte, countBits int, capacity int) []byte {
+	var buf bitBuffer
+	buf.put(0x4, 4) // byte mode
+	buf.put(len(data), countBits)
+	for _, c := range data {
+		buf.put(int(c), 8)
+	}
+
+	// terminator, then pad to a byte boundary
+	terminator := capacity*8 - buf.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	buf.put(0, terminator)
+	if buf.n%8 != 0 {
+		buf.put(0, 8-buf.n%8)
+	}
+
+	for pad := 0; len(buf.bytes) < capacity; pad++ {
+		if pad%2 == 0 {
+			buf.bytes = append(buf.bytes, 0xec)
+		} else {
+			buf.bytes = append(buf.bytes, 0x11)
+		}
+	}
+
+	return buf.bytes
+}
+
+// codewords splits data into blocks, adds error correction to each and
+// interleaves them.
+func (v version) codewords(data []byte) []byte {
+	blocks := make([][]byte, len(v.blocks))
+	ecs := make([][]byte, len(v.blocks))
+	maxData := 0
+	for i, n := range v.blocks {
+		blocks[i] = data[:n]
+		data = data[n:]
+		ecs[i] = reedSolomon(blocks[i], v.ecPerBlock)
+		if n > maxData {
+			maxData = n
+		}
+	}
+
+	out := []byte{}
+	for i := 0; i < maxData; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+
+	return out
+}
+
+// gfExp and gfLog are the GF(256) tables for the QR polynomial 0x11d.
+var gfExp, gfLog = func() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+
+	return exp, log
+}()
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// reedSolomon returns the n error correction codewords of data.
+func reedSolomon(data []byte, n int) []byte {
+	// generator (x - a^0)(x - a^1)...(x - a^(n-1)), highest term first
+	gen := []byte{1}
+	for i := 0; i < n; i++ {
+		next := make([]byte, len(gen)+1)
+		for j, c := range gen {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, gfExp[i])
+		}
+		gen = next
+	}
+
+	msg := make([]byte, len(data)+n)
+	copy(msg, data)
+	for i := range data {
+		coef := msg[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(gen); j++ {
+			msg[i+j] ^= gfMul(gen[j], coef)
+		}
+	}
+
+	return msg[len(data):]
+}
+
+// matrix is a code being built, with the modules reserved for function
+// patterns marked so data and masks skip them.
+type matrix struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func newMatrix(size int) *matrix {
+	m := &matrix{size: size}
+	m.modules = make([][]bool, size)
+	m.function = make([][]bool, size)
+	for y := range m.modules {
+		m.modules[y] = make([]bool, size)
+		m.function[y] = make([]bool, size)
+	}
+	return m
+}
+
+// set sets a function module.
+func (m *matrix) set(x int, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.function[y][x] = true
+}
+
+// build lays out codewords in a version ver code with the best mask.
+func build(ver int, v version, codewords []byte) *Code {
+	size := 17 + 4*ver
+	m := newMatrix(size)
+
+	m.finder(3, 3)
+	m.finder(size-4, 3)
+	m.finder(3, size-4)
+
+	for i := 8; i < size-8; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+
+	last := len(v.alignment) - 1
+	for i, cx := range v.alignment {
+		for j, cy := range v.alignment {
+			// the corners with finder patterns have no alignment pattern
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			m.alignment(cx, cy)
+		}
+	}
+
+	// reserve the format areas, drawn for real once the mask is chosen
+	m.format(0)
+	if ver >= 7 {
+		m.version(ver)
+	}
+
+	m.place(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		m.mask(mask)
+		m.format(mask)
+		if penalty := m.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		m.mask(mask) // masking twice undoes it
+	}
+	m.mask(best)
+	m.format(best)
+
+	return &Code{Size: size, Modules: m.modules}
+}
+
+// finder draws a finder pattern and its separator centered on cx, cy.
+func (m *matrix) finder(cx int, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= m.size || y >= m.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			m.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+// alignment draws an alignment pattern centered on cx, cy.
+func (m *matrix) alignment(cx int, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			m.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// format draws both copies of the level M format bits for mask, and the
+// dark module.
+func (m *matrix) format(mask int) {
+	data := mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+	m.set(8, m.size-8, true)
+}
+
+// version draws both copies of the version bits.
+func (m *matrix) version(ver int) {
+	rem := ver
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	bits := ver<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := m.size-11+i%3, i/3
+		m.set(a, b, dark)
+		m.set(b, a, dark)
+	}
+}
+
+// place fills the non-function modules with codewords, in two module
+// wide columns zigzagging up and down from the bottom right.
+func (m *matrix) place(codewords []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		// the vertical timing pattern is skipped
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < m.size; vert++ {
+			y := vert
+			if upward {
+				y = m.size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if m.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				m.modules[y][x] = codewords[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// mask inverts the data modules selected by mask.
+func (m *matrix) mask(mask int) {
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.function[y][x] {
+				continue
+			}
+
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			if invert {
+				m.modules[y][x] = !m.modules[y][x]
+			}
+		}
+	}
+}
+
+// finderLike are the 1:1:3:1:1 runs with four light modules on one side
+// that the penalty rules punish.
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores the masked code, lower is easier to read.
+func (m *matrix) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return m.modules[x][y]
+		}
+		return m.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < m.size; y++ {
+			// runs of five or more modules of one color
+			run := 1
+			for x := 1; x < m.size; x++ {
+				if at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+
+			// patterns that look like finders
+			for x := 0; x+11 <= m.size; x++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if at(x+k, y, vertical) != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						penalty += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of one color
+	dark := 0
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if m.modules[y][x] {
+				dark++
+			}
+			if x+1 < m.size && y+1 < m.size {
+				c := m.modules[y][x]
+				if m.modules[y][x+1] == c && m.modules[y+1][x] == c && m.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	// every 5% away from half dark
+	percent := dark * 100 / (m.size * m.size)
+	penalty += abs(percent-50) / 5 * 10
+
+	return penalty
+}
+
+// dark reports whether the module at x, y is dark, with the quiet zone
+// around the code light.
+func (c *Code) dark(x int, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.Modules[y][x]
+}
+
+// Image renders the code with a quiet zone, scale pixels per module.
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+
+	side := (c.Size + 2*QuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			v := color.Gray{Y: 0xff}
+			if c.dark(px/scale-QuietZone, py/scale-QuietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+
+	return img
+}
+
+// PNG renders the code as a PNG, scale pixels per module.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(scale)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ASCII renders the code with half block characters, two modules per
+// character cell. Light modules are drawn as blocks, so it scans on a
+// terminal with a dark background.
+func (c *Code) ASCII() string {
+	var b strings.Builder
+	for y := -QuietZone; y < c.Size+QuietZone; y += 2 {
+		for x := -QuietZone; x < c.Size+QuietZone; x++ {
+			top, bottom := !c.dark(x, y), !c.dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
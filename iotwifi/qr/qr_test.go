@@ -0,0 +1,392 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// formatBits are the level M format bits of each mask, from the
+// specification's table.
+var formatBits = []int{
+	0x5412, // 101010000010010
+	0x5125, // 101000100100101
+	0x5e7c, // 101111001111100
+	0x5b4b, // 101101101001011
+	0x45f9, // 100010111111001
+	0x40ce, // 100000011001110
+	0x4f97, // 100111110010111
+	0x4aa0, // 100101010100000
+}
+
+// versionBits are the version bits of versions 7 to 10.
+var versionBits = map[int]int{7: 0x07c94, 8: 0x085bc, 9: 0x09a99, 10: 0x0a4d3}
+
+// isFunction reports whether x, y of a version ver code is part of a
+// function pattern or of the format or version bits.
+func isFunction(ver int, x int, y int) bool {
+	size := 17 + 4*ver
+	switch {
+	case x <= 8 && y <= 8, x >= size-8 && y <= 8, x <= 8 && y >= size-8:
+		return true // finders, separators and format bits
+	case x == 6 || y == 6:
+		return true // timing
+	case ver >= 7 && ((x >= size-11 && y < 6) || (y >= size-11 && x < 6)):
+		return true // version bits
+	}
+
+	centers := versions[ver-1].alignment
+	for _, cx := range centers {
+		for _, cy := range centers {
+			if abs(x-cx) <= 2 && abs(y-cy) <= 2 && !(cx <= 8 && cy <= 8) && !(cx <= 8 && cy >= size-9) && !(cx >= size-9 && cy <= 8) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decode reads the text of a code, checking its fixed patterns, format
+// and version bits and the error correction of each block.
+func decode(c *Code) (string, error) {
+	size := c.Size
+	ver := (size - 17) / 4
+	if ver < 1 || ver > 10 || 17+4*ver != size || len(c.Modules) != size {
+		return "", fmt.Errorf("size %d", size)
+	}
+	dark := func(x, y int) bool { return c.Modules[y][x] }
+
+	for _, corner := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				d := max(abs(dx-3), abs(dy-3))
+				if dark(corner[0]+dx, corner[1]+dy) != (d != 2) {
+					return "", fmt.Errorf("finder at %v", corner)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if dark(6, i) != (i%2 == 0) || dark(i, 6) != (i%2 == 0) {
+			return "", fmt.Errorf("timing at %d", i)
+		}
+	}
+	if !dark(8, size-8) {
+		return "", errors.New("no dark module")
+	}
+
+	// format bits, least significant first
+	first, second := 0, 0
+	firstAt := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, at := range firstAt {
+		if dark(at[0], at[1]) {
+			first |= 1 << uint(i)
+		}
+		x, y := size-1-i, 8
+		if i >= 8 {
+			x, y = 8, size-15+i
+		}
+		if dark(x, y) {
+			second |= 1 << uint(i)
+		}
+	}
+	mask := -1
+	for m, bits := range formatBits {
+		if first == bits {
+			mask = m
+		}
+	}
+	if mask < 0 || second != first {
+		return "", fmt.Errorf("format bits %015b, %015b", first, second)
+	}
+
+	if ver >= 7 {
+		for i := 0; i < 18; i++ {
+			want := versionBits[ver]>>uint(i)&1 == 1
+			if dark(size-11+i%3, i/3) != want || dark(i/3, size-11+i%3) != want {
+				return "", fmt.Errorf("version bit %d", i)
+			}
+		}
+	}
+
+	masks := []func(x, y int) bool{
+		func(x, y int) bool { return (x+y)%2 == 0 },
+		func(x, y int) bool { return y%2 == 0 },
+		func(x, y int) bool { return x%3 == 0 },
+		func(x, y int) bool { return (x+y)%3 == 0 },
+		func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+		func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+		func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+		func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+	}
+
+	// the codewords, in pairs of columns from the right, up then down
+	raw := []byte{}
+	n := 0
+	for col, pair := size-1, 0; col > 0; col, pair = col-2, pair+1 {
+		if col == 6 {
+			col--
+		}
+		for i := 0; i < size; i++ {
+			y := i
+			if pair%2 == 0 {
+				y = size - 1 - i
+			}
+			for _, x := range []int{col, col - 1} {
+				if isFunction(ver, x, y) {
+					continue
+				}
+				if n%8 == 0 {
+					raw = append(raw, 0)
+				}
+				if dark(x, y) != masks[mask](x, y) {
+					raw[n/8] |= 0x80 >> uint(n%8)
+				}
+				n++
+			}
+		}
+	}
+
+	v := versions[ver-1]
+	total := v.dataCodewords() + len(v.blocks)*v.ecPerBlock
+	if len(raw) < total {
+		return "", fmt.Errorf("%d codewords, want %d", len(raw), total)
+	}
+
+	blocks := make([][]byte, len(v.blocks))
+	i := 0
+	for k := 0; k < v.blocks[len(v.blocks)-1]; k++ {
+		for b, size := range v.blocks {
+			if k < size {
+				blocks[b] = append(blocks[b], raw[i])
+				i++
+			}
+		}
+	}
+	for k := 0; k < v.ecPerBlock; k++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], raw[i])
+			i++
+		}
+	}
+
+	data := []byte{}
+	for b, block := range blocks {
+		// a codeword is valid when it has the roots a^0..a^(ec-1)
+		for root := 0; root < v.ecPerBlock; root++ {
+			var syndrome byte
+			for _, cw := range block {
+				syndrome = gfMul(syndrome, gfExp[root]) ^ cw
+			}
+			if syndrome != 0 {
+				return "", fmt.Errorf("block %d syndrome %d is %d", b, root, syndrome)
+			}
+		}
+		data = append(data, block[:v.blocks[b]]...)
+	}
+
+	// the byte mode segment
+	bit := 0
+	read := func(bits int) int {
+		value := 0
+		for ; bits > 0; bits-- {
+			value = value<<1 | int(data[bit/8]>>uint(7-bit%8)&1)
+			bit++
+		}
+		return value
+	}
+	if mode := read(4); mode != 0x4 {
+		return "", fmt.Errorf("mode %x", mode)
+	}
+	countBits := 8
+	if ver >= 10 {
+		countBits = 16
+	}
+	length := read(countBits)
+	if 4+countBits+8*length > 8*len(data) {
+		return "", fmt.Errorf("length %d", length)
+	}
+	text := make([]byte, length)
+	for i := range text {
+		text[i] = byte(read(8))
+	}
+	if end := min(bit+4, 8*len(data)); end > bit && read(end-bit) != 0 {
+		return "", errors.New("no terminator")
+	}
+	for k, pad := (bit+7)/8, 0; k < len(data); k, pad = k+1, pad+1 {
+		if want := []byte{0xec, 0x11}[pad%2]; data[k] != want {
+			return "", fmt.Errorf("pad codeword %d is %x", k, data[k])
+		}
+	}
+
+	return string(text), nil
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text    string
+		version int
+	}{
+		{"", 1},
+		{"WIFI:T:nopass;S:txwifi;;", 2},
+		{strings.Repeat("a", 14), 1},
+		{strings.Repeat("a", 15), 2},
+		{"WIFI:T:WPA;S:txwifi-b827eb123456;P:iotwifipass;H:true;;", 4},
+		{strings.Repeat("\x00\xff", 42), 5},
+		{strings.Repeat("b", 122), 7},
+		{strings.Repeat("c", 123), 8},
+		{strings.Repeat("d", 152), 8},
+		{strings.Repeat("e", 180), 9},
+		{strings.Repeat("f", 181), 10},
+		{strings.Repeat("g", 213), 10},
+	}
+
+	for _, tt := range tests {
+		c, err := Encode(tt.text)
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(tt.text), err)
+			continue
+		}
+		if c.Size != 17+4*tt.version {
+			t.Errorf("%d bytes in version %d, want %d", len(tt.text), (c.Size-17)/4, tt.version)
+		}
+		if text, err := decode(c); err != nil || text != tt.text {
+			t.Errorf("%d bytes decoded to %q, %v", len(tt.text), text, err)
+		}
+	}
+
+	if c, err := Encode(strings.Repeat("h", 214)); err != ErrTooLong {
+		t.Errorf("214 bytes encoded to %+v, %v", c, err)
+	}
+}
+
+// TestVersions checks the block structures against the byte mode
+// capacities at level M.
+func TestVersions(t *testing.T) {
+	capacities := []int{14, 26, 42, 62, 84, 106, 122, 152, 180, 213}
+	totals := []int{26, 44, 70, 100, 134, 172, 196, 242, 292, 346}
+
+	for i, v := range versions {
+		ver := i + 1
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if n := (8*v.dataCodewords() - 4 - countBits) / 8; n != capacities[i] {
+			t.Errorf("version %d holds %d bytes, want %d", ver, n, capacities[i])
+		}
+		if n := v.dataCodewords() + len(v.blocks)*v.ecPerBlock; n != totals[i] {
+			t.Errorf("version %d has %d codewords, want %d", ver, n, totals[i])
+		}
+		if len(v.alignment) > 0 && v.alignment[len(v.alignment)-1] != 17+4*ver-7 {
+			t.Errorf("version %d alignment %v", ver, v.alignment)
+		}
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// the version 1-M "HELLO WORLD" example
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ec := reedSolomon(data, 10); !bytes.Equal(ec, want) {
+		t.Errorf("ec %v, want %v", ec, want)
+	}
+}
+
+func TestEncodeData(t *testing.T) {
+	tests := []struct {
+		data      string
+		countBits int
+		capacity  int
+		want      []byte
+	}{
+		{"", 8, 3, []byte{0x40, 0x00, 0xec}},
+		{"A", 8, 5, []byte{0x40, 0x14, 0x10, 0xec, 0x11}},
+		{"A", 16, 4, []byte{0x40, 0x00, 0x14, 0x10}},
+		// the terminator fills the last codeword
+		{"AB", 8, 4, []byte{0x40, 0x24, 0x14, 0x20}},
+	}
+
+	for _, tt := range tests {
+		if got := encodeData([]byte(tt.data), tt.countBits, tt.capacity); !bytes.Equal(got, tt.want) {
+			t.Errorf("%q in %d codewords: % x, want % x", tt.data, tt.capacity, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode("WIFI:T:WPA;S:txwifi;P:iotwifipass;;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := c.Size + 2*QuietZone
+
+	for _, scale := range []int{0, 1, 3} {
+		img := c.Image(scale)
+		px := max(scale, 1)
+		if b := img.Bounds(); b.Dx() != side*px || b.Dy() != side*px {
+			t.Fatalf("scale %d: %v", scale, b)
+		}
+		for y := 0; y < side*px; y++ {
+			for x := 0; x < side*px; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				if dark := c.dark(x/px-QuietZone, y/px-QuietZone); dark != (r == 0) {
+					t.Fatalf("scale %d: pixel %d,%d is %d", scale, x, y, r)
+				}
+			}
+		}
+	}
+
+	data, err := c.PNG(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil || img.Bounds().Dx() != 2*side {
+		t.Errorf("png %v, %v", img, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(c.ASCII(), "\n"), "\n")
+	if len(lines) != (side+1)/2 {
+		t.Fatalf("%d lines, want %d", len(lines), (side+1)/2)
+	}
+	for y, line := range lines {
+		if utf8.RuneCountInString(line) != side {
+			t.Fatalf("line %d is %d wide", y, utf8.RuneCountInString(line))
+		}
+		for x, r := range []rune(line) {
+			top, bottom := !c.dark(x-QuietZone, 2*y-QuietZone), !c.dark(x-QuietZone, 2*y+1-QuietZone)
+			want := map[[2]bool]rune{{true, true}: '█', {true, false}: '▀', {false, true}: '▄', {false, false}: ' '}[[2]bool{top, bottom}]
+			if r != want {
+				t.Fatalf("cell %d,%d is %q, want %q", x, y, r, want)
+			}
+		}
+	}
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add("WIFI:T:WPA;S:txwifi;P:iotwifipass;;")
+	f.Add("")
+	f.Add(strings.Repeat("\xff", 213))
+
+	f.Fuzz(func(t *testing.T, text string) {
+		c, err := Encode(text)
+		if len(text) > 213 {
+			if err != ErrTooLong {
+				t.Fatalf("%d bytes encoded, %v", len(text), err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := decode(c); err != nil || got != text {
+			t.Fatalf("%q decoded to %q, %v", text, got, err)
+		}
+	})
+}
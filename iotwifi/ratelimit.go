@@ -0,0 +1,215 @@
+package iotwifi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rate limit defaults.
+const (
+	DefaultConnectPerMin   = 6
+	DefaultRequestsPerMin  = 120
+	DefaultMaxAuthFailures = 5
+	DefaultLockoutSec      = 300
+)
+
+// RateLimitCfg limits how often each API client may connect and poll, and
+// locks out clients that keep failing to authenticate, and is used by
+// SetupCfg. The AP subnet is open to anyone during setup, and a client
+// guessing passphrases through the connect endpoint would otherwise
+// brute-force a neighbor's network with the device.
+type RateLimitCfg struct {
+	Disabled        bool     `json:"disabled"`
+	ConnectPerMin   int      `json:"connect_per_min"`   // connect attempts, 6 by default
+	RequestsPerMin  int      `json:"requests_per_min"`  // every request, status polling included, 120 by default
+	MaxAuthFailures int      `json:"max_auth_failures"` // wrong passwords within the lockout before a lockout, 5 by default
+	LockoutSec      int      `json:"lockout_sec"`       // 300 by default
+	Exempt          []string `json:"exempt"`            // client addresses never limited
+}
+
+// withDefaults fills in the limits.
+func (c RateLimitCfg) withDefaults() RateLimitCfg {
+	if c.ConnectPerMin == 0 {
+		c.ConnectPerMin = DefaultConnectPerMin
+	}
+	if c.RequestsPerMin == 0 {
+		c.RequestsPerMin = DefaultRequestsPerMin
+	}
+	if c.MaxAuthFailures == 0 {
+		c.MaxAuthFailures = DefaultMaxAuthFailures
+	}
+	if c.LockoutSec == 0 {
+		c.LockoutSec = DefaultLockoutSec
+	}
+
+	return c
+}
+
+// lockout returns the lockout duration.
+func (c RateLimitCfg) lockout() time.Duration {
+	return time.Duration(c.LockoutSec) * time.Second
+}
+
+// bucket is a token bucket holding up to perMin tokens, refilled at
+// perMin a minute.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token, or returns how long until there is one.
+func (b *bucket) take(perMin int, now time.Time) (bool, time.Duration) {
+	rate := float64(perMin) / 60 // tokens a second
+
+	if b.last.IsZero() {
+		b.tokens = float64(perMin)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(perMin) {
+			b.tokens = float64(perMin)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+
+	return true, 0
+}
+
+// rateClient is the limit state of one client.
+type rateClient struct {
+	requests    bucket
+	connects    bucket
+	failures    []time.Time // recent authentication failures
+	lockedUntil time.Time
+	seen        time.Time
+}
+
+// RateLimiter keeps the limits of RateLimitCfg per client, an IP or, for
+// clients on the AP, a MAC, which survives a new DHCP lease.
+type RateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimitCfg
+	exempt    map[string]bool
+	clients   map[string]*rateClient
+	lastPrune time.Time
+}
+
+// NewRateLimiter produces a RateLimiter enforcing cfg.
+func NewRateLimiter(cfg RateLimitCfg) *RateLimiter {
+	l := &RateLimiter{
+		clients: map[string]*rateClient{},
+	}
+	l.Configure(cfg)
+
+	return l
+}
+
+// Configure replaces the limits, on a config reload. The clients keep
+// their buckets and lockouts, so a reload does not hand a client that is
+// guessing passphrases a fresh set of attempts.
+func (l *RateLimiter) Configure(cfg RateLimitCfg) {
+	exempt := map[string]bool{}
+	for _, client := range cfg.Exempt {
+		exempt[client] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cfg = cfg.withDefaults()
+	l.exempt = exempt
+}
+
+// Exempt reports whether addr is never limited.
+func (l *RateLimiter) Exempt(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.cfg.Disabled || l.exempt[addr]
+}
+
+// Allow takes a request, and a connect attempt if connect is set, from
+// client. A client that is over a limit, or locked out, gets an error
+// wrapping ErrRateLimited or ErrLockedOut and how long to wait.
+func (l *RateLimiter) Allow(client string, connect bool) (time.Duration, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	c := l.client(client, now)
+	if now.Before(c.lockedUntil) {
+		return c.lockedUntil.Sub(now), fmt.Errorf("%w: %d failed attempts", ErrLockedOut, len(c.failures))
+	}
+
+	if ok, wait := c.requests.take(l.cfg.RequestsPerMin, now); !ok {
+		return wait, fmt.Errorf("%w: more than %d requests a minute", ErrRateLimited, l.cfg.RequestsPerMin)
+	}
+	if connect {
+		if ok, wait := c.connects.take(l.cfg.ConnectPerMin, now); !ok {
+			return wait, fmt.Errorf("%w: more than %d connects a minute", ErrRateLimited, l.cfg.ConnectPerMin)
+		}
+	}
+
+	return 0, nil
+}
+
+// AuthFailed counts a connect from client that failed on the password,
+// locking it out once it reaches MaxAuthFailures within the lockout.
+func (l *RateLimiter) AuthFailed(client string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.client(client, now)
+
+	recent := []time.Time{}
+	for _, failure := range c.failures {
+		if now.Sub(failure) < l.cfg.lockout() {
+			recent = append(recent, failure)
+		}
+	}
+	c.failures = append(recent, now)
+
+	if len(c.failures) >= l.cfg.MaxAuthFailures {
+		c.lockedUntil = now.Add(l.cfg.lockout())
+	}
+}
+
+// client returns the state of client, adding it if it is new. The caller
+// holds mu.
+func (l *RateLimiter) client(client string, now time.Time) *rateClient {
+	c, ok := l.clients[client]
+	if !ok {
+		c = &rateClient{}
+		l.clients[client] = c
+	}
+	c.seen = now
+
+	return c
+}
+
+// prune forgets clients idle for longer than the lockout and a minute,
+// once a minute. Their buckets are full again by then. The caller holds
+// mu.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for key, c := range l.clients {
+		idle := now.Sub(c.seen)
+		if idle > l.cfg.lockout() && idle > time.Minute && now.After(c.lockedUntil) {
+			delete(l.clients, key)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package iotwifi
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultReloadInterval is how often the CfgWatcher checks the config
+// file for changes.
+const DefaultReloadInterval = 5 * time.Second
+
+// EventCfgReloaded is published when a reload changed the config, its
+// message lists the changed fields.
+const EventCfgReloaded = "config-reloaded"
+
+// ReloadCfg configures the CfgWatcher and is used by SetupCfg.
+type ReloadCfg struct {
+	IntervalSec  int  `json:"interval_sec"`  // how often to check the file for changes, 5 by default
+	DisableWatch bool `json:"disable_watch"` // only reload on SIGHUP or POST /reload
+}
+
+// liveCfgFields are the config fields a reload applies to the running
+// daemon. Changes to any other field are only picked up by a restart.
+var liveCfgFields = map[string]bool{
+	"host_apd_cfg":   true,
+	"ap_allow_list":  true,
+	"ap_deny_list":   true,
+	"ap_window":      true,
+	"country":        true,
+	"signal_monitor": true,
+	"watchdog":       true,
+	"latency":        true,
+	"scan":           true,
+	"survey":         true,
+	"watchlist":      true,
+	"state_machine":  true,
+	"connectivity":   true,
+	"connect_retry":  true,
+	"webhook":        true,
+	"webhooks":       true,
+	"rate_limit":     true,
+}
+
+// apCfgFields are the fields written to hostapd.conf.
+var apCfgFields = []string{"host_apd_cfg", "ap_allow_list", "ap_deny_list"}
+
+// CfgReload is the outcome of a reload.
+type CfgReload struct {
+	Changed []string `json:"changed"`          // fields applied to the running daemon
+	Restart []string `json:"restart_required"` // fields that changed but need a restart
+}
+
+// CfgWatcher reloads the config on SIGHUP, on request and when its file
+// changes, and applies what changed without restarting the station: AP
+// changes rewrite hostapd.conf and reload hostapd, the others are
+// applied by replacing the running config.
+type CfgWatcher struct {
+	Wpa      *WpaCfg
+	Location string
+	Interval time.Duration
+	Watch    bool
+
+	// OnReload is called with the new config after every reload that
+	// changed it, to reconfigure the components outside WpaCfg.
+	OnReload func(cfg *SetupCfg, reload CfgReload)
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewCfgWatcher produces a CfgWatcher for the config at location, which
+// checks the file every DefaultReloadInterval.
+func NewCfgWatcher(wpa *WpaCfg, location string) *CfgWatcher {
+	w := &CfgWatcher{
+		Wpa:      wpa,
+		Location: location,
+		Interval: DefaultReloadInterval,
+		Watch:    true,
+	}
+	w.modTime, _ = cfgModTime(location)
+
+	return w
+}
+
+// Configure applies cfg over the default settings.
+func (w *CfgWatcher) Configure(cfg ReloadCfg) {
+	if cfg.IntervalSec > 0 {
+		w.Interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	w.Watch = !cfg.DisableWatch
+}
+
+// Run reloads on SIGHUP and, unless watching is disabled, whenever the
+// config file changes, until ctx is done. Configs at http(s) URLs are
+// only reloaded on SIGHUP.
+func (w *CfgWatcher) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if _, err := cfgModTime(w.Location); w.Watch && err == nil {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.Wpa.Log.Info("reloading config", "cfg", w.Location, "signal", "SIGHUP")
+		case <-tick:
+			modTime, err := cfgModTime(w.Location)
+			if err != nil || modTime.Equal(w.lastModTime()) {
+				continue
+			}
+			w.Wpa.Log.Info("reloading config", "cfg", w.Location, "mod_time", modTime)
+		}
+
+		if _, err := w.Reload(ctx); err != nil {
+			w.Wpa.Log.Error("could not reload config", "cfg", w.Location, "error", err)
+		}
+	}
+}
+
+// Reload loads the config again and applies what changed. An invalid
+// config is rejected and the running config kept.
+func (w *CfgWatcher) Reload(ctx context.Context) (CfgReload, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reload := CfgReload{Changed: []string{}, Restart: []string{}}
+
+	// the file is not looked at again until it changes, valid or not
+	w.modTime, _ = cfgModTime(w.Location)
+
+	cfg, err := loadCfg(w.Location)
+	if err != nil {
+		return reload, err
+	}
+
+	wpa := w.Wpa
+	old := wpa.Cfg()
+
+	reload.Changed, reload.Restart = splitChanges(old, cfg)
+	if len(reload.Restart) > 0 {
+		wpa.Log.Warn("config changes need a restart", "cfg", w.Location, "fields", strings.Join(reload.Restart, ","))
+	}
+	if len(reload.Changed) == 0 {
+		wpa.Log.Debug("config unchanged", "cfg", w.Location)
+		return reload, nil
+	}
+
+	changed := map[string]bool{}
+	for _, field := range reload.Changed {
+		changed[field] = true
+	}
+
+	if changed["country"] {
+		if err := setRegDomain(ctx, wpa.Runner, cfg.Country); err != nil {
+			return reload, err
+		}
+		if err := wpa.stationCmd(ctx, "SET", "country", cfg.Country); err != nil {
+			return reload, err
+		}
+	}
+
+	for _, field := range apCfgFields {
+		if !changed[field] {
+			continue
+		}
+
+		if _, err := WriteHostapdConf(cfg.APInterface, cfg.HostApdCfg, cfg.MacACL()); err != nil {
+			return reload, err
+		}
+		if err := reloadHostapd(cfg.HostApdCfg.pidFile()); err != nil {
+			return reload, err
+		}
+		wpa.Log.Info("ap reconfigured", "iface", cfg.APInterface, "ssid", cfg.HostApdCfg.Ssid, "channel", cfg.HostApdCfg.Channel)
+		break
+	}
+
+	// replaced, not changed in place, under the readers of the old one
+	wpa.SetCfg(cfg)
+
+	wpa.Log.Info("config reloaded", "cfg", w.Location, "fields", strings.Join(reload.Changed, ","))
+	wpa.publish(Event{
+		Type:    EventCfgReloaded,
+		Source:  "config",
+		Message: strings.Join(reload.Changed, ","),
+	})
+
+	if w.OnReload != nil {
+		w.OnReload(cfg, reload)
+	}
+
+	return reload, nil
+}
+
+// lastModTime returns the modification time of the last config loaded.
+func (w *CfgWatcher) lastModTime() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.modTime
+}
+
+// splitChanges returns the json names of the fields that differ between
+// old and cfg, split into those a reload applies and those that need a
+// restart. The restart fields are reset in cfg to their old values, so
+// cfg describes what is running.
+func splitChanges(old *SetupCfg, cfg *SetupCfg) ([]string, []string) {
+	live, restart := []string{}, []string{}
+
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := strings.Split(oldValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+
+		if liveCfgFields[name] {
+			live = append(live, name)
+			continue
+		}
+
+		restart = append(restart, name)
+		newValue.Field(i).Set(oldValue.Field(i))
+	}
+
+	// the AP address is on the interface and in the dhcp range
+	if cfg.HostApdCfg.Ip != old.HostApdCfg.Ip {
+		restart = append(restart, "host_apd_cfg.ip")
+		cfg.HostApdCfg.Ip = old.HostApdCfg.Ip
+
+		if reflect.DeepEqual(cfg.HostApdCfg, old.HostApdCfg) {
+			live = removeField(live, "host_apd_cfg")
+		}
+	}
+
+	return live, restart
+}
+
+// removeField returns fields without field.
+func removeField(fields []string, field string) []string {
+	kept := []string{}
+	for _, f := range fields {
+		if f != field {
+			kept = append(kept, f)
+		}
+	}
+
+	return kept
+}
+
+// cfgModTime returns the modification time of the config file at
+// location, or an error if it is not a local file.
+func cfgModTime(location string) (time.Time, error) {
+	path := strings.TrimPrefix(location, "file://")
+	if strings.Contains(path, "://") {
+		return time.Time{}, os.ErrNotExist
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
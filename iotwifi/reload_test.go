@@ -0,0 +1,118 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestReloadReplacesCfg reloads while the config is read and changed
+// through the API, for the race detector, and checks a reload replaces
+// the config instead of changing the one readers hold.
+func TestReloadReplacesCfg(t *testing.T) {
+	wpa, runner, cleanup := newTestWpa(t)
+	defer cleanup()
+	runner.Outputs["hostapd_cli"] = "OK\n"
+	_, stop := hupSelf(t, wpa)
+	defer stop()
+
+	location, writeCfg := testCfgFile(t, wpa)
+	held := wpa.Cfg()
+	watcher := NewCfgWatcher(wpa, location)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			cfg := wpa.Cfg()
+			_ = cfg.HostApdCfg.Ssid + cfg.Country
+			_ = cfg.MacACL()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			mac := "02:00:00:00:00:" + strconv.Itoa(10+i%80)
+			if err := wpa.BlockClient(context.Background(), mac); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := wpa.UnblockClient(context.Background(), mac); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		changed := *held
+		changed.HostApdCfg.Ssid = "iot-wifi-" + strconv.Itoa(i)
+		writeCfg(&changed)
+
+		if _, err := watcher.Reload(ctx); err != nil {
+			t.Fatalf("Reload: %s", err)
+		}
+		if ssid := wpa.Cfg().HostApdCfg.Ssid; ssid != changed.HostApdCfg.Ssid {
+			t.Fatalf("ssid %q after the reload, want %q", ssid, changed.HostApdCfg.Ssid)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	if held.HostApdCfg.Ssid != "iot-wifi-test" {
+		t.Errorf("the config held before the reloads changed to ssid %q", held.HostApdCfg.Ssid)
+	}
+}
+
+// TestReloadRateLimit reloads new rate limits into the limiter the way
+// the server does, and checks a lockout outlives the reload.
+func TestReloadRateLimit(t *testing.T) {
+	wpa, _, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	location, writeCfg := testCfgFile(t, wpa)
+	limiter := NewRateLimiter(wpa.Cfg().RateLimit)
+	watcher := NewCfgWatcher(wpa, location)
+	watcher.OnReload = func(cfg *SetupCfg, reload CfgReload) {
+		limiter.Configure(cfg.RateLimit)
+	}
+
+	for i := 0; i < DefaultMaxAuthFailures; i++ {
+		limiter.AuthFailed("locked")
+	}
+	if limiter.Exempt("192.168.27.100") {
+		t.Fatal("client exempt before the reload")
+	}
+
+	changed := *wpa.Cfg()
+	changed.RateLimit = RateLimitCfg{ConnectPerMin: 1, Exempt: []string{"192.168.27.100"}}
+	writeCfg(&changed)
+
+	reload, err := watcher.Reload(context.Background())
+	if err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if !reflect.DeepEqual(reload.Changed, []string{"rate_limit"}) || len(reload.Restart) != 0 {
+		t.Fatalf("reload %+v, want rate_limit applied", reload)
+	}
+
+	if !limiter.Exempt("192.168.27.100") {
+		t.Error("exempt client of the reloaded config is limited")
+	}
+	if _, err := limiter.Allow("client", true); err != nil {
+		t.Fatalf("first connect: %s", err)
+	}
+	if _, err := limiter.Allow("client", true); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("second connect within a minute got %v, want ErrRateLimited", err)
+	}
+	if _, err := limiter.Allow("locked", false); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("client locked out before the reload got %v, want ErrLockedOut", err)
+	}
+}
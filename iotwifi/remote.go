@@ -0,0 +1,383 @@
+package iotwifi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/mqtt"
+)
+
+// DefaultRemoteStatusInterval is how often Remote publishes the status.
+const DefaultRemoteStatusInterval = 60 * time.Second
+
+// remoteRetryMax caps the wait between attempts to reach the broker.
+const remoteRetryMax = 5 * time.Minute
+
+// remoteQueue bounds the commands waiting while one runs.
+const remoteQueue = 8
+
+// Remote commands next to those understood by Dispatch.
+const (
+	CmdAPUp   = "ap-up"
+	CmdAPDown = "ap-down"
+)
+
+// Remote topics, under the topic prefix.
+const (
+	TopicOnline   = "online"   // retained, online or offline
+	TopicStatus   = "status"   // retained, the station status
+	TopicAP       = "ap"       // retained, the AP status
+	TopicScan     = "scan"     // retained, the latest scan results
+	TopicEvents   = "events"   // each wifi event
+	TopicCommand  = "command"  // subscribed, remote commands
+	TopicResponse = "response" // the responses to the commands
+)
+
+// remoteSchemes are the broker URL schemes mqtt.Dial understands.
+var remoteSchemes = map[string]bool{"tcp": true, "mqtt": true, "tls": true, "ssl": true, "mqtts": true}
+
+// remoteAuditActions are the remote commands recorded in the audit log,
+// named as the HTTP routes doing the same are.
+var remoteAuditActions = map[string]string{
+	CmdConnect: "connect",
+	CmdForget:  "forget",
+	CmdAPUp:    "ap/up",
+	CmdAPDown:  "ap/down",
+}
+
+// RemoteCfg configures remote management over MQTT and is used by
+// SetupCfg.
+type RemoteCfg struct {
+	Broker            string `json:"broker"` // tcp://broker:1883 or tls://broker:8883, remote management is off without one
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	ClientId          string `json:"client_id"`           // txwifi-<device_id> by default
+	TopicPrefix       string `json:"topic_prefix"`        // txwifi/<device_id> by default
+	CACert            string `json:"ca_cert"`             // PEM file to verify a tls:// broker with, the system roots by default
+	StatusIntervalSec int    `json:"status_interval_sec"` // how often to publish the status, 60 by default
+	ReadOnly          bool   `json:"read_only"`           // publish only, ignore commands
+}
+
+// statusInterval returns how often to publish the status.
+func (c RemoteCfg) statusInterval() time.Duration {
+	if c.StatusIntervalSec > 0 {
+		return time.Duration(c.StatusIntervalSec) * time.Second
+	}
+
+	return DefaultRemoteStatusInterval
+}
+
+// RemoteCommand is a command published on the command topic, a
+// ProvisionRequest or ap-up and ap-down, with an id echoed in the
+// response.
+type RemoteCommand struct {
+	Id string `json:"id,omitempty"`
+	ProvisionRequest
+}
+
+// RemoteResponse is published on the response topic for each command.
+type RemoteResponse struct {
+	Id string `json:"id,omitempty"`
+	ProvisionResponse
+}
+
+// Remote manages the device through an MQTT broker, for fleets behind NAT
+// that the HTTP API cannot reach: it publishes the status, the AP status,
+// scan results and events under the topic prefix, and runs the commands
+// published on its command topic. It reconnects with backoff when the
+// broker goes away.
+type Remote struct {
+	Wpa         *WpaCfg
+	Provisioner Provisioner  // runs the provisioning commands, Wpa by default
+	Scans       *ScanManager // optional, its results are published
+	Bus         *EventBus    // optional, its events are published
+	Audit       *AuditLog    // optional, records the commands that change something
+
+	mu  sync.Mutex
+	cfg RemoteCfg
+}
+
+// NewRemote produces a Remote, off until configured with a broker.
+func NewRemote(wpa *WpaCfg, scans *ScanManager) *Remote {
+	return &Remote{
+		Wpa:         wpa,
+		Provisioner: wpa,
+		Scans:       scans,
+	}
+}
+
+// Configure applies cfg, taking effect on the next connection.
+func (m *Remote) Configure(cfg RemoteCfg) {
+	secrets.add(cfg.Password)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cfg = cfg
+}
+
+// config returns the settings of the next connection.
+func (m *Remote) config() RemoteCfg {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cfg
+}
+
+// Run stays connected to the broker until ctx is done, then marks the
+// device offline. It returns at once without a broker.
+func (m *Remote) Run(ctx context.Context) {
+	if m.config().Broker == "" {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		cfg := m.config()
+		if cfg.Broker == "" {
+			return
+		}
+
+		start := time.Now()
+		err := m.session(ctx, cfg)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a session that lasted starts the backoff over
+		if time.Since(start) > remoteRetryMax {
+			backoff = time.Second
+		}
+		m.Wpa.Log.Warn("mqtt broker connection lost", "broker", cfg.Broker, "error", err, "retry", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > remoteRetryMax {
+			backoff = remoteRetryMax
+		}
+	}
+}
+
+// session connects to the broker and publishes and takes commands until
+// ctx is done or the connection is lost.
+func (m *Remote) session(ctx context.Context, cfg RemoteCfg) error {
+	prefix, clientId, err := m.names(cfg)
+	if err != nil {
+		return err
+	}
+
+	opts := mqtt.Options{
+		ClientId: clientId,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Will:     &mqtt.Message{Topic: prefix + "/" + TopicOnline, Payload: []byte("offline"), QoS: 1, Retain: true},
+	}
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates", cfg.CACert)
+		}
+		opts.TLS = &tls.Config{RootCAs: roots}
+	}
+
+	client, err := mqtt.Dial(ctx, cfg.Broker, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	m.Wpa.Log.Info("connected to mqtt broker", "broker", cfg.Broker, "prefix", prefix)
+
+	publish := func(topic string, payload interface{}, retain bool) {
+		if err := m.publish(ctx, client, prefix+"/"+topic, payload, retain); err != nil {
+			m.Wpa.Log.Debug("mqtt publish failed", "topic", topic, "error", err)
+		}
+	}
+
+	publish(TopicOnline, "online", true)
+
+	commands := make(chan RemoteCommand, remoteQueue)
+	defer close(commands)
+	if !cfg.ReadOnly {
+		if err := client.Subscribe(ctx, prefix+"/"+TopicCommand, 1); err != nil {
+			return err
+		}
+		go func() {
+			for cmd := range commands {
+				publish(TopicResponse, m.run(ctx, cfg, cmd), false)
+				if cmd.Command == CmdScan && m.Scans != nil {
+					publish(TopicScan, m.Scans.Cached(), true)
+				}
+			}
+		}()
+	}
+
+	var events <-chan Event
+	if m.Bus != nil {
+		ch, unsubscribe := m.Bus.Subscribe()
+		defer unsubscribe()
+		events = ch
+	}
+
+	var scanned time.Time
+	publishState := func() {
+		if status, err := m.Provisioner.Status(ctx); err == nil {
+			publish(TopicStatus, status, true)
+		}
+		if status, err := m.Wpa.APStatus(ctx); err == nil {
+			publish(TopicAP, status, true)
+		}
+		if m.Scans != nil {
+			if results := m.Scans.Cached(); results.Time.After(scanned) {
+				scanned = results.Time
+				publish(TopicScan, results, true)
+			}
+		}
+	}
+	publishState()
+
+	ticker := time.NewTicker(cfg.statusInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is done, the last word gets a moment of its own
+			offline, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			m.publish(offline, client, prefix+"/"+TopicOnline, "offline", true)
+			cancel()
+			return ctx.Err()
+
+		case <-client.Done():
+			return client.Err()
+
+		case <-ticker.C:
+			publishState()
+
+		case ev := <-events:
+			publish(TopicEvents, ev, false)
+			if ev.Type == EventConnected || ev.Type == EventDisconnected || ev.Type == EventScanComplete {
+				publishState()
+			}
+
+		case msg, ok := <-client.Messages():
+			if !ok {
+				return client.Err()
+			}
+
+			var cmd RemoteCommand
+			if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+				publish(TopicResponse, RemoteResponse{ProvisionResponse: ProvisionResponse{Status: "FAIL", Message: err.Error()}}, false)
+				continue
+			}
+
+			select {
+			case commands <- cmd:
+			default:
+				publish(TopicResponse, RemoteResponse{Id: cmd.Id, ProvisionResponse: ProvisionResponse{Status: "FAIL", Message: "too many commands waiting"}}, false)
+			}
+		}
+	}
+}
+
+// names returns the topic prefix and client id of cfg, defaulting both
+// to the device id.
+func (m *Remote) names(cfg RemoteCfg) (string, string, error) {
+	prefix, clientId := strings.TrimSuffix(cfg.TopicPrefix, "/"), cfg.ClientId
+	if prefix != "" && clientId != "" {
+		return prefix, clientId, nil
+	}
+
+	identity, err := m.Wpa.Identity()
+	if err != nil {
+		return "", "", err
+	}
+	if prefix == "" {
+		prefix = "txwifi/" + identity.DeviceId
+	}
+	if clientId == "" {
+		clientId = "txwifi-" + identity.DeviceId
+	}
+
+	return prefix, clientId, nil
+}
+
+// publish publishes payload as JSON at QoS 1.
+func (m *Remote) publish(ctx context.Context, client *mqtt.Client, topic string, payload interface{}, retain bool) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	return client.Publish(ctx, mqtt.Message{Topic: topic, Payload: data, QoS: 1, Retain: retain})
+}
+
+// run runs cmd and records it in the audit log if it changes something.
+func (m *Remote) run(ctx context.Context, cfg RemoteCfg, cmd RemoteCommand) RemoteResponse {
+	start := time.Now()
+
+	var resp ProvisionResponse
+	switch cmd.Command {
+	case CmdAPUp, CmdAPDown:
+		toggle := m.Wpa.EnableAP
+		if cmd.Command == CmdAPDown {
+			toggle = m.Wpa.DisableAP
+		}
+		resp = ProvisionResponse{Status: "OK", Message: cmd.Command}
+		if err := toggle(ctx); err != nil {
+			resp = ProvisionResponse{Status: "FAIL", Message: err.Error()}
+		}
+	case CmdScan:
+		if m.Scans == nil {
+			resp = Dispatch(ctx, m.Provisioner, cmd.ProvisionRequest)
+			break
+		}
+		// through the cache, so the scan topic gets the results too
+		resp = ProvisionResponse{Status: "OK", Message: cmd.Command}
+		results, err := m.Scans.Scan(ctx)
+		if err != nil {
+			resp = ProvisionResponse{Status: "FAIL", Message: err.Error()}
+		}
+		resp.Payload = results.Networks
+	default:
+		resp = Dispatch(ctx, m.Provisioner, cmd.ProvisionRequest)
+	}
+
+	if resp.Status != "OK" {
+		m.Wpa.Log.Error("remote command failed", "command", cmd.Command, "error", errors.New(resp.Message))
+	}
+
+	if action, ok := remoteAuditActions[cmd.Command]; ok && m.Audit != nil {
+		m.Audit.Record(AuditEntry{
+			Transport: TransportMQTT,
+			Client:    cfg.Broker,
+			Action:    action,
+			Ssid:      cmd.Credentials.Ssid,
+			Success:   resp.Status == "OK",
+			Message:   resp.Message,
+			Duration:  time.Since(start),
+		})
+	}
+
+	return RemoteResponse{Id: cmd.Id, ProvisionResponse: resp}
+}
@@ -0,0 +1,127 @@
+package iotwifi
+
+import (
+	"fmt"
+	"time"
+)
+
+// Connect retry defaults: one attempt of 15s, then 2s, 4s, 8s... between
+// attempts when more are configured, 30s at most.
+const (
+	DefaultConnectAttempts   = 1
+	DefaultAttemptTimeout    = 15 * time.Second
+	DefaultConnectBackoff    = 2 * time.Second
+	DefaultBackoffFactor     = 2.0
+	DefaultMaxConnectBackoff = 30 * time.Second
+	maxConnectAttempts       = 10
+)
+
+// ConnectRetryCfg is how ConnectNetwork retries a connect that timed out,
+// did not find the network or lost wpa_supplicant. A wrong password or a
+// failed authentication is never retried. It is used by SetupCfg and can
+// be overridden per request, field by field, in WpaCredentials.Retry.
+type ConnectRetryCfg struct {
+	MaxAttempts       int     `json:"max_attempts"`        // 1 by default, no retry; 10 at most
+	AttemptTimeoutSec int     `json:"attempt_timeout_sec"` // for wpa_supplicant to report the connection, 15 by default
+	BackoffSec        float64 `json:"backoff_sec"`         // wait before the second attempt, 2 by default
+	BackoffFactor     float64 `json:"backoff_factor"`      // the wait is multiplied by this after each attempt, 2 by default, 1 for a constant wait
+	MaxBackoffSec     float64 `json:"max_backoff_sec"`     // the longest wait, 30 by default
+}
+
+// Validate checks the policy.
+func (c ConnectRetryCfg) Validate() error {
+	switch {
+	case c.MaxAttempts < 0 || c.MaxAttempts > maxConnectAttempts:
+		return fmt.Errorf("max_attempts must be between 1 and %d", maxConnectAttempts)
+	case c.AttemptTimeoutSec < 0:
+		return fmt.Errorf("attempt_timeout_sec must not be negative")
+	case c.BackoffSec < 0 || c.MaxBackoffSec < 0:
+		return fmt.Errorf("backoff_sec and max_backoff_sec must not be negative")
+	case c.BackoffFactor != 0 && c.BackoffFactor < 1:
+		return fmt.Errorf("backoff_factor must be at least 1")
+	}
+
+	return nil
+}
+
+// override returns c with the fields set in o.
+func (c ConnectRetryCfg) override(o *ConnectRetryCfg) ConnectRetryCfg {
+	if o == nil {
+		return c
+	}
+	if o.MaxAttempts != 0 {
+		c.MaxAttempts = o.MaxAttempts
+	}
+	if o.AttemptTimeoutSec != 0 {
+		c.AttemptTimeoutSec = o.AttemptTimeoutSec
+	}
+	if o.BackoffSec != 0 {
+		c.BackoffSec = o.BackoffSec
+	}
+	if o.BackoffFactor != 0 {
+		c.BackoffFactor = o.BackoffFactor
+	}
+	if o.MaxBackoffSec != 0 {
+		c.MaxBackoffSec = o.MaxBackoffSec
+	}
+
+	return c
+}
+
+// attempts returns the number of attempts.
+func (c ConnectRetryCfg) attempts() int {
+	if c.MaxAttempts == 0 {
+		return DefaultConnectAttempts
+	}
+
+	return c.MaxAttempts
+}
+
+// attemptTimeout returns how long an attempt waits for the connection.
+func (c ConnectRetryCfg) attemptTimeout() time.Duration {
+	if c.AttemptTimeoutSec == 0 {
+		return DefaultAttemptTimeout
+	}
+
+	return time.Duration(c.AttemptTimeoutSec) * time.Second
+}
+
+// backoff returns the wait after attempt, counted from 1.
+func (c ConnectRetryCfg) backoff(attempt int) time.Duration {
+	wait, factor, max := DefaultConnectBackoff, DefaultBackoffFactor, DefaultMaxConnectBackoff
+	if c.BackoffSec != 0 {
+		wait = time.Duration(c.BackoffSec * float64(time.Second))
+	}
+	if c.BackoffFactor != 0 {
+		factor = c.BackoffFactor
+	}
+	if c.MaxBackoffSec != 0 {
+		max = time.Duration(c.MaxBackoffSec * float64(time.Second))
+	}
+
+	for i := 1; i < attempt && wait < max; i++ {
+		wait = time.Duration(float64(wait) * factor)
+	}
+	if wait > max {
+		wait = max
+	}
+
+	return wait
+}
+
+// retryable reports whether a connect that failed for reason is worth
+// another attempt: a wrong password stays wrong.
+func retryable(reason ConnectReason) bool {
+	return reason == ReasonTimeout || reason == ReasonNetworkNotFound || reason == ReasonLostControl
+}
+
+// ConnectAttempt is the outcome of one attempt of a connect.
+type ConnectAttempt struct {
+	Attempt  int           `json:"attempt"` // from 1
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	State    string        `json:"state"`
+	Reason   ConnectReason `json:"reason"`
+	Error    string        `json:"error,omitempty"`
+	Backoff  time.Duration `json:"backoff,omitempty"` // waited before the next attempt
+}
@@ -0,0 +1,87 @@
+package iotwifi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ConnectRetryCfg
+		waits  []time.Duration // after each attempt, from 1
+	}{
+		{
+			name:   "defaults",
+			policy: ConnectRetryCfg{},
+			waits:  []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second},
+		},
+		{
+			name:   "constant",
+			policy: ConnectRetryCfg{BackoffSec: 3, BackoffFactor: 1},
+			waits:  []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:   "capped",
+			policy: ConnectRetryCfg{BackoffSec: 0.5, BackoffFactor: 3, MaxBackoffSec: 10},
+			waits:  []time.Duration{500 * time.Millisecond, 1500 * time.Millisecond, 4500 * time.Millisecond, 10 * time.Second},
+		},
+		{
+			name:   "first over the cap",
+			policy: ConnectRetryCfg{BackoffSec: 60, MaxBackoffSec: 5},
+			waits:  []time.Duration{5 * time.Second, 5 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.waits {
+				if wait := tt.policy.backoff(i + 1); wait != want {
+					t.Errorf("backoff after attempt %d %s, want %s", i+1, wait, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectRetryOverride(t *testing.T) {
+	policy := ConnectRetryCfg{MaxAttempts: 3, AttemptTimeoutSec: 20, BackoffSec: 1}
+
+	if got := policy.override(nil); got != policy {
+		t.Errorf("no override %+v, want %+v", got, policy)
+	}
+
+	got := policy.override(&ConnectRetryCfg{MaxAttempts: 5, BackoffFactor: 1.5})
+	want := ConnectRetryCfg{MaxAttempts: 5, AttemptTimeoutSec: 20, BackoffSec: 1, BackoffFactor: 1.5}
+	if got != want {
+		t.Errorf("override %+v, want %+v", got, want)
+	}
+
+	if attempts, timeout := (ConnectRetryCfg{}).attempts(), (ConnectRetryCfg{}).attemptTimeout(); attempts != DefaultConnectAttempts || timeout != DefaultAttemptTimeout {
+		t.Errorf("default %d attempts of %s", attempts, timeout)
+	}
+}
+
+func TestConnectRetryValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ConnectRetryCfg
+		valid  bool
+	}{
+		{"defaults", ConnectRetryCfg{}, true},
+		{"most attempts", ConnectRetryCfg{MaxAttempts: maxConnectAttempts}, true},
+		{"no wait", ConnectRetryCfg{MaxAttempts: 2, BackoffFactor: 1}, true},
+		{"too many attempts", ConnectRetryCfg{MaxAttempts: maxConnectAttempts + 1}, false},
+		{"negative attempts", ConnectRetryCfg{MaxAttempts: -1}, false},
+		{"negative timeout", ConnectRetryCfg{AttemptTimeoutSec: -1}, false},
+		{"negative backoff", ConnectRetryCfg{BackoffSec: -1}, false},
+		{"negative max backoff", ConnectRetryCfg{MaxBackoffSec: -1}, false},
+		{"shrinking backoff", ConnectRetryCfg{BackoffFactor: 0.5}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: %+v valid %v, want %v", tt.name, tt.policy, err == nil, tt.valid)
+		}
+	}
+}
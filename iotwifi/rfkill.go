@@ -0,0 +1,146 @@
+package iotwifi
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kinokochat/txwifi/iotwifi/rfkill"
+)
+
+// RfkillCfg configures the rfkill blocks of the wifi radios and is used
+// by SetupCfg.
+type RfkillCfg struct {
+	Unblock bool `json:"unblock"` // soft unblock the radios at startup
+}
+
+// RadioBlock is the rfkill state of the radio of a wifi interface.
+type RadioBlock struct {
+	Iface    string          `json:"iface"`
+	Blocked  bool            `json:"blocked"`
+	Soft     bool            `json:"soft_blocked"`
+	Hard     bool            `json:"hard_blocked"`
+	Switches []rfkill.Switch `json:"switches"`
+}
+
+// radioBlock reads the rfkill state of the radio of iface.
+func radioBlock(iface string) (RadioBlock, error) {
+	block := RadioBlock{Iface: iface, Switches: []rfkill.Switch{}}
+
+	switches, err := rfkill.ForInterface(iface)
+	if err != nil {
+		return block, err
+	}
+
+	block.Switches = switches
+	for _, s := range switches {
+		block.Soft = block.Soft || s.Soft
+		block.Hard = block.Hard || s.Hard
+	}
+	block.Blocked = block.Soft || block.Hard
+
+	return block, nil
+}
+
+// wifiInterfaces returns the station interfaces and a dedicated AP
+// interface, whose radios txwifi needs.
+func (wpa *WpaCfg) wifiInterfaces() []string {
+	ifaces := wpa.stationInterfaces()
+	if wpa.Cfg().APDedicated {
+		ifaces = append(ifaces, wpa.Cfg().APInterface)
+	}
+
+	return ifaces
+}
+
+// Rfkill returns the rfkill state of the radios of the wifi interfaces.
+func (wpa *WpaCfg) Rfkill() ([]RadioBlock, error) {
+	blocks := []RadioBlock{}
+	for _, iface := range wpa.wifiInterfaces() {
+		block, err := radioBlock(iface)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// SetRfkill soft blocks, or unblocks, the radio of iface, or of every
+// wifi interface when iface is empty, and returns the new state.
+func (wpa *WpaCfg) SetRfkill(iface string, block bool) ([]RadioBlock, error) {
+	ifaces := wpa.wifiInterfaces()
+	if iface != "" {
+		if !contains(ifaces, iface) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownInterface, iface)
+		}
+		ifaces = []string{iface}
+	}
+
+	done := map[int]bool{}
+	for _, name := range ifaces {
+		switches, err := rfkill.ForInterface(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range switches {
+			if done[s.Index] || s.Soft == block {
+				continue
+			}
+			done[s.Index] = true
+
+			if err := rfkill.SetSoft(s.Index, block); err != nil {
+				if errors.Is(err, rfkill.ErrHardBlocked) {
+					return nil, fmt.Errorf("%w: %s", ErrRadioBlocked, err)
+				}
+				return nil, err
+			}
+			wpa.Log.Info("rfkill changed", "iface", name, "switch", s.Name, "soft_blocked", block)
+		}
+	}
+
+	return wpa.Rfkill()
+}
+
+// radioBlocked returns ErrRadioBlocked when the radio of iface is
+// blocked.
+func radioBlocked(iface string) error {
+	block, err := radioBlock(iface)
+	if err != nil || !block.Blocked {
+		return nil
+	}
+
+	kind := "soft"
+	if block.Hard {
+		kind = "hard"
+	}
+
+	return fmt.Errorf("%w: %s is %s blocked", ErrRadioBlocked, iface, kind)
+}
+
+// UnblockRadios soft unblocks the blocked radios of the wifi interfaces
+// if the config says so, or warns about them.
+func (wpa *WpaCfg) UnblockRadios() {
+	blocks, err := wpa.Rfkill()
+	if err != nil {
+		wpa.Log.Warn("could not read rfkill", "error", err)
+		return
+	}
+
+	for _, block := range blocks {
+		if !block.Blocked {
+			continue
+		}
+
+		if !wpa.Cfg().Rfkill.Unblock || block.Hard {
+			wpa.Log.Warn("radio blocked", "iface", block.Iface, "soft_blocked", block.Soft, "hard_blocked", block.Hard,
+				"hint", "set rfkill.unblock, or run rfkill unblock wifi, and flip the wifi switch if it is hard blocked")
+			continue
+		}
+
+		if _, err := wpa.SetRfkill(block.Iface, false); err != nil {
+			wpa.Log.Error("could not unblock radio", "iface", block.Iface, "error", err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package rfkill reads and changes the blocks of radios: the soft block
+// set from software, often left on by fresh Raspberry Pi images until a
+// country is set, and the hard block of a switch, read only.
+
+package rfkill
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Device is where blocks are changed.
+const Device = "/dev/rfkill"
+
+// SysDir lists the rfkill switches.
+const SysDir = "/sys/class/rfkill"
+
+// TypeWLAN is the type of wifi switches.
+const TypeWLAN = "wlan"
+
+// Event types and operations of /dev/rfkill, linux/rfkill.h.
+const (
+	eventTypeAll = 0
+	opChange     = 2
+)
+
+// ErrHardBlocked is returned when unblocking a radio blocked by a switch.
+var ErrHardBlocked = errors.New("hard blocked")
+
+// Switch is an rfkill switch, one per radio or platform switch.
+type Switch struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"` // phy0
+	Type  string `json:"type"` // wlan, bluetooth, ...
+	Soft  bool   `json:"soft_blocked"`
+	Hard  bool   `json:"hard_blocked"`
+}
+
+// Blocked reports whether the radio of s is off.
+func (s Switch) Blocked() bool {
+	return s.Soft || s.Hard
+}
+
+// List returns the switches, by index. A system without rfkill has none.
+func List() ([]Switch, error) {
+	switches := []Switch{}
+
+	dirs, err := filepath.Glob(filepath.Join(SysDir, "rfkill[0-9]*"))
+	if err != nil {
+		return switches, err
+	}
+
+	for _, dir := range dirs {
+		s, err := read(dir)
+		if err != nil {
+			return switches, err
+		}
+		switches = append(switches, s)
+	}
+
+	sort.Slice(switches, func(i, j int) bool { return switches[i].Index < switches[j].Index })
+
+	return switches, nil
+}
+
+// read reads the switch in dir.
+func read(dir string) (Switch, error) {
+	s := Switch{}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "rfkill"))
+	if err != nil {
+		return s, fmt.Errorf("invalid rfkill switch %s", dir)
+	}
+	s.Index = index
+
+	values := map[string]string{}
+	for _, name := range []string{"name", "type", "soft", "hard"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return s, err
+		}
+		values[name] = strings.TrimSpace(string(data))
+	}
+
+	s.Name = values["name"]
+	s.Type = values["type"]
+	s.Soft = values["soft"] == "1"
+	s.Hard = values["hard"] == "1"
+
+	return s, nil
+}
+
+// ForInterface returns the wifi switches of the network interface iface:
+// the switch of its phy, or every wifi switch when the phy has none of
+// its own, as with platform switches.
+func ForInterface(iface string) ([]Switch, error) {
+	switches, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	wlan := []Switch{}
+	for _, s := range switches {
+		if s.Type == TypeWLAN {
+			wlan = append(wlan, s)
+		}
+	}
+
+	phy, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "phy80211", "name"))
+	if err != nil {
+		return wlan, nil
+	}
+
+	for _, s := range wlan {
+		if s.Name == strings.TrimSpace(string(phy)) {
+			return []Switch{s}, nil
+		}
+	}
+
+	return wlan, nil
+}
+
+// SetSoft soft blocks, or unblocks, the radio of the switch index.
+// Unblocking a hard blocked radio fails with ErrHardBlocked.
+func SetSoft(index int, block bool) error {
+	s, err := read(filepath.Join(SysDir, "rfkill"+strconv.Itoa(index)))
+	if err != nil {
+		return err
+	}
+	if !block && s.Hard {
+		return fmt.Errorf("%w: %s is switched off", ErrHardBlocked, s.Name)
+	}
+
+	soft := byte(0)
+	if block {
+		soft = 1
+	}
+
+	// struct rfkill_event: idx, type, op, soft, hard, in the byte order
+	// of the arm and x86 boards txwifi runs on
+	event := make([]byte, 8)
+	binary.LittleEndian.PutUint32(event, uint32(index))
+	event[4] = eventTypeAll
+	event[5] = opChange
+	event[6] = soft
+
+	f, err := os.OpenFile(Device, os.O_WRONLY, 0)
+	if err != nil {
+		// the switch files are writable too, without the device
+		return ioutil.WriteFile(filepath.Join(SysDir, "rfkill"+strconv.Itoa(index), "soft"), []byte{'0' + soft}, 0644)
+	}
+	defer f.Close()
+
+	_, err = f.Write(event)
+	return err
+}
@@ -0,0 +1,154 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BssidAny unpins a network so it may use any AP with its ssid.
+const BssidAny = "any"
+
+// RoamingCfg controls which AP a configured network uses and when it
+// looks for a better one. Empty fields are left unchanged.
+type RoamingCfg struct {
+	Ssid  string `json:"ssid"`  // configured network to change, the current one if empty
+	Bssid string `json:"bssid"` // pin to this AP, "any" to unpin
+
+	// bgscan="simple:<short_interval>:<signal_threshold>:<long_interval>".
+	// Below the signal threshold the background scan runs every short
+	// interval and wpa_supplicant roams to a stronger AP when it finds one.
+	BgscanShortInterval   int  `json:"bgscan_short_interval"`   // seconds, 30
+	BgscanSignalThreshold int  `json:"bgscan_signal_threshold"` // dBm, -65
+	BgscanLongInterval    int  `json:"bgscan_long_interval"`    // seconds, 300
+	DisableBgscan         bool `json:"disable_bgscan"`          // never scan in the background
+}
+
+// Validate checks the BSSID and bgscan settings.
+func (cfg RoamingCfg) Validate() error {
+	if cfg.Bssid != "" && cfg.Bssid != BssidAny && !macR.MatchString(cfg.Bssid) {
+		return fmt.Errorf("%w: invalid bssid %q", ErrInvalid, cfg.Bssid)
+	}
+
+	if !cfg.hasBgscan() {
+		return nil
+	}
+
+	if cfg.BgscanShortInterval <= 0 || cfg.BgscanLongInterval <= 0 {
+		return fmt.Errorf("%w: bgscan intervals must be positive", ErrInvalid)
+	}
+	if cfg.BgscanShortInterval > cfg.BgscanLongInterval {
+		return fmt.Errorf("%w: bgscan short interval is longer than the long interval", ErrInvalid)
+	}
+	if cfg.BgscanSignalThreshold >= 0 || cfg.BgscanSignalThreshold < -100 {
+		return fmt.Errorf("%w: bgscan signal threshold %d is not a dBm value", ErrInvalid, cfg.BgscanSignalThreshold)
+	}
+
+	return nil
+}
+
+// hasBgscan reports whether any bgscan field is set.
+func (cfg RoamingCfg) hasBgscan() bool {
+	return cfg.BgscanShortInterval != 0 || cfg.BgscanSignalThreshold != 0 || cfg.BgscanLongInterval != 0
+}
+
+// bgscan returns the quoted bgscan network value, or "" to leave it.
+func (cfg RoamingCfg) bgscan() string {
+	switch {
+	case cfg.DisableBgscan:
+		return "\"\""
+	case cfg.hasBgscan():
+		return fmt.Sprintf("\"simple:%d:%d:%d\"", cfg.BgscanShortInterval, cfg.BgscanSignalThreshold, cfg.BgscanLongInterval)
+	}
+
+	return ""
+}
+
+// SetRoaming applies cfg to every configured network with its ssid,
+// saves the config and reassociates so a new BSSID pin takes effect.
+func (wpa *WpaCfg) SetRoaming(ctx context.Context, cfg RoamingCfg) error {
+	cfg.Bssid = strings.ToLower(cfg.Bssid)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ctx, done, err := wpa.ops.acquire(ctx, OpRoaming, cfg.Ssid)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if cfg.Ssid == "" {
+		status, err := wpa.wpaStatus(ctx)
+		if err != nil {
+			return err
+		}
+		cfg.Ssid = status["ssid"]
+		if cfg.Ssid == "" {
+			return fmt.Errorf("%w: not connected and no ssid given", ErrNotConfigured)
+		}
+	}
+
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	for _, network := range networks {
+		if network.Ssid == cfg.Ssid {
+			ids = append(ids, network.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotConfigured, cfg.Ssid)
+	}
+
+	bgscan := cfg.bgscan()
+	for _, id := range ids {
+		if cfg.Bssid != "" {
+			if err := wpa.setNetwork(ctx, id, "bssid", cfg.Bssid); err != nil {
+				return err
+			}
+		}
+
+		if bgscan != "" {
+			if err := wpa.setNetwork(ctx, id, "bgscan", bgscan); err != nil {
+				return err
+			}
+		}
+
+		wpa.Log.Info("roaming set", "iface", wpa.Cfg().StationInterface, "ssid", cfg.Ssid, "net_id", id, "bssid", cfg.Bssid, "bgscan", bgscan)
+	}
+
+	if err := wpa.SaveConfig(ctx); err != nil {
+		return err
+	}
+
+	if cfg.Bssid != "" {
+		return wpa.Reassociate(ctx)
+	}
+
+	return nil
+}
+
+// Roam moves the station to the AP bssid of its current network.
+func (wpa *WpaCfg) Roam(ctx context.Context, bssid string) error {
+	if !macR.MatchString(bssid) {
+		return fmt.Errorf("%w: invalid bssid %q", ErrInvalid, bssid)
+	}
+
+	out, err := wpa.wpaCtl(ctx, "ROAM", bssid)
+	if err != nil {
+		return fmt.Errorf("%w: roam: %s", ErrCommandFailed, err)
+	}
+
+	status := strings.TrimSpace(string(out))
+	wpa.Log.Info("station command", "iface", wpa.Cfg().StationInterface, "cmd", "ROAM", "bssid", bssid, "status", status)
+
+	if status != "OK" {
+		return fmt.Errorf("%w: roam: %s", ErrCommandFailed, status)
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// IPForwardFile switches IPv4 forwarding between interfaces.
+const IPForwardFile = "/proc/sys/net/ipv4/ip_forward"
+
+// routerGroup is the firewall group of the router rules.
+const routerGroup = "router"
+
+// RouterCfg shares the station uplink with AP clients through NAT and is
+// used by SetupCfg.
+type RouterCfg struct {
+	Enabled bool   `json:"enabled"` // route from startup, POST /router/enable otherwise
+	Uplink  string `json:"uplink"`  // station_interface by default
+}
+
+// RouterStatus is the state of routing from the AP to the uplink.
+type RouterStatus struct {
+	Enabled    bool     `json:"enabled"`    // every rule is installed
+	Forwarding bool     `json:"forwarding"` // IPv4 forwarding is on
+	Subnet     string   `json:"subnet"`     // the AP subnet, 192.168.27.0/24
+	Uplink     string   `json:"uplink"`
+	Firewall   string   `json:"firewall"` // iptables or nftables
+	Rules      []string `json:"rules"`    // the installed rules, as the firewall prints them
+}
+
+// uplink returns the interface AP traffic is routed out of.
+func (s *SetupCfg) uplink() string {
+	if s.Router.Uplink != "" {
+		return s.Router.Uplink
+	}
+
+	return s.StationInterface
+}
+
+// apSubnet returns the network the AP address is in.
+func (s *SetupCfg) apSubnet() string {
+	_, subnet, err := net.ParseCIDR(s.apAddress())
+	if err != nil {
+		return ""
+	}
+
+	return subnet.String()
+}
+
+// routerRules returns the rules that masquerade the AP subnet behind the
+// uplink and let AP traffic, and the replies to it, through.
+func (s *SetupCfg) routerRules() []FirewallRule {
+	ap, uplink := s.APInterface, s.uplink()
+
+	return []FirewallRule{
+		{Action: ActionMasquerade, Source: s.apSubnet(), Out: uplink},
+		{Action: ActionAccept, In: ap, Out: uplink},
+		{Action: ActionAccept, In: uplink, Out: ap, Established: true},
+	}
+}
+
+// EnableRouter turns on IPv4 forwarding and installs the NAT and forward
+// rules that route AP clients out of the uplink, replacing any installed
+// before.
+func (wpa *WpaCfg) EnableRouter(ctx context.Context) error {
+	firewall, err := wpa.firewall(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(IPForwardFile, []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("enabling ip forwarding: %w", err)
+	}
+
+	if err := firewall.Apply(ctx, routerGroup, wpa.Cfg().routerRules()); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("router enabled", "iface", wpa.Cfg().APInterface, "subnet", wpa.Cfg().apSubnet(), "uplink", wpa.Cfg().uplink(), "firewall", firewall.Name())
+
+	return nil
+}
+
+// DisableRouter removes the rules EnableRouter installed. Forwarding is
+// left on, other services on the host may rely on it.
+func (wpa *WpaCfg) DisableRouter(ctx context.Context) error {
+	firewall, err := wpa.firewall(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := firewall.Clear(ctx, routerGroup); err != nil {
+		return err
+	}
+
+	wpa.Log.Info("router disabled", "iface", wpa.Cfg().APInterface, "uplink", wpa.Cfg().uplink(), "firewall", firewall.Name())
+
+	return nil
+}
+
+// RouterStatus returns whether AP clients are routed out of the uplink
+// and the rules installed for it.
+func (wpa *WpaCfg) RouterStatus(ctx context.Context) (RouterStatus, error) {
+	status := RouterStatus{
+		Subnet: wpa.Cfg().apSubnet(),
+		Uplink: wpa.Cfg().uplink(),
+		Rules:  []string{},
+	}
+
+	forward, err := ioutil.ReadFile(IPForwardFile)
+	if err != nil {
+		return status, err
+	}
+	status.Forwarding = strings.TrimSpace(string(forward)) == "1"
+
+	firewall, err := wpa.firewall(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.Firewall = firewall.Name()
+
+	status.Rules, err = firewall.List(ctx, routerGroup)
+	if err != nil {
+		return status, err
+	}
+	status.Enabled = len(status.Rules) == len(wpa.Cfg().routerRules())
+
+	return status, nil
+}
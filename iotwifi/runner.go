@@ -0,0 +1,168 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// Runner executes everything WpaCfg needs from the system: external
+// commands such as hostapd_cli and iw, and requests and events on the
+// wpa_supplicant control socket. The default talks to the real system,
+// iotwifitest.Runner replays canned output so WpaCfg can be exercised
+// without root or hardware.
+type Runner interface {
+	// Output runs name with args and returns its standard output.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+
+	// Request sends cmd to the wpa_supplicant controlling iface.
+	Request(ctx context.Context, iface string, cmd string) ([]byte, error)
+
+	// Attach streams unsolicited wpa_supplicant events for iface until
+	// the returned Closer is closed.
+	Attach(iface string) (<-chan wpactl.Event, io.Closer, error)
+}
+
+// systemRunner runs real commands and keeps one control connection per
+// station interface.
+type systemRunner struct {
+	dir   string // of the control sockets
+	mu    sync.Mutex
+	conns map[string]*wpactl.Conn
+}
+
+// NewSystemRunner produces a Runner for the real system, talking to the
+// wpa_supplicant control sockets in ctrlDir.
+func NewSystemRunner(ctrlDir string) Runner {
+	return &systemRunner{dir: ctrlDir, conns: make(map[string]*wpactl.Conn)}
+}
+
+// Output runs name and includes its standard error in a failure.
+func (r *systemRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+		return out, fmt.Errorf("%s: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	}
+
+	return out, err
+}
+
+// Request dials the control socket of iface on first use. The connection
+// is dropped on any error and redialed on the next call, since
+// wpa_supplicant may restart underneath us, and a request given up on
+// may still be answered: its late reply would be read as the reply to
+// the next request.
+func (r *systemRunner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conn, ok := r.conns[iface]
+	if !ok {
+		var err error
+		conn, err = wpactl.DialInterface(r.dir, iface)
+		if err != nil {
+			return nil, err
+		}
+		r.conns[iface] = conn
+	}
+
+	out, err := conn.RequestContext(ctx, cmd)
+	if err != nil {
+		conn.Close()
+		delete(r.conns, iface)
+	}
+
+	return out, err
+}
+
+// Attach opens a second control connection attached for events.
+func (r *systemRunner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	conn, err := wpactl.DialInterface(r.dir, iface)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events, err := conn.Attach()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return events, conn, nil
+}
+
+// wpaCtl sends a command to the wpa_supplicant of the station interface.
+// A FAIL reply, or one such as FAIL-BUSY, is returned along with an error
+// wrapping wpactl.ErrFail, so it is never taken for a result, such as the
+// id of a network that was not added.
+func (wpa *WpaCfg) wpaCtl(ctx context.Context, args ...string) ([]byte, error) {
+	cmd, err := ctlCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := wpa.Runner.Request(ctx, wpa.Cfg().StationInterface, cmd)
+	if err != nil {
+		return out, err
+	}
+	if reply := strings.TrimSpace(string(out)); strings.HasPrefix(reply, "FAIL") {
+		return out, fmt.Errorf("%w: %s: %s", wpactl.ErrFail, args[0], reply)
+	}
+
+	return out, nil
+}
+
+// valueArgs is the index of the value of the commands whose value runs
+// to the end of the command: SET <name> <value> and SET_NETWORK <id>
+// <name> <value>.
+var valueArgs = map[string]int{
+	"SET":         2,
+	"SET_NETWORK": 3,
+}
+
+// ctlCommand joins args into a control socket command, refusing any that
+// would be read as other arguments than it was given: wpa_supplicant
+// splits a command on spaces, except for the value of SET and
+// SET_NETWORK, which runs to its end, and writes values to its config a
+// line each, which a control character could break out of. Values from
+// requests are hex encoded or checked before they get here, this is the
+// last line of defense. The arguments are not in the error, one may be a
+// secret.
+func ctlCommand(args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("%w: no command", ErrInvalid)
+	}
+	value, ok := valueArgs[args[0]]
+	if ok && len(args) != value+1 {
+		return "", fmt.Errorf("%w: %s takes %d arguments, not %d", ErrInvalid, args[0], value, len(args)-1)
+	}
+
+	for i, arg := range args {
+		for j := 0; j < len(arg); j++ {
+			if arg[j] < 0x20 || arg[j] == 0x7f {
+				return "", fmt.Errorf("%w: argument %d holds a control character", ErrInvalid, i)
+			}
+		}
+
+		if (!ok || i != value) && (arg == "" || strings.Contains(arg, " ")) {
+			return "", fmt.Errorf("%w: argument %d is empty or holds a space", ErrInvalid, i)
+		}
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+// monitor attaches to the wpa_supplicant of the station interface for
+// unsolicited events. The caller must Close the returned Closer.
+func (wpa *WpaCfg) monitor() (<-chan wpactl.Event, io.Closer, error) {
+	return wpa.Runner.Attach(wpa.Cfg().StationInterface)
+}
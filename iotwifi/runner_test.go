@@ -0,0 +1,336 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/iotwifitest"
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// ifaceRunner records the interfaces requests and monitors are for.
+type ifaceRunner struct {
+	*iotwifitest.Runner
+	ifaces []string
+}
+
+func (r *ifaceRunner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	r.ifaces = append(r.ifaces, iface)
+	return r.Runner.Request(ctx, iface, cmd)
+}
+
+func (r *ifaceRunner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	r.ifaces = append(r.ifaces, iface)
+	return r.Runner.Attach(iface)
+}
+
+func TestSystemRunnerOutput(t *testing.T) {
+	r := &systemRunner{}
+	ctx := context.Background()
+
+	out, err := r.Output(ctx, "sh", "-c", "echo out; echo ignored >&2")
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("output %q, %v", out, err)
+	}
+
+	out, err = r.Output(ctx, "sh", "-c", "echo partial; echo '  not permitted ' >&2; exit 3")
+	if err == nil || err.Error() != "exit status 3: not permitted" || string(out) != "partial\n" {
+		t.Errorf("failure %q, %v", out, err)
+	}
+
+	// without standard error the exit status is all there is
+	if _, err := r.Output(ctx, "sh", "-c", "exit 1"); err == nil || err.Error() != "exit status 1" {
+		t.Errorf("silent failure %v", err)
+	}
+
+	if _, err := r.Output(ctx, "/nonexistent/command"); err == nil {
+		t.Error("ran a missing command")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.Output(ctx, "sleep", "5"); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("cancelled command returned %v after %s", err, time.Since(start))
+	}
+}
+
+// fakeSupplicant answers requests on a control socket in dir for iface
+// with the request and " reply", and DELAY after delay.
+func fakeSupplicant(t *testing.T, dir string, iface string, delay time.Duration) {
+	t.Helper()
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, iface), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			cmd := string(buf[:n])
+			go func() {
+				if cmd == "DELAY" {
+					time.Sleep(delay)
+				}
+				conn.WriteToUnix([]byte(cmd+" reply"), addr)
+			}()
+		}
+	}()
+}
+
+func TestSystemRunnerRequest(t *testing.T) {
+	dir := t.TempDir()
+	fakeSupplicant(t, dir, "wlan0", 200*time.Millisecond)
+	r := &systemRunner{dir: dir, conns: make(map[string]*wpactl.Conn)}
+
+	out, err := r.Request(context.Background(), "wlan0", "PING")
+	if err != nil || string(out) != "PING reply" {
+		t.Fatalf("ping %q, %v", out, err)
+	}
+	first := r.conns["wlan0"]
+	if out, err := r.Request(context.Background(), "wlan0", "STATUS"); err != nil || string(out) != "STATUS reply" || r.conns["wlan0"] != first {
+		t.Fatalf("status %q, %v on another connection", out, err)
+	}
+
+	// the reply arrives after the deadline, on the connection given up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Request(ctx, "wlan0", "DELAY"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("delayed request %v", err)
+	}
+	if _, ok := r.conns["wlan0"]; ok {
+		t.Fatal("kept the connection of a request given up on")
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	for _, cmd := range []string{"PING", "LIST_NETWORKS"} {
+		if out, err := r.Request(context.Background(), "wlan0", cmd); err != nil || string(out) != cmd+" reply" {
+			t.Errorf("%s after a late reply: %q, %v", cmd, out, err)
+		}
+	}
+
+	// a cancelled request drops its connection too
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Request(ctx, "wlan0", "PING"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled request %v", err)
+	}
+	if _, ok := r.conns["wlan0"]; ok {
+		t.Error("kept the connection of a cancelled request")
+	}
+
+	if _, err := r.Request(context.Background(), "wlan1", "PING"); err == nil {
+		t.Error("request to an interface without a control socket")
+	}
+}
+
+func TestWpaCtl(t *testing.T) {
+	runner := &ifaceRunner{Runner: iotwifitest.NewRunner()}
+	runner.Errors["ROAM"] = errors.New("connection refused")
+	wpa := &WpaCfg{WpaCfg: &SetupCfg{StationInterface: "wlan1"}, Runner: runner}
+	ctx := context.Background()
+
+	out, err := wpa.wpaCtl(ctx, "SET_NETWORK", "1", "psk", `"pass phrase"`)
+	if err != nil || string(out) != "OK\n" {
+		t.Errorf("set_network %q, %v", out, err)
+	}
+	out, err = wpa.wpaCtl(ctx, "LIST_NETWORKS")
+	if err != nil || string(out) != iotwifitest.WpaListNetworks {
+		t.Errorf("list_networks %q, %v", out, err)
+	}
+	if _, err := wpa.wpaCtl(ctx, "ROAM", "aa:bb:cc:dd:ee:01"); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("roam %v", err)
+	}
+
+	runner.Replies["ADD_NETWORK"] = "FAIL\n"
+	if out, err := wpa.wpaCtl(ctx, "ADD_NETWORK"); !errors.Is(err, wpactl.ErrFail) || string(out) != "FAIL\n" {
+		t.Errorf("add_network %q, %v, want ErrFail", out, err)
+	}
+
+	want := []string{`SET_NETWORK 1 psk "pass phrase"`, "LIST_NETWORKS", "ROAM aa:bb:cc:dd:ee:01", "ADD_NETWORK"}
+	if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("sent %q, want %q", calls, want)
+	}
+
+	events, closer, err := wpa.monitor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wpa.wpaCtl(ctx, "ENABLE_NETWORK", "1")
+	select {
+	case ev := <-events:
+		if ev.Name != "CTRL-EVENT-CONNECTED" {
+			t.Errorf("event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event after enable_network")
+	}
+	closer.Close()
+	if _, ok := <-events; ok {
+		t.Error("events open after close")
+	}
+
+	for i, iface := range runner.ifaces {
+		if iface != "wlan1" {
+			t.Errorf("call %d for %q", i, iface)
+		}
+	}
+}
+
+// ctlArgs splits a control socket command the way wpa_supplicant reads
+// it: on spaces, the value of SET and SET_NETWORK running to the end.
+func ctlArgs(cmd string) []string {
+	n := -1
+	if value, ok := valueArgs[strings.SplitN(cmd, " ", 2)[0]]; ok {
+		n = value + 1
+	}
+
+	return strings.SplitN(cmd, " ", n)
+}
+
+// checkSent fails t if cmd would reach wpa_supplicant as anything but
+// the one command args, with a control character or another SET.
+func checkSent(t *testing.T, cmd string, args []string) {
+	t.Helper()
+
+	if strings.IndexFunc(cmd, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		t.Fatalf("sent %q with a control character", cmd)
+	}
+	if got := ctlArgs(cmd); !reflect.DeepEqual(got, args) {
+		t.Fatalf("sent %q, read as %q, not %q", cmd, got, args)
+	}
+	if args[0] != "SET" && strings.HasPrefix(cmd, "SET ") {
+		t.Fatalf("sent %q, read as a SET", cmd)
+	}
+}
+
+func TestCtlCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		cmd  string
+	}{
+		{"command", []string{"STATUS"}, "STATUS"},
+		{"arguments", []string{"ENABLE_NETWORK", "1"}, "ENABLE_NETWORK 1"},
+		{"set", []string{"SET", "country", "DE"}, "SET country DE"},
+		{"value with spaces", []string{"SET_NETWORK", "1", "psk", `"my pass phrase"`}, `SET_NETWORK 1 psk "my pass phrase"`},
+		{"empty value", []string{"SET_NETWORK", "1", "bssid", ""}, "SET_NETWORK 1 bssid "},
+		{"no command", nil, ""},
+		{"newline", []string{"SET", "country", "DE\nSET update_config 0"}, ""},
+		{"carriage return", []string{"SET_NETWORK", "1", "psk", "\"pass\rphrase\""}, ""},
+		{"delete", []string{"ROAM", "aa:bb\x7f"}, ""},
+		{"space in argument", []string{"SET", "country DE", "x"}, ""},
+		{"space in name", []string{"SET_NETWORK", "1", "psk x", "y"}, ""},
+		{"name as value", []string{"SET_NETWORK", "1", "ssid x"}, ""},
+		{"argument after value", []string{"SET", "country", "DE", "x"}, ""},
+		{"empty argument", []string{"REMOVE_NETWORK", ""}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newTestWpa(t)
+			defer cleanup()
+
+			_, err := wpa.wpaCtl(context.Background(), tt.args...)
+			if tt.cmd == "" {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("err %v, want ErrInvalid", err)
+				}
+				if calls := runner.Calls(); len(calls) != 0 {
+					t.Errorf("sent %q", calls)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calls := runner.Calls(); !reflect.DeepEqual(calls, []string{tt.cmd}) {
+				t.Fatalf("sent %q, want %q", calls, tt.cmd)
+			}
+			checkSent(t, tt.cmd, tt.args)
+		})
+	}
+}
+
+func FuzzCtlCommand(f *testing.F) {
+	f.Add("SET", "country", "DE", "")
+	f.Add("SET_NETWORK", "1", "psk", `"pass phrase"`)
+	f.Add("SET_NETWORK", "1", "ssid x", "")
+	f.Add("SET", "country", "DE\nSET update_config 0", "")
+	f.Add("ROAM", "aa:bb:cc:dd:ee:01", "", "")
+
+	wpa, runner, cleanup := newTestWpa(f)
+	defer cleanup()
+
+	f.Fuzz(func(t *testing.T, cmd, a, b, c string) {
+		// as many arguments as the fuzzer gives, the empty ones last
+		args := []string{cmd, a, b, c}
+		for len(args) > 1 && args[len(args)-1] == "" {
+			args = args[:len(args)-1]
+		}
+
+		before := len(runner.Calls())
+		_, err := wpa.wpaCtl(context.Background(), args...)
+		calls := callsSince(runner, before)
+		if err != nil {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("err %v, want ErrInvalid", err)
+			}
+			if len(calls) != 0 {
+				t.Fatalf("refused %q but sent %q", args, calls)
+			}
+			return
+		}
+
+		if len(calls) != 1 {
+			t.Fatalf("sent %q for %q", calls, args)
+		}
+		checkSent(t, calls[0], args)
+	})
+}
+
+func FuzzConfigureNetwork(f *testing.F) {
+	f.Add("home", "passphrase", false)
+	f.Add("café \"net\"", "pass phrase\"", true)
+	f.Add("home\nSET update_config 0", "pass\nSET update_config 0", false)
+	f.Add("\x00\xff", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", false)
+
+	wpa, runner, cleanup := newTestWpa(f)
+	defer cleanup()
+
+	f.Fuzz(func(t *testing.T, ssid, psk string, hidden bool) {
+		before := len(runner.Calls())
+		err := wpa.configureNetwork(context.Background(), "1", WpaCredentials{Ssid: ssid, Psk: psk, Hidden: hidden})
+		calls := callsSince(runner, before)
+		if err == nil && len(calls) == 0 {
+			t.Fatal("configured without a request")
+		}
+
+		for _, call := range calls {
+			args := ctlArgs(call)
+			if args[0] != "SET_NETWORK" || len(args) != 4 || args[1] != "1" {
+				t.Fatalf("sent %q", call)
+			}
+			checkSent(t, call, args)
+
+			// the ssid goes in hex, whatever its bytes
+			if args[2] == "ssid" && args[3] != EncodeSsid(ssid) {
+				t.Fatalf("sent ssid %q for %q", args[3], ssid)
+			}
+		}
+	})
+}
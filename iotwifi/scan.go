@@ -0,0 +1,379 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WpaNetwork defines a wifi network to connect to, one per BSS.
+type WpaNetwork struct {
+	Bssid       string      `json:"bssid"`
+	Frequency   string      `json:"frequency"`
+	Channel     int         `json:"channel"`
+	Band        string      `json:"band"`         // 2.4GHz, 5GHz or 6GHz
+	SignalLevel int         `json:"signal_level"` // dBm
+	Quality     int         `json:"quality"`      // 0-100 percent
+	Flags       string      `json:"flags"`
+	Security    WpaSecurity `json:"security"`
+	Ssid        string      `json:"ssid"`
+	P2P         bool        `json:"p2p"`               // a Wi-Fi Direct group owner or device
+	Vendor      string      `json:"vendor,omitempty"`  // of the AP, from the OUI of the bssid
+	Iface       string      `json:"iface,omitempty"`   // the station interface that saw it, the strongest of SeenBy
+	SeenBy      []string    `json:"seen_by,omitempty"` // every interface that saw it, in a scan of all the radios
+}
+
+// WpaSecurity is the parsed form of scan result flags such as
+// [WPA2-PSK-CCMP][WPS][ESS].
+type WpaSecurity struct {
+	Open       bool `json:"open"`
+	Wep        bool `json:"wep"`
+	Wpa        bool `json:"wpa"`
+	Wpa2       bool `json:"wpa2"`
+	Wpa3       bool `json:"wpa3"`
+	Enterprise bool `json:"enterprise"`
+	Wps        bool `json:"wps"`
+}
+
+// ParseSecurity parses scan result flags into a WpaSecurity.
+func ParseSecurity(flags string) WpaSecurity {
+	sec := WpaSecurity{
+		Wep:        strings.Contains(flags, "[WEP"),
+		Wpa:        strings.Contains(flags, "[WPA-"),
+		Wpa2:       strings.Contains(flags, "[WPA2-") || strings.Contains(flags, "[RSN-"),
+		Wpa3:       strings.Contains(flags, "SAE") || strings.Contains(flags, "SUITE-B"),
+		Enterprise: strings.Contains(flags, "-EAP"),
+		Wps:        strings.Contains(flags, "[WPS"),
+	}
+	sec.Open = !sec.Wep && !sec.Wpa && !sec.Wpa2 && !sec.Wpa3
+
+	return sec
+}
+
+// WpaScanResult groups every BSS advertising one ssid. The embedded
+// WpaNetwork is the strongest BSS, Bss lists all of them strongest first.
+type WpaScanResult struct {
+	WpaNetwork
+	Bss []WpaNetwork `json:"bss"`
+}
+
+// SignalQuality converts an RSSI in dBm to a 0-100 quality percentage,
+// linear between -100 dBm (0%) and -50 dBm (100%).
+func SignalQuality(dbm int) int {
+	switch {
+	case dbm <= -100:
+		return 0
+	case dbm >= -50:
+		return 100
+	}
+
+	return 2 * (dbm + 100)
+}
+
+// ScanNetworks scans and returns the visible networks, strongest first.
+func (wpa *WpaCfg) ScanNetworks(ctx context.Context) ([]WpaScanResult, error) {
+	return wpa.scan(ctx, ScanOptions{})
+}
+
+// ScanHidden probes for ssid directly, so a hidden network shows up in the
+// results alongside the broadcasting ones.
+func (wpa *WpaCfg) ScanHidden(ctx context.Context, ssid string) ([]WpaScanResult, error) {
+	return wpa.scan(ctx, ScanOptions{Ssid: ssid})
+}
+
+// ScanWith scans as opts say, for the APs a default scan misses.
+func (wpa *WpaCfg) ScanWith(ctx context.Context, opts ScanOptions) ([]WpaScanResult, error) {
+	if err := opts.Validate(); err != nil {
+		return []WpaScanResult{}, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	return wpa.scan(ctx, opts)
+}
+
+// How long a scan may take to report results, by default and at most
+// with ScanOptions.DurationSec.
+const (
+	scanTimeout    = 15 * time.Second
+	maxScanTimeout = 60 * time.Second
+)
+
+// dfsChannels are the 5GHz channels an AP must first check for radar.
+// A station only listens on them, an active scan may not probe there.
+var dfsChannels = []int{52, 56, 60, 64, 100, 104, 108, 112, 116, 120, 124, 128, 132, 136, 140, 144}
+
+// ScanOptions tune a scan for where the default, active scan of every
+// channel misses APs: regulatory domains that forbid probing and radar
+// (DFS) channels, whose APs are only found by listening for their
+// beacons long enough. They need wpa_supplicant 2.7 or later.
+type ScanOptions struct {
+	Passive     bool   `json:"passive"`        // listen for beacons instead of sending probe requests
+	Freqs       []int  `json:"freqs"`          // MHz, scan only these
+	Dfs         bool   `json:"dfs"`            // add the 5GHz DFS channels to freqs; the kernel scans them passively
+	DurationSec int    `json:"duration_sec"`   // how long to wait for the results, 15 by default, 60 at most
+	Ssid        string `json:"ssid,omitempty"` // probe for this hidden network
+}
+
+// Validate checks the options.
+func (o ScanOptions) Validate() error {
+	for _, freq := range o.Freqs {
+		if channel, _ := FrequencyChannel(freq); channel == 0 {
+			return fmt.Errorf("unknown frequency %d MHz", freq)
+		}
+	}
+
+	switch {
+	case o.DurationSec < 0 || time.Duration(o.DurationSec)*time.Second > maxScanTimeout:
+		return fmt.Errorf("duration_sec must be within 0-%d", int(maxScanTimeout/time.Second))
+	case o.Passive && o.Ssid != "":
+		return fmt.Errorf("a passive scan cannot probe for a hidden ssid")
+	}
+
+	return nil
+}
+
+// IsZero reports whether o is a default scan.
+func (o ScanOptions) IsZero() bool {
+	return !o.Passive && len(o.Freqs) == 0 && !o.Dfs && o.DurationSec == 0 && o.Ssid == ""
+}
+
+// freqs returns the frequencies to scan, sorted, none for all of them.
+func (o ScanOptions) freqs() []int {
+	seen := map[int]bool{}
+	freqs := []int{}
+	add := func(freq int) {
+		if !seen[freq] {
+			seen[freq] = true
+			freqs = append(freqs, freq)
+		}
+	}
+
+	for _, freq := range o.Freqs {
+		add(freq)
+	}
+	if o.Dfs {
+		for _, channel := range dfsChannels {
+			add(ChannelFrequency(channel, Band5))
+		}
+	}
+	sort.Ints(freqs)
+
+	return freqs
+}
+
+// params returns the SCAN parameters of the options.
+func (o ScanOptions) params() []string {
+	params := []string{}
+	if o.Ssid != "" {
+		params = append(params, "ssid", EncodeSsid(o.Ssid))
+	}
+	if freqs := o.freqs(); len(freqs) > 0 {
+		list := []string{}
+		for _, freq := range freqs {
+			list = append(list, strconv.Itoa(freq))
+		}
+		params = append(params, "freq="+strings.Join(list, ","))
+	}
+	if o.Passive {
+		params = append(params, "passive=1")
+	}
+
+	return params
+}
+
+// timeout returns how long to wait for the results.
+func (o ScanOptions) timeout() time.Duration {
+	if o.DurationSec == 0 {
+		return scanTimeout
+	}
+
+	return time.Duration(o.DurationSec) * time.Second
+}
+
+// scan triggers a scan with the SCAN parameters of opts, waits for
+// wpa_supplicant to report it finished and collects the results.
+func (wpa *WpaCfg) scan(ctx context.Context, opts ScanOptions) ([]WpaScanResult, error) {
+	results := []WpaScanResult{}
+
+	ctx, done, err := wpa.ops.acquire(ctx, OpScan, opts.Ssid)
+	if err != nil {
+		return results, err
+	}
+	defer done()
+
+	start := time.Now()
+
+	// a blocked radio cannot scan, the commonest reason for no networks
+	if err := radioBlocked(wpa.Cfg().StationInterface); err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+
+	// watch for the results before starting the scan
+	events, monitor, err := wpa.monitor()
+	if err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+	defer monitor.Close()
+
+	// FAIL-BUSY means a scan is already running, its results are just as good
+	scanOut, err := wpa.wpaCtl(ctx, append([]string{"SCAN"}, opts.params()...)...)
+	scanOutClean := strings.TrimSpace(string(scanOut))
+	if err != nil && scanOutClean != "FAIL-BUSY" {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+	if scanOutClean != "OK" && scanOutClean != "FAIL-BUSY" {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, scanOutClean)
+	}
+
+	timeout := time.After(opts.timeout())
+	for done := false; !done; {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return results, fmt.Errorf("%w: lost wpa_supplicant control connection", ErrScanFailed)
+			}
+
+			switch ev.Name {
+			case "CTRL-EVENT-SCAN-RESULTS":
+				done = true
+			case "CTRL-EVENT-SCAN-FAILED":
+				return results, fmt.Errorf("%w: %s", ErrScanFailed, strings.TrimSpace(ev.Message))
+			}
+		case <-ctx.Done():
+			return results, ctx.Err()
+		case <-timeout:
+			return results, fmt.Errorf("%w: scan", ErrTimeout)
+		}
+	}
+
+	networkListOut, err := wpa.wpaCtl(ctx, "SCAN_RESULTS")
+	if err != nil {
+		return results, fmt.Errorf("%w: %s", ErrScanFailed, err)
+	}
+
+	networks := parseScanResults(networkListOut)
+	if !wpa.Cfg().P2P.Enabled {
+		networks = withoutP2P(networks)
+	}
+
+	for i := range networks {
+		networks[i].Iface = wpa.Cfg().StationInterface
+	}
+
+	wpa.OUI.annotate(networks)
+	results = groupScanResults(networks)
+	wpa.Log.Debug("scan complete", "iface", wpa.Cfg().StationInterface, "networks", len(results), "duration", time.Since(start))
+
+	return results, nil
+}
+
+// parseScanResults parses the tab separated SCAN_RESULTS reply, skipping
+// the header and hidden (empty ssid) BSSs. Wi-Fi Direct devices are
+// marked P2P.
+func parseScanResults(out []byte) []WpaNetwork {
+	networks := []WpaNetwork{}
+
+	lines := strings.Split(string(out), "\n")
+	for _, line := range lines[1:] {
+		// bssid / frequency / signal level / flags / ssid
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 5 || fields[4] == "" {
+			continue
+		}
+
+		freq, _ := strconv.Atoi(fields[1])
+		channel, band := FrequencyChannel(freq)
+		signal, _ := strconv.Atoi(fields[2])
+		networks = append(networks, WpaNetwork{
+			Bssid:       fields[0],
+			Frequency:   fields[1],
+			Channel:     channel,
+			Band:        band,
+			SignalLevel: signal,
+			Quality:     SignalQuality(signal),
+			Flags:       fields[3],
+			Security:    ParseSecurity(fields[3]),
+			Ssid:        DecodeSsidText(fields[4]),
+			P2P:         strings.Contains(fields[3], "[P2P]"),
+		})
+	}
+
+	return networks
+}
+
+// withoutP2P drops the Wi-Fi Direct devices from networks.
+func withoutP2P(networks []WpaNetwork) []WpaNetwork {
+	infra := []WpaNetwork{}
+	for _, network := range networks {
+		if !network.P2P {
+			infra = append(infra, network)
+		}
+	}
+
+	return infra
+}
+
+// mergeScanResults merges the results of scans on several interfaces,
+// keyed by interface: a BSS seen by more than one is kept once, with the
+// strongest reading, tagged with every interface that saw it.
+func mergeScanResults(scans map[string][]WpaScanResult) []WpaScanResult {
+	ifaces := make([]string, 0, len(scans))
+	for iface := range scans {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	networks := []WpaNetwork{}
+	index := make(map[string]int)
+	for _, iface := range ifaces {
+		for _, result := range scans[iface] {
+			for _, network := range result.Bss {
+				if network.Iface == "" {
+					network.Iface = iface
+				}
+
+				key := strings.ToLower(network.Bssid)
+				i, ok := index[key]
+				if !ok {
+					network.SeenBy = []string{iface}
+					index[key] = len(networks)
+					networks = append(networks, network)
+					continue
+				}
+
+				seenBy := append(networks[i].SeenBy, iface)
+				if network.SignalLevel > networks[i].SignalLevel {
+					networks[i] = network
+				}
+				networks[i].SeenBy = seenBy
+			}
+		}
+	}
+
+	return groupScanResults(networks)
+}
+
+// groupScanResults groups BSSs by ssid, sorting each group and the groups
+// themselves by signal level, strongest first.
+func groupScanResults(networks []WpaNetwork) []WpaScanResult {
+	sort.SliceStable(networks, func(i, j int) bool {
+		return networks[i].SignalLevel > networks[j].SignalLevel
+	})
+
+	results := []WpaScanResult{}
+	index := make(map[string]int)
+
+	for _, network := range networks {
+		i, ok := index[network.Ssid]
+		if !ok {
+			index[network.Ssid] = len(results)
+			results = append(results, WpaScanResult{WpaNetwork: network})
+			i = len(results) - 1
+		}
+		results[i].Bss = append(results[i].Bss, network)
+	}
+
+	return results
+}
@@ -0,0 +1,240 @@
+package iotwifi
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultScanInterval is how often the ScanManager scans in the background.
+const DefaultScanInterval = 60 * time.Second
+
+// ScanCfg configures the ScanManager and is used by SetupCfg.
+type ScanCfg struct {
+	IntervalSec       int         `json:"interval_sec"`       // how often to scan, 60 by default
+	DisableBackground bool        `json:"disable_background"` // only scan on demand
+	StationOnly       bool        `json:"station_only"`       // scan on the station interface only, not on the radios as well
+	Options           ScanOptions `json:"options"`            // of the background and cached scans, when wpa_supplicant scans
+}
+
+// ScanResults are the networks found by a scan and when it finished.
+type ScanResults struct {
+	Time     time.Time         `json:"time"` // zero if there has been no scan yet
+	Networks []WpaScanResult   `json:"networks"`
+	Ifaces   []string          `json:"ifaces,omitempty"` // scanned on, with radios
+	Errors   map[string]string `json:"errors,omitempty"` // of the interfaces whose scan failed, by interface
+}
+
+// ScanManager scans on a schedule and on demand and caches the results,
+// so they can be served without waiting for a scan. Concurrent requests
+// for a fresh scan share one scan.
+type ScanManager struct {
+	Wpa        *WpaCfg
+	Scanner    Provisioner // scans, Wpa unless NetworkManager drives the station
+	Radios     []*WpaCfg   // scanned alongside the station, optional
+	Interval   time.Duration
+	Background bool
+	AllRadios  bool
+	Options    ScanOptions // used when wpa_supplicant scans
+
+	mu        sync.Mutex
+	cached    ScanResults
+	inflight  *scanCall
+	observers []func(ScanResults)
+}
+
+// scanCall is a scan in progress, done is closed when it finishes.
+type scanCall struct {
+	done    chan struct{}
+	results ScanResults
+	err     error
+}
+
+// NewScanManager produces a ScanManager that scans in the background
+// every DefaultScanInterval.
+func NewScanManager(wpa *WpaCfg) *ScanManager {
+	return &ScanManager{
+		Wpa:        wpa,
+		Scanner:    wpa,
+		Interval:   DefaultScanInterval,
+		Background: true,
+		AllRadios:  true,
+		cached:     ScanResults{Networks: []WpaScanResult{}},
+	}
+}
+
+// Configure applies cfg over the default settings.
+func (m *ScanManager) Configure(cfg ScanCfg) {
+	if cfg.IntervalSec > 0 {
+		m.Interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	m.Background = !cfg.DisableBackground
+	m.AllRadios = !cfg.StationOnly
+	m.Options = cfg.Options
+}
+
+// Run scans every Interval until ctx is done, unless background scans
+// are disabled.
+func (m *ScanManager) Run(ctx context.Context) {
+	if !m.Background {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Interval):
+		}
+
+		if _, err := m.Scan(ctx); err != nil {
+			m.Wpa.Log.Debug("background scan failed", "iface", m.Wpa.Cfg().StationInterface, "error", err)
+		}
+	}
+}
+
+// OnResults has fn called with the results of every successful scan,
+// background or on demand. fn must not block the scanner for long.
+func (m *ScanManager) OnResults(fn func(ScanResults)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.observers = append(m.observers, fn)
+}
+
+// Results returns the cached results, scanning first if fresh is set or
+// nothing has been scanned yet.
+func (m *ScanManager) Results(ctx context.Context, fresh bool) (ScanResults, error) {
+	cached := m.Cached()
+	if !fresh && !cached.Time.IsZero() {
+		return cached, nil
+	}
+
+	return m.Scan(ctx)
+}
+
+// Cached returns the results of the last successful scan.
+func (m *ScanManager) Cached() ScanResults {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cached
+}
+
+// Scan scans now, or waits for the scan already in progress, and caches
+// the results.
+func (m *ScanManager) Scan(ctx context.Context) (ScanResults, error) {
+	m.mu.Lock()
+	call := m.inflight
+	if call == nil {
+		call = &scanCall{done: make(chan struct{})}
+		m.inflight = call
+
+		// the scan outlives any one caller, it is shared
+		go m.run(call)
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.results, call.err
+	case <-ctx.Done():
+		return ScanResults{}, ctx.Err()
+	}
+}
+
+// scanAll scans on the station interface and the radios at once, for
+// the coverage of every radio in the time of one scan, and merges the
+// results. It fails only when every scan failed.
+func (m *ScanManager) scanAll(ctx context.Context, opts ScanOptions) (ScanResults, error) {
+	scanners := map[string]Provisioner{m.Wpa.Cfg().StationInterface: m.Scanner}
+	for _, radio := range m.Radios {
+		scanners[radio.Cfg().StationInterface] = radio
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	scans := map[string][]WpaScanResult{}
+	errs := map[string]error{}
+	for iface, scanner := range scanners {
+		wg.Add(1)
+		go func(iface string, scanner Provisioner) {
+			defer wg.Done()
+
+			networks, err := m.scanWith(ctx, scanner, opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[iface] = err
+				return
+			}
+			scans[iface] = networks
+		}(iface, scanner)
+	}
+	wg.Wait()
+
+	results := ScanResults{Time: time.Now(), Ifaces: []string{}}
+	for iface := range scanners {
+		results.Ifaces = append(results.Ifaces, iface)
+	}
+	sort.Strings(results.Ifaces)
+
+	if len(scans) == 0 {
+		return results, errs[m.Wpa.Cfg().StationInterface]
+	}
+
+	for iface, err := range errs {
+		if results.Errors == nil {
+			results.Errors = map[string]string{}
+		}
+		results.Errors[iface] = err.Error()
+		m.Wpa.Log.Warn("radio scan failed", "iface", iface, "error", err)
+	}
+	results.Networks = mergeScanResults(scans)
+
+	return results, nil
+}
+
+// scanWith scans with scanner, with opts when wpa_supplicant scans.
+// NetworkManager scans its own way.
+func (m *ScanManager) scanWith(ctx context.Context, scanner Provisioner, opts ScanOptions) ([]WpaScanResult, error) {
+	if wpa, ok := scanner.(*WpaCfg); ok && !opts.IsZero() {
+		return wpa.ScanWith(ctx, opts)
+	}
+
+	return scanner.ScanNetworks(ctx)
+}
+
+// run performs call and publishes its results.
+func (m *ScanManager) run(call *scanCall) {
+	opts := m.Options
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout()+5*time.Second)
+	defer cancel()
+
+	if m.AllRadios && len(m.Radios) > 0 {
+		call.results, call.err = m.scanAll(ctx, opts)
+	} else {
+		networks, err := m.scanWith(ctx, m.Scanner, opts)
+		call.results = ScanResults{Time: time.Now(), Networks: networks}
+		call.err = err
+	}
+	err := call.err
+
+	m.mu.Lock()
+	if err == nil {
+		m.cached = call.results
+	}
+	m.inflight = nil
+	observers := m.observers
+	m.mu.Unlock()
+
+	close(call.done)
+
+	if err == nil {
+		for _, fn := range observers {
+			fn(call.results)
+		}
+	}
+}
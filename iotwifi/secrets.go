@@ -0,0 +1,167 @@
+package iotwifi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in log entries.
+const redacted = "[REDACTED]"
+
+// minSecretLength keeps short values, such as an empty or a one word
+// password, from redacting unrelated text. Passphrases are at least 8.
+const minSecretLength = 6
+
+// maxSecrets bounds the secrets remembered for redaction, the oldest are
+// forgotten first.
+const maxSecrets = 64
+
+// hexPskR matches a pre-hashed PSK, the 256 bit key wpa_passphrase
+// derives from the passphrase and ssid.
+var hexPskR = regexp.MustCompile("^[0-9a-fA-F]{64}$")
+
+// secretKeys are log keys whose values are never written.
+var secretKeys = map[string]bool{
+	"psk":            true,
+	"password":       true,
+	"passphrase":     true,
+	"wpa_passphrase": true,
+}
+
+// secretSet holds the passphrases and passwords seen, so they can be
+// redacted wherever they turn up, such as inside an error message.
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// secrets are redacted from every entry of a Scrub logger.
+var secrets = &secretSet{}
+
+// add remembers secret for redaction.
+func (s *secretSet) add(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, value := range s.values {
+		if value == secret {
+			return
+		}
+	}
+
+	s.values = append(s.values, secret)
+	if len(s.values) > maxSecrets {
+		s.values = s.values[len(s.values)-maxSecrets:]
+	}
+}
+
+// scrub replaces every known secret in text.
+func (s *secretSet) scrub(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, value := range s.values {
+		if strings.Contains(text, value) {
+			text = strings.ReplaceAll(text, value, redacted)
+		}
+	}
+
+	return text
+}
+
+// addSecrets remembers the passphrase and password of creds.
+func addSecrets(creds WpaCredentials) {
+	secrets.add(creds.Psk)
+	secrets.add(creds.Password)
+}
+
+// pskValue returns the psk of creds as set with SET_NETWORK: a
+// passphrase quoted, a pre-hashed PSK of 64 hex digits as it is. SAE
+// derives its keys from the passphrase itself and cannot use a hash.
+func pskValue(creds WpaCredentials) (string, error) {
+	if hexPskR.MatchString(creds.Psk) {
+		if strings.Contains(creds.KeyMgmt, KeyMgmtSae) {
+			return "", fmt.Errorf("%w: %s needs the passphrase, not a pre-hashed psk", ErrConnectFailed, creds.KeyMgmt)
+		}
+		return strings.ToLower(creds.Psk), nil
+	}
+
+	if len(creds.Psk) < 8 || len(creds.Psk) > 63 {
+		return "", fmt.Errorf("%w: psk must be 8-63 characters or 64 hex digits, not %d characters", ErrConnectFailed, len(creds.Psk))
+	}
+
+	// wpa_supplicant takes a passphrase only quoted, it is ASCII per the
+	// standard and the quotes then hold it whatever it is
+	for i := 0; i < len(creds.Psk); i++ {
+		if creds.Psk[i] < 0x20 || creds.Psk[i] > 0x7e {
+			return "", fmt.Errorf("%w: psk must be printable ASCII", ErrConnectFailed)
+		}
+	}
+
+	return "\"" + creds.Psk + "\"", nil
+}
+
+// scrubLogger redacts secrets before passing entries on.
+type scrubLogger struct {
+	log Logger
+}
+
+// Scrub wraps log so passphrases and passwords never reach it: values
+// under keys such as psk are replaced, and the secrets of networks
+// configured so far are redacted from the message and every value.
+func Scrub(log Logger) Logger {
+	if _, ok := log.(*scrubLogger); ok {
+		return log
+	}
+
+	return &scrubLogger{log: log}
+}
+
+// scrub returns msg and keysAndValues with the secrets redacted.
+func (s *scrubLogger) scrub(msg string, keysAndValues []interface{}) (string, []interface{}) {
+	scrubbed := make([]interface{}, len(keysAndValues))
+	for i, v := range keysAndValues {
+		// values follow their keys
+		if i%2 == 1 && secretKeys[strings.ToLower(fmt.Sprint(keysAndValues[i-1]))] {
+			scrubbed[i] = redacted
+			continue
+		}
+
+		switch value := v.(type) {
+		case string:
+			scrubbed[i] = secrets.scrub(value)
+		case error:
+			scrubbed[i] = secrets.scrub(value.Error())
+		default:
+			scrubbed[i] = v
+		}
+	}
+
+	return secrets.scrub(msg), scrubbed
+}
+
+func (s *scrubLogger) Debug(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = s.scrub(msg, keysAndValues)
+	s.log.Debug(msg, keysAndValues...)
+}
+
+func (s *scrubLogger) Info(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = s.scrub(msg, keysAndValues)
+	s.log.Info(msg, keysAndValues...)
+}
+
+func (s *scrubLogger) Warn(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = s.scrub(msg, keysAndValues)
+	s.log.Warn(msg, keysAndValues...)
+}
+
+func (s *scrubLogger) Error(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = s.scrub(msg, keysAndValues)
+	s.log.Error(msg, keysAndValues...)
+}
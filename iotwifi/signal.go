@@ -0,0 +1,188 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signal monitor defaults.
+const (
+	DefaultSignalInterval = 5 * time.Second
+	DefaultSignalHistory  = 720 // an hour at the default interval
+)
+
+// noiseUnknown is the NOISE SIGNAL_POLL reports when the driver has none.
+const noiseUnknown = 9999
+
+// SignalMonitorCfg configures the SignalMonitor and is used by SetupCfg.
+type SignalMonitorCfg struct {
+	IntervalSec int `json:"interval_sec"` // how often to sample, 5 by default
+	History     int `json:"history"`      // samples kept, 720 by default
+}
+
+// SignalSample is the station link quality at one point in time.
+type SignalSample struct {
+	Time      time.Time `json:"time"`
+	Bssid     string    `json:"bssid"`
+	Rssi      int       `json:"rssi"`       // dBm
+	Noise     int       `json:"noise"`      // dBm, 0 if the driver does not report it
+	LinkSpeed int       `json:"link_speed"` // Mbit/s
+	Frequency int       `json:"frequency"`  // MHz
+	TxRetries int64     `json:"tx_retries"` // since association
+	TxFailed  int64     `json:"tx_failed"`  // since association
+}
+
+// SignalPoll samples the link quality of the station interface. It
+// fails when the station is not associated.
+func (wpa *WpaCfg) SignalPoll(ctx context.Context) (SignalSample, error) {
+	sample := SignalSample{Time: time.Now()}
+
+	pollOut, err := wpa.wpaCtl(ctx, "SIGNAL_POLL")
+	if err != nil {
+		return sample, fmt.Errorf("%w: signal_poll: %s", ErrCommandFailed, err)
+	}
+
+	poll := cfgMapper(pollOut)
+	sample.Rssi, _ = strconv.Atoi(poll["RSSI"])
+	sample.LinkSpeed, _ = strconv.Atoi(poll["LINKSPEED"])
+	sample.Frequency, _ = strconv.Atoi(poll["FREQUENCY"])
+	if noise, err := strconv.Atoi(poll["NOISE"]); err == nil && noise != noiseUnknown {
+		sample.Noise = noise
+	}
+
+	// retries are only counted by the driver, per associated AP
+	dumpOut, err := wpa.Runner.Output(ctx, "iw", "dev", wpa.Cfg().StationInterface, "station", "dump")
+	if err != nil {
+		wpa.Log.Debug("station dump failed", "iface", wpa.Cfg().StationInterface, "error", err)
+		return sample, nil
+	}
+	sample.Bssid, sample.TxRetries, sample.TxFailed = parseStationDump(dumpOut)
+
+	return sample, nil
+}
+
+// parseStationDump reads the AP address and the tx retry and failure
+// counters of iw station dump.
+func parseStationDump(out []byte) (string, int64, int64) {
+	var bssid string
+	var retries, failed int64
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Station aa:bb:cc:dd:ee:ff (on wlan0)
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Station" {
+			bssid = fields[1]
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case "tx retries":
+			retries, _ = strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		case "tx failed":
+			failed, _ = strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		}
+	}
+
+	return bssid, retries, failed
+}
+
+// SignalMonitor samples the station link quality on an interval and
+// keeps the most recent samples in a ring buffer, for live signal
+// surveys while the device is repositioned.
+type SignalMonitor struct {
+	Wpa      *WpaCfg
+	Interval time.Duration
+
+	mu      sync.Mutex
+	samples []SignalSample
+	next    int
+	full    bool
+}
+
+// NewSignalMonitor produces a SignalMonitor with default settings.
+func NewSignalMonitor(wpa *WpaCfg) *SignalMonitor {
+	return &SignalMonitor{
+		Wpa:      wpa,
+		Interval: DefaultSignalInterval,
+		samples:  make([]SignalSample, DefaultSignalHistory),
+	}
+}
+
+// Configure applies cfg over the default settings, dropping the history.
+func (m *SignalMonitor) Configure(cfg SignalMonitorCfg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cfg.IntervalSec > 0 {
+		m.Interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	if cfg.History > 0 {
+		m.samples = make([]SignalSample, cfg.History)
+		m.next = 0
+		m.full = false
+	}
+}
+
+// Run samples every Interval until ctx is done. Samples are skipped
+// while the station is not associated.
+func (m *SignalMonitor) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Interval):
+		}
+
+		sample, err := m.Wpa.SignalPoll(ctx)
+		if err != nil {
+			m.Wpa.Log.Debug("signal poll failed", "iface", m.Wpa.Cfg().StationInterface, "error", err)
+			continue
+		}
+
+		m.add(sample)
+	}
+}
+
+// add records sample, overwriting the oldest once the buffer is full.
+func (m *SignalMonitor) add(sample SignalSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples[m.next] = sample
+	m.next = (m.next + 1) % len(m.samples)
+	if m.next == 0 {
+		m.full = true
+	}
+}
+
+// History returns up to last of the most recent samples, oldest first,
+// or all of them if last is 0.
+func (m *SignalMonitor) History(last int) []SignalSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := []SignalSample{}
+	if m.full {
+		history = append(history, m.samples[m.next:]...)
+	}
+	history = append(history, m.samples[:m.next]...)
+
+	if last > 0 && last < len(history) {
+		history = history[len(history)-last:]
+	}
+
+	return history
+}
@@ -0,0 +1,96 @@
+package iotwifi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// DefaultSocket is where the API is served for local administration.
+const DefaultSocket = "/var/run/txwifi.sock"
+
+// DefaultSocketMode lets only root connect to the API socket.
+const DefaultSocketMode os.FileMode = 0600
+
+// APISocketCfg configures the unix socket the API is served on and is
+// used by SetupCfg. Access is controlled by the socket's permissions.
+type APISocketCfg struct {
+	Disabled   bool   `json:"disabled"`    // do not serve the API on a socket
+	Path       string `json:"path"`        // /var/run/txwifi.sock, or IOTWIFI_SOCKET
+	Mode       string `json:"mode"`        // octal permissions, "0600" by default
+	Group      string `json:"group"`       // group owning the socket, for a mode such as "0660"
+	DisableTCP bool   `json:"disable_tcp"` // serve the API on the socket only
+}
+
+// FileMode returns the socket permissions, DefaultSocketMode if Mode is
+// empty.
+func (c APISocketCfg) FileMode() (os.FileMode, error) {
+	if c.Mode == "" {
+		return DefaultSocketMode, nil
+	}
+
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q, want octal permissions such as 0660", c.Mode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// Validate checks the socket settings.
+func (c APISocketCfg) Validate() error {
+	if c.Disabled && c.DisableTCP {
+		return fmt.Errorf("the api socket and tcp are both disabled")
+	}
+
+	_, err := c.FileMode()
+	return err
+}
+
+// ListenAPISocket listens on the socket at cfg.Path, replacing a socket
+// left behind by an earlier run, and applies its mode and group.
+func ListenAPISocket(cfg APISocketCfg) (net.Listener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	mode, _ := cfg.FileMode()
+
+	path := cfg.Path
+	if path == "" {
+		path = DefaultSocket
+	}
+
+	gid := -1
+	if cfg.Group != "" {
+		group, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return nil, fmt.Errorf("group %s has gid %q", cfg.Group, group.Gid)
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket is removed when the listener is closed
+	if err := os.Chown(path, -1, gid); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
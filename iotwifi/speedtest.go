@@ -0,0 +1,301 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Speed test methods.
+const (
+	SpeedTestDownload = "download" // an HTTP download of speed_test.url
+	SpeedTestIperf3   = "iperf3"   // iperf3 in client mode against speed_test.iperf3_server
+)
+
+// Speed test directions.
+const (
+	SpeedTestDown = "download"
+	SpeedTestUp   = "upload"
+)
+
+// Speed test defaults.
+const (
+	DefaultSpeedTestDuration = 10 * time.Second
+	MaxSpeedTestDuration     = 60 * time.Second
+	DefaultIperf3Port        = "5201"
+	speedTestSetupTimeout    = 15 * time.Second // to connect, on top of the duration
+
+	maxSpeedTestSec = int(MaxSpeedTestDuration / time.Second)
+)
+
+// SpeedTestCfg configures the speed test and is used by SetupCfg.
+type SpeedTestCfg struct {
+	Url          string `json:"url"`           // a large file downloaded by the download test
+	Iperf3Server string `json:"iperf3_server"` // host or host:port of an iperf3 server
+	DurationSec  int    `json:"duration_sec"`  // how long a test runs, 10 by default, 60 at most
+}
+
+// SpeedTestRequest asks for a speed test. Empty fields are taken from
+// SpeedTestCfg.
+type SpeedTestRequest struct {
+	Method      string `json:"method"` // download or iperf3; iperf3 when only an iperf3 server is configured
+	Url         string `json:"url"`
+	Server      string `json:"server"` // the iperf3 server
+	DurationSec int    `json:"duration_sec"`
+	Upload      bool   `json:"upload"` // iperf3 measures sending instead of receiving
+}
+
+// SpeedTestResult is the throughput a speed test measured.
+type SpeedTestResult struct {
+	Method      string        `json:"method"`
+	Target      string        `json:"target"`    // the URL or iperf3 server
+	Direction   string        `json:"direction"` // download or upload
+	Iface       string        `json:"iface"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
+	Mbps        float64       `json:"mbps"`
+	Retransmits int           `json:"retransmits,omitempty"` // TCP retransmits of an iperf3 upload
+	Time        time.Time     `json:"time"`
+}
+
+// iperf3Report is the part of the iperf3 --json report read.
+type iperf3Report struct {
+	End struct {
+		SumSent struct {
+			Retransmits int `json:"retransmits"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			Bytes         int64   `json:"bytes"`
+			Seconds       float64 `json:"seconds"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// SpeedTester measures the throughput of the station's network on
+// demand, so an installer can tell whether it carries the device's
+// workload. One test runs at a time.
+type SpeedTester struct {
+	Wpa *WpaCfg
+
+	mu      sync.Mutex
+	running bool
+	last    *SpeedTestResult
+}
+
+// NewSpeedTester produces a SpeedTester for wpa.
+func NewSpeedTester(wpa *WpaCfg) *SpeedTester {
+	return &SpeedTester{Wpa: wpa}
+}
+
+// Last returns the result of the last test that succeeded, nil if none
+// did.
+func (s *SpeedTester) Last() *SpeedTestResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.last
+}
+
+// Run runs the test of req through the station interface.
+func (s *SpeedTester) Run(ctx context.Context, req SpeedTestRequest) (SpeedTestResult, error) {
+	cfg := s.Wpa.Cfg().SpeedTest
+	if req.Url == "" {
+		req.Url = cfg.Url
+	}
+	if req.Server == "" {
+		req.Server = cfg.Iperf3Server
+	}
+	if req.DurationSec == 0 {
+		req.DurationSec = cfg.DurationSec
+	}
+	if req.Method == "" {
+		req.Method = SpeedTestDownload
+		if req.Url == "" && req.Server != "" {
+			req.Method = SpeedTestIperf3
+		}
+	}
+
+	if req.DurationSec < 0 || req.DurationSec > maxSpeedTestSec {
+		return SpeedTestResult{}, fmt.Errorf("%w: duration_sec must be within 1-%d", ErrInvalid, maxSpeedTestSec)
+	}
+	duration := DefaultSpeedTestDuration
+	if req.DurationSec > 0 {
+		duration = time.Duration(req.DurationSec) * time.Second
+	}
+
+	iface := s.Wpa.Cfg().StationInterface
+	if interfaceIPv4(iface) == "" && len(interfaceIPv6(iface)) == 0 {
+		return SpeedTestResult{}, fmt.Errorf("%w: %s has no address", ErrSpeedTestFailed, iface)
+	}
+
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return SpeedTestResult{}, fmt.Errorf("%w: a speed test is already running", ErrBusy)
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	var result SpeedTestResult
+	var err error
+	switch req.Method {
+	case SpeedTestDownload:
+		if req.Url == "" {
+			return result, fmt.Errorf("%w: no url, set speed_test.url", ErrInvalid)
+		}
+		result, err = s.download(ctx, req.Url, duration)
+	case SpeedTestIperf3:
+		if req.Server == "" {
+			return result, fmt.Errorf("%w: no iperf3 server, set speed_test.iperf3_server", ErrInvalid)
+		}
+		result, err = s.iperf3(ctx, req.Server, duration, req.Upload)
+	default:
+		return result, fmt.Errorf("%w: unknown speed test method %q, want download or iperf3", ErrInvalid, req.Method)
+	}
+	if err != nil {
+		s.Wpa.Log.Warn("speed test failed", "iface", iface, "method", req.Method, "error", err)
+		return result, err
+	}
+
+	s.Wpa.Log.Info("speed test", "iface", iface, "method", result.Method, "target", result.Target, "direction", result.Direction, "mbps", result.Mbps, "bytes", result.Bytes, "duration", result.Duration)
+
+	s.mu.Lock()
+	s.last = &result
+	s.mu.Unlock()
+
+	return result, nil
+}
+
+// download fetches url through the station interface, and the proxy of
+// its network, for up to duration and measures how fast the body came.
+func (s *SpeedTester) download(ctx context.Context, url string, duration time.Duration) (SpeedTestResult, error) {
+	iface := s.Wpa.Cfg().StationInterface
+	result := SpeedTestResult{Method: SpeedTestDownload, Target: url, Direction: SpeedTestDown, Iface: iface, Time: time.Now()}
+
+	dialer := &net.Dialer{
+		Timeout: speedTestSetupTimeout,
+		Control: netif.BindToDevice(iface),
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if proxy := s.Wpa.activeProxy(ctx); proxy.Enabled() {
+		transport.Proxy = proxy.proxyFunc()
+	}
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithTimeout(ctx, duration+speedTestSetupTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return result, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return result, fmt.Errorf("%w: %s", ErrSpeedTestFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("%w: %s answered %s", ErrSpeedTestFailed, url, resp.Status)
+	}
+
+	// the clock starts with the body, and stops at the end of the file
+	// or of the duration, whichever comes first
+	start := time.Now()
+	stop := time.AfterFunc(duration, cancel)
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	stop.Stop()
+	elapsed := time.Since(start)
+
+	if err != nil && elapsed < duration {
+		return result, fmt.Errorf("%w: %s", ErrSpeedTestFailed, err)
+	}
+	if elapsed > duration {
+		elapsed = duration
+	}
+
+	result.Bytes = n
+	result.Duration = elapsed
+	result.Mbps = mbps(n, elapsed)
+
+	return result, nil
+}
+
+// iperf3 runs iperf3 against server, receiving from it, or sending to it
+// with upload, bound to the station address.
+func (s *SpeedTester) iperf3(ctx context.Context, server string, duration time.Duration, upload bool) (SpeedTestResult, error) {
+	iface := s.Wpa.Cfg().StationInterface
+	result := SpeedTestResult{Method: SpeedTestIperf3, Target: server, Direction: SpeedTestDown, Iface: iface, Time: time.Now()}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, DefaultIperf3Port
+	}
+
+	args := []string{"--client", host, "--port", port, "--time", strconv.Itoa(int(duration / time.Second)), "--json"}
+	if ip := interfaceIPv4(iface); ip != "" {
+		args = append(args, "--bind", ip)
+	}
+	if upload {
+		result.Direction = SpeedTestUp
+	} else {
+		args = append(args, "--reverse")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration+speedTestSetupTimeout)
+	defer cancel()
+
+	// iperf3 reports its errors in the json too, and exits non-zero
+	out, runErr := s.Wpa.Runner.Output(ctx, "iperf3", args...)
+
+	var report iperf3Report
+	if err := json.Unmarshal(out, &report); err != nil {
+		if runErr != nil {
+			return result, fmt.Errorf("%w: iperf3: %s", ErrSpeedTestFailed, runErr)
+		}
+		return result, fmt.Errorf("%w: iperf3 report: %s", ErrSpeedTestFailed, err)
+	}
+	if report.Error != "" {
+		return result, fmt.Errorf("%w: iperf3: %s", ErrSpeedTestFailed, report.Error)
+	}
+	if runErr != nil {
+		return result, fmt.Errorf("%w: iperf3: %s", ErrSpeedTestFailed, runErr)
+	}
+
+	received := report.End.SumReceived
+	result.Bytes = received.Bytes
+	result.Duration = time.Duration(received.Seconds * float64(time.Second))
+	result.Mbps = received.BitsPerSecond / 1e6
+	if upload {
+		result.Retransmits = report.End.SumSent.Retransmits
+	}
+
+	return result, nil
+}
+
+// mbps returns the rate of n bytes in d in Mbit/s.
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
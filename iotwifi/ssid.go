@@ -0,0 +1,89 @@
+package iotwifi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxSsidLen is the longest SSID, in bytes. An SSID is any bytes: spaces,
+// tabs, quotes, emoji and bytes that are not UTF-8 at all. wpa_supplicant
+// takes an SSID quoted, which cannot hold a quote or a newline, or hex,
+// which holds anything, and reports one with the bytes that are not
+// printable ASCII escaped. SSIDs go to it in hex and are unescaped from
+// what it reports, so an SSID round-trips byte for byte.
+const maxSsidLen = 32
+
+// ValidateSsid checks ssid is 1-32 bytes.
+func ValidateSsid(ssid string) error {
+	if ssid == "" || len(ssid) > maxSsidLen {
+		return fmt.Errorf("ssid must be 1-%d bytes, not %d", maxSsidLen, len(ssid))
+	}
+
+	return nil
+}
+
+// EncodeSsid returns ssid in the hex form wpa_supplicant and hostapd
+// take in place of a quoted SSID.
+func EncodeSsid(ssid string) string {
+	return hex.EncodeToString([]byte(ssid))
+}
+
+// DecodeSsidText reverses the escaping of an SSID reported by
+// wpa_supplicant or hostapd: \\, \", \e, \n, \r, \t and \xNN. Anything
+// else is taken as it is.
+func DecodeSsidText(text string) string {
+	ssid := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 == len(text) {
+			ssid = append(ssid, text[i])
+			continue
+		}
+
+		i++
+		switch text[i] {
+		case '\\', '"':
+			ssid = append(ssid, text[i])
+		case 'e':
+			ssid = append(ssid, '\033')
+		case 'n':
+			ssid = append(ssid, '\n')
+		case 'r':
+			ssid = append(ssid, '\r')
+		case 't':
+			ssid = append(ssid, '\t')
+		case 'x':
+			if i+2 < len(text) {
+				if b, err := strconv.ParseUint(text[i+1:i+3], 16, 8); err == nil {
+					ssid = append(ssid, byte(b))
+					i += 2
+					continue
+				}
+			}
+			ssid = append(ssid, '\\', 'x')
+		default:
+			ssid = append(ssid, '\\', text[i])
+		}
+	}
+
+	return string(ssid)
+}
+
+// plainSsid reports whether ssid can be written as it is in a config
+// line: printable ASCII, without spaces at either end.
+func plainSsid(ssid string) bool {
+	for i := 0; i < len(ssid); i++ {
+		if ssid[i] < 0x20 || ssid[i] > 0x7e {
+			return false
+		}
+	}
+
+	return ssid != "" && ssid[0] != ' ' && ssid[len(ssid)-1] != ' '
+}
+
+// utf8Ssid reports whether ssid is UTF-8 beyond ASCII, which an AP flags
+// so clients display it as such.
+func utf8Ssid(ssid string) bool {
+	return utf8.ValidString(ssid) && utf8.RuneCountInString(ssid) < len(ssid)
+}
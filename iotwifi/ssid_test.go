@@ -0,0 +1,89 @@
+package iotwifi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// escapeSsid escapes ssid the way wpa_supplicant and hostapd report it,
+// with printf_encode.
+func escapeSsid(ssid string) string {
+	text := ""
+	for i := 0; i < len(ssid); i++ {
+		switch b := ssid[i]; {
+		case b == '"' || b == '\\':
+			text += `\` + string(b)
+		case b == '\033':
+			text += `\e`
+		case b == '\n':
+			text += `\n`
+		case b == '\r':
+			text += `\r`
+		case b == '\t':
+			text += `\t`
+		case b >= 0x20 && b <= 0x7e:
+			text += string(b)
+		default:
+			text += fmt.Sprintf(`\x%02x`, b)
+		}
+	}
+
+	return text
+}
+
+func TestDecodeSsidText(t *testing.T) {
+	tests := []struct {
+		text string
+		ssid string
+	}{
+		{`home`, "home"},
+		{`my net`, "my net"},
+		{`say \"hi\"`, `say "hi"`},
+		{`back\\slash`, `back\slash`},
+		{`caf\xc3\xa9`, "café"},
+		{`tab\there`, "tab\there"},
+		{`\e\n\r`, "\033\n\r"},
+		{`\x00\xff`, "\x00\xff"},
+		// not escapes, taken as they are
+		{`\q`, `\q`},
+		{`\xzz`, `\xzz`},
+		{`\x4`, `\x4`},
+		{`end\`, `end\`},
+	}
+
+	for _, tt := range tests {
+		if ssid := DecodeSsidText(tt.text); ssid != tt.ssid {
+			t.Errorf("DecodeSsidText(%q) = %q, want %q", tt.text, ssid, tt.ssid)
+		}
+	}
+}
+
+func FuzzSsid(f *testing.F) {
+	f.Add("home")
+	f.Add(`say "hi"\`)
+	f.Add("café 📶")
+	f.Add("\x00\t\n\r\033\x7f\xff")
+	f.Add("home\nSET update_config 0")
+
+	f.Fuzz(func(t *testing.T, ssid string) {
+		// reported by wpa_supplicant, an ssid decodes to its bytes
+		if decoded := DecodeSsidText(escapeSsid(ssid)); decoded != ssid {
+			t.Fatalf("%q reported as %q decodes to %q", ssid, escapeSsid(ssid), decoded)
+		}
+
+		// sent to it in hex, it is one argument holding its bytes
+		encoded := EncodeSsid(ssid)
+		if decoded, err := hex.DecodeString(encoded); err != nil || string(decoded) != ssid {
+			t.Fatalf("%q encoded as %q decodes to %q, %v", ssid, encoded, decoded, err)
+		}
+		if ValidateSsid(ssid) != nil {
+			return
+		}
+		cmd, err := ctlCommand("SET_NETWORK", "1", "ssid", encoded)
+		if err != nil {
+			t.Fatalf("%q refused: %s", ssid, err)
+		}
+		checkSent(t, cmd, []string{"SET_NETWORK", "1", "ssid", encoded})
+	})
+}
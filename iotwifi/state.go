@@ -0,0 +1,334 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStateFile is where the network state and history are kept.
+const DefaultStateFile = "/etc/txwifi/state.json"
+
+// maxHistory is how many history entries are kept, the oldest are dropped.
+const maxHistory = 200
+
+// History entry types.
+const (
+	HistoryStarted      = "started"      // txwifi started, Message is the version
+	HistoryConnect      = "connect"      // a connection attempt through the API
+	HistoryAssociated   = "associated"   // the station (re)associated, Message is the bssid
+	HistoryDisconnected = "disconnected" // the station lost its network, Reason is the deauth reason code
+	HistoryAPUp         = "ap-up"        // the AP was enabled through the API
+	HistoryAPDown       = "ap-down"      // the AP was disabled through the API
+	HistoryBootstrap    = "bootstrap"    // networks were saved from a setup file, Message is the file
+)
+
+// HistoryEntry is one recorded change of the network state.
+type HistoryEntry struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"`
+	Iface    string        `json:"iface,omitempty"`
+	Ssid     string        `json:"ssid,omitempty"`
+	Success  bool          `json:"success"`
+	Reason   string        `json:"reason,omitempty"` // WRONG_PASSWORD, NETWORK_NOT_FOUND, ...
+	Message  string        `json:"message,omitempty"`
+	Ip       string        `json:"ip,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// NetworkState is what txwifi remembers across reboots: the last good
+// connection, whether the AP was turned off, the SSIDs watched for
+// through the API, the setup files applied, and the history, oldest
+// first.
+type NetworkState struct {
+	LastConnection *HistoryEntry  `json:"last_connection"` // the last successful connect
+	APDisabled     bool           `json:"ap_disabled"`     // the AP was disabled through the API and stays off
+	APChanged      time.Time      `json:"ap_changed"`
+	Watchlist      []WatchEntry   `json:"watchlist,omitempty"`
+	Bootstrapped   []string       `json:"bootstrapped,omitempty"` // sha256 of the setup files applied
+	History        []HistoryEntry `json:"history"`
+}
+
+// StateStore keeps the NetworkState in a JSON file.
+type StateStore struct {
+	path string
+
+	mu    sync.Mutex
+	state NetworkState
+}
+
+// stateStores are the open stores by path. RunWifi and the API each
+// have a WpaCfg, they share the store so neither overwrites the other.
+var (
+	stateStoresMu sync.Mutex
+	stateStores   = map[string]*StateStore{}
+)
+
+// OpenStateStore loads the state in path, or returns the store already
+// open for it. A missing file is an empty state.
+func OpenStateStore(path string) (*StateStore, error) {
+	if path == "" {
+		path = DefaultStateFile
+	}
+
+	stateStoresMu.Lock()
+	defer stateStoresMu.Unlock()
+
+	if store, ok := stateStores[path]; ok {
+		return store, nil
+	}
+
+	store := &StateStore{path: path, state: NetworkState{History: []HistoryEntry{}}}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrConfig, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &store.state); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrConfig, path, err)
+		}
+	}
+
+	stateStores[path] = store
+	return store, nil
+}
+
+// State returns a copy of the state.
+func (s *StateStore) State() NetworkState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.state
+	state.History = append([]HistoryEntry{}, s.state.History...)
+	state.Watchlist = append([]WatchEntry{}, s.state.Watchlist...)
+	state.Bootstrapped = append([]string{}, s.state.Bootstrapped...)
+	if s.state.LastConnection != nil {
+		last := *s.state.LastConnection
+		state.LastConnection = &last
+	}
+
+	return state
+}
+
+// History returns up to limit entries of type entryType, newest first.
+// An empty type matches every entry, a limit of 0 returns them all.
+func (s *StateStore) History(entryType string, limit int) []HistoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []HistoryEntry{}
+	for i := len(s.state.History) - 1; i >= 0; i-- {
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+		if entryType == "" || s.state.History[i].Type == entryType {
+			entries = append(entries, s.state.History[i])
+		}
+	}
+
+	return entries
+}
+
+// Record appends entry to the history, updating the last connection and
+// the AP state it changes, and saves the state.
+func (s *StateStore) Record(entry HistoryEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case entry.Type == HistoryConnect && entry.Success:
+		last := entry
+		s.state.LastConnection = &last
+	case entry.Type == HistoryAPUp, entry.Type == HistoryAPDown:
+		s.state.APDisabled = entry.Type == HistoryAPDown
+		s.state.APChanged = entry.Time
+	}
+
+	s.state.History = append(s.state.History, entry)
+	if len(s.state.History) > maxHistory {
+		s.state.History = append([]HistoryEntry{}, s.state.History[len(s.state.History)-maxHistory:]...)
+	}
+
+	return s.save()
+}
+
+// SetWatchlist replaces the SSIDs watched for through the API and saves
+// the state.
+func (s *StateStore) SetWatchlist(entries []WatchEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.Watchlist = append([]WatchEntry{}, entries...)
+
+	return s.save()
+}
+
+// Bootstrapped reports whether the setup file with the sha256 sum was
+// applied before.
+func (s *StateStore) Bootstrapped(sum string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, applied := range s.state.Bootstrapped {
+		if applied == sum {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetBootstrapped remembers the setup file with the sha256 sum as applied
+// and saves the state.
+func (s *StateStore) SetBootstrapped(sum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.Bootstrapped = append(s.state.Bootstrapped, sum)
+
+	return s.save()
+}
+
+// save writes the state. The caller holds mu.
+func (s *StateStore) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// record adds entry to the history, if there is a store, logging rather
+// than failing when it cannot be saved.
+func (wpa *WpaCfg) record(entry HistoryEntry) {
+	if wpa.State == nil {
+		return
+	}
+
+	if err := wpa.State.Record(entry); err != nil {
+		wpa.Log.Warn("could not save state", "type", entry.Type, "error", err)
+	}
+}
+
+// recordConnect records a connection attempt and its outcome.
+func (wpa *WpaCfg) recordConnect(ssid string, connection WpaConnection, err error, duration time.Duration) {
+	entry := HistoryEntry{
+		Type:     HistoryConnect,
+		Iface:    wpa.Cfg().StationInterface,
+		Ssid:     ssid,
+		Success:  err == nil,
+		Reason:   string(connection.Reason),
+		Message:  connection.Message,
+		Ip:       connection.Ip,
+		Duration: duration,
+	}
+	if err != nil && entry.Message == "" {
+		entry.Message = err.Error()
+	}
+
+	wpa.record(entry)
+}
+
+// RecordEvents records the station associating and losing its network,
+// from the events on bus, until ctx is done.
+func (wpa *WpaCfg) RecordEvents(ctx context.Context, bus *EventBus) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			switch ev.Type {
+			case EventConnected:
+				wpa.record(HistoryEntry{Time: ev.Time, Type: HistoryAssociated, Iface: ev.Iface, Success: true, Message: eventBssid(ev.Message)})
+			case EventDisconnected:
+				wpa.record(HistoryEntry{Time: ev.Time, Type: HistoryDisconnected, Iface: ev.Iface, Reason: eventField(ev.Message, "reason"), Message: eventField(ev.Message, "bssid")})
+			}
+		}
+	}
+}
+
+// eventBssid returns the bssid of a CTRL-EVENT-CONNECTED message,
+// "- Connection to 50:3b:cb:c8:d3:cd completed [id=0 id_str=]".
+func eventBssid(message string) string {
+	for _, field := range strings.Fields(message) {
+		if macR.MatchString(field) {
+			return field
+		}
+	}
+
+	return ""
+}
+
+// RestoreState brings back what was recorded before a restart: the AP
+// stays off if it was disabled through the API, and the network of the
+// last successful connection is enabled again should a failed attempt
+// have left it disabled.
+func (wpa *WpaCfg) RestoreState(ctx context.Context) error {
+	if wpa.State == nil {
+		return nil
+	}
+	state := wpa.State.State()
+
+	if state.APDisabled {
+		// not DisableAP, this is no new toggle to record
+		if err := wpa.hostapdCli(ctx, "disable"); err != nil {
+			return err
+		}
+		wpa.Log.Info("ap kept disabled", "iface", wpa.Cfg().APInterface, "since", state.APChanged)
+	}
+
+	if state.LastConnection == nil {
+		return nil
+	}
+
+	ctx, done, err := wpa.ops.acquire(ctx, OpRestore, state.LastConnection.Ssid)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if network.Ssid != state.LastConnection.Ssid {
+			continue
+		}
+
+		if _, err := wpa.wpaCtl(ctx, "ENABLE_NETWORK", network.Id); err != nil {
+			return fmt.Errorf("%w: enable_network: %s", ErrCommandFailed, err)
+		}
+		wpa.Log.Info("last network enabled", "iface", wpa.Cfg().StationInterface, "ssid", network.Ssid, "net_id", network.Id, "connected", state.LastConnection.Time)
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Provisioning states.
+const (
+	StateBoot         = "BOOT"          // starting, until the station's state is known
+	StateAPSetup      = "AP_SETUP"      // no network to join, waiting on the setup AP to be provisioned
+	StateConnecting   = "CONNECTING"    // joining a network
+	StateOnline       = "ONLINE"        // the station is connected
+	StateOfflineRetry = "OFFLINE_RETRY" // the station lost its network or could not join it, wpa_supplicant retries
+	StateError        = "ERROR"         // a daemon or interface went down
+)
+
+// State machine defaults.
+const (
+	DefaultBootTimeout       = 30 * time.Second
+	DefaultConnectingTimeout = 90 * time.Second
+	DefaultOfflineTimeout    = 5 * time.Minute
+	DefaultErrorTimeout      = time.Minute
+	maxStateTransitions      = 20
+)
+
+// StateMachineCfg sets how long the state machine stays in a state before
+// it moves on, and is used by SetupCfg.
+type StateMachineCfg struct {
+	BootTimeoutSec       int  `json:"boot_timeout_sec"`       // BOOT, then the station's state decides, 30 by default
+	ConnectingTimeoutSec int  `json:"connecting_timeout_sec"` // CONNECTING, then OFFLINE_RETRY, 90 by default
+	OfflineTimeoutSec    int  `json:"offline_timeout_sec"`    // OFFLINE_RETRY, then AP_SETUP, 300 by default
+	ErrorTimeoutSec      int  `json:"error_timeout_sec"`      // ERROR without a restart, then the station's state decides, 60 by default
+	ReopenAP             bool `json:"reopen_ap"`              // open the setup AP again on AP_SETUP, if its window closed it
+}
+
+// timeout returns how long the machine stays in state, zero for as long
+// as it takes.
+func (c StateMachineCfg) timeout(state string) time.Duration {
+	seconds := func(sec int, def time.Duration) time.Duration {
+		if sec > 0 {
+			return time.Duration(sec) * time.Second
+		}
+		return def
+	}
+
+	switch state {
+	case StateBoot:
+		return seconds(c.BootTimeoutSec, DefaultBootTimeout)
+	case StateConnecting:
+		return seconds(c.ConnectingTimeoutSec, DefaultConnectingTimeout)
+	case StateOfflineRetry:
+		return seconds(c.OfflineTimeoutSec, DefaultOfflineTimeout)
+	case StateError:
+		return seconds(c.ErrorTimeoutSec, DefaultErrorTimeout)
+	}
+
+	return 0
+}
+
+// StateTransition is a move of the state machine.
+type StateTransition struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// MachineStatus is the state of the state machine.
+type MachineStatus struct {
+	State       string            `json:"state"`
+	Since       time.Time         `json:"since"`
+	Reason      string            `json:"reason"`
+	Deadline    *time.Time        `json:"deadline,omitempty"` // when the state times out, nil if it does not
+	Transitions []StateTransition `json:"transitions"`        // the last 20, oldest first
+}
+
+// StateMachine follows what the daemon is doing, from BOOT through
+// AP_SETUP, CONNECTING, ONLINE, OFFLINE_RETRY and ERROR, on the events
+// of the station, the API connects and the supervisor. A state that
+// lasts past its timeout moves on: a connect that does not complete is
+// retried by wpa_supplicant in OFFLINE_RETRY, and a station offline for
+// too long falls back to AP_SETUP, opening the setup AP with reopen_ap.
+type StateMachine struct {
+	Wpa       *WpaCfg
+	AP        *APWindow  // opened on AP_SETUP with reopen_ap, optional
+	Telemetry *Telemetry // records each state as a span, optional
+
+	mu          sync.Mutex
+	cfg         StateMachineCfg
+	state       string
+	since       time.Time
+	reason      string
+	transitions []StateTransition
+	changed     chan struct{}
+}
+
+// NewStateMachine produces a StateMachine in BOOT.
+func NewStateMachine(wpa *WpaCfg, ap *APWindow) *StateMachine {
+	return &StateMachine{
+		Wpa:         wpa,
+		AP:          ap,
+		state:       StateBoot,
+		since:       time.Now(),
+		reason:      "started",
+		transitions: []StateTransition{},
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+// Configure applies cfg, timing the current state out anew.
+func (m *StateMachine) Configure(cfg StateMachineCfg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cfg = cfg
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the state and the last transitions.
+func (m *StateMachine) Status() MachineStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := MachineStatus{
+		State:       m.state,
+		Since:       m.since,
+		Reason:      m.reason,
+		Transitions: append([]StateTransition{}, m.transitions...),
+	}
+	if deadline := m.deadline(); !deadline.IsZero() {
+		status.Deadline = &deadline
+	}
+
+	return status
+}
+
+// State returns the current state.
+func (m *StateMachine) State() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.state
+}
+
+// deadline returns when the current state times out, zero if it does
+// not. The caller holds mu.
+func (m *StateMachine) deadline() time.Time {
+	timeout := m.cfg.timeout(m.state)
+	if timeout == 0 {
+		return time.Time{}
+	}
+
+	return m.since.Add(timeout)
+}
+
+// Run moves the machine on the events of bus and the timeouts of its
+// states until ctx is done.
+func (m *StateMachine) Run(ctx context.Context, bus *EventBus) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	for {
+		m.mu.Lock()
+		deadline := m.deadline()
+		m.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-m.changed:
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			m.handle(ctx, ev)
+		case <-expired:
+			m.expire(ctx)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// handle moves the machine on ev.
+func (m *StateMachine) handle(ctx context.Context, ev Event) {
+	cfg := m.Wpa.Cfg()
+	station := ev.Iface == cfg.StationInterface
+	state := m.State()
+
+	switch {
+	case ev.Type == EventComponentDown:
+		m.transition(ctx, StateError, fmt.Sprintf("%s down: %s", ev.Name, ev.Message))
+	case ev.Type == EventComponentRestarted && state == StateError:
+		m.settle(ctx, ev.Name+" restarted")
+	case state == StateError:
+		// the daemons are not all there, only a restart or the timeout
+		// tells what they do
+	case station && ev.Type == EventConnecting:
+		m.transition(ctx, StateConnecting, "connect requested, "+ev.Message)
+	case station && (ev.Type == EventConnected || ev.Type == EventProvisioned):
+		if state != StateOnline {
+			m.transition(ctx, StateOnline, "connected")
+		}
+	case station && ev.Type == EventAPFallback:
+		m.transition(ctx, StateAPSetup, "connect failed, "+ev.Message)
+	case station && ev.Type == EventDisconnected && state == StateOnline:
+		m.transition(ctx, StateOfflineRetry, "disconnected")
+	}
+}
+
+// expire moves the machine on when its state times out.
+func (m *StateMachine) expire(ctx context.Context) {
+	m.mu.Lock()
+	state, timeout := m.state, m.cfg.timeout(m.state)
+	m.mu.Unlock()
+
+	switch state {
+	case StateBoot:
+		m.settle(ctx, "booted")
+	case StateError:
+		m.settle(ctx, fmt.Sprintf("no restart within %s", timeout))
+	case StateConnecting:
+		m.transition(ctx, StateOfflineRetry, fmt.Sprintf("not connected within %s", timeout))
+	case StateOfflineRetry:
+		m.transition(ctx, StateAPSetup, fmt.Sprintf("offline for %s", timeout))
+	}
+}
+
+// settle moves the machine to the state the station is in: ONLINE when
+// it is connected, CONNECTING while it has saved networks to join,
+// AP_SETUP without any.
+func (m *StateMachine) settle(ctx context.Context, reason string) {
+	status, err := m.Wpa.wpaStatus(ctx)
+	switch {
+	case err == nil && status["wpa_state"] == "COMPLETED":
+		m.transition(ctx, StateOnline, reason+", connected to "+status["ssid"])
+	case len(m.Wpa.Profiles.List()) > 0:
+		m.transition(ctx, StateConnecting, reason+", joining the saved networks")
+	default:
+		m.transition(ctx, StateAPSetup, reason+", no saved networks")
+	}
+}
+
+// transition moves the machine to state, publishes the state-changed
+// event and does what the state asks for.
+func (m *StateMachine) transition(ctx context.Context, state string, reason string) {
+	wpa := m.Wpa
+
+	m.mu.Lock()
+	from, entered := m.state, m.since
+	m.state, m.since, m.reason = state, time.Now(), reason
+	m.transitions = append(m.transitions, StateTransition{Time: m.since, From: from, To: state, Reason: reason})
+	if len(m.transitions) > maxStateTransitions {
+		m.transitions = append([]StateTransition{}, m.transitions[len(m.transitions)-maxStateTransitions:]...)
+	}
+	reopen := m.cfg.ReopenAP
+	m.mu.Unlock()
+
+	wpa.Log.Info("provisioning state changed", "from", from, "to", state, "reason", reason)
+	m.Telemetry.StateChanged(from, entered, state, reason)
+	wpa.publish(Event{
+		Type:    EventStateChanged,
+		Source:  "state-machine",
+		Iface:   wpa.Cfg().StationInterface,
+		Name:    state,
+		Message: fmt.Sprintf("from=%s to=%s reason=%q", from, state, reason),
+	})
+
+	// an AP disabled through the API stays off
+	if state != StateAPSetup || !reopen || m.AP == nil || m.AP.Status().Open {
+		return
+	}
+	if wpa.State != nil && wpa.State.State().APDisabled {
+		return
+	}
+	if _, err := m.AP.Open(ctx); err != nil {
+		wpa.Log.Error("could not open setup ap", "iface", wpa.Cfg().APInterface, "error", err)
+	}
+}
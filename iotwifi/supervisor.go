@@ -0,0 +1,270 @@
+package iotwifi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Components watched by the Supervisor.
+const (
+	ComponentApInterface   = "ap_interface"
+	ComponentHostapd       = "hostapd"
+	ComponentWpaSupplicant = "wpa_supplicant"
+	ComponentDnsmasq       = "dnsmasq"
+)
+
+// Supervisor defaults.
+const (
+	DefaultSupervisorInterval = 10 * time.Second
+	DefaultMinBackoff         = 5 * time.Second
+	DefaultMaxBackoff         = 5 * time.Minute
+)
+
+// SupervisorCfg configures the Supervisor and is used by SetupCfg.
+type SupervisorCfg struct {
+	Enabled       bool `json:"enabled"`
+	IntervalSec   int  `json:"interval_sec"`    // how often to check, 10 by default
+	MaxBackoffSec int  `json:"max_backoff_sec"` // longest wait between restarts, 300 by default
+}
+
+// RecoveryCounter counts the recoveries of one component.
+type RecoveryCounter struct {
+	Failures    int       `json:"failures"`     // failures since the component was last stable
+	Restarts    int       `json:"restarts"`     // restarts since the daemon started
+	LastFailure time.Time `json:"last_failure"` // zero if it never failed
+	LastError   string    `json:"last_error"`
+}
+
+// Supervisor watches the AP interface and the hostapd, wpa_supplicant
+// and dnsmasq children, and restarts any that disappear with exponential
+// backoff between attempts. The children the process supervisor is still
+// restarting by their restart policy are left to it.
+type Supervisor struct {
+	Log        Logger
+	Events     *EventBus // optional, receives component-down and component-restarted
+	Interval   time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu       sync.Mutex
+	counters map[string]*RecoveryCounter
+	next     map[string]time.Time
+}
+
+// NewSupervisor produces a Supervisor with default timings.
+func NewSupervisor(log Logger, bus *EventBus) *Supervisor {
+	return &Supervisor{
+		Log:        log,
+		Events:     bus,
+		Interval:   DefaultSupervisorInterval,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		counters:   make(map[string]*RecoveryCounter),
+		next:       make(map[string]time.Time),
+	}
+}
+
+// Configure applies cfg over the default timings.
+func (s *Supervisor) Configure(cfg SupervisorCfg) {
+	if cfg.IntervalSec > 0 {
+		s.Interval = time.Duration(cfg.IntervalSec) * time.Second
+	}
+	if cfg.MaxBackoffSec > 0 {
+		s.MaxBackoff = time.Duration(cfg.MaxBackoffSec) * time.Second
+	}
+}
+
+// Counters returns a copy of the recovery counters by component.
+func (s *Supervisor) Counters() map[string]RecoveryCounter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counters := make(map[string]RecoveryCounter, len(s.counters))
+	for component, counter := range s.counters {
+		counters[component] = *counter
+	}
+
+	return counters
+}
+
+// Run checks the components of command every Interval until ctx is done.
+func (s *Supervisor) Run(ctx context.Context, command *Command) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.Interval):
+		}
+
+		s.check(command)
+	}
+}
+
+// check restarts every component that is down and not backing off.
+func (s *Supervisor) check(command *Command) {
+	cfg := command.Cfg()
+
+	// hostapd and dnsmasq are bound to the AP interface, so a missing
+	// interface takes them down with it
+	if _, err := netif.LinkByName(cfg.APInterface); err != nil {
+		s.recover(ComponentApInterface, cfg.APInterface, err.Error(), func() error {
+			command.Processes.Stop(ComponentHostapd)
+			command.StopDnsmasq()
+
+			if err := command.AddApInterface(); err != nil {
+				return err
+			}
+			if err := command.UpApInterface(); err != nil {
+				return err
+			}
+			if err := command.ConfigureApInterface(); err != nil {
+				return err
+			}
+
+			if err := command.StartHostapd(); err != nil {
+				return err
+			}
+			command.StartDnsmasq()
+
+			return nil
+		})
+		return
+	}
+	s.healthy(ComponentApInterface)
+
+	if !command.Processes.Active(ComponentHostapd) {
+		s.recover(ComponentHostapd, cfg.APInterface, "process stopped", command.StartHostapd)
+	} else {
+		s.healthy(ComponentHostapd)
+	}
+
+	// NetworkManager runs the wpa_supplicant of the station
+	if !cfg.NetworkManager.Enabled {
+		if !command.Processes.Active(ComponentWpaSupplicant) {
+			s.recover(ComponentWpaSupplicant, cfg.StationInterface, "process stopped", func() error {
+				command.StartWpaSupplicant()
+				return nil
+			})
+		} else {
+			s.healthy(ComponentWpaSupplicant)
+		}
+
+		for _, radio := range cfg.Radios {
+			radio := radio
+			component := radioComponent(radio.Interface)
+
+			if !command.Processes.Active(component) {
+				s.recover(component, radio.Interface, "process stopped", func() error {
+					return command.StartRadio(radio)
+				})
+			} else {
+				s.healthy(component)
+			}
+		}
+	}
+
+	// a bridged AP runs no dnsmasq
+	if cfg.Bridge.Enabled {
+		return
+	}
+
+	if !command.DnsmasqActive() {
+		s.recover(ComponentDnsmasq, cfg.APInterface, "process stopped", func() error {
+			command.StartDnsmasq()
+			return nil
+		})
+	} else {
+		s.healthy(ComponentDnsmasq)
+	}
+}
+
+// recover restarts component with restart unless it is backing off from
+// an earlier attempt.
+func (s *Supervisor) recover(component string, iface string, reason string, restart func() error) {
+	s.mu.Lock()
+	if time.Now().Before(s.next[component]) {
+		s.mu.Unlock()
+		return
+	}
+
+	counter, ok := s.counters[component]
+	if !ok {
+		counter = &RecoveryCounter{}
+		s.counters[component] = counter
+	}
+	counter.Failures++
+	counter.LastFailure = time.Now()
+	counter.LastError = reason
+
+	backoff := s.backoff(counter.Failures)
+	s.next[component] = time.Now().Add(backoff)
+	failures := counter.Failures
+	s.mu.Unlock()
+
+	s.Log.Warn("component down", "component", component, "iface", iface, "reason", reason, "failures", failures)
+	s.publish(EventComponentDown, component, reason)
+
+	start := time.Now()
+	if err := restart(); err != nil {
+		s.Log.Error("component restart failed", "component", component, "iface", iface, "error", err, "retry_in", backoff)
+		s.mu.Lock()
+		counter.LastError = err.Error()
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	counter.Restarts++
+	restarts := counter.Restarts
+	s.mu.Unlock()
+
+	s.Log.Info("component restarted", "component", component, "iface", iface, "restarts", restarts, "duration", time.Since(start))
+	s.publish(EventComponentRestarted, component, reason)
+}
+
+// healthy resets the failure count of a component once it has stayed up
+// longer than the longest backoff.
+func (s *Supervisor) healthy(component string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, ok := s.counters[component]
+	if !ok || counter.Failures == 0 {
+		return
+	}
+
+	if time.Since(counter.LastFailure) > s.MaxBackoff {
+		counter.Failures = 0
+	}
+}
+
+// backoff doubles MinBackoff for every failure, up to MaxBackoff.
+func (s *Supervisor) backoff(failures int) time.Duration {
+	backoff := s.MinBackoff
+	for i := 1; i < failures && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > s.MaxBackoff {
+		backoff = s.MaxBackoff
+	}
+
+	return backoff
+}
+
+// publish sends a supervisor event if there is a bus to send it on.
+func (s *Supervisor) publish(evType string, component string, message string) {
+	if s.Events == nil {
+		return
+	}
+
+	s.Events.Publish(Event{
+		Type:    evType,
+		Source:  "supervisor",
+		Name:    component,
+		Message: message,
+	})
+}
@@ -0,0 +1,486 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// Site survey defaults.
+const (
+	DefaultSurveyScans = 3
+	MaxSurveyScans     = 10
+	surveyScanGap      = 2 * time.Second
+	surveyHysteresis   = 0.5 // how much lower the score of a channel must be for auto_channel to move the AP
+)
+
+// surveyBuckets are the bounds, in dBm, of ChannelUsage.Signals.
+var surveyBuckets = []int{-50, -60, -70, -80}
+
+// surveyChannels are the channels recommended when the radio's channels
+// are unknown: the three that do not overlap on 2.4GHz, and the 5GHz ones
+// without DFS.
+var surveyChannels = map[string][]int{
+	Band24: {1, 6, 11},
+	Band5:  {36, 40, 44, 48, 149, 153, 157, 161, 165},
+}
+
+// SurveyCfg configures the site survey and is used by SetupCfg.
+type SurveyCfg struct {
+	Scans       int  `json:"scans"`        // scans a survey aggregates, 3 by default
+	AutoChannel bool `json:"auto_channel"` // move the AP to the least congested channel at startup
+	IntervalSec int  `json:"interval_sec"` // and survey again this often, 0 for only at startup
+}
+
+// SurveyRequest asks for a site survey.
+type SurveyRequest struct {
+	Scans int    `json:"scans"` // survey.scans by default
+	Band  string `json:"band"`  // 2.4GHz or 5GHz, of the channel recommended, the AP's by default
+	Apply bool   `json:"apply"` // move the AP to the recommended channel
+}
+
+// ChannelUsage is how busy a channel is.
+type ChannelUsage struct {
+	Channel     int     `json:"channel"`
+	Band        string  `json:"band"`
+	Frequency   int     `json:"frequency"`          // MHz
+	Aps         int     `json:"aps"`                // BSSs on the channel
+	Overlapping int     `json:"overlapping"`        // BSSs on the 2.4GHz channels that overlap it
+	RssiMax     int     `json:"rssi_max,omitempty"` // dBm, of the BSSs on the channel
+	RssiAvg     int     `json:"rssi_avg,omitempty"`
+	Signals     []int   `json:"signals"`   // BSSs on the channel above -50, -50 to -60, -60 to -70, -70 to -80 and below -80 dBm
+	Score       float64 `json:"score"`     // congestion, the BSSs weighed by signal and overlap, lower is better
+	Candidate   bool    `json:"candidate"` // the AP may use it
+}
+
+// SurveyReport is what a site survey found and the channel it
+// recommends for the AP.
+type SurveyReport struct {
+	Time        time.Time      `json:"time"`
+	Scans       int            `json:"scans"`
+	Bss         int            `json:"bss"`      // distinct BSSs seen
+	Channels    []ChannelUsage `json:"channels"` // by band and channel
+	Band        string         `json:"band"`     // of the recommendation
+	APChannel   int            `json:"ap_channel"`
+	Recommended int            `json:"recommended_channel"`
+	Applied     bool           `json:"applied"` // the AP moved to the recommended channel
+}
+
+// usage returns the entry of channel in band, nil if there is none.
+func (r *SurveyReport) usage(channel int, band string) *ChannelUsage {
+	for i := range r.Channels {
+		if r.Channels[i].Channel == channel && r.Channels[i].Band == band {
+			return &r.Channels[i]
+		}
+	}
+
+	return nil
+}
+
+// surveyBss is a BSS seen by the scans of a survey.
+type surveyBss struct {
+	channel int
+	band    string
+	rssi    int // the sum over the scans that saw it
+	seen    int
+}
+
+// SiteSurvey aggregates repeated scans into how busy each channel is and
+// recommends the least congested one for the AP, and with auto_channel
+// moves the AP there. One survey runs at a time.
+type SiteSurvey struct {
+	Wpa   *WpaCfg
+	Scans *ScanManager
+
+	mu      sync.Mutex
+	cfg     SurveyCfg
+	running bool
+	last    *SurveyReport
+	changed chan struct{}
+}
+
+// NewSiteSurvey produces a SiteSurvey scanning with scans.
+func NewSiteSurvey(wpa *WpaCfg, scans *ScanManager) *SiteSurvey {
+	return &SiteSurvey{
+		Wpa:     wpa,
+		Scans:   scans,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Configure applies cfg.
+func (s *SiteSurvey) Configure(cfg SurveyCfg) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Last returns the last survey, nil if none ran.
+func (s *SiteSurvey) Last() *SurveyReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.last
+}
+
+// Run surveys and moves the AP at startup, and every interval_sec after,
+// until ctx is done. It idles while auto_channel is off.
+func (s *SiteSurvey) Run(ctx context.Context) {
+	first := true
+
+	for {
+		s.mu.Lock()
+		cfg := s.cfg
+		s.mu.Unlock()
+
+		var tick <-chan time.Time
+		switch {
+		case !cfg.AutoChannel:
+		case first:
+			tick = time.After(0)
+		case cfg.IntervalSec > 0:
+			tick = time.After(time.Duration(cfg.IntervalSec) * time.Second)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+			continue
+		case <-tick:
+		}
+		first = false
+
+		if _, err := s.survey(ctx, SurveyRequest{Apply: true}, surveyHysteresis); err != nil {
+			s.Wpa.Log.Warn("auto channel failed", "iface", s.Wpa.Cfg().APInterface, "error", err)
+		}
+	}
+}
+
+// Survey scans req.Scans times, a few seconds apart, and reports how
+// busy each channel is. With req.Apply the AP moves to the recommended
+// channel.
+func (s *SiteSurvey) Survey(ctx context.Context, req SurveyRequest) (SurveyReport, error) {
+	return s.survey(ctx, req, 0)
+}
+
+// survey is Survey, only moving the AP when the recommended channel's
+// score is at least gain below that of the AP's channel.
+func (s *SiteSurvey) survey(ctx context.Context, req SurveyRequest, gain float64) (SurveyReport, error) {
+	s.mu.Lock()
+	cfg := s.cfg
+	if s.running {
+		s.mu.Unlock()
+		return SurveyReport{}, fmt.Errorf("%w: a survey is already running", ErrBusy)
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	if req.Scans == 0 {
+		req.Scans = cfg.Scans
+	}
+	if req.Scans == 0 {
+		req.Scans = DefaultSurveyScans
+	}
+	if req.Scans < 0 || req.Scans > MaxSurveyScans {
+		return SurveyReport{}, fmt.Errorf("%w: scans must be within 1-%d", ErrInvalid, MaxSurveyScans)
+	}
+
+	ap := s.Wpa.Cfg().HostApdCfg.withDefaults()
+	if req.Band == "" {
+		req.Band = ap.Band
+	}
+	if req.Band != Band24 && req.Band != Band5 {
+		return SurveyReport{}, fmt.Errorf("%w: unknown band %q, want %s or %s", ErrInvalid, req.Band, Band24, Band5)
+	}
+
+	// the AP's own BSS is no neighbor
+	own := ""
+	if link, err := netif.LinkByName(s.Wpa.Cfg().APInterface); err == nil {
+		own = strings.ToLower(link.Mac)
+	}
+
+	bsss := map[string]*surveyBss{}
+	for i := 0; i < req.Scans; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return SurveyReport{}, ctx.Err()
+			case <-time.After(surveyScanGap):
+			}
+		}
+
+		results, err := s.Scans.Scan(ctx)
+		if err != nil {
+			return SurveyReport{}, err
+		}
+
+		for _, network := range results.Networks {
+			for _, bss := range network.Bss {
+				bssid := strings.ToLower(bss.Bssid)
+				if bssid == own || bss.Channel == 0 {
+					continue
+				}
+
+				b, ok := bsss[bssid]
+				if !ok {
+					b = &surveyBss{channel: bss.Channel, band: bss.Band}
+					bsss[bssid] = b
+				}
+				b.rssi += bss.SignalLevel
+				b.seen++
+			}
+		}
+	}
+
+	report := SurveyReport{
+		Time:     time.Now(),
+		Scans:    req.Scans,
+		Bss:      len(bsss),
+		Channels: []ChannelUsage{},
+		Band:     req.Band,
+	}
+	if ap.Band == req.Band {
+		report.APChannel, _ = strconv.Atoi(ap.Channel)
+	}
+
+	channel := func(c int, band string) *ChannelUsage {
+		if u := report.usage(c, band); u != nil {
+			return u
+		}
+		report.Channels = append(report.Channels, ChannelUsage{
+			Channel:   c,
+			Band:      band,
+			Frequency: ChannelFrequency(c, band),
+			Signals:   make([]int, len(surveyBuckets)+1),
+		})
+		return &report.Channels[len(report.Channels)-1]
+	}
+
+	for _, c := range s.candidates(ctx, req.Band) {
+		channel(c, req.Band).Candidate = true
+	}
+	for _, b := range bsss {
+		channel(b.channel, b.band)
+	}
+
+	for i := range report.Channels {
+		u := &report.Channels[i]
+		rssiSum := 0
+
+		for _, b := range bsss {
+			if b.band != u.Band {
+				continue
+			}
+
+			rssi := b.rssi / b.seen
+			overlap := surveyOverlap(u.Channel, b.channel, u.Band)
+			if overlap == 0 {
+				continue
+			}
+
+			// a BSS heard in a few of the scans is there part of the time
+			u.Score += overlap * float64(SignalQuality(rssi)) / 100 * float64(b.seen) / float64(req.Scans)
+
+			if b.channel != u.Channel {
+				u.Overlapping++
+				continue
+			}
+
+			u.Aps++
+			rssiSum += rssi
+			if u.Aps == 1 || rssi > u.RssiMax {
+				u.RssiMax = rssi
+			}
+			bucket := len(surveyBuckets)
+			for j, bound := range surveyBuckets {
+				if rssi > bound {
+					bucket = j
+					break
+				}
+			}
+			u.Signals[bucket]++
+		}
+
+		if u.Aps > 0 {
+			u.RssiAvg = rssiSum / u.Aps
+		}
+		u.Score = math.Round(u.Score*100) / 100
+	}
+
+	sort.Slice(report.Channels, func(i, j int) bool {
+		a, b := report.Channels[i], report.Channels[j]
+		if a.Band != b.Band {
+			return a.Band < b.Band
+		}
+		return a.Channel < b.Channel
+	})
+
+	// the least congested candidate, then the one with the fewest APs,
+	// then the AP's own, so it does not move for nothing
+	var best *ChannelUsage
+	for i := range report.Channels {
+		u := &report.Channels[i]
+		if !u.Candidate {
+			continue
+		}
+		if best == nil || u.Score < best.Score ||
+			(u.Score == best.Score && (u.Aps < best.Aps || (u.Aps == best.Aps && u.Channel == report.APChannel))) {
+			best = u
+		}
+	}
+	if best != nil {
+		report.Recommended = best.Channel
+	}
+
+	s.Wpa.Log.Info("site survey", "iface", s.Wpa.Cfg().StationInterface, "scans", report.Scans, "bss", report.Bss, "band", report.Band, "ap_channel", report.APChannel, "recommended", report.Recommended)
+
+	if req.Apply && report.Recommended != 0 && report.Recommended != report.APChannel {
+		current := report.usage(report.APChannel, report.Band)
+		if current == nil || current.Score-best.Score >= gain {
+			if err := s.apply(ctx, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.last = &report
+	s.mu.Unlock()
+
+	return report, nil
+}
+
+// apply moves the AP to the recommended channel of report. An AP that
+// follows the station, or shares a radio of one channel with the
+// connected station, stays where it is.
+func (s *SiteSurvey) apply(ctx context.Context, report *SurveyReport) error {
+	wpa := s.Wpa
+	cfg := wpa.Cfg()
+	iface := cfg.APInterface
+
+	if cfg.HostApdCfg.FollowStationChannel {
+		return fmt.Errorf("%w: the ap follows the station's channel, unset host_apd_cfg.follow_station_channel", ErrInvalid)
+	}
+
+	if !cfg.APDedicated {
+		status, err := wpa.wpaStatus(ctx)
+		if err == nil && status["wpa_state"] == "COMPLETED" {
+			freq, _ := strconv.Atoi(status["freq"])
+			channel, band := FrequencyChannel(freq)
+			phy, err := wpa.apPhy(ctx)
+			if (err != nil || phy.APSTAChannels < 2) && (channel != report.Recommended || band != report.Band) {
+				return fmt.Errorf("%w: the ap shares its radio with the station, on channel %d", ErrInvalid, channel)
+			}
+		}
+	}
+
+	from := report.APChannel
+	how, err := wpa.switchAPChannel(ctx, report.Recommended, report.Band)
+	if err != nil {
+		return err
+	}
+	report.Applied = true
+
+	wpa.Log.Info("ap channel changed", "iface", iface, "from", from, "channel", report.Recommended, "band", report.Band, "switch", how)
+	wpa.publish(Event{
+		Type:    EventAPChannelChanged,
+		Source:  "survey",
+		Iface:   iface,
+		Message: fmt.Sprintf("channel=%d band=%s from=%d", report.Recommended, report.Band, from),
+	})
+
+	return nil
+}
+
+// candidates returns the channels of band the AP may use: of the
+// radio's, those allowed without radar detection, and on 2.4GHz only
+// the ones that do not overlap.
+func (s *SiteSurvey) candidates(ctx context.Context, band string) []int {
+	phy, err := s.Wpa.apPhy(ctx)
+	if err != nil {
+		return surveyChannels[band]
+	}
+
+	b := phy.band(band)
+	if b == nil {
+		return []int{}
+	}
+
+	channels := []int{}
+	for _, c := range b.Channels {
+		if c.Disabled || c.NoIR || c.Radar {
+			continue
+		}
+		if band == Band24 && c.Channel != 1 && c.Channel != 6 && c.Channel != 11 {
+			continue
+		}
+		channels = append(channels, c.Channel)
+	}
+
+	return channels
+}
+
+// apPhy returns the capabilities of the radio of the AP.
+func (wpa *WpaCfg) apPhy(ctx context.Context) (PhyCapabilities, error) {
+	phys, err := wpa.Capabilities(ctx)
+	if err != nil {
+		return PhyCapabilities{}, err
+	}
+
+	iface := wpa.Cfg().APInterface
+	if !wpa.Cfg().APDedicated {
+		iface = wpa.Cfg().StationInterface
+	}
+	for _, phy := range phys {
+		for _, i := range phy.Ifaces {
+			if i == iface {
+				return phy, nil
+			}
+		}
+	}
+
+	return PhyCapabilities{}, fmt.Errorf("%w: no radio for %s", ErrCommandFailed, iface)
+}
+
+// surveyOverlap returns how much a BSS on channel other interferes with
+// channel, 1 on the same channel. 2.4GHz channels are 5 MHz apart and 20
+// MHz wide, so those within 4 of each other overlap, less the further
+// apart they are. Channel widths are not scanned, so the wider channels
+// of 5GHz BSSs are not counted.
+func surveyOverlap(channel int, other int, band string) float64 {
+	if channel == other {
+		return 1
+	}
+	if band != Band24 || channel == 14 || other == 14 {
+		return 0
+	}
+
+	d := channel - other
+	if d < 0 {
+		d = -d
+	}
+	if d >= 5 {
+		return 0
+	}
+
+	return float64(5-d) / 5
+}
@@ -0,0 +1,229 @@
+// Package systemd lets txwifi run as a systemd service without libsystemd:
+// readiness and watchdog notifications over $NOTIFY_SOCKET, the listeners
+// of socket activation, and structured logging to the journal over its
+// native protocol.
+package systemd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Notifications for Notify.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// JournalSocket is where journald reads native protocol entries.
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Status returns the notification setting the status line shown by
+// systemctl status.
+func Status(status string) string {
+	return "STATUS=" + strings.Replace(status, "\n", " ", -1)
+}
+
+// Notify sends the notifications in states to the service manager. It
+// returns false, and no error, when not run by systemd with
+// Type=notify.
+func Notify(states ...string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	// abstract sockets start with @
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// WatchdogInterval returns the interval WatchdogSec= set, in which the
+// service must send Watchdog, or 0 when the watchdog is off.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+
+	// the watchdog may be meant for another process of the service
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Listeners returns the listeners passed by socket activation, by their
+// FileDescriptorName=, none when the service was not socket activated.
+// The environment variables are unset so children do not inherit them.
+func Listeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return listeners, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		name := "fd" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener dups the descriptor, close-on-exec
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("socket %s: %s", name, err)
+		}
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+// JournalStream reports whether stdout is connected to the journal, as
+// systemd sets up with StandardOutput=journal.
+func JournalStream() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	return stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// Priorities of journal entries, as syslog's.
+const (
+	PriErr     = 3
+	PriWarning = 4
+	PriInfo    = 6
+	PriDebug   = 7
+)
+
+// Journal writes entries to journald over its native protocol.
+type Journal struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// OpenJournal produces a Journal sending to JournalSocket.
+func OpenJournal() (*Journal, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{conn: conn, addr: &net.UnixAddr{Name: JournalSocket, Net: "unixgram"}}, nil
+}
+
+// Send writes an entry of message at priority with fields, whose names
+// must be upper case letters, digits and underscores.
+func (j *Journal) Send(priority int, message string, fields map[string]string) error {
+	var entry []byte
+	entry = appendField(entry, "MESSAGE", message)
+	entry = appendField(entry, "PRIORITY", strconv.Itoa(priority))
+	for name, value := range fields {
+		entry = appendField(entry, name, value)
+	}
+
+	_, err := j.conn.WriteToUnix(entry, j.addr)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return fmt.Errorf("journal entry of %d bytes is too large", len(entry))
+	}
+
+	return err
+}
+
+// Close closes the connection to journald.
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
+
+// appendField appends a field to a native protocol entry, values with
+// newlines in the binary form: the name, a newline, the length as a
+// little endian uint64 and the value.
+func appendField(entry []byte, name string, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(append(append(append(entry, name...), '='), value...), '\n')
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+
+	entry = append(append(entry, name...), '\n')
+	entry = append(append(entry, size[:]...), value...)
+
+	return append(entry, '\n')
+}
+
+// FieldName turns a log key into a journal field name: upper case, with
+// anything but letters and digits as underscores. Names journald would
+// reject, starting with an underscore or a digit, get an F_ prefix.
+func FieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		name = append([]byte("F_"), name...)
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return string(name)
+}
@@ -0,0 +1,706 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// Telemetry defaults and bounds.
+const (
+	DefaultTelemetryService  = "txwifi"
+	DefaultTelemetryInterval = 10 * time.Second
+	maxTelemetrySpans        = 2048 // buffered between exports, the oldest are dropped first
+	telemetryExportTimeout   = 10 * time.Second
+	telemetryScope           = "github.com/kinokochat/txwifi/iotwifi"
+)
+
+// Span kinds, as OTLP numbers them.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// OTLP span status codes.
+const (
+	spanStatusOk    = 1
+	spanStatusError = 2
+)
+
+// telemetryBounds are the buckets of the duration histograms, in seconds.
+var telemetryBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// TelemetryCfg configures the OpenTelemetry export and is used by
+// SetupCfg. Without an endpoint, from the config or the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT, nothing is recorded.
+type TelemetryCfg struct {
+	Endpoint    string            `json:"endpoint"`     // OTLP/HTTP collector, such as http://collector:4318
+	Headers     map[string]string `json:"headers"`      // sent with every export, such as an API key
+	ServiceName string            `json:"service_name"` // txwifi by default, or OTEL_SERVICE_NAME
+	IntervalSec int               `json:"interval_sec"` // between exports, 10 by default
+	Attributes  map[string]string `json:"attributes"`   // added to the resource, such as the site of the device
+}
+
+// withEnv fills in the endpoint and service name from the standard
+// OpenTelemetry environment.
+func (c TelemetryCfg) withEnv() TelemetryCfg {
+	if c.Endpoint == "" {
+		c.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = getEnvDefault("OTEL_SERVICE_NAME", DefaultTelemetryService)
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+
+	return c
+}
+
+// getEnvDefault returns the environment variable key, def if unset.
+func getEnvDefault(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return def
+}
+
+// spanContext identifies a span within its trace.
+type spanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+}
+
+type spanKey struct{}
+
+// parseTraceparent returns the trace context of a W3C traceparent header,
+// the span of the caller, so the spans of a request join its trace. Later
+// versions may add fields, version 00 has four.
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || !lowerHex(fields[0], 2) || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return sc, false
+	}
+	if !lowerHex(fields[1], 32) || !lowerHex(fields[2], 16) || !lowerHex(fields[3], 2) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceId[:], []byte(fields[1]))
+	hex.Decode(sc.SpanId[:], []byte(fields[2]))
+	if sc.TraceId == ([16]byte{}) || sc.SpanId == ([8]byte{}) {
+		return sc, false
+	}
+
+	return sc, true
+}
+
+// lowerHex reports whether s is n lowercase hex digits, as traceparent
+// fields are.
+func lowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WithRemoteParent returns a copy of ctx whose spans are children of the
+// caller's span in header, a W3C traceparent. ctx is returned as it is
+// when header is not a valid traceparent.
+func WithRemoteParent(ctx context.Context, header string) context.Context {
+	sc, ok := parseTraceparent(header)
+	if !ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanKey{}, &Span{sc: sc})
+}
+
+// Traceparent returns the W3C traceparent header of the span of ctx, for
+// the response or a request it makes, empty without a span.
+func Traceparent(ctx context.Context) string {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	if span == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(span.sc.TraceId[:]), hex.EncodeToString(span.sc.SpanId[:]))
+}
+
+// Span is an operation traced by Telemetry. The methods of a nil Span do
+// nothing, so callers need not check whether telemetry is on.
+type Span struct {
+	t      *Telemetry
+	sc     spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  map[string]interface{}
+	status int
+	msg    string
+}
+
+// SetAttr sets the attribute key, a string, bool, int or float64.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil || s.t == nil {
+		return
+	}
+
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.attrs[key] = value
+}
+
+// SetError marks the span failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || s.t == nil || err == nil {
+		return
+	}
+
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.status, s.msg = spanStatusError, secrets.scrub(err.Error())
+}
+
+// End ends the span, it is exported with the next batch. Ending it again
+// does nothing.
+func (s *Span) End() {
+	if s == nil || s.t == nil {
+		return
+	}
+
+	s.t.finish(s, time.Now())
+}
+
+// metricPoint is the value of an instrument for one set of attributes.
+type metricPoint struct {
+	attrs   map[string]interface{}
+	count   uint64
+	sum     float64
+	buckets []uint64 // of a histogram, one past the bounds
+}
+
+// instrument is a counter or a histogram.
+type instrument struct {
+	name      string
+	unit      string
+	desc      string
+	histogram bool
+	points    map[string]*metricPoint
+}
+
+// Telemetry records spans of the API requests, the commands they run and
+// the provisioning states, and metrics of them, and exports both to an
+// OpenTelemetry collector over OTLP/HTTP, so fleet operators can follow a
+// request from their backend onto the device. A nil Telemetry records
+// nothing.
+type Telemetry struct {
+	Wpa     *WpaCfg
+	Events  *Metrics // exported as the txwifi.events counter, optional
+	Version string   // of txwifi, for the resource
+
+	cfg         TelemetryCfg
+	client      *http.Client
+	started     time.Time
+	mu          sync.Mutex
+	spans       []*Span
+	dropped     int
+	instruments map[string]*instrument
+}
+
+// NewTelemetry produces Telemetry for the telemetry config of wpa, nil
+// when no endpoint is configured.
+func NewTelemetry(wpa *WpaCfg) *Telemetry {
+	cfg := wpa.Cfg().Telemetry.withEnv()
+	if cfg.Endpoint == "" {
+		return nil
+	}
+
+	return &Telemetry{
+		Wpa:         wpa,
+		cfg:         cfg,
+		client:      &http.Client{Timeout: telemetryExportTimeout},
+		started:     time.Now(),
+		instruments: map[string]*instrument{},
+	}
+}
+
+// StartSpan starts the span name as a child of the span of ctx, if it has
+// one, and returns a copy of ctx carrying the new span.
+func (t *Telemetry) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{t: t, name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent, _ := ctx.Value(spanKey{}).(*Span); parent != nil {
+		span.sc.TraceId = parent.sc.TraceId
+		span.parent = parent.sc.SpanId
+	} else {
+		rand.Read(span.sc.TraceId[:])
+	}
+	rand.Read(span.sc.SpanId[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// HasSpan reports whether ctx carries a span, local or remote.
+func HasSpan(ctx context.Context) bool {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span != nil
+}
+
+// finish ends span at end and queues it for export, unless it ended
+// before.
+func (t *Telemetry) finish(span *Span, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !span.end.IsZero() {
+		return
+	}
+	span.end = end
+	if span.status == 0 {
+		span.status = spanStatusOk
+	}
+	t.spans = append(t.spans, span)
+	if len(t.spans) > maxTelemetrySpans {
+		t.dropped += len(t.spans) - maxTelemetrySpans
+		t.spans = append([]*Span{}, t.spans[len(t.spans)-maxTelemetrySpans:]...)
+	}
+}
+
+// Count adds n to the counter name for attrs.
+func (t *Telemetry) Count(name string, desc string, n uint64, attrs map[string]interface{}) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	point := t.point(name, "1", desc, false, attrs)
+	point.count += n
+}
+
+// Observe records a duration in the histogram name for attrs.
+func (t *Telemetry) Observe(name string, desc string, d time.Duration, attrs map[string]interface{}) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seconds := d.Seconds()
+	point := t.point(name, "s", desc, true, attrs)
+	point.count++
+	point.sum += seconds
+	i := sort.SearchFloat64s(telemetryBounds, seconds)
+	point.buckets[i]++
+}
+
+// point returns the point of the instrument name for attrs, creating
+// both as needed. The caller holds mu.
+func (t *Telemetry) point(name string, unit string, desc string, histogram bool, attrs map[string]interface{}) *metricPoint {
+	inst, ok := t.instruments[name]
+	if !ok {
+		inst = &instrument{name: name, unit: unit, desc: desc, histogram: histogram, points: map[string]*metricPoint{}}
+		t.instruments[name] = inst
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// quoted, so values holding = or ; cannot make another set's id
+	id := ""
+	for _, key := range keys {
+		id += fmt.Sprintf("%q=%#v;", key, attrs[key])
+	}
+
+	point, ok := inst.points[id]
+	if !ok {
+		point = &metricPoint{attrs: attrs}
+		if histogram {
+			point.buckets = make([]uint64, len(telemetryBounds)+1)
+		}
+		inst.points[id] = point
+	}
+
+	return point
+}
+
+// StateChanged records the provisioning state from, entered at since, as
+// a span ending now, and counts the transition.
+func (t *Telemetry) StateChanged(from string, since time.Time, to string, reason string) {
+	if t == nil {
+		return
+	}
+
+	span := &Span{t: t, name: "state " + from, kind: SpanKindInternal, start: since, attrs: map[string]interface{}{
+		"txwifi.state":      from,
+		"txwifi.state.next": to,
+		"txwifi.reason":     reason,
+	}}
+	rand.Read(span.sc.TraceId[:])
+	rand.Read(span.sc.SpanId[:])
+	span.End()
+
+	t.Count("txwifi.state.transitions", "Moves of the provisioning state machine.", 1, map[string]interface{}{"txwifi.state.from": from, "txwifi.state.to": to})
+}
+
+// Run exports the spans and metrics every interval until ctx is done,
+// then once more.
+func (t *Telemetry) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	interval := DefaultTelemetryInterval
+	if t.cfg.IntervalSec > 0 {
+		interval = time.Duration(t.cfg.IntervalSec) * time.Second
+	}
+
+	t.Wpa.Log.Info("exporting telemetry", "endpoint", t.cfg.Endpoint, "service", t.cfg.ServiceName)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), telemetryExportTimeout)
+			t.Export(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			t.Export(ctx)
+		}
+	}
+}
+
+// Export sends the spans finished since the last export and the metrics.
+// Spans that cannot be sent are kept for the next export.
+func (t *Telemetry) Export(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	resource := t.resource()
+
+	t.mu.Lock()
+	spans, dropped := t.spans, t.dropped
+	t.spans, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.Wpa.Log.Warn("telemetry spans dropped", "spans", dropped)
+	}
+
+	if len(spans) > 0 {
+		if err := t.post(ctx, "/v1/traces", t.traces(resource, spans)); err != nil {
+			t.Wpa.Log.Warn("could not export spans", "endpoint", t.cfg.Endpoint, "error", err)
+
+			t.mu.Lock()
+			t.spans = append(spans, t.spans...)
+			if len(t.spans) > maxTelemetrySpans {
+				t.dropped += len(t.spans) - maxTelemetrySpans
+				t.spans = t.spans[len(t.spans)-maxTelemetrySpans:]
+			}
+			t.mu.Unlock()
+		}
+	}
+
+	if err := t.post(ctx, "/v1/metrics", t.metrics(resource)); err != nil {
+		t.Wpa.Log.Warn("could not export metrics", "endpoint", t.cfg.Endpoint, "error", err)
+	}
+}
+
+// post sends body as OTLP JSON to path of the endpoint.
+func (t *Telemetry) post(ctx context.Context, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.cfg.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// otlpAttr is an OTLP key and value.
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// otlpAttrs returns attrs in the OTLP form, sorted by key.
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	list := []otlpAttr{}
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case float64:
+			// JSON has no NaN or infinities, they would fail every export
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				v = map[string]interface{}{"stringValue": strconv.FormatFloat(value, 'g', -1, 64)}
+			} else {
+				v = map[string]interface{}{"doubleValue": value}
+			}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, otlpAttr{Key: key, Value: v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list
+}
+
+// unixNano returns t in the OTLP form, nanoseconds as a string.
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// resource returns the attributes of the device: the service, the
+// version, the host and the device id.
+func (t *Telemetry) resource() map[string]interface{} {
+	attrs := map[string]interface{}{
+		"service.name": t.cfg.ServiceName,
+	}
+	if t.Version != "" {
+		attrs["service.version"] = t.Version
+	}
+	if host, err := os.Hostname(); err == nil {
+		attrs["host.name"] = host
+	}
+	if identity, err := t.Wpa.Identity(); err == nil {
+		attrs["service.instance.id"] = identity.DeviceId
+	}
+	for key, value := range t.cfg.Attributes {
+		attrs[key] = value
+	}
+
+	return attrs
+}
+
+// traces returns spans as an OTLP ExportTraceServiceRequest.
+func (t *Telemetry) traces(resource map[string]interface{}, spans []*Span) map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := []map[string]interface{}{}
+	for _, span := range spans {
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.sc.TraceId[:]),
+			"spanId":            hex.EncodeToString(span.sc.SpanId[:]),
+			"name":              span.name,
+			"kind":              span.kind,
+			"startTimeUnixNano": unixNano(span.start),
+			"endTimeUnixNano":   unixNano(span.end),
+			"attributes":        otlpAttrs(span.attrs),
+			"status":            map[string]interface{}{"code": span.status, "message": span.msg},
+		}
+		if span.parent != ([8]byte{}) {
+			s["parentSpanId"] = hex.EncodeToString(span.parent[:])
+		}
+		list = append(list, s)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttrs(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": telemetryScope, "version": t.Version},
+				"spans": list,
+			}},
+		}},
+	}
+}
+
+// metrics returns the instruments and the event counts as an OTLP
+// ExportMetricsServiceRequest, cumulative since the start.
+func (t *Telemetry) metrics(resource map[string]interface{}) map[string]interface{} {
+	if t.Events != nil {
+		for series, n := range t.Events.counts() {
+			attrs := map[string]interface{}{"txwifi.event.type": series.Type, "txwifi.event.source": series.Source, "txwifi.iface": series.Iface}
+			t.mu.Lock()
+			t.point("txwifi.events", "1", "Events of wpa_supplicant, hostapd and txwifi.", false, attrs).count = n
+			t.mu.Unlock()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start, now := unixNano(t.started), unixNano(time.Now())
+
+	names := make([]string, 0, len(t.instruments))
+	for name := range t.instruments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := []map[string]interface{}{}
+	for _, name := range names {
+		inst := t.instruments[name]
+
+		points := []map[string]interface{}{}
+		for _, point := range inst.points {
+			p := map[string]interface{}{
+				"attributes":        otlpAttrs(point.attrs),
+				"startTimeUnixNano": start,
+				"timeUnixNano":      now,
+			}
+			if inst.histogram {
+				buckets := []string{}
+				for _, n := range point.buckets {
+					buckets = append(buckets, strconv.FormatUint(n, 10))
+				}
+				p["count"] = strconv.FormatUint(point.count, 10)
+				p["sum"] = point.sum
+				p["bucketCounts"] = buckets
+				p["explicitBounds"] = telemetryBounds
+			} else {
+				p["asInt"] = strconv.FormatUint(point.count, 10)
+			}
+			points = append(points, p)
+		}
+
+		m := map[string]interface{}{"name": inst.name, "unit": inst.unit, "description": inst.desc}
+		if inst.histogram {
+			m["histogram"] = map[string]interface{}{"aggregationTemporality": 2, "dataPoints": points}
+		} else {
+			m["sum"] = map[string]interface{}{"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": points}
+		}
+		list = append(list, m)
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttrs(resource)},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]interface{}{"name": telemetryScope, "version": t.Version},
+				"metrics": list,
+			}},
+		}},
+	}
+}
+
+// telemetryRunner traces the commands run for a traced request and
+// measures every command.
+type telemetryRunner struct {
+	Runner
+	t *Telemetry
+}
+
+// NewTelemetryRunner produces a Runner that runs through r, timing each
+// command and request in t and tracing those made within a span.
+func NewTelemetryRunner(r Runner, t *Telemetry) Runner {
+	return &telemetryRunner{Runner: r, t: t}
+}
+
+// Output runs name within an exec span.
+func (r *telemetryRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	start := time.Now()
+
+	var span *Span
+	if HasSpan(ctx) {
+		ctx, span = r.t.StartSpan(ctx, "exec "+name, SpanKindClient)
+		span.SetAttr("txwifi.command", secrets.scrub(strings.Join(append([]string{name}, args...), " ")))
+	}
+
+	out, err := r.Runner.Output(ctx, name, args...)
+
+	span.SetError(err)
+	span.End()
+	r.t.Observe("txwifi.command.duration", "Time the external commands and wpa_supplicant requests take.", time.Since(start), map[string]interface{}{
+		"txwifi.command.target": PlanExec,
+		"txwifi.command.name":   name,
+		"error":                 err != nil,
+	})
+
+	return out, err
+}
+
+// Request sends cmd within a wpa_supplicant span.
+func (r *telemetryRunner) Request(ctx context.Context, iface string, cmd string) ([]byte, error) {
+	start := time.Now()
+	verb := strings.SplitN(cmd, " ", 2)[0]
+
+	var span *Span
+	if HasSpan(ctx) {
+		ctx, span = r.t.StartSpan(ctx, "wpa_supplicant "+verb, SpanKindClient)
+		span.SetAttr("txwifi.command", redactRequest(cmd))
+		span.SetAttr("txwifi.iface", iface)
+	}
+
+	out, err := r.Runner.Request(ctx, iface, cmd)
+	if err == nil && strings.HasPrefix(string(out), "FAIL") {
+		span.SetError(fmt.Errorf("%s: FAIL", verb))
+	}
+
+	span.SetError(err)
+	span.End()
+	r.t.Observe("txwifi.command.duration", "Time the external commands and wpa_supplicant requests take.", time.Since(start), map[string]interface{}{
+		"txwifi.command.target": PlanWpaSupplicant,
+		"txwifi.command.name":   verb,
+		"error":                 err != nil,
+	})
+
+	return out, err
+}
+
+// Attach is not traced.
+func (r *telemetryRunner) Attach(iface string) (<-chan wpactl.Event, io.Closer, error) {
+	return r.Runner.Attach(iface)
+}
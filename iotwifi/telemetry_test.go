@@ -0,0 +1,406 @@
+package iotwifi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanId  = "00f067aa0ba902b7"
+	)
+
+	valid := []string{
+		"00-" + traceId + "-" + spanId + "-01",
+		"00-" + traceId + "-" + spanId + "-00",
+		" 00-" + traceId + "-" + spanId + "-01\n",
+		"01-" + traceId + "-" + spanId + "-01-later",
+	}
+	for _, header := range valid {
+		sc, ok := parseTraceparent(header)
+		if !ok {
+			t.Errorf("%q not parsed", header)
+			continue
+		}
+		if got := Traceparent(context.WithValue(context.Background(), spanKey{}, &Span{sc: sc})); got != "00-"+traceId+"-"+spanId+"-01" {
+			t.Errorf("%q parsed to %s", header, got)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"00-" + traceId + "-" + spanId,
+		"00-" + traceId + "-" + spanId + "-01-later",
+		"ff-" + traceId + "-" + spanId + "-01",
+		"0-" + traceId + "-" + spanId + "-01",
+		"0g-" + traceId + "-" + spanId + "-01",
+		"00-" + strings.ToUpper(traceId) + "-" + spanId + "-01",
+		"00-" + traceId[1:] + "-" + spanId + "-01",
+		"00-" + traceId + "-" + spanId + "0-01",
+		"00-" + traceId + "-" + spanId + "-1",
+		"00-" + traceId + "-" + spanId + "-0x",
+		"00-00000000000000000000000000000000-" + spanId + "-01",
+		"00-" + traceId + "-0000000000000000-01",
+	}
+	for _, header := range invalid {
+		if sc, ok := parseTraceparent(header); ok {
+			t.Errorf("%q parsed to %+v", header, sc)
+		}
+	}
+}
+
+func FuzzParseTraceparent(f *testing.F) {
+	f.Add("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	f.Add("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-x")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		sc, ok := parseTraceparent(header)
+		if !ok {
+			if ctx := WithRemoteParent(context.Background(), header); HasSpan(ctx) {
+				t.Fatalf("%q joined", header)
+			}
+			return
+		}
+
+		// the header of the span parses back to it
+		again, ok := parseTraceparent(Traceparent(WithRemoteParent(context.Background(), header)))
+		if !ok || again != sc {
+			t.Fatalf("%q parsed to %+v, then to %+v", header, sc, again)
+		}
+	})
+}
+
+func TestOtlpAttrs(t *testing.T) {
+	attrs := otlpAttrs(map[string]interface{}{
+		"s":   "x",
+		"b":   true,
+		"i":   -3,
+		"f":   0.5,
+		"nan": math.NaN(),
+		"inf": math.Inf(-1),
+		"d":   time.Second,
+	})
+	want := []otlpAttr{
+		{Key: "b", Value: map[string]interface{}{"boolValue": true}},
+		{Key: "d", Value: map[string]interface{}{"stringValue": "1s"}},
+		{Key: "f", Value: map[string]interface{}{"doubleValue": 0.5}},
+		{Key: "i", Value: map[string]interface{}{"intValue": "-3"}},
+		{Key: "inf", Value: map[string]interface{}{"stringValue": "-Inf"}},
+		{Key: "nan", Value: map[string]interface{}{"stringValue": "NaN"}},
+		{Key: "s", Value: map[string]interface{}{"stringValue": "x"}},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("attrs %+v, want %+v", attrs, want)
+	}
+	if _, err := json.Marshal(attrs); err != nil {
+		t.Error(err)
+	}
+}
+
+// collector is a fake OTLP/HTTP collector, keeping what it was sent by
+// path.
+type collector struct {
+	mu      sync.Mutex
+	status  int
+	exports map[string][]map[string]interface{}
+	headers http.Header
+}
+
+func newCollector(t *testing.T) (*collector, *httptest.Server) {
+	c := &collector{status: http.StatusOK, exports: map[string][]map[string]interface{}{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		export := map[string]interface{}{}
+		if err := json.Unmarshal(body, &export); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("exported %s %q: %v", r.Header.Get("Content-Type"), body, err)
+		}
+		c.headers = r.Header
+		if c.status == http.StatusOK {
+			c.exports[r.URL.Path] = append(c.exports[r.URL.Path], export)
+		}
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return c, srv
+}
+
+// last returns the last export of path, walked down to the list at key
+// under the resource and scope lists.
+func (c *collector) last(t *testing.T, path string, resourceKey string, scopeKey string, key string) ([]interface{}, map[string]interface{}) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exports := c.exports[path]
+	if len(exports) == 0 {
+		t.Fatalf("nothing exported to %s", path)
+	}
+	resource := exports[len(exports)-1][resourceKey].([]interface{})[0].(map[string]interface{})
+	scope := resource[scopeKey].([]interface{})[0].(map[string]interface{})
+	attrs := map[string]interface{}{}
+	for _, attr := range resource["resource"].(map[string]interface{})["attributes"].([]interface{}) {
+		attr := attr.(map[string]interface{})
+		attrs[attr["key"].(string)] = attr["value"]
+	}
+
+	return scope[key].([]interface{}), attrs
+}
+
+// newTestTelemetry produces Telemetry exporting to a fake collector.
+func newTestTelemetry(t *testing.T) (*Telemetry, *collector, *WpaCfg) {
+	t.Helper()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_SERVICE_NAME", "")
+
+	wpa, _, cleanup := newTestWpa(t)
+	t.Cleanup(cleanup)
+	if NewTelemetry(wpa) != nil {
+		t.Fatal("telemetry without an endpoint")
+	}
+
+	c, srv := newCollector(t)
+	wpa.updateCfg(func(cfg *SetupCfg) {
+		cfg.Telemetry = TelemetryCfg{
+			Endpoint:   srv.URL + "/",
+			Headers:    map[string]string{"Api-Key": "k"},
+			Attributes: map[string]string{"site": "lab"},
+		}
+	})
+	telemetry := NewTelemetry(wpa)
+	telemetry.Version = "1.2.3"
+
+	return telemetry, c, wpa
+}
+
+// byName returns the spans or metrics of an export by name.
+func byName(list []interface{}) map[string]map[string]interface{} {
+	named := map[string]map[string]interface{}{}
+	for _, item := range list {
+		item := item.(map[string]interface{})
+		named[item["name"].(string)] = item
+	}
+
+	return named
+}
+
+func TestTelemetryTraces(t *testing.T) {
+	telemetry, c, _ := newTestTelemetry(t)
+
+	ctx := WithRemoteParent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := telemetry.StartSpan(ctx, "POST /connect", SpanKindServer)
+	_, child := telemetry.StartSpan(ctx, "connect", SpanKindInternal)
+	child.SetAttr("txwifi.ssid", "home")
+	child.SetAttr("txwifi.attempt", 2)
+	child.SetError(errors.New("wrong key"))
+	child.End()
+	child.End()
+	server.SetError(nil)
+	server.End()
+	telemetry.StateChanged("ap", time.Now().Add(-time.Second), "station", "connected")
+
+	if tp := Traceparent(ctx); !strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(tp, "00f067aa0ba902b7") {
+		t.Errorf("traceparent %s", tp)
+	}
+
+	telemetry.Export(context.Background())
+
+	list, resource := c.last(t, "/v1/traces", "resourceSpans", "scopeSpans", "spans")
+	if len(list) != 3 {
+		t.Fatalf("%d spans exported", len(list))
+	}
+	spans := byName(list)
+	for key, want := range map[string]interface{}{
+		"service.name":    map[string]interface{}{"stringValue": DefaultTelemetryService},
+		"service.version": map[string]interface{}{"stringValue": "1.2.3"},
+		"site":            map[string]interface{}{"stringValue": "lab"},
+	} {
+		if !reflect.DeepEqual(resource[key], want) {
+			t.Errorf("resource %s %v, want %v", key, resource[key], want)
+		}
+	}
+	if c.headers.Get("Api-Key") != "k" {
+		t.Errorf("headers %v", c.headers)
+	}
+
+	srv, connect, state := spans["POST /connect"], spans["connect"], spans["state ap"]
+	if srv["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || srv["parentSpanId"] != "00f067aa0ba902b7" || srv["kind"] != float64(SpanKindServer) {
+		t.Errorf("server span %v", srv)
+	}
+	if connect["traceId"] != srv["traceId"] || connect["parentSpanId"] != srv["spanId"] {
+		t.Errorf("child span %v of %v", connect, srv)
+	}
+	if status := connect["status"].(map[string]interface{}); status["code"] != float64(spanStatusError) || status["message"] != "wrong key" {
+		t.Errorf("child status %v", status)
+	}
+	if status := srv["status"].(map[string]interface{}); status["code"] != float64(spanStatusOk) {
+		t.Errorf("server status %v", status)
+	}
+	wantAttrs := []interface{}{
+		map[string]interface{}{"key": "txwifi.attempt", "value": map[string]interface{}{"intValue": "2"}},
+		map[string]interface{}{"key": "txwifi.ssid", "value": map[string]interface{}{"stringValue": "home"}},
+	}
+	if !reflect.DeepEqual(connect["attributes"], wantAttrs) {
+		t.Errorf("child attributes %v", connect["attributes"])
+	}
+	if _, ok := state["parentSpanId"]; ok || state["startTimeUnixNano"].(string) >= state["endTimeUnixNano"].(string) {
+		t.Errorf("state span %v", state)
+	}
+
+	// exported once
+	telemetry.Export(context.Background())
+	c.mu.Lock()
+	if n := len(c.exports["/v1/traces"]); n != 1 {
+		t.Errorf("%d trace exports", n)
+	}
+	c.mu.Unlock()
+}
+
+func TestTelemetryExportFailure(t *testing.T) {
+	telemetry, c, _ := newTestTelemetry(t)
+
+	for i := 0; i < maxTelemetrySpans+3; i++ {
+		_, span := telemetry.StartSpan(context.Background(), "span", SpanKindInternal)
+		span.SetAttr("f", math.NaN())
+		span.End()
+	}
+	if len(telemetry.spans) != maxTelemetrySpans || telemetry.dropped != 3 {
+		t.Fatalf("%d spans, %d dropped", len(telemetry.spans), telemetry.dropped)
+	}
+
+	c.mu.Lock()
+	c.status = http.StatusServiceUnavailable
+	c.mu.Unlock()
+	telemetry.Export(context.Background())
+
+	_, span := telemetry.StartSpan(context.Background(), "later", SpanKindInternal)
+	span.End()
+	if len(telemetry.spans) != maxTelemetrySpans || telemetry.dropped != 1 {
+		t.Fatalf("%d spans kept, %d dropped", len(telemetry.spans), telemetry.dropped)
+	}
+
+	c.mu.Lock()
+	c.status = http.StatusOK
+	c.mu.Unlock()
+	telemetry.Export(context.Background())
+	list, _ := c.last(t, "/v1/traces", "resourceSpans", "scopeSpans", "spans")
+	if len(list) != maxTelemetrySpans || list[len(list)-1].(map[string]interface{})["name"] != "later" {
+		t.Errorf("%d spans exported", len(list))
+	}
+	if len(telemetry.spans) != 0 {
+		t.Errorf("%d spans left", len(telemetry.spans))
+	}
+}
+
+func TestTelemetryMetrics(t *testing.T) {
+	telemetry, c, _ := newTestTelemetry(t)
+
+	telemetry.Count("txwifi.test", "Tests.", 2, map[string]interface{}{"a": "1;b=2"})
+	telemetry.Count("txwifi.test", "Tests.", 1, map[string]interface{}{"a": "1", "b": "2"})
+	telemetry.Count("txwifi.test", "Tests.", 3, map[string]interface{}{"a": "1;b=2"})
+	telemetry.Observe("txwifi.duration", "Durations.", 3*time.Millisecond, nil)
+	telemetry.Observe("txwifi.duration", "Durations.", 10*time.Millisecond, nil)
+	telemetry.Observe("txwifi.duration", "Durations.", time.Minute, nil)
+
+	events := NewMetrics()
+	events.Count(Event{Type: "CONNECTED", Source: "wpa_supplicant", Iface: "wlan0"})
+	telemetry.Events = events
+
+	telemetry.Export(context.Background())
+	list, _ := c.last(t, "/v1/metrics", "resourceMetrics", "scopeMetrics", "metrics")
+	metrics := byName(list)
+
+	counter := metrics["txwifi.test"]["sum"].(map[string]interface{})
+	if counter["isMonotonic"] != true || counter["aggregationTemporality"] != float64(2) {
+		t.Errorf("counter %v", counter)
+	}
+	counts := map[string]bool{}
+	for _, point := range counter["dataPoints"].([]interface{}) {
+		point := point.(map[string]interface{})
+		counts[point["asInt"].(string)] = true
+	}
+	if !reflect.DeepEqual(counts, map[string]bool{"5": true, "1": true}) {
+		t.Errorf("counts %v", counts)
+	}
+
+	histogram := metrics["txwifi.duration"]["histogram"].(map[string]interface{})
+	point := histogram["dataPoints"].([]interface{})[0].(map[string]interface{})
+	buckets := []interface{}{"1", "1", "0", "0", "0", "0", "0", "0", "0", "0", "0", "0", "1"}
+	if point["count"] != "3" || !reflect.DeepEqual(point["bucketCounts"], buckets) || math.Abs(point["sum"].(float64)-60.013) > 1e-9 {
+		t.Errorf("histogram point %v", point)
+	}
+	if metrics["txwifi.duration"]["unit"] != "s" {
+		t.Errorf("histogram %v", metrics["txwifi.duration"])
+	}
+
+	eventPoints := metrics["txwifi.events"]["sum"].(map[string]interface{})["dataPoints"].([]interface{})
+	if len(eventPoints) != 1 || eventPoints[0].(map[string]interface{})["asInt"] != "1" {
+		t.Errorf("event points %v", eventPoints)
+	}
+}
+
+func TestTelemetryRunner(t *testing.T) {
+	telemetry, c, wpa := newTestTelemetry(t)
+	runner := NewTelemetryRunner(wpa.Runner, telemetry)
+
+	ctx, span := telemetry.StartSpan(context.Background(), "connect", SpanKindInternal)
+	runner.Request(ctx, "wlan0", `SET_NETWORK 1 psk "secret"`)
+	runner.Output(ctx, "iw", "dev")
+	runner.Request(context.Background(), "wlan0", "SCAN")
+	span.End()
+
+	telemetry.Export(context.Background())
+	list, _ := c.last(t, "/v1/traces", "resourceSpans", "scopeSpans", "spans")
+	spans := byName(list)
+	if len(list) != 3 {
+		t.Fatalf("%d spans, %v", len(list), spans)
+	}
+	request := spans["wpa_supplicant SET_NETWORK"]
+	for _, attr := range request["attributes"].([]interface{}) {
+		attr := attr.(map[string]interface{})
+		if attr["key"] == "txwifi.command" && strings.Contains(attr["value"].(map[string]interface{})["stringValue"].(string), "secret") {
+			t.Errorf("command %v", attr)
+		}
+	}
+	if request["parentSpanId"] != spans["connect"]["spanId"] || spans["exec iw"]["parentSpanId"] != spans["connect"]["spanId"] {
+		t.Errorf("spans %v", spans)
+	}
+
+	list, _ = c.last(t, "/v1/metrics", "resourceMetrics", "scopeMetrics", "metrics")
+	points := byName(list)["txwifi.command.duration"]["histogram"].(map[string]interface{})["dataPoints"].([]interface{})
+	if len(points) != 3 {
+		t.Errorf("%d command points", len(points))
+	}
+}
+
+func TestTelemetryNil(t *testing.T) {
+	var telemetry *Telemetry
+
+	ctx, span := telemetry.StartSpan(context.Background(), "x", SpanKindInternal)
+	span.SetAttr("a", 1)
+	span.SetError(errors.New("x"))
+	span.End()
+	telemetry.Count("c", "", 1, nil)
+	telemetry.Observe("h", "", time.Second, nil)
+	telemetry.StateChanged("a", time.Now(), "b", "")
+	telemetry.Export(ctx)
+	telemetry.Run(ctx)
+
+	if HasSpan(ctx) || Traceparent(ctx) != "" {
+		t.Error("span of nil telemetry")
+	}
+}
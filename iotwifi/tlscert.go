@@ -0,0 +1,139 @@
+package iotwifi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default locations of the generated certificate and key.
+const (
+	DefaultCertFile = "/etc/txwifi/cert.pem"
+	DefaultKeyFile  = "/etc/txwifi/key.pem"
+)
+
+// HTTPSCfg configures TLS for the API server.
+type HTTPSCfg struct {
+	Enabled      bool   `json:"enabled"`
+	CertFile     string `json:"cert_file"`     // /etc/txwifi/cert.pem
+	KeyFile      string `json:"key_file"`      // /etc/txwifi/key.pem
+	AutoGenerate bool   `json:"auto_generate"` // create a self-signed cert if the files are missing
+}
+
+// paths returns the cert and key paths with defaults applied.
+func (c HTTPSCfg) paths() (string, string) {
+	certFile, keyFile := c.CertFile, c.KeyFile
+	if certFile == "" {
+		certFile = DefaultCertFile
+	}
+	if keyFile == "" {
+		keyFile = DefaultKeyFile
+	}
+
+	return certFile, keyFile
+}
+
+// LoadOrCreateCert loads the configured certificate. When the files are
+// missing and AutoGenerate is set, a self-signed certificate valid for
+// hosts is generated and persisted first, so the device keeps the same
+// certificate (and fingerprint) across restarts.
+func LoadOrCreateCert(cfg HTTPSCfg, hosts []string) (tls.Certificate, error) {
+	certFile, keyFile := cfg.paths()
+
+	_, err := os.Stat(certFile)
+	if os.IsNotExist(err) && cfg.AutoGenerate {
+		if err := generateCert(certFile, keyFile, hosts); err != nil {
+			return tls.Certificate{}, fmt.Errorf("generating certificate: %w", err)
+		}
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// generateCert writes a self-signed ECDSA P-256 certificate and key.
+func generateCert(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"txwifi"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range append(hosts, hostname) {
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return ioutil.WriteFile(keyFile, keyPem, 0600)
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the leaf certificate
+// as colon separated hex, the form apps pin against.
+func CertFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	hexPairs := make([]string, len(sum))
+	for i, b := range sum {
+		hexPairs[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(hexPairs, ":")
+}
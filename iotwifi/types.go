@@ -1,28 +1,139 @@
 package iotwifi
 
+import (
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
 // SetupCfg is the main configuration structure.
 type SetupCfg struct {
-	DnsmasqCfg       DnsmasqCfg       `json:"dnsmasq_cfg"`
-	HostApdCfg       HostApdCfg       `json:"host_apd_cfg"`
-	WpaSupplicantCfg WpaSupplicantCfg `json:"wpa_supplicant_cfg"`
+	Version          int               `json:"version"`           // config layout, CfgVersion; older layouts are migrated
+	StationInterface string            `json:"station_interface"` // wlan0
+	APInterface      string            `json:"ap_interface"`      // uap0
+	APDedicated      bool              `json:"ap_dedicated"`      // ap_interface is a radio of its own, not added on the station's
+	Radios           []RadioCfg        `json:"radios"`            // more station radios, each with its own wpa_supplicant
+	Country          string            `json:"country"`           // DE, regulatory domain for iw, wpa_supplicant and hostapd
+	StationIP        StaticIPCfg       `json:"station_ip"`        // static address for the station interface, DHCP if empty
+	APSubnet         string            `json:"ap_subnet"`         // 192.168.27.0/24, sets the AP ip and dhcp range if they are empty
+	Bridge           BridgeCfg         `json:"bridge"`            // bridges the AP to eth0 instead of serving DHCP on it
+	Router           RouterCfg         `json:"router"`            // routes AP clients out of the station uplink
+	Firewall         string            `json:"firewall"`          // auto (default), iptables or nftables
+	IPv6             IPv6Cfg           `json:"ipv6"`              // router advertisements and DHCPv6 on the AP
+	DnsmasqCfg       DnsmasqCfg        `json:"dnsmasq_cfg"`
+	HostApdCfg       HostApdCfg        `json:"host_apd_cfg"`
+	WpaSupplicantCfg WpaSupplicantCfg  `json:"wpa_supplicant_cfg"`
+	NetworkManager   NetworkManagerCfg `json:"network_manager"` // drive the station through NetworkManager instead
+	Conflicts        ConflictCfg       `json:"conflicts"`       // other network managers claiming the interfaces
+	APAllowList      []string          `json:"ap_allow_list"`   // only these stations may join the AP
+	APDenyList       []string          `json:"ap_deny_list"`    // these stations may never join the AP
+	APWindow         APWindowCfg       `json:"ap_window"`       // how long the AP broadcasts after boot or provisioning
+	GPIO             GPIOCfg           `json:"gpio"`            // a button opening the AP and an LED showing the state
+	CaptivePortal    CaptivePortalCfg  `json:"captive_portal"`
+	SerialDevice     string            `json:"serial_device"` // /dev/ttyGS0, serves provisioning over a serial line
+	HTTPS            HTTPSCfg          `json:"https"`
+	APISocket        APISocketCfg      `json:"api_socket"`
+	GRPC             GRPCCfg           `json:"grpc"`          // the gRPC API, beside the HTTP one
+	LogLevel         string            `json:"log_level"`     // debug, info, warn or error; defaults to info
+	ProfileFile      string            `json:"profile_file"`  // /etc/txwifi/profiles.json
+	Credentials      CredentialsCfg    `json:"credentials"`   // encryption of the stored passphrases
+	IdentityFile     string            `json:"identity_file"` // /etc/txwifi/identity.json, the generated AP ssid and passphrase
+	StateFile        string            `json:"state_file"`    // /etc/txwifi/state.json, the last good connection and the history
+	ResolvConf       string            `json:"resolv_conf"`   // /etc/resolv.conf, where static nameservers are written
+	ProxyFile        string            `json:"proxy_file"`    // /run/txwifi/proxy.env, where the proxy of the current network is exported
+	DBusSocket       string            `json:"dbus_socket"`   // /var/run/dbus/system_bus_socket, of the system bus
+	Preflight        PreflightCfg      `json:"preflight"`     // the checks of the container at startup
+	Capabilities     CapabilitiesCfg   `json:"capabilities"`  // the check of the config against the radios at startup
+	Rfkill           RfkillCfg         `json:"rfkill"`        // the soft blocks of the wifi radios
+	P2P              P2PCfg            `json:"p2p"`           // Wi-Fi Direct discovery, groups and pairing
+	Audit            AuditCfg          `json:"audit"`         // the log of provisioning actions
+	RateLimit        RateLimitCfg      `json:"rate_limit"`    // per client API limits and lockouts
+	Supervisor       SupervisorCfg     `json:"supervisor"`
+	Processes        ProcessCfg        `json:"processes"` // restarts of hostapd, dnsmasq and wpa_supplicant
+	SignalMonitor    SignalMonitorCfg  `json:"signal_monitor"`
+	Watchdog         WatchdogCfg       `json:"watchdog"`   // roams or reconnects when the link stays poor
+	SpeedTest        SpeedTestCfg      `json:"speed_test"` // the download URL and iperf3 server of the speed test
+	Latency          LatencyCfg        `json:"latency"`    // pings to the gateway and targets, for the status and metrics
+	Scan             ScanCfg           `json:"scan"`
+	Survey           SurveyCfg         `json:"survey"`        // site surveys and moving the AP to the least congested channel
+	StateMachine     StateMachineCfg   `json:"state_machine"` // timeouts of the provisioning states
+	Bootstrap        BootstrapCfg      `json:"bootstrap"`     // setup files on the boot partition or a USB stick, read at startup
+	Watchlist        []WatchEntry      `json:"watchlist"`     // SSIDs the scans watch for, and connect to when they appear
+	Operations       OperationsCfg     `json:"operations"`    // the trace of the commands each API request runs
+	Telemetry        TelemetryCfg      `json:"telemetry"`     // OpenTelemetry spans and metrics, exported over OTLP
+	ConnectRetry     ConnectRetryCfg   `json:"connect_retry"` // attempts of a connect and the backoff between them
+	Oui              OUICfg            `json:"oui"`           // the registry naming the vendors of BSSIDs and AP clients
+	Connectivity     ConnectivityCfg   `json:"connectivity"`
+	Zeroconf         ZeroconfCfg       `json:"zeroconf"` // mDNS responder, answering for txwifi.local
+	Remote           RemoteCfg         `json:"remote"`   // remote management through an MQTT broker
+	Webhook          WebhookCfg        `json:"webhook"`  // events posted to a URL as they happen
+	Webhooks         []WebhookCfg      `json:"webhooks"` // more webhooks, each with its own events
+	Reload           ReloadCfg         `json:"reload"`
+}
+
+// MacACL returns the AP allow and deny lists.
+func (s *SetupCfg) MacACL() MacACL {
+	return MacACL{
+		Allow: s.APAllowList,
+		Deny:  s.APDenyList,
+	}
 }
 
 // DnsmasqCfg configures dnsmasq and is used by SetupCfg.
 type DnsmasqCfg struct {
-	Address     string `json:"address"`      // --address=/#/192.168.27.1",
-	DhcpRange   string `json:"dhcp_range"`   // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
-	VendorClass string `json:"vendor_class"` // "--dhcp-vendorclass=set:device,IoT",
+	Address      string             `json:"address"`      // --address=/#/192.168.27.1",
+	DhcpRange    string             `json:"dhcp_range"`   // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
+	VendorClass  string             `json:"vendor_class"` // "--dhcp-vendorclass=set:device,IoT",
+	LeaseFile    string             `json:"lease_file"`   // "--dhcp-leasefile=/var/lib/misc/dnsmasq.leases",
+	Reservations []dhcp.Reservation `json:"reservations"` // "--dhcp-host=b8:27:eb:00:00:01,192.168.27.10,sensor",
+	Builtin      bool               `json:"builtin"`      // serve DHCP and DNS from txwifi instead of dnsmasq
+}
+
+// leaseFile returns the configured lease file.
+func (cfg DnsmasqCfg) leaseFile() string {
+	if cfg.LeaseFile != "" {
+		return cfg.LeaseFile
+	}
+
+	return DefaultLeaseFile
 }
 
 // HostApdCfg configures hostapd and is used by SetupCfg.
 type HostApdCfg struct {
-	Ssid          string `json:"ssid"`           // ssid=iotwifi2
-	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass
+	Ssid          string `json:"ssid"`           // ssid=iotwifi2, TXWIFI-3456 from the identity if empty
+	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass, random from the identity if empty
 	Channel       string `json:"channel"`        //  channel=6
 	Ip            string `json:"ip"`             // 192.168.27.1
+	WpaKeyMgmt    string `json:"wpa_key_mgmt"`   // wpa_key_mgmt=WPA-PSK, SAE or "WPA-PSK SAE"
+	Band          string `json:"band"`           // 2.4GHz (default) or 5GHz
+	HwMode        string `json:"hw_mode"`        // hw_mode=g, derived from band when empty
+	CountryCode   string `json:"country_code"`   // country_code=US, required on 5GHz
+	Ieee80211n    bool   `json:"ieee80211n"`     // ieee80211n=1
+	Ieee80211ac   bool   `json:"ieee80211ac"`    // ieee80211ac=1, 5GHz only
+	Ieee80211ax   bool   `json:"ieee80211ax"`    // ieee80211ax=1
+	MaxNumSta     int    `json:"max_num_sta"`    // max_num_sta=8, 0 for the hostapd default
+	Hidden        bool   `json:"hidden"`         // ignore_broadcast_ssid=1
+	Wmm           bool   `json:"wmm_enabled"`    // wmm_enabled=1
+	Wps           bool   `json:"wps"`            // wps_state=2, lets devices join with WPS
+	ConfFile      string `json:"conf_file"`      // /etc/hostapd/hostapd.conf
+	CtrlDir       string `json:"ctrl_dir"`       // ctrl_interface=/var/run/hostapd
+	PidFile       string `json:"pid_file"`       // /var/run/hostapd.pid
+	Bridge        string `json:"bridge"`         // bridge=br0, set from bridge
+
+	FollowStationChannel bool `json:"follow_station_channel"` // move the AP to the channel of the station's network
 }
 
 // WpaSupplicantCfg configures wpa_supplicant and is used by SetupCfg
 type WpaSupplicantCfg struct {
-	CfgFile string `json:"cfg_file"` // /etc/wpa_supplicant/wpa_supplicant.conf
+	CfgFile    string `json:"cfg_file"`    // /etc/wpa_supplicant/wpa_supplicant.conf
+	DhcpClient string `json:"dhcp_client"` // udhcpc, dhclient or dhcpcd, empty leaves DHCP to the host
+	CtrlDir    string `json:"ctrl_dir"`    // /var/run/wpa_supplicant, the ctrl_interface of cfg_file, shared by the radios
+}
+
+// ctrlDir returns the directory of the wpa_supplicant control sockets.
+func (cfg WpaSupplicantCfg) ctrlDir() string {
+	if cfg.CtrlDir != "" {
+		return cfg.CtrlDir
+	}
+
+	return wpactl.DefaultDir
 }
@@ -0,0 +1,352 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watchdog defaults.
+const (
+	DefaultWatchdogInterval   = 10 * time.Second
+	DefaultWatchdogWindow     = 6
+	DefaultWatchdogMinRssi    = -75
+	DefaultWatchdogMaxLoss    = 50
+	DefaultWatchdogHysteresis = 5
+	DefaultWatchdogRoamAfter  = 3
+	DefaultWatchdogReconnect  = 9
+	DefaultWatchdogCooldown   = 60 * time.Second
+	watchdogPingTimeout       = 2 * time.Second
+)
+
+// Watchdog states.
+const (
+	WatchdogOK           = "ok"
+	WatchdogDegraded     = "degraded"     // the link has been poor for a window
+	WatchdogDisconnected = "disconnected" // the station is not associated
+)
+
+// Watchdog actions.
+const (
+	WatchdogRoam      = "roam"      // to a stronger AP of the network
+	WatchdogScan      = "scan"      // for a stronger AP, none was found
+	WatchdogReconnect = "reconnect" // dropped the connection and joined again
+)
+
+// WatchdogCfg configures the Watchdog and is used by SetupCfg.
+type WatchdogCfg struct {
+	Enabled        bool   `json:"enabled"`
+	IntervalSec    int    `json:"interval_sec"`    // how often to check, 10 by default
+	Window         int    `json:"window"`          // checks averaged, 6 by default
+	MinRssi        int    `json:"min_rssi"`        // dBm, a weaker link is poor, -75 by default
+	MaxLoss        int    `json:"max_loss"`        // percent of pings lost, more is poor, 50 by default
+	HysteresisDb   int    `json:"hysteresis_db"`   // how far above min_rssi a link recovers, and how much stronger an AP to roam to, 5 by default
+	PingHost       string `json:"ping_host"`       // pinged for the loss, the default gateway if empty
+	RoamAfter      int    `json:"roam_after"`      // poor checks in a row before roaming, 3 by default
+	ReconnectAfter int    `json:"reconnect_after"` // poor checks in a row before reconnecting, 9 by default
+	CooldownSec    int    `json:"cooldown_sec"`    // least time between two actions, 60 by default
+}
+
+// withDefaults fills in the empty settings.
+func (c WatchdogCfg) withDefaults() WatchdogCfg {
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = int(DefaultWatchdogInterval / time.Second)
+	}
+	if c.Window <= 0 {
+		c.Window = DefaultWatchdogWindow
+	}
+	if c.MinRssi == 0 {
+		c.MinRssi = DefaultWatchdogMinRssi
+	}
+	if c.MaxLoss == 0 {
+		c.MaxLoss = DefaultWatchdogMaxLoss
+	}
+	if c.HysteresisDb == 0 {
+		c.HysteresisDb = DefaultWatchdogHysteresis
+	}
+	if c.RoamAfter <= 0 {
+		c.RoamAfter = DefaultWatchdogRoamAfter
+	}
+	if c.ReconnectAfter <= 0 {
+		c.ReconnectAfter = DefaultWatchdogReconnect
+	}
+	if c.CooldownSec <= 0 {
+		c.CooldownSec = int(DefaultWatchdogCooldown / time.Second)
+	}
+
+	return c
+}
+
+// WatchdogStatus is the link quality the Watchdog sees and what it did
+// about it.
+type WatchdogStatus struct {
+	Enabled    bool       `json:"enabled"`
+	State      string     `json:"state"` // ok, degraded or disconnected
+	Bssid      string     `json:"bssid"`
+	Rssi       int        `json:"rssi"`                  // dBm, averaged over the window
+	Loss       int        `json:"loss"`                  // percent of the pings of the window lost
+	PoorChecks int        `json:"poor_checks"`           // in a row
+	Roams      int        `json:"roams"`                 // since the daemon started
+	Reconnects int        `json:"reconnects"`            // since the daemon started
+	LastAction string     `json:"last_action,omitempty"` // roam, scan or reconnect
+	LastTime   *time.Time `json:"last_action_time,omitempty"`
+}
+
+// watchdogCheck is one check of the window.
+type watchdogCheck struct {
+	rssi int
+	lost bool
+}
+
+// Watchdog watches the signal and packet loss of the station and, when
+// they stay poor, roams to a stronger AP of the network or reconnects,
+// so a device does not cling to a dying AP. The link is poor below
+// min_rssi or above max_loss, and only counts as recovered hysteresis_db
+// above min_rssi, so a link on the edge does not flap.
+type Watchdog struct {
+	Wpa *WpaCfg
+
+	mu      sync.Mutex
+	cfg     WatchdogCfg
+	window  []watchdogCheck
+	status  WatchdogStatus
+	roamed  bool // a roam was tried since the link became poor
+	changed chan struct{}
+}
+
+// NewWatchdog produces a Watchdog for wpa, disabled until configured.
+func NewWatchdog(wpa *WpaCfg) *Watchdog {
+	return &Watchdog{
+		Wpa:     wpa,
+		status:  WatchdogStatus{State: WatchdogDisconnected},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Configure applies cfg, starting over with an empty window.
+func (w *Watchdog) Configure(cfg WatchdogCfg) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cfg = cfg
+	w.status.Enabled = cfg.Enabled
+	w.reset()
+
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// reset empties the window. The caller holds mu.
+func (w *Watchdog) reset() {
+	w.window = nil
+	w.roamed = false
+	w.status.PoorChecks = 0
+	w.status.Rssi = 0
+	w.status.Loss = 0
+}
+
+// Status returns the link quality and the actions taken.
+func (w *Watchdog) Status() WatchdogStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.status
+}
+
+// Run checks the link every interval until ctx is done. It idles while
+// the watchdog is disabled.
+func (w *Watchdog) Run(ctx context.Context) {
+	for {
+		w.mu.Lock()
+		cfg := w.cfg.withDefaults()
+		enabled := w.cfg.Enabled
+		w.mu.Unlock()
+
+		var tick <-chan time.Time
+		if enabled {
+			tick = time.After(time.Duration(cfg.IntervalSec) * time.Second)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.changed:
+			continue
+		case <-tick:
+		}
+
+		w.check(ctx, cfg)
+	}
+}
+
+// check adds a check to the window, moves between ok and degraded and
+// acts on a link that stays poor.
+func (w *Watchdog) check(ctx context.Context, cfg WatchdogCfg) {
+	wpa := w.Wpa
+	iface := wpa.Cfg().StationInterface
+
+	sample, err := wpa.SignalPoll(ctx)
+	if err != nil {
+		w.mu.Lock()
+		w.reset()
+		w.status.State = WatchdogDisconnected
+		w.status.Bssid = ""
+		w.mu.Unlock()
+		return
+	}
+
+	lost := false
+	host := cfg.PingHost
+	if host == "" {
+		host = defaultGateway(iface)
+	}
+	if host != "" {
+		lost = ping(ctx, iface, host, watchdogPingTimeout) != nil
+	}
+
+	w.mu.Lock()
+	// another AP, or a new connection, is a fresh start
+	if sample.Bssid != w.status.Bssid || w.status.State == WatchdogDisconnected {
+		w.reset()
+		w.status.Bssid = sample.Bssid
+		w.status.State = WatchdogOK
+	}
+
+	w.window = append(w.window, watchdogCheck{rssi: sample.Rssi, lost: lost})
+	if len(w.window) > cfg.Window {
+		w.window = w.window[len(w.window)-cfg.Window:]
+	}
+
+	rssi, losses := 0, 0
+	for _, c := range w.window {
+		rssi += c.rssi
+		if c.lost {
+			losses++
+		}
+	}
+	rssi /= len(w.window)
+	loss := 100 * losses / len(w.window)
+	w.status.Rssi, w.status.Loss = rssi, loss
+
+	poor := rssi < cfg.MinRssi || loss > cfg.MaxLoss
+	recovered := rssi >= cfg.MinRssi+cfg.HysteresisDb && loss <= cfg.MaxLoss
+
+	var ev string
+	switch {
+	case w.status.State != WatchdogDegraded && poor && len(w.window) >= cfg.Window:
+		w.status.State = WatchdogDegraded
+		ev = EventLinkDegraded
+	case w.status.State == WatchdogDegraded && recovered:
+		w.status.State = WatchdogOK
+		w.status.PoorChecks = 0
+		w.roamed = false
+		ev = EventLinkRecovered
+	}
+
+	if w.status.State == WatchdogDegraded && poor {
+		w.status.PoorChecks++
+	}
+
+	action := ""
+	cooled := w.status.LastTime == nil || time.Since(*w.status.LastTime) >= time.Duration(cfg.CooldownSec)*time.Second
+	if w.status.State == WatchdogDegraded && cooled {
+		switch {
+		case w.status.PoorChecks >= cfg.ReconnectAfter:
+			action = WatchdogReconnect
+		case w.status.PoorChecks >= cfg.RoamAfter && !w.roamed:
+			action = WatchdogRoam
+			w.roamed = true
+		}
+	}
+	state, bssid, poorChecks := w.status.State, w.status.Bssid, w.status.PoorChecks
+	w.mu.Unlock()
+
+	if ev != "" {
+		wpa.Log.Warn("link quality changed", "iface", iface, "state", state, "bssid", bssid, "rssi", rssi, "loss", loss)
+		wpa.publish(Event{
+			Type:    ev,
+			Source:  "watchdog",
+			Iface:   iface,
+			Message: fmt.Sprintf("bssid=%s rssi=%d loss=%d", bssid, rssi, loss),
+		})
+	}
+
+	if action == "" {
+		return
+	}
+
+	target := ""
+	switch action {
+	case WatchdogRoam:
+		target, err = w.roam(ctx, sample, cfg)
+		if err == nil && target == "" {
+			action = WatchdogScan
+		}
+	case WatchdogReconnect:
+		err = wpa.Disconnect(ctx)
+		if err == nil {
+			err = wpa.Reconnect(ctx)
+		}
+	}
+	if err != nil {
+		wpa.Log.Error("watchdog action failed", "iface", iface, "action", action, "error", err)
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	w.status.LastAction = action
+	w.status.LastTime = &now
+	switch action {
+	case WatchdogRoam:
+		w.status.Roams++
+	case WatchdogReconnect:
+		w.status.Reconnects++
+		w.status.State = WatchdogDisconnected
+		w.reset()
+	}
+	w.mu.Unlock()
+
+	wpa.Log.Info("watchdog action", "iface", iface, "action", action, "bssid", bssid, "target", target, "rssi", rssi, "loss", loss, "poor_checks", poorChecks)
+	wpa.publish(Event{
+		Type:    EventWatchdogAction,
+		Source:  "watchdog",
+		Iface:   iface,
+		Message: fmt.Sprintf("action=%s bssid=%s target=%s rssi=%d loss=%d", action, bssid, target, rssi, loss),
+	})
+}
+
+// roam scans for the APs of the current network and roams to the
+// strongest, when it is hysteresis_db stronger than the current one. It
+// returns the AP roamed to, empty when none was stronger.
+func (w *Watchdog) roam(ctx context.Context, sample SignalSample, cfg WatchdogCfg) (string, error) {
+	status, err := w.Wpa.wpaStatus(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	results, err := w.Wpa.ScanNetworks(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	best := WpaNetwork{SignalLevel: sample.Rssi + cfg.HysteresisDb - 1}
+	for _, result := range results {
+		if result.Ssid != status["ssid"] {
+			continue
+		}
+		for _, bss := range result.Bss {
+			if !strings.EqualFold(bss.Bssid, status["bssid"]) && bss.SignalLevel > best.SignalLevel {
+				best = bss
+			}
+		}
+	}
+	if best.Bssid == "" {
+		return "", nil
+	}
+
+	return best.Bssid, w.Wpa.Roam(ctx, best.Bssid)
+}
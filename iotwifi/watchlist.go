@@ -0,0 +1,303 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Where a watched SSID was registered.
+const (
+	WatchSourceConfig = "config"
+	WatchSourceAPI    = "api"
+)
+
+// watchMisses is how many scans in a row a watched SSID must be missing
+// from to count as gone, so one missed beacon does not make it appear
+// again.
+const watchMisses = 2
+
+// watchConnectTimeout bounds an auto-connect to a watched SSID.
+const watchConnectTimeout = 2 * time.Minute
+
+// WatchEntry is an SSID the background scanner watches for, and is used
+// by SetupCfg.
+type WatchEntry struct {
+	Ssid        string `json:"ssid"`
+	AutoConnect bool   `json:"auto_connect"` // connect with its profile when it appears
+	MinRssi     int    `json:"min_rssi"`     // dBm, a weaker network is not in range, any by default
+}
+
+// Validate checks the ssid and signal of e.
+func (e WatchEntry) Validate() error {
+	if e.Ssid == "" || len(e.Ssid) > 32 {
+		return fmt.Errorf("invalid ssid %q, want 1-32 bytes", e.Ssid)
+	}
+	if e.MinRssi > 0 || e.MinRssi < -100 {
+		return fmt.Errorf("min_rssi %d is not a dBm value", e.MinRssi)
+	}
+
+	return nil
+}
+
+// WatchStatus is a watched SSID and whether it is in range.
+type WatchStatus struct {
+	WatchEntry
+	Source    string     `json:"source"` // config or api
+	InRange   bool       `json:"in_range"`
+	Rssi      int        `json:"rssi,omitempty"`       // dBm, of the strongest BSS in the last scan that saw it
+	Appeared  *time.Time `json:"appeared,omitempty"`   // when it last came in range
+	LastSeen  *time.Time `json:"last_seen,omitempty"`  // the last scan that saw it
+	Connects  int        `json:"connects"`             // auto-connects since the daemon started
+	LastError string     `json:"last_error,omitempty"` // of the last auto-connect
+
+	misses int
+}
+
+// Watchlist watches the results of the scans for SSIDs, publishing an
+// event when one appears and, with auto_connect, connecting to it with
+// its profile, even while the station is on another network. The SSIDs
+// come from the config and the API, which are kept in the state.
+type Watchlist struct {
+	Wpa         *WpaCfg
+	Provisioner Provisioner // connects, Wpa unless NetworkManager drives the station
+
+	mu         sync.Mutex
+	cfg        []WatchEntry
+	api        []WatchEntry
+	status     map[string]*WatchStatus
+	connecting bool
+}
+
+// NewWatchlist produces a Watchlist for wpa, watching the SSIDs added
+// through the API before a restart.
+func NewWatchlist(wpa *WpaCfg) *Watchlist {
+	w := &Watchlist{
+		Wpa:         wpa,
+		Provisioner: wpa,
+		api:         []WatchEntry{},
+		status:      map[string]*WatchStatus{},
+	}
+	if wpa.State != nil {
+		w.api = wpa.State.State().Watchlist
+	}
+
+	return w
+}
+
+// Configure watches the SSIDs of entries, besides those added through
+// the API.
+func (w *Watchlist) Configure(entries []WatchEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cfg = append([]WatchEntry{}, entries...)
+}
+
+// entries returns the watched SSIDs and where they came from, the config
+// ones first. The caller holds mu.
+func (w *Watchlist) entries() ([]WatchEntry, []string) {
+	entries, sources := []WatchEntry{}, []string{}
+	for _, e := range w.cfg {
+		entries, sources = append(entries, e), append(sources, WatchSourceConfig)
+	}
+	for _, e := range w.api {
+		entries, sources = append(entries, e), append(sources, WatchSourceAPI)
+	}
+
+	return entries, sources
+}
+
+// Status returns the watched SSIDs, the config ones first.
+func (w *Watchlist) Status() []WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	statuses := []WatchStatus{}
+	entries, sources := w.entries()
+	for i, e := range entries {
+		status := WatchStatus{WatchEntry: e, Source: sources[i]}
+		if st, ok := w.status[e.Ssid]; ok {
+			status = *st
+			status.WatchEntry, status.Source = e, sources[i]
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// Add watches entry, replacing the API entry of the same ssid, and saves
+// it in the state. An ssid the config watches is left to the config.
+func (w *Watchlist) Add(entry WatchEntry) error {
+	if err := entry.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, e := range w.cfg {
+		if e.Ssid == entry.Ssid {
+			return fmt.Errorf("%w: %s is watched by the config", ErrInvalid, entry.Ssid)
+		}
+	}
+
+	api := []WatchEntry{}
+	for _, e := range w.api {
+		if e.Ssid != entry.Ssid {
+			api = append(api, e)
+		}
+	}
+
+	return w.save(append(api, entry))
+}
+
+// Remove stops watching ssid. Only SSIDs added through the API can be
+// removed.
+func (w *Watchlist) Remove(ssid string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	api := []WatchEntry{}
+	for _, e := range w.api {
+		if e.Ssid != ssid {
+			api = append(api, e)
+		}
+	}
+	if len(api) == len(w.api) {
+		for _, e := range w.cfg {
+			if e.Ssid == ssid {
+				return fmt.Errorf("%w: %s is watched by the config", ErrInvalid, ssid)
+			}
+		}
+		return fmt.Errorf("%w: %s is not watched", ErrNotConfigured, ssid)
+	}
+
+	delete(w.status, ssid)
+
+	return w.save(api)
+}
+
+// save keeps api as the API entries and in the state. The caller holds
+// mu.
+func (w *Watchlist) save(api []WatchEntry) error {
+	if w.Wpa.State != nil {
+		if err := w.Wpa.State.SetWatchlist(api); err != nil {
+			return err
+		}
+	}
+	w.api = api
+
+	return nil
+}
+
+// Observe checks results for the watched SSIDs. It is called with the
+// results of every scan.
+func (w *Watchlist) Observe(results ScanResults) {
+	wpa := w.Wpa
+	iface := wpa.Cfg().StationInterface
+
+	strongest := map[string]int{}
+	for _, network := range results.Networks {
+		if rssi, ok := strongest[network.Ssid]; !ok || network.SignalLevel > rssi {
+			strongest[network.Ssid] = network.SignalLevel
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entries, _ := w.entries()
+	for _, e := range entries {
+		st, ok := w.status[e.Ssid]
+		if !ok {
+			st = &WatchStatus{}
+			w.status[e.Ssid] = st
+		}
+
+		rssi, seen := strongest[e.Ssid]
+		if seen && (e.MinRssi == 0 || rssi >= e.MinRssi) {
+			t := results.Time
+			st.Rssi, st.LastSeen, st.misses = rssi, &t, 0
+			if st.InRange {
+				continue
+			}
+
+			st.InRange, st.Appeared = true, &t
+			wpa.Log.Info("watched ssid appeared", "iface", iface, "ssid", e.Ssid, "rssi", rssi, "auto_connect", e.AutoConnect)
+			wpa.publish(Event{
+				Type:    EventWatchedAppeared,
+				Source:  "watchlist",
+				Iface:   iface,
+				Message: fmt.Sprintf("ssid=%s rssi=%d", e.Ssid, rssi),
+			})
+
+			if e.AutoConnect && !w.connecting {
+				w.connecting = true
+				go w.connect(e.Ssid)
+			}
+			continue
+		}
+
+		if !st.InRange {
+			continue
+		}
+		if st.misses++; st.misses < watchMisses {
+			continue
+		}
+
+		st.InRange, st.Rssi = false, 0
+		wpa.Log.Info("watched ssid gone", "iface", iface, "ssid", e.Ssid)
+		wpa.publish(Event{
+			Type:    EventWatchedGone,
+			Source:  "watchlist",
+			Iface:   iface,
+			Message: fmt.Sprintf("ssid=%s", e.Ssid),
+		})
+	}
+}
+
+// connect connects the station to ssid with its profile, unless it is
+// already on it.
+func (w *Watchlist) connect(ssid string) {
+	wpa := w.Wpa
+	iface := wpa.Cfg().StationInterface
+
+	ctx, cancel := context.WithTimeout(context.Background(), watchConnectTimeout)
+	defer cancel()
+
+	err := func() error {
+		if status, err := w.Provisioner.Status(ctx); err == nil && status["wpa_state"] == "COMPLETED" && status["ssid"] == ssid {
+			return nil
+		}
+
+		profile, err := wpa.Profiles.Get(ssid)
+		if err != nil {
+			return fmt.Errorf("%w: save a profile with the credentials of %s", err, ssid)
+		}
+
+		_, err = w.Provisioner.ConnectNetwork(ctx, profile.WpaCredentials)
+		return err
+	}()
+
+	if err != nil {
+		wpa.Log.Warn("could not connect to watched ssid", "iface", iface, "ssid", ssid, "error", err)
+	} else {
+		wpa.Log.Info("connected to watched ssid", "iface", iface, "ssid", ssid)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.connecting = false
+	if st, ok := w.status[ssid]; ok {
+		st.LastError = ""
+		if err != nil {
+			st.LastError = err.Error()
+		} else {
+			st.Connects++
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package iotwifi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+)
+
+// Webhook defaults.
+const (
+	DefaultWebhookTimeout  = 10 * time.Second
+	DefaultWebhookAttempts = 3
+	DefaultWebhookBackoff  = 2 * time.Second // doubled after each failed attempt
+)
+
+// WebhookAllEvents in WebhookCfg.Events posts every event.
+const WebhookAllEvents = "*"
+
+// defaultWebhookEvents are posted when WebhookCfg.Events is empty, the
+// changes of the device's state a backend follows.
+var defaultWebhookEvents = []string{
+	EventConnected,
+	EventDisconnected,
+	EventAPFallback,
+	EventClientJoined,
+	EventClientLeft,
+	EventProvisioned,
+}
+
+// WebhookCfg configures a webhook of the Webhook and is used by SetupCfg.
+type WebhookCfg struct {
+	Url        string            `json:"url"`         // https://provisioning.example.com/txwifi, no webhook if empty
+	Headers    map[string]string `json:"headers"`     // sent with every POST, such as Authorization
+	Events     []string          `json:"events"`      // event types to post, the lifecycle events if empty, * for all
+	TimeoutSec int               `json:"timeout_sec"` // of each attempt, 10 by default
+	Retry      WebhookRetryCfg   `json:"retry"`
+}
+
+// WebhookRetryCfg is how failed POSTs are retried.
+type WebhookRetryCfg struct {
+	Attempts   int `json:"attempts"`    // in all, 3 by default, 1 to never retry
+	BackoffSec int `json:"backoff_sec"` // before the first retry, doubled for each next one, 2 by default
+}
+
+// Validate checks the url and the retry policy.
+func (cfg WebhookCfg) Validate() error {
+	if cfg.Url == "" {
+		return nil
+	}
+
+	u, err := url.Parse(cfg.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, want http:// or https://", cfg.Url)
+	}
+	if cfg.TimeoutSec < 0 || cfg.Retry.Attempts < 0 || cfg.Retry.BackoffSec < 0 {
+		return fmt.Errorf("timeout_sec, retry.attempts and retry.backoff_sec must not be negative")
+	}
+
+	return nil
+}
+
+// wants reports whether events of type evType are posted.
+func (cfg WebhookCfg) wants(evType string) bool {
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+
+	return contains(events, evType) || contains(events, WebhookAllEvents)
+}
+
+// timeout returns the configured timeout of an attempt.
+func (cfg WebhookCfg) timeout() time.Duration {
+	if cfg.TimeoutSec > 0 {
+		return time.Duration(cfg.TimeoutSec) * time.Second
+	}
+
+	return DefaultWebhookTimeout
+}
+
+// attempts returns the configured number of attempts.
+func (cfg WebhookRetryCfg) attempts() int {
+	if cfg.Attempts > 0 {
+		return cfg.Attempts
+	}
+
+	return DefaultWebhookAttempts
+}
+
+// backoff returns the configured wait before the first retry.
+func (cfg WebhookRetryCfg) backoff() time.Duration {
+	if cfg.BackoffSec > 0 {
+		return time.Duration(cfg.BackoffSec) * time.Second
+	}
+
+	return DefaultWebhookBackoff
+}
+
+// WebhookCfgs returns the webhooks configured, webhook and webhooks,
+// leaving out those without a url.
+func (s *SetupCfg) WebhookCfgs() []WebhookCfg {
+	hooks := []WebhookCfg{}
+	for _, hook := range append([]WebhookCfg{s.Webhook}, s.Webhooks...) {
+		if hook.Url != "" {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	return hooks
+}
+
+// WebhookPayload is the body posted to the webhook.
+type WebhookPayload struct {
+	Device string    `json:"device"` // the device_id of the Identity
+	Event  Event     `json:"event"`
+	Client *APClient `json:"client,omitempty"` // the station of AP client events, with its lease if it has one
+}
+
+// webhookError is a failed POST, retried unless the webhook rejected
+// the event for good.
+type webhookError struct {
+	err   error
+	retry bool
+}
+
+func (e *webhookError) Error() string {
+	return e.err.Error()
+}
+
+// Webhook posts the events on a bus to the configured URLs as they
+// happen, so a backend learns of the device's state changes, such as a
+// phone joining the setup AP, without polling.
+type Webhook struct {
+	Wpa *WpaCfg
+
+	mu     sync.Mutex
+	hooks  []WebhookCfg
+	client *http.Client
+}
+
+// NewWebhook produces a Webhook posting nowhere until configured.
+func NewWebhook(wpa *WpaCfg) *Webhook {
+	return &Webhook{
+		Wpa:    wpa,
+		client: &http.Client{},
+	}
+}
+
+// Configure applies hooks, taking effect with the next event.
+func (h *Webhook) Configure(hooks []WebhookCfg) {
+	for _, hook := range hooks {
+		for _, value := range hook.Headers {
+			secrets.add(value)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.hooks = hooks
+}
+
+// config returns the webhooks of the next event.
+func (h *Webhook) config() []WebhookCfg {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.hooks
+}
+
+// Run posts the events on bus until ctx is done. Each event is delivered
+// in the background, retried as its webhook says, so a slow webhook
+// neither holds up the others nor misses the events that follow.
+func (h *Webhook) Run(ctx context.Context, bus *EventBus) {
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+
+			var payload *WebhookPayload
+			for _, hook := range h.config() {
+				if !hook.wants(ev.Type) {
+					continue
+				}
+				if payload == nil {
+					p := h.payload(ev)
+					payload = &p
+				}
+
+				go h.deliver(ctx, hook, *payload)
+			}
+		}
+	}
+}
+
+// deliver posts payload to hook, retrying with backoff until it is
+// accepted, rejected for good or out of attempts.
+func (h *Webhook) deliver(ctx context.Context, hook WebhookCfg, payload WebhookPayload) {
+	backoff := hook.Retry.backoff()
+	attempts := hook.Retry.attempts()
+
+	for attempt := 1; ; attempt++ {
+		err := h.post(ctx, hook, payload)
+		if err == nil {
+			return
+		}
+
+		werr, ok := err.(*webhookError)
+		if attempt >= attempts || (ok && !werr.retry) {
+			h.Wpa.Log.Warn("webhook failed", "host", webhookHost(hook.Url), "event", payload.Event.Type, "attempts", attempt, "error", err)
+			return
+		}
+		h.Wpa.Log.Debug("webhook failed, retrying", "host", webhookHost(hook.Url), "event", payload.Event.Type, "attempt", attempt, "retry", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// payload returns the payload of ev, with the AP client it is about.
+func (h *Webhook) payload(ev Event) WebhookPayload {
+	payload := WebhookPayload{Event: ev}
+
+	identity, err := h.Wpa.Identity()
+	if err != nil {
+		h.Wpa.Log.Warn("webhook without device id", "error", err)
+	}
+	payload.Device = identity.DeviceId
+
+	if ev.Mac == "" {
+		return payload
+	}
+
+	// a client joining for the first time has no lease yet
+	payload.Client = &APClient{Mac: ev.Mac}
+	leases, _ := dhcp.ReadLeases(h.Wpa.leaseFile())
+	for _, lease := range leases {
+		if lease.Mac == ev.Mac {
+			payload.Client.Ip = lease.Ip
+			payload.Client.Hostname = lease.Hostname
+		}
+	}
+
+	return payload
+}
+
+// post sends payload to hook once. Errors reaching the webhook, and
+// 429 and 5xx answers, are worth retrying; other answers outside 2xx
+// are not.
+func (h *Webhook) post(ctx context.Context, hook WebhookCfg, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return &webhookError{err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hook.timeout())
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{err: err}
+	}
+	req = req.WithContext(ctx)
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Txwifi-Event", payload.Event.Type)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &webhookError{err: err, retry: true}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return &webhookError{err: fmt.Errorf("webhook answered %s", resp.Status), retry: retry}
+	}
+
+	return nil
+}
+
+// webhookHost returns the host of the webhook url, logged instead of a
+// url that may carry a token.
+func webhookHost(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
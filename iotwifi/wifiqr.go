@@ -0,0 +1,169 @@
+package iotwifi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Authentication types of a WIFI: QR payload.
+const (
+	QRTypeWpa    = "WPA"
+	QRTypeSae    = "SAE"
+	QRTypeWep    = "WEP"
+	QRTypeEap    = "WPA2-EAP"
+	QRTypeNoPass = "nopass"
+)
+
+// WifiQR is the body of the QR connect endpoint.
+type WifiQR struct {
+	Qr string `json:"qr"` // WIFI:T:WPA;S:ssid;P:pass;;
+}
+
+// ParseWifiQR parses a WIFI: QR payload such as WIFI:T:WPA;S:ssid;P:pass;;
+// into credentials. WPA2-EAP payloads carry E (method), I (identity) and
+// PH2 (phase 2) as well. WEP is not supported.
+func ParseWifiQR(payload string) (WpaCredentials, error) {
+	creds := WpaCredentials{}
+
+	payload = strings.TrimSpace(payload)
+	if !strings.HasPrefix(payload, "WIFI:") {
+		return creds, fmt.Errorf("qr payload does not start with WIFI:")
+	}
+
+	fields := map[string]string{}
+	for _, field := range splitQR(payload[len("WIFI:"):]) {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields[strings.ToUpper(kv[0])] = unescapeQR(kv[1])
+	}
+
+	creds.Ssid = fields["S"]
+	if creds.Ssid == "" {
+		return creds, fmt.Errorf("qr payload has no ssid")
+	}
+	creds.Hidden = strings.EqualFold(fields["H"], "true")
+
+	switch auth := fields["T"]; strings.ToUpper(auth) {
+	case strings.ToUpper(QRTypeNoPass):
+	case "", QRTypeWpa:
+		// an omitted type with a password is WPA
+		creds.Psk = fields["P"]
+	case QRTypeSae:
+		creds.Psk = fields["P"]
+		creds.KeyMgmt = KeyMgmtSae
+	case QRTypeEap:
+		creds.EapMethod = fields["E"]
+		creds.Identity = fields["I"]
+		creds.Password = fields["P"]
+		creds.Phase2 = fields["PH2"]
+		if creds.EapMethod == "" {
+			return creds, fmt.Errorf("qr payload has no eap method")
+		}
+	case QRTypeWep:
+		return creds, fmt.Errorf("wep networks are not supported")
+	default:
+		return creds, fmt.Errorf("unsupported qr authentication type %q", auth)
+	}
+
+	return creds, nil
+}
+
+// FormatWifiQR builds the WIFI: QR payload for creds.
+func FormatWifiQR(creds WpaCredentials) string {
+	auth := QRTypeWpa
+	switch {
+	case creds.EapMethod != "":
+		auth = QRTypeEap
+	case creds.Psk == "":
+		auth = QRTypeNoPass
+	case creds.KeyMgmt == KeyMgmtSae:
+		auth = QRTypeSae
+	}
+
+	var b strings.Builder
+	b.WriteString("WIFI:T:" + auth + ";S:" + escapeQR(creds.Ssid) + ";")
+
+	switch auth {
+	case QRTypeEap:
+		b.WriteString("E:" + escapeQR(creds.EapMethod) + ";")
+		if creds.Phase2 != "" {
+			b.WriteString("PH2:" + escapeQR(creds.Phase2) + ";")
+		}
+		b.WriteString("I:" + escapeQR(creds.Identity) + ";")
+		b.WriteString("P:" + escapeQR(creds.Password) + ";")
+	case QRTypeNoPass:
+	default:
+		b.WriteString("P:" + escapeQR(creds.Psk) + ";")
+	}
+
+	if creds.Hidden {
+		b.WriteString("H:true;")
+	}
+	b.WriteString(";")
+
+	return b.String()
+}
+
+// APWifiQR returns the WIFI: QR payload for joining the device's own AP.
+func (wpa *WpaCfg) APWifiQR() string {
+	ap := wpa.Cfg().HostApdCfg
+
+	creds := WpaCredentials{
+		Ssid:   ap.Ssid,
+		Psk:    ap.WpaPassphrase,
+		Hidden: ap.Hidden,
+	}
+	// transition mode APs still take WPA2 clients
+	if ap.WpaKeyMgmt == KeyMgmtSae {
+		creds.KeyMgmt = KeyMgmtSae
+	}
+
+	return FormatWifiQR(creds)
+}
+
+// splitQR splits a payload on unescaped semicolons, dropping empty fields.
+func splitQR(s string) []string {
+	fields := []string{}
+	field := ""
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			field += s[i : i+2]
+			i++
+		case s[i] == ';':
+			if field != "" {
+				fields = append(fields, field)
+			}
+			field = ""
+		default:
+			field += s[i : i+1]
+		}
+	}
+	if field != "" {
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// qrEscaper escapes the characters with a meaning in WIFI: payloads.
+var qrEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`)
+
+func escapeQR(s string) string {
+	return qrEscaper.Replace(s)
+}
+
+// unescapeQR drops backslash escapes.
+func unescapeQR(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package iotwifi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWifiQR(t *testing.T) {
+	tests := []struct {
+		payload string
+		creds   WpaCredentials
+	}{
+		{"WIFI:T:WPA;S:home;P:secret;;", WpaCredentials{Ssid: "home", Psk: "secret"}},
+		{"  WIFI:S:home;T:wpa;P:secret;;\n", WpaCredentials{Ssid: "home", Psk: "secret"}},
+		{"WIFI:S:home;P:secret;;", WpaCredentials{Ssid: "home", Psk: "secret"}},
+		{"WIFI:T:SAE;S:home;P:secret;H:true;;", WpaCredentials{Ssid: "home", Psk: "secret", KeyMgmt: KeyMgmtSae, Hidden: true}},
+		{"WIFI:T:nopass;S:cafe;P:ignored;H:false;;", WpaCredentials{Ssid: "cafe"}},
+		{"WIFI:T:NOPASS;S:cafe", WpaCredentials{Ssid: "cafe"}},
+		{`WIFI:T:WPA;S:a\;b\:c\,d\"e\\f;P:p\;ss;;`, WpaCredentials{Ssid: `a;b:c,d"e\f`, Psk: "p;ss"}},
+		{`WIFI:S:x:y;P:\;;;`, WpaCredentials{Ssid: "x:y", Psk: ";"}},
+		{`WIFI:S:end\`, WpaCredentials{Ssid: `end\`}},
+		{"WIFI:S:café ☕;P:pässwörd;;", WpaCredentials{Ssid: "café ☕", Psk: "pässwörd"}},
+		{"WIFI:S:\xff\x00;;", WpaCredentials{Ssid: "\xff\x00"}},
+		{"WIFI:S:home;X:unknown;novalue;P:secret;;", WpaCredentials{Ssid: "home", Psk: "secret"}},
+		{
+			"WIFI:T:WPA2-EAP;S:corp;E:PEAP;PH2:MSCHAPV2;I:alice;P:hunter2;;",
+			WpaCredentials{Ssid: "corp", EapMethod: "PEAP", Phase2: "MSCHAPV2", Identity: "alice", Password: "hunter2"},
+		},
+	}
+
+	for _, tt := range tests {
+		creds, err := ParseWifiQR(tt.payload)
+		if err != nil || !reflect.DeepEqual(creds, tt.creds) {
+			t.Errorf("ParseWifiQR(%q) = %+v, %v, want %+v", tt.payload, creds, err, tt.creds)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"WIFI;S:home;;",
+		"wifi:S:home;;",
+		"WIFI:T:WPA;P:secret;;",
+		"WIFI:S:;;",
+		"WIFI:T:WEP;S:old;P:12345;;",
+		"WIFI:T:WPA3;S:home;P:secret;;",
+		"WIFI:T:WPA2-EAP;S:corp;I:alice;P:hunter2;;",
+	}
+	for _, payload := range invalid {
+		if creds, err := ParseWifiQR(payload); err == nil {
+			t.Errorf("ParseWifiQR(%q) = %+v", payload, creds)
+		}
+	}
+}
+
+func TestFormatWifiQR(t *testing.T) {
+	tests := []struct {
+		creds   WpaCredentials
+		payload string
+	}{
+		{WpaCredentials{Ssid: "home", Psk: "secret"}, "WIFI:T:WPA;S:home;P:secret;;"},
+		{WpaCredentials{Ssid: "home", Psk: "secret", KeyMgmt: KeyMgmtTransition}, "WIFI:T:WPA;S:home;P:secret;;"},
+		{WpaCredentials{Ssid: "home", Psk: "secret", KeyMgmt: KeyMgmtSae, Hidden: true}, "WIFI:T:SAE;S:home;P:secret;H:true;;"},
+		{WpaCredentials{Ssid: "cafe"}, "WIFI:T:nopass;S:cafe;;"},
+		{WpaCredentials{Ssid: `a;b:c,d"e\f`, Psk: "p;ss"}, `WIFI:T:WPA;S:a\;b\:c\,d\"e\\f;P:p\;ss;;`},
+		{
+			WpaCredentials{Ssid: "corp", EapMethod: "TTLS", Phase2: "auth=PAP", Identity: "alice", Password: "p:w", Psk: "unused"},
+			`WIFI:T:WPA2-EAP;S:corp;E:TTLS;PH2:auth=PAP;I:alice;P:p\:w;;`,
+		},
+		{WpaCredentials{Ssid: "corp", EapMethod: "TLS", Identity: "dev"}, "WIFI:T:WPA2-EAP;S:corp;E:TLS;I:dev;P:;;"},
+	}
+
+	for _, tt := range tests {
+		if payload := FormatWifiQR(tt.creds); payload != tt.payload {
+			t.Errorf("FormatWifiQR(%+v) = %q, want %q", tt.creds, payload, tt.payload)
+		}
+	}
+}
+
+func TestAPWifiQR(t *testing.T) {
+	wpa, _, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	tests := []struct {
+		keyMgmt string
+		hidden  bool
+		payload string
+	}{
+		{"", false, "WIFI:T:WPA;S:iot-wifi-test;P:iotwifipass;;"},
+		{KeyMgmtTransition, true, "WIFI:T:WPA;S:iot-wifi-test;P:iotwifipass;H:true;;"},
+		{KeyMgmtSae, false, "WIFI:T:SAE;S:iot-wifi-test;P:iotwifipass;;"},
+	}
+
+	for _, tt := range tests {
+		cfg := *wpa.Cfg()
+		cfg.HostApdCfg.WpaKeyMgmt = tt.keyMgmt
+		cfg.HostApdCfg.Hidden = tt.hidden
+		wpa.WpaCfg = &cfg
+
+		if payload := wpa.APWifiQR(); payload != tt.payload {
+			t.Errorf("key_mgmt %q: %q, want %q", tt.keyMgmt, payload, tt.payload)
+		}
+	}
+}
+
+func FuzzWifiQR(f *testing.F) {
+	f.Add("home", "secret", "", "", "", "", false, false)
+	f.Add(`a;b:c,d"e\f`, `\`, "", "", "", "", true, true)
+	f.Add("corp", "", "PEAP", "MSCHAPV2", "alice", "hunter2", false, false)
+
+	f.Fuzz(func(t *testing.T, ssid, psk, eapMethod, phase2, identity, password string, sae, hidden bool) {
+		creds := WpaCredentials{Ssid: ssid, Psk: psk, EapMethod: eapMethod, Phase2: phase2, Identity: identity, Password: password, Hidden: hidden}
+		if sae {
+			creds.KeyMgmt = KeyMgmtSae
+		}
+
+		payload := FormatWifiQR(creds)
+		parsed, err := ParseWifiQR(payload)
+		if ssid == "" {
+			if err == nil {
+				t.Fatalf("%q parsed without an ssid", payload)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", payload, err)
+		}
+		if again := FormatWifiQR(parsed); again != payload {
+			t.Fatalf("%+v formats to %q, parsed to %+v formats to %q", creds, payload, parsed, again)
+		}
+		if parsed.Ssid != ssid || parsed.Hidden != hidden {
+			t.Fatalf("%q parsed to %+v", payload, parsed)
+		}
+	})
+}
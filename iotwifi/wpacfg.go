@@ -2,68 +2,257 @@ package iotwifi
 
 import (
 	"bytes"
-	"os/exec"
-	"regexp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
 )
 
 // WpaCfg for configuring wpa
 type WpaCfg struct {
-	Log    bunyan.Logger
-	WpaCmd []string
-	WpaCfg *SetupCfg
+	Log      Logger
+	WpaCmd   []string
+	WpaCfg   *SetupCfg // the config it starts with, read through Cfg once running
+	Profiles *ProfileStore
+	State    *StateStore // optional, records connects and AP toggles
+	Runner   Runner
+	Bus      *EventBus    // optional, receives events raised by WpaCfg itself
+	Firewall Firewall     // detected on first use when nil
+	OUI      *OUIRegistry // optional, names the vendors of BSSIDs and AP clients
+
+	fwMu sync.Mutex
+
+	connMu       sync.Mutex
+	connectivity Connectivity
+
+	latencyMu sync.Mutex
+	latency   []LatencyResult
+
+	ops opQueue // operations on the networks and scans, one at a time
+
+	cfgMu sync.RWMutex
+}
+
+// Cfg returns the running config. It is never changed in place, reloads
+// and API changes replace it, so it can be read without a lock.
+func (wpa *WpaCfg) Cfg() *SetupCfg {
+	wpa.cfgMu.RLock()
+	defer wpa.cfgMu.RUnlock()
+
+	return wpa.WpaCfg
 }
 
-// WpaNetwork defines a wifi network to connect to.
-type WpaNetwork struct {
-	Bssid       string `json:"bssid"`
-	Frequency   string `json:"frequency"`
-	SignalLevel string `json:"signal_level"`
-	Flags       string `json:"flags"`
-	Ssid        string `json:"ssid"`
+// SetCfg replaces the running config with cfg.
+func (wpa *WpaCfg) SetCfg(cfg *SetupCfg) {
+	wpa.cfgMu.Lock()
+	defer wpa.cfgMu.Unlock()
+
+	wpa.WpaCfg = cfg
+}
+
+// updateCfg replaces the running config with a copy changed by change.
+// Slices of the copy are shared with the running config, change must
+// replace them rather than modify them.
+func (wpa *WpaCfg) updateCfg(change func(cfg *SetupCfg)) {
+	wpa.cfgMu.Lock()
+	defer wpa.cfgMu.Unlock()
+
+	cfg := *wpa.WpaCfg
+	change(&cfg)
+	wpa.WpaCfg = &cfg
+}
+
+// WpaConfiguredNetwork is a network block configured in wpa_supplicant.
+type WpaConfiguredNetwork struct {
+	Id    string `json:"id"`
+	Ssid  string `json:"ssid"`
+	Bssid string `json:"bssid"`
+	Flags string `json:"flags"`
 }
 
 // WpaCredentials defines wifi network credentials.
 type WpaCredentials struct {
-	Ssid string `json:"ssid"`
-	Psk  string `json:"psk"`
+	Ssid    string `json:"ssid"`
+	Psk     string `json:"psk"`      // the passphrase, or the pre-hashed PSK as 64 hex digits
+	KeyMgmt string `json:"key_mgmt"` // WPA-PSK (default), SAE, "WPA-PSK SAE" or NONE
+	Hidden  bool   `json:"hidden"`   // probe for the ssid, it is not broadcast
+
+	PreferredBand string `json:"preferred_band"` // 2.4, 5 or any (default), the band to connect on when the ssid is on both
+
+	// 802.1X (WPA2-Enterprise), used when EapMethod is set
+	Identity   string `json:"identity"`
+	Password   string `json:"password"`
+	EapMethod  string `json:"eap_method"`  // PEAP, TTLS or TLS
+	Phase2     string `json:"phase2"`      // MSCHAPV2 or auth=MSCHAPV2
+	CACert     string `json:"ca_cert"`     // path to the CA certificate
+	ClientCert string `json:"client_cert"` // path to the client certificate (EAP-TLS)
+	PrivateKey string `json:"private_key"` // path to the client private key (EAP-TLS)
+
+	Retry *ConnectRetryCfg `json:"retry,omitempty"` // overrides the fields set of connect_retry for this connect
+}
+
+// Key management modes for WpaCredentials.KeyMgmt and HostApdCfg.WpaKeyMgmt.
+const (
+	KeyMgmtWpaPsk     = "WPA-PSK"
+	KeyMgmtSae        = "SAE"
+	KeyMgmtTransition = "WPA-PSK SAE"
+	KeyMgmtNone       = "NONE"
+	KeyMgmtEap        = "WPA-EAP"
+)
+
+// pmfFor returns the ieee80211w (management frame protection) setting a
+// key management mode requires: mandatory for SAE, optional in transition
+// mode and unset otherwise.
+func pmfFor(keyMgmt string) string {
+	switch keyMgmt {
+	case KeyMgmtSae:
+		return "2"
+	case KeyMgmtTransition:
+		return "1"
+	}
+
+	return ""
+}
+
+// Bands for WpaCredentials.PreferredBand.
+const (
+	PreferredBandAny = "any"
+	PreferredBand24  = "2.4"
+	PreferredBand5   = "5"
+)
+
+// freqList returns the freq_list that keeps a network on band, empty for
+// any band.
+func freqList(band string) (string, error) {
+	freqs := []string{}
+	switch band {
+	case "", PreferredBandAny:
+		return "", nil
+	case PreferredBand24:
+		for channel := 1; channel <= 14; channel++ {
+			freqs = append(freqs, strconv.Itoa(ChannelFrequency(channel, Band24)))
+		}
+	case PreferredBand5:
+		channels := []int{}
+		for channel := range channels5 {
+			channels = append(channels, channel)
+		}
+		sort.Ints(channels)
+		for _, channel := range channels {
+			freqs = append(freqs, strconv.Itoa(ChannelFrequency(channel, Band5)))
+		}
+	default:
+		return "", fmt.Errorf("unknown preferred_band %q, want 2.4, 5 or any", band)
+	}
+
+	return strings.Join(freqs, " "), nil
 }
 
 // WpaConnection defines a WPA connection.
 type WpaConnection struct {
-	Ssid    string `json:"ssid"`
-	State   string `json:"state"`
-	Ip      string `json:"ip"`
-	Message string `json:"message"`
+	Ssid     string        `json:"ssid"`
+	State    string        `json:"state"`
+	Ip       string        `json:"ip"`
+	Gateway  string        `json:"gateway"`
+	Dns      []string      `json:"dns"`
+	Ipv6     []string      `json:"ipv6"`     // global IPv6 addresses
+	Gateway6 string        `json:"gateway6"` // IPv6 default router
+	Message  string        `json:"message"`
+	Reason   ConnectReason `json:"reason"`
+
+	Connectivity     string `json:"connectivity"`       // online, captive, no-dns or link-only
+	CaptivePortalUrl string `json:"captive_portal_url"` // set when captive
+
+	Attempts []ConnectAttempt `json:"attempts,omitempty"` // of ConnectNetwork, oldest first
 }
 
+// ConnectReason explains why a connection attempt failed.
+type ConnectReason string
+
+// Reasons reported in WpaConnection.Reason.
+const (
+	ReasonNone            ConnectReason = ""
+	ReasonWrongPassword   ConnectReason = "WRONG_PASSWORD"
+	ReasonAuthFailed      ConnectReason = "AUTH_FAILED"
+	ReasonNetworkNotFound ConnectReason = "NETWORK_NOT_FOUND"
+	ReasonTimeout         ConnectReason = "TIMEOUT"
+	ReasonLostControl     ConnectReason = "LOST_CONTROL"
+)
+
+// notFoundScans is how many scans must miss the network before it is
+// reported not found; the first may have started before it was enabled.
+const notFoundScans = 2
+
+// addressTimeout bounds how long ConnectNetwork waits for DHCP.
+const addressTimeout = 20 * time.Second
+
+// ipv6Grace is how long ConnectNetwork waits for an IPv4 address once it
+// has a global IPv6 one.
+const ipv6Grace = 5 * time.Second
+
 // NewWpaCfg produces WpaCfg configuration types.
-func NewWpaCfg(log bunyan.Logger, cfgLocation string) *WpaCfg {
+func NewWpaCfg(log Logger, cfgLocation string) (*WpaCfg, error) {
 
 	setupCfg, err := loadCfg(cfgLocation)
 	if err != nil {
-		log.Error("Could not load config: %s", err.Error())
-		panic(err)
+		// ConfigErrors already say which fields are wrong
+		if errors.Is(err, ErrConfig) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrConfig, err)
 	}
 
-	return &WpaCfg{
-		Log:    log,
-		WpaCfg: setupCfg,
+	runner := NewSystemRunner(setupCfg.WpaSupplicantCfg.ctrlDir())
+
+	// saved passphrases are only readable on this device
+	var cipher *CredentialCipher
+	if setupCfg.Credentials.Encrypt {
+		cipher, err = NewCredentialCipher(context.Background(), runner, setupCfg.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		if cipher.Source == KeySourceMachineId {
+			log.Warn("credentials key is derived from the machine id, which is stored beside them", "key_source", cipher.Source)
+		}
+	}
+
+	profiles, err := NewProfileStore(setupCfg.ProfileFile, cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := OpenStateStore(setupCfg.StateFile)
+	if err != nil {
+		return nil, err
 	}
+
+	log = WithLevel(Scrub(log), setupCfg.LogLevel)
+
+	return &WpaCfg{
+		Log:      log,
+		WpaCfg:   setupCfg,
+		Profiles: profiles,
+		State:    state,
+		Runner:   runner,
+		OUI:      NewOUIRegistry(log, setupCfg.Oui),
+	}, nil
 }
 
 // Status returns the AP status.
-func (wpa *WpaCfg) APStatus() (map[string]interface{}, error) {
+func (wpa *WpaCfg) APStatus(ctx context.Context) (map[string]interface{}, error) {
 	cfgMap := make(map[string]interface{}, 0)
 
 	// get the standard stats
-	stateOut, err := exec.Command("hostapd_cli", "-i", "uap0", "status").Output()
+	stateOut, err := wpa.Runner.Output(ctx, "hostapd_cli", "-i", wpa.Cfg().APInterface, "status")
 	if err != nil {
-		wpa.Log.Fatal("Got error checking state: %s", err.Error())
-		return cfgMap, err
+		return cfgMap, fmt.Errorf("%w: checking state: %s", ErrAPStatusFailed, err)
 	}
 
 	// Remove the indexing associated with ssid, bssid, and bss
@@ -73,134 +262,593 @@ func (wpa *WpaCfg) APStatus() (map[string]interface{}, error) {
 	for key, val := range cfgMapper(stateOut) {
 		cfgMap[key] = val
 	}
+	if ssid, ok := cfgMap["ssid"].(string); ok {
+		cfgMap["ssid"] = DecodeSsidText(ssid)
+	}
 
-	// get the list of connected clients
-	clientsOut, err := exec.Command("hostapd_cli", "-i", "uap0", "list_sta").Output()
+	// get the connected clients
+	clients, err := wpa.APClients(ctx)
 	if err != nil {
-		wpa.Log.Fatal("Got error checking clients: %s", err.Error())
 		return cfgMap, err
 	}
+	cfgMap["clients"] = clients
 
-	clients := []string{}
-	lines := strings.Split(string(clientsOut), "\n")
-	for _, line := range lines {
-		if len(line) > 1 {
-			clients = append(clients, string(line))
+	return cfgMap, nil
+}
+
+// ListConfiguredNetworks returns the networks configured in wpa_supplicant.
+func (wpa *WpaCfg) ListConfiguredNetworks(ctx context.Context) ([]WpaConfiguredNetwork, error) {
+	networks := []WpaConfiguredNetwork{}
+
+	listOut, err := wpa.wpaCtl(ctx, "LIST_NETWORKS")
+	if err != nil {
+		return networks, fmt.Errorf("%w: list_networks: %s", ErrCommandFailed, err)
+	}
+
+	// first line is the "network id / ssid / bssid / flags" header; the
+	// flags may be empty, so the tab before them is not trimmed
+	lines := strings.Split(strings.TrimRight(string(listOut), "\n"), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 {
+			continue
 		}
+
+		networks = append(networks, WpaConfiguredNetwork{
+			Id:    fields[0],
+			Ssid:  DecodeSsidText(fields[1]),
+			Bssid: fields[2],
+			Flags: fields[3],
+		})
 	}
-	cfgMap["clients"] = clients
 
-	return cfgMap, nil
+	return networks, nil
+}
+
+// ConnectNetwork connects to a wifi network, recording the attempt in the
+// state history and publishing its outcome.
+func (wpa *WpaCfg) ConnectNetwork(ctx context.Context, creds WpaCredentials) (WpaConnection, error) {
+	ctx, done, err := wpa.ops.acquire(ctx, OpConnect, creds.Ssid)
+	if err != nil {
+		return WpaConnection{State: "FAIL", Message: err.Error()}, err
+	}
+	defer done()
+
+	wpa.publish(Event{
+		Type:    EventConnecting,
+		Source:  "connect",
+		Iface:   wpa.Cfg().StationInterface,
+		Message: fmt.Sprintf("ssid=%q", creds.Ssid),
+	})
+
+	start := time.Now()
+	connection, err := wpa.connectNetwork(ctx, creds)
+	wpa.recordConnect(creds.Ssid, connection, err, time.Since(start))
+	wpa.publishConnect(creds.Ssid, connection, err)
+
+	return connection, err
+}
+
+// publishConnect publishes provisioning-complete for a successful
+// connect, fell-back-to-ap for a failed one while the AP is up.
+func (wpa *WpaCfg) publishConnect(ssid string, connection WpaConnection, err error) {
+	ev := Event{
+		Source: "connect",
+		Iface:  wpa.Cfg().StationInterface,
+	}
+
+	if err == nil {
+		ev.Type = EventProvisioned
+		ev.Message = fmt.Sprintf("ssid=%q ip=%s", ssid, connection.Ip)
+		wpa.publish(ev)
+		return
+	}
+
+	if wpa.State != nil && wpa.State.State().APDisabled {
+		return
+	}
+
+	ev.Type = EventAPFallback
+	ev.Message = fmt.Sprintf("ssid=%q reason=%s", ssid, connection.Reason)
+	wpa.publish(ev)
 }
 
-// ConfiguredNetworks returns a list of configured wifi networks.
-func (wpa *WpaCfg) ConfiguredNetworks() string {
-	netOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
+// connectNetwork connects to a wifi network, retrying as the connect_retry
+// policy, overridden by creds.Retry, says. The attempts are made with the
+// network of the ssid, or one added for it, configured for creds, which
+// replaces any other networks of the ssid once connected, and is put back
+// or removed if the connect fails.
+func (wpa *WpaCfg) connectNetwork(ctx context.Context, creds WpaCredentials) (WpaConnection, error) {
+	iface := wpa.Cfg().StationInterface
+
+	policy := wpa.Cfg().ConnectRetry.override(creds.Retry)
+	if err := policy.Validate(); err != nil {
+		return WpaConnection{}, fmt.Errorf("%w: retry: %s", ErrInvalid, err)
+	}
+	if _, err := freqList(creds.PreferredBand); err != nil {
+		return WpaConnection{}, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	staged, err := wpa.stageNetwork(ctx, creds)
 	if err != nil {
-		wpa.Log.Fatal(err)
+		wpa.dropNetwork(ctx, staged)
+		return WpaConnection{}, err
 	}
 
-	return string(netOut)
+	attempts := []ConnectAttempt{}
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		connection, err := wpa.connectAttempt(ctx, creds, staged, policy.attemptTimeout())
+
+		outcome := ConnectAttempt{
+			Attempt:  attempt,
+			Started:  started.UTC(),
+			Duration: time.Since(started),
+			State:    connection.State,
+			Reason:   connection.Reason,
+		}
+		if err != nil {
+			outcome.Error = err.Error()
+		}
+
+		if err == nil || attempt >= policy.attempts() || !retryable(connection.Reason) || ctx.Err() != nil {
+			// a connect that completed keeps its network, saved or not
+			if err != nil && connection.State != "COMPLETED" {
+				wpa.dropNetwork(ctx, staged)
+			}
+			connection.Attempts = append(attempts, outcome)
+			return connection, err
+		}
+
+		outcome.Backoff = policy.backoff(attempt)
+		attempts = append(attempts, outcome)
+		wpa.Log.Info("retrying connect", "iface", iface, "ssid", creds.Ssid, "attempt", attempt, "reason", connection.Reason, "backoff", outcome.Backoff)
+
+		select {
+		case <-ctx.Done():
+			wpa.dropNetwork(ctx, staged)
+			connection.Attempts = attempts
+			return connection, ctx.Err()
+		case <-time.After(outcome.Backoff):
+		}
+	}
 }
 
-// ConnectNetwork connects to a wifi network
-func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
+// connectAttempt enables the network staged for creds and waits up to
+// timeout for wpa_supplicant to connect to it.
+func (wpa *WpaCfg) connectAttempt(ctx context.Context, creds WpaCredentials, staged stagedNetwork, timeout time.Duration) (WpaConnection, error) {
 	connection := WpaConnection{}
+	iface := wpa.Cfg().StationInterface
+	net := staged.id
+	start := time.Now()
 
-	// 1. Add a network
-	addNetOut, err := exec.Command("wpa_cli", "-i", "wlan0", "add_network").Output()
+	// watch for connection events before touching the network config
+	events, monitor, err := wpa.monitor()
 	if err != nil {
-		wpa.Log.Fatal(err)
+		return connection, fmt.Errorf("%w: %s", ErrConnectFailed, err)
+	}
+	defer monitor.Close()
+
+	if err := wpa.enableNetwork(ctx, staged); err != nil {
 		return connection, err
 	}
-	net := strings.TrimSpace(string(addNetOut))
-	wpa.Log.Info("WPA add network got: %s", net)
+	wpa.Log.Info("network enabled", "iface", iface, "ssid", creds.Ssid, "net_id", net)
+
+	// fail reports a failed attempt in connection and as an error
+	fail := func(reason ConnectReason, message string, kind error) (WpaConnection, error) {
+		connection.State = "FAIL"
+		connection.Reason = reason
+		connection.Message = message
+		wpa.Log.Error("connect failed", "iface", iface, "ssid", creds.Ssid, "net_id", net, "reason", reason, "duration", time.Since(start))
+		return connection, fmt.Errorf("%w: %s", kind, creds.Ssid)
+	}
+
+	// wait for the supplicant to report the connection
+	expired := time.After(timeout)
+	notFound := 0
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fail(ReasonLostControl, "Lost wpa_supplicant control connection", ErrConnectFailed)
+			}
+
+			wpa.Log.Debug("wpa_supplicant event", "iface", iface, "event", ev.Name, "message", ev.Message)
+
+			switch ev.Name {
+			case "CTRL-EVENT-SSID-TEMP-DISABLED":
+				if eventField(ev.Message, "id") != net {
+					continue
+				}
+				if eventField(ev.Message, "reason") == "WRONG_KEY" {
+					return fail(ReasonWrongPassword, "Wrong password for "+creds.Ssid, ErrWrongPassword)
+				}
+				return fail(ReasonAuthFailed, "Authentication failed for "+creds.Ssid, ErrConnectFailed)
+
+			case "CTRL-EVENT-EAP-FAILURE":
+				return fail(ReasonAuthFailed, "Authentication failed for "+creds.Ssid, ErrConnectFailed)
+
+			case "CTRL-EVENT-NETWORK-NOT-FOUND":
+				notFound++
+				if notFound >= notFoundScans {
+					return fail(ReasonNetworkNotFound, "Unable to find "+creds.Ssid, ErrNetworkNotFound)
+				}
+				continue
+
+			case "CTRL-EVENT-CONNECTED":
+			default:
+				continue
+			}
+
+			status, err := wpa.wpaStatus(ctx)
+			if err != nil {
+				return connection, err
+			}
+
+			// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
+			state := status["wpa_state"]
+			wpa.Log.Info("connection state", "iface", iface, "ssid", creds.Ssid, "net_id", net, "state", state)
+			if state != "COMPLETED" {
+				continue
+			}
+
+			connection.Ssid = creds.Ssid
+			connection.State = state
+
+			// connected, the network takes the place of the others of
+			// the ssid and the config is saved
+			wpa.replaceNetworks(ctx, staged)
+			saveOut, err := wpa.wpaCtl(ctx, "SAVE_CONFIG")
+			if err != nil {
+				return connection, fmt.Errorf("%w: save_config: %s", ErrConnectFailed, err)
+			}
+			saveStatus := strings.TrimSpace(string(saveOut))
+			wpa.Log.Info("config saved", "iface", iface, "status", saveStatus)
+
+			// associated, now wait for an address to report back
+			ip, err := wpa.waitForAddress(ctx, creds.Ssid)
+			if !wpa.Cfg().Connectivity.Disabled {
+				connectivity := wpa.CheckConnectivity(ctx)
+				connection.Connectivity = connectivity.State
+				connection.CaptivePortalUrl = connectivity.PortalUrl
+			}
+			if err != nil {
+				wpa.Log.Warn("connected without address", "iface", iface, "ssid", creds.Ssid, "net_id", net, "error", err, "duration", time.Since(start))
+				connection.Message = "Connected, no IP address assigned yet"
+				return connection, nil
+			}
+
+			connection.Ip = ip
+			connection.Gateway = defaultGateway(wpa.Cfg().StationInterface)
+			connection.Dns = nameservers(wpa.Cfg().resolvConf())
+			connection.Ipv6 = interfaceIPv6(wpa.Cfg().StationInterface)
+			connection.Gateway6 = defaultGateway6(wpa.Cfg().StationInterface)
+
+			wpa.Log.Info("connected", "iface", iface, "ssid", creds.Ssid, "net_id", net, "ip", ip, "connectivity", connection.Connectivity, "duration", time.Since(start))
+
+			return connection, nil
+
+		case <-ctx.Done():
+			return connection, ctx.Err()
+
+		case <-expired:
+			return fail(ReasonTimeout, "Unable to connect to "+creds.Ssid, ErrTimeout)
+		}
+	}
+}
+
+// configureNetwork sets the ssid and credentials of network net.
+func (wpa *WpaCfg) configureNetwork(ctx context.Context, net string, creds WpaCredentials) error {
+	if err := ValidateSsid(creds.Ssid); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+	addSecrets(creds)
+
+	// in hex, which holds any ssid a quoted string cannot
+	if err := wpa.setNetwork(ctx, net, "ssid", EncodeSsid(creds.Ssid)); err != nil {
+		return err
+	}
+
+	// hidden networks only answer probes addressed to their ssid
+	if creds.Hidden {
+		if err := wpa.setNetwork(ctx, net, "scan_ssid", "1"); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case creds.EapMethod != "":
+		// enterprise networks authenticate with EAP instead of a psk
+		creds.KeyMgmt = KeyMgmtEap
+		if err := wpa.setEap(ctx, net, creds); err != nil {
+			return err
+		}
+
+	case creds.Psk == "":
+		// open networks have no psk
+		creds.KeyMgmt = KeyMgmtNone
+
+	default:
+		psk, err := wpa.storedPsk(creds)
+		if err != nil {
+			return err
+		}
+		if err := wpa.setNetwork(ctx, net, "psk", psk); err != nil {
+			return err
+		}
+	}
+
+	if creds.PreferredBand != "" {
+		if err := wpa.setPreferredBand(ctx, net, creds.PreferredBand); err != nil {
+			return err
+		}
+	}
+
+	// key management, and PMF for WPA3 networks
+	if creds.KeyMgmt != "" {
+		if err := wpa.setNetwork(ctx, net, "key_mgmt", creds.KeyMgmt); err != nil {
+			return err
+		}
+
+		if pmf := pmfFor(creds.KeyMgmt); pmf != "" {
+			if err := wpa.setNetwork(ctx, net, "ieee80211w", pmf); err != nil {
+				return err
+			}
+		}
+	}
 
-	// 2. Set the ssid for the new network
-	addSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", "\""+creds.Ssid+"\"").Output()
+	return nil
+}
+
+// setPreferredBand keeps network net on band, for ssids on both bands,
+// with freq_list. Any band clears it.
+func (wpa *WpaCfg) setPreferredBand(ctx context.Context, net string, band string) error {
+	freqs, err := freqList(band)
 	if err != nil {
-		wpa.Log.Fatal(err)
-		return connection, err
+		return fmt.Errorf("%w: %s", ErrConnectFailed, err)
 	}
-	ssidStatus := strings.TrimSpace(string(addSsidOut))
-	wpa.Log.Info("WPA add ssid got: %s", ssidStatus)
 
-	// 3. Set the psk for the new network
-	addPskOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "psk", "\""+creds.Psk+"\"").Output()
+	return wpa.setNetwork(ctx, net, "freq_list", freqs)
+}
+
+// waitForAddress sets the static address for ssid or runs the configured
+// DHCP client, if any, and waits for the station interface to get an
+// IPv4 address, or only an IPv6 one on IPv6-only networks.
+func (wpa *WpaCfg) waitForAddress(ctx context.Context, ssid string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, addressTimeout)
+	defer cancel()
+
+	iface := wpa.Cfg().StationInterface
+	if static := wpa.stationIP(ssid); static.Enabled() {
+		if err := setStaticAddress(iface, static, wpa.Cfg().resolvConf()); err != nil {
+			return "", err
+		}
+		return waitForIPv4(ctx, iface)
+	}
+
+	if err := requestDhcp(ctx, wpa.Runner, wpa.Cfg().WpaSupplicantCfg.DhcpClient, iface); err != nil {
+		wpa.Log.Error("dhcp request failed", "iface", iface, "dhcp_client", wpa.Cfg().WpaSupplicantCfg.DhcpClient, "error", err)
+	}
+
+	return waitForIP(ctx, iface)
+}
+
+// eventField returns the value of key=value in an event message, unquoting
+// values such as ssid="my network".
+func eventField(message string, key string) string {
+	prefix := key + "="
+	for _, field := range strings.Fields(message) {
+		if strings.HasPrefix(field, prefix) {
+			return strings.Trim(field[len(prefix):], "\"")
+		}
+	}
+
+	return ""
+}
+
+// setNetwork sets one variable of network id and checks the reply.
+func (wpa *WpaCfg) setNetwork(ctx context.Context, id string, name string, value string) error {
+	out, err := wpa.wpaCtl(ctx, "SET_NETWORK", id, name, value)
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
-		return connection, err
+		return fmt.Errorf("%w: set_network %s: %s", ErrConnectFailed, name, err)
 	}
-	pskStatus := strings.TrimSpace(string(addPskOut))
-	wpa.Log.Info("WPA psk got: %s", pskStatus)
 
-	// 4. Enable the new network
-	enableOut, err := exec.Command("wpa_cli", "-i", "wlan0", "enable_network", net).Output()
+	status := strings.TrimSpace(string(out))
+	wpa.Log.Debug("network variable set", "iface", wpa.Cfg().StationInterface, "net_id", id, "name", name, "status", status)
+
+	if status != "OK" {
+		return fmt.Errorf("%w: set_network %s: %s", ErrCommandFailed, name, status)
+	}
+
+	return nil
+}
+
+// RemoveNetwork removes every configured network with the given ssid and
+// saves the config, so the device forgets it across restarts.
+func (wpa *WpaCfg) RemoveNetwork(ctx context.Context, ssid string) error {
+	ctx, done, err := wpa.ops.acquire(ctx, OpForget, ssid)
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
-		return connection, err
+		return err
 	}
-	enableStatus := strings.TrimSpace(string(enableOut))
-	wpa.Log.Info("WPA enable got: %s", enableStatus)
+	defer done()
 
-	// regex for state
-	rState := regexp.MustCompile("(?m)wpa_state=(.*)\n")
+	networks, err := wpa.ListConfiguredNetworks(ctx)
+	if err != nil {
+		return err
+	}
 
-	// loop for status every second
-	for i := 0; i < 5; i++ {
-		wpa.Log.Info("WPA Checking wifi state")
+	ids := []string{}
+	for _, network := range networks {
+		if network.Ssid == ssid {
+			ids = append(ids, network.Id)
+		}
+	}
 
-		stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+	if len(ids) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotConfigured, ssid)
+	}
+
+	for _, id := range ids {
+		removeOut, err := wpa.wpaCtl(ctx, "REMOVE_NETWORK", id)
 		if err != nil {
-			wpa.Log.Fatal("Got error checking state: %s", err.Error())
-			return connection, err
+			return fmt.Errorf("%w: remove_network: %s", ErrCommandFailed, err)
 		}
-		ms := rState.FindSubmatch(stateOut)
+		wpa.Log.Info("network removed", "iface", wpa.Cfg().StationInterface, "ssid", ssid, "net_id", id, "status", strings.TrimSpace(string(removeOut)))
+	}
 
-		if len(ms) > 0 {
-			state := string(ms[1])
-			wpa.Log.Info("WPA Enable state: %s", state)
-			// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
-			if state == "COMPLETED" {
-				// save the config
-				saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
-				if err != nil {
-					wpa.Log.Fatal(err.Error())
-					return connection, err
-				}
-				saveStatus := strings.TrimSpace(string(saveOut))
-				wpa.Log.Info("WPA save got: %s", saveStatus)
+	saveOut, err := wpa.wpaCtl(ctx, "SAVE_CONFIG")
+	if err != nil {
+		return fmt.Errorf("%w: save_config: %s", ErrCommandFailed, err)
+	}
+	wpa.Log.Info("config saved", "iface", wpa.Cfg().StationInterface, "status", strings.TrimSpace(string(saveOut)))
 
-				connection.Ssid = creds.Ssid
-				connection.State = state
+	return nil
+}
 
-				return connection, nil
-			}
-		}
+// Disconnect drops the current connection and stays disconnected until
+// Reassociate or Reconnect is called.
+func (wpa *WpaCfg) Disconnect(ctx context.Context) error {
+	return wpa.stationCmd(ctx, "DISCONNECT")
+}
+
+// Reassociate forces a new association, even if already connected.
+func (wpa *WpaCfg) Reassociate(ctx context.Context) error {
+	return wpa.stationCmd(ctx, "REASSOCIATE")
+}
 
-		time.Sleep(3 * time.Second)
+// Reconnect connects again after Disconnect, it does nothing if already
+// connected.
+func (wpa *WpaCfg) Reconnect(ctx context.Context) error {
+	return wpa.stationCmd(ctx, "RECONNECT")
+}
+
+// stationCmd runs a wpa_supplicant command that replies OK, given as its
+// arguments as for wpaCtl.
+func (wpa *WpaCfg) stationCmd(ctx context.Context, args ...string) error {
+	cmd := strings.Join(args, " ")
+
+	out, err := wpa.wpaCtl(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCommandFailed, strings.ToLower(cmd), err)
 	}
 
-	connection.State = "FAIL"
-	connection.Message = "Unable to connect to " + creds.Ssid
-	return connection, nil
+	status := strings.TrimSpace(string(out))
+	wpa.Log.Info("station command", "iface", wpa.Cfg().StationInterface, "cmd", cmd, "status", status)
+
+	if status != "OK" {
+		return fmt.Errorf("%w: %s: %s", ErrCommandFailed, strings.ToLower(cmd), status)
+	}
+
+	return nil
 }
 
-// Status returns the WPA wireless status.
-func (wpa *WpaCfg) Status() (map[string]string, error) {
-	cfgMap := make(map[string]string, 0)
+// SaveConfig writes the running wpa_supplicant configuration to its config file.
+func (wpa *WpaCfg) SaveConfig(ctx context.Context) error {
+	saveOut, err := wpa.wpaCtl(ctx, "SAVE_CONFIG")
+	if err != nil {
+		return fmt.Errorf("%w: save_config: %s", ErrCommandFailed, err)
+	}
+	wpa.Log.Info("config saved", "iface", wpa.Cfg().StationInterface, "status", strings.TrimSpace(string(saveOut)))
+
+	return nil
+}
+
+// setEap sets the 802.1X fields of network net, skipping any left empty.
+func (wpa *WpaCfg) setEap(ctx context.Context, net string, creds WpaCredentials) error {
+	phase2 := creds.Phase2
+	if phase2 != "" && !strings.Contains(phase2, "=") {
+		phase2 = "auth=" + phase2
+	}
+
+	// the strings are in hex, which wpa_supplicant takes for any of them
+	// and which no identity or password can break out of
+	fields := []struct {
+		name  string
+		value string
+		hex   bool
+	}{
+		{"eap", creds.EapMethod, false},
+		{"identity", creds.Identity, true},
+		{"password", creds.Password, true},
+		{"phase2", phase2, true},
+		{"ca_cert", creds.CACert, true},
+		{"client_cert", creds.ClientCert, true},
+		{"private_key", creds.PrivateKey, true},
+	}
 
-	stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+
+		value := f.value
+		if f.hex {
+			value = hex.EncodeToString([]byte(value))
+		}
+
+		if err := wpa.setNetwork(ctx, net, f.name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Status returns the WPA wireless status, with the connectivity state
+// once associated.
+func (wpa *WpaCfg) Status(ctx context.Context) (map[string]string, error) {
+	cfgMap, err := wpa.wpaStatus(ctx)
 	if err != nil {
-		wpa.Log.Fatal("Got error checking state: %s", err.Error())
 		return cfgMap, err
 	}
 
-	cfgMap = cfgMapper(stateOut)
+	// whether the connection actually reaches anything
+	if cfgMap["wpa_state"] == "COMPLETED" {
+		connectivity := wpa.connectivityState(ctx)
+		if connectivity.State != "" {
+			cfgMap["connectivity"] = connectivity.State
+		}
+		if connectivity.PortalUrl != "" {
+			cfgMap["captive_portal_url"] = connectivity.PortalUrl
+		}
+
+		if proxy := wpa.proxy(cfgMap["ssid"]).Redacted(); proxy.Enabled() {
+			cfgMap["http_proxy"] = proxy.Http
+			cfgMap["https_proxy"] = proxy.https()
+			cfgMap["no_proxy"] = proxy.NoProxy
+		}
+	}
+
+	// wpa_supplicant only knows the IPv4 address
+	iface := wpa.Cfg().StationInterface
+	if radioBlocked(iface) != nil {
+		cfgMap["radio"] = "blocked"
+	}
+	if ips := interfaceIPv6(iface); len(ips) > 0 {
+		cfgMap["ipv6_address"] = strings.Join(ips, ",")
+	}
+	if gw := defaultGateway6(iface); gw != "" {
+		cfgMap["ipv6_gateway"] = gw
+	}
 
 	return cfgMap, nil
 }
 
+// wpaStatus returns the wpa_supplicant STATUS fields.
+func (wpa *WpaCfg) wpaStatus(ctx context.Context) (map[string]string, error) {
+	stateOut, err := wpa.wpaCtl(ctx, "STATUS")
+	if err != nil {
+		return make(map[string]string, 0), fmt.Errorf("%w: %s", ErrStatusFailed, err)
+	}
+
+	status := cfgMapper(stateOut)
+	if ssid, ok := status["ssid"]; ok {
+		status["ssid"] = DecodeSsidText(ssid)
+	}
+
+	return status, nil
+}
+
 // cfgMapper handle wpa_cli and hostapd_cli results, takes a byte array and splits by \n and then by = and puts it all in a map.
 func cfgMapper(data []byte) map[string]string {
 	cfgMap := make(map[string]string, 0)
@@ -208,7 +856,8 @@ func cfgMapper(data []byte) map[string]string {
 	lines := bytes.Split(data, []byte("\n"))
 
 	for _, line := range lines {
-		kv := bytes.Split(line, []byte("="))
+		// values such as an ssid may hold an =
+		kv := bytes.SplitN(line, []byte("="), 2)
 		if len(kv) > 1 {
 			cfgMap[string(kv[0])] = string(kv[1])
 		}
@@ -217,48 +866,18 @@ func cfgMapper(data []byte) map[string]string {
 	return cfgMap
 }
 
-// ScanNetworks returns a map of WpaNetwork data structures.
-func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
-	wpaNetworks := make(map[string]WpaNetwork, 0)
-
-	scanOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
+// Events streams unsolicited wpa_supplicant events (CTRL-EVENT-CONNECTED,
+// CTRL-EVENT-DISCONNECTED, ...) until ctx is done.
+func (wpa *WpaCfg) Events(ctx context.Context) (<-chan wpactl.Event, error) {
+	events, conn, err := wpa.monitor()
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
-		return wpaNetworks, err
+		return nil, err
 	}
-	scanOutClean := strings.TrimSpace(string(scanOut))
-
-	// wait one second for results
-	time.Sleep(1 * time.Second)
-
-	if scanOutClean == "OK" {
-		networkListOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan_results").Output()
-		if err != nil {
-			wpa.Log.Fatal(err.Error())
-			return wpaNetworks, err
-		}
 
-		networkListOutArr := strings.Split(string(networkListOut), "\n")
-		for _, netRecord := range networkListOutArr[1:] {
-			if strings.Contains(netRecord, "[P2P]") {
-				continue
-			}
-
-			fields := strings.Fields(netRecord)
-
-			if len(fields) > 4 {
-				ssid := strings.Join(fields[4:], " ")
-				wpaNetworks[ssid] = WpaNetwork{
-					Bssid:       fields[0],
-					Frequency:   fields[1],
-					SignalLevel: fields[2],
-					Flags:       fields[3],
-					Ssid:        ssid,
-				}
-			}
-		}
-
-	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 
-	return wpaNetworks, nil
+	return events, nil
 }
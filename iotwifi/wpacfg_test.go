@@ -0,0 +1,345 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// connected is the event of the network a connect adds completing.
+var connected = wpactl.Event{
+	Level:   3,
+	Name:    "CTRL-EVENT-CONNECTED",
+	Message: "- Connection to aa:bb:cc:dd:ee:01 completed [id=1 id_str=]",
+}
+
+func TestScanNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		events  []wpactl.Event
+		err     error
+		results []string // ssid of each result, strongest first
+		bss     []int    // of each result
+	}{
+		{
+			name:    "results",
+			results: []string{"home", "cafe"},
+			bss:     []int{2, 1},
+		},
+		{
+			name:    "busy",
+			reply:   "FAIL-BUSY\n",
+			results: []string{"home", "cafe"},
+			bss:     []int{2, 1},
+		},
+		{
+			name:  "refused",
+			reply: "FAIL\n",
+			err:   ErrScanFailed,
+		},
+		{
+			name:   "failed",
+			events: []wpactl.Event{{Level: 3, Name: "CTRL-EVENT-SCAN-FAILED", Message: "ret=-16"}},
+			err:    ErrScanFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newTestWpa(t)
+			defer cleanup()
+			if tt.reply != "" {
+				runner.Replies["SCAN"] = tt.reply
+			}
+			if tt.events != nil {
+				runner.Events["SCAN"] = tt.events
+			}
+
+			results, err := wpa.ScanNetworks(context.Background())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err %v, want %v", err, tt.err)
+			}
+
+			ssids, bss := []string{}, []int{}
+			for _, result := range results {
+				ssids = append(ssids, result.Ssid)
+				bss = append(bss, len(result.Bss))
+			}
+			if tt.err == nil && (!reflect.DeepEqual(ssids, tt.results) || !reflect.DeepEqual(bss, tt.bss)) {
+				t.Errorf("results %q with %v bss, want %q with %v", ssids, bss, tt.results, tt.bss)
+			}
+		})
+	}
+}
+
+func TestScanResult(t *testing.T) {
+	wpa, _, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	results, err := wpa.ScanNetworks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	home := results[0].WpaNetwork
+	want := WpaNetwork{
+		Bssid:       "aa:bb:cc:dd:ee:01",
+		Frequency:   "2437",
+		Channel:     6,
+		Band:        Band24,
+		SignalLevel: -48,
+		Quality:     100,
+		Flags:       "[WPA2-PSK-CCMP][WPS][ESS]",
+		Security:    WpaSecurity{Wpa2: true, Wps: true},
+		Ssid:        "home",
+		Iface:       "wlan0",
+	}
+	if !reflect.DeepEqual(home, want) {
+		t.Errorf("strongest home bss\n%+v\nwant\n%+v", home, want)
+	}
+	if cafe := results[1].Security; !cafe.Open {
+		t.Errorf("cafe security %+v, want open", cafe)
+	}
+}
+
+func TestConnectNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   *ConnectRetryCfg
+		turns   [][]wpactl.Event // after each ENABLE_NETWORK of the network of home
+		err     error
+		reasons []ConnectReason // of each attempt
+		enabled int             // ENABLE_NETWORK requests of the network of home
+		saved   bool            // the config was saved
+	}{
+		{
+			name:    "connected",
+			turns:   [][]wpactl.Event{{connected}},
+			reasons: []ConnectReason{ReasonNone},
+			enabled: 1,
+			saved:   true,
+		},
+		{
+			name:    "wrong password",
+			turns:   [][]wpactl.Event{{wrongKey}},
+			err:     ErrWrongPassword,
+			reasons: []ConnectReason{ReasonWrongPassword},
+			enabled: 1,
+		},
+		{
+			name:    "not found, no retry by default",
+			turns:   [][]wpactl.Event{{notFound, notFound}},
+			err:     ErrNetworkNotFound,
+			reasons: []ConnectReason{ReasonNetworkNotFound},
+			enabled: 1,
+		},
+		{
+			name:    "not found, then connected",
+			retry:   &ConnectRetryCfg{MaxAttempts: 3, BackoffSec: 0.001},
+			turns:   [][]wpactl.Event{{notFound, notFound}, {connected}},
+			reasons: []ConnectReason{ReasonNetworkNotFound, ReasonNone},
+			enabled: 2,
+			saved:   true,
+		},
+		{
+			name:    "not found every attempt",
+			retry:   &ConnectRetryCfg{MaxAttempts: 3, BackoffSec: 0.001},
+			turns:   [][]wpactl.Event{{notFound, notFound}, {notFound, notFound}, {notFound, notFound}},
+			err:     ErrNetworkNotFound,
+			reasons: []ConnectReason{ReasonNetworkNotFound, ReasonNetworkNotFound, ReasonNetworkNotFound},
+			enabled: 3,
+		},
+		{
+			name:    "wrong password not retried",
+			retry:   &ConnectRetryCfg{MaxAttempts: 3, BackoffSec: 0.001},
+			turns:   [][]wpactl.Event{{wrongKey}, {connected}},
+			err:     ErrWrongPassword,
+			reasons: []ConnectReason{ReasonWrongPassword},
+			enabled: 1,
+		},
+		{
+			name:    "timed out, then connected",
+			retry:   &ConnectRetryCfg{MaxAttempts: 2, AttemptTimeoutSec: 1, BackoffSec: 0.001},
+			turns:   [][]wpactl.Event{{}, {connected}},
+			reasons: []ConnectReason{ReasonTimeout, ReasonNone},
+			enabled: 2,
+			saved:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newStationWpa(t)
+			defer cleanup()
+			runner.EventsInTurn["ENABLE_NETWORK "+homeNetId] = tt.turns
+
+			connection, err := wpa.ConnectNetwork(context.Background(), WpaCredentials{Ssid: "home", Psk: "new passphrase", Retry: tt.retry})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err %v, want %v", err, tt.err)
+			}
+
+			reasons := []ConnectReason{}
+			for i, attempt := range connection.Attempts {
+				reasons = append(reasons, attempt.Reason)
+				if attempt.Attempt != i+1 {
+					t.Errorf("attempt %d numbered %d", i+1, attempt.Attempt)
+				}
+				if last := i == len(connection.Attempts)-1; last != (attempt.Backoff == 0) {
+					t.Errorf("attempt %d of %d backed off %s", i+1, len(connection.Attempts), attempt.Backoff)
+				}
+			}
+			if !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("attempts %q, want %q", reasons, tt.reasons)
+			}
+
+			if enabled := countCalls(runner, "ENABLE_NETWORK "+homeNetId); enabled != tt.enabled {
+				t.Errorf("network enabled %d times, want %d", enabled, tt.enabled)
+			}
+
+			// the network of home for every attempt
+			if added := countCalls(runner, "ADD_NETWORK"); added != 0 {
+				t.Errorf("added %d networks", added)
+			}
+			if configured := countCalls(runner, `SET_NETWORK `+homeNetId+` psk "new passphrase"`); configured != 1 {
+				t.Errorf("configured the network %d times", configured)
+			}
+
+			if saved := hasCall(runner, "SAVE_CONFIG"); saved != tt.saved {
+				t.Errorf("saved %v, want %v, calls %q", saved, tt.saved, runner.Calls())
+			}
+			if restored := hasCall(runner, `SET_NETWORK `+homeNetId+` psk "`+savedPsk+`"`); restored != (tt.err != nil) {
+				t.Errorf("network restored %v, want %v", restored, tt.err != nil)
+			}
+
+			if tt.err == nil && (connection.State != "COMPLETED" || connection.Ssid != "home" || connection.Ip == "") {
+				t.Errorf("connection %+v", connection)
+			}
+			if tt.err != nil && connection.Reason != tt.reasons[len(tt.reasons)-1] {
+				t.Errorf("reason %s, want %s", connection.Reason, tt.reasons[len(tt.reasons)-1])
+			}
+		})
+	}
+}
+
+func TestConnectCancelledBackingOff(t *testing.T) {
+	wpa, runner, cleanup := newStationWpa(t)
+	defer cleanup()
+	runner.Events["ENABLE_NETWORK "+homeNetId] = []wpactl.Event{notFound, notFound}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	connection, err := wpa.ConnectNetwork(ctx, WpaCredentials{Ssid: "home", Psk: "new passphrase", Retry: &ConnectRetryCfg{MaxAttempts: 3, BackoffSec: 10}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v, want the deadline", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("waited %s for the backoff", waited)
+	}
+	if len(connection.Attempts) != 1 {
+		t.Errorf("attempts %+v, want one", connection.Attempts)
+	}
+
+	// the connect is undone even though its context ended
+	if !hasCall(runner, `SET_NETWORK `+homeNetId+` psk "`+savedPsk+`"`) {
+		t.Errorf("connect not undone, calls %q", runner.Calls())
+	}
+}
+
+func TestRemoveNetwork(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks string
+		ssid     string
+		err      error
+		calls    []string
+	}{
+		{
+			name:  "one",
+			ssid:  "home",
+			calls: []string{"LIST_NETWORKS", "REMOVE_NETWORK 0", "SAVE_CONFIG"},
+		},
+		{
+			name: "every network of the ssid",
+			networks: "network id / ssid / bssid / flags\n" +
+				"0\thome\tany\t[CURRENT]\n" +
+				"1\tcafe\tany\t[DISABLED]\n" +
+				"2\thome\tany\t[DISABLED]\n",
+			ssid:  "home",
+			calls: []string{"LIST_NETWORKS", "REMOVE_NETWORK 0", "REMOVE_NETWORK 2", "SAVE_CONFIG"},
+		},
+		{
+			name: "escaped ssid",
+			networks: "network id / ssid / bssid / flags\n" +
+				"3\tsay \\\"hi\\\"\tany\t\n",
+			ssid:  `say "hi"`,
+			calls: []string{"LIST_NETWORKS", "REMOVE_NETWORK 3", "SAVE_CONFIG"},
+		},
+		{
+			name:  "unknown",
+			ssid:  "cafe",
+			err:   ErrNotConfigured,
+			calls: []string{"LIST_NETWORKS"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wpa, runner, cleanup := newTestWpa(t)
+			defer cleanup()
+			if tt.networks != "" {
+				runner.Replies["LIST_NETWORKS"] = tt.networks
+			}
+
+			if err := wpa.RemoveNetwork(context.Background(), tt.ssid); !errors.Is(err, tt.err) {
+				t.Fatalf("err %v, want %v", err, tt.err)
+			}
+			if calls := runner.Calls(); !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls %q, want %q", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	wpa, _, cleanup := newStationWpa(t)
+	defer cleanup()
+
+	status, err := wpa.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{"wpa_state": "COMPLETED", "ssid": "home", "ip_address": "192.168.1.50"} {
+		if status[key] != value {
+			t.Errorf("%s %q, want %q", key, status[key], value)
+		}
+	}
+}
+
+func TestAPStatus(t *testing.T) {
+	wpa, _, cleanup := newTestWpa(t)
+	defer cleanup()
+
+	status, err := wpa.APStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{"state": "ENABLED", "ssid": "iot-wifi-cfg-3", "bss": "uap0", "channel": "6"} {
+		if status[key] != value {
+			t.Errorf("%s %v, want %q", key, status[key], value)
+		}
+	}
+
+	clients, ok := status["clients"].([]APClient)
+	if !ok || len(clients) != 1 || clients[0].Mac != "02:00:00:00:00:01" {
+		t.Errorf("clients %+v", status["clients"])
+	}
+}
@@ -0,0 +1,276 @@
+// Package wpactl speaks the wpa_supplicant control interface protocol over
+// its Unix datagram socket. The same protocol is used by hostapd, so a Conn
+// can be pointed at either daemon's control socket.
+
+package wpactl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDir is the default wpa_supplicant ctrl_interface directory.
+const DefaultDir = "/var/run/wpa_supplicant"
+
+// DefaultTimeout is how long a request waits for a reply.
+const DefaultTimeout = 10 * time.Second
+
+// bufSize is large enough for the longest reply (SCAN_RESULTS on a busy band).
+const bufSize = 64 * 1024
+
+// ErrFail is returned by RequestOK when the daemon replies FAIL.
+var ErrFail = errors.New("wpactl: command failed")
+
+var localSeq uint32
+
+// Conn is a connection to a wpa_supplicant or hostapd control socket.
+type Conn struct {
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	conn   *net.UnixConn
+	local  string
+	events chan Event
+	done   chan struct{}
+}
+
+// Event is an unsolicited message delivered to attached connections, for
+// example "<3>CTRL-EVENT-CONNECTED - Connection to ... completed".
+type Event struct {
+	Level   int    `json:"level"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// Dial connects to the control socket at path.
+func Dial(path string) (*Conn, error) {
+	dir, err := ioutil.TempDir("", "wpactl")
+	if err != nil {
+		return nil, err
+	}
+	seq := atomic.AddUint32(&localSeq, 1)
+	local := filepath.Join(dir, fmt.Sprintf("wpa_ctrl_%d-%d", os.Getpid(), seq))
+
+	laddr := &net.UnixAddr{Name: local, Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+
+	conn, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &Conn{
+		Timeout: DefaultTimeout,
+		conn:    conn,
+		local:   local,
+	}, nil
+}
+
+// DialInterface connects to the control socket for iface under dir.
+func DialInterface(dir string, iface string) (*Conn, error) {
+	return Dial(filepath.Join(dir, iface))
+}
+
+// Request sends cmd and returns the raw reply.
+func (c *Conn) Request(cmd string) ([]byte, error) {
+	return c.RequestContext(context.Background(), cmd)
+}
+
+// RequestContext sends cmd and returns the raw reply, giving up when ctx
+// is done or the connection Timeout passes, whichever is first.
+func (c *Conn) RequestContext(ctx context.Context, cmd string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.events != nil {
+		return nil, errors.New("wpactl: connection is attached for events")
+	}
+	if c.conn == nil {
+		return nil, errors.New("wpactl: connection closed")
+	}
+
+	// unblock the read as soon as ctx is cancelled
+	conn := c.conn
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+
+	reply, err := c.request(ctx, cmd)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// the read deadline is the deadline of ctx, and may pass a moment
+	// before ctx is done
+	if d, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(d) {
+		return nil, context.DeadlineExceeded
+	}
+
+	return reply, err
+}
+
+// RequestOK sends cmd and returns ErrFail unless the reply is OK.
+func (c *Conn) RequestOK(cmd string) error {
+	return c.RequestOKContext(context.Background(), cmd)
+}
+
+// RequestOKContext is RequestOK with a context.
+func (c *Conn) RequestOKContext(ctx context.Context, cmd string) error {
+	reply, err := c.RequestContext(ctx, cmd)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(reply)) != "OK" {
+		return fmt.Errorf("%w: %s", ErrFail, strings.Fields(cmd)[0])
+	}
+
+	return nil
+}
+
+// request writes cmd and reads until a non-event reply arrives.
+func (c *Conn) request(ctx context.Context, cmd string) ([]byte, error) {
+	if c.conn == nil {
+		return nil, errors.New("wpactl: connection closed")
+	}
+
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, bufSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// unsolicited messages may interleave with replies; skip them
+		if n > 0 && buf[0] == '<' {
+			continue
+		}
+
+		reply := make([]byte, n)
+		copy(reply, buf[:n])
+		return reply, nil
+	}
+}
+
+// Attach registers the connection as an event monitor. After Attach the
+// connection only delivers events, so a separate Conn is needed for requests.
+func (c *Conn) Attach() (<-chan Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.events != nil {
+		return c.events, nil
+	}
+
+	reply, err := c.request(context.Background(), "ATTACH")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(reply)) != "OK" {
+		return nil, fmt.Errorf("%w: ATTACH", ErrFail)
+	}
+
+	c.events = make(chan Event, 16)
+	c.done = make(chan struct{})
+	c.conn.SetDeadline(time.Time{})
+
+	go c.readEvents(c.conn, c.events, c.done)
+
+	return c.events, nil
+}
+
+// readEvents delivers unsolicited messages until the connection closes.
+func (c *Conn) readEvents(conn *net.UnixConn, events chan Event, done chan struct{}) {
+	defer close(events)
+
+	buf := make([]byte, bufSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if n == 0 || buf[0] != '<' {
+			continue
+		}
+
+		select {
+		case events <- ParseEvent(string(buf[:n])):
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close detaches (if needed) and closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	if c.events != nil {
+		c.conn.SetDeadline(time.Now().Add(time.Second))
+		c.conn.Write([]byte("DETACH"))
+		close(c.done)
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+	os.RemoveAll(filepath.Dir(c.local))
+
+	return err
+}
+
+// ParseEvent splits a raw "<level>NAME message" string into an Event.
+func ParseEvent(raw string) Event {
+	ev := Event{}
+	raw = strings.TrimSpace(raw)
+
+	if strings.HasPrefix(raw, "<") {
+		if end := strings.Index(raw, ">"); end > 0 {
+			ev.Level, _ = strconv.Atoi(raw[1:end])
+			raw = raw[end+1:]
+		}
+	}
+
+	if i := strings.IndexByte(raw, ' '); i >= 0 {
+		ev.Name = raw[:i]
+		ev.Message = strings.TrimSpace(raw[i+1:])
+	} else {
+		ev.Name = raw
+	}
+
+	return ev
+}
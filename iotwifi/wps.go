@@ -0,0 +1,210 @@
+package iotwifi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/wpactl"
+)
+
+// wpsWalkTime is how long WPS waits for the other side, two minutes per
+// the WPS spec, plus some slack for the association that follows.
+const wpsWalkTime = 2*time.Minute + 15*time.Second
+
+// WPSRequest is the body of the WPS PIN endpoints.
+type WPSRequest struct {
+	Pin string `json:"pin"` // 8 digit (or 4 digit) PIN, empty to generate one
+}
+
+// ValidWPSPin reports whether pin is a 4 digit PIN or an 8 digit PIN
+// with a valid checksum.
+func ValidWPSPin(pin string) bool {
+	if len(pin) != 4 && len(pin) != 8 {
+		return false
+	}
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	if len(pin) == 4 {
+		return true
+	}
+
+	// the last digit checks the first seven, weighted 3,1,3,1,...
+	sum := 0
+	for i, c := range pin[:7] {
+		weight := 1
+		if i%2 == 0 {
+			weight = 3
+		}
+		sum += int(c-'0') * weight
+	}
+
+	return int(pin[7]-'0') == (10-sum%10)%10
+}
+
+// WPSPushButton starts WPS push button mode on the station interface. The
+// router's WPS button must be pressed within two minutes; the connection
+// completes in the background and is reported as wps-success and
+// connected events.
+func (wpa *WpaCfg) WPSPushButton(ctx context.Context) error {
+	_, err := wpa.startWps(ctx, "WPS_PBC")
+	return err
+}
+
+// WPSPin starts WPS PIN mode on the station interface and returns the PIN
+// to enter on the router, pin itself or a generated one if pin is empty.
+// The connection completes in the background.
+func (wpa *WpaCfg) WPSPin(ctx context.Context, pin string) (string, error) {
+	if pin != "" && !ValidWPSPin(pin) {
+		return "", fmt.Errorf("%w: invalid pin %q", ErrWpsFailed, pin)
+	}
+
+	args := []string{"WPS_PIN", "any"}
+	if pin != "" {
+		args = append(args, pin)
+	}
+
+	return wpa.startWps(ctx, args...)
+}
+
+// startWps sends a WPS command to wpa_supplicant and leaves a monitor
+// behind to save the network and get an address once it connects.
+func (wpa *WpaCfg) startWps(ctx context.Context, args ...string) (string, error) {
+	iface := wpa.Cfg().StationInterface
+
+	// the network WPS adds is left to wpa_supplicant, only the start
+	// waits its turn
+	ctx, done, err := wpa.ops.acquire(ctx, OpWps, "")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrWpsFailed, err)
+	}
+	defer done()
+
+	// watch for WPS events before starting it
+	events, monitor, err := wpa.monitor()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrWpsFailed, err)
+	}
+
+	out, err := wpa.wpaCtl(ctx, args...)
+	if err != nil {
+		monitor.Close()
+		return "", fmt.Errorf("%w: %s", ErrWpsFailed, err)
+	}
+	reply := strings.TrimSpace(string(out))
+
+	method := args[0]
+	wpa.Log.Info("wps started", "iface", iface, "method", method)
+
+	go func() {
+		defer monitor.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), wpsWalkTime)
+		defer cancel()
+
+		if err := wpa.awaitWps(ctx, events); err != nil {
+			wpa.Log.Error("wps failed", "iface", iface, "method", method, "error", err)
+		}
+	}()
+
+	// WPS_PIN replies with the PIN in use, WPS_PBC with OK
+	return reply, nil
+}
+
+// awaitWps waits for WPS to hand over credentials and the station to
+// connect, then saves the new network and waits for an address.
+func (wpa *WpaCfg) awaitWps(ctx context.Context, events <-chan wpactl.Event) error {
+	iface := wpa.Cfg().StationInterface
+	start := time.Now()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("%w: lost wpa_supplicant control connection", ErrWpsFailed)
+			}
+
+			switch ev.Name {
+			case "WPS-SUCCESS":
+				wpa.Log.Info("wps credentials received", "iface", iface)
+				continue
+			case "WPS-FAIL":
+				return fmt.Errorf("%w: %s", ErrWpsFailed, strings.TrimSpace(ev.Message))
+			case "WPS-OVERLAP-DETECTED":
+				return fmt.Errorf("%w: more than one access point in push button mode", ErrWpsFailed)
+			case "WPS-TIMEOUT":
+				return fmt.Errorf("%w: wps", ErrTimeout)
+			case "CTRL-EVENT-CONNECTED":
+			default:
+				continue
+			}
+
+			status, err := wpa.wpaStatus(ctx)
+			if err != nil {
+				return err
+			}
+			if status["wpa_state"] != "COMPLETED" {
+				continue
+			}
+
+			// WPS adds the network itself, keep it across restarts
+			if err := wpa.SaveConfig(ctx); err != nil {
+				return err
+			}
+
+			ip, err := wpa.waitForAddress(ctx, status["ssid"])
+			if err != nil {
+				wpa.Log.Warn("connected without address", "iface", iface, "ssid", status["ssid"], "error", err, "duration", time.Since(start))
+				return nil
+			}
+
+			wpa.Log.Info("connected", "iface", iface, "ssid", status["ssid"], "ip", ip, "duration", time.Since(start))
+			return nil
+
+		case <-ctx.Done():
+			return fmt.Errorf("%w: wps", ErrTimeout)
+		}
+	}
+}
+
+// APWPSPushButton starts WPS push button mode on the AP, letting the next
+// device that presses its own WPS button join within two minutes.
+func (wpa *WpaCfg) APWPSPushButton(ctx context.Context) error {
+	if !wpa.Cfg().HostApdCfg.Wps {
+		return fmt.Errorf("%w: wps is not enabled on the ap", ErrWpsFailed)
+	}
+
+	if err := wpa.hostapdCli(ctx, "wps_pbc"); err != nil {
+		return fmt.Errorf("%w: %s", ErrWpsFailed, err)
+	}
+	wpa.Log.Info("ap wps started", "iface", wpa.Cfg().APInterface, "method", "wps_pbc")
+
+	return nil
+}
+
+// APWPSPin lets the device showing pin join the AP within two minutes.
+func (wpa *WpaCfg) APWPSPin(ctx context.Context, pin string) error {
+	if !wpa.Cfg().HostApdCfg.Wps {
+		return fmt.Errorf("%w: wps is not enabled on the ap", ErrWpsFailed)
+	}
+	if !ValidWPSPin(pin) {
+		return fmt.Errorf("%w: invalid pin %q", ErrWpsFailed, pin)
+	}
+
+	// wps_pin replies with the PIN rather than OK
+	out, err := wpa.Runner.Output(ctx, "hostapd_cli", "-i", wpa.Cfg().APInterface, "wps_pin", "any", pin, "120")
+	if err != nil {
+		return fmt.Errorf("%w: hostapd_cli wps_pin: %s", ErrWpsFailed, err)
+	}
+	if reply := strings.TrimSpace(string(out)); strings.HasPrefix(reply, "FAIL") {
+		return fmt.Errorf("%w: hostapd_cli wps_pin: %s", ErrWpsFailed, reply)
+	}
+	wpa.Log.Info("ap wps started", "iface", wpa.Cfg().APInterface, "method", "wps_pin")
+
+	return nil
+}
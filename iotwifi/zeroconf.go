@@ -0,0 +1,280 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi/mdns"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+)
+
+// DefaultZeroconfHost is the mDNS host name, answered as txwifi.local.
+const DefaultZeroconfHost = "txwifi"
+
+// hostLabelR matches a host name label, as the zeroconf host must be.
+var hostLabelR = regexp.MustCompile("^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$")
+
+// zeroconfRetry is how long Zeroconf waits before listening again on an
+// interface that is missing, down or was recreated.
+const zeroconfRetry = 5 * time.Second
+
+// errLinkChanged stops listening on an interface that was recreated, its
+// socket is bound to the old one.
+var errLinkChanged = errors.New("interface changed")
+
+// ZeroconfCfg configures the mDNS responder and is used by SetupCfg.
+type ZeroconfCfg struct {
+	Disabled   bool              `json:"disabled"`
+	Host       string            `json:"host"`       // txwifi by default, answered as txwifi.local
+	Instance   string            `json:"instance"`   // the name shown when browsing, "txwifi <device_id>" by default
+	Interfaces []string          `json:"interfaces"` // the AP (or bridge) and station interfaces by default
+	Txt        map[string]string `json:"txt"`        // more TXT metadata, next to id, version and path
+}
+
+// Zeroconf answers mDNS queries for the device's host name and announces
+// the API as a DNS-SD service, _http._tcp or _https._tcp, on the AP and
+// station interfaces, so apps can find the device without knowing its
+// address. Each interface answers with its own addresses.
+type Zeroconf struct {
+	Wpa     *WpaCfg
+	Version string // firmware version, in the TXT record
+	Port    int    // the API port
+	TLS     bool   // the API is served over HTTPS
+
+	mu  sync.Mutex
+	cfg ZeroconfCfg
+}
+
+// NewZeroconf produces a Zeroconf announcing version.
+func NewZeroconf(wpa *WpaCfg, version string) *Zeroconf {
+	return &Zeroconf{
+		Wpa:     wpa,
+		Version: version,
+	}
+}
+
+// Configure applies cfg, taking effect on the next Run.
+func (z *Zeroconf) Configure(cfg ZeroconfCfg) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.cfg = cfg
+}
+
+// Run answers on every interface until ctx is done, then says goodbye so
+// caches drop the records. It returns at once when disabled.
+func (z *Zeroconf) Run(ctx context.Context) {
+	z.mu.Lock()
+	cfg := z.cfg
+	z.mu.Unlock()
+
+	if cfg.Disabled {
+		return
+	}
+
+	service := z.service(cfg)
+	ifaces := z.interfaces(cfg)
+	z.Wpa.Log.Info("zeroconf announcing", "host", service.Host+".local", "instance", service.Instance, "type", service.Type, "ifaces", strings.Join(ifaces, ","))
+
+	var wg sync.WaitGroup
+	for _, iface := range ifaces {
+		wg.Add(1)
+		go func(iface string) {
+			defer wg.Done()
+			z.serve(ctx, iface, service)
+		}(iface)
+	}
+	wg.Wait()
+}
+
+// service returns the service announced for cfg.
+func (z *Zeroconf) service(cfg ZeroconfCfg) mdns.Service {
+	identity, err := z.Wpa.Identity()
+	if err != nil {
+		z.Wpa.Log.Warn("no device identity", "error", err)
+	}
+	id := identity.DeviceId
+
+	service := mdns.Service{
+		Instance: cfg.Instance,
+		Type:     "_http._tcp",
+		Host:     cfg.Host,
+		Port:     z.Port,
+		Txt:      []string{"id=" + id, "version=" + z.Version, "path=/"},
+	}
+	if z.TLS {
+		service.Type = "_https._tcp"
+	}
+	if service.Host == "" {
+		service.Host = DefaultZeroconfHost
+	}
+	if service.Instance == "" {
+		service.Instance = strings.TrimSpace("txwifi " + id)
+	}
+
+	keys := make([]string, 0, len(cfg.Txt))
+	for key := range cfg.Txt {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		service.Txt = append(service.Txt, key+"="+cfg.Txt[key])
+	}
+
+	return service
+}
+
+// interfaces returns the interfaces to answer on.
+func (z *Zeroconf) interfaces(cfg ZeroconfCfg) []string {
+	if len(cfg.Interfaces) > 0 {
+		return cfg.Interfaces
+	}
+
+	// a bridged AP interface has no address, the bridge does
+	ap := z.Wpa.Cfg().APInterface
+	if z.Wpa.Cfg().Bridge.Enabled {
+		ap = z.Wpa.Cfg().Bridge.Name
+	}
+
+	return []string{ap, z.Wpa.Cfg().StationInterface}
+}
+
+// serve answers on iface until ctx is done, listening again whenever the
+// interface goes away and comes back, as the AP interface does.
+func (z *Zeroconf) serve(ctx context.Context, iface string, service mdns.Service) {
+	responder := &mdns.Responder{
+		Service: service,
+		Addrs:   func() []net.IP { return interfaceIPs(iface) },
+	}
+
+	for {
+		err := z.listen(ctx, iface, responder)
+		if ctx.Err() != nil {
+			return
+		}
+		z.Wpa.Log.Debug("zeroconf listen failed", "iface", iface, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(zeroconfRetry):
+		}
+	}
+}
+
+// listen joins the mDNS group on iface and answers queries, announcing
+// the records when it starts, again a second later and whenever the
+// addresses of iface change.
+func (z *Zeroconf) listen(ctx context.Context, iface string, responder *mdns.Responder) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	group := &net.UDPAddr{IP: mdns.Group, Port: mdns.Port}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// every interface has a socket of its own and answers with its own
+	// addresses, so only take queries that arrived on it
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := netif.BindToDevice(iface)("udp4", group.String(), raw); err != nil {
+		return err
+	}
+	// receivers may drop mDNS packets that crossed a router
+	if err := netif.SetMulticastTTL(raw, 255); err != nil {
+		return err
+	}
+
+	announce := func(goodbye bool) {
+		if _, err := conn.WriteToUDP(responder.Announcement(goodbye), group); err != nil {
+			z.Wpa.Log.Debug("zeroconf announcement failed", "iface", iface, "error", err)
+		}
+	}
+	announce(false)
+	defer announce(true)
+
+	addrs := ipsKey(responder.Addrs())
+	reannounce := true
+	check := time.Now().Add(time.Second)
+
+	buf := make([]byte, 9000)
+	for {
+		conn.SetReadDeadline(check)
+		n, from, err := conn.ReadFromUDP(buf)
+
+		// once a second, between queries or not
+		if time.Now().After(check) {
+			check = time.Now().Add(time.Second)
+
+			if ctx.Err() != nil {
+				return nil
+			}
+			if current, err := net.InterfaceByName(iface); err != nil || current.Index != ifi.Index {
+				return errLinkChanged
+			}
+
+			if current := ipsKey(responder.Addrs()); current != addrs || reannounce {
+				addrs = current
+				reannounce = false
+				announce(false)
+			}
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// queries from other ports are one-shot queries from plain resolvers
+		response, unicast, err := responder.Answer(buf[:n], from.Port != mdns.Port)
+		if err != nil || response == nil {
+			continue
+		}
+
+		dst := group
+		if unicast {
+			dst = from
+		}
+		if _, err := conn.WriteToUDP(response, dst); err != nil {
+			z.Wpa.Log.Debug("zeroconf answer failed", "iface", iface, "to", dst.String(), "error", err)
+		}
+	}
+}
+
+// interfaceIPs returns the IPv4 and global IPv6 addresses of iface.
+func interfaceIPs(iface string) []net.IP {
+	ips := []net.IP{}
+	if ip := net.ParseIP(interfaceIPv4(iface)); ip != nil {
+		ips = append(ips, ip)
+	}
+	for _, addr := range interfaceIPv6(iface) {
+		ips = append(ips, net.ParseIP(addr))
+	}
+
+	return ips
+}
+
+// ipsKey joins ips, to notice when they change.
+func ipsKey(ips []net.IP) string {
+	key := ""
+	for _, ip := range ips {
+		key += ip.String() + ","
+	}
+
+	return key
+}
@@ -3,23 +3,48 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bhoriuchi/go-bunyan/bunyan"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/kinokochat/txwifi/iotwifi"
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/grpc"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+	"github.com/kinokochat/txwifi/iotwifi/process"
+	"github.com/kinokochat/txwifi/iotwifi/qr"
+	"github.com/kinokochat/txwifi/iotwifi/systemd"
 )
 
+// version is the firmware version, set at build time with
+// -ldflags "-X main.version=1.0.4".
+var version = "dev"
+
+// diagnosticsLogEntries is how many of the last log entries go into the
+// diagnostics bundle.
+const diagnosticsLogEntries = 500
+
 // ApiReturn structures a message for returned API calls.
 type ApiReturn struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message"`
-	Payload interface{} `json:"payload"`
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+	Payload interface{}       `json:"payload"`
+	Error   *iotwifi.APIError `json:"error,omitempty"` // why a v2 call failed
 }
 
 func main() {
@@ -35,15 +60,272 @@ func main() {
 		panic(err)
 	}
 
-	blog.Info("Starting IoT Wifi...")
+	// under systemd with StandardOutput=journal, log to the journal
+	// with the key/value pairs as fields
+	var base iotwifi.Logger = iotwifi.NewBunyanLogger(&blog)
+	if systemd.JournalStream() {
+		if journal, err := systemd.OpenJournal(); err == nil {
+			base = iotwifi.NewJournalLogger(journal, "txwifi", os.Stdout)
+		}
+	}
+
+	// keep the recent entries for the diagnostics bundle
+	recent := iotwifi.NewLogRecorder(base, diagnosticsLogEntries)
+
+	// passphrases never reach the log
+	logger := iotwifi.Scrub(recent)
 
 	messages := make(chan iotwifi.CmdMessage, 1)
 
 	cfgUrl := setEnvIfEmpty("IOTWIFI_CFG", "cfg/wificfg.json")
 	port := setEnvIfEmpty("IOTWIFI_PORT", "8080")
+	socket := setEnvIfEmpty("IOTWIFI_SOCKET", iotwifi.DefaultSocket)
+
+	// the qr argument prints the QR code for joining the AP, for attached
+	// screens, and exits
+	if len(os.Args) > 1 && os.Args[1] == "qr" {
+		os.Exit(printAPQR(logger, cfgUrl))
+	}
+
+	// any other argument is a command for the running daemon
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(socket, os.Args[1:]))
+	}
+
+	logger.Info("starting iot wifi", "version", version)
+
+	// take the sockets of socket activation before starting the daemons,
+	// which would inherit them
+	activated, err := systemd.Listeners()
+	if err != nil {
+		logger.Error("could not use activated sockets", "error", err)
+	}
+	var activatedTCP, activatedSocket net.Listener
+	for name, listener := range activated {
+		if listener.Addr().Network() == "unix" {
+			activatedSocket = listener
+		} else if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			activatedTCP = listener
+			port = strconv.Itoa(addr.Port) // for mdns and the log
+		}
+		logger.Info("socket activated", "name", name, "addr", listener.Addr().String())
+	}
+
+	events := iotwifi.NewEventBus()
+	supervisor := iotwifi.NewSupervisor(logger, events)
+	processes := process.NewSupervisor(logger)
+
+	// cancelled on SIGTERM, RunWifi then cleans up and closes wifiDone
+	ctx, stop := context.WithCancel(context.Background())
+
+	// count the events from the start, for /metrics
+	metrics := iotwifi.NewMetrics()
+	go metrics.Run(ctx, events)
+	wpacfg, err := iotwifi.NewWpaCfg(logger, cfgUrl)
+	if err != nil {
+		logCfgError(logger, cfgUrl, err)
+		os.Exit(1)
+	}
+
+	// log at the configured level from here on
+	log := wpacfg.Log
+
+	// the commands each API request runs, for /operations
+	operations := iotwifi.NewOperationLog(wpacfg.Cfg().Operations)
+	if !wpacfg.Cfg().Operations.Disabled {
+		wpacfg.Runner = iotwifi.NewTracingRunner(wpacfg.Runner, operations)
+	}
+
+	// OpenTelemetry spans and metrics, nil without a collector
+	telemetry := iotwifi.NewTelemetry(wpacfg)
+	if telemetry != nil {
+		telemetry.Events = metrics
+		telemetry.Version = version
+		wpacfg.Runner = iotwifi.NewTelemetryRunner(wpacfg.Runner, telemetry)
+		go telemetry.Run(ctx)
+	}
+
+	// transports drive wifi through the Provisioner interface, and so
+	// does the API where NetworkManager owns the station
+	var provisioner iotwifi.Provisioner = wpacfg
+	if wpacfg.Cfg().NetworkManager.Enabled {
+		nm := iotwifi.NewNetworkManager(wpacfg)
+		defer nm.Close()
+		provisioner = nm
+		log.Info("driving the station through NetworkManager", "iface", wpacfg.Cfg().StationInterface)
+	}
+
+	// provisioning actions over every transport, for operators
+	audit := iotwifi.NewAuditLog(wpacfg.Cfg().Audit)
+
+	// the AP subnet is untrusted during setup
+	limiter := iotwifi.NewRateLimiter(wpacfg.Cfg().RateLimit)
+
+	if device := wpacfg.Cfg().SerialDevice; device != "" {
+		go func() {
+			transport, closer, err := iotwifi.OpenSerialTransport(device)
+			if err != nil {
+				log.Error("serial transport failed", "device", device, "error", err)
+				return
+			}
+			defer closer.Close()
+			transport.Audit = audit
+
+			log.Info("serial transport listening", "device", device)
+			if err := transport.Serve(context.Background(), provisioner); err != nil {
+				log.Error("serial transport failed", "device", device, "error", err)
+			}
+		}()
+	}
+
+	wpacfg.Bus = events
+	wpacfg.WatchEvents(ctx, events)
+
+	// keep a history of the connection across reboots
+	if err := wpacfg.State.Record(iotwifi.HistoryEntry{Type: iotwifi.HistoryStarted, Success: true, Message: version}); err != nil {
+		log.Warn("could not save state", "error", err)
+	}
+	go wpacfg.RecordEvents(ctx, events)
+
+	// the router rules go through iptables or nftables, whichever the
+	// kernel uses
+	if backend, err := wpacfg.DetectFirewall(ctx); err != nil {
+		log.Warn("no firewall available", "error", err)
+	} else {
+		log.Info("firewall detected", "firewall", backend)
+	}
+
+	// the station radios, addressed by interface name
+	interfaces := iotwifi.NewInterfaceManager(wpacfg)
+	interfaces.WatchEvents(ctx, events)
+
+	// bring up the AP and the stations on the same WpaCfg and radios the
+	// API uses, so they share the config and the operation queues
+	wifiDone := make(chan struct{})
+	go func() {
+		defer close(wifiDone)
+		iotwifi.RunWifi(ctx, wpacfg, interfaces, messages, events, supervisor, processes)
+	}()
+
+	// sample the station signal for live surveys
+	signalMonitor := iotwifi.NewSignalMonitor(wpacfg)
+	signalMonitor.Configure(wpacfg.Cfg().SignalMonitor)
+	go signalMonitor.Run(ctx)
+
+	// roam or reconnect when the station clings to a dying AP
+	watchdog := iotwifi.NewWatchdog(wpacfg)
+	watchdog.Configure(wpacfg.Cfg().Watchdog)
+	go watchdog.Run(ctx)
+
+	speedTester := iotwifi.NewSpeedTester(wpacfg)
+
+	// ping the gateway and targets for the status and metrics
+	latencyProber := iotwifi.NewLatencyProber(wpacfg)
+	latencyProber.Configure(wpacfg.Cfg().Latency)
+	go latencyProber.Run(ctx)
+
+	// scan in the background so /scan can answer from the cache
+	scanManager := iotwifi.NewScanManager(wpacfg)
+	scanManager.Scanner = provisioner
+	scanManager.Radios = interfaces.Radios()
+	scanManager.Configure(wpacfg.Cfg().Scan)
+	go scanManager.Run(ctx)
+
+	// survey the channels, and move the AP to the least congested one
+	// with auto_channel
+	siteSurvey := iotwifi.NewSiteSurvey(wpacfg, scanManager)
+	siteSurvey.Configure(wpacfg.Cfg().Survey)
+	go siteSurvey.Run(ctx)
+
+	// save the networks of a setup file on the boot partition or a USB
+	// stick, for headless devices
+	bootstrap := iotwifi.NewBootstrap(wpacfg)
+	go bootstrap.Run(ctx)
+
+	// watch the scans for SSIDs, and connect to one when it appears
+	watchlist := iotwifi.NewWatchlist(wpacfg)
+	watchlist.Provisioner = provisioner
+	watchlist.Configure(wpacfg.Cfg().Watchlist)
+	scanManager.OnResults(watchlist.Observe)
 
-	go iotwifi.RunWifi(blog, messages, cfgUrl)
-	wpacfg := iotwifi.NewWpaCfg(blog, cfgUrl)
+	// answer for txwifi.local and announce the API to apps browsing for it
+	zeroconf := iotwifi.NewZeroconf(wpacfg, version)
+	zeroconf.Configure(wpacfg.Cfg().Zeroconf)
+	zeroconf.Port, _ = strconv.Atoi(port)
+	zeroconf.TLS = wpacfg.Cfg().HTTPS.Enabled
+	go zeroconf.Run(ctx)
+
+	// publish state to and take commands from an MQTT broker, for fleets
+	// the API cannot reach
+	remote := iotwifi.NewRemote(wpacfg, scanManager)
+	remote.Provisioner = provisioner
+	remote.Bus = events
+	remote.Audit = audit
+	remote.Configure(wpacfg.Cfg().Remote)
+	go remote.Run(ctx)
+
+	// stop broadcasting the setup AP once its window is over or the
+	// device is provisioned
+	apWindow := iotwifi.NewAPWindow(wpacfg)
+	apWindow.Configure(wpacfg.Cfg().APWindow)
+	go apWindow.Run(ctx, events)
+
+	// follow what the daemon is doing, from boot to online, and fall
+	// back to the setup AP when the station stays offline
+	stateMachine := iotwifi.NewStateMachine(wpacfg, apWindow)
+	stateMachine.Telemetry = telemetry
+	stateMachine.Configure(wpacfg.Cfg().StateMachine)
+	go stateMachine.Run(ctx, events)
+
+	// keep the AP on the channel of the station's network, for radios
+	// with one channel for both
+	channelSync := iotwifi.NewChannelSync(wpacfg)
+	go channelSync.Run(ctx, events)
+
+	// put the static address or nameservers of a profile on the station
+	// while it is on that network
+	profileIP := iotwifi.NewProfileIP(wpacfg)
+	go profileIP.Run(ctx, events)
+
+	// export the proxy of a profile for the other services on the device
+	// while the station is on that network
+	profileProxy := iotwifi.NewProfileProxy(wpacfg)
+	go profileProxy.Run(ctx, events)
+
+	// open and close the AP with a button, and show the state on an
+	// LED, on devices without a screen
+	gpio := iotwifi.NewGPIO(wpacfg, apWindow)
+	go gpio.Run(ctx, events)
+
+	// tell backends about connections, AP clients and other state
+	// changes as they happen
+	webhook := iotwifi.NewWebhook(wpacfg)
+	webhook.Configure(wpacfg.Cfg().WebhookCfgs())
+	go webhook.Run(ctx, events)
+
+	// reload the config on SIGHUP or when the file changes
+	cfgWatcher := iotwifi.NewCfgWatcher(wpacfg, cfgUrl)
+	cfgWatcher.Configure(wpacfg.Cfg().Reload)
+	cfgWatcher.OnReload = func(cfg *iotwifi.SetupCfg, reload iotwifi.CfgReload) {
+		signalMonitor.Configure(cfg.SignalMonitor)
+		watchdog.Configure(cfg.Watchdog)
+		latencyProber.Configure(cfg.Latency)
+		scanManager.Configure(cfg.Scan)
+		siteSurvey.Configure(cfg.Survey)
+		stateMachine.Configure(cfg.StateMachine)
+		watchlist.Configure(cfg.Watchlist)
+		remote.Configure(cfg.Remote)
+		webhook.Configure(cfg.WebhookCfgs())
+		limiter.Configure(cfg.RateLimit)
+
+		// a new window only when it changed, not with every reload
+		for _, field := range reload.Changed {
+			if field == "ap_window" {
+				apWindow.Configure(cfg.APWindow)
+			}
+		}
+	}
+	go cfgWatcher.Run(ctx)
 
 	apiPayloadReturn := func(w http.ResponseWriter, message string, payload interface{}) {
 		apiReturn := &ApiReturn{
@@ -57,82 +339,267 @@ func main() {
 		w.Write(ret)
 	}
 
-	// marshallPost populates a struct with json in post body
-	marshallPost := func(w http.ResponseWriter, r *http.Request, v interface{}) {
-		bytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
-			return
+	// common error return from api, v2 calls also get a reason and an
+	// HTTP status for the error
+	retError := func(w http.ResponseWriter, err error) {
+		apiReturn := &ApiReturn{
+			Status:  "FAIL",
+			Message: err.Error(),
 		}
+		status := http.StatusOK
+		if isV2(w) {
+			apiErr := iotwifi.NewAPIError(err)
+			apiReturn.Error = &apiErr
+			status = apiErr.Status
+		}
+		ret, _ := json.Marshal(apiReturn)
 
-		defer r.Body.Close()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(ret)
+	}
 
-		decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	// marshallPost populates a struct with json in post body. When the
+	// body cannot be read or decoded it writes the error response and
+	// returns an error wrapping ErrInvalid, and the handler must return.
+	marshallPost := func(w http.ResponseWriter, r *http.Request, v interface{}) error {
+		defer r.Body.Close()
 
-		err = decoder.Decode(&v)
+		err := json.NewDecoder(r.Body).Decode(v)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
-			return
+			err = fmt.Errorf("%w: %s", iotwifi.ErrInvalid, err)
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
 		}
+
+		return err
 	}
 
-	// common error return from api
-	retError := func(w http.ResponseWriter, err error) {
-		apiReturn := &ApiReturn{
-			Status:  "FAIL",
-			Message: err.Error(),
+	// stationStatus returns the station status of wpa as the API version
+	// of w has it
+	stationStatus := func(w http.ResponseWriter, r *http.Request, p iotwifi.Provisioner) (interface{}, error) {
+		if wpa, ok := p.(*iotwifi.WpaCfg); ok && isV2(w) {
+			return wpa.StationStatus(r.Context())
 		}
-		ret, _ := json.Marshal(apiReturn)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		status, err := p.Status(r.Context())
+		if err != nil || !isV2(w) {
+			return status, err
+		}
+		return iotwifi.ParseStationStatus(status), nil
+	}
+
+	// apPayload, scanPayload and networksPayload convert for the API
+	// version of w
+	apPayload := func(w http.ResponseWriter, status map[string]interface{}) interface{} {
+		if isV2(w) {
+			return iotwifi.ParseAPStatus(status)
+		}
+		return status
+	}
+	scanPayload := func(w http.ResponseWriter, results iotwifi.ScanResults) interface{} {
+		if isV2(w) {
+			return iotwifi.NewScanReport(results)
+		}
+		return results
+	}
+	networksPayload := func(w http.ResponseWriter, networks []iotwifi.WpaConfiguredNetwork) interface{} {
+		if isV2(w) {
+			return iotwifi.NewConfiguredNetworks(networks)
+		}
+		return networks
 	}
 
 	// handle /apstatus GETs
 	apStatusHandler := func(w http.ResponseWriter, r *http.Request) {
 
-		status, err := wpacfg.APStatus()
+		status, err := wpacfg.APStatus(r.Context())
 		if err != nil {
-			blog.Error(err.Error())
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
 			return
 		}
 
-		apiPayloadReturn(w, "status", status)
+		apiPayloadReturn(w, "status", apPayload(w, status))
+	}
+
+	// handle /ap/devices GETs, the devices on the AP from hostapd, the
+	// leases and the neighbor table
+	apDevicesHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "AP devices", wpacfg.APInventory(r.Context()))
+	}
+
+	// handle /ap POSTs json in the form of iotwifi.APConfig
+	apConfigHandler := func(w http.ResponseWriter, r *http.Request) {
+		var apCfg iotwifi.APConfig
+		if err := marshallPost(w, r, &apCfg); err != nil {
+			return
+		}
+
+		log.Info("ap config handler", "ssid", apCfg.Ssid, "channel", apCfg.Channel, "dry_run", dryRun(r))
+
+		if dryRun(r) {
+			plan, err := wpacfg.PlanReconfigureAP(apCfg)
+			if err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			apiPayloadReturn(w, "Plan", plan)
+			return
+		}
+
+		status, err := wpacfg.ReconfigureAP(r.Context(), apCfg)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "status", apPayload(w, status))
+	}
+
+	// handle /ap/block and /ap/unblock POSTs json in the form of
+	// iotwifi.APClient, only the mac is used
+	apBlockHandler := func(block bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var client iotwifi.APClient
+			if err := marshallPost(w, r, &client); err != nil {
+				return
+			}
+
+			log.Info("ap block handler", "mac", client.Mac, "block", block)
+
+			aclFunc := wpacfg.UnblockClient
+			if block {
+				aclFunc = wpacfg.BlockClient
+			}
+
+			if err := aclFunc(r.Context(), client.Mac); err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			apiPayloadReturn(w, "ACL updated", client.Mac)
+		}
+	}
+
+	// handle /ap/up and /ap/down POSTs, the new AP status is returned
+	apStateHandler := func(up bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.Info("ap state handler", "up", up)
+
+			stateFunc := wpacfg.DisableAP
+			if up {
+				stateFunc = wpacfg.EnableAP
+			}
+
+			if err := stateFunc(r.Context()); err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			status, err := wpacfg.APStatus(r.Context())
+			if err != nil {
+				retError(w, err)
+				return
+			}
+
+			apiPayloadReturn(w, "status", apPayload(w, status))
+		}
+	}
+
+	// handle /router GETs
+	routerStatusHandler := func(w http.ResponseWriter, r *http.Request) {
+		status, err := wpacfg.RouterStatus(r.Context())
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Router", status)
+	}
+
+	// handle /router/enable and /router/disable POSTs, the new router
+	// status is returned
+	routerStateHandler := func(enable bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.Info("router state handler", "enable", enable)
+
+			stateFunc := wpacfg.DisableRouter
+			if enable {
+				stateFunc = wpacfg.EnableRouter
+			}
+
+			if err := stateFunc(r.Context()); err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			routerStatusHandler(w, r)
+		}
 	}
 
 	// handle /status GETs
 	statusHandler := func(w http.ResponseWriter, r *http.Request) {
 
-		status, err := wpacfg.Status()
+		status, err := stationStatus(w, r, provisioner)
 		if err != nil {
-			blog.Error(err.Error())
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
 			return
 		}
 
 		apiPayloadReturn(w, "status", status)
 	}
 
-	// handle /connect POSTs json in the form of iotwifi.WpaConnect
-	connectHandler := func(w http.ResponseWriter, r *http.Request) {
-		var creds iotwifi.WpaCredentials
-		marshallPost(w, r, &creds)
+	// connect connects p with creds and returns the connection
+	connect := func(w http.ResponseWriter, r *http.Request, p iotwifi.Provisioner, creds iotwifi.WpaCredentials) {
+		if dryRun(r) {
+			// only wpa_supplicant is driven by commands a plan can show
+			wpa, ok := p.(*iotwifi.WpaCfg)
+			if !ok {
+				retError(w, fmt.Errorf("%w: dry_run is not supported with NetworkManager", iotwifi.ErrInvalid))
+				return
+			}
 
-		blog.Info("Connect Handler Got: ssid:|%s| psk:|%s|", creds.Ssid, creds.Psk)
+			plan, err := wpa.PlanConnect(r.Context(), creds)
+			if err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
 
-		connection, err := wpacfg.ConnectNetwork(creds)
-		if err != nil {
-			blog.Error(err.Error())
+			apiPayloadReturn(w, "Plan", plan)
 			return
 		}
 
+		connection, err := p.ConnectNetwork(r.Context(), creds)
+
 		apiReturn := &ApiReturn{
 			Status:  "OK",
 			Message: "Connection",
 			Payload: connection,
 		}
 
+		// failed connections still carry the connection state
+		status := http.StatusOK
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			apiReturn.Status = "FAIL"
+			apiReturn.Message = err.Error()
+			if isV2(w) {
+				apiErr := iotwifi.ConnectError(connection, err)
+				apiReturn.Error = &apiErr
+				status = apiErr.Status
+			}
+		}
+
 		ret, err := json.Marshal(apiReturn)
 		if err != nil {
 			retError(w, err)
@@ -140,86 +607,1800 @@ func main() {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		w.Write(ret)
 	}
 
-	// scan for wifi networks
-	scanHandler := func(w http.ResponseWriter, r *http.Request) {
-		blog.Info("Got Scan")
-		wpaNetworks, err := wpacfg.ScanNetworks()
+	// handle /connect POSTs json in the form of iotwifi.WpaConnect
+	connectHandler := func(w http.ResponseWriter, r *http.Request) {
+		var creds iotwifi.WpaCredentials
+		if err := marshallPost(w, r, &creds); err != nil {
+			return
+		}
+
+		log.Info("connect handler", "ssid", creds.Ssid, "hidden", creds.Hidden)
+
+		connect(w, r, provisioner, creds)
+	}
+
+	// handle /connect/qr POSTs json in the form of iotwifi.WifiQR, the
+	// scanned WIFI: payload
+	connectQRHandler := func(w http.ResponseWriter, r *http.Request) {
+		var qrCode iotwifi.WifiQR
+		if err := marshallPost(w, r, &qrCode); err != nil {
+			return
+		}
+
+		creds, err := iotwifi.ParseWifiQR(qrCode.Qr)
 		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
 			retError(w, err)
 			return
 		}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Networks",
-			Payload: wpaNetworks,
+		log.Info("connect qr handler", "ssid", creds.Ssid, "hidden", creds.Hidden)
+
+		connect(w, r, provisioner, creds)
+	}
+
+	// the provisioning state and its last transitions
+	stateHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "State", stateMachine.Status())
+	}
+
+	// the window of the setup AP, when it closes and why
+	apWindowHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "AP window", apWindow.Status())
+	}
+
+	// handle /ap/window/open POSTs, bringing the AP up for another window
+	apWindowOpenHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("ap window open handler")
+
+		status, err := apWindow.Open(r.Context())
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
 		}
 
-		ret, err := json.Marshal(apiReturn)
+		apiPayloadReturn(w, "AP window opened", status)
+	}
+
+	// handle /ap/qr GETs, the QR code for joining the AP as a PNG, or
+	// as text with ?format=ascii or the raw payload with ?format=text
+	apQRHandler := func(w http.ResponseWriter, r *http.Request) {
+		payload := wpacfg.APWifiQR()
+		format := r.URL.Query().Get("format")
+
+		if format == "text" {
+			apiPayloadReturn(w, "AP QR", iotwifi.WifiQR{Qr: payload})
+			return
+		}
+
+		code, err := qr.Encode(payload)
 		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
 			retError(w, err)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		if format == "ascii" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(code.ASCII()))
+			return
+		}
+
+		img, err := code.PNG(8)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
 	}
 
-	// kill the application
-	killHandler := func(w http.ResponseWriter, r *http.Request) {
-		messages <- iotwifi.CmdMessage{Id: "kill"}
+	// handle /forget POSTs json in the form of iotwifi.WpaCredentials,
+	// only the ssid is used
+	forgetHandler := func(w http.ResponseWriter, r *http.Request) {
+		var creds iotwifi.WpaCredentials
+		if err := marshallPost(w, r, &creds); err != nil {
+			return
+		}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Killing service.",
+		log.Info("forget handler", "ssid", creds.Ssid)
+
+		err := provisioner.RemoveNetwork(r.Context(), creds.Ssid)
+		if err != nil {
+			retError(w, err)
+			return
 		}
-		ret, err := json.Marshal(apiReturn)
+
+		apiPayloadReturn(w, "Forgot network", creds.Ssid)
+	}
+
+	// handle /disconnect, /reassociate and /reconnect POSTs, the new
+	// status is returned
+	stationCmdHandler := func(name string, stationCmd func(context.Context) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			log.Info("station command handler", "cmd", name)
+
+			if err := stationCmd(r.Context()); err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			status, err := stationStatus(w, r, wpacfg)
+			if err != nil {
+				retError(w, err)
+				return
+			}
+
+			apiPayloadReturn(w, name, status)
+		}
+	}
+
+	// handle /roaming POSTs json in the form of iotwifi.RoamingCfg
+	roamingHandler := func(w http.ResponseWriter, r *http.Request) {
+		var roaming iotwifi.RoamingCfg
+		if err := marshallPost(w, r, &roaming); err != nil {
+			return
+		}
+
+		log.Info("roaming handler", "ssid", roaming.Ssid, "bssid", roaming.Bssid)
+
+		if err := wpacfg.SetRoaming(r.Context(), roaming); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		status, err := stationStatus(w, r, wpacfg)
 		if err != nil {
 			retError(w, err)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		apiPayloadReturn(w, "Roaming", status)
 	}
 
-	// common log middleware for api
-	logHandler := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			staticFields := make(map[string]interface{})
-			staticFields["remote"] = r.RemoteAddr
-			staticFields["method"] = r.Method
-			staticFields["url"] = r.RequestURI
+	// handle /wps/pbc POSTs, the router's WPS button must be pressed
+	// within two minutes
+	wpsPushButtonHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("wps push button handler")
 
-			blog.Info(staticFields, "HTTP")
-			next.ServeHTTP(w, r)
-		})
+		if err := wpacfg.WPSPushButton(r.Context()); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "WPS started, press the WPS button on the router", wpacfg.Cfg().StationInterface)
 	}
 
-	// setup router and middleware
-	r := mux.NewRouter()
-	r.Use(logHandler)
+	// handle /wps/pin POSTs json in the form of iotwifi.WPSRequest, an
+	// empty pin generates one; the pin to enter on the router is returned
+	wpsPinHandler := func(w http.ResponseWriter, r *http.Request) {
+		var wps iotwifi.WPSRequest
+		if err := marshallPost(w, r, &wps); err != nil {
+			return
+		}
 
-	// set app routes
-	r.HandleFunc("/ap", apStatusHandler)
-	r.HandleFunc("/status", statusHandler)
-	r.HandleFunc("/connect", connectHandler).Methods("POST")
-	r.HandleFunc("/scan", scanHandler)
-	r.HandleFunc("/kill", killHandler)
-	http.Handle("/", r)
+		log.Info("wps pin handler", "generate", wps.Pin == "")
 
-	// CORS
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Content-Length", "X-Requested-With", "Accept", "Origin"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
+		pin, err := wpacfg.WPSPin(r.Context(), wps.Pin)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "WPS started, enter the pin on the router", iotwifi.WPSRequest{Pin: pin})
+	}
+
+	// handle /ap/wps/pbc POSTs, a device may join by pressing its WPS
+	// button within two minutes
+	apWpsPushButtonHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("ap wps push button handler")
 
-	// serve http
-	blog.Info("HTTP Listening on " + port)
-	http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(r))
+		if err := wpacfg.APWPSPushButton(r.Context()); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "AP WPS started", wpacfg.Cfg().APInterface)
+	}
+
+	// handle /ap/wps/pin POSTs json in the form of iotwifi.WPSRequest,
+	// the pin shown by the joining device
+	apWpsPinHandler := func(w http.ResponseWriter, r *http.Request) {
+		var wps iotwifi.WPSRequest
+		if err := marshallPost(w, r, &wps); err != nil {
+			return
+		}
 
+		log.Info("ap wps pin handler")
+
+		if err := wpacfg.APWPSPin(r.Context(), wps.Pin); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "AP WPS started", wpacfg.Cfg().APInterface)
+	}
+
+	// handle /country GETs and POSTs json in the form of iotwifi.CountryStatus,
+	// only the country is used
+	countryHandler := func(w http.ResponseWriter, r *http.Request) {
+		var country iotwifi.CountryStatus
+		var err error
+
+		if r.Method == http.MethodPost {
+			if err := marshallPost(w, r, &country); err != nil {
+				return
+			}
+
+			log.Info("country handler", "country", country.Country)
+
+			country, err = wpacfg.SetCountry(r.Context(), country.Country)
+		} else {
+			country, err = wpacfg.Country(r.Context())
+		}
+
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Country", country)
+	}
+
+	// scan for wifi networks, answered from the cache unless ?fresh=true;
+	// ?ssid= probes for a hidden network, ?passive=, ?freq=, ?dfs= and
+	// ?duration= tune the scan
+	scanHandler := func(w http.ResponseWriter, r *http.Request) {
+		fresh := r.URL.Query().Get("fresh") == "true"
+		opts, err := scanOptions(r)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		log.Info("scan handler", "fresh", fresh, "ssid", opts.Ssid, "passive", opts.Passive, "dfs", opts.Dfs)
+
+		var results iotwifi.ScanResults
+		if !opts.IsZero() {
+			// scans with options are made directly, never cached
+			results.Networks, err = wpacfg.ScanWith(r.Context(), opts)
+			results.Time = time.Now()
+		} else {
+			results, err = scanManager.Results(r.Context(), fresh)
+		}
+
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiReturn := &ApiReturn{
+			Status:  "OK",
+			Message: "Networks",
+			Payload: scanPayload(w, results),
+		}
+
+		ret, err := json.Marshal(apiReturn)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ret)
+	}
+
+	// list configured wifi networks
+	networksHandler := func(w http.ResponseWriter, r *http.Request) {
+		networks, err := provisioner.ListConfiguredNetworks(r.Context())
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Configured networks", networksPayload(w, networks))
+	}
+
+	// handle /networks/collect POSTs, removes the duplicate networks and
+	// the disabled ones without a profile, and returns those removed
+	collectNetworksHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("collect networks handler")
+
+		// NetworkManager keeps its own connections
+		if _, ok := provisioner.(*iotwifi.WpaCfg); !ok {
+			retError(w, fmt.Errorf("%w: collecting networks is not supported with NetworkManager", iotwifi.ErrInvalid))
+			return
+		}
+
+		removed, err := wpacfg.CollectNetworks(r.Context())
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Removed networks", networksPayload(w, removed))
+	}
+
+	// list saved connection profiles, secrets are not returned
+	profilesHandler := func(w http.ResponseWriter, r *http.Request) {
+		profiles := wpacfg.Profiles.List()
+		for i := range profiles {
+			profiles[i].Psk = ""
+			profiles[i].Password = ""
+			profiles[i].Proxy = profiles[i].Proxy.Redacted()
+		}
+
+		apiPayloadReturn(w, "Profiles", profiles)
+	}
+
+	// handle /profiles POSTs json in the form of iotwifi.Profile
+	saveProfileHandler := func(w http.ResponseWriter, r *http.Request) {
+		var profile iotwifi.Profile
+		if err := marshallPost(w, r, &profile); err != nil {
+			return
+		}
+
+		log.Info("save profile handler", "ssid", profile.Ssid, "priority", profile.Priority)
+
+		if err := wpacfg.SaveProfile(r.Context(), profile); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Saved profile", profile.Ssid)
+	}
+
+	// handle /profiles/delete POSTs json in the form of iotwifi.Profile,
+	// only the ssid is used
+	deleteProfileHandler := func(w http.ResponseWriter, r *http.Request) {
+		var profile iotwifi.Profile
+		if err := marshallPost(w, r, &profile); err != nil {
+			return
+		}
+
+		log.Info("delete profile handler", "ssid", profile.Ssid)
+
+		if err := wpacfg.DeleteProfile(r.Context(), profile.Ssid); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Deleted profile", profile.Ssid)
+	}
+
+	// handle /profiles/export POSTs json in the form of
+	// iotwifi.ProfileExport, returns the saved networks as a bundle
+	exportProfilesHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.ProfileExport
+		if r.ContentLength != 0 {
+			if err := marshallPost(w, r, &req); err != nil {
+				return
+			}
+		}
+
+		log.Info("export profiles handler", "encrypted", req.Passphrase != "")
+
+		// in plain only to local administration
+		bundle, err := wpacfg.ExportProfiles(req.Passphrase, fromSocket(r))
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Profile bundle", bundle)
+	}
+
+	// handle /profiles/import POSTs json in the form of
+	// iotwifi.ProfileImport, saves the networks of a bundle
+	importProfilesHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.ProfileImport
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("import profiles handler", "device_id", req.Bundle.DeviceId, "ssids", len(req.Bundle.Ssids), "replace", req.Replace)
+
+		result, err := wpacfg.ImportProfiles(r.Context(), req)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Imported profiles", result)
+	}
+
+	// link state of the station radios and the AP interface
+	interfacesHandler := func(w http.ResponseWriter, r *http.Request) {
+		links := []netif.Link{}
+		for _, name := range append(interfaces.Names(), wpacfg.Cfg().APInterface) {
+			link, err := netif.LinkByName(name)
+			if err != nil {
+				retError(w, err)
+				return
+			}
+			links = append(links, link)
+		}
+
+		apiPayloadReturn(w, "Interfaces", links)
+	}
+
+	// radio returns the station radio named in the url, failing the
+	// request if there is none
+	radio := func(w http.ResponseWriter, r *http.Request) (*iotwifi.WpaCfg, bool) {
+		wpa, err := interfaces.Get(mux.Vars(r)["iface"])
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return nil, false
+		}
+
+		return wpa, true
+	}
+
+	// handle /interfaces/{iface}/status GETs
+	radioStatusHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		status, err := stationStatus(w, r, wpa)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "status", status)
+	}
+
+	// handle /interfaces/{iface}/scan GETs, always a fresh scan, with the
+	// options of /scan
+	radioScanHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		opts, err := scanOptions(r)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		log.Info("scan handler", "iface", wpa.Cfg().StationInterface, "fresh", true, "passive", opts.Passive, "dfs", opts.Dfs)
+
+		networks, err := wpa.ScanWith(r.Context(), opts)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Networks", scanPayload(w, iotwifi.ScanResults{Time: time.Now(), Networks: networks}))
+	}
+
+	// handle /interfaces/{iface}/connect POSTs json in the form of
+	// iotwifi.WpaCredentials
+	radioConnectHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		var creds iotwifi.WpaCredentials
+		if err := marshallPost(w, r, &creds); err != nil {
+			return
+		}
+
+		log.Info("connect handler", "iface", wpa.Cfg().StationInterface, "ssid", creds.Ssid, "hidden", creds.Hidden)
+
+		connect(w, r, wpa, creds)
+	}
+
+	// handle /interfaces/{iface}/forget POSTs json in the form of
+	// iotwifi.WpaCredentials, only the ssid is used
+	radioForgetHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		var creds iotwifi.WpaCredentials
+		if err := marshallPost(w, r, &creds); err != nil {
+			return
+		}
+
+		log.Info("forget handler", "iface", wpa.Cfg().StationInterface, "ssid", creds.Ssid)
+
+		if err := wpa.RemoveNetwork(r.Context(), creds.Ssid); err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Forgot network", creds.Ssid)
+	}
+
+	// handle /interfaces/{iface}/networks GETs
+	radioNetworksHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		networks, err := wpa.ListConfiguredNetworks(r.Context())
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Configured networks", networksPayload(w, networks))
+	}
+
+	// handle /queue GETs, the operations running and waiting on each
+	// station interface, by interface
+	queueHandler := func(w http.ResponseWriter, r *http.Request) {
+		queues := map[string][]iotwifi.QueuedOp{}
+		for _, name := range interfaces.Names() {
+			wpa, err := interfaces.Get(name)
+			if err != nil {
+				retError(w, err)
+				return
+			}
+			queues[name] = wpa.Queue()
+		}
+
+		apiPayloadReturn(w, "Queue", queues)
+	}
+
+	// handle /interfaces/{iface}/queue GETs
+	radioQueueHandler := func(w http.ResponseWriter, r *http.Request) {
+		wpa, ok := radio(w, r)
+		if !ok {
+			return
+		}
+
+		apiPayloadReturn(w, "Queue", wpa.Queue())
+	}
+
+	// handle /bridge GETs, the bridge between the AP and the wired network
+	bridgeHandler := func(w http.ResponseWriter, r *http.Request) {
+		status, err := wpacfg.BridgeStatus()
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Bridge", status)
+	}
+
+	// handle /identity GETs, the device id and default AP credentials,
+	// the passphrase only over the API socket
+	identityHandler := func(w http.ResponseWriter, r *http.Request) {
+		identity, err := wpacfg.Identity()
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		// the default AP passphrase is only handed out over the socket,
+		// the same as a plain profile export
+		if !fromSocket(r) {
+			identity = identity.Redacted()
+		}
+
+		apiPayloadReturn(w, "Identity", identity)
+	}
+
+	// handle /history GETs, the last good connection, the AP state and
+	// the history, newest first, optionally ?type=connect&limit=20
+	historyHandler := func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				retError(w, fmt.Errorf("%w: invalid limit %q", iotwifi.ErrInvalid, v))
+				return
+			}
+			limit = n
+		}
+
+		state := wpacfg.State.State()
+		state.History = wpacfg.State.History(r.URL.Query().Get("type"), limit)
+
+		apiPayloadReturn(w, "History", state)
+	}
+
+	// handle /audit GETs, the provisioning actions newest first,
+	// optionally ?action=connect&transport=http&ssid=home&since=RFC3339&limit=20
+	auditHandler := func(w http.ResponseWriter, r *http.Request) {
+		query := iotwifi.AuditQuery{
+			Action:    r.URL.Query().Get("action"),
+			Transport: r.URL.Query().Get("transport"),
+			Ssid:      r.URL.Query().Get("ssid"),
+		}
+		if v := r.URL.Query().Get("since"); v != "" {
+			since, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				retError(w, fmt.Errorf("%w: invalid since %q, expected RFC 3339", iotwifi.ErrInvalid, v))
+				return
+			}
+			query.Since = since
+		}
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				retError(w, fmt.Errorf("%w: invalid limit %q", iotwifi.ErrInvalid, v))
+				return
+			}
+			query.Limit = n
+		}
+
+		entries, err := audit.Query(query)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Audit", entries)
+	}
+
+	// handle /operations GETs, the API requests and the commands they
+	// ran, newest first, optionally ?limit=20
+	operationsHandler := func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				retError(w, fmt.Errorf("%w: invalid limit %q", iotwifi.ErrInvalid, v))
+				return
+			}
+			limit = n
+		}
+
+		apiPayloadReturn(w, "Operations", operations.List(limit))
+	}
+
+	// handle /operations/{id} GETs, the trace of one API request
+	operationHandler := func(w http.ResponseWriter, r *http.Request) {
+		op, err := operations.Get(mux.Vars(r)["id"])
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Operation", op)
+	}
+
+	// list DHCP leases handed out on the AP
+	leasesHandler := func(w http.ResponseWriter, r *http.Request) {
+		leases, err := wpacfg.Leases()
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Leases", leases)
+	}
+
+	// handle /leases/revoke POSTs json in the form of dhcp.Lease,
+	// only the mac is used
+	revokeLeaseHandler := func(w http.ResponseWriter, r *http.Request) {
+		var lease dhcp.Lease
+		if err := marshallPost(w, r, &lease); err != nil {
+			return
+		}
+
+		log.Info("revoke lease handler", "mac", lease.Mac)
+
+		err := wpacfg.RevokeLease(r.Context(), lease.Mac)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Revoked lease", lease.Mac)
+	}
+
+	// stream wifi events as Server-Sent Events
+	eventsHandler := func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		sub, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-sub:
+				data, err := json.Marshal(ev)
+				if err != nil {
+					log.Error("request failed", "url", r.RequestURI, "error", err)
+					continue
+				}
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+				flusher.Flush()
+			}
+		}
+	}
+
+	// handle /signal GETs, ?last=N limits the history to the N most
+	// recent samples
+	signalHandler := func(w http.ResponseWriter, r *http.Request) {
+		last := 0
+		if v := r.URL.Query().Get("last"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				retError(w, fmt.Errorf("%w: invalid last %q", iotwifi.ErrInvalid, v))
+				return
+			}
+			last = n
+		}
+
+		apiPayloadReturn(w, "Signal", signalMonitor.History(last))
+	}
+
+	// handle /speedtest POSTs, runs a speed test of the station's network,
+	// and GETs with the last result
+	speedTestHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			apiPayloadReturn(w, "Speed test", speedTester.Last())
+			return
+		}
+
+		var req iotwifi.SpeedTestRequest
+		if r.ContentLength != 0 {
+			if err := marshallPost(w, r, &req); err != nil {
+				return
+			}
+		}
+
+		log.Info("speed test handler", "method", req.Method)
+
+		result, err := speedTester.Run(r.Context(), req)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Speed test", result)
+	}
+
+	// handle /survey POSTs, surveys the channels and recommends one for
+	// the AP, moving it there with apply; GETs return the last survey
+	surveyHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			apiPayloadReturn(w, "Survey", siteSurvey.Last())
+			return
+		}
+
+		var req iotwifi.SurveyRequest
+		if r.ContentLength != 0 {
+			if err := marshallPost(w, r, &req); err != nil {
+				return
+			}
+		}
+
+		log.Info("survey handler", "scans", req.Scans, "band", req.Band, "apply", req.Apply)
+
+		report, err := siteSurvey.Survey(r.Context(), req)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Survey", report)
+	}
+
+	// handle /watchlist GETs with the watched SSIDs and whether they are
+	// in range; POSTs json in the form of iotwifi.WatchEntry watch an SSID
+	watchlistHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			apiPayloadReturn(w, "Watchlist", watchlist.Status())
+			return
+		}
+
+		var entry iotwifi.WatchEntry
+		if err := marshallPost(w, r, &entry); err != nil {
+			return
+		}
+
+		log.Info("watchlist handler", "ssid", entry.Ssid, "auto_connect", entry.AutoConnect, "min_rssi", entry.MinRssi)
+
+		if err := watchlist.Add(entry); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Watchlist", watchlist.Status())
+	}
+
+	// handle /watchlist/delete POSTs json in the form of
+	// iotwifi.WatchEntry, only the ssid is used
+	deleteWatchHandler := func(w http.ResponseWriter, r *http.Request) {
+		var entry iotwifi.WatchEntry
+		if err := marshallPost(w, r, &entry); err != nil {
+			return
+		}
+
+		log.Info("delete watch handler", "ssid", entry.Ssid)
+
+		if err := watchlist.Remove(entry.Ssid); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Watchlist", watchlist.Status())
+	}
+
+	// handle /watchdog GETs with the link quality and the recoveries
+	watchdogHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Watchdog", watchdog.Status())
+	}
+
+	// handle /healthz and /readyz GETs for probes, 503 Service
+	// Unavailable when a check fails
+	healthHandler := func(ready bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			health := wpacfg.Liveness(r.Context())
+			if ready {
+				health = wpacfg.Readiness(r.Context())
+			}
+
+			apiReturn := &ApiReturn{
+				Status:  "OK",
+				Message: "Healthy",
+				Payload: health,
+			}
+			status := http.StatusOK
+			if !health.Ok {
+				apiReturn.Status = "FAIL"
+				apiReturn.Message = "Unhealthy"
+				status = http.StatusServiceUnavailable
+			}
+
+			ret, err := json.Marshal(apiReturn)
+			if err != nil {
+				retError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(ret)
+		}
+	}
+
+	// handle /connectivity GETs, checks the station connectivity now
+	connectivityHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("connectivity handler")
+
+		apiPayloadReturn(w, "Connectivity", wpacfg.CheckConnectivity(r.Context()))
+	}
+
+	// handle /reload POSTs, reloads the config and returns what changed
+	reloadHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("reload handler", "cfg", cfgUrl)
+
+		reload, err := cfgWatcher.Reload(r.Context())
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Reloaded", reload)
+	}
+
+	// recovery counters of the supervised components
+	supervisorHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Supervisor", supervisor.Counters())
+	}
+
+	// the child processes, their state, restarts and uptime
+	processesHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Processes", processes.List())
+	}
+
+	// other network managers claiming the interfaces
+	conflictsHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Conflicts", wpacfg.Conflicts(r.Context()))
+	}
+
+	// handle /conflicts/fix POSTs, writes the configuration that makes
+	// the managers leave the interfaces alone
+	fixConflictsHandler := func(w http.ResponseWriter, r *http.Request) {
+		log.Info("fix conflicts handler")
+
+		conflicts := wpacfg.Conflicts(r.Context())
+		if len(conflicts) > 0 {
+			conflicts = wpacfg.FixConflicts(r.Context(), conflicts)
+		}
+
+		apiPayloadReturn(w, "Conflicts", conflicts)
+	}
+
+	// the rfkill blocks of the wifi radios
+	rfkillHandler := func(w http.ResponseWriter, r *http.Request) {
+		blocks, err := wpacfg.Rfkill()
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Rfkill", blocks)
+	}
+
+	// handle /rfkill/block and /rfkill/unblock POSTs for the radio of
+	// iface, or every radio without one
+	rfkillStateHandler := func(block bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req iotwifi.RadioBlock
+			if err := marshallPost(w, r, &req); err != nil {
+				return
+			}
+
+			log.Info("rfkill state handler", "iface", req.Iface, "block", block)
+
+			blocks, err := wpacfg.SetRfkill(req.Iface, block)
+			if err != nil {
+				log.Error("request failed", "url", r.RequestURI, "error", err)
+				retError(w, err)
+				return
+			}
+
+			apiPayloadReturn(w, "Rfkill", blocks)
+		}
+	}
+
+	// handle /p2p/find POSTs json in the form of iotwifi.P2PFindRequest,
+	// looking for Wi-Fi Direct devices for the timeout
+	p2pFindHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.P2PFindRequest
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("p2p find handler", "timeout", req.Timeout)
+
+		peers, err := wpacfg.P2PFind(r.Context(), time.Duration(req.Timeout)*time.Second)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P peers", peers)
+	}
+
+	// the Wi-Fi Direct devices found so far
+	p2pPeersHandler := func(w http.ResponseWriter, r *http.Request) {
+		peers, err := wpacfg.P2PPeers(r.Context())
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P peers", peers)
+	}
+
+	// handle /p2p/group POSTs json in the form of iotwifi.P2PGroupRequest,
+	// starting a group this device owns
+	p2pGroupAddHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.P2PGroupRequest
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("p2p group add handler", "persistent", req.Persistent, "frequency", req.Frequency)
+
+		group, err := wpacfg.P2PGroupAdd(r.Context(), req.Persistent, req.Frequency)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P group started", group)
+	}
+
+	// handle /p2p/group/remove POSTs json in the form of
+	// iotwifi.P2PGroupRequest, only the iface is used
+	p2pGroupRemoveHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.P2PGroupRequest
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("p2p group remove handler", "iface", req.Iface)
+
+		if err := wpacfg.P2PGroupRemove(r.Context(), req.Iface); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P group removed", req.Iface)
+	}
+
+	// handle /p2p/connect POSTs json in the form of
+	// iotwifi.P2PConnectRequest; the pin to enter on the peer is returned
+	// for the display method
+	p2pConnectHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.P2PConnectRequest
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("p2p connect handler", "peer", req.Peer, "method", req.Method, "join", req.Join)
+
+		pin, err := wpacfg.P2PConnect(r.Context(), req)
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P connect started", iotwifi.WPSRequest{Pin: pin})
+	}
+
+	// handle /p2p/authorize POSTs json in the form of
+	// iotwifi.P2PConnectRequest, letting a peer join a group this device
+	// owns
+	p2pAuthorizeHandler := func(w http.ResponseWriter, r *http.Request) {
+		var req iotwifi.P2PConnectRequest
+		if err := marshallPost(w, r, &req); err != nil {
+			return
+		}
+
+		log.Info("p2p authorize handler", "iface", req.Iface, "peer", req.Peer, "method", req.Method)
+
+		if err := wpacfg.P2PAuthorize(r.Context(), req); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "P2P peer authorized", req.Iface)
+	}
+
+	// the startup checks of the container, run again
+	preflightHandler := func(w http.ResponseWriter, r *http.Request) {
+		apiPayloadReturn(w, "Preflight", wpacfg.Preflight())
+	}
+
+	// what the radios support and what of the config they do not
+	capabilitiesHandler := func(w http.ResponseWriter, r *http.Request) {
+		report, err := wpacfg.CapabilityReport(r.Context())
+		if err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		apiPayloadReturn(w, "Capabilities", report)
+	}
+
+	// everything a support ticket needs in one bundle, as JSON or a
+	// gzipped tar with ?format=tar
+	diagnosticsHandler := func(w http.ResponseWriter, r *http.Request) {
+		diag := wpacfg.Diagnostics(r.Context(), recent.Entries())
+		diag.Version = version
+
+		if r.URL.Query().Get("format") != "tar" {
+			apiPayloadReturn(w, "Diagnostics", diag)
+			return
+		}
+
+		name := fmt.Sprintf("txwifi-diagnostics-%s.tar.gz", diag.Time.Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if err := diag.WriteTar(w); err != nil {
+			log.Error("request failed", "url", r.RequestURI, "error", err)
+		}
+	}
+
+	// kill the application
+	killHandler := func(w http.ResponseWriter, r *http.Request) {
+		messages <- iotwifi.CmdMessage{Id: "kill"}
+
+		apiReturn := &ApiReturn{
+			Status:  "OK",
+			Message: "Killing service.",
+		}
+		ret, err := json.Marshal(apiReturn)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ret)
+	}
+
+	// common log middleware for api
+	logHandler := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			log.Info("HTTP", "remote", r.RemoteAddr, "method", r.Method, "url", r.RequestURI, "duration", time.Since(start))
+		})
+	}
+
+	// setup router and middleware
+	r := mux.NewRouter()
+	r.Use(logHandler)
+
+	// set app routes. The unversioned routes are the v1 API, for the apps
+	// that predate /v1; /v2 answers with the structured types and errors
+	// with a reason and an HTTP status.
+	routes := func(r *mux.Router) {
+		r.HandleFunc("/ap", apConfigHandler).Methods("POST")
+		r.HandleFunc("/ap", apStatusHandler)
+		r.HandleFunc("/ap/devices", apDevicesHandler)
+		r.HandleFunc("/ap/block", apBlockHandler(true)).Methods("POST")
+		r.HandleFunc("/ap/unblock", apBlockHandler(false)).Methods("POST")
+		r.HandleFunc("/ap/up", apStateHandler(true)).Methods("POST")
+		r.HandleFunc("/ap/down", apStateHandler(false)).Methods("POST")
+		r.HandleFunc("/ap/qr", apQRHandler)
+		r.HandleFunc("/ap/window", apWindowHandler)
+		r.HandleFunc("/ap/window/open", apWindowOpenHandler).Methods("POST")
+		r.HandleFunc("/ap/wps/pbc", apWpsPushButtonHandler).Methods("POST")
+		r.HandleFunc("/ap/wps/pin", apWpsPinHandler).Methods("POST")
+		r.HandleFunc("/router", routerStatusHandler)
+		r.HandleFunc("/router/enable", routerStateHandler(true)).Methods("POST")
+		r.HandleFunc("/router/disable", routerStateHandler(false)).Methods("POST")
+		r.HandleFunc("/status", statusHandler)
+		r.HandleFunc("/connect", connectHandler).Methods("POST")
+		r.HandleFunc("/connect/qr", connectQRHandler).Methods("POST")
+		r.HandleFunc("/forget", forgetHandler).Methods("POST")
+		r.HandleFunc("/disconnect", stationCmdHandler("Disconnected", wpacfg.Disconnect)).Methods("POST")
+		r.HandleFunc("/reassociate", stationCmdHandler("Reassociated", wpacfg.Reassociate)).Methods("POST")
+		r.HandleFunc("/reconnect", stationCmdHandler("Reconnected", wpacfg.Reconnect)).Methods("POST")
+		r.HandleFunc("/roaming", roamingHandler).Methods("POST")
+		r.HandleFunc("/wps/pbc", wpsPushButtonHandler).Methods("POST")
+		r.HandleFunc("/wps/pin", wpsPinHandler).Methods("POST")
+		r.HandleFunc("/p2p/find", p2pFindHandler).Methods("POST")
+		r.HandleFunc("/p2p/peers", p2pPeersHandler)
+		r.HandleFunc("/p2p/group", p2pGroupAddHandler).Methods("POST")
+		r.HandleFunc("/p2p/group/remove", p2pGroupRemoveHandler).Methods("POST")
+		r.HandleFunc("/p2p/connect", p2pConnectHandler).Methods("POST")
+		r.HandleFunc("/p2p/authorize", p2pAuthorizeHandler).Methods("POST")
+		r.HandleFunc("/country", countryHandler).Methods("GET", "POST")
+		r.HandleFunc("/scan", scanHandler)
+		r.HandleFunc("/networks", networksHandler)
+		r.HandleFunc("/networks/collect", collectNetworksHandler).Methods("POST")
+		r.HandleFunc("/events", eventsHandler)
+		r.HandleFunc("/profiles", saveProfileHandler).Methods("POST")
+		r.HandleFunc("/profiles", profilesHandler)
+		r.HandleFunc("/profiles/delete", deleteProfileHandler).Methods("POST")
+		r.HandleFunc("/profiles/export", exportProfilesHandler).Methods("POST")
+		r.HandleFunc("/profiles/import", importProfilesHandler).Methods("POST")
+		r.HandleFunc("/interfaces", interfacesHandler)
+		r.HandleFunc("/interfaces/{iface}/status", radioStatusHandler)
+		r.HandleFunc("/interfaces/{iface}/scan", radioScanHandler)
+		r.HandleFunc("/interfaces/{iface}/connect", radioConnectHandler).Methods("POST")
+		r.HandleFunc("/interfaces/{iface}/forget", radioForgetHandler).Methods("POST")
+		r.HandleFunc("/interfaces/{iface}/networks", radioNetworksHandler)
+		r.HandleFunc("/interfaces/{iface}/queue", radioQueueHandler)
+		r.HandleFunc("/queue", queueHandler)
+		r.HandleFunc("/bridge", bridgeHandler)
+		r.HandleFunc("/identity", identityHandler)
+		r.HandleFunc("/history", historyHandler)
+		r.HandleFunc("/state", stateHandler)
+		r.HandleFunc("/audit", auditHandler)
+		r.HandleFunc("/operations", operationsHandler)
+		r.HandleFunc("/operations/{id}", operationHandler)
+		r.HandleFunc("/leases", leasesHandler)
+		r.HandleFunc("/leases/revoke", revokeLeaseHandler).Methods("POST")
+		r.HandleFunc("/reload", reloadHandler).Methods("POST")
+		r.HandleFunc("/supervisor", supervisorHandler)
+		r.HandleFunc("/processes", processesHandler)
+		r.HandleFunc("/conflicts", conflictsHandler)
+		r.HandleFunc("/conflicts/fix", fixConflictsHandler).Methods("POST")
+		r.HandleFunc("/preflight", preflightHandler)
+		r.HandleFunc("/diagnostics", diagnosticsHandler)
+		r.HandleFunc("/capabilities", capabilitiesHandler)
+		r.HandleFunc("/rfkill", rfkillHandler)
+		r.HandleFunc("/rfkill/block", rfkillStateHandler(true)).Methods("POST")
+		r.HandleFunc("/rfkill/unblock", rfkillStateHandler(false)).Methods("POST")
+		r.HandleFunc("/signal", signalHandler)
+		r.HandleFunc("/watchdog", watchdogHandler)
+		r.HandleFunc("/speedtest", speedTestHandler).Methods("GET", "POST")
+		r.HandleFunc("/survey", surveyHandler).Methods("GET", "POST")
+		r.HandleFunc("/watchlist", watchlistHandler).Methods("GET", "POST")
+		r.HandleFunc("/watchlist/delete", deleteWatchHandler).Methods("POST")
+		r.HandleFunc("/connectivity", connectivityHandler)
+		r.HandleFunc("/kill", killHandler)
+	}
+	routes(r.PathPrefix("/v1").Subrouter())
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.Use(v2Responses)
+	routes(v2)
+	routes(r)
+
+	// probes are not versioned
+	r.HandleFunc("/healthz", healthHandler(false))
+	r.HandleFunc("/readyz", healthHandler(true))
+
+	// event counters and process state for Prometheus
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", iotwifi.MetricsContentType)
+		if err := metrics.WritePrometheus(w, processes.List(), wpacfg.Latency()); err != nil {
+			log.Error("request failed", "url", req.RequestURI, "error", err)
+		}
+	})
+
+	// the OpenAPI document of the routes, /tls included once it is added
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, req *http.Request) {
+		doc, err := apiDocument(r)
+		if err != nil {
+			log.Error("request failed", "url", req.RequestURI, "error", err)
+			retError(w, err)
+			return
+		}
+
+		ret, err := json.Marshal(doc)
+		if err != nil {
+			retError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ret)
+	})
+	r.Use(traceRequests(operations), telemetryRequests(telemetry), auditRequests(audit, log), rateLimitRequests(limiter, log))
+	http.Handle("/", r)
+
+	// CORS
+	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Content-Length", "X-Requested-With", "Accept", "Origin", "traceparent"})
+	exposedOk := handlers.ExposedHeaders([]string{iotwifi.OperationHeader})
+	originsOk := handlers.AllowedOrigins([]string{"*"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
+
+	// captive portal for phones joining the AP
+	if portalCfg := wpacfg.Cfg().CaptivePortal; portalCfg.Enabled {
+		go func() {
+			log.Info("captive portal listening", "addr", portalCfg.ListenAddr())
+			err := http.ListenAndServe(portalCfg.ListenAddr(), iotwifi.NewCaptivePortal(wpacfg.Cfg()))
+			if err != nil {
+				log.Error("captive portal failed", "addr", portalCfg.ListenAddr(), "error", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)(r),
+	}
+
+	// shut down cleanly on SIGTERM (docker stop) or interrupt
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+
+		log.Info("shutting down", "signal", sig.String())
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		systemd.Notify(systemd.Stopping)
+		server.Shutdown(shutdownCtx)
+		stop()
+
+		select {
+		case <-wifiDone:
+		case <-shutdownCtx.Done():
+			log.Error("shutdown timed out", "error", shutdownCtx.Err())
+		}
+	}()
+
+	// local administration, see cli.go, over a unix socket that file
+	// permissions protect
+	socketCfg := wpacfg.Cfg().APISocket
+	if socketCfg.Path == "" {
+		socketCfg.Path = socket
+	}
+
+	var socketListener net.Listener
+	if activatedSocket != nil {
+		socketListener = activatedSocket
+		log.Info("API socket listening", "socket", activatedSocket.Addr().String(), "activated", true)
+	} else if !socketCfg.Disabled {
+		socketListener, err = iotwifi.ListenAPISocket(socketCfg)
+		if err != nil {
+			log.Error("could not listen on socket", "socket", socketCfg.Path, "error", err)
+
+			// without tcp there would be no API at all
+			if socketCfg.DisableTCP {
+				os.Exit(1)
+			}
+		} else {
+			mode, _ := socketCfg.FileMode()
+			log.Info("API socket listening", "socket", socketCfg.Path, "mode", fmt.Sprintf("%04o", mode), "group", socketCfg.Group)
+		}
+	}
+
+	// serve http, or https if enabled, or only the socket, on the
+	// activated tcp socket if there is one
+	serve := server.ListenAndServe
+	serveTLS := func() error { return server.ListenAndServeTLS("", "") }
+	if activatedTCP != nil {
+		serve = func() error { return server.Serve(activatedTCP) }
+		serveTLS = func() error { return server.ServeTLS(activatedTCP, "", "") }
+	}
+	if socketCfg.DisableTCP && activatedTCP == nil {
+		listener := socketListener
+		socketListener = nil
+		serve = func() error { return server.Serve(listener) }
+	} else if httpsCfg := wpacfg.Cfg().HTTPS; httpsCfg.Enabled {
+		cert, err := iotwifi.LoadOrCreateCert(httpsCfg, []string{wpacfg.Cfg().HostApdCfg.Ip})
+		if err != nil {
+			log.Error("could not load certificate", "cert_file", httpsCfg.CertFile, "error", err)
+			os.Exit(1)
+		}
+
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		fingerprint := iotwifi.CertFingerprint(cert)
+
+		// let apps pin the certificate
+		r.HandleFunc("/tls", func(w http.ResponseWriter, r *http.Request) {
+			apiPayloadReturn(w, "TLS", map[string]string{"fingerprint_sha256": fingerprint})
+		})
+
+		log.Info("HTTPS listening", "port", port, "fingerprint_sha256", fingerprint)
+		serve = serveTLS
+	} else {
+		log.Info("HTTP listening", "port", port)
+	}
+
+	// the gRPC API beside the HTTP one, HTTP/2 over TLS with the same
+	// certificate, or in cleartext
+	if grpcCfg := wpacfg.Cfg().GRPC; grpcCfg.Enabled {
+		service := &iotwifi.GRPCService{
+			Wpa:     wpacfg,
+			Scans:   scanManager,
+			Bus:     events,
+			Audit:   audit,
+			Limiter: limiter,
+		}
+		grpcServer := &http.Server{
+			Addr:      grpcCfg.Addr(),
+			Handler:   grpc.NewServer(service),
+			TLSConfig: server.TLSConfig,
+			Protocols: new(http.Protocols),
+		}
+
+		serveGRPC := grpcServer.ListenAndServeTLS
+		if grpcServer.TLSConfig == nil {
+			grpcServer.Protocols.SetUnencryptedHTTP2(true)
+			serveGRPC = func(string, string) error { return grpcServer.ListenAndServe() }
+		} else {
+			grpcServer.Protocols.SetHTTP2(true)
+		}
+
+		go func() {
+			<-ctx.Done()
+			grpcServer.Close()
+		}()
+		go func() {
+			log.Info("gRPC listening", "addr", grpcCfg.Addr(), "tls", grpcServer.TLSConfig != nil)
+			if err := serveGRPC("", ""); err != http.ErrServerClosed {
+				log.Error("gRPC server stopped", "addr", grpcCfg.Addr(), "error", err)
+			}
+		}()
+	}
+
+	// the socket is served beside tcp
+	if socketListener != nil {
+		go func() {
+			if err := server.Serve(socketListener); err != http.ErrServerClosed {
+				log.Error("socket server stopped", "socket", socketCfg.Path, "error", err)
+			}
+		}()
+	}
+
+	// tell systemd once the wifi is up, and keep its watchdog fed
+	go notifySystemd(ctx, wpacfg, log)
+
+	if err := serve(); err != http.ErrServerClosed {
+		log.Error("server stopped", "port", port, "error", err)
+		os.Exit(1)
+	}
+
+	// the server closes first, wait for the rest of the shutdown
+	<-shutdownDone
+}
+
+// printAPQR prints the QR code of the AP configured in cfgUrl to stdout.
+func printAPQR(logger iotwifi.Logger, cfgUrl string) int {
+	wpacfg, err := iotwifi.NewWpaCfg(logger, cfgUrl)
+	if err != nil {
+		logCfgError(logger, cfgUrl, err)
+		return 1
+	}
+
+	code, err := qr.Encode(wpacfg.APWifiQR())
+	if err != nil {
+		logger.Error("could not encode qr code", "error", err)
+		return 1
+	}
+
+	fmt.Print(code.ASCII())
+	fmt.Println(wpacfg.Cfg().HostApdCfg.Ssid)
+
+	return 0
+}
+
+// responseRecorder keeps the start of a response, enough for the status,
+// message and a small payload of an ApiReturn.
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if room := 4096 - w.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// statusRecorder keeps the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// v2Writer marks the responses of /v2 routes, which handlers give the
+// structured types and errors of the v2 API.
+type v2Writer struct {
+	http.ResponseWriter
+}
+
+// Flush implements http.Flusher, for the event stream.
+func (w v2Writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// v2Responses marks the responses of the routes it wraps as v2.
+func v2Responses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(v2Writer{w}, r)
+	})
+}
+
+// isV2 reports whether w answers a /v2 route.
+func isV2(w http.ResponseWriter) bool {
+	_, ok := w.(v2Writer)
+	return ok
+}
+
+// dryRun reports whether r asks with ?dry_run=true for the plan of a
+// change rather than the change.
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// scanOptions reads the scan options of r, from
+// ?passive=true&freq=5260,5280&dfs=true&duration=30&ssid=.
+func scanOptions(r *http.Request) (iotwifi.ScanOptions, error) {
+	query := r.URL.Query()
+	opts := iotwifi.ScanOptions{
+		Passive: query.Get("passive") == "true",
+		Dfs:     query.Get("dfs") == "true",
+		Ssid:    query.Get("ssid"),
+	}
+
+	if v := query.Get("freq"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			freq, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return opts, fmt.Errorf("%w: invalid freq %q", iotwifi.ErrInvalid, field)
+			}
+			opts.Freqs = append(opts.Freqs, freq)
+		}
+	}
+	if v := query.Get("duration"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("%w: invalid duration %q", iotwifi.ErrInvalid, v)
+		}
+		opts.DurationSec = sec
+	}
+
+	if err := opts.Validate(); err != nil {
+		return opts, fmt.Errorf("%w: %s", iotwifi.ErrInvalid, err)
+	}
+
+	return opts, nil
+}
+
+// untracedPaths are not recorded as operations: the traces themselves,
+// the queue, polled while operations run, and the event stream, which
+// lasts as long as the client listens.
+var untracedPaths = map[string]bool{"/operations": true, "/queue": true, "/events": true}
+
+// traceRequests gives each request an operation id, returned in the
+// X-Operation-Id header, under which the commands it runs are recorded
+// in operations.
+func traceRequests(operations *iotwifi.OperationLog) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := iotwifi.NewOperationId()
+			w.Header().Set(iotwifi.OperationHeader, id)
+
+			path := apiPath(r.URL.Path)
+			if untracedPaths[path] || probePaths[path] || strings.HasPrefix(path, "/operations/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			operations.Start(id, r.Method, r.URL.Path)
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(iotwifi.WithOperation(r.Context(), id)))
+			operations.Finish(id, recorder.status)
+		})
+	}
+}
+
+// telemetryRequests records a server span for each request, a child of
+// the caller's span when it sends a traceparent header, and the duration
+// of the requests by route.
+func telemetryRequests(telemetry *iotwifi.Telemetry) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := apiPath(r.URL.Path)
+			if telemetry == nil || untracedPaths[path] || probePaths[path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			ctx := iotwifi.WithRemoteParent(r.Context(), r.Header.Get("traceparent"))
+			ctx, span := telemetry.StartSpan(ctx, r.Method+" "+route, iotwifi.SpanKindServer)
+			span.SetAttr("http.request.method", r.Method)
+			span.SetAttr("http.route", route)
+			if id := iotwifi.OperationId(ctx); id != "" {
+				span.SetAttr("txwifi.operation.id", id)
+			}
+
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			span.SetAttr("http.response.status_code", recorder.status)
+			if recorder.status >= 500 {
+				span.SetError(errors.New(http.StatusText(recorder.status)))
+			}
+			span.End()
+
+			telemetry.Observe("http.server.request.duration", "Time the API requests take.", time.Since(start), map[string]interface{}{
+				"http.request.method":       r.Method,
+				"http.route":                route,
+				"http.response.status_code": recorder.status,
+			})
+		})
+	}
+}
+
+// auditRequests records the POSTs, the requests that change something, in
+// audit: the transport and client, the route, the ssid asked for and the
+// ApiReturn status and message. Passphrases in the body are not kept.
+func auditRequests(audit *iotwifi.AuditLog, log iotwifi.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			entry := iotwifi.AuditEntry{
+				Transport: iotwifi.TransportHTTP,
+				Action:    routeAction(r),
+				Iface:     mux.Vars(r)["iface"],
+				Operation: iotwifi.OperationId(r.Context()),
+			}
+			if r.TLS != nil {
+				entry.Transport = iotwifi.TransportHTTPS
+			}
+			if fromSocket(r) {
+				entry.Transport = iotwifi.TransportSocket
+			} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				entry.Client = host
+				entry.Mac = iotwifi.NeighborMac(host)
+			}
+
+			// the body is read again by the handler
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var req struct {
+				Ssid string `json:"ssid"`
+			}
+			json.Unmarshal(body, &req)
+			entry.Ssid = req.Ssid
+
+			start := time.Now()
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+			entry.Duration = time.Since(start)
+
+			var ret ApiReturn
+			if err := json.Unmarshal(recorder.body.Bytes(), &ret); err == nil {
+				entry.Success = ret.Status == "OK"
+				entry.Message = ret.Message
+			}
+
+			if err := audit.Record(entry); err != nil {
+				log.Warn("could not write audit log", "url", r.RequestURI, "error", err)
+			}
+		})
+	}
+}
+
+// probePaths are the health probes and the metrics scrape, never rate
+// limited.
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// rateLimitRequests holds back API clients that poll or connect too often,
+// and locks out those that keep getting the password wrong, answering 429
+// with a Retry-After. Clients on the AP are told apart by MAC. Local
+// clients, over the unix socket or loopback, and probes are not limited.
+func rateLimitRequests(limiter *iotwifi.RateLimiter, log iotwifi.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if fromSocket(r) || err != nil || net.ParseIP(host).IsLoopback() || limiter.Exempt(host) || probePaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client := host
+			if mac := iotwifi.NeighborMac(host); mac != "" {
+				client = mac
+			}
+
+			action := routeAction(r)
+			connect := r.Method == http.MethodPost && (action == "connect" || action == "connect/qr")
+
+			if wait, err := limiter.Allow(client, connect); err != nil {
+				log.Warn("request limited", "url", r.RequestURI, "client", client, "error", err)
+
+				apiReturn := &ApiReturn{Status: "FAIL", Message: err.Error()}
+				if strings.HasPrefix(r.URL.Path, "/v2/") {
+					apiErr := iotwifi.NewAPIError(err)
+					apiReturn.Error = &apiErr
+				}
+				ret, _ := json.Marshal(apiReturn)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write(ret)
+				return
+			}
+
+			if !connect {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// count the connects that failed on the password
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+
+			var ret struct {
+				Payload iotwifi.WpaConnection `json:"payload"`
+			}
+			if err := json.Unmarshal(recorder.body.Bytes(), &ret); err == nil {
+				if reason := ret.Payload.Reason; reason == iotwifi.ReasonWrongPassword || reason == iotwifi.ReasonAuthFailed {
+					limiter.AuthFailed(client)
+				}
+			}
+		})
+	}
+}
+
+// fromSocket reports whether r came over the unix socket.
+func fromSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// routeAction names the route of r for the audit log and rate limits,
+// connect for /connect and for /interfaces/{iface}/connect.
+func routeAction(r *http.Request) string {
+	action := strings.TrimPrefix(r.URL.Path, "/")
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			action = strings.TrimPrefix(apiPath(template), "/")
+			action = strings.TrimPrefix(action, "interfaces/{iface}/")
+		}
+	}
+
+	return action
+}
+
+// apiPath returns path without its API version, /status for /v2/status.
+func apiPath(path string) string {
+	for _, prefix := range []string{"/v1/", "/v2/"} {
+		if strings.HasPrefix(path, prefix) {
+			return path[len(prefix)-1:]
+		}
+	}
+
+	return path
+}
+
+// logCfgError logs why the config in cfgUrl could not be used, a line
+// for each invalid field.
+func logCfgError(logger iotwifi.Logger, cfgUrl string, err error) {
+	var cfgErrs iotwifi.ConfigErrors
+	if !errors.As(err, &cfgErrs) {
+		logger.Error("could not configure wpa", "cfg", cfgUrl, "error", err)
+		return
+	}
+
+	for _, fieldErr := range cfgErrs {
+		logger.Error("invalid config", "cfg", cfgUrl, "field", fieldErr.Field, "line", fieldErr.Line, "error", fieldErr.Message)
+	}
 }
 
 // getEnv gets an environment variable or sets a default if
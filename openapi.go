@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kinokochat/txwifi/iotwifi"
+	"github.com/kinokochat/txwifi/iotwifi/dhcp"
+	"github.com/kinokochat/txwifi/iotwifi/netif"
+	"github.com/kinokochat/txwifi/iotwifi/openapi"
+	"github.com/kinokochat/txwifi/iotwifi/process"
+)
+
+// apiDoc documents a route: what it does, the query parameters, the body
+// posted and the payload of the ApiReturn.
+type apiDoc struct {
+	summary  string
+	query    []openapi.Param
+	request  interface{} // a value of the posted type
+	payload  interface{} // a value of the payload type, nil for none
+	produces string      // for routes that do not return an ApiReturn
+}
+
+// stationStatus is the payload of the station status routes.
+var stationStatus = map[string]string{}
+
+// apStatus is the payload of the AP status routes, hostapd's status and
+// the clients.
+var apStatus = map[string]interface{}{}
+
+// limitParam limits a list to its newest entries.
+var limitParam = openapi.Param{Name: "limit", Type: "integer", Description: "at most this many entries, newest first, 0 for all"}
+
+// dryRunParam asks for the iotwifi.Plan of a change rather than the change.
+var dryRunParam = openapi.Param{Name: "dry_run", Type: "boolean", Description: "return the commands and files the change would apply, without applying them"}
+
+// scanParams tune a scan, made fresh and not cached when given.
+var scanParams = []openapi.Param{
+	{Name: "passive", Type: "boolean", Description: "listen for beacons instead of probing"},
+	{Name: "freq", Type: "string", Description: "comma separated MHz to scan, all by default"},
+	{Name: "dfs", Type: "boolean", Description: "scan the 5GHz DFS (radar) channels as well"},
+	{Name: "duration", Type: "integer", Description: "seconds to wait for the results, 15 by default, 60 at most"},
+}
+
+// apiDocs document the routes, by method and path template. Routes
+// missing here are documented with a generic ApiReturn.
+var apiDocs = map[string]apiDoc{
+	"GET /status":            {summary: "Station status, as wpa_supplicant reports it", payload: stationStatus},
+	"POST /connect":          {summary: "Connect the station; a failed attempt returns FAIL with the connection and a reason; with ?dry_run=true the Plan of the wpa_supplicant requests instead", query: []openapi.Param{dryRunParam}, request: iotwifi.WpaCredentials{}, payload: iotwifi.WpaConnection{}},
+	"POST /connect/qr":       {summary: "Connect the station to the network of a scanned WIFI: QR code; with ?dry_run=true the Plan instead", query: []openapi.Param{dryRunParam}, request: iotwifi.WifiQR{}, payload: iotwifi.WpaConnection{}},
+	"POST /forget":           {summary: "Remove a saved network, only the ssid is used", request: iotwifi.WpaCredentials{}, payload: ""},
+	"POST /disconnect":       {summary: "Disconnect the station", payload: stationStatus},
+	"POST /reassociate":      {summary: "Reassociate the station", payload: stationStatus},
+	"POST /reconnect":        {summary: "Reconnect a disconnected station", payload: stationStatus},
+	"POST /roaming":          {summary: "Pin the station to a BSS or set the roaming threshold", request: iotwifi.RoamingCfg{}, payload: stationStatus},
+	"POST /wps/pbc":          {summary: "Join a router by pressing its WPS button within two minutes", payload: ""},
+	"POST /wps/pin":          {summary: "Join a router by WPS pin, an empty pin generates one", request: iotwifi.WPSRequest{}, payload: iotwifi.WPSRequest{}},
+	"POST /p2p/find":         {summary: "Look for Wi-Fi Direct devices for the timeout", request: iotwifi.P2PFindRequest{}, payload: []iotwifi.P2PPeer{}},
+	"GET /p2p/peers":         {summary: "Wi-Fi Direct devices found so far", payload: []iotwifi.P2PPeer{}},
+	"POST /p2p/group":        {summary: "Start a Wi-Fi Direct group this device owns", request: iotwifi.P2PGroupRequest{}, payload: iotwifi.P2PGroup{}},
+	"POST /p2p/group/remove": {summary: "End a Wi-Fi Direct group, only the iface is used", request: iotwifi.P2PGroupRequest{}, payload: ""},
+	"POST /p2p/connect":      {summary: "Pair with a Wi-Fi Direct device by push button or pin, the display pin is returned", request: iotwifi.P2PConnectRequest{}, payload: iotwifi.WPSRequest{}},
+	"POST /p2p/authorize":    {summary: "Let a Wi-Fi Direct device join the group on iface", request: iotwifi.P2PConnectRequest{}, payload: ""},
+	"GET /country":           {summary: "Regulatory domain", payload: iotwifi.CountryStatus{}},
+	"POST /country":          {summary: "Set the regulatory domain, only the country is used", request: iotwifi.CountryStatus{}, payload: iotwifi.CountryStatus{}},
+	"GET /scan":              {summary: "Networks in range, from the latest background scan", query: append([]openapi.Param{{Name: "fresh", Type: "boolean", Description: "scan now"}, {Name: "ssid", Type: "string", Description: "probe for this hidden network"}}, scanParams...), payload: iotwifi.ScanResults{}},
+	"GET /networks":          {summary: "Networks configured in wpa_supplicant", payload: []iotwifi.WpaConfiguredNetwork{}},
+	"POST /networks/collect": {summary: "Remove all but one network of each ssid and the disabled networks without a profile, returns those removed", payload: []iotwifi.WpaConfiguredNetwork{}},
+	"GET /events":            {summary: "Wifi events as Server-Sent Events", produces: "text/event-stream"},
+	"GET /profiles":          {summary: "Saved connection profiles, without their secrets", payload: []iotwifi.Profile{}},
+	"POST /profiles":         {summary: "Save a connection profile", request: iotwifi.Profile{}, payload: ""},
+	"POST /profiles/export":  {summary: "The saved networks with their secrets as a bundle for another device, encrypted with passphrase, which only the API socket may leave empty", request: iotwifi.ProfileExport{}, payload: iotwifi.ProfileBundle{}},
+	"POST /profiles/import":  {summary: "Save the networks of a bundle, dropping the saved networks it does not have with replace", request: iotwifi.ProfileImport{}, payload: iotwifi.ProfileImportResult{}},
+	"POST /profiles/delete":  {summary: "Delete a connection profile, only the ssid is used", request: iotwifi.Profile{}, payload: ""},
+
+	"GET /interfaces":                  {summary: "Link state of the station radios and the AP interface", payload: []netif.Link{}},
+	"GET /interfaces/{iface}/status":   {summary: "Status of a station radio", payload: stationStatus},
+	"GET /interfaces/{iface}/scan":     {summary: "Scan with a station radio, always fresh", query: scanParams, payload: iotwifi.ScanResults{}},
+	"POST /interfaces/{iface}/connect": {summary: "Connect a station radio; with ?dry_run=true the Plan instead", query: []openapi.Param{dryRunParam}, request: iotwifi.WpaCredentials{}, payload: iotwifi.WpaConnection{}},
+	"POST /interfaces/{iface}/forget":  {summary: "Remove a saved network of a station radio, only the ssid is used", request: iotwifi.WpaCredentials{}, payload: ""},
+	"GET /interfaces/{iface}/networks": {summary: "Networks configured on a station radio", payload: []iotwifi.WpaConfiguredNetwork{}},
+	"GET /interfaces/{iface}/queue":    {summary: "The operation running on a station radio, then those waiting", payload: []iotwifi.QueuedOp{}},
+	"GET /queue":                       {summary: "The operation running on each station radio, then those waiting, by interface", payload: map[string][]iotwifi.QueuedOp{}},
+
+	"GET /ap":              {summary: "AP status and clients", payload: apStatus},
+	"POST /ap":             {summary: "Change the AP settings, applied without a restart; with ?dry_run=true the Plan of the files and reload instead", query: []openapi.Param{dryRunParam}, request: iotwifi.APConfig{}, payload: apStatus},
+	"GET /ap/devices":      {summary: "Devices on the AP, merged from the associated stations, the DHCP leases and the neighbor table, with their vendor and when they were last seen", payload: []iotwifi.APDevice{}},
+	"POST /ap/block":       {summary: "Block a client from the AP, only the mac is used", request: iotwifi.APClient{}, payload: ""},
+	"POST /ap/unblock":     {summary: "Unblock a client, only the mac is used", request: iotwifi.APClient{}, payload: ""},
+	"POST /ap/up":          {summary: "Enable the AP", payload: apStatus},
+	"POST /ap/down":        {summary: "Disable the AP", payload: apStatus},
+	"GET /ap/qr":           {summary: "QR code for joining the AP, a PNG, or text with ?format=ascii, or the ApiReturn of the payload with ?format=text", query: []openapi.Param{{Name: "format", Type: "string", Description: "ascii or text"}}, produces: "image/png"},
+	"GET /ap/window":       {summary: "When the setup AP closes and why", payload: iotwifi.APWindowStatus{}},
+	"POST /ap/window/open": {summary: "Bring the setup AP up for another window", payload: iotwifi.APWindowStatus{}},
+	"POST /ap/wps/pbc":     {summary: "Let a device join the AP by pressing its WPS button", payload: ""},
+	"POST /ap/wps/pin":     {summary: "Let a device join the AP with the pin it shows", request: iotwifi.WPSRequest{}, payload: ""},
+	"GET /router":          {summary: "Router status", payload: iotwifi.RouterStatus{}},
+	"POST /router/enable":  {summary: "Share the uplink with AP clients", payload: iotwifi.RouterStatus{}},
+	"POST /router/disable": {summary: "Stop sharing the uplink", payload: iotwifi.RouterStatus{}},
+	"GET /bridge":          {summary: "Bridge between the AP and the wired network", payload: iotwifi.BridgeStatus{}},
+	"GET /leases":          {summary: "DHCP leases handed out on the AP", payload: []dhcp.Lease{}},
+	"POST /leases/revoke":  {summary: "Revoke a DHCP lease, only the mac is used", request: dhcp.Lease{}, payload: ""},
+
+	"GET /identity":          {summary: "Device id and default AP ssid, and passphrase over the API socket", payload: iotwifi.Identity{}},
+	"GET /state":             {summary: "The provisioning state (BOOT, AP_SETUP, CONNECTING, ONLINE, OFFLINE_RETRY or ERROR), when it times out and the last transitions", payload: iotwifi.MachineStatus{}},
+	"GET /history":           {summary: "Last good connection, AP state and history", query: []openapi.Param{{Name: "type", Type: "string", Description: "only entries of this type, such as connect"}, limitParam}, payload: iotwifi.NetworkState{}},
+	"GET /operations":        {summary: "API requests and the commands they ran, newest first", query: []openapi.Param{limitParam}, payload: []iotwifi.Operation{}},
+	"GET /operations/{id}":   {summary: "The commands an API request ran, by the X-Operation-Id of its response", payload: iotwifi.Operation{}},
+	"GET /audit":             {summary: "Provisioning actions and who made them", query: []openapi.Param{{Name: "action", Type: "string"}, {Name: "transport", Type: "string"}, {Name: "ssid", Type: "string"}, {Name: "since", Type: "string", Description: "RFC 3339"}, limitParam}, payload: []iotwifi.AuditEntry{}},
+	"POST /reload":           {summary: "Reload the config, returns what changed", payload: iotwifi.CfgReload{}},
+	"GET /supervisor":        {summary: "Recovery counters of the supervised components", payload: map[string]iotwifi.RecoveryCounter{}},
+	"GET /processes":         {summary: "The hostapd, dnsmasq and wpa_supplicant children, their state, restarts and uptime", payload: []process.Status{}},
+	"GET /conflicts":         {summary: "Other network managers claiming the wireless interfaces, with remediation hints", payload: []iotwifi.Conflict{}},
+	"POST /conflicts/fix":    {summary: "Write the configuration that makes the other network managers leave the interfaces alone", payload: []iotwifi.Conflict{}},
+	"GET /rfkill":            {summary: "The rfkill blocks of the radios of the wifi interfaces", payload: []iotwifi.RadioBlock{}},
+	"POST /rfkill/block":     {summary: "Soft block the radio of iface, or of every wifi interface", request: iotwifi.RadioBlock{}, payload: []iotwifi.RadioBlock{}},
+	"POST /rfkill/unblock":   {summary: "Soft unblock the radio of iface, or of every wifi interface", request: iotwifi.RadioBlock{}, payload: []iotwifi.RadioBlock{}},
+	"GET /preflight":         {summary: "Check the capabilities, devices, network namespace and socket directories txwifi needs", payload: iotwifi.PreflightReport{}},
+	"GET /capabilities":      {summary: "What the radios support: AP and station at once, bands, channels, standards and AP stations, and what of the config they do not", payload: iotwifi.CapabilityReport{}},
+	"GET /diagnostics":       {summary: "Interface, wpa_supplicant, hostapd, driver and kernel state, the leases and recent log entries, for support tickets; a gzipped tar with ?format=tar", query: []openapi.Param{{Name: "format", Type: "string", Description: "tar"}}, payload: iotwifi.Diagnostics{}},
+	"GET /speedtest":         {summary: "The result of the last speed test, null if none ran", payload: iotwifi.SpeedTestResult{}},
+	"GET /survey":            {summary: "The last site survey, null if none ran", payload: iotwifi.SurveyReport{}},
+	"POST /survey":           {summary: "Survey how busy each channel is and recommend the least congested for the AP, moving it there with apply", request: iotwifi.SurveyRequest{}, payload: iotwifi.SurveyReport{}},
+	"GET /watchlist":         {summary: "The SSIDs the scans watch for and whether they are in range", payload: []iotwifi.WatchStatus{}},
+	"POST /watchlist":        {summary: "Watch for an SSID, connecting to it with its profile when it appears with auto_connect", request: iotwifi.WatchEntry{}, payload: []iotwifi.WatchStatus{}},
+	"POST /watchlist/delete": {summary: "Stop watching an SSID added through the API, only the ssid is used", request: iotwifi.WatchEntry{}, payload: []iotwifi.WatchStatus{}},
+	"POST /speedtest":        {summary: "Measure the throughput of the station's network with a download or iperf3", request: iotwifi.SpeedTestRequest{}, payload: iotwifi.SpeedTestResult{}},
+	"GET /watchdog":          {summary: "Station link quality and the roams and reconnects of the watchdog", payload: iotwifi.WatchdogStatus{}},
+	"GET /signal":            {summary: "Station signal history", query: []openapi.Param{{Name: "last", Type: "integer", Description: "only the most recent samples"}}, payload: []iotwifi.SignalSample{}},
+	"GET /connectivity":      {summary: "Check the station connectivity now", payload: iotwifi.Connectivity{}},
+	"GET /healthz":           {summary: "Whether the daemons run and answer on their control sockets, 503 if not", payload: iotwifi.Health{}},
+	"GET /readyz":            {summary: "The /healthz checks and whether the interfaces exist, 503 if not", payload: iotwifi.Health{}},
+	"GET /kill":              {summary: "Stop the service"},
+	"GET /tls":               {summary: "Fingerprint of the HTTPS certificate, for pinning", payload: map[string]string{}},
+	"GET /metrics":           {summary: "Event counters and child process state in the Prometheus text format", produces: "text/plain"},
+	"GET /openapi.json":      {summary: "This document", produces: "application/json"},
+}
+
+// apiDocsV2 are the payloads of the routes that differ in the v2 API.
+var apiDocsV2 = map[string]interface{}{
+	"GET /status":                      iotwifi.StationStatus{},
+	"POST /disconnect":                 iotwifi.StationStatus{},
+	"POST /reassociate":                iotwifi.StationStatus{},
+	"POST /reconnect":                  iotwifi.StationStatus{},
+	"POST /roaming":                    iotwifi.StationStatus{},
+	"GET /scan":                        iotwifi.ScanReport{},
+	"GET /networks":                    []iotwifi.ConfiguredNetwork{},
+	"POST /networks/collect":           []iotwifi.ConfiguredNetwork{},
+	"GET /interfaces/{iface}/status":   iotwifi.StationStatus{},
+	"GET /interfaces/{iface}/scan":     iotwifi.ScanReport{},
+	"GET /interfaces/{iface}/networks": []iotwifi.ConfiguredNetwork{},
+	"GET /ap":                          iotwifi.AccessPointStatus{},
+	"POST /ap":                         iotwifi.AccessPointStatus{},
+	"POST /ap/up":                      iotwifi.AccessPointStatus{},
+	"POST /ap/down":                    iotwifi.AccessPointStatus{},
+}
+
+// apiDocument documents the routes of r. The unversioned routes are
+// left out, they are the /v1 ones.
+func apiDocument(r *mux.Router) (*openapi.Document, error) {
+	doc := openapi.New("txwifi", version)
+
+	versioned := map[string]bool{}
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if path, err := route.GetPathTemplate(); err == nil && apiPath(path) != path {
+			versioned[apiPath(path)] = true
+		}
+		return nil
+	})
+
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || (apiPath(path) == path && versioned[path]) {
+			return nil
+		}
+		v2 := strings.HasPrefix(path, "/v2/")
+
+		// routes for any method are documented as GETs
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+
+		for _, method := range methods {
+			key := method + " " + apiPath(path)
+			d, ok := apiDocs[key]
+			if !ok {
+				d = apiDoc{summary: strings.TrimPrefix(path, "/")}
+			}
+			if payload, ok := apiDocsV2[key]; ok && v2 {
+				d.payload = payload
+			}
+
+			op := openapi.Operation{
+				Summary:  d.summary,
+				Query:    d.query,
+				Request:  d.request,
+				Produces: d.produces,
+			}
+			if d.produces == "" {
+				op.Response = apiReturnSchema(doc, d.payload, v2)
+			}
+
+			doc.Add(path, method, op)
+		}
+
+		return nil
+	})
+
+	return doc, err
+}
+
+// apiReturnSchema returns the schema of an ApiReturn carrying payload,
+// with the error of a failed v2 call.
+func apiReturnSchema(doc *openapi.Document, payload interface{}, v2 bool) openapi.Schema {
+	properties := map[string]interface{}{
+		"status":  openapi.Schema{"type": "string", "enum": []string{"OK", "FAIL"}},
+		"message": openapi.Schema{"type": "string"},
+		"payload": doc.Schema(payload),
+	}
+	if v2 {
+		properties["error"] = doc.Schema(iotwifi.APIError{})
+	}
+
+	return openapi.Schema{"type": "object", "properties": properties}
+}
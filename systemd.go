@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kinokochat/txwifi/iotwifi"
+	"github.com/kinokochat/txwifi/iotwifi/systemd"
+)
+
+// notifySystemd tells systemd, when it runs txwifi as a Type=notify
+// service, that txwifi is ready once the Readiness checks pass, and then
+// feeds the watchdog while the Liveness checks pass so a wedged wifi
+// stack gets restarted.
+func notifySystemd(ctx context.Context, wpa *iotwifi.WpaCfg, log iotwifi.Logger) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		health := wpa.Readiness(ctx)
+		if health.Ok {
+			break
+		}
+		systemd.Notify(systemd.Status("starting, waiting for " + failedChecks(health)))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if _, err := systemd.Notify(systemd.Ready, systemd.Status("ready")); err != nil {
+		log.Error("could not notify systemd", "error", err)
+		return
+	}
+	log.Info("notified systemd of readiness")
+
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Error("watchdog disabled", "error", err)
+	}
+	if interval == 0 {
+		return
+	}
+
+	// ping twice per interval, as systemd recommends
+	watchdog := time.NewTicker(interval / 2)
+	defer watchdog.Stop()
+
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watchdog.C:
+		}
+
+		health := wpa.Liveness(ctx)
+		if !health.Ok {
+			if healthy {
+				log.Warn("not feeding the watchdog", "failed", failedChecks(health))
+				systemd.Notify(systemd.Status("unhealthy: " + failedChecks(health)))
+			}
+			healthy = false
+			continue
+		}
+
+		if !healthy {
+			log.Info("feeding the watchdog again")
+			systemd.Notify(systemd.Status("ready"))
+		}
+		healthy = true
+		systemd.Notify(systemd.Watchdog)
+	}
+}
+
+// failedChecks describes the failed checks of health.
+func failedChecks(health iotwifi.Health) string {
+	var failed []string
+	for _, check := range health.Checks {
+		if check.Ok {
+			continue
+		}
+		name := check.Name + " " + check.Kind
+		if check.Iface != "" && check.Iface != check.Name {
+			name += " on " + check.Iface
+		}
+		failed = append(failed, name)
+	}
+
+	return strings.Join(failed, ", ")
+}